@@ -1,6 +1,8 @@
 package ast
 
 import (
+	"strings"
+
 	"github.com/codeassociates/occam2go/lexer"
 )
 
@@ -35,9 +37,14 @@ func (p *Program) TokenLiteral() string {
 
 // VarDecl represents a variable declaration: INT x:
 type VarDecl struct {
-	Token lexer.Token // the type token (INT, BYTE, BOOL)
-	Type  string      // "INT", "BYTE", "BOOL", etc.
-	Names []string    // variable names (can declare multiple: INT x, y, z:)
+	Token  lexer.Token // the type token (INT, BYTE, BOOL)
+	Type   string      // "INT", "BYTE", "BOOL", etc.
+	Names  []string    // variable names (can declare multiple: INT x, y, z:)
+	End    string      // "?" or "!" for an end of a CHAN TYPE: FOO? svr:
+	Shared bool        // SHARED FOO! cli: (used inside CLAIM)
+	Mobile bool        // MOBILE INT x: (moved, not copied, by assignment and output)
+	// The declared type, from which Type and Mobile are derived
+	TypeRef *TypeRef
 }
 
 func (v *VarDecl) statementNode()       {}
@@ -45,10 +52,13 @@ func (v *VarDecl) TokenLiteral() string { return v.Token.Literal }
 
 // ArrayDecl represents an array declaration: [5]INT arr: or [5][3]INT arr:
 type ArrayDecl struct {
-	Token lexer.Token  // the [ token
-	Sizes []Expression // array sizes (one per dimension)
-	Type  string       // element type ("INT", "BYTE", "BOOL", etc.)
-	Names []string     // variable names
+	Token  lexer.Token  // the [ token
+	Sizes  []Expression // array sizes (one per dimension; nil for MOBILE []BYTE)
+	Type   string       // element type ("INT", "BYTE", "BOOL", etc.)
+	Names  []string     // variable names
+	Mobile bool         // MOBILE [n]BYTE a: or MOBILE []BYTE a:
+	// The declared type, from which Sizes, Type and Mobile are derived
+	TypeRef *TypeRef
 }
 
 func (a *ArrayDecl) statementNode()       {}
@@ -99,13 +109,55 @@ func (s *SeqBlock) TokenLiteral() string { return s.Token.Literal }
 type ParBlock struct {
 	Token      lexer.Token // the PAR token
 	Statements []Statement
-	Replicator *Replicator // optional replicator
-	Priority   bool        // true for PRI PAR
+	Replicator *Replicator  // optional replicator
+	Priority   bool         // true for PRI PAR
+	Processors []*Processor // for PLACED PAR: the PROCESSOR each statement is placed on
+	Enroll     []string     // PAR ... ENROLL b, c: the barriers each branch is enrolled on
+}
+
+// Processor is the placement of one branch of a PLACED PAR: PROCESSOR n T8
+type Processor struct {
+	Token  lexer.Token // the PROCESSOR token
+	Number Expression  // processor number
+	Type   string      // processor type, e.g. "T8"
 }
 
 func (p *ParBlock) statementNode()       {}
 func (p *ParBlock) TokenLiteral() string { return p.Token.Literal }
 
+// Branches returns the processes of the PAR, each with the declarations
+// written before it. The body of a replicated PAR is one process, run for
+// each index.
+func (p *ParBlock) Branches() [][]Statement {
+	if p.Replicator != nil {
+		return [][]Statement{p.Statements}
+	}
+	var branches [][]Statement
+	start := 0
+	for i, stmt := range p.Statements {
+		if !IsSpecification(stmt) {
+			branches = append(branches, p.Statements[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(p.Statements) {
+		branches = append(branches, p.Statements[start:])
+	}
+	return branches
+}
+
+// IsSpecification reports whether stmt declares names rather than being a
+// process.
+func IsSpecification(stmt Statement) bool {
+	switch stmt.(type) {
+	case *VarDecl, *ArrayDecl, *ChanDecl, *TimerDecl, *BarrierDecl,
+		*Abbreviation, *RetypesDecl, *PlaceDecl, *ProcDecl, *FuncDecl,
+		*ProtocolDecl, *RecordDecl, *DataTypeDecl:
+		return true
+	}
+	return false
+}
+
 // Replicator represents a replication spec: i = start FOR count [STEP step]
 type Replicator struct {
 	Variable string     // loop variable name
@@ -130,12 +182,25 @@ type Stop struct {
 func (s *Stop) statementNode()       {}
 func (s *Stop) TokenLiteral() string { return s.Token.Literal }
 
+// Unsupported stands, when parsing permissively, for a statement that could
+// not be parsed, with the lines indented below it
+type Unsupported struct {
+	Token  lexer.Token // the statement's first token
+	Text   string      // the statement's first line of source, trimmed
+	Reason string      // the first parse error, without its position
+	Proc   string      // the name of a PROC whose declaration it is, or ""
+}
+
+func (u *Unsupported) statementNode()       {}
+func (u *Unsupported) TokenLiteral() string { return u.Token.Literal }
+
 // ProcDecl represents a procedure declaration
 type ProcDecl struct {
 	Token  lexer.Token // the PROC token
 	Name   string
 	Params []ProcParam
 	Body   []Statement // local declarations + body process
+	Entry  bool        // preceded by a --#PRAGMA ENTRY comment
 }
 
 func (p *ProcDecl) statementNode()       {}
@@ -150,15 +215,22 @@ type ProcParam struct {
 	ChanArrayDims int   // number of [] dimensions for []CHAN, [][]CHAN, etc. (0 = not a chan array)
 	OpenArrayDims int   // number of [] dimensions for []TYPE, [][]TYPE, etc. (0 = not an open array)
 	ChanElemType string // element type when IsChan (e.g., "INT")
-	ChanDir      string // "?" for input, "!" for output, "" for bidirectional
+	ChanDir      string // "?" for input, "!" for output, "" for bidirectional; also the end of a CHAN TYPE param
 	ArraySize    string // non-empty for fixed-size array params like [2]INT
+	Shared       bool   // SHARED CHAN TYPE end or SHARED channel
+	Mobile       bool   // MOBILE data parameter: MOBILE []BYTE data
+	// The declared type, from which the flattened fields above are derived
+	// (see NewParam)
+	TypeRef *TypeRef
 }
 
 // ProcCall represents a procedure call
 type ProcCall struct {
-	Token lexer.Token // the procedure name token
-	Name  string
-	Args  []Expression
+	Token    lexer.Token // the procedure name token
+	Name     string
+	Args     []Expression
+	ArgDirs  []string // per argument, a "?" or "!" direction annotation written after it, or ""
+	NoParens bool     // written as a bare name, e.g. "tick" rather than "tick ()"
 }
 
 func (p *ProcCall) statementNode()       {}
@@ -167,16 +239,25 @@ func (p *ProcCall) TokenLiteral() string { return p.Token.Literal }
 // FuncDecl represents a function declaration (single or multi-result)
 type FuncDecl struct {
 	Token       lexer.Token    // the return type token
-	ReturnTypes []string       // return types: ["INT"], ["INT", "INT"], etc.
+	ReturnTypes []string       // return types: ["INT"], ["INT", "INT"], ["[]INT"], ["POINT"], etc.
+	Results     []*TypeRef     // the result types, from which ReturnTypes are derived
 	Name        string
 	Params      []ProcParam
 	Body        []Statement    // local decls + body statements (VALOF form), empty for IS form
 	ResultExprs []Expression   // return expressions (from IS or RESULT)
+	Asserts     []*Assert      // "--#ASSERT" examples in the comments just above
 }
 
 func (f *FuncDecl) statementNode()       {}
 func (f *FuncDecl) TokenLiteral() string { return f.Token.Literal }
 
+// Assert is a "--#ASSERT expr" comment example, e.g. "--#ASSERT square(3) = 9",
+// used to generate Go tests for the FUNCTION it precedes.
+type Assert struct {
+	Text string     // the expression as written
+	Expr Expression // the parsed boolean expression
+}
+
 // FuncCall represents a function call expression
 type FuncCall struct {
 	Token lexer.Token // the function name token
@@ -197,6 +278,49 @@ type WhileLoop struct {
 func (w *WhileLoop) statementNode()       {}
 func (w *WhileLoop) TokenLiteral() string { return w.Token.Literal }
 
+// ClaimBlock represents CLAIM name followed by an indented process, which
+// has name, a SHARED end of a CHAN TYPE or a SHARED channel, to itself
+// while it runs
+type ClaimBlock struct {
+	Token lexer.Token // the CLAIM token
+	Name  string
+	End   string // CLAIM c! or CLAIM c?: the end of a SHARED channel claimed
+	Body  []Statement
+}
+
+func (c *ClaimBlock) statementNode()       {}
+func (c *ClaimBlock) TokenLiteral() string { return c.Token.Literal }
+
+// ForkingBlock represents FORKING followed by an indented process, which
+// ends when the process and every process it FORKed have finished
+type ForkingBlock struct {
+	Token lexer.Token // the FORKING token
+	Body  []Statement
+}
+
+func (f *ForkingBlock) statementNode()       {}
+func (f *ForkingBlock) TokenLiteral() string { return f.Token.Literal }
+
+// ForkStmt represents FORK proc(args), which starts the call running
+// alongside the rest of the enclosing FORKING block
+type ForkStmt struct {
+	Token lexer.Token // the FORK token
+	Call  *ProcCall
+}
+
+func (f *ForkStmt) statementNode()       {}
+func (f *ForkStmt) TokenLiteral() string { return f.Token.Literal }
+
+// SyncStmt represents SYNC b, which waits until every process enrolled on
+// the barrier b has reached a SYNC on it
+type SyncStmt struct {
+	Token   lexer.Token // the SYNC token
+	Barrier string
+}
+
+func (s *SyncStmt) statementNode()       {}
+func (s *SyncStmt) TokenLiteral() string { return s.Token.Literal }
+
 // IfStatement represents an IF statement
 type IfStatement struct {
 	Token      lexer.Token // the IF token
@@ -249,6 +373,17 @@ type IntegerLiteral struct {
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
 
+// RealLiteral represents a real literal: 2.5, 1.0E-6, or 3.14159(REAL32)
+// with the type decoration kept in Type ("" when undecorated)
+type RealLiteral struct {
+	Token lexer.Token
+	Value float64
+	Type  string // "REAL32", "REAL64" or ""
+}
+
+func (rl *RealLiteral) expressionNode()      {}
+func (rl *RealLiteral) TokenLiteral() string { return rl.Token.Literal }
+
 // BooleanLiteral represents TRUE or FALSE
 type BooleanLiteral struct {
 	Token lexer.Token
@@ -308,6 +443,17 @@ type TypeConversion struct {
 func (tc *TypeConversion) expressionNode()      {}
 func (tc *TypeConversion) TokenLiteral() string { return tc.Token.Literal }
 
+// MobileExpr allocates a CHAN TYPE bundle: svr, cli := MOBILE FOO, or a
+// mobile array: buf := MOBILE [n]BYTE
+type MobileExpr struct {
+	Token lexer.Token // the MOBILE token
+	Type  string      // the CHAN TYPE name, or the array's element type
+	Size  Expression  // the array size (nil for a CHAN TYPE bundle)
+}
+
+func (m *MobileExpr) expressionNode()      {}
+func (m *MobileExpr) TokenLiteral() string { return m.Token.Literal }
+
 // SizeExpr represents a SIZE expression: SIZE arr
 type SizeExpr struct {
 	Token lexer.Token // the SIZE token
@@ -336,6 +482,16 @@ type ParenExpr struct {
 func (pe *ParenExpr) expressionNode()      {}
 func (pe *ParenExpr) TokenLiteral() string { return pe.Token.Literal }
 
+// ValofExpr represents a VALOF as an expression: (VALOF process RESULT e)
+type ValofExpr struct {
+	Token  lexer.Token // the VALOF token
+	Body   []Statement // local decls + statements before RESULT
+	Result Expression
+}
+
+func (ve *ValofExpr) expressionNode()      {}
+func (ve *ValofExpr) TokenLiteral() string { return ve.Token.Literal }
+
 // IndexExpr represents an array index expression: arr[i]
 type IndexExpr struct {
 	Token lexer.Token // the [ token
@@ -352,6 +508,9 @@ type ChanDecl struct {
 	ElemType string       // the element type (INT, BYTE, etc.)
 	Names    []string     // channel names
 	Sizes    []Expression // array sizes per dimension (empty = scalar channel)
+	Shared   bool         // SHARED CHAN OF INT c: (written to inside CLAIM)
+	// The declared type, from which ElemType and Sizes are derived
+	TypeRef *TypeRef
 }
 
 func (c *ChanDecl) statementNode()       {}
@@ -378,6 +537,7 @@ type Receive struct {
 	Variable        string       // variable to receive into (simple receive)
 	VariableIndices []Expression // non-empty for c ? flags[0] or c ? grid[i][j]
 	Variables       []string     // additional variables for sequential receives (c ? x ; y)
+	Arrays          []string     // per variable (Variable, then Variables): the array of a counted "n :: arr" item, or ""; nil if none
 }
 
 func (r *Receive) statementNode()       {}
@@ -400,6 +560,9 @@ type AltBlock struct {
 	Cases      []AltCase
 	Replicator *Replicator // optional replicator
 	Priority   bool        // true for PRI ALT
+	// An extended input c ?? x outside an ALT (Token is its channel): the
+	// one case, with the extended process as its body
+	ExtendedInput bool
 }
 
 func (a *AltBlock) statementNode()       {}
@@ -412,12 +575,19 @@ type AltCase struct {
 	ChannelIndices  []Expression // non-empty for cs[i] ? x or cs[i][j] ? x in ALT
 	Variable        string       // variable to receive into
 	VariableIndices []Expression // non-empty for c ? flags[0] or c ? grid[i][j]
+	Variables       []string     // additional variables for sequential protocol inputs (c ? x ; y)
+	Arrays          []string     // per variable, as in Receive: the array of a counted "n :: arr" item, or ""; nil if none
 	Body            []Statement  // the body to execute
+	IsVariant      bool         // c ? CASE: Body is the VariantReceive of the variants, on the message received
+	Extended       bool         // c ?? x: the sender is held until Body, the extended process, ends
+	IsOutput       bool         // output guard c ! x: Body starts with the Send, made when the receiver is ready
+	IsAlt          bool         // a nested ALT, possibly replicated: Body is the AltBlock, whose alternatives are this ALT's too
 	IsTimer        bool         // true if this is a timer AFTER case
 	IsSkip         bool         // true if this is a guarded SKIP case (guard & SKIP)
 	Timer          string       // timer name (when IsTimer)
 	Deadline       Expression   // AFTER deadline expression (when IsTimer)
 	Declarations   []Statement  // scoped declarations before channel input (e.g., BYTE ch:)
+	Text           string       // source text of the guard and input, e.g. "(n < max) & in[i] ? x"
 }
 
 // TimerDecl represents a timer declaration: TIMER tim:
@@ -429,6 +599,15 @@ type TimerDecl struct {
 func (td *TimerDecl) statementNode()       {}
 func (td *TimerDecl) TokenLiteral() string { return td.Token.Literal }
 
+// BarrierDecl represents a barrier declaration: BARRIER b:
+type BarrierDecl struct {
+	Token lexer.Token // the BARRIER token
+	Names []string    // barrier names
+}
+
+func (bd *BarrierDecl) statementNode()       {}
+func (bd *BarrierDecl) TokenLiteral() string { return bd.Token.Literal }
+
 // TimerRead represents a timer read: tim ? t
 type TimerRead struct {
 	Token    lexer.Token // the ? token
@@ -444,13 +623,34 @@ type ProtocolDecl struct {
 	Token    lexer.Token       // the PROTOCOL token
 	Name     string            // protocol name
 	Kind     string            // "simple", "sequential", or "variant"
-	Types    []string          // element types (simple: len=1, sequential: len>1)
-	Variants []ProtocolVariant // only for Kind="variant"
+	Extends  string            // base PROTOCOL of PROTOCOL NAME EXTENDS BASE, or ""
+	Types    []string          // element types (simple: len=1, sequential: len>1), "INT32::[]BYTE" for counted arrays
+	Items    []*TypeRef        // the element types, from which Types are derived
+	Variants []ProtocolVariant // only for Kind="variant"; the base's come first
+}
+
+// CountedArray splits a counted array protocol type "COUNT::[]ELEM" into its
+// count and element types.
+func CountedArray(typ string) (count, elem string, ok bool) {
+	count, elem, ok = strings.Cut(typ, "::[]")
+	return count, elem, ok
+}
+
+// FixedArray splits a fixed-size array protocol type "[SIZE]ELEM" into its
+// size and element type.
+func FixedArray(typ string) (size, elem string, ok bool) {
+	if !strings.HasPrefix(typ, "[") {
+		return "", "", false
+	}
+	size, elem, ok = strings.Cut(typ[1:], "]")
+	return size, elem, ok && size != ""
 }
 
 type ProtocolVariant struct {
-	Tag   string   // tag name (e.g., "text", "quit")
-	Types []string // associated types (empty for no-payload tags)
+	Tag   string     // tag name (e.g., "text", "quit")
+	Types []string   // associated types (empty for no-payload tags)
+	Items []*TypeRef // the associated types, from which Types are derived
+	From  string     // PROTOCOL declaring the tag when inherited through EXTENDS, else ""
 }
 
 func (pd *ProtocolDecl) statementNode()       {}
@@ -465,9 +665,12 @@ type VariantReceive struct {
 }
 
 type VariantCase struct {
-	Tag       string      // variant tag name
-	Variables []string    // variables to bind payload fields
-	Body      []Statement // case body (may include scoped declarations)
+	Declarations []Statement // scoped declarations before the tag (e.g., INT n:)
+	Tag          string      // variant tag name; empty for ELSE
+	IsElse       bool        // ELSE: taken for any tag without a case of its own
+	Variables    []string    // variables to bind payload fields
+	Arrays       []string    // per variable: the array of a counted "n :: arr" item, or ""; nil if none
+	Body         []Statement // case body (may include scoped declarations)
 }
 
 func (vr *VariantReceive) statementNode()       {}
@@ -475,19 +678,34 @@ func (vr *VariantReceive) TokenLiteral() string { return vr.Token.Literal }
 
 // RecordDecl represents a record type declaration: RECORD POINT { INT x: INT y: }
 type RecordDecl struct {
-	Token  lexer.Token   // the RECORD token
-	Name   string        // record type name
-	Fields []RecordField // named fields
+	Token    lexer.Token   // the RECORD token, or DATA for DATA TYPE
+	Name     string        // record type name
+	Fields   []RecordField // named fields
+	DataType bool          // declared as DATA TYPE name RECORD rather than RECORD name
+	ChanType bool          // declared as CHAN TYPE name MOBILE RECORD: every field is a CHAN with a Dir
 }
 
 type RecordField struct {
-	Type string // "INT", "BYTE", "BOOL", "REAL"
-	Name string
+	Type   string // "INT", "BYTE", "BOOL", "REAL", a DATA TYPE, or the element type/protocol when IsChan
+	Name   string
+	IsChan bool   // CHAN OF Type field: r[name] ! x, r[name] ? x
+	Dir    string // CHAN TYPE field direction, as seen from the ? end
 }
 
 func (rd *RecordDecl) statementNode()       {}
 func (rd *RecordDecl) TokenLiteral() string { return rd.Token.Literal }
 
+// DataTypeDecl names a primitive type: DATA TYPE NAME IS TYPE:
+// (DATA TYPEs with a RECORD body are RecordDecls)
+type DataTypeDecl struct {
+	Token lexer.Token // the DATA token
+	Name  string
+	Type  string // a primitive type or another DataTypeDecl's name
+}
+
+func (d *DataTypeDecl) statementNode()       {}
+func (d *DataTypeDecl) TokenLiteral() string { return d.Token.Literal }
+
 // SliceExpr represents an array slice: [arr FROM start FOR length]
 type SliceExpr struct {
 	Token  lexer.Token // the [ token
@@ -499,15 +717,40 @@ type SliceExpr struct {
 func (se *SliceExpr) expressionNode()      {}
 func (se *SliceExpr) TokenLiteral() string { return se.Token.Literal }
 
+// PlaceDecl represents a placement declaration: PLACE x AT addr:
+type PlaceDecl struct {
+	Token   lexer.Token // the PLACE token
+	Name    string      // the variable, channel or port placed
+	Address Expression  // the address it is placed at
+}
+
+func (pd *PlaceDecl) statementNode()       {}
+func (pd *PlaceDecl) TokenLiteral() string { return pd.Token.Literal }
+
+// CountedArrayExpr represents a counted array item in a send: n :: arr
+type CountedArrayExpr struct {
+	Token lexer.Token // the :: token
+	Count Expression  // number of elements sent
+	Array Expression  // the array they are taken from
+}
+
+func (ca *CountedArrayExpr) expressionNode()      {}
+func (ca *CountedArrayExpr) TokenLiteral() string { return ca.Token.Literal }
+
 // Abbreviation represents an abbreviation: VAL INT x IS 42:, INT y IS z:, or INITIAL INT x IS 42:
 type Abbreviation struct {
 	Token         lexer.Token // VAL, INITIAL, or type token
 	IsVal         bool        // true for VAL abbreviations
 	IsInitial     bool        // true for INITIAL declarations
+	IsChan        bool        // true for CHAN abbreviations, whose Type is the element type or protocol
+	ChanDir       string      // "?" or "!" for a CHAN abbreviation restricted to one end, or ""
 	OpenArrayDims int         // number of [] dimensions (1 for []BYTE, 2 for [][2]BYTE or [][]INT, etc.)
 	Type          string      // "INT", "BYTE", "BOOL", etc.
 	Name          string      // variable name
 	Value         Expression  // the expression
+	// The declared type, from which IsChan, OpenArrayDims and Type are
+	// derived; nil for VAL name IS expr:
+	TypeRef *TypeRef
 }
 
 func (a *Abbreviation) statementNode()       {}
@@ -517,21 +760,36 @@ func (a *Abbreviation) TokenLiteral() string { return a.Token.Literal }
 type ArrayLiteral struct {
 	Token    lexer.Token  // the [ token
 	Elements []Expression // the elements
+	Type     string       // element type decoration: INT32 in [1, 2](INT32), or ""
 }
 
 func (al *ArrayLiteral) expressionNode()      {}
 func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
 
-// RetypesDecl represents a RETYPES declaration:
-// VAL INT X RETYPES X : or VAL [2]INT X RETYPES X :
+// ArrayConstructor represents a replicated array constructor, whose
+// elements are Value for each value of the replicator: [i = 0 FOR n | i * i]
+type ArrayConstructor struct {
+	Token      lexer.Token // the [ token
+	Replicator *Replicator
+	Value      Expression
+}
+
+func (ac *ArrayConstructor) expressionNode()      {}
+func (ac *ArrayConstructor) TokenLiteral() string { return ac.Token.Literal }
+
+// RetypesDecl represents a RETYPES or RESHAPES declaration, which gives the
+// bytes of Source another type or, for RESHAPES, its elements another shape:
+// VAL INT X RETYPES X :, [4]BYTE b RETYPES word : or VAL []INT f RESHAPES g :
 type RetypesDecl struct {
-	Token      lexer.Token // the VAL token
-	IsVal      bool        // always true for now (VAL ... RETYPES ...)
-	TargetType string      // "INT", "REAL32", etc.
-	IsArray    bool        // true for [n]TYPE
-	ArraySize  Expression  // array size when IsArray
-	Name       string      // target variable name
-	Source     string      // source variable name
+	Token      lexer.Token  // the VAL token, or the type or first [ token
+	IsVal      bool         // true for VAL ... RETYPES ...; otherwise Name aliases Source
+	Reshapes   bool         // true for RESHAPES
+	TargetType string       // "INT", "REAL32", a record type, etc.
+	Sizes      []Expression // array dimensions of the target, nil for an open one
+	Name       string       // target variable name
+	Source     Expression   // the value retyped: a variable, element or slice unless VAL
+	// The target type, from which TargetType and Sizes are derived
+	TypeRef *TypeRef
 }
 
 func (r *RetypesDecl) statementNode()       {}
@@ -0,0 +1,220 @@
+package ast
+
+import (
+	"strconv"
+	"strings"
+)
+
+// TypeKind says what a TypeRef describes.
+type TypeKind int
+
+const (
+	ScalarType  TypeKind = iota // a primitive type: INT, BYTE, BOOL, REAL32, ...
+	NamedType                   // a RECORD, DATA TYPE, PROTOCOL or CHAN TYPE, by name
+	ArrayType                   // [Size]Elem, or []Elem when Size is nil
+	ChanType                    // CHAN OF Elem
+	CountedType                 // Count::[]Elem, a counted array PROTOCOL item
+)
+
+// TypeRef is the structured form of an occam type as written in a
+// declaration or parameter: [4][]CHAN OF MOBILE []BYTE is an array of open
+// arrays of channels carrying mobile byte arrays.
+type TypeRef struct {
+	Kind   TypeKind
+	Name   string     // ScalarType, NamedType: the type name
+	Size   Expression // ArrayType: the size, nil for an open dimension
+	Elem   *TypeRef   // ArrayType, ChanType, CountedType: the element type
+	Count  *TypeRef   // CountedType: the type of the count
+	Mobile bool       // MOBILE data
+}
+
+// Scalar returns the primitive type name (INT, BYTE, ...).
+func Scalar(name string) *TypeRef {
+	return &TypeRef{Kind: ScalarType, Name: name}
+}
+
+// Named returns the declared type name (a RECORD, DATA TYPE, PROTOCOL or
+// CHAN TYPE).
+func Named(name string) *TypeRef {
+	return &TypeRef{Kind: NamedType, Name: name}
+}
+
+// ArrayOf returns [size]elem, or []elem if size is nil.
+func ArrayOf(size Expression, elem *TypeRef) *TypeRef {
+	return &TypeRef{Kind: ArrayType, Size: size, Elem: elem}
+}
+
+// ArrayOfSizes returns an array of elem with a dimension of each of sizes,
+// the first outermost: [2][3]INT for sizes 2 and 3.
+func ArrayOfSizes(sizes []Expression, elem *TypeRef) *TypeRef {
+	for i := len(sizes) - 1; i >= 0; i-- {
+		elem = ArrayOf(sizes[i], elem)
+	}
+	return elem
+}
+
+// CountedOf returns count::[]elem.
+func CountedOf(count, elem *TypeRef) *TypeRef {
+	return &TypeRef{Kind: CountedType, Count: count, Elem: elem}
+}
+
+// ChanOf returns CHAN OF elem.
+func ChanOf(elem *TypeRef) *TypeRef {
+	return &TypeRef{Kind: ChanType, Elem: elem}
+}
+
+// Dims returns the number of array dimensions of t and the type of the
+// elements inside them, which is t itself if t is not an array (0 and nil
+// if t is nil, as for an untyped VAL abbreviation).
+func (t *TypeRef) Dims() (int, *TypeRef) {
+	dims := 0
+	for t != nil && t.Kind == ArrayType {
+		dims++
+		t = t.Elem
+	}
+	return dims, t
+}
+
+// ChanElem returns the type carried by t, a channel or an array of
+// channels, and the number of array dimensions, or nil if t is neither.
+func (t *TypeRef) ChanElem() (*TypeRef, int) {
+	dims, elem := t.Dims()
+	if elem == nil || elem.Kind != ChanType {
+		return nil, 0
+	}
+	return elem.Elem, dims
+}
+
+// IsDataArray reports whether t is an array of data, rather than a single
+// value or an array of channels.
+func (t *TypeRef) IsDataArray() bool {
+	dims, elem := t.Dims()
+	return dims > 0 && elem.Kind != ChanType
+}
+
+// Sizes returns the size of each array dimension of t, nil for open ones.
+func (t *TypeRef) Sizes() []Expression {
+	var sizes []Expression
+	for ; t.Kind == ArrayType; t = t.Elem {
+		sizes = append(sizes, t.Size)
+	}
+	return sizes
+}
+
+// IsData reports whether t is a single value of a primitive or named type,
+// rather than an array or channel.
+func (t *TypeRef) IsData() bool {
+	return t != nil && (t.Kind == ScalarType || t.Kind == NamedType)
+}
+
+// FlatName returns the name of t as the flattened string type fields hold
+// it: the type name, with [] for each array dimension (CHAN MOBILE []BYTE
+// carries "[]BYTE", and []INT FUNCTION returns "[]INT").
+func (t *TypeRef) FlatName() string {
+	switch t.Kind {
+	case ArrayType:
+		return "[]" + t.Elem.FlatName()
+	case CountedType:
+		return t.Count.Name + "::[]" + t.Elem.FlatName()
+	}
+	return t.Name
+}
+
+// ItemName returns the name of the PROTOCOL item t as ProtocolDecl.Types
+// holds it: like FlatName, but keeping a fixed size, as in "[4]BYTE".
+func (t *TypeRef) ItemName() string {
+	if t.Kind == ArrayType && t.Size != nil {
+		return "[" + sizeText(t.Size) + "]" + t.Elem.ItemName()
+	}
+	return t.FlatName()
+}
+
+// NewParam returns a parameter named name of type t, with the flattened type
+// fields (Type, IsChan, ChanElemType, OpenArrayDims, ...) derived from t.
+func NewParam(name string, isVal bool, t *TypeRef) ProcParam {
+	p := ProcParam{Name: name, IsVal: isVal, TypeRef: t, Mobile: t.Mobile}
+	dims, elem := t.Dims()
+	if elem.Kind == ChanType {
+		p.IsChan = true
+		p.ChanArrayDims = dims
+		p.ChanElemType = elem.Elem.FlatName()
+	} else {
+		p.Type = elem.Name
+		if dims > 0 && t.Size == nil {
+			p.OpenArrayDims = dims
+		}
+	}
+	if dims > 0 && t.Size != nil {
+		// [n]TYPE keeps n; [n][m]TYPE is otherwise treated like [][]TYPE
+		p.ArraySize = sizeText(t.Size)
+		if dims > 1 && !p.IsChan {
+			p.OpenArrayDims = dims
+		}
+	}
+	return p
+}
+
+// sizeText returns the text of a fixed array size in a parameter type.
+func sizeText(size Expression) string {
+	return ExprText(size)
+}
+
+// ExprText returns e as it is written in occam, with integer literals in
+// decimal, for the constant expressions that array sizes are. Other
+// expressions are shown by their first token.
+func ExprText(e Expression) string {
+	switch e := e.(type) {
+	case *IntegerLiteral:
+		return strconv.FormatInt(e.Value, 10)
+	case *Identifier:
+		return e.Value
+	case *ByteLiteral:
+		return "'" + e.Token.Literal + "'"
+	case *BooleanLiteral:
+		if e.Value {
+			return "TRUE"
+		}
+		return "FALSE"
+	case *BinaryExpr:
+		return operandText(e.Left) + " " + e.Operator + " " + operandText(e.Right)
+	case *UnaryExpr:
+		if e.Operator == "NOT" {
+			return "NOT " + operandText(e.Right)
+		}
+		return e.Operator + operandText(e.Right)
+	case *ParenExpr:
+		return "(" + ExprText(e.Expr) + ")"
+	case *SizeExpr:
+		return "SIZE " + operandText(e.Expr)
+	case *TypeConversion:
+		if e.Qualifier != "" {
+			return e.TargetType + " " + e.Qualifier + " " + operandText(e.Expr)
+		}
+		return e.TargetType + " " + operandText(e.Expr)
+	case *MostExpr:
+		if e.IsNeg {
+			return "MOSTNEG " + e.ExprType
+		}
+		return "MOSTPOS " + e.ExprType
+	case *IndexExpr:
+		return ExprText(e.Left) + "[" + ExprText(e.Index) + "]"
+	case *FuncCall:
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = ExprText(arg)
+		}
+		return e.Name + "(" + strings.Join(args, ", ") + ")"
+	case nil:
+		return ""
+	}
+	return e.TokenLiteral()
+}
+
+// operandText returns ExprText of an operand, parenthesized if compound.
+func operandText(e Expression) string {
+	switch e.(type) {
+	case *BinaryExpr, *UnaryExpr, *TypeConversion, *SizeExpr:
+		return "(" + ExprText(e) + ")"
+	}
+	return ExprText(e)
+}
@@ -1,7 +1,11 @@
 package codegen
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/codeassociates/occam2go/ast"
@@ -21,6 +25,34 @@ type Generator struct {
 	needReflect    bool // track if we need reflect package import
 	needBoolHelper bool // track if we need _boolToInt helper
 	needTerm       bool // track if we need golang.org/x/term package import
+	needIo         bool // track if we need io package import
+	needAltAfter   bool // track if we need _altAfter helper
+	needBytes      bool // track if we need bytes package import
+	needSlices     bool // track if we need slices package import
+	needSliceEqual bool // track if we need _sliceEqual helper
+	needRuntime    bool // track if we need runtime package import
+	needPriSelect  bool // track if we need _priSelect helper
+	needBarrier    bool // track if we need _barrier helper type
+	needChanClaim  bool // track if we need _chanClaim helper
+	needRendezvous bool // track if we need the _sent and _received helpers
+	needStrconv    bool // track if we need strconv package import
+	needJSON       bool // track if we need encoding/json package import
+	needChecked    bool // track if we need _addChecked etc. helpers
+	needConvCheck  bool // track if we need _intChecked helper
+	needBounds     bool // track if we need _index and _sliceEnd helpers
+	needRetype     bool // track if we need the _retype helpers
+	needStrings    bool // track if we need strings package import
+	needUninitNaN  bool // track if we need the _uninitNaN variable
+	needTableInts  bool // track if we need _tableInts helper
+	needParRecover bool // track if we need _parRecover helper
+	needPreemptOff bool // track if we need _preemptOff helper (and os/exec)
+
+	// Conversion builtins (INTTOSTRING, ...) called and not declared by the
+	// program, whose helper functions are emitted
+	conversions map[string]bool
+	// Building-block processes (id, succ, ...) called and not declared by
+	// the program, likewise
+	cycles map[string]bool
 
 	// Track procedure signatures for proper pointer handling
 	procSigs map[string][]ast.ProcParam
@@ -30,25 +62,246 @@ type Generator struct {
 	// Protocol support
 	protocolDefs  map[string]*ast.ProtocolDecl
 	chanProtocols map[string]string // channel name → protocol name
-	tmpCounter    int               // for unique temp variable names
+	tmpCounter    int               // for unique temp variable names (scoped per function)
 
 	// Record support
 	recordDefs map[string]*ast.RecordDecl
 	recordVars map[string]string // variable name → record type name
 
+	// DATA TYPE name → the primitive type or DATA TYPE it names
+	dataTypes map[string]string
+
 	// Channel element type tracking (for ALT guard codegen)
 	chanElemTypes map[string]string // channel name → Go element type
 
+	// One-dimensional arrays, by name → occam element type (for = and <>)
+	arrayVars map[string]string
+	// Arrays of more than one dimension, by name → element type and dimensions
+	multiArrays map[string]multiArray
+	// Scalar BYTE variables, abbreviations and params (for CASE labels)
+	byteVars map[string]bool
+
+	// Directed channel params passed on to undirected CHAN params, which
+	// are generated as plain chan since Go cannot convert <-chan to chan
+	bidiChans map[*ast.ProcParam]bool
+
 	// Bool variable tracking (for type conversion codegen)
 	boolVars map[string]bool
+	// Channels (and channel arrays) carrying BOOL, for WithTypeMap conversions
+	boolChans map[string]bool
+	// MOBILE variables, mapped to the Go zero value left behind when they
+	// are moved by assignment or output
+	mobileVars map[string]string
+	// Result types of FUNCTIONs, by name
+	funcResults map[string][]*ast.TypeRef
+
+	// Go type for each occam scalar type (see WithTypeMap)
+	goTypes map[string]string
 
 	// Nesting level: 0 = package level, >0 = inside a function
 	nestingLevel int
 
+	// Nested PROCs and FUNCTIONs declared as function variables before
+	// their closures, which are assigned to them (declareForwardRoutines)
+	forwardRoutines map[ast.Statement]bool
+
 	// RETYPES parameter renames: when a RETYPES declaration shadows a
 	// parameter (e.g. VAL INT X RETYPES X :), the parameter is renamed
 	// in the signature so := can create a new variable with the original name.
 	retypesRenames map[string]string
+
+	// Non-VAL RETYPES and RESHAPES copy their source, so the copy is
+	// written back after the process the declaration scopes over;
+	// stmtDepth is the nesting of the statement being generated
+	retypeViews []retypeView
+	stmtDepth   int
+
+	// Generated function size accounting (see WithMaxFuncSize)
+	maxFuncSize int
+	outline     bool
+	// Array literals with more elements than tableThreshold are laid out
+	// over several lines, or as encoded data (WithTableThreshold, WithTableData)
+	tableThreshold int
+	tableData      bool
+	funcFrames  []funcFrame
+	warnings    []string
+	errors      []string
+
+	// Variant receive checking (see WithStrict)
+	strict      bool
+
+	// Poison propagation (see WithPoison): poisonProc is the PROC whose
+	// function a generated return would leave, nil where a return would
+	// only leave a goroutine; poisonReturns counts the returns generated.
+	poisonTag     string
+	poisonProc    *ast.ProcDecl
+	poisonReturns int
+
+	// Report PLACED PAR and PLACE as errors (see WithRejectPlacement)
+	rejectPlacement bool
+
+	// Run on one thread with ALTs taking the first ready case (WithDeterministic)
+	deterministic bool
+
+	// Stop on overflow of +, - and * (WithCheckedArith)
+	checkedArith bool
+	// Stop on subscripts and slices out of range (WithBoundsCheck)
+	boundsCheck bool
+	// Report PROC goroutines still running when the entry PROC ends (WithLeakCheck)
+	leakCheck bool
+	// Report panics in PAR branches with their occam context (WithParRecover)
+	parRecover bool
+	// Fill declared variables with conspicuous values (WithPoisonUninit)
+	poisonUninit bool
+	// Hold the sender of each message until its receiver releases it, for
+	// extended inputs (WithExtendedRendezvous)
+	rendezvous bool
+	// What PRI PAR priority becomes (WithPriPar), and, in a lower priority
+	// branch under PriParYield, the Go condition on which its loops yield
+	// ("true" for always)
+	priPar   PriPar
+	priYield string
+	// Wrap PROCs with an error channel as Go functions returning an error
+	// (WithErrorWrappers), and the index of that channel in each one's params
+	errorWrappers bool
+	errorChans    map[*ast.ProcDecl]int
+
+	// Optimization level and per-pass overrides (WithOptLevel, WithPass)
+	optLevel int
+	passes   map[string]bool
+
+	// FUNCTION whose body is being generated, in which STOP panics since
+	// the Go function must return or panic
+	stopFunc string
+
+	// WaitGroup of the innermost FORKING block in the PROC being generated,
+	// "" outside one
+	forking string
+
+	// Reusable timers for ALT timeouts in loops, by deadline expression
+	altTimers map[ast.Expression]string
+
+	// Entry point PROC requested by WithEntry ("" = choose automatically)
+	entryName string
+
+	// Names source lines in generated messages (WithSourcePos); nil for
+	// "line N"
+	sourcePos func(line int) string
+
+	// Start of the names of generated package-level declarations (WithPrefix)
+	prefix string
+
+	// Go package to generate instead of a program (WithPackage), and the Go
+	// names of top-level PROCs and FUNCTIONs other than goIdent(name): those
+	// exported from the package, and those taken from the runtime package
+	pkg      string
+	exported map[string]string
+
+	// Call the runtime package for the course library (WithRuntime)
+	useRuntime bool
+	needOccrt  bool
+
+	// Minor version of the oldest Go release to generate for (WithGoVersion)
+	goMinor int
+
+	// Channels of ALT alternatives removed by foldAltGuards, by the ALT (or
+	// the STOP replacing it), still referenced so Go does not find them unused
+	prunedAltChans map[ast.Statement][]string
+
+	// What the last Generate translated (see Stats); skippedNodes holds the
+	// nodes already in stats.Skipped, as some are generated twice
+	stats        Stats
+	skippedNodes map[ast.Node]bool
+
+	// The API of the package the last Generate made (see Manifest)
+	manifest Manifest
+}
+
+// Stats counts what the last call to Generate translated, to estimate the
+// effort of porting a codebase and to spot constructs left out of the Go.
+type Stats struct {
+	Procs       int      // PROCs, nested ones included
+	Functions   int      // FUNCTIONs, nested ones included
+	Channels    int      // declared channels, an array of them counting once
+	ParBranches int      // processes of PAR blocks, a replicated PAR counting once
+	Alts        int      // ALTs and PRI ALTs
+	ReflectAlts []string // "line N: ..." for each ALT generated with reflect.Select
+	Protocols   int      // PROTOCOL declarations
+	Skipped     []string // constructs with no Go translation, "line N: ..." where the line is known
+	Lines       int      // lines of Go generated
+}
+
+// Manifest describes the API of a generated package (see WithPackage): its
+// exported PROCs, FUNCTIONs and protocol types, with both their occam and Go
+// names, so that binding generators and documentation tools need not parse
+// the Go.
+type Manifest struct {
+	Package   string             `json:"package"`
+	Procs     []ManifestProc     `json:"procs"`
+	Protocols []ManifestProtocol `json:"protocols"`
+}
+
+// ManifestProc is an exported PROC or FUNCTION.
+type ManifestProc struct {
+	Name    string          `json:"name"`
+	GoName  string          `json:"goName"`
+	Kind    string          `json:"kind"` // "PROC" or "FUNCTION"
+	Params  []ManifestParam `json:"params"`
+	Results []ManifestType  `json:"results,omitempty"` // of a FUNCTION
+	ErrFunc string          `json:"errFunc,omitempty"` // Go wrapper returning an error (WithErrorWrappers)
+}
+
+// ManifestParam is a parameter of a PROC or FUNCTION.
+type ManifestParam struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"` // "val", "ref" (passed by reference) or "chan"
+	ManifestType
+	Protocol  string `json:"protocol,omitempty"`  // of a channel: the PROTOCOL or type it carries
+	Direction string `json:"direction,omitempty"` // of a channel end: "in" or "out"
+}
+
+// ManifestType is an occam type and the Go type it is passed as.
+type ManifestType struct {
+	Type   string `json:"type"`
+	GoType string `json:"goType"`
+}
+
+// ManifestProtocol is a protocol type. Fields holds the Go types of the
+// message's fields F0, F1, ..., except for a simple PROTOCOL of one type
+// other than a counted array, whose messages are values of that Go type.
+type ManifestProtocol struct {
+	Name     string            `json:"name"`
+	GoName   string            `json:"goName"`
+	Kind     string            `json:"kind"` // "simple", "sequential" or "variant"
+	Extends  string            `json:"extends,omitempty"`
+	Items    []string          `json:"items,omitempty"`
+	Fields   []string          `json:"fields,omitempty"`
+	Variants []ManifestVariant `json:"variants,omitempty"`
+}
+
+// ManifestVariant is a tag of a variant protocol, whose Go type has fields
+// F0, F1, ... of types Fields.
+type ManifestVariant struct {
+	Tag    string   `json:"tag"`
+	GoName string   `json:"goName"`
+	Items  []string `json:"items,omitempty"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// funcFrame tracks the extent of a Go function being generated. Bytes of
+// nested closures that Go compiles as separate functions (nested PROCs and
+// outlined blocks) are excluded from the frame's own size.
+type funcFrame struct {
+	desc     string // e.g. "PROC foo", for warnings
+	line     int
+	start    int // builder offset of the function's first line
+	excluded int
+}
+
+// multiArray describes an array of more than one dimension.
+type multiArray struct {
+	elem string // occam element type
+	dims int
 }
 
 // Transputer intrinsic function names
@@ -70,9 +323,607 @@ var printBuiltins = map[string]bool{
 	"print.newline": true,
 }
 
+// Standard library conversion PROCs between numbers and strings, with their
+// occam signatures. They are implemented as Go helper functions (see
+// emitConversionHelpers); a PROC of the same name in the program wins.
+var conversionBuiltins = map[string][]ast.ProcParam{
+	"INTTOSTRING":    {refParam("len", "INT"), stringParam("string", false), valParam("n", "INT")},
+	"STRINGTOINT":    {refParam("error", "BOOL"), refParam("n", "INT"), stringParam("string", true)},
+	"REAL32TOSTRING": {refParam("len", "INT"), stringParam("string", false), valParam("X", "REAL32"), valParam("Ip", "INT"), valParam("Dp", "INT")},
+	"REAL64TOSTRING": {refParam("len", "INT"), stringParam("string", false), valParam("X", "REAL64"), valParam("Ip", "INT"), valParam("Dp", "INT")},
+	"STRINGTOREAL32": {refParam("error", "BOOL"), refParam("X", "REAL32"), stringParam("string", true)},
+	"STRINGTOREAL64": {refParam("error", "BOOL"), refParam("X", "REAL64"), stringParam("string", true)},
+}
+
+// cycleProcs are the building-block processes of the demo_cycles library,
+// with their occam signatures, and consume, a sink that inputs and discards
+// (not the consume of commstime, which times n.loops inputs and reports on
+// a BYTE channel). They are implemented, by the cycle-builtins pass, as Go
+// helper functions (see emitCycleHelpers) that run their parallel inputs
+// and outputs with a select rather than goroutines; a PROC of the same name
+// in the program wins.
+var cycleProcs = map[string][]ast.ProcParam{
+	"id":      {intChanParam("in", "?"), intChanParam("out", "!")},
+	"succ":    {intChanParam("in", "?"), intChanParam("out", "!")},
+	"tail":    {intChanParam("in", "?"), intChanParam("out", "!")},
+	"prefix":  {valParam("n", "INT"), intChanParam("in", "?"), intChanParam("out", "!")},
+	"plus":    {intChanParam("in.1", "?"), intChanParam("in.2", "?"), intChanParam("out", "!")},
+	"delta":   {intChanParam("in", "?"), intChanParam("out.1", "!"), intChanParam("out.2", "!")},
+	"consume": {intChanParam("in", "?")},
+}
+
+// CycleDecls returns declarations of the building-block processes that
+// calls go to when the program does not declare them, for checking calls
+// to them. There are none when opts turn the cycle-builtins pass off.
+func CycleDecls(opts ...Option) []ast.Statement {
+	if !New(opts...).pass("cycle-builtins") {
+		return nil
+	}
+	names := make([]string, 0, len(cycleProcs))
+	for name := range cycleProcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var decls []ast.Statement
+	for _, name := range names {
+		decls = append(decls, &ast.ProcDecl{Name: name, Params: cycleProcs[name]})
+	}
+	return decls
+}
+
+// RuntimeImport is the import path of the runtime package, which implements
+// the course library in Go (see WithRuntime).
+const RuntimeImport = "github.com/codeassociates/occam2go/runtime"
+
+// runtimeProc is a course library PROC or FUNCTION implemented by the
+// runtime package.
+type runtimeProc struct {
+	goName string
+	params []ast.ProcParam
+	result string // FUNCTION result type, "" for a PROC
+}
+
+func valParam(name, typ string) ast.ProcParam {
+	return ast.NewParam(name, true, ast.Scalar(typ))
+}
+
+func refParam(name, typ string) ast.ProcParam {
+	return ast.NewParam(name, false, ast.Scalar(typ))
+}
+
+func stringParam(name string, isVal bool) ast.ProcParam {
+	return ast.NewParam(name, isVal, ast.ArrayOf(nil, ast.Scalar("BYTE")))
+}
+
+// chanParam returns a CHAN BYTE parameter with direction dir.
+func chanParam(name, dir string) ast.ProcParam {
+	p := ast.NewParam(name, false, ast.ChanOf(ast.Scalar("BYTE")))
+	p.ChanDir = dir
+	return p
+}
+
+// intChanParam returns a CHAN INT parameter with direction dir.
+func intChanParam(name, dir string) ast.ProcParam {
+	p := ast.NewParam(name, false, ast.ChanOf(ast.Scalar("INT")))
+	p.ChanDir = dir
+	return p
+}
+
+var (
+	inParam  = chanParam("in", "?")
+	outParam = chanParam("out", "!")
+)
+
+// runtimeProcs are the course library PROCs and FUNCTIONs the runtime
+// package implements, by occam name, with their occam signatures.
+var runtimeProcs = map[string]runtimeProc{
+	"out.repeat": {"OutRepeat", []ast.ProcParam{valParam("ch", "BYTE"), valParam("n", "INT"), outParam}, ""},
+	"out.ch":     {"OutCh", []ast.ProcParam{valParam("ch", "BYTE"), valParam("field", "INT"), outParam}, ""},
+	"out.string": {"OutString", []ast.ProcParam{stringParam("s", true), valParam("field", "INT"), outParam}, ""},
+	"out.byte":   {"OutByte", []ast.ProcParam{valParam("b", "BYTE"), valParam("field", "INT"), outParam}, ""},
+	"out.int":    {"OutInt", []ast.ProcParam{valParam("n", "INT"), valParam("field", "INT"), outParam}, ""},
+	"out.hex":    {"OutHex", []ast.ProcParam{valParam("n", "INT"), valParam("field", "INT"), outParam}, ""},
+	"out.bool":   {"OutBool", []ast.ProcParam{valParam("b", "BOOL"), valParam("field", "INT"), outParam}, ""},
+	"out.yes.no": {"OutYesNo", []ast.ProcParam{valParam("b", "BOOL"), valParam("field", "INT"), outParam}, ""},
+	"flush":      {"Flush", []ast.ProcParam{outParam}, ""},
+	"black.hole": {"BlackHole", []ast.ProcParam{inParam}, ""},
+	"in.skip":    {"InSkip", []ast.ProcParam{refParam("ch", "BYTE"), inParam}, ""},
+	"in.digit":   {"InDigit", []ast.ProcParam{refParam("d", "BYTE"), inParam, outParam}, ""},
+	"in.string":  {"InString", []ast.ProcParam{stringParam("s", false), refParam("length", "INT"), valParam("max", "INT"), inParam, outParam}, ""},
+	"in.bool":    {"InBool", []ast.ProcParam{refParam("b", "BOOL"), inParam, outParam}, ""},
+	"in.byte":    {"InByte", []ast.ProcParam{refParam("b", "BYTE"), valParam("max", "INT"), inParam, outParam}, ""},
+	"in.int":     {"InInt", []ast.ProcParam{refParam("n", "INT"), valParam("max", "INT"), inParam, outParam}, ""},
+	"ask.string": {"AskString", []ast.ProcParam{stringParam("prompt", true), stringParam("s", false), refParam("length", "INT"), valParam("max", "INT"), inParam, outParam}, ""},
+	"ask.bool":   {"AskBool", []ast.ProcParam{stringParam("prompt", true), refParam("b", "BOOL"), inParam, outParam}, ""},
+	"ask.byte":   {"AskByte", []ast.ProcParam{stringParam("prompt", true), refParam("b", "BYTE"), valParam("max", "INT"), inParam, outParam}, ""},
+	"ask.int":    {"AskInt", []ast.ProcParam{stringParam("prompt", true), refParam("n", "INT"), valParam("max", "INT"), inParam, outParam}, ""},
+
+	"cursor.x.y":       {"CursorXY", []ast.ProcParam{valParam("x", "BYTE"), valParam("y", "BYTE"), outParam}, ""},
+	"cursor.up":        {"CursorUp", []ast.ProcParam{valParam("n", "BYTE"), outParam}, ""},
+	"cursor.down":      {"CursorDown", []ast.ProcParam{valParam("n", "BYTE"), outParam}, ""},
+	"cursor.right":     {"CursorRight", []ast.ProcParam{valParam("n", "BYTE"), outParam}, ""},
+	"cursor.left":      {"CursorLeft", []ast.ProcParam{valParam("n", "BYTE"), outParam}, ""},
+	"erase.eol":        {"EraseEOL", []ast.ProcParam{outParam}, ""},
+	"erase.bol":        {"EraseBOL", []ast.ProcParam{outParam}, ""},
+	"erase.line":       {"EraseLine", []ast.ProcParam{outParam}, ""},
+	"erase.eos":        {"EraseEOS", []ast.ProcParam{outParam}, ""},
+	"erase.bos":        {"EraseBOS", []ast.ProcParam{outParam}, ""},
+	"erase.screen":     {"EraseScreen", []ast.ProcParam{outParam}, ""},
+	"cursor.visible":   {"CursorVisible", []ast.ProcParam{outParam}, ""},
+	"cursor.invisible": {"CursorInvisible", []ast.ProcParam{outParam}, ""},
+
+	"make.string":    {"MakeString", []ast.ProcParam{stringParam("a", false), valParam("length", "INT")}, ""},
+	"copy.string":    {"CopyString", []ast.ProcParam{stringParam("a", true), stringParam("b", false)}, ""},
+	"equal.string":   {"EqualString", []ast.ProcParam{stringParam("a", true), stringParam("b", true)}, "BOOL"},
+	"compare.string": {"CompareString", []ast.ProcParam{stringParam("a", true), stringParam("b", true)}, "INT"},
+}
+
+// RuntimeDecls returns declarations of the PROCs and FUNCTIONs that
+// WithRuntime takes from the runtime package, for checking calls to them.
+func RuntimeDecls() []ast.Statement {
+	names := make([]string, 0, len(runtimeProcs))
+	for name := range runtimeProcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var decls []ast.Statement
+	for _, name := range names {
+		rp := runtimeProcs[name]
+		if rp.result != "" {
+			decls = append(decls, &ast.FuncDecl{Name: name, Params: rp.params, ReturnTypes: []string{rp.result}, Results: []*ast.TypeRef{ast.Scalar(rp.result)}})
+		} else {
+			decls = append(decls, &ast.ProcDecl{Name: name, Params: rp.params})
+		}
+	}
+	return decls
+}
+
+// defaultGoTypes maps the occam scalar types to Go types.
+var defaultGoTypes = map[string]string{
+	"INT":    "int",
+	"INT16":  "int16",
+	"INT32":  "int32",
+	"INT64":  "int64",
+	"BYTE":   "byte",
+	"BOOL":   "bool",
+	"REAL":   "float64",
+	"REAL32": "float32",
+	"REAL64": "float64",
+}
+
+// Option configures a Generator.
+type Option func(*Generator)
+
+// WithMaxFuncSize warns (see Warnings) about every generated Go function
+// whose body exceeds n bytes; such functions are slow for the Go compiler.
+// Zero disables the check.
+func WithMaxFuncSize(n int) Option {
+	return func(g *Generator) {
+		g.maxFuncSize = n
+	}
+}
+
+// WithOutlining keeps generated functions within the WithMaxFuncSize budget
+// where possible: once a function goes over it, each compound statement that
+// completes is moved into an immediately-called closure, which Go compiles
+// as a separate function.
+func WithOutlining(on bool) Option {
+	return func(g *Generator) {
+		g.outline = on
+	}
+}
+
+// DefaultTableThreshold is the number of elements above which an array
+// literal is a large table unless WithTableThreshold says otherwise.
+const DefaultTableThreshold = 256
+
+// tableRowSize is the number of scalars on each line of a large table.
+const tableRowSize = 16
+
+// WithTableThreshold sets the number of elements, counting those of nested
+// literals, above which an array literal such as a sine table or sprite
+// data is a large table: laid out over several lines, tableRowSize
+// elements or one nested array to a line, with integer constants folded,
+// instead of on one line that is slow for gofmt and editors. Zero keeps
+// every literal on one line.
+func WithTableThreshold(n int) Option {
+	return func(g *Generator) {
+		g.tableThreshold = n
+	}
+}
+
+// WithTableData makes each large table (see WithTableThreshold) of
+// integer constants declared by a top-level VAL []TYPE abbreviation an
+// encoded Go string, decoded when the program starts: the bytes of a
+// []BYTE table, or the zigzag varints of other integer types, decoded by
+// _tableInts. The Go compiler handles a string far faster than a
+// composite literal of as many elements. Other tables are laid out over
+// several lines.
+func WithTableData(on bool) Option {
+	return func(g *Generator) {
+		g.tableData = on
+	}
+}
+
+// WithSourcePos names the source lines that generated code reports, such
+// as in the stubs of unsupported statements and PAR branch panics, as pos
+// does, instead of as
+// "line N": for a preprocessed program, the file and line in the original
+// source that each line of the expanded source came from.
+func WithSourcePos(pos func(line int) string) Option {
+	return func(g *Generator) {
+		g.sourcePos = pos
+	}
+}
+
+// WithEntry names the PROC to call from the generated main, overriding any
+// --#PRAGMA ENTRY marker and the default of the last matching PROC. It is
+// an error if there is no such PROC with the entry point signature.
+func WithEntry(name string) Option {
+	return func(g *Generator) {
+		g.entryName = name
+	}
+}
+
+// WithTypeMap overrides the Go types used for occam scalar types, e.g.
+// {"BOOL": "int32"} for embedding targets that pass BOOLs as integers.
+// INT is best given a fixed width with WithWordSize. With BOOL mapped to an integer type, BOOL variables,
+// parameters, FUNCTION results, RECORD fields and channels hold 0 or 1 and
+// are converted to Go bool where read; BOOL arrays are reported as errors.
+func WithTypeMap(m map[string]string) Option {
+	return func(g *Generator) {
+		for occamType, goType := range m {
+			g.goTypes[occamType] = goType
+		}
+	}
+}
+
+// WithWordSize maps occam INT to Go int32 or int64 (bits 32 or 64) instead
+// of int, for programs written for a TARGET.BITS.PER.WORD: PLUS, MINUS and
+// TIMES wrap at the word size, MOSTNEG/MOSTPOS INT are the word's limits,
+// and SIZE, replicator variables, timer values, RETYPES and the intrinsic
+// and conversion helpers all use the INT type. 0 keeps Go int.
+func WithWordSize(bits int) Option {
+	return func(g *Generator) {
+		switch bits {
+		case 32:
+			g.goTypes["INT"] = "int32"
+		case 64:
+			g.goTypes["INT"] = "int64"
+		}
+	}
+}
+
+// WithStrict reports variant receives that do not handle every tag of the
+// channel's protocol as errors (see Errors) rather than warnings, warns
+// about PROC calls written as a bare name without parentheses, and makes
+// conversions to integer types STOP when the value is out of range.
+func WithStrict(on bool) Option {
+	return func(g *Generator) {
+		g.strict = on
+	}
+}
+
+// WithPoison automates the occam shutdown pattern for the variant tag tag.
+// A variant receive in a PROC that has no case for tag, on a channel whose
+// PROTOCOL has it, gets one that sends tag on each of the PROC's output (!)
+// channels whose PROTOCOL has it, then returns from the PROC. Receives inside
+// a PAR are left alone, as a return there would only end that branch.
+func WithPoison(tag string) Option {
+	return func(g *Generator) {
+		g.poisonTag = tag
+	}
+}
+
+// WithRejectPlacement reports PLACED PAR and PLACE declarations as errors
+// (see Errors). By default a PLACED PAR runs as a PAR and a PLACE becomes a
+// comment, as there are no processors or addresses to place things on.
+func WithRejectPlacement(on bool) Option {
+	return func(g *Generator) {
+		g.rejectPlacement = on
+	}
+}
+
+// WithDeterministic makes a program produce the same output on every run,
+// for grading and teaching. The generated main runs goroutines on a single
+// thread without asynchronous preemption (running itself again with
+// GODEBUG=asyncpreemptoff=1), so they switch where they block (mostly
+// channel operations) or, once one has run for 10ms, at its next function
+// call, and every ALT, replicated or not, takes the first ready case in
+// textual order, as a PRI ALT would. Timers and those long computations
+// remain sources of variation.
+func WithDeterministic(on bool) Option {
+	return func(g *Generator) {
+		g.deterministic = on
+	}
+}
+
+// WithCheckedArith makes +, - and * stop the program on integer overflow,
+// as occam's checked operators do, by generating calls of _addChecked,
+// _subChecked and _mulChecked, which STOP as WithBoundsCheck's helpers do,
+// reporting "STOP: integer overflow in + at line N" on stderr. PLUS, MINUS
+// and TIMES still wrap, and REAL operands are not checked. Without it every
+// operator wraps, as Go's do.
+func WithCheckedArith(on bool) Option {
+	return func(g *Generator) {
+		g.checkedArith = on
+	}
+}
+
+// WithBoundsCheck makes every subscript and [a FROM s FOR n] slice STOP,
+// naming the line, when it is out of the array's range, as occam requires,
+// by generating calls of _index and _sliceEnd. Without it Go's own checks
+// panic, and a slice with a negative count may read past its end.
+func WithBoundsCheck(on bool) Option {
+	return func(g *Generator) {
+		g.boundsCheck = on
+	}
+}
+
+// WithLeakCheck makes the entry harness report, on stderr, goroutines
+// still running the program's PROCs when the entry PROC has finished and
+// its output has been written, naming the innermost PROC of each and what
+// it is blocked on. Goroutines are counted from runtime.Stack.
+func WithLeakCheck(on bool) Option {
+	return func(g *Generator) {
+		g.leakCheck = on
+	}
+}
+
+// WithParRecover makes each PAR branch recover a panic in its goroutine,
+// such as an index out of range, a STOP in a FUNCTION or CAUSEERROR, and
+// report it on stderr with the line of the PAR, the branch (its number, or
+// the value of a replicated PAR's variable) and the PROC or FUNCTION it is
+// in, then exit with status 2 as the panic would have, instead of printing
+// a Go stack trace. Run other than from the program's main, as a package or
+// through RunWithIO, a branch panics again with the report instead of
+// exiting. It is on by default.
+func WithParRecover(on bool) Option {
+	return func(g *Generator) {
+		g.parRecover = on
+	}
+}
+
+// WithPoisonUninit fills each scalar variable, array element and record
+// field, when declared, with a value unlikely to be a program's own rather
+// than Go's zero: 0xDEADBEEF (or as much of it as fits) for integers, 0xDE
+// for BYTEs and NaN for REALs. occam leaves variables undefined until
+// assigned, so a program that relies on zero works only by chance; with
+// this it visibly misbehaves instead. BOOLs, MOBILEs and channels are left
+// alone.
+func WithPoisonUninit(on bool) Option {
+	return func(g *Generator) {
+		g.poisonUninit = on
+	}
+}
+
+// WithExtendedRendezvous gives extended inputs (c ?? x) their occam
+// meaning: the sender stays blocked until the extended process below the
+// input has ended. Every send then waits for its receiver to release it,
+// through an acknowledgement channel kept for each channel by the _sent
+// and _received helpers, so all of a program's channels pay for the
+// handshake. Without it an extended input is an ordinary input followed by
+// its process. A package (WithPackage) cannot use it, as Go code sending
+// or receiving on its channels would not take part in the handshake.
+func WithExtendedRendezvous(on bool) Option {
+	return func(g *Generator) {
+		g.rendezvous = on
+	}
+}
+
+// PriPar selects what the priority of a PRI PAR's branches becomes in Go,
+// which has no goroutine priorities.
+type PriPar int
+
+const (
+	PriParIgnore     PriPar = iota // PRI PAR runs as PAR (default)
+	PriParLockThread               // the first branch runs on an OS thread of its own
+	PriParYield                    // later branches yield when they start and on each loop iteration
+)
+
+var priParNames = map[string]PriPar{
+	"ignore":      PriParIgnore,
+	"lock-thread": PriParLockThread,
+	"yield":       PriParYield,
+}
+
+// ParsePriPar maps a -pri-par name (ignore, lock-thread, yield) to a PriPar.
+func ParsePriPar(name string) (PriPar, error) {
+	if m, ok := priParNames[name]; ok {
+		return m, nil
+	}
+	return PriParIgnore, fmt.Errorf("unknown PRI PAR mode %q (want ignore, lock-thread or yield)", name)
+}
+
+func (m PriPar) String() string {
+	for name, v := range priParNames {
+		if v == m {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// WithPriPar gives the branches of each PRI PAR a scheduling hint standing
+// for their priority. With PriParLockThread the first, highest priority,
+// branch calls runtime.LockOSThread, so that it does not wait for a thread
+// behind the others' goroutines. With PriParYield every later branch calls
+// runtime.Gosched when it starts and at the top of each iteration of the
+// WHILE and replicated SEQ loops written in it (not those of the PROCs it
+// calls), letting the first run ahead. In a replicated PRI PAR the first
+// iteration is the first branch. Neither is a real priority: Go may still
+// run a lower priority branch while a higher one is ready. With
+// PriParIgnore, the default, PRI PAR is PAR.
+func WithPriPar(mode PriPar) Option {
+	return func(g *Generator) {
+		g.priPar = mode
+	}
+}
+
+// WithErrorWrappers adds, to a package (see WithPackage), a Go function
+// NameErr for each top-level PROC name with one output channel called
+// error, err or report (or error.out and the like) of a variant PROTOCOL.
+// It takes the PROC's other params, but returns those passed by reference
+// rather than taking pointers to them, and returns as an error the first
+// message the PROC sends on that channel, discarding the rest. The types of
+// the PROTOCOL's tags get Error methods, so callers can use errors.As.
+func WithErrorWrappers(on bool) Option {
+	return func(g *Generator) {
+		g.errorWrappers = on
+	}
+}
+
+// WithPrefix starts the name of every package-level declaration the
+// generator makes up (protocol types and helpers such as _boolToInt) with
+// prefix, so that several transpiled programs can be compiled as one Go
+// package. Names from the occam source, main and RunWithIO are unchanged.
+func WithPrefix(prefix string) Option {
+	return func(g *Generator) {
+		g.prefix = prefix
+	}
+}
+
+// WithPackage generates a library package called pkg instead of package
+// main: top-level PROCs, FUNCTIONs and protocol types get exported names and
+// no func main is made, so the code can be imported by Go programs.
+func WithPackage(pkg string) Option {
+	return func(g *Generator) {
+		g.pkg = pkg
+	}
+}
+
+// WithRuntime calls the Go implementations of the course library (out.string,
+// in.int, ...) in the runtime package instead of occam PROCs. Top-level
+// declarations of those names, such as those #INCLUDEd from course.module,
+// are dropped.
+func WithRuntime(on bool) Option {
+	return func(g *Generator) {
+		g.useRuntime = on
+	}
+}
+
+// DefaultGoVersion is the Go release generated code is written for unless
+// WithGoVersion says otherwise.
+const DefaultGoVersion = "1.21"
+
+// oldestGoMinor is the minor version of the oldest Go release generated code
+// can be built with: it uses any.
+const oldestGoMinor = 18
+
+// ParseGoVersion returns the minor version of a Go release named like
+// "1.22", "1.22.3" or "go1.22", for WithGoVersion.
+func ParseGoVersion(v string) (int, error) {
+	parts := strings.Split(strings.TrimPrefix(v, "go"), ".")
+	minor := 0
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "1" {
+		return 0, fmt.Errorf("invalid Go version %q (want e.g. 1.22)", v)
+	}
+	if _, err := fmt.Sscanf(parts[1], "%d", &minor); err != nil || fmt.Sprint(minor) != parts[1] {
+		return 0, fmt.Errorf("invalid Go version %q (want e.g. 1.22)", v)
+	}
+	if minor < oldestGoMinor {
+		return 0, fmt.Errorf("Go version %s is too old: generated code needs Go 1.%d or later", v, oldestGoMinor)
+	}
+	return minor, nil
+}
+
+// WithGoVersion tailors the generated code to Go 1.minor and later (see
+// ParseGoVersion). From Go 1.22, where each loop iteration has its own loop
+// variable, a replicated PAR's goroutines capture the replicator directly
+// instead of through a copy; before Go 1.21, which added package slices,
+// whole arrays are compared with a generated helper instead of slices.Equal.
+func WithGoVersion(minor int) Option {
+	return func(g *Generator) {
+		g.goMinor = minor
+	}
+}
+
+// DefaultOptLevel is the optimization level without WithOptLevel.
+const DefaultOptLevel = 2
+
+// Pass is an optimization pass: a rewrite of the generated code, not
+// needed for it to be correct, that levels from Level up run.
+type Pass struct {
+	Name  string
+	Level int
+	Doc   string
+}
+
+// Passes lists the optimization passes, for WithOptLevel and WithPass.
+var Passes = []Pass{
+	{"fold-guards", 1, "remove ALT inputs guarded by constant FALSE and drop constant TRUE guards"},
+	{"fold-conversions", 1, "evaluate type conversions of integer constants, such as BYTE (64 + 1), at transpile time"},
+	{"cycle-builtins", 1, "call Go helpers for the demo_cycles processes, such as id and delta, that the program uses without declaring"},
+	{"reuse-timers", 2, "give each ALT timeout repeated by a loop one timer, reset each time, instead of time.After"},
+}
+
+// WithOptLevel sets the optimization level, which picks the passes run
+// (see Passes). Level 0 runs none, so that each construct has its most
+// direct translation, for debugging the generated code against the occam.
+func WithOptLevel(level int) Option {
+	return func(g *Generator) {
+		g.optLevel = level
+	}
+}
+
+// WithPass runs the optimization pass name, or not, whatever the level.
+func WithPass(name string, on bool) Option {
+	return func(g *Generator) {
+		if g.passes == nil {
+			g.passes = make(map[string]bool)
+		}
+		g.passes[name] = on
+	}
+}
+
+// pass reports whether the optimization pass name runs.
+func (g *Generator) pass(name string) bool {
+	if on, ok := g.passes[name]; ok {
+		return on
+	}
+	for _, p := range Passes {
+		if p.Name == name {
+			return g.optLevel >= p.Level
+		}
+	}
+	return false
+}
+
 // New creates a new code generator
-func New() *Generator {
-	return &Generator{}
+func New(opts ...Option) *Generator {
+	g := &Generator{goTypes: make(map[string]string, len(defaultGoTypes)), optLevel: DefaultOptLevel, tableThreshold: DefaultTableThreshold, parRecover: true}
+	g.goMinor, _ = ParseGoVersion(DefaultGoVersion)
+	for occamType, goType := range defaultGoTypes {
+		g.goTypes[occamType] = goType
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Warnings returns the warnings raised by the last call to Generate, in
+// "line N: msg" form where a source line is known.
+func (g *Generator) Warnings() []string {
+	return g.warnings
+}
+
+// Errors returns the errors raised by the last call to Generate (see
+// WithStrict), in the same form as Warnings. The generated code should not
+// be used if there are any.
+func (g *Generator) Errors() []string {
+	return g.errors
+}
+
+// Stats returns the counts of what the last call to Generate translated.
+func (g *Generator) Stats() Stats {
+	return g.stats
+}
+
+// Manifest returns the API of the package the last call to Generate made,
+// or an empty Manifest if it made a program.
+func (g *Generator) Manifest() Manifest {
+	return g.manifest
 }
 
 // goIdent converts an occam identifier to a valid Go identifier.
@@ -107,6 +958,31 @@ func (g *Generator) Generate(program *ast.Program) string {
 	g.needReflect = false
 	g.needBoolHelper = false
 	g.needTerm = false
+	g.needIo = false
+	g.needAltAfter = false
+	g.needBytes = false
+	g.needSlices = false
+	g.needSliceEqual = false
+	g.needRuntime = false
+	g.needPriSelect = false
+	g.needBarrier = false
+	g.needChanClaim = false
+	g.needRendezvous = false
+	g.needStrconv = false
+	g.needJSON = false
+	g.needChecked = false
+	g.needConvCheck = false
+	g.needBounds = false
+	g.needRetype = false
+	g.needStrings = false
+	g.needUninitNaN = false
+	g.needTableInts = false
+	g.needParRecover = false
+	g.needPreemptOff = false
+	g.needOccrt = false
+	g.conversions = make(map[string]bool)
+	g.cycles = make(map[string]bool)
+	g.exported = make(map[string]string)
 	g.procSigs = make(map[string][]ast.ProcParam)
 	g.refParams = make(map[string]bool)
 	g.protocolDefs = make(map[string]*ast.ProtocolDecl)
@@ -115,24 +991,113 @@ func (g *Generator) Generate(program *ast.Program) string {
 	g.tmpCounter = 0
 	g.recordDefs = make(map[string]*ast.RecordDecl)
 	g.recordVars = make(map[string]string)
+	g.dataTypes = make(map[string]string)
 	g.boolVars = make(map[string]bool)
+	g.arrayVars = make(map[string]string)
+	g.multiArrays = make(map[string]multiArray)
+	g.byteVars = make(map[string]bool)
+	g.bidiChans = make(map[*ast.ProcParam]bool)
+	g.boolChans = make(map[string]bool)
+	g.mobileVars = make(map[string]string)
+	g.funcResults = make(map[string][]*ast.TypeRef)
+	g.funcFrames = nil
+	g.warnings = nil
+	g.errors = nil
+	g.poisonProc = nil
+	g.poisonReturns = 0
+	g.altTimers = make(map[ast.Expression]string)
+	g.prunedAltChans = make(map[ast.Statement][]string)
+	g.stats = Stats{}
+	g.manifest = Manifest{}
+	g.skippedNodes = make(map[ast.Node]bool)
+
+	if g.useRuntime {
+		program = g.useRuntimeProcs(program)
+	}
 
-	// Pre-pass: collect BOOL variable names (needed before containsBoolConversion)
+	// Pre-pass: collect PROTOCOL, RECORD and DATA TYPE declarations from
+	// the whole program first, so that channels, variables and params
+	// declared before their types (as #INCLUDEs may order them) find them
+	g.collectTypeDecls(program.Statements)
+
+	// Prune ALT alternatives with constant guards before anything looks
+	// at them, so that helpers and imports only they need are left out
+	g.foldAltGuards(program.Statements)
+
+	// collect BOOL variable names (needed before containsBoolConversion)
 	for _, stmt := range program.Statements {
 		g.collectBoolVars(stmt)
 	}
+	// and array and BYTE names (needed before containsArrayComparison)
+	for _, stmt := range program.Statements {
+		g.collectArrayVars(stmt)
+	}
+
+	// Checked subscripts are too widespread to look for: any program
+	// compiled with the option is assumed to have some
+	if g.boundsCheck {
+		g.needBounds = true
+		g.needFmt = true
+		g.needOs = true
+	}
+
+	// As are REAL variables with WithPoisonUninit, filled from _uninitNaN
+	if g.poisonUninit {
+		g.needUninitNaN = true
+		g.needMath = true
+	}
+
+	// And channel communication with WithExtendedRendezvous
+	if g.rendezvous {
+		g.needRendezvous = true
+		g.needReflect = true
+		g.needSync = true
+		if g.pkg != "" {
+			g.errors = append(g.errors, fmt.Sprintf("package %s: extended rendezvous needs a program, not a package", g.pkg))
+		}
+		if g.useRuntime {
+			g.errors = append(g.errors, "extended rendezvous cannot be used with the course library runtime")
+		}
+	}
 
 	// First pass: collect procedure signatures, protocols, and check for PAR/print
-	for _, stmt := range program.Statements {
+	for _, stmt := range append(program.Statements[:len(program.Statements):len(program.Statements)], g.valofBodies(program.Statements)...) {
+		g.countStats(stmt)
 		if g.containsPar(stmt) {
 			g.needSync = true
+			if g.parRecover {
+				g.needParRecover = true
+				g.needFmt = true
+				g.needOs = true
+			}
 		}
-		if g.containsPrint(stmt) {
+		if g.containsProcCall(stmt, func(name string) bool { return printBuiltins[name] }) {
 			g.needFmt = true
 		}
+		g.containsProcCall(stmt, func(name string) bool {
+			if conversionBuiltins[name] != nil {
+				g.conversions[name] = true
+			}
+			if cycleProcs[name] != nil && g.pass("cycle-builtins") {
+				g.cycles[name] = true
+			}
+			return false
+		})
+		if g.useRuntime && g.containsRuntimeCall(stmt) {
+			g.needOccrt = true
+		}
 		if g.containsTimer(stmt) {
 			g.needTime = true
 		}
+		if g.containsBarrier(stmt) {
+			g.needBarrier = true
+			g.needSync = true
+		}
+		if g.containsSharedChan(stmt) {
+			g.needChanClaim = true
+			g.needReflect = true
+			g.needSync = true
+		}
 		if g.containsStop(stmt) {
 			g.needOs = true
 			g.needFmt = true
@@ -144,31 +1109,92 @@ func (g *Generator) Generate(program *ast.Program) string {
 			g.needMathBits = true
 		}
 		if g.containsRetypes(stmt) {
+			g.needRetype = true
 			g.needMath = true
+			g.needReflect = true
+			g.needFmt = true
+			g.needOs = true
 		}
-		if g.containsAltReplicator(stmt) {
+		if g.containsAltReplicator(stmt, false) {
 			g.needReflect = true
+			g.needPriSelect = g.needPriSelect || g.deterministic || g.containsAltReplicator(stmt, true)
 		}
-		if g.containsBoolConversion(stmt) {
+		if g.containsBoolConversion(stmt) || g.boolAsInt() {
 			g.needBoolHelper = true
 		}
+		if g.pass("reuse-timers") && g.containsLoopedAltTimeout(stmt) {
+			g.needAltAfter = true
+		}
+		if g.containsCheckedArith(stmt) {
+			g.needChecked = true
+			g.needFmt = true
+			g.needOs = true
+		}
+		if g.containsCheckedConversion(stmt) {
+			g.needConvCheck = true
+			g.needFmt = true
+			g.needOs = true
+			g.needMath = true
+		}
+		if g.containsArrayComparison(stmt, "bytes.Equal") {
+			g.needBytes = true
+		}
+		if g.containsArrayComparison(stmt, "slices.Equal") {
+			g.needSlices = true
+		}
+		if g.containsArrayComparison(stmt, g.prefix+"_sliceEqual") {
+			g.needSliceEqual = true
+		}
+		if g.containsArrayComparison(stmt, "reflect.DeepEqual") {
+			g.needReflect = true
+		}
 		if proc, ok := stmt.(*ast.ProcDecl); ok {
 			g.procSigs[proc.Name] = proc.Params
 			g.collectNestedProcSigs(proc.Body)
+			if g.pkg != "" {
+				g.exported[proc.Name] = exportIdent(goIdent(proc.Name))
+			}
 		}
 		if fn, ok := stmt.(*ast.FuncDecl); ok {
 			g.procSigs[fn.Name] = fn.Params
+			g.funcResults[fn.Name] = fn.Results
+			if g.pkg != "" {
+				g.exported[fn.Name] = exportIdent(goIdent(fn.Name))
+			}
 		}
-		if proto, ok := stmt.(*ast.ProtocolDecl); ok {
-			g.protocolDefs[proto.Name] = proto
-		}
-		if rec, ok := stmt.(*ast.RecordDecl); ok {
-			g.recordDefs[rec.Name] = rec
+		if u, ok := stmt.(*ast.Unsupported); ok && u.Proc != "" && g.pkg != "" {
+			g.exported[u.Proc] = exportIdent(goIdent(u.Proc))
 		}
 		g.collectChanProtocols(stmt)
 		g.collectRecordVars(stmt)
 	}
 
+	for name := range g.cycles {
+		if _, declared := g.procSigs[name]; declared {
+			delete(g.cycles, name)
+		}
+	}
+	for name := range g.conversions {
+		if _, declared := g.procSigs[name]; declared {
+			delete(g.conversions, name)
+			continue
+		}
+		g.needStrconv = true
+		if strings.HasPrefix(name, "REAL") {
+			g.needMath = true
+		}
+	}
+
+	// Needs every procSigs entry, so runs once the first pass is done;
+	// repeated until no more params widen, since a widened param is itself
+	// an undirected target for its callers
+	for n := -1; n != len(g.bidiChans); {
+		n = len(g.bidiChans)
+		for _, stmt := range program.Statements {
+			g.collectBidiChans(stmt, nil)
+		}
+	}
+
 	// Separate protocol, record, procedure declarations from other statements
 	var typeDecls []ast.Statement
 	var procDecls []ast.Statement
@@ -190,12 +1216,19 @@ func (g *Generator) Generate(program *ast.Program) string {
 	var abbrDecls []ast.Statement
 	for _, stmt := range program.Statements {
 		switch s := stmt.(type) {
-		case *ast.ProtocolDecl, *ast.RecordDecl:
+		case *ast.ProtocolDecl, *ast.RecordDecl, *ast.DataTypeDecl:
 			typeDecls = append(typeDecls, stmt)
 		case *ast.ProcDecl, *ast.FuncDecl:
 			procDecls = append(procDecls, stmt)
+		case *ast.Unsupported:
+			// A stub for a PROC declaration, or a comment, at package level
+			if hasProcDecls || g.pkg != "" {
+				procDecls = append(procDecls, stmt)
+			} else {
+				mainStatements = append(mainStatements, stmt)
+			}
 		case *ast.Abbreviation:
-			if hasProcDecls {
+			if hasProcDecls || g.pkg != "" {
 				// Top-level abbreviations need to be at package level
 				// so PROCs can reference them
 				abbrDecls = append(abbrDecls, stmt)
@@ -211,32 +1244,82 @@ func (g *Generator) Generate(program *ast.Program) string {
 		}
 	}
 
+	// Top-level tables encoded as data may need _tableInts to decode them
+	for _, stmt := range abbrDecls {
+		g.tableDataValue(stmt.(*ast.Abbreviation))
+	}
+
 	// Detect entry point PROC so we can set import flags before writing imports
 	var entryProc *ast.ProcDecl
-	if len(mainStatements) == 0 {
+	if g.pkg != "" {
+		if len(mainStatements) > 0 {
+			g.errors = append(g.errors, fmt.Sprintf("package %s: statements outside PROCs and FUNCTIONs need a program, not a package", g.pkg))
+			mainStatements = nil
+		}
+		if g.errorWrappers {
+			g.collectErrorChans(procDecls)
+		}
+	} else if len(mainStatements) == 0 {
 		entryProc = g.findEntryProc(procDecls)
 		if entryProc != nil {
 			g.needOs = true
 			g.needSync = true
 			g.needBufio = true
 			g.needTerm = true
+			g.needIo = true
+			g.needTime = true
+			if proto := g.screenProtocol(entryProc); proto != nil {
+				if g.isTerminalProtocol(proto) {
+					g.needFmt = g.needFmt || g.screenNeedsFmt(proto)
+				} else {
+					g.needJSON = true
+				}
+			}
+			if g.leakCheck {
+				g.needFmt = true
+				g.needRuntime = true
+				g.needStrings = true
+			}
+		}
+	}
+	if g.deterministic && (len(mainStatements) > 0 || entryProc != nil) {
+		g.needRuntime = true
+		g.needPreemptOff = true
+		g.needFmt = true
+		g.needOs = true
+		g.needStrings = true
+	}
+	if g.priPar != PriParIgnore {
+		for _, stmt := range program.Statements {
+			if g.containsPriPar(stmt) {
+				g.needRuntime = true
+			}
 		}
 	}
 
 	// Write package declaration
-	g.writeLine("package main")
+	g.writeLine("package " + g.packageName())
 	g.writeLine("")
 
 	// Write imports
-	if g.needSync || g.needFmt || g.needTime || g.needOs || g.needMath || g.needMathBits || g.needBufio || g.needReflect || g.needTerm {
+	if g.needSync || g.needFmt || g.needTime || g.needOs || g.needMath || g.needMathBits || g.needBufio || g.needReflect || g.needTerm || g.needIo || g.needBytes || g.needSlices || g.needRuntime || g.needStrconv || g.needStrings || g.needOccrt || g.needJSON {
 		g.writeLine("import (")
 		g.indent++
 		if g.needBufio {
 			g.writeLine(`"bufio"`)
 		}
+		if g.needBytes {
+			g.writeLine(`"bytes"`)
+		}
+		if g.needJSON {
+			g.writeLine(`"encoding/json"`)
+		}
 		if g.needFmt {
 			g.writeLine(`"fmt"`)
 		}
+		if g.needIo {
+			g.writeLine(`"io"`)
+		}
 		if g.needMath {
 			g.writeLine(`"math"`)
 		}
@@ -246,23 +1329,43 @@ func (g *Generator) Generate(program *ast.Program) string {
 		if g.needOs {
 			g.writeLine(`"os"`)
 		}
+		if g.needPreemptOff {
+			g.writeLine(`"os/exec"`)
+		}
 		if g.needTerm {
 			g.writeLine(`"os/signal"`)
 		}
 		if g.needReflect {
 			g.writeLine(`"reflect"`)
 		}
-		if g.needSync {
-			g.writeLine(`"sync"`)
+		if g.needRuntime {
+			g.writeLine(`"runtime"`)
 		}
-		if g.needTerm {
+		if g.needSlices {
+			g.writeLine(`"slices"`)
+		}
+		if g.needStrconv {
+			g.writeLine(`"strconv"`)
+		}
+		if g.needStrings {
+			g.writeLine(`"strings"`)
+		}
+		if g.needSync {
+			g.writeLine(`"sync"`)
+		}
+		if g.needTerm {
 			g.writeLine(`"syscall"`)
 		}
 		if g.needTime {
 			g.writeLine(`"time"`)
 		}
-		if g.needTerm {
+		if g.needTerm || g.needOccrt {
 			g.writeLine("")
+		}
+		if g.needOccrt {
+			g.writeLine(`occrt "` + RuntimeImport + `"`)
+		}
+		if g.needTerm {
 			g.writeLine(`"golang.org/x/term"`)
 		}
 		g.indent--
@@ -275,39 +1378,115 @@ func (g *Generator) Generate(program *ast.Program) string {
 		g.emitIntrinsicHelpers()
 	}
 
+	// Emit helper functions for the conversion builtins called
+	if len(g.conversions) > 0 {
+		g.emitConversionHelpers()
+	}
+
+	// Emit the building-block processes called
+	if len(g.cycles) > 0 {
+		g.emitCycleHelpers()
+	}
+
 	// Emit _boolToInt helper function
 	if g.needBoolHelper {
 		g.emitBoolHelper()
 	}
 
+	if g.needUninitNaN {
+		g.writeLine("var " + g.prefix + "_uninitNaN = math.NaN()")
+		g.writeLine("")
+	}
+
+	if g.needTableInts {
+		g.emitTableIntsHelper()
+	}
+
+	// Emit _altAfter helper function
+	if g.needAltAfter {
+		g.emitAltAfterHelper()
+	}
+
+	// Emit the _number constraint of the checked arithmetic and conversion
+	// helpers, then the helpers
+	if g.needChecked || g.needConvCheck || g.needBounds {
+		g.writeLine("type " + g.prefix + "_number interface {")
+		g.writeLine("\t~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~float32 | ~float64")
+		g.writeLine("}")
+		g.writeLine("")
+	}
+	if g.needChecked {
+		g.emitCheckedArithHelpers()
+	}
+	if g.needConvCheck {
+		g.emitConvCheckHelper()
+	}
+	if g.needBounds {
+		g.emitBoundsHelpers()
+	}
+	if g.needRetype {
+		g.emitRetypeHelpers()
+	}
+	if g.needParRecover {
+		g.emitParRecoverHelper()
+	}
+	if g.needPreemptOff {
+		g.emitPreemptOffHelper()
+	}
+
+	// Emit _sliceEqual helper function
+	if g.needSliceEqual {
+		g.emitSliceEqualHelper()
+	}
+
+	// Emit _priSelect helper function
+	if g.needPriSelect {
+		g.emitPriSelectHelper()
+	}
+
+	// Emit _barrier helper type
+	if g.needBarrier {
+		g.emitBarrierHelper()
+	}
+
+	// Emit _chanClaim helper function
+	if g.needChanClaim {
+		g.emitChanClaimHelper()
+	}
+
+	// Emit the _sent and _received helper functions
+	if g.needRendezvous {
+		g.emitRendezvousHelpers()
+	}
+
 	// Generate type definitions first (at package level)
 	for _, stmt := range typeDecls {
 		g.generateStatement(stmt)
 	}
 
-	// Generate package-level abbreviations (constants)
-	for _, stmt := range abbrDecls {
+	// Generate package-level abbreviations (constants), each after the
+	// ones it depends on
+	for _, stmt := range g.orderAbbreviations(abbrDecls, procDecls) {
 		abbr := stmt.(*ast.Abbreviation)
 		if abbr.Type == "" {
 			// Untyped VAL: let Go infer the type
 			g.builder.WriteString("var ")
 			g.write(fmt.Sprintf("%s = ", goIdent(abbr.Name)))
-			g.generateExpression(abbr.Value)
+			g.generateUntypedValue(abbr.Value)
 			g.write("\n")
 		} else {
-			goType := g.occamTypeToGo(abbr.Type)
-			if abbr.OpenArrayDims > 0 {
-				goType = strings.Repeat("[]", abbr.OpenArrayDims) + goType
-			}
+			dims, _ := abbr.TypeRef.Dims()
 			g.builder.WriteString("var ")
-			g.write(fmt.Sprintf("%s %s = ", goIdent(abbr.Name), goType))
+			g.write(fmt.Sprintf("%s %s = ", goIdent(abbr.Name), g.abbrGoType(abbr)))
 			// Wrap string literals with []byte() when assigned to []byte variables
-			if _, isStr := abbr.Value.(*ast.StringLiteral); isStr && abbr.OpenArrayDims > 0 && abbr.Type == "BYTE" {
+			if _, isStr := abbr.Value.(*ast.StringLiteral); isStr && dims > 0 && abbr.Type == "BYTE" {
 				g.write("[]byte(")
 				g.generateExpression(abbr.Value)
 				g.write(")")
-			} else if al, isArr := abbr.Value.(*ast.ArrayLiteral); isArr && abbr.OpenArrayDims > 1 {
-				g.generateTypedArrayLiteral(al, goType)
+			} else if data, ok := g.tableDataValue(abbr); ok {
+				g.write(data)
+			} else if isTable(abbr.Value) {
+				g.generateTypedLiteral(abbr.Value, abbr.Type, dims)
 			} else {
 				g.generateExpression(abbr.Value)
 			}
@@ -322,25 +1501,254 @@ func (g *Generator) Generate(program *ast.Program) string {
 	for _, stmt := range procDecls {
 		g.generateStatement(stmt)
 	}
+	if len(g.errorChans) > 0 {
+		g.emitErrorWrappers(procDecls)
+	}
+	if g.pkg != "" {
+		g.manifest = g.buildManifest(typeDecls, procDecls)
+	}
 
 	// Generate main function with other statements
 	if len(mainStatements) > 0 {
 		g.writeLine("func main() {")
 		g.indent++
 		g.nestingLevel++
+		g.tmpCounter = 0
+		g.beginFunc("main program", 0)
+		g.emitDeterministicSetup()
+		g.emitParExit()
 		for _, stmt := range mainStatements {
 			g.generateStatement(stmt)
 		}
+		g.endFunc()
 		g.nestingLevel--
 		g.indent--
 		g.writeLine("}")
 	} else if entryProc != nil {
 		g.generateEntryHarness(entryProc)
+		if g.leakCheck {
+			g.emitLeakCheckHelper(procDecls)
+		}
 	}
 
+	g.stats.Lines = strings.Count(g.builder.String(), "\n")
 	return g.builder.String()
 }
 
+// abbrDep is an edge from a package-level abbreviation to another that its
+// value refers to, directly or through a FUNCTION call (via).
+type abbrDep struct {
+	to  int
+	via string
+}
+
+// orderAbbreviations returns the package-level abbreviations abbrs sorted so
+// that each comes after those its value depends on, either directly or
+// through the FUNCTIONs among decls that it calls, and otherwise in source
+// order. Cycles, which Go would reject as initialization cycles, are
+// reported as errors.
+func (g *Generator) orderAbbreviations(abbrs, decls []ast.Statement) []ast.Statement {
+	index := make(map[string]int)
+	for i, stmt := range abbrs {
+		index[stmt.(*ast.Abbreviation).Name] = i
+	}
+	funcs := make(map[string]*ast.FuncDecl)
+	for _, stmt := range decls {
+		if fn, ok := stmt.(*ast.FuncDecl); ok {
+			funcs[fn.Name] = fn
+		}
+	}
+
+	// Direct references of each FUNCTION, ignoring its own names
+	type funcRefs struct {
+		abbrs []int
+		calls []string
+	}
+	refsOf := make(map[string]*funcRefs)
+	funcRefsOf := func(name string) *funcRefs {
+		if r, ok := refsOf[name]; ok {
+			return r
+		}
+		fn := funcs[name]
+		locals := make(map[string]bool)
+		for _, p := range fn.Params {
+			locals[p.Name] = true
+		}
+		for _, n := range scopeNames(fn.Body) {
+			locals[n] = true
+		}
+		r := &funcRefs{}
+		collect := func(e ast.Expression) bool {
+			switch e := e.(type) {
+			case *ast.Identifier:
+				if i, ok := index[e.Value]; ok && !locals[e.Value] {
+					r.abbrs = append(r.abbrs, i)
+				}
+			case *ast.FuncCall:
+				if _, ok := funcs[e.Name]; ok {
+					r.calls = append(r.calls, e.Name)
+				}
+			}
+			return false
+		}
+		for _, stmt := range fn.Body {
+			g.walkStatements(stmt, collect)
+		}
+		for _, e := range fn.ResultExprs {
+			g.walkExpr(e, collect)
+		}
+		refsOf[name] = r
+		return r
+	}
+
+	deps := make([][]abbrDep, len(abbrs))
+	for i, stmt := range abbrs {
+		g.walkExpr(stmt.(*ast.Abbreviation).Value, func(e ast.Expression) bool {
+			switch e := e.(type) {
+			case *ast.Identifier:
+				if j, ok := index[e.Value]; ok {
+					deps[i] = append(deps[i], abbrDep{to: j})
+				}
+			case *ast.FuncCall:
+				if _, ok := funcs[e.Name]; !ok {
+					break
+				}
+				// Everything the FUNCTION reaches, through its own calls
+				seen := map[string]bool{e.Name: true}
+				queue := []string{e.Name}
+				for len(queue) > 0 {
+					r := funcRefsOf(queue[0])
+					queue = queue[1:]
+					for _, j := range r.abbrs {
+						deps[i] = append(deps[i], abbrDep{to: j, via: e.Name})
+					}
+					for _, c := range r.calls {
+						if !seen[c] {
+							seen[c] = true
+							queue = append(queue, c)
+						}
+					}
+				}
+			}
+			return false
+		})
+	}
+
+	// Depth-first topological sort, visiting in source order
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	name := func(i int) string { return abbrs[i].(*ast.Abbreviation).Name }
+	step := func(d abbrDep) string {
+		if d.via != "" {
+			return " -> " + d.via + "() -> " + name(d.to)
+		}
+		return " -> " + name(d.to)
+	}
+	state := make([]int, len(abbrs))
+	var stack []abbrDep // the path being visited, with the edge into each
+	var ordered []ast.Statement
+	var visit func(in abbrDep)
+	visit = func(in abbrDep) {
+		i := in.to
+		state[i] = visiting
+		stack = append(stack, in)
+		for _, d := range deps[i] {
+			switch state[d.to] {
+			case unvisited:
+				visit(d)
+			case visiting:
+				k := len(stack) - 1
+				for stack[k].to != d.to {
+					k--
+				}
+				cycle := name(d.to)
+				for _, e := range stack[k+1:] {
+					cycle += step(e)
+				}
+				cycle += step(d)
+				abbr := abbrs[i].(*ast.Abbreviation)
+				g.errors = append(g.errors, fmt.Sprintf("line %d: abbreviation %s is part of an initialization cycle: %s", abbr.Token.Line, abbr.Name, cycle))
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = done
+		ordered = append(ordered, abbrs[i])
+	}
+	for i := range abbrs {
+		if state[i] == unvisited {
+			visit(abbrDep{to: i})
+		}
+	}
+	return ordered
+}
+
+// scopeNames returns the names declared anywhere within stmts, including
+// replicator variables and nested PROC and FUNCTION parameters.
+func scopeNames(stmts []ast.Statement) []string {
+	var names []string
+	addRep := func(r *ast.Replicator) {
+		if r != nil {
+			names = append(names, r.Variable)
+		}
+	}
+	for _, stmt := range stmts {
+		names = append(names, declaredNames(stmt)...)
+		switch s := stmt.(type) {
+		case *ast.SeqBlock:
+			addRep(s.Replicator)
+			names = append(names, scopeNames(s.Statements)...)
+		case *ast.ParBlock:
+			addRep(s.Replicator)
+			names = append(names, scopeNames(s.Statements)...)
+		case *ast.ClaimBlock:
+			names = append(names, scopeNames(s.Body)...)
+		case *ast.ForkingBlock:
+			names = append(names, scopeNames(s.Body)...)
+		case *ast.WhileLoop:
+			names = append(names, scopeNames(s.Body)...)
+		case *ast.IfStatement:
+			addRep(s.Replicator)
+			for _, choice := range s.Choices {
+				if choice.NestedIf != nil {
+					names = append(names, scopeNames([]ast.Statement{choice.NestedIf})...)
+				}
+				names = append(names, scopeNames(choice.Body)...)
+			}
+		case *ast.CaseStatement:
+			for _, choice := range s.Choices {
+				names = append(names, scopeNames(choice.Body)...)
+			}
+		case *ast.AltBlock:
+			addRep(s.Replicator)
+			for _, c := range s.Cases {
+				names = append(names, scopeNames(c.Declarations)...)
+				names = append(names, scopeNames(c.Body)...)
+			}
+		case *ast.VariantReceive:
+			for _, c := range s.Cases {
+				names = append(names, scopeNames(c.Declarations)...)
+				names = append(names, scopeNames(c.Body)...)
+			}
+		case *ast.ProcDecl:
+			names = append(names, s.Name)
+			for _, p := range s.Params {
+				names = append(names, p.Name)
+			}
+			names = append(names, scopeNames(s.Body)...)
+		case *ast.FuncDecl:
+			names = append(names, s.Name)
+			for _, p := range s.Params {
+				names = append(names, p.Name)
+			}
+			names = append(names, scopeNames(s.Body)...)
+		}
+	}
+	return names
+}
+
 // collectNestedProcSigs recursively collects procedure/function signatures
 // from nested declarations inside PROC bodies.
 func (g *Generator) collectNestedProcSigs(stmts []ast.Statement) {
@@ -360,6 +1768,10 @@ func (g *Generator) collectNestedProcSigs(stmts []ast.Statement) {
 			for _, c := range s.Choices {
 				g.collectNestedProcSigs(c.Body)
 			}
+		case *ast.ClaimBlock:
+			g.collectNestedProcSigs(s.Body)
+		case *ast.ForkingBlock:
+			g.collectNestedProcSigs(s.Body)
 		case *ast.WhileLoop:
 			g.collectNestedProcSigs(s.Body)
 		case *ast.CaseStatement:
@@ -397,6 +1809,10 @@ func (g *Generator) collectNestedProcSigsScoped(stmts []ast.Statement, oldSigs m
 			for _, c := range s.Choices {
 				g.collectNestedProcSigsScoped(c.Body, oldSigs)
 			}
+		case *ast.ClaimBlock:
+			g.collectNestedProcSigsScoped(s.Body, oldSigs)
+		case *ast.ForkingBlock:
+			g.collectNestedProcSigsScoped(s.Body, oldSigs)
 		case *ast.WhileLoop:
 			g.collectNestedProcSigsScoped(s.Body, oldSigs)
 		case *ast.CaseStatement:
@@ -407,63 +1823,189 @@ func (g *Generator) collectNestedProcSigsScoped(stmts []ast.Statement, oldSigs m
 	}
 }
 
-// findEntryProc looks for the last top-level PROC with the standard occam
-// entry point signature: exactly 3 CHAN OF BYTE params (keyboard?, screen!, error!).
+// findEntryProc picks the top-level PROC to run from main among those with
+// an entry point signature (see IsEntryProc): the one named by WithEntry,
+// else the one marked --#PRAGMA ENTRY, else the last. Ambiguities are
+// reported as warnings.
 func (g *Generator) findEntryProc(procDecls []ast.Statement) *ast.ProcDecl {
-	var entry *ast.ProcDecl
+	var candidates, marked []*ast.ProcDecl
+	var named *ast.ProcDecl
 	for _, stmt := range procDecls {
 		proc, ok := stmt.(*ast.ProcDecl)
 		if !ok {
 			continue
 		}
-		if len(proc.Params) != 3 {
+		if proc.Name == g.entryName {
+			named = proc
+		}
+		if !IsEntryProc(proc) || chanElemType(proc.Params[1].TypeRef) != "BYTE" && g.screenProtocol(proc) == nil {
+			if proc.Entry {
+				g.warnings = append(g.warnings, fmt.Sprintf("line %d: PROC %s is marked ENTRY but does not have an entry point signature", proc.Token.Line, proc.Name))
+			}
 			continue
 		}
-		p0, p1, p2 := proc.Params[0], proc.Params[1], proc.Params[2]
-		if p0.IsChan && p0.ChanElemType == "BYTE" && p0.ChanDir == "?" &&
-			p1.IsChan && p1.ChanElemType == "BYTE" && p1.ChanDir == "!" &&
-			p2.IsChan && p2.ChanElemType == "BYTE" && p2.ChanDir == "!" {
-			entry = proc
+		candidates = append(candidates, proc)
+		if proc.Entry {
+			marked = append(marked, proc)
 		}
 	}
+
+	if g.entryName != "" {
+		// A program running some other PROC than the one asked for is
+		// worse than none
+		for _, proc := range candidates {
+			if proc == named {
+				return proc
+			}
+		}
+		if named != nil {
+			g.errors = append(g.errors, fmt.Sprintf("line %d: entry PROC %s does not have an entry point signature", named.Token.Line, g.entryName))
+		} else {
+			g.errors = append(g.errors, fmt.Sprintf("entry PROC %s not found", g.entryName))
+		}
+		return nil
+	}
+	if len(marked) > 0 {
+		candidates = marked
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	entry := candidates[len(candidates)-1]
+	if len(candidates) > 1 {
+		names := make([]string, len(candidates))
+		for i, proc := range candidates {
+			names[i] = proc.Name
+		}
+		what := "match the entry point signature"
+		if len(marked) > 0 {
+			what = "are marked ENTRY"
+		}
+		g.warnings = append(g.warnings, fmt.Sprintf("line %d: several PROCs %s: %s; using %s", entry.Token.Line, what, strings.Join(names, ", "), entry.Name))
+	}
 	return entry
 }
 
+// IsEntryProc reports whether proc has the standard occam entry point
+// signature: 3 CHAN OF BYTE params (keyboard?, screen!, error!), optionally
+// followed by a fourth CHAN OF BYTE — an extra error output (!) or an input
+// carrying the command-line arguments (?). The screen channel may instead
+// carry a PROTOCOL, which must be a variant one for the harness to run it.
+func IsEntryProc(proc *ast.ProcDecl) bool {
+	if len(proc.Params) != 3 && len(proc.Params) != 4 {
+		return false
+	}
+	for i, p := range proc.Params {
+		dir := "!"
+		if i == 0 {
+			dir = "?"
+		}
+		if i == 3 && p.ChanDir == "?" {
+			dir = "?"
+		}
+		if p.TypeRef.Kind != ast.ChanType {
+			return false
+		}
+		carried := p.TypeRef.Elem.FlatName()
+		elem := "BYTE"
+		if i == 3 && p.ChanDir == "!" && carried == "BOOL" {
+			elem = "BOOL"
+		}
+		if i == 1 && !isScalarType(carried) {
+			elem = carried
+		}
+		if carried != elem || p.ChanDir != dir {
+			return false
+		}
+	}
+	return true
+}
+
+// chanElemType returns the name of the type that t, a channel or an array of
+// channels, carries ("INT", "[]BYTE" or a PROTOCOL), or "" if t is neither.
+func chanElemType(t *ast.TypeRef) string {
+	if elem, _ := t.ChanElem(); elem != nil {
+		return elem.FlatName()
+	}
+	return ""
+}
+
+// screenProtocol returns the variant PROTOCOL carried by the screen channel
+// of entry PROC proc, or nil if it carries BYTEs or another protocol.
+func (g *Generator) screenProtocol(proc *ast.ProcDecl) *ast.ProtocolDecl {
+	proto := g.protocolDefs[chanElemType(proc.Params[1].TypeRef)]
+	if proto == nil || proto.Kind != "variant" {
+		return nil
+	}
+	return proto
+}
+
+// emitDeterministicSetup starts func main with the single-thread setup
+// for WithDeterministic.
+func (g *Generator) emitDeterministicSetup() {
+	if !g.deterministic {
+		return
+	}
+	g.writeLine("// -deterministic: one thread without asynchronous preemption, so goroutines")
+	g.writeLine("// switch where they block or, once they have run for 10ms, at a function call")
+	g.writeLine(g.prefix + "_preemptOff()")
+	g.writeLine("runtime.GOMAXPROCS(1)")
+	g.writeLine("")
+}
+
+// emitParExit lets _parRecover exit the program, which it does only when
+// the program runs from its main: a package's caller, or a host calling
+// RunWithIO, gets the panic instead.
+func (g *Generator) emitParExit() {
+	if !g.needParRecover {
+		return
+	}
+	g.writeLine(g.prefix + "_parExit = true")
+	g.writeLine("")
+}
+
 // generateEntryHarness emits a func main() that wires stdin/stdout/stderr
 // to channels and calls the entry PROC.  When stdin is a terminal, the
 // harness switches to raw mode (via golang.org/x/term) so that keyboard
 // input is available character-by-character without waiting for Enter.
+// The channel wiring lives in _runEntry, which is also exported as
+// RunWithIO so that host programs and tests can supply their own streams.
 func (g *Generator) generateEntryHarness(proc *ast.ProcDecl) {
 	name := goIdent(proc.Name)
+	extra := ""
+	if len(proc.Params) == 4 {
+		if chanElemType(proc.Params[3].TypeRef) == "BOOL" {
+			extra = "_status"
+		} else if proc.Params[3].ChanDir == "!" {
+			extra = "_error2"
+		} else {
+			extra = "_args"
+		}
+	}
+
 	g.writeLine("func main() {")
 	g.indent++
-
-	// Create channels
-	g.writeLine("keyboard := make(chan byte, 256)")
-	g.writeLine("screen := make(chan byte, 256)")
-	g.writeLine("_error := make(chan byte, 256)")
-	g.writeLine("")
+	g.emitDeterministicSetup()
+	g.emitParExit()
 
 	// Raw terminal mode setup
 	g.writeLine("// Raw terminal mode — gives character-at-a-time keyboard input")
-	g.writeLine("var rawMode bool")
-	g.writeLine("var oldState *term.State")
+	g.writeLine("var restore func()")
 	g.writeLine("fd := int(os.Stdin.Fd())")
 	g.writeLine("if term.IsTerminal(fd) {")
 	g.indent++
-	g.writeLine("var err error")
-	g.writeLine("oldState, err = term.MakeRaw(fd)")
+	g.writeLine("oldState, err := term.MakeRaw(fd)")
 	g.writeLine("if err == nil {")
 	g.indent++
-	g.writeLine("rawMode = true")
-	g.writeLine("defer term.Restore(fd, oldState)")
+	g.writeLine("restore = func() { term.Restore(fd, oldState) }")
+	g.writeLine("defer restore()")
 	g.writeLine("// Restore terminal on external signals")
 	g.writeLine("sigCh := make(chan os.Signal, 1)")
 	g.writeLine("signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)")
 	g.writeLine("go func() {")
 	g.indent++
 	g.writeLine("<-sigCh")
-	g.writeLine("term.Restore(fd, oldState)")
+	g.writeLine("restore()")
 	g.writeLine("os.Exit(1)")
 	g.indent--
 	g.writeLine("}()")
@@ -472,49 +2014,468 @@ func (g *Generator) generateEntryHarness(proc *ast.ProcDecl) {
 	g.indent--
 	g.writeLine("}")
 	g.writeLine("")
+	if extra == "_args" {
+		g.writeLine(g.prefix + "_runEntry(os.Stdin, os.Stdout, os.Stderr, restore, os.Args[1:])")
+	} else if extra == "_status" {
+		g.writeLine("if !" + g.prefix + "_runEntry(os.Stdin, os.Stdout, os.Stderr, restore) {")
+		g.indent++
+		g.writeLine("if restore != nil {")
+		g.writeLine("restore()")
+		g.writeLine("}")
+		g.writeLine("os.Exit(1)")
+		g.indent--
+		g.writeLine("}")
+	} else {
+		g.writeLine(g.prefix + "_runEntry(os.Stdin, os.Stdout, os.Stderr, restore)")
+	}
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+
+	// Exported entry point for embedding
+	g.writeLine(fmt.Sprintf("// RunWithIO runs PROC %s with its keyboard channel reading from stdin", proc.Name))
+	g.writeLine("// and its screen and error channels writing to stdout and stderr. It")
+	g.writeLine("// returns when the PROC has finished and its output has been written,")
+	g.writeLine("// without waiting for more input: the keyboard reader stops, ending a")
+	g.writeLine("// pending read at once if stdin has a SetReadDeadline method (as pipes")
+	g.writeLine("// from os.Pipe and network connections do), and otherwise when it returns.")
+	if extra == "_args" {
+		g.writeLine("// The args channel receives each of args followed by a newline.")
+		g.writeLine("func RunWithIO(stdin io.Reader, stdout, stderr io.Writer, args ...string) {")
+		g.indent++
+		g.writeLine(g.prefix + "_runEntry(stdin, stdout, stderr, nil, args)")
+	} else if extra == "_status" {
+		g.writeLine(fmt.Sprintf("// It returns the last BOOL sent on %s, or true if none was sent.", proc.Params[3].Name))
+		g.writeLine("func RunWithIO(stdin io.Reader, stdout, stderr io.Writer) bool {")
+		g.indent++
+		g.writeLine("return " + g.prefix + "_runEntry(stdin, stdout, stderr, nil)")
+	} else {
+		g.writeLine("func RunWithIO(stdin io.Reader, stdout, stderr io.Writer) {")
+		g.indent++
+		g.writeLine(g.prefix + "_runEntry(stdin, stdout, stderr, nil)")
+	}
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+
+	// Channel wiring
+	g.writeLine("// " + g.prefix + "_runEntry connects the entry PROC's channels to the given streams. A")
+	g.writeLine("// non-nil restore means stdin is a terminal in raw mode: input is read a")
+	g.writeLine("// byte at a time, Ctrl+C restores the terminal and exits, and output")
+	g.writeLine("// newlines get a carriage return.")
+	if extra == "_args" {
+		g.writeLine("func " + g.prefix + "_runEntry(stdin io.Reader, stdout, stderr io.Writer, restore func(), args []string) {")
+	} else if extra == "_status" {
+		g.writeLine("func " + g.prefix + "_runEntry(stdin io.Reader, stdout, stderr io.Writer, restore func()) bool {")
+	} else {
+		g.writeLine("func " + g.prefix + "_runEntry(stdin io.Reader, stdout, stderr io.Writer, restore func()) {")
+	}
+	g.indent++
+	g.writeLine("rawMode := restore != nil")
+	g.writeLine("")
+
+	// Create channels
+	screenProto := g.screenProtocol(proc)
+	g.writeLine("keyboard := make(chan byte, 256)")
+	if screenProto != nil {
+		g.writeLine(fmt.Sprintf("screen := make(chan %s, 256)", g.protoType(screenProto.Name)))
+	} else {
+		g.writeLine("screen := make(chan byte, 256)")
+	}
+	g.writeLine("_error := make(chan byte, 256)")
+	if extra == "_status" {
+		g.writeLine(fmt.Sprintf("_status := make(chan %s, 1)", g.occamTypeToGo("BOOL")))
+	} else if extra != "" {
+		g.writeLine(fmt.Sprintf("%s := make(chan byte, 256)", extra))
+	}
+	if g.rendezvous {
+		// The harness's own goroutines do not acknowledge
+		for _, ch := range []string{"keyboard", "screen", "_error", extra} {
+			if ch != "" {
+				g.writeLine(g.prefix + "_noAck(" + ch + ")")
+			}
+		}
+	}
+	g.writeLine("")
 
 	// WaitGroup for writer goroutines to finish draining
+	writers := 2
+	if extra == "_error2" || extra == "_status" {
+		writers++
+	}
 	g.writeLine("var wg sync.WaitGroup")
-	g.writeLine("wg.Add(2)")
+	g.writeLine(fmt.Sprintf("wg.Add(%d)", writers))
 	g.writeLine("")
 
-	// Screen writer goroutine — in raw mode, insert CR before LF
+	if screenProto != nil {
+		g.emitScreenWriter(screenProto)
+	} else {
+		g.emitByteWriter("screen", "stdout")
+	}
+	g.emitByteWriter("_error", "stderr")
+	if extra == "_error2" {
+		g.emitByteWriter(extra, "stderr")
+	}
+	if extra == "_status" {
+		// Status goroutine — keeps the last BOOL sent
+		status := "b"
+		if g.boolAsInt() {
+			status = "b != 0"
+		}
+		g.writeLine("status := true")
+		g.writeLine("go func() {")
+		g.indent++
+		g.writeLine("defer wg.Done()")
+		g.writeLine("for b := range _status {")
+		g.indent++
+		g.writeLine("status = " + status)
+		g.indent--
+		g.writeLine("}")
+		g.indent--
+		g.writeLine("}()")
+		g.writeLine("")
+	}
+
+	if extra == "_args" {
+		// Arguments goroutine — each argument followed by a newline
+		g.writeLine("go func() {")
+		g.indent++
+		g.writeLine("for _, a := range args {")
+		g.indent++
+		g.writeLine("for i := 0; i < len(a); i++ {")
+		g.indent++
+		g.writeLine("_args <- a[i]")
+		g.indent--
+		g.writeLine("}")
+		g.writeLine(`_args <- '\n'`)
+		g.indent--
+		g.writeLine("}")
+		g.writeLine("close(_args)")
+		g.indent--
+		g.writeLine("}()")
+		g.writeLine("")
+	}
+
+	// Keyboard reader goroutine, stopped by done when the entry PROC ends
+	// so that it never waits on a keyboard channel no longer read
+	g.writeLine("done := make(chan struct{})")
 	g.writeLine("go func() {")
 	g.indent++
-	g.writeLine("defer wg.Done()")
-	g.writeLine("w := bufio.NewWriter(os.Stdout)")
-	g.writeLine("for b := range screen {")
-	g.indent++
-	g.writeLine("if b == 255 {")
+	g.writeLine("if rawMode {")
 	g.indent++
-	g.writeLine("w.Flush()")
-	g.indent--
-	g.writeLine("} else {")
+	g.writeLine("buf := make([]byte, 1)")
+	g.writeLine("for {")
 	g.indent++
-	g.writeLine(`if rawMode && b == '\n' {`)
-	g.writeLine(`w.WriteByte('\r')`)
-	g.writeLine("}")
-	g.writeLine("w.WriteByte(b)")
-	g.writeLine("if len(screen) == 0 {")
+	g.writeLine("n, err := stdin.Read(buf)")
+	g.writeLine("if err != nil || n == 0 {")
 	g.indent++
-	g.writeLine("w.Flush()")
+	g.writeLine("close(keyboard)")
+	g.writeLine("return")
 	g.indent--
 	g.writeLine("}")
+	g.writeLine("if buf[0] == 3 { // Ctrl+C")
+	g.indent++
+	g.writeLine("restore()")
+	g.writeLine("os.Exit(1)")
 	g.indent--
 	g.writeLine("}")
+	g.emitKeyboardSend("buf[0]")
 	g.indent--
 	g.writeLine("}")
-	g.writeLine("w.Flush()")
 	g.indent--
-	g.writeLine("}()")
-	g.writeLine("")
-
-	// Error writer goroutine — same CR/LF handling
-	g.writeLine("go func() {")
+	g.writeLine("} else {")
 	g.indent++
-	g.writeLine("defer wg.Done()")
-	g.writeLine("w := bufio.NewWriter(os.Stderr)")
-	g.writeLine("for b := range _error {")
+	g.writeLine("r := bufio.NewReader(stdin)")
+	g.writeLine("for {")
+	g.indent++
+	g.writeLine("b, err := r.ReadByte()")
+	g.writeLine("if err != nil {")
+	g.indent++
+	g.writeLine("close(keyboard)")
+	g.writeLine("return")
+	g.indent--
+	g.writeLine("}")
+	g.emitKeyboardSend("b")
+	g.indent--
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}()")
+	g.writeLine("")
+
+	// Call the entry proc
+	args := "keyboard, screen, _error"
+	if extra != "" {
+		args += ", " + extra
+	}
+	g.writeLine(fmt.Sprintf("%s(%s)", name, args))
+	g.writeLine("")
+
+	// Stop the keyboard reader, interrupting its read where stdin allows
+	g.writeLine("close(done)")
+	g.writeLine("if d, ok := stdin.(interface{ SetReadDeadline(time.Time) error }); ok {")
+	g.writeLine("\td.SetReadDeadline(time.Now())")
+	g.writeLine("}")
+	g.writeLine("")
+
+	// Close output channels and wait for writers to drain
+	g.writeLine("close(screen)")
+	g.writeLine("close(_error)")
+	if extra == "_error2" || extra == "_status" {
+		g.writeLine(fmt.Sprintf("close(%s)", extra))
+	}
+	g.writeLine("wg.Wait()")
+	if g.leakCheck {
+		g.writeLine(g.prefix + "_leakCheck(stderr)")
+	}
+	if extra == "_status" {
+		g.writeLine("return status")
+	}
+
+	g.indent--
+	g.writeLine("}")
+}
+
+// emitKeyboardSend emits the keyboard reader's send of b, which returns
+// from the reader instead once the entry PROC has ended.
+func (g *Generator) emitKeyboardSend(b string) {
+	g.writeLine("select {")
+	g.writeLine("case keyboard <- " + b + ":")
+	g.writeLine("case <-done:")
+	g.writeLine("\treturn")
+	g.writeLine("}")
+}
+
+// emitLeakCheckHelper emits _leakCheck, which the entry harness calls when
+// the entry PROC has finished, and the table of PROC and FUNCTION names it
+// finds goroutines' PROCs by. Closures (PAR branches, nested PROCs) count
+// as the top-level PROC they are in.
+func (g *Generator) emitLeakCheckHelper(decls []ast.Statement) {
+	g.writeLine("")
+	g.writeLine("// " + g.prefix + "_leakProcs maps the Go names of the PROCs and FUNCTIONs to their occam names.")
+	g.writeLine("var " + g.prefix + "_leakProcs = map[string]string{")
+	for _, decl := range decls {
+		var name string
+		switch d := decl.(type) {
+		case *ast.ProcDecl:
+			name = d.Name
+		case *ast.FuncDecl:
+			name = d.Name
+		}
+		g.writeLine(fmt.Sprintf("\t%q: %q,", g.procIdent(name), name))
+	}
+	for _, name := range g.cycleNames() {
+		g.writeLine(fmt.Sprintf("\t%q: %q,", g.prefix+"_"+name, name))
+	}
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("// " + g.prefix + "_leakCheck writes to w the goroutines still running PROCs, giving")
+	g.writeLine("// them a moment to finish first.")
+	g.writeLine("func " + g.prefix + "_leakCheck(w io.Writer) {")
+	g.writeLine("\tvar live []string")
+	g.writeLine("\tfor try := 0; try < 10; try++ {")
+	g.writeLine("\t\tif try > 0 {")
+	g.writeLine("\t\t\ttime.Sleep(10 * time.Millisecond)")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\tbuf := make([]byte, 1<<20)")
+	g.writeLine("\t\tstacks := strings.Split(string(buf[:runtime.Stack(buf, true)]), \"\\n\\n\")")
+	g.writeLine("\t\tlive = live[:0]")
+	g.writeLine("\t\tfor _, stack := range stacks[1:] { // the first is this goroutine")
+	g.writeLine("\t\t\tif proc := " + g.prefix + "_leakProc(stack); proc != \"\" {")
+	g.writeLine("\t\t\t\tlive = append(live, proc)")
+	g.writeLine("\t\t\t}")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\tif len(live) == 0 {")
+	g.writeLine("\t\t\treturn")
+	g.writeLine("\t\t}")
+	g.writeLine("\t}")
+	g.writeLine("\tfmt.Fprintf(w, \"leak: %d goroutine(s) still running at exit:\\n\", len(live))")
+	g.writeLine("\tfor _, proc := range live {")
+	g.writeLine("\t\tfmt.Fprintf(w, \"  PROC %s\\n\", proc)")
+	g.writeLine("\t}")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("// " + g.prefix + "_leakProc returns the occam name of the innermost PROC in a")
+	g.writeLine("// goroutine's stack trace with the goroutine's state, or \"\" if it runs none.")
+	g.writeLine("func " + g.prefix + "_leakProc(stack string) string {")
+	g.writeLine("\tlines := strings.Split(stack, \"\\n\")")
+	g.writeLine("\tstate := \"\"")
+	g.writeLine("\tif i := strings.Index(lines[0], \"[\"); i >= 0 {")
+	g.writeLine("\t\tstate = \" \" + strings.TrimSuffix(lines[0][i:], \":\")")
+	g.writeLine("\t}")
+	g.writeLine("\tfor _, line := range lines[1:] {")
+	g.writeLine("\t\tif strings.HasPrefix(line, \"\\t\") || strings.HasPrefix(line, \"created by \") {")
+	g.writeLine("\t\t\tcontinue")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\tif i := strings.LastIndex(line, \"(\"); i >= 0 {")
+	g.writeLine("\t\t\tline = line[:i]")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\t// Drop the package, and the closure of proc.func1")
+	g.writeLine("\t\t_, fn, _ := strings.Cut(line[strings.LastIndex(line, \"/\")+1:], \".\")")
+	g.writeLine("\t\tfn, _, _ = strings.Cut(fn, \".\")")
+	g.writeLine("\t\tif name, ok := " + g.prefix + "_leakProcs[fn]; ok {")
+	g.writeLine("\t\t\treturn name + state")
+	g.writeLine("\t\t}")
+	g.writeLine("\t}")
+	g.writeLine("\treturn \"\"")
+	g.writeLine("}")
+}
+
+// errorChanNames are the names, before any dot, of the channel params that
+// WithErrorWrappers takes as a PROC's error channel.
+var errorChanNames = map[string]bool{"error": true, "err": true, "report": true}
+
+// collectErrorChans finds the PROCs among decls that WithErrorWrappers
+// wraps, and the index of each one's error channel.
+func (g *Generator) collectErrorChans(decls []ast.Statement) {
+	g.errorChans = make(map[*ast.ProcDecl]int)
+	for _, decl := range decls {
+		proc, ok := decl.(*ast.ProcDecl)
+		if !ok {
+			continue
+		}
+		index := -1
+		for i, p := range proc.Params {
+			name, _, _ := strings.Cut(p.Name, ".")
+			if p.TypeRef.Kind != ast.ChanType || p.ChanDir != "!" || !errorChanNames[name] {
+				continue
+			}
+			if proto := g.protocolDefs[chanElemType(p.TypeRef)]; proto == nil || proto.Kind != "variant" {
+				continue
+			}
+			if index >= 0 {
+				index = -1 // more than one: none is the error channel
+				break
+			}
+			index = i
+		}
+		if index < 0 {
+			continue
+		}
+		wrapper := g.procIdent(proc.Name) + "Err"
+		for _, name := range g.exported {
+			if name == wrapper {
+				g.warnings = append(g.warnings, fmt.Sprintf("line %d: no error wrapper for PROC %s: %s is already declared", proc.Token.Line, proc.Name, wrapper))
+				index = -1
+			}
+		}
+		if index < 0 {
+			continue
+		}
+		g.errorChans[proc] = index
+		for _, v := range g.protocolDefs[chanElemType(proc.Params[index].TypeRef)].Variants {
+			if len(v.Types) > 0 {
+				g.needFmt = true
+			}
+		}
+	}
+}
+
+// emitErrorWrappers emits the functions WithErrorWrappers adds for the PROCs
+// among decls, and Error methods for the tag types of their error channels.
+func (g *Generator) emitErrorWrappers(decls []ast.Statement) {
+	var protos []string
+	seen := make(map[string]bool)
+	for _, decl := range decls {
+		proc, ok := decl.(*ast.ProcDecl)
+		if !ok {
+			continue
+		}
+		index, ok := g.errorChans[proc]
+		if !ok {
+			continue
+		}
+		errChan := proc.Params[index]
+		if proto := chanElemType(errChan.TypeRef); !seen[proto] {
+			seen[proto] = true
+			protos = append(protos, proto)
+		}
+
+		// Params passed by reference become results
+		var params, results, refs, args []string
+		for i, p := range proc.Params {
+			name := goIdent(p.Name)
+			switch {
+			case i == index:
+				args = append(args, "_errs")
+			case !p.IsVal && p.TypeRef.IsData():
+				results = append(results, g.goType(p.TypeRef, ""))
+				refs = append(refs, name)
+				args = append(args, "&"+name)
+			default:
+				params = append(params, fmt.Sprintf("%s %s", name, g.paramGoType(proc.Params, i)))
+				args = append(args, name)
+			}
+		}
+		procName := g.procIdent(proc.Name)
+		g.writeLine(fmt.Sprintf("// %sErr calls %s, returning as an error the first message it sends on %s.", procName, procName, errChan.Name))
+		g.writeLine(fmt.Sprintf("func %sErr(%s) (%s) {", procName, strings.Join(params, ", "), strings.Join(append(results, "error"), ", ")))
+		g.indent++
+		for i, name := range refs {
+			g.writeLine(fmt.Sprintf("var %s %s", name, results[i]))
+		}
+		g.writeLine(fmt.Sprintf("_errs := make(chan %s)", g.protoType(chanElemType(errChan.TypeRef))))
+		g.writeLine("_done := make(chan struct{})")
+		g.writeLine("go func() {")
+		g.writeLine("\tdefer close(_done)")
+		g.writeLine(fmt.Sprintf("\t%s(%s)", procName, strings.Join(args, ", ")))
+		g.writeLine("}()")
+		g.writeLine("var _err error")
+		g.writeLine("for {")
+		g.writeLine("\tselect {")
+		g.writeLine("\tcase _m := <-_errs:")
+		g.writeLine("\t\tif _err == nil {")
+		g.writeLine("\t\t\t_err = _m.(error)")
+		g.writeLine("\t\t}")
+		g.writeLine("\tcase <-_done:")
+		g.writeLine(fmt.Sprintf("\t\treturn %s", strings.Join(append(refs, "_err"), ", ")))
+		g.writeLine("\t}")
+		g.writeLine("}")
+		g.indent--
+		g.writeLine("}")
+		g.writeLine("")
+	}
+
+	// A tag inherited through EXTENDS has its base PROTOCOL's type
+	methods := make(map[string]bool)
+	for _, name := range protos {
+		for _, v := range g.protocolDefs[name].Variants {
+			typ := g.variantType(name, v.Tag)
+			if methods[typ] {
+				continue
+			}
+			methods[typ] = true
+			fieldTypes := g.protocolFieldTypes(v.Items)
+			if len(fieldTypes) == 0 {
+				g.writeLine(fmt.Sprintf("func (%s) Error() string { return %q }", typ, v.Tag))
+				continue
+			}
+			// The fields follow the tag as in occam: bad.digit; 'x'
+			format := v.Tag
+			var fields []string
+			for i, goType := range fieldTypes {
+				verb := "%v"
+				if goType == "byte" || goType == "[]byte" {
+					verb = "%q"
+				}
+				format += "; " + verb
+				fields = append(fields, "m."+g.protoField(i))
+			}
+			g.writeLine(fmt.Sprintf("func (m %s) Error() string { return fmt.Sprintf(%q, %s) }", typ, format, strings.Join(fields, ", ")))
+		}
+	}
+	g.writeLine("")
+}
+
+// emitByteWriter emits a goroutine draining a byte channel to the writer w.
+// Byte 255 flushes; in raw terminal mode a CR is inserted before each LF.
+func (g *Generator) emitByteWriter(ch, w string) {
+	g.writeLine("go func() {")
+	g.indent++
+	g.writeLine("defer wg.Done()")
+	g.writeLine(fmt.Sprintf("w := bufio.NewWriter(%s)", w))
+	g.writeLine(fmt.Sprintf("for b := range %s {", ch))
 	g.indent++
 	g.writeLine("if b == 255 {")
 	g.indent++
@@ -526,7 +2487,7 @@ func (g *Generator) generateEntryHarness(proc *ast.ProcDecl) {
 	g.writeLine(`w.WriteByte('\r')`)
 	g.writeLine("}")
 	g.writeLine("w.WriteByte(b)")
-	g.writeLine("if len(_error) == 0 {")
+	g.writeLine(fmt.Sprintf("if len(%s) == 0 {", ch))
 	g.indent++
 	g.writeLine("w.Flush()")
 	g.indent--
@@ -539,69 +2500,235 @@ func (g *Generator) generateEntryHarness(proc *ast.ProcDecl) {
 	g.indent--
 	g.writeLine("}()")
 	g.writeLine("")
+}
+
+// screenTag is how the entry harness renders one variant of a screen
+// PROTOCOL on a terminal. payload lists the tag's item types, where "INT"
+// is any integer type and "::[]BYTE" a counted BYTE array; write is the Go
+// to emit, with {0}, {1}, ... standing for the message's struct fields.
+type screenTag struct {
+	payload []string
+	write   string
+}
+
+// screenTags are the terminal-control variants the entry harness knows, by
+// tag name. A screen PROTOCOL all of whose tags are here, with these
+// payloads, is rendered with ANSI escape sequences; any other is written to
+// stdout as JSON, one {"args": [...], "tag": name} object per message.
+// Supporting another terminal protocol is a matter of adding its tags.
+var screenTags = map[string]screenTag{
+	"char":      {[]string{"BYTE"}, "w.WriteByte({0})"},
+	"string":    {[]string{"::[]BYTE"}, "w.Write({1})"},
+	"int":       {[]string{"INT"}, "fmt.Fprint(w, {0})"},
+	"newline":   {nil, "if rawMode {\n\tw.WriteByte('\\r')\n}\nw.WriteByte('\\n')"},
+	"goto":      {[]string{"INT", "INT"}, `fmt.Fprintf(w, "\x1b[%d;%dH", {1}, {0})`},
+	"clear":     {nil, `w.WriteString("\x1b[2J\x1b[H")`},
+	"home":      {nil, `w.WriteString("\x1b[H")`},
+	"erase.eol": {nil, `w.WriteString("\x1b[K")`},
+	"up":        {[]string{"INT"}, `fmt.Fprintf(w, "\x1b[%dA", {0})`},
+	"down":      {[]string{"INT"}, `fmt.Fprintf(w, "\x1b[%dB", {0})`},
+	"right":     {[]string{"INT"}, `fmt.Fprintf(w, "\x1b[%dC", {0})`},
+	"left":      {[]string{"INT"}, `fmt.Fprintf(w, "\x1b[%dD", {0})`},
+	"bell":      {nil, "w.WriteByte(7)"},
+	"flush":     {nil, "w.Flush()"},
+}
+
+// isTerminalProtocol reports whether every variant of proto is one of
+// screenTags with the payload it expects.
+func (g *Generator) isTerminalProtocol(proto *ast.ProtocolDecl) bool {
+	for _, v := range proto.Variants {
+		tag, ok := screenTags[v.Tag]
+		if !ok || len(tag.payload) != len(v.Types) {
+			return false
+		}
+		for i, t := range v.Types {
+			switch want := tag.payload[i]; want {
+			case "INT":
+				ok = isOccamIntType(g.primitiveType(t))
+			case "::[]BYTE":
+				_, elem, counted := ast.CountedArray(t)
+				ok = counted && g.primitiveType(elem) == "BYTE"
+			default:
+				ok = g.primitiveType(t) == want
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// screenNeedsFmt reports whether rendering terminal protocol proto uses fmt.
+func (g *Generator) screenNeedsFmt(proto *ast.ProtocolDecl) bool {
+	for _, v := range proto.Variants {
+		if strings.Contains(screenTags[v.Tag].write, "fmt.") {
+			return true
+		}
+	}
+	return false
+}
+
+// emitScreenWriter emits a goroutine draining the screen channel, which
+// carries variant PROTOCOL proto, to stdout: as terminal output if proto is
+// a terminal protocol, as JSON lines otherwise.
+func (g *Generator) emitScreenWriter(proto *ast.ProtocolDecl) {
+	terminal := g.isTerminalProtocol(proto)
+	cases := make([][]string, len(proto.Variants))
+	usesFields := false
+	for i, v := range proto.Variants {
+		fields := make([]string, len(g.protocolFieldTypes(v.Items)))
+		for j := range fields {
+			fields[j] = "m." + g.protoField(j)
+		}
+		usesFields = usesFields || len(fields) > 0
+		if terminal {
+			code := screenTags[v.Tag].write
+			for j, f := range fields {
+				code = strings.ReplaceAll(code, fmt.Sprintf("{%d}", j), f)
+			}
+			cases[i] = strings.Split(code, "\n")
+			continue
+		}
+		// JSON: the items, with a counted array as its elements and no
+		// count, and BYTE arrays as strings
+		var args []string
+		j := 0
+		for _, t := range v.Types {
+			if _, elem, ok := ast.CountedArray(t); ok {
+				if g.primitiveType(elem) == "BYTE" {
+					args = append(args, "string("+fields[j+1]+")")
+				} else {
+					args = append(args, fields[j+1])
+				}
+				j += 2
+				continue
+			}
+			if _, elem, ok := ast.FixedArray(t); ok && g.primitiveType(elem) == "BYTE" {
+				args = append(args, "string("+fields[j]+")")
+				j++
+				continue
+			}
+			args = append(args, fields[j])
+			j++
+		}
+		cases[i] = []string{fmt.Sprintf(`enc.Encode(map[string]interface{}{"tag": %q, "args": []interface{}{%s}})`, v.Tag, strings.Join(args, ", "))}
+	}
 
-	// Keyboard reader goroutine
 	g.writeLine("go func() {")
 	g.indent++
-	g.writeLine("if rawMode {")
-	g.indent++
-	g.writeLine("buf := make([]byte, 1)")
-	g.writeLine("for {")
-	g.indent++
-	g.writeLine("n, err := os.Stdin.Read(buf)")
-	g.writeLine("if err != nil || n == 0 {")
-	g.indent++
-	g.writeLine("close(keyboard)")
-	g.writeLine("return")
-	g.indent--
-	g.writeLine("}")
-	g.writeLine("if buf[0] == 3 { // Ctrl+C")
+	g.writeLine("defer wg.Done()")
+	g.writeLine("w := bufio.NewWriter(stdout)")
+	if !terminal {
+		g.writeLine("enc := json.NewEncoder(w)")
+	}
+	g.writeLine("for m := range screen {")
 	g.indent++
-	g.writeLine("term.Restore(fd, oldState)")
-	g.writeLine("os.Exit(1)")
-	g.indent--
-	g.writeLine("}")
-	g.writeLine("keyboard <- buf[0]")
-	g.indent--
+	if usesFields {
+		g.writeLine("switch m := m.(type) {")
+	} else {
+		g.writeLine("switch m.(type) {")
+	}
+	for i, v := range proto.Variants {
+		g.writeLine(fmt.Sprintf("case %s:", g.variantType(proto.Name, v.Tag)))
+		g.indent++
+		for _, line := range cases[i] {
+			g.writeLine(line)
+		}
+		g.indent--
+	}
 	g.writeLine("}")
-	g.indent--
-	g.writeLine("} else {")
-	g.indent++
-	g.writeLine("r := bufio.NewReader(os.Stdin)")
-	g.writeLine("for {")
-	g.indent++
-	g.writeLine("b, err := r.ReadByte()")
-	g.writeLine("if err != nil {")
+	g.writeLine("if len(screen) == 0 {")
 	g.indent++
-	g.writeLine("close(keyboard)")
-	g.writeLine("return")
-	g.indent--
-	g.writeLine("}")
-	g.writeLine("keyboard <- b")
+	g.writeLine("w.Flush()")
 	g.indent--
 	g.writeLine("}")
 	g.indent--
 	g.writeLine("}")
+	g.writeLine("w.Flush()")
 	g.indent--
 	g.writeLine("}()")
 	g.writeLine("")
+}
 
-	// Call the entry proc
-	g.writeLine(fmt.Sprintf("%s(keyboard, screen, _error)", name))
-	g.writeLine("")
-
-	// Close output channels and wait for writers to drain
-	g.writeLine("close(screen)")
-	g.writeLine("close(_error)")
-	g.writeLine("wg.Wait()")
+// countStats adds the constructs in a statement tree to g.stats.
+func (g *Generator) countStats(stmt ast.Statement) {
+	var body []ast.Statement
+	switch s := stmt.(type) {
+	case *ast.ProcDecl:
+		g.stats.Procs++
+		body = s.Body
+	case *ast.FuncDecl:
+		g.stats.Functions++
+		body = s.Body
+	case *ast.ChanDecl:
+		g.stats.Channels += len(s.Names)
+	case *ast.ProtocolDecl:
+		g.stats.Protocols++
+	case *ast.PlaceDecl:
+		g.stats.Skipped = append(g.stats.Skipped, fmt.Sprintf("line %d: PLACE %s AT (placement)", s.Token.Line, s.Name))
+	case *ast.Unsupported:
+		g.stats.Skipped = append(g.stats.Skipped, fmt.Sprintf("line %d: unsupported: %s", s.Token.Line, s.Text))
+	case *ast.ParBlock:
+		g.stats.ParBranches += len(s.Branches())
+		if s.Processors != nil {
+			g.stats.Skipped = append(g.stats.Skipped, fmt.Sprintf("line %d: PLACED PAR (processor placement)", s.Token.Line))
+		}
+		body = s.Statements
+	case *ast.AltBlock:
+		if !s.ExtendedInput {
+			g.stats.Alts++
+		}
+		if s.Replicator != nil {
+			g.stats.ReflectAlts = append(g.stats.ReflectAlts, fmt.Sprintf("line %d: replicated ALT", s.Token.Line))
+		}
+		for _, c := range s.Cases {
+			body = append(body, c.Declarations...)
+			body = append(body, c.Body...)
+		}
+	case *ast.SeqBlock:
+		body = s.Statements
+	case *ast.IfStatement:
+		for _, choice := range s.Choices {
+			if choice.NestedIf != nil {
+				body = append(body, choice.NestedIf)
+			}
+			body = append(body, choice.Body...)
+		}
+	case *ast.CaseStatement:
+		for _, choice := range s.Choices {
+			body = append(body, choice.Body...)
+		}
+	case *ast.WhileLoop:
+		body = s.Body
+	case *ast.ClaimBlock:
+		body = s.Body
+	case *ast.ForkingBlock:
+		body = s.Body
+	case *ast.VariantReceive:
+		for _, c := range s.Cases {
+			body = append(body, c.Declarations...)
+			body = append(body, c.Body...)
+		}
+	}
+	for _, inner := range body {
+		g.countStats(inner)
+	}
+}
 
-	g.indent--
-	g.writeLine("}")
+// skip records a statement or expression the generator has no translation
+// for, which is left out of the Go.
+func (g *Generator) skip(node ast.Node) {
+	if node == nil || g.skippedNodes[node] {
+		return
+	}
+	g.skippedNodes[node] = true
+	g.stats.Skipped = append(g.stats.Skipped, fmt.Sprintf("%T %q", node, node.TokenLiteral()))
 }
 
 func (g *Generator) containsPar(stmt ast.Statement) bool {
 	switch s := stmt.(type) {
-	case *ast.ParBlock:
+	case *ast.ParBlock, *ast.ForkingBlock:
 		return true
 	case *ast.SeqBlock:
 		for _, inner := range s.Statements {
@@ -629,6 +2756,12 @@ func (g *Generator) containsPar(stmt ast.Statement) bool {
 				return true
 			}
 		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsPar(inner) {
+				return true
+			}
+		}
 	case *ast.WhileLoop:
 		for _, inner := range s.Body {
 			if g.containsPar(inner) {
@@ -668,57 +2801,87 @@ func (g *Generator) containsPar(stmt ast.Statement) bool {
 	return false
 }
 
-func (g *Generator) containsPrint(stmt ast.Statement) bool {
+// valofBodies returns the bodies of the VALOF expressions in stmts, as SEQs,
+// for the checks of the first pass, which look for statements only where
+// statements go.
+func (g *Generator) valofBodies(stmts []ast.Statement) []ast.Statement {
+	var bodies []ast.Statement
+	for _, stmt := range stmts {
+		g.walkStatements(stmt, func(e ast.Expression) bool {
+			if v, ok := e.(*ast.ValofExpr); ok {
+				bodies = append(bodies, &ast.SeqBlock{Token: v.Token, Statements: v.Body})
+			}
+			return false
+		})
+	}
+	return bodies
+}
+
+// containsPriPar checks if a statement tree contains a PRI PAR.
+func (g *Generator) containsPriPar(stmt ast.Statement) bool {
 	switch s := stmt.(type) {
-	case *ast.ProcCall:
-		return printBuiltins[s.Name]
-	case *ast.SeqBlock:
+	case *ast.ParBlock:
+		if s.Priority {
+			return true
+		}
 		for _, inner := range s.Statements {
-			if g.containsPrint(inner) {
+			if g.containsPriPar(inner) {
 				return true
 			}
 		}
-	case *ast.ParBlock:
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			if g.containsPriPar(inner) {
+				return true
+			}
+		}
+	case *ast.SeqBlock:
 		for _, inner := range s.Statements {
-			if g.containsPrint(inner) {
+			if g.containsPriPar(inner) {
 				return true
 			}
 		}
 	case *ast.AltBlock:
 		for _, c := range s.Cases {
 			for _, inner := range c.Body {
-				if g.containsPrint(inner) {
+				if g.containsPriPar(inner) {
 					return true
 				}
 			}
 		}
 	case *ast.ProcDecl:
 		for _, inner := range s.Body {
-			if g.containsPrint(inner) {
+			if g.containsPriPar(inner) {
 				return true
 			}
 		}
 	case *ast.FuncDecl:
 		for _, inner := range s.Body {
-			if g.containsPrint(inner) {
+			if g.containsPriPar(inner) {
+				return true
+			}
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsPriPar(inner) {
 				return true
 			}
 		}
 	case *ast.WhileLoop:
 		for _, inner := range s.Body {
-			if g.containsPrint(inner) {
+			if g.containsPriPar(inner) {
 				return true
 			}
 		}
 	case *ast.IfStatement:
 		for _, choice := range s.Choices {
 			if choice.NestedIf != nil {
-				if g.containsPrint(choice.NestedIf) {
+				if g.containsPriPar(choice.NestedIf) {
 					return true
 				}
 			}
 			for _, inner := range choice.Body {
-				if g.containsPrint(inner) {
+				if g.containsPriPar(inner) {
 					return true
 				}
 			}
@@ -726,7 +2889,7 @@ func (g *Generator) containsPrint(stmt ast.Statement) bool {
 	case *ast.CaseStatement:
 		for _, choice := range s.Choices {
 			for _, inner := range choice.Body {
-				if g.containsPrint(inner) {
+				if g.containsPriPar(inner) {
 					return true
 				}
 			}
@@ -734,7 +2897,7 @@ func (g *Generator) containsPrint(stmt ast.Statement) bool {
 	case *ast.VariantReceive:
 		for _, c := range s.Cases {
 			for _, inner := range c.Body {
-				if g.containsPrint(inner) {
+				if g.containsPriPar(inner) {
 					return true
 				}
 			}
@@ -743,60 +2906,73 @@ func (g *Generator) containsPrint(stmt ast.Statement) bool {
 	return false
 }
 
-func (g *Generator) containsTimer(stmt ast.Statement) bool {
+// containsProcCall checks if a statement tree calls a PROC whose name
+// satisfies match.
+func (g *Generator) containsProcCall(stmt ast.Statement, match func(name string) bool) bool {
 	switch s := stmt.(type) {
-	case *ast.TimerDecl, *ast.TimerRead, *ast.TimerAfterWait:
-		return true
-	case *ast.AltBlock:
-		for _, c := range s.Cases {
-			if c.IsTimer {
-				return true
-			}
-			for _, inner := range c.Body {
-				if g.containsTimer(inner) {
-					return true
-				}
-			}
-		}
+	case *ast.ProcCall:
+		return match(s.Name)
+	case *ast.ForkStmt:
+		return g.containsProcCall(s.Call, match)
 	case *ast.SeqBlock:
 		for _, inner := range s.Statements {
-			if g.containsTimer(inner) {
+			if g.containsProcCall(inner, match) {
 				return true
 			}
 		}
 	case *ast.ParBlock:
 		for _, inner := range s.Statements {
-			if g.containsTimer(inner) {
-				return true
-			}
-		}
-	case *ast.ProcDecl:
-		for _, inner := range s.Body {
-			if g.containsTimer(inner) {
+			if g.containsProcCall(inner, match) {
+				return true
+			}
+		}
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				if g.containsProcCall(inner, match) {
+					return true
+				}
+			}
+		}
+	case *ast.ProcDecl:
+		for _, inner := range s.Body {
+			if g.containsProcCall(inner, match) {
 				return true
 			}
 		}
 	case *ast.FuncDecl:
 		for _, inner := range s.Body {
-			if g.containsTimer(inner) {
+			if g.containsProcCall(inner, match) {
+				return true
+			}
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsProcCall(inner, match) {
+				return true
+			}
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			if g.containsProcCall(inner, match) {
 				return true
 			}
 		}
 	case *ast.WhileLoop:
 		for _, inner := range s.Body {
-			if g.containsTimer(inner) {
+			if g.containsProcCall(inner, match) {
 				return true
 			}
 		}
 	case *ast.IfStatement:
 		for _, choice := range s.Choices {
 			if choice.NestedIf != nil {
-				if g.containsTimer(choice.NestedIf) {
+				if g.containsProcCall(choice.NestedIf, match) {
 					return true
 				}
 			}
 			for _, inner := range choice.Body {
-				if g.containsTimer(inner) {
+				if g.containsProcCall(inner, match) {
 					return true
 				}
 			}
@@ -804,7 +2980,7 @@ func (g *Generator) containsTimer(stmt ast.Statement) bool {
 	case *ast.CaseStatement:
 		for _, choice := range s.Choices {
 			for _, inner := range choice.Body {
-				if g.containsTimer(inner) {
+				if g.containsProcCall(inner, match) {
 					return true
 				}
 			}
@@ -812,7 +2988,7 @@ func (g *Generator) containsTimer(stmt ast.Statement) bool {
 	case *ast.VariantReceive:
 		for _, c := range s.Cases {
 			for _, inner := range c.Body {
-				if g.containsTimer(inner) {
+				if g.containsProcCall(inner, match) {
 					return true
 				}
 			}
@@ -821,57 +2997,72 @@ func (g *Generator) containsTimer(stmt ast.Statement) bool {
 	return false
 }
 
-func (g *Generator) containsStop(stmt ast.Statement) bool {
+func (g *Generator) containsTimer(stmt ast.Statement) bool {
 	switch s := stmt.(type) {
-	case *ast.Stop:
+	case *ast.TimerDecl, *ast.TimerRead, *ast.TimerAfterWait:
 		return true
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			if c.IsTimer {
+				return true
+			}
+			for _, inner := range c.Body {
+				if g.containsTimer(inner) {
+					return true
+				}
+			}
+		}
 	case *ast.SeqBlock:
 		for _, inner := range s.Statements {
-			if g.containsStop(inner) {
+			if g.containsTimer(inner) {
 				return true
 			}
 		}
 	case *ast.ParBlock:
 		for _, inner := range s.Statements {
-			if g.containsStop(inner) {
+			if g.containsTimer(inner) {
 				return true
 			}
 		}
-	case *ast.AltBlock:
-		for _, c := range s.Cases {
-			for _, inner := range c.Body {
-				if g.containsStop(inner) {
-					return true
-				}
-			}
-		}
 	case *ast.ProcDecl:
 		for _, inner := range s.Body {
-			if g.containsStop(inner) {
+			if g.containsTimer(inner) {
 				return true
 			}
 		}
 	case *ast.FuncDecl:
 		for _, inner := range s.Body {
-			if g.containsStop(inner) {
+			if g.containsTimer(inner) {
+				return true
+			}
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsTimer(inner) {
+				return true
+			}
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			if g.containsTimer(inner) {
 				return true
 			}
 		}
 	case *ast.WhileLoop:
 		for _, inner := range s.Body {
-			if g.containsStop(inner) {
+			if g.containsTimer(inner) {
 				return true
 			}
 		}
 	case *ast.IfStatement:
 		for _, choice := range s.Choices {
 			if choice.NestedIf != nil {
-				if g.containsStop(choice.NestedIf) {
+				if g.containsTimer(choice.NestedIf) {
 					return true
 				}
 			}
 			for _, inner := range choice.Body {
-				if g.containsStop(inner) {
+				if g.containsTimer(inner) {
 					return true
 				}
 			}
@@ -879,7 +3070,7 @@ func (g *Generator) containsStop(stmt ast.Statement) bool {
 	case *ast.CaseStatement:
 		for _, choice := range s.Choices {
 			for _, inner := range choice.Body {
-				if g.containsStop(inner) {
+				if g.containsTimer(inner) {
 					return true
 				}
 			}
@@ -887,7 +3078,7 @@ func (g *Generator) containsStop(stmt ast.Statement) bool {
 	case *ast.VariantReceive:
 		for _, c := range s.Cases {
 			for _, inner := range c.Body {
-				if g.containsStop(inner) {
+				if g.containsTimer(inner) {
 					return true
 				}
 			}
@@ -896,113 +3087,181 @@ func (g *Generator) containsStop(stmt ast.Statement) bool {
 	return false
 }
 
-func (g *Generator) containsMostExpr(stmt ast.Statement) bool {
+// containsBarrier reports whether stmt declares, takes, enrolls on or
+// synchronises on a BARRIER.
+func (g *Generator) containsBarrier(stmt ast.Statement) bool {
 	switch s := stmt.(type) {
-	case *ast.Assignment:
-		result := g.exprNeedsMath(s.Value)
-		for _, idx := range s.Indices {
-			result = result || g.exprNeedsMath(idx)
-		}
-		return result
-	case *ast.MultiAssignment:
-		for _, t := range s.Targets {
-			for _, idx := range t.Indices {
-				if g.exprNeedsMath(idx) {
+	case *ast.BarrierDecl, *ast.SyncStmt:
+		return true
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				if g.containsBarrier(inner) {
 					return true
 				}
 			}
 		}
-		for _, v := range s.Values {
-			if g.exprNeedsMath(v) {
-				return true
-			}
-		}
-	case *ast.Abbreviation:
-		return g.exprNeedsMath(s.Value)
 	case *ast.SeqBlock:
 		for _, inner := range s.Statements {
-			if g.containsMostExpr(inner) {
+			if g.containsBarrier(inner) {
 				return true
 			}
 		}
 	case *ast.ParBlock:
+		if len(s.Enroll) > 0 {
+			return true
+		}
 		for _, inner := range s.Statements {
-			if g.containsMostExpr(inner) {
+			if g.containsBarrier(inner) {
 				return true
 			}
 		}
 	case *ast.ProcDecl:
+		for _, p := range s.Params {
+			if p.Type == "BARRIER" {
+				return true
+			}
+		}
 		for _, inner := range s.Body {
-			if g.containsMostExpr(inner) {
+			if g.containsBarrier(inner) {
 				return true
 			}
 		}
 	case *ast.FuncDecl:
 		for _, inner := range s.Body {
-			if g.containsMostExpr(inner) {
+			if g.containsBarrier(inner) {
 				return true
 			}
 		}
-	case *ast.WhileLoop:
-		if g.exprNeedsMath(s.Condition) {
-			return true
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsBarrier(inner) {
+				return true
+			}
 		}
+	case *ast.ForkingBlock:
 		for _, inner := range s.Body {
-			if g.containsMostExpr(inner) {
+			if g.containsBarrier(inner) {
+				return true
+			}
+		}
+	case *ast.WhileLoop:
+		for _, inner := range s.Body {
+			if g.containsBarrier(inner) {
 				return true
 			}
 		}
 	case *ast.IfStatement:
 		for _, choice := range s.Choices {
 			if choice.NestedIf != nil {
-				if g.containsMostExpr(choice.NestedIf) {
+				if g.containsBarrier(choice.NestedIf) {
 					return true
 				}
 			}
-			if g.exprNeedsMath(choice.Condition) {
-				return true
-			}
 			for _, inner := range choice.Body {
-				if g.containsMostExpr(inner) {
+				if g.containsBarrier(inner) {
 					return true
 				}
 			}
 		}
 	case *ast.CaseStatement:
-		if g.exprNeedsMath(s.Selector) {
-			return true
-		}
 		for _, choice := range s.Choices {
-			for _, v := range choice.Values {
-				if g.exprNeedsMath(v) {
+			for _, inner := range choice.Body {
+				if g.containsBarrier(inner) {
 					return true
 				}
 			}
-			for _, inner := range choice.Body {
-				if g.containsMostExpr(inner) {
+		}
+	case *ast.VariantReceive:
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				if g.containsBarrier(inner) {
 					return true
 				}
 			}
 		}
-	case *ast.Send:
-		if g.exprNeedsMath(s.Value) {
-			return true
+	}
+	return false
+}
+
+// containsSharedChan reports whether stmt declares or takes a SHARED
+// channel.
+func (g *Generator) containsSharedChan(stmt ast.Statement) bool {
+	switch s := stmt.(type) {
+	case *ast.ChanDecl:
+		return s.Shared
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				if g.containsSharedChan(inner) {
+					return true
+				}
+			}
 		}
-		for _, v := range s.Values {
-			if g.exprNeedsMath(v) {
+	case *ast.SeqBlock:
+		for _, inner := range s.Statements {
+			if g.containsSharedChan(inner) {
 				return true
 			}
 		}
-	case *ast.ProcCall:
-		for _, arg := range s.Args {
-			if g.exprNeedsMath(arg) {
+	case *ast.ParBlock:
+		for _, inner := range s.Statements {
+			if g.containsSharedChan(inner) {
 				return true
 			}
 		}
-	case *ast.AltBlock:
-		for _, c := range s.Cases {
-			for _, inner := range c.Body {
-				if g.containsMostExpr(inner) {
+	case *ast.ProcDecl:
+		for _, p := range s.Params {
+			if p.IsChan && p.Shared {
+				return true
+			}
+		}
+		for _, inner := range s.Body {
+			if g.containsSharedChan(inner) {
+				return true
+			}
+		}
+	case *ast.FuncDecl:
+		for _, inner := range s.Body {
+			if g.containsSharedChan(inner) {
+				return true
+			}
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsSharedChan(inner) {
+				return true
+			}
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			if g.containsSharedChan(inner) {
+				return true
+			}
+		}
+	case *ast.WhileLoop:
+		for _, inner := range s.Body {
+			if g.containsSharedChan(inner) {
+				return true
+			}
+		}
+	case *ast.IfStatement:
+		for _, choice := range s.Choices {
+			if choice.NestedIf != nil {
+				if g.containsSharedChan(choice.NestedIf) {
+					return true
+				}
+			}
+			for _, inner := range choice.Body {
+				if g.containsSharedChan(inner) {
+					return true
+				}
+			}
+		}
+	case *ast.CaseStatement:
+		for _, choice := range s.Choices {
+			for _, inner := range choice.Body {
+				if g.containsSharedChan(inner) {
 					return true
 				}
 			}
@@ -1010,7 +3269,7 @@ func (g *Generator) containsMostExpr(stmt ast.Statement) bool {
 	case *ast.VariantReceive:
 		for _, c := range s.Cases {
 			for _, inner := range c.Body {
-				if g.containsMostExpr(inner) {
+				if g.containsSharedChan(inner) {
 					return true
 				}
 			}
@@ -1019,52 +3278,299 @@ func (g *Generator) containsMostExpr(stmt ast.Statement) bool {
 	return false
 }
 
-func (g *Generator) exprNeedsMath(expr ast.Expression) bool {
-	if expr == nil {
-		return false
-	}
-	switch e := expr.(type) {
-	case *ast.MostExpr:
-		// BYTE uses literal 0/255, doesn't need math
-		return e.ExprType != "BYTE"
-	case *ast.BinaryExpr:
-		return g.exprNeedsMath(e.Left) || g.exprNeedsMath(e.Right)
-	case *ast.UnaryExpr:
-		return g.exprNeedsMath(e.Right)
-	case *ast.ParenExpr:
-		return g.exprNeedsMath(e.Expr)
-	case *ast.TypeConversion:
-		if e.Qualifier == "ROUND" && isOccamIntType(e.TargetType) {
-			return true
-		}
-		return g.exprNeedsMath(e.Expr)
-	case *ast.SizeExpr:
-		return g.exprNeedsMath(e.Expr)
-	case *ast.IndexExpr:
-		return g.exprNeedsMath(e.Left) || g.exprNeedsMath(e.Index)
-	case *ast.FuncCall:
-		for _, arg := range e.Args {
-			if g.exprNeedsMath(arg) {
+func (g *Generator) containsStop(stmt ast.Statement) bool {
+	switch s := stmt.(type) {
+	case *ast.Stop:
+		return true
+	case *ast.SeqBlock:
+		for _, inner := range s.Statements {
+			if g.containsStop(inner) {
 				return true
 			}
 		}
-	case *ast.SliceExpr:
-		return g.exprNeedsMath(e.Array) || g.exprNeedsMath(e.Start) || g.exprNeedsMath(e.Length)
-	case *ast.ArrayLiteral:
-		for _, elem := range e.Elements {
-			if g.exprNeedsMath(elem) {
+	case *ast.ParBlock:
+		for _, inner := range s.Statements {
+			if g.containsStop(inner) {
 				return true
 			}
 		}
-	}
-	return false
-}
-
-func (g *Generator) generateMostExpr(e *ast.MostExpr) {
-	switch e.ExprType {
-	case "INT":
-		if e.IsNeg {
-			g.write("math.MinInt")
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				if g.containsStop(inner) {
+					return true
+				}
+			}
+		}
+	case *ast.ProcDecl:
+		for _, inner := range s.Body {
+			if g.containsStop(inner) {
+				return true
+			}
+		}
+	case *ast.FuncDecl:
+		// STOP in a FUNCTION panics, needing neither fmt nor os, but
+		// a PROC nested in one stops as usual
+		for _, inner := range s.Body {
+			if _, ok := inner.(*ast.ProcDecl); ok && g.containsStop(inner) {
+				return true
+			}
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsStop(inner) {
+				return true
+			}
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			if g.containsStop(inner) {
+				return true
+			}
+		}
+	case *ast.WhileLoop:
+		for _, inner := range s.Body {
+			if g.containsStop(inner) {
+				return true
+			}
+		}
+	case *ast.IfStatement:
+		for _, choice := range s.Choices {
+			if choice.NestedIf != nil {
+				if g.containsStop(choice.NestedIf) {
+					return true
+				}
+			}
+			for _, inner := range choice.Body {
+				if g.containsStop(inner) {
+					return true
+				}
+			}
+		}
+	case *ast.CaseStatement:
+		for _, choice := range s.Choices {
+			for _, inner := range choice.Body {
+				if g.containsStop(inner) {
+					return true
+				}
+			}
+		}
+	case *ast.VariantReceive:
+		// Without an ELSE, unhandled variants STOP
+		hasElse := false
+		for _, c := range s.Cases {
+			hasElse = hasElse || c.IsElse
+		}
+		if !hasElse {
+			return true
+		}
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				if g.containsStop(inner) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (g *Generator) containsMostExpr(stmt ast.Statement) bool {
+	switch s := stmt.(type) {
+	case *ast.Assignment:
+		result := g.exprNeedsMath(s.Value)
+		for _, idx := range s.Indices {
+			result = result || g.exprNeedsMath(idx)
+		}
+		return result
+	case *ast.MultiAssignment:
+		for _, t := range s.Targets {
+			for _, idx := range t.Indices {
+				if g.exprNeedsMath(idx) {
+					return true
+				}
+			}
+		}
+		for _, v := range s.Values {
+			if g.exprNeedsMath(v) {
+				return true
+			}
+		}
+	case *ast.Abbreviation:
+		return g.exprNeedsMath(s.Value)
+	case *ast.SeqBlock:
+		for _, inner := range s.Statements {
+			if g.containsMostExpr(inner) {
+				return true
+			}
+		}
+	case *ast.ParBlock:
+		for _, inner := range s.Statements {
+			if g.containsMostExpr(inner) {
+				return true
+			}
+		}
+	case *ast.ProcDecl:
+		for _, inner := range s.Body {
+			if g.containsMostExpr(inner) {
+				return true
+			}
+		}
+	case *ast.FuncDecl:
+		for _, inner := range s.Body {
+			if g.containsMostExpr(inner) {
+				return true
+			}
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsMostExpr(inner) {
+				return true
+			}
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			if g.containsMostExpr(inner) {
+				return true
+			}
+		}
+	case *ast.WhileLoop:
+		if g.exprNeedsMath(s.Condition) {
+			return true
+		}
+		for _, inner := range s.Body {
+			if g.containsMostExpr(inner) {
+				return true
+			}
+		}
+	case *ast.IfStatement:
+		for _, choice := range s.Choices {
+			if choice.NestedIf != nil {
+				if g.containsMostExpr(choice.NestedIf) {
+					return true
+				}
+			}
+			if g.exprNeedsMath(choice.Condition) {
+				return true
+			}
+			for _, inner := range choice.Body {
+				if g.containsMostExpr(inner) {
+					return true
+				}
+			}
+		}
+	case *ast.CaseStatement:
+		if g.exprNeedsMath(s.Selector) {
+			return true
+		}
+		for _, choice := range s.Choices {
+			for _, v := range choice.Values {
+				if g.exprNeedsMath(v) {
+					return true
+				}
+			}
+			for _, inner := range choice.Body {
+				if g.containsMostExpr(inner) {
+					return true
+				}
+			}
+		}
+	case *ast.Send:
+		if g.exprNeedsMath(s.Value) {
+			return true
+		}
+		for _, v := range s.Values {
+			if g.exprNeedsMath(v) {
+				return true
+			}
+		}
+	case *ast.ProcCall:
+		for _, arg := range s.Args {
+			if g.exprNeedsMath(arg) {
+				return true
+			}
+		}
+	case *ast.ForkStmt:
+		return g.containsMostExpr(s.Call)
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				if g.containsMostExpr(inner) {
+					return true
+				}
+			}
+		}
+	case *ast.VariantReceive:
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				if g.containsMostExpr(inner) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (g *Generator) exprNeedsMath(expr ast.Expression) bool {
+	if expr == nil {
+		return false
+	}
+	switch e := expr.(type) {
+	case *ast.MostExpr:
+		// BYTE uses literal 0/255, doesn't need math
+		return e.ExprType != "BYTE"
+	case *ast.BinaryExpr:
+		return g.exprNeedsMath(e.Left) || g.exprNeedsMath(e.Right)
+	case *ast.UnaryExpr:
+		return g.exprNeedsMath(e.Right)
+	case *ast.ParenExpr:
+		return g.exprNeedsMath(e.Expr)
+	case *ast.TypeConversion:
+		if e.Qualifier == "ROUND" && isOccamIntType(g.primitiveType(e.TargetType)) {
+			return true
+		}
+		return g.exprNeedsMath(e.Expr)
+	case *ast.SizeExpr:
+		return g.exprNeedsMath(e.Expr)
+	case *ast.IndexExpr:
+		return g.exprNeedsMath(e.Left) || g.exprNeedsMath(e.Index)
+	case *ast.FuncCall:
+		for _, arg := range e.Args {
+			if g.exprNeedsMath(arg) {
+				return true
+			}
+		}
+	case *ast.SliceExpr:
+		return g.exprNeedsMath(e.Array) || g.exprNeedsMath(e.Start) || g.exprNeedsMath(e.Length)
+	case *ast.ArrayLiteral:
+		for _, elem := range e.Elements {
+			if g.exprNeedsMath(elem) {
+				return true
+			}
+		}
+	case *ast.ArrayConstructor:
+		return g.exprNeedsMath(e.Value)
+	case *ast.ValofExpr:
+		return g.exprNeedsMath(e.Result)
+	}
+	return false
+}
+
+func (g *Generator) generateMostExpr(e *ast.MostExpr) {
+	typ := e.ExprType
+	if typ == "INT" {
+		switch g.intType() {
+		case "int32":
+			typ = "INT32"
+		case "int64":
+			typ = "INT64"
+		}
+	}
+	switch typ {
+	case "INT":
+		if e.IsNeg {
+			g.write("math.MinInt")
 		} else {
 			g.write("math.MaxInt")
 		}
@@ -1121,11 +3627,91 @@ func (g *Generator) write(s string) {
 	g.builder.WriteString(s)
 }
 
-func (g *Generator) generateStatement(stmt ast.Statement) {
-	switch s := stmt.(type) {
-	case *ast.VarDecl:
-		g.generateVarDecl(s)
-	case *ast.ArrayDecl:
+// beginFunc starts size accounting for a Go function whose body is about
+// to be generated.
+func (g *Generator) beginFunc(desc string, line int) {
+	g.funcFrames = append(g.funcFrames, funcFrame{desc: desc, line: line, start: g.builder.Len()})
+}
+
+// endFunc finishes the innermost function started by beginFunc, warning if
+// it is over the size limit.
+func (g *Generator) endFunc() {
+	f := g.funcFrames[len(g.funcFrames)-1]
+	g.funcFrames = g.funcFrames[:len(g.funcFrames)-1]
+	total := g.builder.Len() - f.start
+	if size := total - f.excluded; g.maxFuncSize > 0 && size > g.maxFuncSize {
+		msg := fmt.Sprintf("%s generates %d bytes of Go (limit %d)", f.desc, size, g.maxFuncSize)
+		if f.line > 0 {
+			msg = fmt.Sprintf("line %d: %s", f.line, msg)
+		}
+		g.warnings = append(g.warnings, msg)
+	}
+	if len(g.funcFrames) > 0 {
+		// A nested PROC/FUNCTION is a closure, compiled separately
+		g.funcFrames[len(g.funcFrames)-1].excluded += total
+	}
+}
+
+// isCompound reports whether stmt is a process containing other processes.
+// Outlining one into a closure is safe: any names it declares are scoped to it.
+func isCompound(stmt ast.Statement) bool {
+	switch stmt.(type) {
+	case *ast.SeqBlock, *ast.ParBlock, *ast.AltBlock, *ast.IfStatement,
+		*ast.WhileLoop, *ast.CaseStatement, *ast.ClaimBlock, *ast.ForkingBlock:
+		return true
+	}
+	return false
+}
+
+// isDeclaration reports whether stmt declares names rather than being a
+// process, and so changes no variable.
+func isDeclaration(stmt ast.Statement) bool {
+	switch stmt.(type) {
+	case *ast.VarDecl, *ast.ArrayDecl, *ast.ChanDecl, *ast.TimerDecl, *ast.BarrierDecl,
+		*ast.Abbreviation, *ast.RetypesDecl, *ast.PlaceDecl, *ast.ProcDecl, *ast.FuncDecl,
+		*ast.ProtocolDecl, *ast.RecordDecl, *ast.DataTypeDecl:
+		return true
+	}
+	return false
+}
+
+// outlineIfLarge wraps the code generated since start in func() { ... }()
+// when the enclosing function is over the size limit. excluded is the
+// enclosing frame's excluded count at start.
+func (g *Generator) outlineIfLarge(start, excluded, poisonReturns int) {
+	f := &g.funcFrames[len(g.funcFrames)-1]
+	if g.builder.Len()-f.start-f.excluded <= g.maxFuncSize {
+		return
+	}
+	if g.poisonReturns != poisonReturns {
+		// A poison branch's return must stay in the PROC's own function
+		return
+	}
+	out := g.builder.String()
+	body := out[start:]
+	g.builder.Reset()
+	g.builder.WriteString(out[:start])
+	g.writeLine("func() {")
+	for _, line := range strings.SplitAfter(body, "\n") {
+		if line != "" && line != "\n" {
+			g.builder.WriteString("\t")
+		}
+		g.builder.WriteString(line)
+	}
+	g.writeLine("}()")
+	f.excluded = excluded + g.builder.Len() - start
+}
+
+func (g *Generator) generateStatement(stmt ast.Statement) {
+	if g.outline && g.maxFuncSize > 0 && len(g.funcFrames) > 0 && isCompound(stmt) {
+		defer g.outlineIfLarge(g.builder.Len(), g.funcFrames[len(g.funcFrames)-1].excluded, g.poisonReturns)
+	}
+	g.stmtDepth++
+	defer g.endStatement(stmt)
+	switch s := stmt.(type) {
+	case *ast.VarDecl:
+		g.generateVarDecl(s)
+	case *ast.ArrayDecl:
 		g.generateArrayDecl(s)
 	case *ast.ChanDecl:
 		g.generateChanDecl(s)
@@ -1145,7 +3731,14 @@ func (g *Generator) generateStatement(stmt ast.Statement) {
 		g.generateAltBlock(s)
 	case *ast.Skip:
 		g.writeLine("// SKIP")
+	case *ast.Unsupported:
+		g.generateUnsupported(s)
 	case *ast.Stop:
+		g.generatePrunedAltChans(s)
+		if g.stopFunc != "" {
+			g.writeLine(fmt.Sprintf("panic(%q)", fmt.Sprintf("STOP at line %d in FUNCTION %s", s.Token.Line, g.stopFunc)))
+			break
+		}
 		g.writeLine(`fmt.Fprintln(os.Stderr, "STOP encountered")`)
 		g.writeLine("select {}")
 	case *ast.ProcDecl:
@@ -1156,12 +3749,22 @@ func (g *Generator) generateStatement(stmt ast.Statement) {
 		g.generateProcCall(s)
 	case *ast.WhileLoop:
 		g.generateWhileLoop(s)
+	case *ast.ClaimBlock:
+		g.generateClaimBlock(s)
+	case *ast.ForkingBlock:
+		g.generateForkingBlock(s)
+	case *ast.ForkStmt:
+		g.generateFork(s)
 	case *ast.IfStatement:
 		g.generateIfStatement(s)
 	case *ast.CaseStatement:
 		g.generateCaseStatement(s)
 	case *ast.TimerDecl:
 		g.generateTimerDecl(s)
+	case *ast.BarrierDecl:
+		g.generateBarrierDecl(s)
+	case *ast.SyncStmt:
+		g.writeLine(goIdent(s.Barrier) + ".sync()")
 	case *ast.TimerRead:
 		g.generateTimerRead(s)
 	case *ast.ProtocolDecl:
@@ -1170,17 +3773,53 @@ func (g *Generator) generateStatement(stmt ast.Statement) {
 		g.generateVariantReceive(s)
 	case *ast.RecordDecl:
 		g.generateRecordDecl(s)
+	case *ast.DataTypeDecl:
+		g.dataTypes[s.Name] = s.Type // another of this name may have been collected last
+		g.writeLine(fmt.Sprintf("type %s %s", goIdent(s.Name), g.occamTypeToGo(s.Type)))
+		g.writeLine("")
 	case *ast.Abbreviation:
 		g.generateAbbreviation(s)
 	case *ast.MultiAssignment:
 		g.generateMultiAssignment(s)
 	case *ast.RetypesDecl:
 		g.generateRetypesDecl(s)
+	case *ast.PlaceDecl:
+		g.generatePlaceDecl(s)
+	default:
+		g.skip(stmt)
+	}
+}
+
+// linePos names source line for messages of the generated code: by
+// WithSourcePos, or as "line N".
+func (g *Generator) linePos(line int) string {
+	if g.sourcePos != nil {
+		return g.sourcePos(line)
+	}
+	return fmt.Sprintf("line %d", line)
+}
+
+// generateUnsupported stands in for a statement the parser skipped in
+// permissive mode: a panic where it would run, a PROC that panics for a
+// PROC declaration (accepting any arguments, so that calls still build),
+// or a comment at package level.
+func (g *Generator) generateUnsupported(s *ast.Unsupported) {
+	msg := fmt.Sprintf("occam2go: unsupported: %s at %s", s.Text, g.linePos(s.Token.Line))
+	switch {
+	case s.Proc != "" && g.nestingLevel > 0:
+		g.writeLine(fmt.Sprintf("%s := func(...any) { panic(%q) }", goIdent(s.Proc), msg))
+		g.writeLine("_ = " + goIdent(s.Proc))
+	case s.Proc != "":
+		g.writeLine(fmt.Sprintf("func %s(...any) { panic(%q) }", g.procIdent(s.Proc), msg))
+	case g.nestingLevel > 0:
+		g.writeLine(fmt.Sprintf("panic(%q)", msg))
+	default:
+		g.writeLine("// " + msg)
 	}
 }
 
 func (g *Generator) generateVarDecl(decl *ast.VarDecl) {
-	goType := g.occamTypeToGo(decl.Type)
+	goType := g.goType(decl.TypeRef, "")
 	goNames := make([]string, len(decl.Names))
 	for i, n := range decl.Names {
 		goNames[i] = goIdent(n)
@@ -1191,31 +3830,66 @@ func (g *Generator) generateVarDecl(decl *ast.VarDecl) {
 		g.writeLine(fmt.Sprintf("_ = %s", n))
 	}
 	// Track BOOL variables for type conversion codegen
-	if decl.Type == "BOOL" {
-		for _, n := range decl.Names {
-			g.boolVars[n] = true
+	for _, n := range decl.Names {
+		g.boolVars[n] = decl.Type == "BOOL"
+		delete(g.refParams, n) // hides an alias or reference parameter
+	}
+	g.trackMobile(decl.Names, decl.Mobile, g.mobileZero(decl.Type, false))
+	if g.poisonUninit && !decl.Mobile && decl.End == "" {
+		for _, n := range goNames {
+			for _, line := range g.poisonLines(n, decl.Type) {
+				g.writeLine(line)
+			}
+		}
+	}
+	// Make the channels of records with channel fields (CHAN TYPE ends
+	// get theirs from MOBILE)
+	if rec := g.recordDefs[decl.Type]; rec != nil && decl.End == "" {
+		for _, n := range goNames {
+			for _, f := range rec.Fields {
+				if f.IsChan {
+					g.writeLine(fmt.Sprintf("%s.%s = make(chan %s)", n, goIdent(f.Name), g.occamTypeToGo(f.Type)))
+				}
+			}
 		}
 	}
 }
 
 func (g *Generator) generateAbbreviation(abbr *ast.Abbreviation) {
+	if abbr.IsChan {
+		g.generateChanAbbreviation(abbr)
+		return
+	}
+	if abbr.TypeRef != nil {
+		if dims, elem := abbr.TypeRef.Dims(); dims > 0 && elem.Name == "BOOL" {
+			g.rejectBoolArray(abbr.Token.Line)
+		}
+	}
+	if target, ok := g.aliasTarget(abbr); ok {
+		// A non-VAL abbreviation of a variable or element aliases it
+		// through a pointer, dereferenced as reference parameters are
+		g.writeLine(fmt.Sprintf("%s := &%s", goIdent(abbr.Name), target))
+		g.refParams[abbr.Name] = true
+		g.boolVars[abbr.Name] = abbr.Type == "BOOL"
+		g.writeLine(fmt.Sprintf("_ = %s", goIdent(abbr.Name)))
+		return
+	}
 	g.builder.WriteString(strings.Repeat("\t", g.indent))
 	if abbr.Type != "" {
-		goType := g.occamTypeToGo(abbr.Type)
-		if abbr.OpenArrayDims > 0 {
-			goType = strings.Repeat("[]", abbr.OpenArrayDims) + goType
-		}
-		g.write(fmt.Sprintf("var %s %s = ", goIdent(abbr.Name), goType))
+		g.write(fmt.Sprintf("var %s %s = ", goIdent(abbr.Name), g.abbrGoType(abbr)))
 	} else {
 		g.write(fmt.Sprintf("%s := ", goIdent(abbr.Name)))
 	}
+	dims, _ := abbr.TypeRef.Dims()
 	// Wrap string literals with []byte() when assigned to []byte variables
-	if _, isStr := abbr.Value.(*ast.StringLiteral); isStr && abbr.OpenArrayDims > 0 && abbr.Type == "BYTE" {
+	if _, isStr := abbr.Value.(*ast.StringLiteral); isStr && dims > 0 && abbr.Type == "BYTE" {
 		g.write("[]byte(")
 		g.generateExpression(abbr.Value)
 		g.write(")")
-	} else if al, isArr := abbr.Value.(*ast.ArrayLiteral); isArr && abbr.OpenArrayDims > 1 {
-		g.generateTypedArrayLiteral(al, strings.Repeat("[]", abbr.OpenArrayDims)+g.occamTypeToGo(abbr.Type))
+	} else if isTable(abbr.Value) && abbr.Type != "" {
+		g.generateTypedLiteral(abbr.Value, abbr.Type, dims)
+	} else if abbr.Type == "" {
+		g.generateUntypedValue(abbr.Value)
 	} else {
 		g.generateExpression(abbr.Value)
 	}
@@ -1226,10 +3900,71 @@ func (g *Generator) generateAbbreviation(abbr *ast.Abbreviation) {
 	}
 }
 
+// abbrGoType returns the Go type of typed abbreviation abbr. Abbreviations
+// are not tracked as BOOL variables, so BOOL ones stay Go bools whatever
+// BOOL is mapped to.
+func (g *Generator) abbrGoType(abbr *ast.Abbreviation) string {
+	if t := abbr.TypeRef; t.Kind == ast.ScalarType && t.Name == "BOOL" {
+		return "bool"
+	}
+	return g.goType(abbr.TypeRef, "")
+}
+
+// generateChanAbbreviation generates a channel or channel array
+// abbreviation, which shares the channels it names as Go channels and
+// slices do, and registers its element type and protocol as a channel
+// declaration does. A direction is checked, not kept in the Go type, as
+// for channels in arrays.
+func (g *Generator) generateChanAbbreviation(abbr *ast.Abbreviation) {
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write(fmt.Sprintf("%s := ", goIdent(abbr.Name)))
+	g.generateExpression(abbr.Value)
+	g.write("\n")
+	if g.nestingLevel > 0 {
+		g.writeLine(fmt.Sprintf("_ = %s", goIdent(abbr.Name)))
+	}
+	g.chanElemTypes[abbr.Name] = g.occamTypeToGo(abbr.Type)
+	g.boolChans[abbr.Name] = g.carriesBool(abbr.Type)
+	if _, ok := g.protocolDefs[abbr.Type]; ok {
+		g.chanProtocols[abbr.Name] = abbr.Type
+	}
+	delete(g.refParams, abbr.Name)
+	delete(g.boolVars, abbr.Name)
+}
+
+// aliasTarget returns the Go lvalue a non-VAL scalar abbreviation aliases:
+// the variable, array element or record field it names.
+// Array abbreviations need no pointer, as Go slices already share storage.
+func (g *Generator) aliasTarget(abbr *ast.Abbreviation) (string, bool) {
+	if abbr.IsVal || abbr.IsInitial || abbr.TypeRef == nil || abbr.TypeRef.Kind == ast.ArrayType {
+		return "", false
+	}
+	var name string
+	var indices []ast.Expression
+	switch v := abbr.Value.(type) {
+	case *ast.Identifier:
+		name = v.Value
+	case *ast.IndexExpr:
+		var ok bool
+		if name, indices, ok = indexPath(v); !ok {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	if _, isChan := g.chanElemTypes[name]; isChan {
+		return "", false
+	}
+	target, _ := g.lvalue(name, indices)
+	return target, true
+}
+
 func (g *Generator) generateChanDecl(decl *ast.ChanDecl) {
-	goType := g.occamTypeToGo(decl.ElemType)
+	_, ch := decl.TypeRef.Dims()
+	goType := g.goType(ch.Elem, "")
 	for _, name := range decl.Names {
 		g.chanElemTypes[name] = goType
+		g.boolChans[name] = g.carriesBool(decl.ElemType)
 	}
 	if len(decl.Sizes) > 0 {
 		for _, name := range decl.Names {
@@ -1304,15 +4039,34 @@ func (g *Generator) generateTimerDecl(decl *ast.TimerDecl) {
 	}
 }
 
+// generateBarrierDecl declares each barrier with the declaring process as
+// its one enrolled process.
+func (g *Generator) generateBarrierDecl(decl *ast.BarrierDecl) {
+	for _, name := range decl.Names {
+		n := goIdent(name)
+		g.writeLine(fmt.Sprintf("%s := %s_barrier{enrolled: 1}", n, g.prefix))
+		g.writeLine(fmt.Sprintf("_ = &%s", n))
+	}
+}
+
 func (g *Generator) generateTimerRead(tr *ast.TimerRead) {
-	g.writeLine(fmt.Sprintf("%s = int(time.Now().UnixMicro())", goIdent(tr.Variable)))
+	g.writeLine(fmt.Sprintf("%s = %s(time.Now().UnixMicro())", g.varRef(tr.Variable), g.intType()))
 }
 
 func (g *Generator) generateArrayDecl(decl *ast.ArrayDecl) {
-	goType := g.occamTypeToGo(decl.Type)
+	_, elem := decl.TypeRef.Dims()
+	goType := g.goType(elem, "")
+	if decl.Type == "BOOL" {
+		g.rejectBoolArray(decl.Token.Line)
+	}
+	g.trackMobile(decl.Names, decl.Mobile, "nil")
 	for _, name := range decl.Names {
 		n := goIdent(name)
-		if len(decl.Sizes) == 1 {
+		if decl.Sizes[0] == nil {
+			// MOBILE []TYPE: allocated later by name := MOBILE [n]TYPE
+			g.writeLine(fmt.Sprintf("var %s []%s", n, goType))
+			g.writeLine(fmt.Sprintf("_ = %s", n))
+		} else if len(decl.Sizes) == 1 {
 			g.builder.WriteString(strings.Repeat("\t", g.indent))
 			g.write(fmt.Sprintf("%s := make([]%s, ", n, goType))
 			g.generateExpression(decl.Sizes[0])
@@ -1320,6 +4074,110 @@ func (g *Generator) generateArrayDecl(decl *ast.ArrayDecl) {
 		} else {
 			g.generateMultiDimArrayInit(n, goType, decl.Sizes, 0)
 		}
+		if g.poisonUninit && decl.Sizes[0] != nil {
+			g.poisonArray(n, decl.Type, len(decl.Sizes))
+		}
+	}
+}
+
+// poisonArray fills the elements of the dims-dimensional array name with
+// the values of WithPoisonUninit, in nested range loops.
+func (g *Generator) poisonArray(name, occamType string, dims int) {
+	elem := name
+	for i := 0; i < dims; i++ {
+		elem += fmt.Sprintf("[_p%d]", i)
+	}
+	lines := g.poisonLines(elem, occamType)
+	if len(lines) == 0 {
+		return
+	}
+	for i := 0; i < dims; i++ {
+		g.writeLine(fmt.Sprintf("for _p%d := range %s {", i, name))
+		g.indent++
+		name += fmt.Sprintf("[_p%d]", i)
+	}
+	for _, line := range lines {
+		g.writeLine(line)
+	}
+	for i := 0; i < dims; i++ {
+		g.indent--
+		g.writeLine("}")
+	}
+}
+
+// poisonLines returns the assignments filling target, of occamType, with
+// the values of WithPoisonUninit: target itself when a number, its numeric
+// fields when a record, and none otherwise.
+func (g *Generator) poisonLines(target, occamType string) []string {
+	if rec := g.recordDefs[occamType]; rec != nil {
+		var lines []string
+		for _, f := range rec.Fields {
+			if !f.IsChan {
+				lines = append(lines, g.poisonLines(target+"."+goIdent(f.Name), f.Type)...)
+			}
+		}
+		return lines
+	}
+	if occamType == "BOOL" {
+		return nil // whatever Go type it is mapped to
+	}
+	var value string
+	switch g.occamTypeToGo(occamType) {
+	case "int", "int32":
+		value = "-559038737" // 0xDEADBEEF
+	case "int64":
+		value = "-2401053088876216593" // 0xDEADBEEFDEADBEEF
+	case "int16":
+		value = "-8531" // 0xDEAD
+	case "byte", "uint8":
+		value = "0xDE"
+	case "float64":
+		value = g.prefix + "_uninitNaN"
+	case "float32":
+		value = "float32(" + g.prefix + "_uninitNaN)"
+	default:
+		return nil
+	}
+	return []string{target + " = " + value}
+}
+
+// trackMobile records whether the declared names are MOBILE, and so moved
+// by assignment and output, leaving zero behind.
+func (g *Generator) trackMobile(names []string, mobile bool, zero string) {
+	for _, n := range names {
+		if mobile {
+			g.mobileVars[n] = zero
+		} else {
+			delete(g.mobileVars, n)
+		}
+	}
+}
+
+// mobileZero returns the Go zero value of a MOBILE of occamType, or of an
+// array of them.
+func (g *Generator) mobileZero(occamType string, array bool) string {
+	goType := g.occamTypeToGo(occamType)
+	switch {
+	case array:
+		return "nil"
+	case goType == "bool":
+		return "false"
+	case g.recordDefs[occamType] != nil:
+		return goType + "{}"
+	}
+	return "0"
+}
+
+// moveMobile ends a MOBILE's ownership after value has been assigned or
+// output: if value is a MOBILE variable, it is reset to its zero value, so
+// that any use of it after the move sees no data.
+func (g *Generator) moveMobile(value ast.Expression) {
+	ident, ok := value.(*ast.Identifier)
+	if !ok {
+		return
+	}
+	if zero, ok := g.mobileVars[ident.Value]; ok {
+		g.writeLine(fmt.Sprintf("%s = %s", g.varRef(ident.Value), zero))
 	}
 }
 
@@ -1366,71 +4224,153 @@ func (g *Generator) generateMultiDimArrayInit(name, goType string, sizes []ast.E
 	}
 }
 
-// generateIndices emits [idx1][idx2]... for multi-dimensional index access.
-func (g *Generator) generateIndices(indices []ast.Expression) {
-	for _, idx := range indices {
-		g.write("[")
-		g.generateExpression(idx)
-		g.write("]")
+// recordChanField returns the channel field that name with indices refers
+// to when name is a record variable and the first index names one of its
+// CHAN OF fields, as in r[c] ! x, or nil otherwise.
+func (g *Generator) recordChanField(name string, indices []ast.Expression) *ast.RecordField {
+	rec := g.recordDefs[g.recordVars[name]]
+	if rec == nil || len(indices) == 0 {
+		return nil
+	}
+	ident, ok := indices[0].(*ast.Identifier)
+	if !ok {
+		return nil
+	}
+	for i, f := range rec.Fields {
+		if f.IsChan && f.Name == ident.Value {
+			return &rec.Fields[i]
+		}
+	}
+	return nil
+}
+
+// channelRef returns the Go expression for channel name with indices,
+// resolving a record channel field r[c] to r.c.
+func (g *Generator) channelRef(name string, indices []ast.Expression) string {
+	ref := goIdent(name)
+	if f := g.recordChanField(name, indices); f != nil {
+		ref += "." + goIdent(f.Name)
+		indices = indices[1:]
+	}
+	return g.indexed(ref, indices)
+}
+
+// channelProtocol returns the element type or protocol of channel name
+// with indices, taking it from the field for a record channel field.
+func (g *Generator) channelProtocol(name string, indices []ast.Expression) string {
+	if f := g.recordChanField(name, indices); f != nil {
+		return f.Type
 	}
+	return g.chanProtocols[name]
 }
 
-// generateIndicesStr generates indices into a buffer and returns the string.
-func (g *Generator) generateIndicesStr(indices []ast.Expression) string {
-	var buf strings.Builder
+// indexed returns the Go expression for base subscripted by each of
+// indices in turn, with every subscript checked under WithBoundsCheck.
+func (g *Generator) indexed(base string, indices []ast.Expression) string {
 	for _, idx := range indices {
-		buf.WriteString("[")
-		oldBuilder := g.builder
-		g.builder = strings.Builder{}
-		g.generateExpression(idx)
-		buf.WriteString(g.builder.String())
-		g.builder = oldBuilder
-		buf.WriteString("]")
+		i := g.exprString(idx)
+		if g.boundsCheck {
+			i = fmt.Sprintf("%s_index(%s, len(%s), %d)", g.prefix, i, base, exprLine(idx))
+		}
+		base += "[" + i + "]"
+	}
+	return base
+}
+
+// slice returns the Go expression for [array FROM start FOR length], the
+// slice being checked under WithBoundsCheck.
+func (g *Generator) slice(array, start, length ast.Expression, line int) string {
+	a, from, count := g.exprString(array), g.exprString(start), g.exprString(length)
+	if g.boundsCheck {
+		return fmt.Sprintf("%s[%s : %s_sliceEnd(int(%s), int(%s), len(%s), %d)]", a, from, g.prefix, from, count, a, line)
+	}
+	return fmt.Sprintf("%s[%s : %s + %s]", a, from, from, count)
+}
+
+// exprString generates expr into a buffer and returns the string.
+func (g *Generator) exprString(expr ast.Expression) string {
+	oldBuilder := g.builder
+	g.builder = strings.Builder{}
+	g.generateExpression(expr)
+	str := g.builder.String()
+	g.builder = oldBuilder
+	return str
+}
+
+// exprLine returns the source line of expression e, or 0 if not known.
+func exprLine(e ast.Expression) int {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		return e.Token.Line
+	case *ast.IntegerLiteral:
+		return e.Token.Line
+	case *ast.ByteLiteral:
+		return e.Token.Line
+	case *ast.BinaryExpr:
+		return exprLine(e.Left)
+	case *ast.UnaryExpr:
+		return e.Token.Line
+	case *ast.ParenExpr:
+		return e.Token.Line
+	case *ast.TypeConversion:
+		return e.Token.Line
+	case *ast.SizeExpr:
+		return e.Token.Line
+	case *ast.MostExpr:
+		return e.Token.Line
+	case *ast.IndexExpr:
+		return e.Token.Line
+	case *ast.FuncCall:
+		return e.Token.Line
+	case *ast.ValofExpr:
+		return e.Token.Line
 	}
-	return buf.String()
+	return 0
 }
 
 func (g *Generator) generateSend(send *ast.Send) {
+	chanRef := g.channelRef(send.Channel, send.ChannelIndices)
 	g.builder.WriteString(strings.Repeat("\t", g.indent))
-	g.write(goIdent(send.Channel))
-	g.generateIndices(send.ChannelIndices)
-	g.write(" <- ")
+	g.write(chanRef + " <- ")
+	g.generateSendValue(send)
+	g.write("\n")
+	g.sent(chanRef)
+	if len(send.Values) == 0 && send.VariantTag == "" {
+		g.moveMobile(send.Value)
+	}
+}
 
-	protoName := g.chanProtocols[send.Channel]
+// generateSendValue generates the message of send, as the channel's Go
+// type: the value, or the protocol struct or variant of its items.
+func (g *Generator) generateSendValue(send *ast.Send) {
+	protoName := g.channelProtocol(send.Channel, send.ChannelIndices)
 	proto := g.protocolDefs[protoName]
-	gProtoName := goIdent(protoName)
 
 	if send.VariantTag != "" && proto != nil && proto.Kind == "variant" {
 		// Variant send with explicit tag: c <- _proto_NAME_tag{values...}
-		g.write(fmt.Sprintf("_proto_%s_%s{", gProtoName, goIdent(send.VariantTag)))
-		for i, val := range send.Values {
-			if i > 0 {
-				g.write(", ")
-			}
-			g.generateExpression(val)
-		}
+		g.write(g.variantType(protoName, send.VariantTag) + "{")
+		g.generateProtocolValues(g.variantTypes(protoName, send.VariantTag), send.Values)
 		g.write("}")
 	} else if proto != nil && proto.Kind == "variant" && send.Value != nil && len(send.Values) == 0 {
 		// Check if the send value is a bare identifier matching a variant tag
 		if ident, ok := send.Value.(*ast.Identifier); ok && g.isVariantTag(protoName, ident.Value) {
-			g.write(fmt.Sprintf("_proto_%s_%s{}", gProtoName, goIdent(ident.Value)))
+			g.write(g.variantType(protoName, ident.Value) + "{}")
 		} else {
 			g.generateExpression(send.Value)
 		}
-	} else if len(send.Values) > 0 && proto != nil && proto.Kind == "sequential" {
+	} else if proto != nil && (len(send.Values) > 0 && proto.Kind == "sequential" || hasCountedArray(proto.Items)) {
 		// Sequential send: c <- _proto_NAME{val1, val2, ...}
-		g.write(fmt.Sprintf("_proto_%s{", gProtoName))
-		g.generateExpression(send.Value)
-		for _, val := range send.Values {
-			g.write(", ")
-			g.generateExpression(val)
-		}
+		g.write(g.protoType(protoName) + "{")
+		g.generateProtocolValues(proto.Types, append([]ast.Expression{send.Value}, send.Values...))
 		g.write("}")
+	} else if g.boolChans[send.Channel] || (protoName == "BOOL" && g.recordChanField(send.Channel, send.ChannelIndices) != nil) {
+		g.generateBoolValue(send.Value)
+	} else if proto != nil && proto.Kind == "simple" && isFixedArray(proto.Types[0]) {
+		g.generateProtocolValues(proto.Types, []ast.Expression{send.Value})
 	} else {
 		// Simple send
 		g.generateExpression(send.Value)
 	}
-	g.write("\n")
 }
 
 func (g *Generator) generateTimerAfterWait(s *ast.TimerAfterWait) {
@@ -1438,41 +4378,39 @@ func (g *Generator) generateTimerAfterWait(s *ast.TimerAfterWait) {
 	g.builder.WriteString(strings.Repeat("\t", g.indent))
 	g.write("time.Sleep(time.Duration(")
 	g.generateExpression(s.Deadline)
-	g.write(" - int(time.Now().UnixMicro())) * time.Microsecond)\n")
+	g.write(" - " + g.intType() + "(time.Now().UnixMicro())) * time.Microsecond)\n")
 }
 
 func (g *Generator) generateReceive(recv *ast.Receive) {
-	chanRef := goIdent(recv.Channel)
-	if len(recv.ChannelIndices) > 0 {
-		chanRef += g.generateIndicesStr(recv.ChannelIndices)
-	}
+	g.generateReceiveMessage(recv)
+	g.received(g.channelRef(recv.Channel, recv.ChannelIndices))
+}
+
+// generateReceiveMessage generates the input of recv, without releasing
+// the sender under WithExtendedRendezvous.
+func (g *Generator) generateReceiveMessage(recv *ast.Receive) {
+	chanRef := g.channelRef(recv.Channel, recv.ChannelIndices)
 
-	if len(recv.Variables) > 0 {
+	if len(recv.Variables) > 0 || recv.Arrays != nil {
 		// Sequential receive: _tmpN := <-c; x = _tmpN._0; y = _tmpN._1
 		tmpName := fmt.Sprintf("_tmp%d", g.tmpCounter)
 		g.tmpCounter++
 		g.writeLine(fmt.Sprintf("%s := <-%s", tmpName, chanRef))
-		varRef := goIdent(recv.Variable)
-		if len(recv.VariableIndices) > 0 {
-			varRef += g.generateIndicesStr(recv.VariableIndices)
-		} else if g.refParams[recv.Variable] {
-			varRef = "*" + varRef
-		}
-		g.writeLine(fmt.Sprintf("%s = %s._0", varRef, tmpName))
-		for i, v := range recv.Variables {
-			vRef := goIdent(v)
-			if g.refParams[v] {
-				vRef = "*" + vRef
-			}
-			g.writeLine(fmt.Sprintf("%s = %s._%d", vRef, tmpName, i+1))
-		}
+		varRef, _ := g.lvalue(recv.Variable, recv.VariableIndices)
+		vars := []string{varRef}
+		for _, v := range recv.Variables {
+			vars = append(vars, g.varRef(v))
+		}
+		var types []string
+		if proto := g.protocolDefs[g.channelProtocol(recv.Channel, recv.ChannelIndices)]; proto != nil {
+			types = proto.Types
+		}
+		g.generateProtocolReceives(tmpName, types, vars, recv.Arrays)
+	} else if proto := g.protocolDefs[g.channelProtocol(recv.Channel, recv.ChannelIndices)]; proto != nil && proto.Kind == "simple" && isFixedArray(proto.Types[0]) {
+		varRef, _ := g.lvalue(recv.Variable, recv.VariableIndices)
+		g.writeLine(fmt.Sprintf("copy(%s, <-%s)", varRef, chanRef))
 	} else {
-		varRef := goIdent(recv.Variable)
-		if len(recv.VariableIndices) > 0 {
-			varRef += g.generateIndicesStr(recv.VariableIndices)
-		} else if g.refParams[recv.Variable] {
-			varRef = "*" + varRef
-		}
+		varRef, _ := g.lvalue(recv.Variable, recv.VariableIndices)
 		g.writeLine(fmt.Sprintf("%s = <-%s", varRef, chanRef))
 	}
 }
@@ -1480,107 +4418,568 @@ func (g *Generator) generateReceive(recv *ast.Receive) {
 func (g *Generator) generateProtocolDecl(proto *ast.ProtocolDecl) {
 	gName := goIdent(proto.Name)
 	switch proto.Kind {
-	case "simple":
-		goType := g.occamTypeToGoBase(proto.Types[0])
-		g.writeLine(fmt.Sprintf("type _proto_%s = %s", gName, goType))
-		g.writeLine("")
-	case "sequential":
-		g.writeLine(fmt.Sprintf("type _proto_%s struct {", gName))
+	case "simple", "sequential":
+		if proto.Kind == "simple" && !hasCountedArray(proto.Items) {
+			goType := g.protocolFieldTypes(proto.Items)[0]
+			g.writeLine(fmt.Sprintf("type %s = %s", g.protoType(proto.Name), goType))
+			g.writeLine("")
+			break
+		}
+		g.writeLine(fmt.Sprintf("type %s struct {", g.protoType(proto.Name)))
 		g.indent++
-		for i, t := range proto.Types {
-			goType := g.occamTypeToGoBase(t)
-			g.writeLine(fmt.Sprintf("_%d %s", i, goType))
+		for i, goType := range g.protocolFieldTypes(proto.Items) {
+			g.writeLine(fmt.Sprintf("%s %s", g.protoField(i), goType))
 		}
 		g.indent--
 		g.writeLine("}")
 		g.writeLine("")
 	case "variant":
-		// Interface type
-		g.writeLine(fmt.Sprintf("type _proto_%s interface {", gName))
-		g.indent++
-		g.writeLine(fmt.Sprintf("_is_%s()", gName))
-		g.indent--
-		g.writeLine("}")
-		g.writeLine("")
+		root := gName
+		if proto.Extends != "" {
+			// One Go type for the whole EXTENDS family, so that channels of
+			// a base and an extended PROTOCOL can be passed for each other;
+			// the base's variant types are reused
+			root = g.protocolRoot(proto.Name)
+			g.writeLine(fmt.Sprintf("type %s = %s", g.protoType(proto.Name), g.protoType(proto.Extends)))
+			g.writeLine("")
+		} else {
+			// Interface type
+			g.writeLine(fmt.Sprintf("type %s interface {", g.protoType(proto.Name)))
+			g.indent++
+			g.writeLine(fmt.Sprintf("_is_%s()", gName))
+			g.indent--
+			g.writeLine("}")
+			g.writeLine("")
+		}
 		// Concrete types for each variant
 		for _, v := range proto.Variants {
-			gTag := goIdent(v.Tag)
+			if v.From != "" {
+				continue
+			}
 			if len(v.Types) == 0 {
 				// No-payload variant: empty struct
-				g.writeLine(fmt.Sprintf("type _proto_%s_%s struct{}", gName, gTag))
+				g.writeLine(fmt.Sprintf("type %s struct{}", g.variantType(proto.Name, v.Tag)))
 			} else {
-				g.writeLine(fmt.Sprintf("type _proto_%s_%s struct {", gName, gTag))
+				g.writeLine(fmt.Sprintf("type %s struct {", g.variantType(proto.Name, v.Tag)))
 				g.indent++
-				for i, t := range v.Types {
-					goType := g.occamTypeToGoBase(t)
-					g.writeLine(fmt.Sprintf("_%d %s", i, goType))
+				for i, goType := range g.protocolFieldTypes(v.Items) {
+					g.writeLine(fmt.Sprintf("%s %s", g.protoField(i), goType))
 				}
 				g.indent--
 				g.writeLine("}")
 			}
-			g.writeLine(fmt.Sprintf("func (_proto_%s_%s) _is_%s() {}", gName, gTag, gName))
+			g.writeLine(fmt.Sprintf("func (%s) _is_%s() {}", g.variantType(proto.Name, v.Tag), root))
 			g.writeLine("")
 		}
 	}
 }
 
-func (g *Generator) generateVariantReceive(vr *ast.VariantReceive) {
-	protoName := g.chanProtocols[vr.Channel]
-	gProtoName := goIdent(protoName)
-	chanRef := goIdent(vr.Channel)
-	if len(vr.ChannelIndices) > 0 {
-		chanRef += g.generateIndicesStr(vr.ChannelIndices)
+// buildManifest describes the package generated from the protocol types
+// among typeDecls and the PROCs and FUNCTIONs procDecls.
+func (g *Generator) buildManifest(typeDecls, procDecls []ast.Statement) Manifest {
+	m := Manifest{Package: g.pkg, Procs: []ManifestProc{}, Protocols: []ManifestProtocol{}}
+	for _, stmt := range procDecls {
+		var mp ManifestProc
+		var params []ast.ProcParam
+		switch decl := stmt.(type) {
+		case *ast.ProcDecl:
+			mp = ManifestProc{Name: decl.Name, Kind: "PROC"}
+			params = decl.Params
+			if _, ok := g.errorChans[decl]; ok {
+				mp.ErrFunc = g.procIdent(decl.Name) + "Err"
+			}
+		case *ast.FuncDecl:
+			mp = ManifestProc{Name: decl.Name, Kind: "FUNCTION"}
+			params = decl.Params
+			for _, t := range decl.Results {
+				mp.Results = append(mp.Results, ManifestType{Type: occamTypeText(t), GoType: g.goType(t, "")})
+			}
+		}
+		mp.GoName = g.procIdent(mp.Name)
+		mp.Params = []ManifestParam{}
+		for i, p := range params {
+			param := ManifestParam{
+				Name:         p.Name,
+				Kind:         "ref",
+				ManifestType: ManifestType{Type: occamTypeText(p.TypeRef), GoType: g.paramGoType(params, i)},
+			}
+			switch {
+			case p.IsChan:
+				param.Kind = "chan"
+				param.Protocol = chanElemType(p.TypeRef)
+				param.Direction = map[string]string{"?": "in", "!": "out"}[p.ChanDir]
+			case p.IsVal:
+				param.Kind = "val"
+			}
+			mp.Params = append(mp.Params, param)
+		}
+		m.Procs = append(m.Procs, mp)
 	}
-	g.writeLine(fmt.Sprintf("switch _v := (<-%s).(type) {", chanRef))
-	for _, vc := range vr.Cases {
-		g.writeLine(fmt.Sprintf("case _proto_%s_%s:", gProtoName, goIdent(vc.Tag)))
-		g.indent++
-		for i, v := range vc.Variables {
-			g.writeLine(fmt.Sprintf("%s = _v._%d", goIdent(v), i))
+	for _, stmt := range typeDecls {
+		proto, ok := stmt.(*ast.ProtocolDecl)
+		if !ok {
+			continue
 		}
-		for _, s := range vc.Body {
-			g.generateStatement(s)
+		mp := ManifestProtocol{Name: proto.Name, GoName: g.protoType(proto.Name), Kind: proto.Kind, Extends: proto.Extends}
+		if proto.Kind == "variant" {
+			for _, v := range proto.Variants {
+				mp.Variants = append(mp.Variants, ManifestVariant{
+					Tag:    v.Tag,
+					GoName: g.variantType(proto.Name, v.Tag),
+					Items:  v.Types,
+					Fields: g.protocolFieldTypes(v.Items),
+				})
+			}
+		} else {
+			mp.Items = proto.Types
+			if proto.Kind == "sequential" || hasCountedArray(proto.Items) {
+				mp.Fields = g.protocolFieldTypes(proto.Items)
+			}
 		}
-		g.indent--
+		m.Protocols = append(m.Protocols, mp)
 	}
-	g.writeLine("}")
+	return m
 }
 
-func (g *Generator) isVariantTag(protoName, tagName string) bool {
-	proto := g.protocolDefs[protoName]
-	if proto == nil {
-		return false
+// occamTypeText returns t as it is written in occam.
+func occamTypeText(t *ast.TypeRef) string {
+	s := ""
+	if t.Mobile {
+		s = "MOBILE "
 	}
-	for _, v := range proto.Variants {
-		if v.Tag == tagName {
-			return true
+	switch t.Kind {
+	case ast.ArrayType:
+		return s + "[" + ast.ExprText(t.Size) + "]" + occamTypeText(t.Elem)
+	case ast.ChanType:
+		return s + "CHAN OF " + occamTypeText(t.Elem)
+	}
+	return s + t.Name
+}
+
+// protocolRoot returns the PROTOCOL at the base of name's EXTENDS chain.
+func (g *Generator) protocolRoot(name string) string {
+	for {
+		proto := g.protocolDefs[name]
+		if proto == nil || proto.Extends == "" {
+			return name
 		}
+		name = proto.Extends
 	}
-	return false
 }
 
-func (g *Generator) collectChanProtocols(stmt ast.Statement) {
-	switch s := stmt.(type) {
-	case *ast.ChanDecl:
-		if _, ok := g.protocolDefs[s.ElemType]; ok {
-			for _, name := range s.Names {
-				g.chanProtocols[name] = s.ElemType
+// variantType returns the Go type of the variant tag of PROTOCOL protoName,
+// which is declared by a base PROTOCOL when inherited through EXTENDS.
+func (g *Generator) variantType(protoName, tag string) string {
+	owner := protoName
+	if proto := g.protocolDefs[protoName]; proto != nil {
+		for _, v := range proto.Variants {
+			if v.Tag == tag && v.From != "" {
+				owner = v.From
 			}
 		}
-	case *ast.SeqBlock:
-		for _, inner := range s.Statements {
-			g.collectChanProtocols(inner)
+	}
+	return fmt.Sprintf("%s_%s", g.protoType(owner), goIdent(tag))
+}
+
+// protoType returns the Go type of PROTOCOL name.
+func (g *Generator) protoType(name string) string {
+	if g.pkg != "" {
+		return exportIdent(g.prefix + "_proto_" + goIdent(name))
+	}
+	return g.prefix + "_proto_" + goIdent(name)
+}
+
+// protoField returns the name of field i of a protocol struct: F0, F1, ...
+// in a package, so that importers can build and read messages.
+func (g *Generator) protoField(i int) string {
+	if g.pkg != "" {
+		return fmt.Sprintf("F%d", i)
+	}
+	return fmt.Sprintf("_%d", i)
+}
+
+// packageName returns the name of the Go package generated.
+func (g *Generator) packageName() string {
+	if g.pkg != "" {
+		return g.pkg
+	}
+	return "main"
+}
+
+// procIdent returns the Go name of a PROC or FUNCTION: exported for the
+// top-level ones of a package (see WithPackage).
+func (g *Generator) procIdent(name string) string {
+	if gName, ok := g.exported[name]; ok {
+		return gName
+	}
+	return goIdent(name)
+}
+
+// exportIdent makes a Go identifier exported: leading underscores are
+// dropped (as for _proto_) and the first letter is upper-cased.
+func exportIdent(id string) string {
+	trimmed := strings.TrimLeft(id, "_")
+	if trimmed == "" {
+		return "X" + id
+	}
+	return strings.ToUpper(trimmed[:1]) + trimmed[1:]
+}
+
+// hasCountedArray reports whether any protocol item type is a counted array.
+func hasCountedArray(items []*ast.TypeRef) bool {
+	for _, t := range items {
+		if t.Kind == ast.CountedType {
+			return true
 		}
-	case *ast.ParBlock:
-		for _, inner := range s.Statements {
-			g.collectChanProtocols(inner)
+	}
+	return false
+}
+
+// isFixedArray reports whether a protocol item type is a fixed-size array.
+func isFixedArray(typ string) bool {
+	_, _, ok := ast.FixedArray(typ)
+	return ok
+}
+
+// protocolFieldTypes returns the Go struct field types for protocol items.
+// A counted array COUNT::[]ELEM takes two fields: the count and a slice; a
+// fixed-size array [SIZE]ELEM takes a slice.
+func (g *Generator) protocolFieldTypes(items []*ast.TypeRef) []string {
+	var fields []string
+	for _, t := range items {
+		switch t.Kind {
+		case ast.CountedType:
+			fields = append(fields, g.occamTypeToGoBase(t.Count.Name), "[]"+g.occamTypeToGoBase(t.Elem.Name))
+		case ast.ArrayType:
+			fields = append(fields, "[]"+g.occamTypeToGoBase(t.Elem.Name))
+		default:
+			fields = append(fields, g.occamTypeToGoBase(t.Name))
+		}
+	}
+	return fields
+}
+
+// generateProtocolValues writes the comma-separated struct field values for
+// sending vals as protocol items of types. A counted array n :: arr sends
+// the count and a copy of the first n elements of arr, and a fixed-size
+// array item a copy of its value (an array, a slice or a string), so that
+// the sender may reuse the array once the receiver has been handed the
+// message.
+func (g *Generator) generateProtocolValues(types []string, vals []ast.Expression) {
+	for i, val := range vals {
+		if i > 0 {
+			g.write(", ")
+		}
+		ca, isCounted := val.(*ast.CountedArrayExpr)
+		var count, elem string
+		ok := false
+		if i < len(types) {
+			count, elem, ok = ast.CountedArray(types[i])
+			if _, elem, fixed := ast.FixedArray(types[i]); fixed && !isCounted {
+				g.write(fmt.Sprintf("append([]%s(nil), ", g.occamTypeToGoBase(elem)))
+				g.generateExpression(val)
+				g.write("...)")
+				continue
+			}
+		}
+		if !isCounted && i < len(types) && types[i] == "BOOL" {
+			g.generateBoolValue(val)
+			continue
+		}
+		if !isCounted || !ok {
+			g.generateExpression(val)
+			continue
+		}
+		g.write(g.occamTypeToGoBase(count) + "(")
+		g.generateExpression(ca.Count)
+		g.write(fmt.Sprintf("), append([]%s(nil), ", g.occamTypeToGoBase(elem)))
+		g.generateExpression(ca.Array)
+		g.write("[:")
+		g.generateExpression(ca.Count)
+		g.write("]...)")
+	}
+}
+
+// generateProtocolReceives assigns the fields of the received message src,
+// whose items are of types, to the Go variables vars, copying fixed-size
+// array items into their variables and counted array items into arrays[i].
+func (g *Generator) generateProtocolReceives(src string, types, vars, arrays []string) {
+	field := 0
+	for i, v := range vars {
+		if i < len(types) && isFixedArray(types[i]) {
+			g.writeLine(fmt.Sprintf("copy(%s, %s.%s)", v, src, g.protoField(field)))
+			field++
+			continue
+		}
+		g.writeLine(fmt.Sprintf("%s = %s.%s", v, src, g.protoField(field)))
+		field++
+		if i < len(arrays) && arrays[i] != "" {
+			g.writeLine(fmt.Sprintf("copy(%s, %s.%s)", goIdent(arrays[i]), src, g.protoField(field)))
+			field++
+		}
+	}
+}
+
+func (g *Generator) generateVariantReceive(vr *ast.VariantReceive) {
+	chanRef := g.channelRef(vr.Channel, vr.ChannelIndices)
+	if !g.rendezvous {
+		g.generateVariantSwitch(vr, "<-"+chanRef)
+		return
+	}
+	// The sender is released before the variant's process runs
+	tmpName := fmt.Sprintf("_tmp%d", g.tmpCounter)
+	g.tmpCounter++
+	g.writeLine(fmt.Sprintf("%s := <-%s", tmpName, chanRef))
+	g.received(chanRef)
+	g.generateVariantSwitch(vr, tmpName)
+}
+
+// generateVariantSwitch generates the type switch of variant receive vr
+// on msg, the Go expression of the message: the receive itself, or the
+// message an ALT has already received.
+func (g *Generator) generateVariantSwitch(vr *ast.VariantReceive, msg string) {
+	protoName := g.channelProtocol(vr.Channel, vr.ChannelIndices)
+	// Bind the message only if a case reads its items: Go rejects an
+	// unused type switch variable
+	bind := ""
+	for _, vc := range vr.Cases {
+		if !vc.IsElse && len(vc.Variables) > 0 {
+			bind = "_v := "
+		}
+	}
+	g.writeLine(fmt.Sprintf("switch %s(%s).(type) {", bind, msg))
+	var elseCase *ast.VariantCase
+	for i, vc := range vr.Cases {
+		if vc.IsElse {
+			elseCase = &vr.Cases[i]
+			continue
+		}
+		g.writeLine(fmt.Sprintf("case %s:", g.variantType(protoName, vc.Tag)))
+		g.indent++
+		for _, d := range vc.Declarations {
+			g.generateStatement(d)
+		}
+		vars := make([]string, len(vc.Variables))
+		for i, v := range vc.Variables {
+			vars[i] = g.varRef(v)
+		}
+		g.generateProtocolReceives("_v", g.variantTypes(protoName, vc.Tag), vars, vc.Arrays)
+		for _, s := range vc.Body {
+			g.generateStatement(s)
+		}
+		g.indent--
+	}
+	if elseCase != nil {
+		// ELSE takes every tag without a case of its own, and nil
+		g.writeLine("default:")
+		g.indent++
+		for _, s := range elseCase.Declarations {
+			g.generateStatement(s)
+		}
+		for _, s := range elseCase.Body {
+			g.generateStatement(s)
+		}
+		g.indent--
+		g.writeLine("}")
+		return
+	}
+	unhandled := g.unhandledVariants(vr)
+	if g.poisonProc != nil {
+		var rest []string
+		for _, tag := range unhandled {
+			if tag == g.poisonTag {
+				g.generatePoisonCase(protoName)
+			} else {
+				rest = append(rest, tag)
+			}
+		}
+		unhandled = rest
+	}
+	if len(unhandled) > 0 {
+		msg := fmt.Sprintf("line %d: variant receive on %s does not handle %s of PROTOCOL %s", vr.Token.Line, vr.Channel, strings.Join(unhandled, ", "), protoName)
+		if g.strict {
+			g.errors = append(g.errors, msg)
+		} else {
+			g.warnings = append(g.warnings, msg)
+		}
+	}
+	// A variant with no case STOPs, as in occam
+	for _, tag := range unhandled {
+		g.writeLine(fmt.Sprintf("case %s:", g.variantType(protoName, tag)))
+		g.indent++
+		g.writeLine(fmt.Sprintf("fmt.Fprintln(os.Stderr, %q)", fmt.Sprintf("STOP: unhandled variant %s received on %s", tag, vr.Channel)))
+		g.writeLine("select {}")
+		g.indent--
+	}
+	// Also reached on a nil message, e.g. from a closed channel
+	g.writeLine("default:")
+	g.indent++
+	g.writeLine(fmt.Sprintf("fmt.Fprintln(os.Stderr, %q)", fmt.Sprintf("STOP: unexpected message received on %s", vr.Channel)))
+	g.writeLine("select {}")
+	g.indent--
+	g.writeLine("}")
+}
+
+// generatePoisonCase emits the case of a variant receive on a channel of
+// protocol protoName that passes the poison tag on to the current PROC's
+// output channels and returns.
+func (g *Generator) generatePoisonCase(protoName string) {
+	g.writeLine(fmt.Sprintf("case %s:", g.variantType(protoName, g.poisonTag)))
+	g.indent++
+	for _, p := range g.poisonProc.Params {
+		elem, dims := p.TypeRef.ChanElem()
+		if p.ChanDir != "!" || elem == nil || !g.isVariantTag(elem.Name, g.poisonTag) {
+			continue
+		}
+		send := "<- " + g.variantType(elem.Name, g.poisonTag) + "{}"
+		if dims == 0 {
+			g.writeLine(goIdent(p.Name) + " " + send)
+			g.sent(goIdent(p.Name))
+			continue
+		}
+		// Channel arrays: poison every element
+		ch := goIdent(p.Name)
+		for d := 0; d < dims; d++ {
+			g.writeLine(fmt.Sprintf("for _, _c%d := range %s {", d, ch))
+			g.indent++
+			ch = fmt.Sprintf("_c%d", d)
+		}
+		g.writeLine(ch + " " + send)
+		g.sent(ch)
+		for d := 0; d < dims; d++ {
+			g.indent--
+			g.writeLine("}")
+		}
+	}
+	g.writeLine("return")
+	g.poisonReturns++
+	g.indent--
+}
+
+// unhandledVariants returns the tags of the channel's protocol, in
+// declaration order, that a variant receive has no case for.
+func (g *Generator) unhandledVariants(vr *ast.VariantReceive) []string {
+	proto := g.protocolDefs[g.channelProtocol(vr.Channel, vr.ChannelIndices)]
+	if proto == nil || proto.Kind != "variant" {
+		return nil
+	}
+	handled := make(map[string]bool)
+	for _, vc := range vr.Cases {
+		handled[vc.Tag] = true
+	}
+	var tags []string
+	for _, v := range proto.Variants {
+		if !handled[v.Tag] {
+			tags = append(tags, v.Tag)
+		}
+	}
+	return tags
+}
+
+// variantTypes returns the item types of the variant tagName of protoName.
+func (g *Generator) variantTypes(protoName, tagName string) []string {
+	proto := g.protocolDefs[protoName]
+	if proto == nil {
+		return nil
+	}
+	for _, v := range proto.Variants {
+		if v.Tag == tagName {
+			return v.Types
+		}
+	}
+	return nil
+}
+
+func (g *Generator) isVariantTag(protoName, tagName string) bool {
+	proto := g.protocolDefs[protoName]
+	if proto == nil {
+		return false
+	}
+	for _, v := range proto.Variants {
+		if v.Tag == tagName {
+			return true
+		}
+	}
+	return false
+}
+
+// collectTypeDecls records the PROTOCOL, RECORD and DATA TYPE declarations
+// in stmts and in the blocks and PROCs nested in them.
+func (g *Generator) collectTypeDecls(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.ProtocolDecl:
+			g.protocolDefs[s.Name] = s
+		case *ast.RecordDecl:
+			g.recordDefs[s.Name] = s
+			if s.ChanType {
+				g.needSync = true
+			}
+		case *ast.DataTypeDecl:
+			g.dataTypes[s.Name] = s.Type
+		case *ast.SeqBlock:
+			g.collectTypeDecls(s.Statements)
+		case *ast.ParBlock:
+			g.collectTypeDecls(s.Statements)
+		case *ast.ProcDecl:
+			g.collectTypeDecls(s.Body)
+		case *ast.FuncDecl:
+			g.collectTypeDecls(s.Body)
+		case *ast.WhileLoop:
+			g.collectTypeDecls(s.Body)
+		case *ast.ClaimBlock:
+			g.collectTypeDecls(s.Body)
+		case *ast.ForkingBlock:
+			g.collectTypeDecls(s.Body)
+		case *ast.IfStatement:
+			for _, choice := range s.Choices {
+				if choice.NestedIf != nil {
+					g.collectTypeDecls([]ast.Statement{choice.NestedIf})
+				}
+				g.collectTypeDecls(choice.Body)
+			}
+		case *ast.CaseStatement:
+			for _, choice := range s.Choices {
+				g.collectTypeDecls(choice.Body)
+			}
+		case *ast.AltBlock:
+			for _, c := range s.Cases {
+				g.collectTypeDecls(c.Body)
+			}
+		case *ast.VariantReceive:
+			for _, c := range s.Cases {
+				g.collectTypeDecls(c.Body)
+			}
+		}
+	}
+}
+
+func (g *Generator) collectChanProtocols(stmt ast.Statement) {
+	switch s := stmt.(type) {
+	case *ast.ChanDecl:
+		if _, ok := g.protocolDefs[s.ElemType]; ok {
+			for _, name := range s.Names {
+				g.chanProtocols[name] = s.ElemType
+			}
+		}
+	case *ast.Abbreviation:
+		if _, ok := g.protocolDefs[s.Type]; ok && s.IsChan {
+			g.chanProtocols[s.Name] = s.Type
+		}
+	case *ast.SeqBlock:
+		for _, inner := range s.Statements {
+			g.collectChanProtocols(inner)
+		}
+	case *ast.ParBlock:
+		for _, inner := range s.Statements {
+			g.collectChanProtocols(inner)
 		}
 	case *ast.ProcDecl:
 		// Register PROC param channels (including channel array params)
 		for _, p := range s.Params {
-			if p.IsChan || p.ChanArrayDims > 0 {
-				if _, ok := g.protocolDefs[p.ChanElemType]; ok {
-					g.chanProtocols[p.Name] = p.ChanElemType
+			if elem := chanElemType(p.TypeRef); elem != "" {
+				if _, ok := g.protocolDefs[elem]; ok {
+					g.chanProtocols[p.Name] = elem
 				}
 			}
 		}
@@ -1591,6 +4990,14 @@ func (g *Generator) collectChanProtocols(stmt ast.Statement) {
 		for _, inner := range s.Body {
 			g.collectChanProtocols(inner)
 		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			g.collectChanProtocols(inner)
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			g.collectChanProtocols(inner)
+		}
 	case *ast.WhileLoop:
 		for _, inner := range s.Body {
 			g.collectChanProtocols(inner)
@@ -1643,6 +5050,14 @@ func (g *Generator) collectBoolVars(stmt ast.Statement) {
 		for _, inner := range s.Body {
 			g.collectBoolVars(inner)
 		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			g.collectBoolVars(inner)
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			g.collectBoolVars(inner)
+		}
 	case *ast.WhileLoop:
 		for _, inner := range s.Body {
 			g.collectBoolVars(inner)
@@ -1673,6 +5088,14 @@ func (g *Generator) collectRecordVars(stmt ast.Statement) {
 				g.recordVars[name] = s.Type
 			}
 		}
+	case *ast.Abbreviation:
+		if _, ok := g.recordDefs[s.Type]; ok && s.TypeRef.IsData() {
+			g.recordVars[s.Name] = s.Type
+		}
+	case *ast.RetypesDecl:
+		if _, ok := g.recordDefs[s.TargetType]; ok && len(s.Sizes) == 0 {
+			g.recordVars[s.Name] = s.TargetType
+		}
 	case *ast.SeqBlock:
 		for _, inner := range s.Statements {
 			g.collectRecordVars(inner)
@@ -1696,6 +5119,14 @@ func (g *Generator) collectRecordVars(stmt ast.Statement) {
 		for _, inner := range s.Body {
 			g.collectRecordVars(inner)
 		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			g.collectRecordVars(inner)
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			g.collectRecordVars(inner)
+		}
 	case *ast.WhileLoop:
 		for _, inner := range s.Body {
 			g.collectRecordVars(inner)
@@ -1724,76 +5155,393 @@ func (g *Generator) collectRecordVars(stmt ast.Statement) {
 	}
 }
 
-func (g *Generator) generateRecordDecl(rec *ast.RecordDecl) {
-	g.writeLine(fmt.Sprintf("type %s struct {", goIdent(rec.Name)))
-	g.indent++
-	for _, f := range rec.Fields {
-		goType := g.occamTypeToGoBase(f.Type)
-		g.writeLine(fmt.Sprintf("%s %s", goIdent(f.Name), goType))
+// collectArrayVars records the one-dimensional array variables, abbreviations
+// and parameters declared in stmt, with their element types, and the scalar
+// BYTE ones.
+func (g *Generator) collectArrayVars(stmt ast.Statement) {
+	switch s := stmt.(type) {
+	case *ast.VarDecl:
+		for _, name := range s.Names {
+			g.byteVars[name] = s.Type == "BYTE"
+		}
+	case *ast.ArrayDecl:
+		for _, name := range s.Names {
+			g.recordArrayVar(name, s.Type, len(s.Sizes))
+		}
+	case *ast.Abbreviation:
+		if s.TypeRef.IsDataArray() {
+			dims, elem := s.TypeRef.Dims()
+			g.recordArrayVar(s.Name, elem.Name, dims)
+		}
+		g.byteVars[s.Name] = isByteType(s.TypeRef)
+	case *ast.RetypesDecl:
+		if len(s.Sizes) > 0 {
+			g.recordArrayVar(s.Name, s.TargetType, len(s.Sizes))
+		}
+	case *ast.SeqBlock:
+		for _, inner := range s.Statements {
+			g.collectArrayVars(inner)
+		}
+	case *ast.ParBlock:
+		for _, inner := range s.Statements {
+			g.collectArrayVars(inner)
+		}
+	case *ast.ProcDecl:
+		g.collectArrayParams(s.Params)
+		for _, inner := range s.Body {
+			g.collectArrayVars(inner)
+		}
+	case *ast.FuncDecl:
+		g.collectArrayParams(s.Params)
+		for _, inner := range s.Body {
+			g.collectArrayVars(inner)
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			g.collectArrayVars(inner)
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			g.collectArrayVars(inner)
+		}
+	case *ast.WhileLoop:
+		for _, inner := range s.Body {
+			g.collectArrayVars(inner)
+		}
+	case *ast.IfStatement:
+		for _, choice := range s.Choices {
+			if choice.NestedIf != nil {
+				g.collectArrayVars(choice.NestedIf)
+			}
+			for _, inner := range choice.Body {
+				g.collectArrayVars(inner)
+			}
+		}
+	case *ast.CaseStatement:
+		for _, choice := range s.Choices {
+			for _, inner := range choice.Body {
+				g.collectArrayVars(inner)
+			}
+		}
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			for _, inner := range c.Declarations {
+				g.collectArrayVars(inner)
+			}
+			for _, inner := range c.Body {
+				g.collectArrayVars(inner)
+			}
+		}
+	case *ast.VariantReceive:
+		for _, c := range s.Cases {
+			for _, inner := range c.Declarations {
+				g.collectArrayVars(inner)
+			}
+			for _, inner := range c.Body {
+				g.collectArrayVars(inner)
+			}
+		}
 	}
-	g.indent--
-	g.writeLine("}")
-	g.writeLine("")
 }
 
-// occamTypeToGoBase converts a type name without checking protocol defs
-// (used inside protocol generation to avoid infinite recursion)
-func (g *Generator) occamTypeToGoBase(occamType string) string {
-	switch occamType {
-	case "INT":
-		return "int"
-	case "INT16":
-		return "int16"
-	case "INT32":
-		return "int32"
-	case "INT64":
-		return "int64"
-	case "BYTE":
-		return "byte"
-	case "BOOL":
-		return "bool"
-	case "REAL":
-		return "float64"
-	case "REAL32":
-		return "float32"
-	case "REAL64":
-		return "float64"
-	default:
-		return occamType
+func (g *Generator) collectArrayParams(params []ast.ProcParam) {
+	for _, p := range params {
+		if p.TypeRef.IsDataArray() {
+			dims, elem := p.TypeRef.Dims()
+			g.recordArrayVar(p.Name, elem.Name, dims)
+		}
+		g.byteVars[p.Name] = isByteType(p.TypeRef)
 	}
 }
 
-func (g *Generator) occamTypeToGo(occamType string) string {
-	switch occamType {
-	case "INT":
-		return "int"
-	case "INT16":
-		return "int16"
-	case "INT32":
-		return "int32"
-	case "INT64":
-		return "int64"
-	case "BYTE":
-		return "byte"
-	case "BOOL":
-		return "bool"
-	case "REAL":
-		return "float64"
-	case "REAL32":
-		return "float32"
-	case "REAL64":
-		return "float64"
-	default:
-		// Check if it's a protocol name
-		if _, ok := g.protocolDefs[occamType]; ok {
-			return "_proto_" + goIdent(occamType)
+// recordArrayVar records name as an array of elem with dims dimensions,
+// in arrayVars when it has one and in multiArrays when it has more.
+func (g *Generator) recordArrayVar(name, elem string, dims int) {
+	switch {
+	case dims == 1:
+		g.arrayVars[name] = elem
+		delete(g.multiArrays, name)
+	case dims > 1:
+		g.multiArrays[name] = multiArray{elem: elem, dims: dims}
+		delete(g.arrayVars, name)
+	}
+}
+
+// collectBidiChans marks the directed channel params in dirChans (by name)
+// that stmt passes to a callee's undirected CHAN param.
+func (g *Generator) collectBidiChans(stmt ast.Statement, dirChans map[string]*ast.ProcParam) {
+	switch s := stmt.(type) {
+	case *ast.ProcDecl:
+		inner := make(map[string]*ast.ProcParam)
+		for name, p := range dirChans {
+			inner[name] = p
+		}
+		for i := range s.Params {
+			delete(inner, s.Params[i].Name)
+			if s.Params[i].IsChan && s.Params[i].ChanDir != "" {
+				inner[s.Params[i].Name] = &s.Params[i]
+			}
+		}
+		for _, st := range s.Body {
+			g.collectBidiChans(st, inner)
+		}
+	case *ast.ForkStmt:
+		g.collectBidiChans(s.Call, dirChans)
+	case *ast.ProcCall:
+		sig := g.procSigs[s.Name]
+		for i, arg := range s.Args {
+			ident, ok := arg.(*ast.Identifier)
+			if !ok || i >= len(sig) || !sig[i].IsChan || (sig[i].ChanDir != "" && !g.bidiChans[&sig[i]]) {
+				continue
+			}
+			if p, ok := dirChans[ident.Value]; ok {
+				g.bidiChans[p] = true
+			}
+		}
+	case *ast.SeqBlock:
+		for _, inner := range s.Statements {
+			g.collectBidiChans(inner, dirChans)
+		}
+	case *ast.ParBlock:
+		for _, inner := range s.Statements {
+			g.collectBidiChans(inner, dirChans)
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			g.collectBidiChans(inner, dirChans)
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			g.collectBidiChans(inner, dirChans)
+		}
+	case *ast.WhileLoop:
+		for _, inner := range s.Body {
+			g.collectBidiChans(inner, dirChans)
+		}
+	case *ast.IfStatement:
+		for _, choice := range s.Choices {
+			if choice.NestedIf != nil {
+				g.collectBidiChans(choice.NestedIf, dirChans)
+			}
+			for _, inner := range choice.Body {
+				g.collectBidiChans(inner, dirChans)
+			}
+		}
+	case *ast.CaseStatement:
+		for _, choice := range s.Choices {
+			for _, inner := range choice.Body {
+				g.collectBidiChans(inner, dirChans)
+			}
+		}
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				g.collectBidiChans(inner, dirChans)
+			}
+		}
+	case *ast.VariantReceive:
+		for _, c := range s.Cases {
+			for _, inner := range c.Body {
+				g.collectBidiChans(inner, dirChans)
+			}
+		}
+	}
+}
+
+func (g *Generator) generateRecordDecl(rec *ast.RecordDecl) {
+	g.writeLine(fmt.Sprintf("type %s struct {", goIdent(rec.Name)))
+	g.indent++
+	for _, f := range rec.Fields {
+		goType := g.occamTypeToGoBase(f.Type)
+		if f.IsChan {
+			goType = "chan " + g.occamTypeToGo(f.Type)
+		}
+		g.writeLine(fmt.Sprintf("%s %s", goIdent(f.Name), goType))
+	}
+	if rec.ChanType {
+		// Shared by all copies of the ends; held by CLAIM
+		g.writeLine("_claim *sync.Mutex")
+	}
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// generateMobile emits a new bundle of CHAN TYPE typ, with its channels
+// and CLAIM lock made.
+func (g *Generator) generateMobile(typ string) {
+	g.write(goIdent(typ) + "{")
+	if rec := g.recordDefs[typ]; rec != nil {
+		for _, f := range rec.Fields {
+			g.write(fmt.Sprintf("%s: make(chan %s), ", goIdent(f.Name), g.occamTypeToGo(f.Type)))
+		}
+	}
+	g.write("_claim: new(sync.Mutex)}")
+}
+
+// generateClaimBlock emits CLAIM name as the body run with the bundle's
+// lock held, so that one process at a time uses a SHARED end.
+func (g *Generator) generateClaimBlock(claim *ast.ClaimBlock) {
+	mu := goIdent(claim.Name) + "._claim"
+	if _, isChan := g.chanElemTypes[claim.Name]; isChan {
+		// A SHARED channel: CLAIM c claims its ! end unless written c?
+		end := claim.End
+		if end == "" {
+			end = "!"
+		}
+		mu = fmt.Sprintf("%s_chanClaim(%s, %q)", g.prefix, goIdent(claim.Name), end)
+	}
+	g.writeLine(mu + ".Lock()")
+	for _, s := range claim.Body {
+		g.generateStatement(s)
+	}
+	g.writeLine(mu + ".Unlock()")
+}
+
+// generateForkingBlock emits FORKING as its body followed by a wait for
+// the processes FORKed inside it.
+func (g *Generator) generateForkingBlock(block *ast.ForkingBlock) {
+	wg := fmt.Sprintf("_forking%d", g.tmpCounter)
+	g.tmpCounter++
+	g.writeLine(fmt.Sprintf("var %s sync.WaitGroup", wg))
+	oldForking := g.forking
+	g.forking = wg
+	for _, s := range block.Body {
+		g.generateStatement(s)
+	}
+	g.forking = oldForking
+	g.writeLine(fmt.Sprintf("%s.Wait()", wg))
+}
+
+// generateFork emits FORK p(args) as a goroutine counted by the enclosing
+// FORKING block. The arguments are evaluated before the goroutine starts,
+// as occam-pi passes them when the process is forked: data passed by
+// reference is copied, and a MOBILE argument moves to the new process.
+func (g *Generator) generateFork(fork *ast.ForkStmt) {
+	if g.forking == "" {
+		g.errors = append(g.errors, fmt.Sprintf("line %d: FORK outside a FORKING block", fork.Token.Line))
+		return
+	}
+	name, params := g.procLookup(fork.Call.Name)
+	if len(params) != len(fork.Call.Args) {
+		g.errors = append(g.errors, fmt.Sprintf("line %d: FORK %s: expected %d arguments, got %d", fork.Token.Line, fork.Call.Name, len(params), len(fork.Call.Args)))
+		return
+	}
+	argParams := make([]ast.ProcParam, len(params))
+	var decls, args []string
+	for i, p := range params {
+		argParams[i] = p
+		arg := fmt.Sprintf("_f%d", i)
+		goType := g.paramGoType(params, i)
+		// A BARRIER stays shared with the forking process
+		if p.TypeRef.IsData() && !p.IsVal && p.Type != "BARRIER" {
+			argParams[i].IsVal = true
+			goType = g.goType(p.TypeRef, "")
+			arg = "&" + arg
+		}
+		decls = append(decls, fmt.Sprintf("_f%d %s", i, goType))
+		args = append(args, arg)
+	}
+	g.writeLine(g.forking + ".Add(1)")
+	g.writeLine(fmt.Sprintf("go func(%s) {", strings.Join(decls, ", ")))
+	g.indent++
+	g.writeLine(fmt.Sprintf("defer %s.Done()", g.forking))
+	g.writeLine(fmt.Sprintf("%s(%s)", name, strings.Join(args, ", ")))
+	g.indent--
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write("}(")
+	g.generateProcArgs(argParams, fork.Call.Args)
+	g.write(")\n")
+	for i, arg := range fork.Call.Args {
+		if params[i].Mobile && !params[i].IsVal {
+			g.moveMobile(arg)
 		}
-		// Check if it's a record type name
-		if _, ok := g.recordDefs[occamType]; ok {
+	}
+}
+
+// occamTypeToGoBase converts a type name without checking protocol defs
+// (used inside protocol generation to avoid infinite recursion)
+func (g *Generator) occamTypeToGoBase(occamType string) string {
+	if goType, ok := g.goTypes[occamType]; ok {
+		return goType
+	}
+	if _, ok := g.dataTypes[occamType]; ok {
+		return goIdent(occamType)
+	}
+	return occamType
+}
+
+// intType returns the Go type of occam INT: int unless WithWordSize or
+// WithTypeMap choose another.
+func (g *Generator) intType() string {
+	return g.goTypes["INT"]
+}
+
+// asInt returns the Go int expression v converted to INT's Go type, for
+// lengths, loop counters and clock readings that Go gives as int.
+func (g *Generator) asInt(v string) string {
+	if t := g.intType(); t != "int" {
+		return t + "(" + v + ")"
+	}
+	return v
+}
+
+// generateIntExpression writes e converted to INT's Go type where that is
+// not int, so that a variable declared from an untyped constant is an INT.
+func (g *Generator) generateIntExpression(e ast.Expression) {
+	if t := g.intType(); t != "int" {
+		g.write(t + "(")
+		g.generateExpression(e)
+		g.write(")")
+		return
+	}
+	g.generateExpression(e)
+}
+
+// primitiveType returns the primitive type that occamType, which may be
+// a DATA TYPE, is defined as.
+func (g *Generator) primitiveType(occamType string) string {
+	for {
+		t, ok := g.dataTypes[occamType]
+		if !ok {
 			return occamType
 		}
-		return occamType // pass through unknown types
+		occamType = t
+	}
+}
+
+// carriesBool reports whether channels of elemType carry BOOLs: directly,
+// as a simple PROTOCOL or as a DATA TYPE.
+func (g *Generator) carriesBool(elemType string) bool {
+	if proto, ok := g.protocolDefs[elemType]; ok && proto.Kind == "simple" && len(proto.Types) == 1 {
+		elemType = proto.Types[0]
+	}
+	return g.primitiveType(elemType) == "BOOL"
+}
+
+func (g *Generator) occamTypeToGo(occamType string) string {
+	if goType, ok := g.goTypes[occamType]; ok {
+		return goType
 	}
+	if occamType == "BARRIER" {
+		return g.prefix + "_barrier"
+	}
+	// MOBILE array carried by a channel: CHAN MOBILE []BYTE
+	if elem, ok := strings.CutPrefix(occamType, "[]"); ok {
+		return "[]" + g.occamTypeToGo(elem)
+	}
+	// Check if it's a protocol name
+	if _, ok := g.protocolDefs[occamType]; ok {
+		return g.protoType(occamType)
+	}
+	// Check if it's a record type name or DATA TYPE
+	if _, ok := g.recordDefs[occamType]; ok {
+		return goIdent(occamType)
+	}
+	if _, ok := g.dataTypes[occamType]; ok {
+		return goIdent(occamType)
+	}
+	return occamType // pass through unknown types
 }
 
 func isOccamIntType(t string) bool {
@@ -1810,62 +5558,70 @@ func (g *Generator) generateAssignment(assign *ast.Assignment) {
 	if assign.SliceTarget != nil {
 		// Slice assignment: [arr FROM start FOR length] := value
 		// Maps to: copy(arr[start : start + length], value)
-		g.write("copy(")
-		g.generateExpression(assign.SliceTarget.Array)
-		g.write("[")
-		g.generateExpression(assign.SliceTarget.Start)
-		g.write(" : ")
-		g.generateExpression(assign.SliceTarget.Start)
-		g.write(" + ")
-		g.generateExpression(assign.SliceTarget.Length)
-		g.write("], ")
-		g.generateExpression(assign.Value)
+		t := assign.SliceTarget
+		g.write("copy(" + g.slice(t.Array, t.Start, t.Length, assign.Token.Line) + ", ")
+		if elem, _ := g.arrayElemType(t.Array); typedByTarget(assign.Value) && elem != "" {
+			g.generateTypedLiteral(assign.Value, elem, 1)
+		} else {
+			g.generateExpression(assign.Value)
+		}
 		g.write(")\n")
 		return
 	}
 
-	if len(assign.Indices) > 0 {
-		// Check if this is a record field access (single index that is an identifier)
-		if len(assign.Indices) == 1 {
-			if _, ok := g.recordVars[assign.Name]; ok {
-				if ident, ok := assign.Indices[0].(*ast.Identifier); ok {
-					// Record field: p.x = value (Go auto-dereferences pointers)
-					g.write(goIdent(assign.Name))
-					g.write(".")
-					g.write(goIdent(ident.Value))
-					g.write(" = ")
-					g.generateExpression(assign.Value)
-					g.write("\n")
-					return
-				}
-			}
-		}
-		// Array index: dereference if ref param
-		if g.refParams[assign.Name] {
-			g.write("*")
-		}
-		g.write(goIdent(assign.Name))
-		g.generateIndices(assign.Indices)
-	} else {
-		// Simple assignment: dereference if ref param
-		if g.refParams[assign.Name] {
-			g.write("*")
+	ref, fieldType := g.lvalue(assign.Name, assign.Indices)
+	g.write(ref)
+	if fieldType == "BOOL" || len(assign.Indices) == 0 && g.boolVars[assign.Name] {
+		g.write(" = ")
+		g.generateBoolValue(assign.Value)
+		g.write("\n")
+		if len(assign.Indices) == 0 {
+			g.moveMobile(assign.Value)
 		}
-		g.write(goIdent(assign.Name))
+		return
 	}
 	g.write(" = ")
-	g.generateExpression(assign.Value)
+	if elem := g.arrayVars[assign.Name]; typedByTarget(assign.Value) && len(assign.Indices) == 0 && elem != "" {
+		g.generateTypedLiteral(assign.Value, elem, 1)
+	} else {
+		g.generateExpression(assign.Value)
+	}
 	g.write("\n")
+	if len(assign.Indices) == 0 {
+		g.moveMobile(assign.Value)
+	}
+}
+
+// typedByTarget reports whether e is an array literal without a decoration,
+// or an array constructor, whose element type is then taken from the array
+// it is assigned to.
+func typedByTarget(e ast.Expression) bool {
+	if _, ok := e.(*ast.ArrayConstructor); ok {
+		return true
+	}
+	al, ok := e.(*ast.ArrayLiteral)
+	return ok && al.Type == ""
+}
+
+// isTable reports whether e is an array literal or constructor, which
+// generateTypedLiteral gives the type of its declaration.
+func isTable(e ast.Expression) bool {
+	switch e.(type) {
+	case *ast.ArrayLiteral, *ast.ArrayConstructor:
+		return true
+	}
+	return false
 }
 
 func (g *Generator) generateSeqBlock(seq *ast.SeqBlock) {
 	if seq.Replicator != nil {
+		g.declareAltTimers(seq.Statements)
 		if seq.Replicator.Step != nil {
 			// Replicated SEQ with STEP: counter-based loop
 			v := goIdent(seq.Replicator.Variable)
 			counter := "_repl_" + v
 			g.builder.WriteString(strings.Repeat("\t", g.indent))
-			g.write(fmt.Sprintf("for %s := 0; %s < ", counter, counter))
+			g.write(fmt.Sprintf("for %s := %s; %s < ", counter, g.asInt("0"), counter))
 			g.generateExpression(seq.Replicator.Count)
 			g.write(fmt.Sprintf("; %s++ {\n", counter))
 			g.indent++
@@ -1880,7 +5636,7 @@ func (g *Generator) generateSeqBlock(seq *ast.SeqBlock) {
 			v := goIdent(seq.Replicator.Variable)
 			g.builder.WriteString(strings.Repeat("\t", g.indent))
 			g.write(fmt.Sprintf("for %s := ", v))
-			g.generateExpression(seq.Replicator.Start)
+			g.generateIntExpression(seq.Replicator.Start)
 			g.write(fmt.Sprintf("; %s < ", v))
 			g.generateExpression(seq.Replicator.Start)
 			g.write(" + ")
@@ -1888,6 +5644,7 @@ func (g *Generator) generateSeqBlock(seq *ast.SeqBlock) {
 			g.write(fmt.Sprintf("; %s++ {\n", v))
 			g.indent++
 		}
+		g.generatePriYield()
 		g.generateStatementsWithScoping(seq.Statements)
 		g.indent--
 		g.writeLine("}")
@@ -1898,6 +5655,18 @@ func (g *Generator) generateSeqBlock(seq *ast.SeqBlock) {
 }
 
 func (g *Generator) generateParBlock(par *ast.ParBlock) {
+	// PAR branches run as goroutines, out of reach of a poison return
+	oldPoisonProc := g.poisonProc
+	g.poisonProc = nil
+	defer func() { g.poisonProc = oldPoisonProc }()
+
+	if par.Processors != nil {
+		if g.rejectPlacement {
+			g.errors = append(g.errors, fmt.Sprintf("line %d: PLACED PAR cannot place processes on processors", par.Token.Line))
+		}
+		g.writeLine("// PLACED PAR")
+	}
+
 	if par.Replicator != nil {
 		// Replicated PAR: PAR i = start FOR count becomes goroutines in a loop
 		g.writeLine("var wg sync.WaitGroup")
@@ -1905,12 +5674,17 @@ func (g *Generator) generateParBlock(par *ast.ParBlock) {
 		g.write("wg.Add(int(")
 		g.generateExpression(par.Replicator.Count)
 		g.write("))\n")
+		resigns := g.generateEnroll(par, func() {
+			g.write("int(")
+			g.generateExpression(par.Replicator.Count)
+			g.write(")")
+		})
 
 		v := goIdent(par.Replicator.Variable)
 		if par.Replicator.Step != nil {
 			counter := "_repl_" + v
 			g.builder.WriteString(strings.Repeat("\t", g.indent))
-			g.write(fmt.Sprintf("for %s := 0; %s < ", counter, counter))
+			g.write(fmt.Sprintf("for %s := %s; %s < ", counter, g.asInt("0"), counter))
 			g.generateExpression(par.Replicator.Count)
 			g.write(fmt.Sprintf("; %s++ {\n", counter))
 			g.indent++
@@ -1924,22 +5698,62 @@ func (g *Generator) generateParBlock(par *ast.ParBlock) {
 		} else {
 			g.builder.WriteString(strings.Repeat("\t", g.indent))
 			g.write(fmt.Sprintf("for %s := ", v))
-			g.generateExpression(par.Replicator.Start)
+			g.generateIntExpression(par.Replicator.Start)
 			g.write(fmt.Sprintf("; %s < ", v))
 			g.generateExpression(par.Replicator.Start)
 			g.write(" + ")
 			g.generateExpression(par.Replicator.Count)
 			g.write(fmt.Sprintf("; %s++ {\n", v))
 			g.indent++
-			// Capture loop variable to avoid closure issues
-			g.writeLine(fmt.Sprintf("%s := %s", v, v))
+			if g.goMinor < 22 {
+				// Before Go 1.22 all iterations share v, so give each
+				// goroutine its own copy
+				g.writeLine(fmt.Sprintf("%s := %s", v, v))
+			}
 		}
 		g.writeLine("go func() {")
 		g.indent++
 		g.writeLine("defer wg.Done()")
-		for _, stmt := range par.Statements {
+		if g.parRecover {
+			g.writeLine(fmt.Sprintf("defer %s_parRecover(%q, int(%s), %q, %q)", g.prefix, par.Replicator.Variable, v, g.linePos(par.Token.Line), g.parRecoverProc()))
+		}
+		for _, line := range resigns {
+			g.writeLine(line)
+		}
+		oldPriYield := g.priYield
+		if par.Priority && g.priPar == PriParLockThread {
+			// The first iteration is the highest priority branch
+			g.builder.WriteString(strings.Repeat("\t", g.indent))
+			g.write(fmt.Sprintf("if %s == ", v))
+			g.generateExpression(par.Replicator.Start)
+			g.write(" {\n")
+			g.indent++
+			g.generatePriHigh()
+			g.indent--
+			g.writeLine("}")
+		} else if par.Priority && g.priPar == PriParYield && g.priYield != "true" {
+			// Every iteration but the first is lower priority, as is all of
+			// a branch that is already
+			low := fmt.Sprintf("_priLow%d", g.tmpCounter)
+			g.tmpCounter++
+			g.builder.WriteString(strings.Repeat("\t", g.indent))
+			g.write(low + " := ")
+			if g.priYield != "" {
+				g.write(g.priYield + " || ")
+			}
+			g.write(v + " != ")
+			g.generateExpression(par.Replicator.Start)
+			g.write("\n")
+			g.priYield = low
+			g.generatePriYield()
+		}
+		for i, stmt := range par.Statements {
+			if par.Processors != nil {
+				g.generateProcessorComment(par.Processors[i])
+			}
 			g.generateStatement(stmt)
 		}
+		g.priYield = oldPriYield
 		g.indent--
 		g.writeLine("}()")
 
@@ -1948,14 +5762,36 @@ func (g *Generator) generateParBlock(par *ast.ParBlock) {
 		g.writeLine("wg.Wait()")
 	} else {
 		// PAR becomes goroutines with WaitGroup
+		branches := par.Branches()
 		g.writeLine("var wg sync.WaitGroup")
-		g.writeLine(fmt.Sprintf("wg.Add(%d)", len(par.Statements)))
+		g.writeLine(fmt.Sprintf("wg.Add(%d)", len(branches)))
+		resigns := g.generateEnroll(par, func() {
+			g.write(fmt.Sprint(len(branches)))
+		})
 
-		for _, stmt := range par.Statements {
+		for i, branch := range branches {
 			g.writeLine("go func() {")
 			g.indent++
 			g.writeLine("defer wg.Done()")
-			g.generateStatement(stmt)
+			if g.parRecover {
+				g.writeLine(fmt.Sprintf("defer %s_parRecover(\"\", %d, %q, %q)", g.prefix, i+1, g.linePos(par.Token.Line), g.parRecoverProc()))
+			}
+			for _, line := range resigns {
+				g.writeLine(line)
+			}
+			oldPriYield := g.priYield
+			if par.Priority && i == 0 {
+				g.generatePriHigh()
+			} else if par.Priority {
+				g.generatePriLow()
+			}
+			if par.Processors != nil {
+				g.generateProcessorComment(par.Processors[i])
+			}
+			for _, stmt := range branch {
+				g.generateStatement(stmt)
+			}
+			g.priYield = oldPriYield
 			g.indent--
 			g.writeLine("}()")
 		}
@@ -1964,11 +5800,212 @@ func (g *Generator) generateParBlock(par *ast.ParBlock) {
 	}
 }
 
+// generatePriHigh starts the highest priority branch of a PRI PAR, which
+// under PriParLockThread gets an OS thread of its own until it ends.
+func (g *Generator) generatePriHigh() {
+	if g.priPar == PriParLockThread {
+		g.writeLine("runtime.LockOSThread()")
+		g.writeLine("defer runtime.UnlockOSThread()")
+	}
+}
+
+// generatePriLow starts a lower priority branch of a PRI PAR, which under
+// PriParYield yields now and, through priYield, in each of its loops.
+func (g *Generator) generatePriLow() {
+	if g.priPar == PriParYield {
+		g.writeLine("runtime.Gosched()")
+		g.priYield = "true"
+	}
+}
+
+// generatePriYield yields at the top of a loop body in a lower priority
+// PRI PAR branch (see WithPriPar).
+func (g *Generator) generatePriYield() {
+	switch g.priYield {
+	case "":
+	case "true":
+		g.writeLine("runtime.Gosched()")
+	default:
+		g.writeLine(fmt.Sprintf("if %s {", g.priYield))
+		g.writeLine("\truntime.Gosched()")
+		g.writeLine("}")
+	}
+}
+
+// generateEnroll enrolls the branches of a PAR ENROLL on each of its
+// barriers, count writing the number of branches, and returns the lines each
+// branch starts with to resign when it finishes.
+func (g *Generator) generateEnroll(par *ast.ParBlock, count func()) []string {
+	var resigns []string
+	for _, name := range par.Enroll {
+		left := fmt.Sprintf("_enroll%d", g.tmpCounter)
+		g.tmpCounter++
+		g.builder.WriteString(strings.Repeat("\t", g.indent))
+		g.write(left + " := ")
+		count()
+		g.write("\n")
+		g.writeLine(fmt.Sprintf("%s.enrollPar(%s)", goIdent(name), left))
+		resigns = append(resigns, fmt.Sprintf("defer %s.resignPar(&%s)", goIdent(name), left))
+	}
+	return resigns
+}
+
+// generateProcessorComment records a PLACED PAR branch's PROCESSOR line.
+func (g *Generator) generateProcessorComment(proc *ast.Processor) {
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write("// PROCESSOR ")
+	g.generateExpression(proc.Number)
+	g.write(" " + proc.Type + "\n")
+}
+
+// generatePlaceDecl leaves a comment for PLACE name AT address: the variable
+// stays wherever Go puts it.
+func (g *Generator) generatePlaceDecl(decl *ast.PlaceDecl) {
+	if g.rejectPlacement {
+		g.errors = append(g.errors, fmt.Sprintf("line %d: PLACE %s AT cannot place at an address", decl.Token.Line, decl.Name))
+	}
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write(fmt.Sprintf("// PLACE %s AT ", goIdent(decl.Name)))
+	g.generateExpression(decl.Address)
+	g.write("\n")
+}
+
+// foldAltGuards rewrites the ALTs in stmts, and the statements nested in
+// them, in place: an alternative whose guard is constant FALSE can never be
+// chosen and is removed, and a constant TRUE guard is dropped, so neither
+// needs a nil channel set up before the select. Of several unguarded SKIP
+// alternatives only the first is kept, as a select can have one default. An
+// ALT left with no alternatives is STOP, as in occam. The channels of removed
+// alternatives are noted in prunedAltChans against the ALT or its STOP.
+// Without the fold-guards pass, only SKIP alternatives are folded, since
+// the select could otherwise have more than one default.
+func (g *Generator) foldAltGuards(stmts []ast.Statement) {
+	fold := g.pass("fold-guards")
+	for i, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.AltBlock:
+			var cases []ast.AltCase
+			var pruned []string
+			skip := false
+			for _, c := range s.Cases {
+				g.foldAltGuards(c.Body)
+				if c.Guard != nil && (fold || c.IsSkip) {
+					if v, ok := constBoolValue(c.Guard); ok && !v {
+						if !c.IsTimer && !c.IsSkip {
+							pruned = append(pruned, c.Channel)
+						}
+						continue
+					} else if ok {
+						c.Guard = nil
+					}
+				}
+				if c.IsSkip && c.Guard == nil {
+					if skip {
+						continue
+					}
+					skip = true
+				}
+				cases = append(cases, c)
+			}
+			s.Cases = cases
+			if len(cases) == 0 {
+				stmts[i] = &ast.Stop{Token: s.Token}
+			}
+			if len(pruned) > 0 {
+				g.prunedAltChans[stmts[i]] = pruned
+			}
+		case *ast.SeqBlock:
+			g.foldAltGuards(s.Statements)
+		case *ast.ParBlock:
+			g.foldAltGuards(s.Statements)
+		case *ast.ProcDecl:
+			g.foldAltGuards(s.Body)
+		case *ast.FuncDecl:
+			g.foldAltGuards(s.Body)
+		case *ast.WhileLoop:
+			g.foldAltGuards(s.Body)
+		case *ast.ClaimBlock:
+			g.foldAltGuards(s.Body)
+		case *ast.ForkingBlock:
+			g.foldAltGuards(s.Body)
+		case *ast.IfStatement:
+			for _, choice := range s.Choices {
+				if choice.NestedIf != nil {
+					g.foldAltGuards([]ast.Statement{choice.NestedIf})
+				}
+				g.foldAltGuards(choice.Body)
+			}
+		case *ast.CaseStatement:
+			for _, choice := range s.Choices {
+				g.foldAltGuards(choice.Body)
+			}
+		case *ast.VariantReceive:
+			for _, vc := range s.Cases {
+				g.foldAltGuards(vc.Body)
+			}
+		}
+	}
+}
+
+// generatePrunedAltChans refers to the channels of the alternatives
+// foldAltGuards removed from stmt, and from the ALTs nested in it, which may
+// have no other uses.
+func (g *Generator) generatePrunedAltChans(stmt ast.Statement) {
+	seen := map[string]bool{}
+	for _, name := range g.prunedAltChans[stmt] {
+		if !seen[name] {
+			seen[name] = true
+			g.writeLine("_ = " + goIdent(name))
+		}
+	}
+	if alt, ok := stmt.(*ast.AltBlock); ok {
+		for _, c := range alt.Cases {
+			if c.IsAlt {
+				g.generatePrunedAltChans(c.Body[0])
+			}
+		}
+	}
+}
+
 func (g *Generator) generateAltBlock(alt *ast.AltBlock) {
+	g.generatePrunedAltChans(alt)
+	var reps []*ast.Replicator
+	if alt.Replicator != nil {
+		reps = []*ast.Replicator{alt.Replicator}
+	}
+	arms := altArms(alt.Cases, reps)
+	replicated, nested := false, false
+	for _, a := range arms {
+		if a.c.Extended && !g.rendezvous {
+			g.warnings = append(g.warnings, fmt.Sprintf("line %d: extended input on %s releases its sender when the message arrives, not when the extended process ends", alt.Token.Line, a.c.Channel))
+		}
+		replicated = replicated || len(a.reps) > 0
+	}
+	for _, c := range alt.Cases {
+		nested = nested || c.IsAlt
+	}
+	if alt.ExtendedInput {
+		g.generateExtendedInput(alt)
+		return
+	}
+	if replicated {
+		g.generateReflectAlt(alt, arms)
+		return
+	}
 	if alt.Replicator != nil {
-		g.generateReplicatedAlt(alt)
+		// No alternatives left
 		return
 	}
+	if nested {
+		// Without replicators, the alternatives of nested ALTs join this
+		// ALT's select
+		flat := *alt
+		flat.Cases = make([]ast.AltCase, len(arms))
+		for i, a := range arms {
+			flat.Cases[i] = a.c
+		}
+		alt = &flat
+	}
 
 	// ALT becomes Go select statement
 	// For guards, we use a pattern with nil channels
@@ -1992,25 +6029,56 @@ func (g *Generator) generateAltBlock(alt *ast.AltBlock) {
 	}
 
 	if hasGuards {
+		// Open a block so that the _altN and _altSkipReady variables of
+		// consecutive ALTs do not clash
+		g.writeLine("{")
+		g.indent++
+		defer func() {
+			g.indent--
+			g.writeLine("}")
+		}()
+
 		// Generate channel variables for guarded cases
 		for i, c := range alt.Cases {
-			if c.Guard != nil && !c.IsSkip {
+			if c.Guard != nil && c.IsTimer {
+				// A false guard leaves the timeout channel nil, so the
+				// case is never ready and no timer is started for it
+				g.writeLine(fmt.Sprintf("var _alt%d <-chan time.Time", i))
+				g.builder.WriteString(strings.Repeat("\t", g.indent))
+				g.write("if ")
+				g.generateExpression(c.Guard)
+				g.write(fmt.Sprintf(" { _alt%d = ", i))
+				g.generateAltTimeout(c)
+				g.write(" }\n")
+			} else if c.Guard != nil && !c.IsSkip {
 				g.builder.WriteString(strings.Repeat("\t", g.indent))
 				// Look up the channel's element type
 				elemType := "int" // default fallback
 				if t, ok := g.chanElemTypes[c.Channel]; ok {
 					elemType = t
 				}
-				g.write(fmt.Sprintf("var _alt%d <-chan %s = nil\n", i, elemType))
+				if f := g.recordChanField(c.Channel, c.ChannelIndices); f != nil {
+					elemType = g.occamTypeToGo(f.Type)
+				}
+				dir := "<-chan"
+				if c.IsOutput {
+					dir = "chan<-"
+				}
+				g.write(fmt.Sprintf("var _alt%d %s %s = nil\n", i, dir, elemType))
 				g.builder.WriteString(strings.Repeat("\t", g.indent))
 				g.write(fmt.Sprintf("if "))
 				g.generateExpression(c.Guard)
-				g.write(fmt.Sprintf(" { _alt%d = %s }\n", i, goIdent(c.Channel)))
+				g.write(fmt.Sprintf(" { _alt%d = %s }\n", i, g.channelRef(c.Channel, c.ChannelIndices)))
 			}
 		}
 	}
 
-	if guardedSkipIdx >= 0 {
+	if g.deterministic || alt.Priority {
+		g.generatePriorityAlt(alt.Cases, 0)
+		return
+	}
+
+	if guardedSkipIdx >= 0 {
 		// Dual-select pattern: when guard is true, use default (non-blocking);
 		// when guard is false, omit default (blocking on channels).
 		g.builder.WriteString(strings.Repeat("\t", g.indent))
@@ -2025,7 +6093,7 @@ func (g *Generator) generateAltBlock(alt *ast.AltBlock) {
 		for i, c := range alt.Cases {
 			if c.IsSkip {
 				g.builder.WriteString(strings.Repeat("\t", g.indent))
-				g.write("default:\n")
+				g.write("default:" + altComment(c) + "\n")
 				g.indent++
 				for _, s := range c.Body {
 					g.generateStatement(s)
@@ -2056,7 +6124,7 @@ func (g *Generator) generateAltBlock(alt *ast.AltBlock) {
 		for i, c := range alt.Cases {
 			if c.IsSkip {
 				g.builder.WriteString(strings.Repeat("\t", g.indent))
-				g.write("default:\n")
+				g.write("default:" + altComment(c) + "\n")
 				g.indent++
 				for _, s := range c.Body {
 					g.generateStatement(s)
@@ -2070,162 +6138,517 @@ func (g *Generator) generateAltBlock(alt *ast.AltBlock) {
 	}
 }
 
+// generatePriorityAlt generates cases[i:] of an ALT so that the first
+// ready case in textual order is taken: each channel or timer case is polled
+// with a non-blocking select in turn, a SKIP case whose guard holds is taken
+// when reached, and if nothing is ready the ALT blocks on all channel cases.
+func (g *Generator) generatePriorityAlt(cases []ast.AltCase, i int) {
+	if i == len(cases) {
+		g.writeLine("select {")
+		for j, c := range cases {
+			if !c.IsSkip {
+				g.generateAltChannelCase(j, c)
+			}
+		}
+		g.writeLine("}")
+		return
+	}
+	c := cases[i]
+	if c.IsSkip {
+		if c.Guard == nil {
+			for _, s := range c.Body {
+				g.generateStatement(s)
+			}
+			return
+		}
+		g.builder.WriteString(strings.Repeat("\t", g.indent))
+		g.write("if ")
+		g.generateExpression(c.Guard)
+		g.write(" {" + altComment(c) + "\n")
+		g.indent++
+		for _, s := range c.Body {
+			g.generateStatement(s)
+		}
+		g.indent--
+		g.writeLine("} else {")
+		g.indent++
+		g.generatePriorityAlt(cases, i+1)
+		g.indent--
+		g.writeLine("}")
+		return
+	}
+	g.writeLine("select {")
+	g.generateAltChannelCase(i, c)
+	g.writeLine("default:")
+	g.indent++
+	g.generatePriorityAlt(cases, i+1)
+	g.indent--
+	g.writeLine("}")
+}
+
 // generateAltChannelCase generates a single channel or timer case for a select block.
+//
+// Evaluation order: guards and channel expressions are evaluated before the
+// select; once the case is chosen, its scoped declarations are created, then
+// the received value is assigned, then the body runs (so declarations at the
+// start of the body can use the received value). When the case has scoped
+// declarations the receive goes via _altValue, since the target variable
+// does not exist until they are generated, as does the message of a
+// sequential or variant protocol, which is then unpacked.
 func (g *Generator) generateAltChannelCase(i int, c ast.AltCase) {
+	if c.IsOutput {
+		g.generateAltOutputCase(i, c)
+		return
+	}
+	ch := g.channelRef(c.Channel, c.ChannelIndices)
+	if c.Guard != nil {
+		ch = fmt.Sprintf("_alt%d", i)
+	}
+	varRef, _ := g.lvalue(c.Variable, c.VariableIndices)
+	target, op := varRef, "="
+	if len(c.Declarations) > 0 || isProtocolInput(c) {
+		target, op = "_altValue", ":="
+	}
+
 	g.builder.WriteString(strings.Repeat("\t", g.indent))
-	if c.IsTimer {
-		g.write("case <-time.After(time.Duration(")
-		g.generateExpression(c.Deadline)
-		g.write(" - int(time.Now().UnixMicro())) * time.Microsecond):\n")
-	} else if c.Guard != nil {
-		varRef := goIdent(c.Variable)
-		if len(c.VariableIndices) > 0 {
-			varRef += g.generateIndicesStr(c.VariableIndices)
-		}
-		g.write(fmt.Sprintf("case %s = <-_alt%d:\n", varRef, i))
-	} else if len(c.ChannelIndices) > 0 {
-		varRef := goIdent(c.Variable)
-		if len(c.VariableIndices) > 0 {
-			varRef += g.generateIndicesStr(c.VariableIndices)
-		}
-		g.write(fmt.Sprintf("case %s = <-%s", varRef, goIdent(c.Channel)))
-		g.generateIndices(c.ChannelIndices)
-		g.write(":\n")
+	if c.IsTimer && c.Guard != nil {
+		g.write(fmt.Sprintf("case <-_alt%d:%s\n", i, altComment(c)))
+	} else if c.IsTimer {
+		g.write("case <-")
+		g.generateAltTimeout(c)
+		g.write(":" + altComment(c) + "\n")
 	} else {
-		varRef := goIdent(c.Variable)
-		if len(c.VariableIndices) > 0 {
-			varRef += g.generateIndicesStr(c.VariableIndices)
-		}
-		g.write(fmt.Sprintf("case %s = <-%s:\n", varRef, goIdent(c.Channel)))
+		g.write(fmt.Sprintf("case %s %s <-%s:%s\n", target, op, ch, altComment(c)))
 	}
 	g.indent++
+	release := ""
+	if c.Extended {
+		release = g.taken(ch)
+	} else if !c.IsTimer {
+		g.received(ch)
+	}
+	for _, decl := range c.Declarations {
+		g.generateStatement(decl)
+	}
+	if c.IsVariant {
+		g.generateVariantSwitch(c.Body[0].(*ast.VariantReceive), "_altValue")
+		g.indent--
+		return
+	}
+	if isProtocolInput(c) {
+		g.generateAltProtocolReceives("_altValue", c)
+	} else if target != varRef && !c.IsTimer {
+		g.writeLine(fmt.Sprintf("%s = _altValue", varRef))
+	}
 	for _, s := range c.Body {
 		g.generateStatement(s)
 	}
+	g.release(release)
 	g.indent--
 }
 
-func (g *Generator) generateReplicatedAlt(alt *ast.AltBlock) {
-	// Replicated ALT: ALT i = start FOR count
-	// Uses reflect.Select for runtime-variable case count
-	if len(alt.Cases) == 0 {
-		return
+// generateAltOutputCase generates output guard c of a select block: the
+// send of Body[0] as the case's communication, made only when the receiver
+// is ready, then the rest of the body.
+func (g *Generator) generateAltOutputCase(i int, c ast.AltCase) {
+	send := c.Body[0].(*ast.Send)
+	ch := g.channelRef(send.Channel, send.ChannelIndices)
+	if c.Guard != nil {
+		ch = fmt.Sprintf("_alt%d", i)
+	}
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write("case " + ch + " <- ")
+	g.generateSendValue(send)
+	g.write(":" + altComment(c) + "\n")
+	g.indent++
+	g.sent(ch)
+	if len(send.Values) == 0 && send.VariantTag == "" {
+		g.moveMobile(send.Value)
+	}
+	for _, decl := range c.Declarations {
+		g.generateStatement(decl)
+	}
+	for _, s := range c.Body[1:] {
+		g.generateStatement(s)
 	}
+	g.indent--
+}
+
+// generateExtendedInput generates alt, the extended input c ?? x outside
+// an ALT: the input, then the extended process, then under
+// WithExtendedRendezvous the release of the sender.
+func (g *Generator) generateExtendedInput(alt *ast.AltBlock) {
 	c := alt.Cases[0]
-	rep := alt.Replicator
-	v := goIdent(rep.Variable)
+	recv := &ast.Receive{
+		Token:           alt.Token,
+		Channel:         c.Channel,
+		ChannelIndices:  c.ChannelIndices,
+		Variable:        c.Variable,
+		VariableIndices: c.VariableIndices,
+		Variables:       c.Variables,
+		Arrays:          c.Arrays,
+	}
+	g.generateReceiveMessage(recv)
+	release := g.taken(g.channelRef(c.Channel, c.ChannelIndices))
+	scoped := false
+	for _, s := range c.Body {
+		scoped = scoped || isDeclaration(s)
+	}
+	if scoped {
+		g.writeLine("{")
+		g.indent++
+	}
+	for _, s := range c.Body {
+		g.generateStatement(s)
+	}
+	if scoped {
+		g.indent--
+		g.writeLine("}")
+	}
+	g.release(release)
+}
+
+// isProtocolInput reports whether ALT case c inputs a message to unpack:
+// several items of a sequential protocol, a counted array or a variant.
+func isProtocolInput(c ast.AltCase) bool {
+	return c.IsVariant || len(c.Variables) > 0 || c.Arrays != nil
+}
+
+// generateAltProtocolReceives assigns the items of the sequential protocol
+// message msg, received by ALT case c, to the case's variables, as
+// generateReceive does.
+func (g *Generator) generateAltProtocolReceives(msg string, c ast.AltCase) {
+	varRef, _ := g.lvalue(c.Variable, c.VariableIndices)
+	vars := []string{varRef}
+	for _, v := range c.Variables {
+		vars = append(vars, g.varRef(v))
+	}
+	var types []string
+	if proto := g.protocolDefs[g.channelProtocol(c.Channel, c.ChannelIndices)]; proto != nil {
+		types = proto.Types
+	}
+	g.generateProtocolReceives(msg, types, vars, c.Arrays)
+}
+
+// altComment returns a trailing comment giving the occam source of ALT case
+// c, such as "// (n < max) & in[i] ? x", or "" if it is not known.
+func altComment(c ast.AltCase) string {
+	if c.Text == "" {
+		return ""
+	}
+	return " // " + c.Text
+}
+
+// generateAltTimeout generates the channel that fires at the deadline of
+// timer case c: the reused timer of an enclosing loop, or time.After.
+func (g *Generator) generateAltTimeout(c ast.AltCase) {
+	if timer, ok := g.altTimers[c.Deadline]; ok {
+		g.write(fmt.Sprintf("%s_altAfter(&%s, ", g.prefix, timer))
+		g.generateExpression(c.Deadline)
+		g.write(")")
+		return
+	}
+	g.write("time.After(time.Duration(")
+	g.generateExpression(c.Deadline)
+	g.write(" - " + g.intType() + "(time.Now().UnixMicro())) * time.Microsecond)")
+}
+
+// altArm is an alternative of an ALT, with the replicators of the ALTs it
+// is in, outermost first.
+type altArm struct {
+	c    ast.AltCase
+	reps []*ast.Replicator
+}
+
+// altArms flattens the nested ALTs among cases, which are inside the
+// replicators reps, into the alternatives they offer, in textual order.
+func altArms(cases []ast.AltCase, reps []*ast.Replicator) []altArm {
+	var arms []altArm
+	for _, c := range cases {
+		if !c.IsAlt {
+			arms = append(arms, altArm{c: c, reps: reps})
+			continue
+		}
+		nested := c.Body[0].(*ast.AltBlock)
+		inner := reps
+		if nested.Replicator != nil {
+			inner = append(reps[:len(reps):len(reps)], nested.Replicator)
+		}
+		arms = append(arms, altArms(nested.Cases, inner)...)
+	}
+	return arms
+}
 
-	// Determine receive type from scoped declarations
+// altRecvType returns the Go type of the message ALT case c inputs or
+// outputs: that of its channel, or of its variable's scoped declaration.
+func (g *Generator) altRecvType(c ast.AltCase) string {
 	recvType := "int" // default
+	if t, ok := g.chanElemTypes[c.Channel]; ok {
+		recvType = t
+	}
+	if f := g.recordChanField(c.Channel, c.ChannelIndices); f != nil {
+		recvType = g.occamTypeToGo(f.Type)
+	}
 	for _, decl := range c.Declarations {
-		if vd, ok := decl.(*ast.VarDecl); ok {
-			for _, name := range vd.Names {
+		switch d := decl.(type) {
+		case *ast.VarDecl:
+			for _, name := range d.Names {
 				if name == c.Variable {
-					recvType = g.occamTypeToGo(vd.Type)
-					break
+					recvType = g.occamTypeToGo(d.Type)
+				}
+			}
+		case *ast.ArrayDecl:
+			for _, name := range d.Names {
+				if name == c.Variable && len(c.VariableIndices) == len(d.Sizes) {
+					recvType = g.occamTypeToGo(d.Type)
 				}
 			}
 		}
 	}
+	return recvType
+}
 
+// generateReflectAlt generates an ALT with replicated alternatives, arms,
+// from its own replicator or those of ALTs nested in it, using
+// reflect.Select for the run-time number of cases. The cases are built
+// first, each recorded in _altArms with the index of its arm and in _altReps
+// with the values of the replicators it is in; the chosen case's arm is then
+// run by a switch, with those replicator values.
+func (g *Generator) generateReflectAlt(alt *ast.AltBlock, arms []altArm) {
 	// Open a block for scoping
 	g.writeLine("{")
 	g.indent++
+	g.writeLine("var _altCases []reflect.SelectCase")
+	g.writeLine("var _altArms []int")
+	g.writeLine("var _altReps [][]" + g.intType())
+	readsValue, hasSkip := false, false
+	for _, a := range arms {
+		readsValue = readsValue || !a.c.IsOutput && !a.c.IsTimer && !a.c.IsSkip
+		hasSkip = hasSkip || a.c.IsSkip
+	}
+	if hasSkip {
+		// reflect.Select takes one default case: the first SKIP whose guard
+		// holds
+		g.writeLine("_altSkip := false")
+	}
 
-	// _altCount := int(<count>)
-	g.builder.WriteString(strings.Repeat("\t", g.indent))
-	g.write("_altCount := int(")
-	g.generateExpression(rep.Count)
-	g.write(")\n")
+	// Build the select cases; arms in the same replicated ALT share its
+	// loop, so that their cases are in occam's order for PRI ALT
+	var open []*ast.Replicator
+	for k, a := range arms {
+		shared := 0
+		for shared < len(open) && shared < len(a.reps) && open[shared] == a.reps[shared] {
+			shared++
+		}
+		for len(open) > shared {
+			g.indent--
+			g.writeLine("}")
+			open = open[:len(open)-1]
+		}
+		for len(open) < len(a.reps) {
+			g.openAltReplicator(a.reps[len(open)], len(open))
+			open = append(open, a.reps[len(open)])
+		}
+		g.generateReflectAltCase(k, a)
+	}
+	for range open {
+		g.indent--
+		g.writeLine("}")
+	}
 
-	// _altCases := make([]reflect.SelectCase, _altCount)
-	g.writeLine("_altCases := make([]reflect.SelectCase, _altCount)")
+	// Call reflect.Select
+	value := "_altValue"
+	if !readsValue {
+		value = "_"
+	}
+	if g.deterministic || alt.Priority {
+		g.writeLine("_altChosen, " + value + " := " + g.prefix + "_priSelect(_altCases)")
+	} else {
+		g.writeLine("_altChosen, " + value + ", _ := reflect.Select(_altCases)")
+	}
+
+	// Run the chosen arm
+	g.writeLine("switch _altArms[_altChosen] {")
+	for k, a := range arms {
+		g.writeLine(fmt.Sprintf("case %d:%s", k, altComment(a.c)))
+		g.indent++
+		for d, rep := range a.reps {
+			v := goIdent(rep.Variable)
+			g.writeLine(fmt.Sprintf("%s := _altReps[_altChosen][%d]", v, d))
+			g.writeLine("_ = " + v)
+		}
+		g.generateReflectAltBody(a.c)
+		g.indent--
+	}
+	g.writeLine("}")
+
+	g.indent--
+	g.writeLine("}")
+}
 
-	// Setup loop: build select cases
-	g.writeLine("for _altI := 0; _altI < _altCount; _altI++ {")
+// openAltReplicator opens the loop over replicator rep, at depth among the
+// replicators of an ALT's arms, that builds their select cases, setting the
+// replicator variable.
+func (g *Generator) openAltReplicator(rep *ast.Replicator, depth int) {
+	i, count := "_altI", "_altCount"
+	if depth > 0 {
+		i, count = fmt.Sprintf("_altI%d", depth), fmt.Sprintf("_altCount%d", depth)
+	}
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write(fmt.Sprintf("for %s, %s := 0, int(", i, count))
+	g.generateExpression(rep.Count)
+	g.write(fmt.Sprintf("); %s < %s; %s++ {\n", i, count, i))
 	g.indent++
 
 	// Compute replicator variable
+	v := goIdent(rep.Variable)
 	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write(fmt.Sprintf("%s := ", v))
+	g.generateExpression(rep.Start)
 	if rep.Step != nil {
-		g.write(fmt.Sprintf("%s := ", v))
-		g.generateExpression(rep.Start)
-		g.write(" + _altI * (")
+		g.write(" + " + g.asInt(i) + " * (")
 		g.generateExpression(rep.Step)
 		g.write(")\n")
 	} else {
-		g.write(fmt.Sprintf("%s := ", v))
-		g.generateExpression(rep.Start)
-		g.write(" + _altI\n")
+		g.write(" + " + g.asInt(i) + "\n")
 	}
+	g.writeLine("_ = " + v)
+}
 
-	// Generate scoped abbreviations (needed for channel index computation)
+// generateReflectAltCase appends the select case of arm k, a, to _altCases,
+// and its arm and replicator values to _altArms and _altReps. A false
+// guard leaves the case's Chan as the zero Value, which reflect.Select
+// ignores, and its channel indices unevaluated. An output guard's message is
+// converted to the channel's type, as Go would an untyped constant sent on
+// it.
+func (g *Generator) generateReflectAltCase(k int, a altArm) {
+	c := a.c
+
+	// Scoped abbreviations, needed for channel index computation, in a
+	// block of their own so that those of other arms do not clash
+	var abbrs []*ast.Abbreviation
 	for _, decl := range c.Declarations {
 		if abbr, ok := decl.(*ast.Abbreviation); ok {
+			abbrs = append(abbrs, abbr)
+		}
+	}
+	if len(abbrs) > 0 {
+		g.writeLine("{")
+		g.indent++
+		for _, abbr := range abbrs {
 			g.generateAbbreviation(abbr)
 		}
 	}
 
-	// Build select case entry
-	g.builder.WriteString(strings.Repeat("\t", g.indent))
-	g.write("_altCases[_altI] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(")
-	if len(c.ChannelIndices) > 0 {
-		g.write(goIdent(c.Channel))
-		g.generateIndices(c.ChannelIndices)
-	} else {
-		g.write(goIdent(c.Channel))
+	last := "_altCases[len(_altCases)-1]"
+	switch {
+	case c.IsSkip:
+		g.writeLine("_altCases = append(_altCases, reflect.SelectCase{Dir: reflect.SelectRecv})" + altComment(c))
+		g.builder.WriteString(strings.Repeat("\t", g.indent))
+		g.write("if ")
+		if c.Guard != nil {
+			g.generateExpression(c.Guard)
+			g.write(" && ")
+		}
+		g.write("!_altSkip {\n")
+		g.indent++
+		g.writeLine(last + ".Dir, _altSkip = reflect.SelectDefault, true")
+		g.indent--
+		g.writeLine("}")
+	default:
+		dir, ch, send := "reflect.SelectRecv", g.channelRef(c.Channel, c.ChannelIndices), ""
+		if c.IsTimer {
+			oldBuilder := g.builder
+			g.builder = strings.Builder{}
+			g.generateAltTimeout(c)
+			ch = g.builder.String()
+			g.builder = oldBuilder
+		}
+		if c.IsOutput {
+			dir = "reflect.SelectSend"
+			oldBuilder := g.builder
+			g.builder = strings.Builder{}
+			g.generateSendValue(c.Body[0].(*ast.Send))
+			send = fmt.Sprintf("reflect.ValueOf(%s(%s))", g.altRecvType(c), g.builder.String())
+			g.builder = oldBuilder
+		}
+		if c.Guard != nil {
+			g.writeLine("_altCases = append(_altCases, reflect.SelectCase{Dir: " + dir + "})")
+			g.builder.WriteString(strings.Repeat("\t", g.indent))
+			g.write("if ")
+			g.generateExpression(c.Guard)
+			g.write(" {\n")
+			g.indent++
+			g.writeLine(last + ".Chan = reflect.ValueOf(" + ch + ")" + altComment(c))
+			if send != "" {
+				g.writeLine(last + ".Send = " + send)
+			}
+			g.indent--
+			g.writeLine("}")
+		} else if send != "" {
+			g.writeLine("_altCases = append(_altCases, reflect.SelectCase{Dir: " + dir + ", Chan: reflect.ValueOf(" + ch + "), Send: " + send + "})" + altComment(c))
+		} else {
+			g.writeLine("_altCases = append(_altCases, reflect.SelectCase{Dir: " + dir + ", Chan: reflect.ValueOf(" + ch + ")})" + altComment(c))
+		}
 	}
-	g.write(")}\n")
-
-	g.indent--
-	g.writeLine("}")
-
-	// Call reflect.Select
-	g.writeLine("_altChosen, _altValue, _ := reflect.Select(_altCases)")
-
-	// Recompute replicator variable from chosen index
-	g.builder.WriteString(strings.Repeat("\t", g.indent))
-	if rep.Step != nil {
-		g.write(fmt.Sprintf("%s := ", v))
-		g.generateExpression(rep.Start)
-		g.write(" + _altChosen * (")
-		g.generateExpression(rep.Step)
-		g.write(")\n")
+	g.writeLine(fmt.Sprintf("_altArms = append(_altArms, %d)", k))
+	if len(a.reps) == 0 {
+		g.writeLine("_altReps = append(_altReps, nil)")
 	} else {
-		g.write(fmt.Sprintf("%s := ", v))
-		g.generateExpression(rep.Start)
-		g.write(" + _altChosen\n")
+		vars := make([]string, len(a.reps))
+		for d, rep := range a.reps {
+			vars[d] = goIdent(rep.Variable)
+		}
+		g.writeLine(fmt.Sprintf("_altReps = append(_altReps, []%s{%s})", g.intType(), strings.Join(vars, ", ")))
 	}
-	g.writeLine(fmt.Sprintf("_ = %s", v))
 
-	// Generate scoped var declarations
-	for _, decl := range c.Declarations {
-		if vd, ok := decl.(*ast.VarDecl); ok {
-			g.generateVarDecl(vd)
-		}
+	if len(abbrs) > 0 {
+		g.indent--
+		g.writeLine("}")
 	}
+}
 
-	// Generate scoped abbreviations
+// generateReflectAltBody generates the process of ALT case c once
+// reflect.Select has chosen it: its scoped declarations, then the received
+// value, then the body (same order as generateAltChannelCase).
+func (g *Generator) generateReflectAltBody(c ast.AltCase) {
+	ack, release := "_altCases[_altChosen].Chan.Interface()", ""
+	if c.IsOutput {
+		g.sent(ack)
+	} else if c.Extended {
+		release = g.taken(ack)
+	} else if !c.IsTimer && !c.IsSkip {
+		g.received(ack)
+	}
 	for _, decl := range c.Declarations {
-		if abbr, ok := decl.(*ast.Abbreviation); ok {
-			g.generateAbbreviation(abbr)
-		}
+		g.generateStatement(decl)
 	}
 
-	// Assign received value from reflect.Value
-	varRef := goIdent(c.Variable)
-	if len(c.VariableIndices) > 0 {
-		varRef += g.generateIndicesStr(c.VariableIndices)
+	// Assign received value from reflect.Value, or unpack the message
+	recvType := g.altRecvType(c)
+	switch {
+	case c.IsOutput:
+		for _, s := range c.Body[1:] {
+			g.generateStatement(s)
+		}
+		return
+	case c.IsVariant:
+		g.generateVariantSwitch(c.Body[0].(*ast.VariantReceive), "_altValue.Interface()")
+		return
+	case c.IsTimer, c.IsSkip:
+	case isProtocolInput(c):
+		g.writeLine(fmt.Sprintf("_altMsg := _altValue.Interface().(%s)", recvType))
+		g.generateAltProtocolReceives("_altMsg", c)
+	default:
+		varRef, _ := g.lvalue(c.Variable, c.VariableIndices)
+		g.writeLine(fmt.Sprintf("%s = _altValue.Interface().(%s)", varRef, recvType))
 	}
-	g.writeLine(fmt.Sprintf("%s = _altValue.Interface().(%s)", varRef, recvType))
 
 	// Generate body
 	for _, s := range c.Body {
 		g.generateStatement(s)
 	}
-
-	g.indent--
-	g.writeLine("}")
+	g.release(release)
 }
 
 func (g *Generator) generateProcDecl(proc *ast.ProcDecl) {
@@ -2244,25 +6667,49 @@ func (g *Generator) generateProcDecl(proc *ast.ProcDecl) {
 			newBoolVars[k] = v
 		}
 	}
+	// Scope channel element types too, so that a nested PROC's channel
+	// params do not change those of the enclosing PROC's same-named channels
+	oldChanElemTypes, oldBoolChans, oldMobileVars := g.chanElemTypes, g.boolChans, g.mobileVars
+	g.chanElemTypes = make(map[string]string, len(oldChanElemTypes))
+	for k, v := range oldChanElemTypes {
+		g.chanElemTypes[k] = v
+	}
+	g.mobileVars = make(map[string]string, len(oldMobileVars))
+	for k, v := range oldMobileVars {
+		g.mobileVars[k] = v
+	}
+	g.boolChans = make(map[string]bool, len(oldBoolChans))
+	for k, v := range oldBoolChans {
+		g.boolChans[k] = v
+	}
 	for _, p := range proc.Params {
-		if !p.IsVal && !p.IsChan && p.ChanArrayDims == 0 && p.OpenArrayDims == 0 && p.ArraySize == "" {
+		if !p.IsVal && p.TypeRef.IsData() {
 			newRefParams[p.Name] = true
 		} else {
 			// Own param shadows any inherited ref param with same name
 			delete(newRefParams, p.Name)
 		}
 		// Track BOOL params; delete non-BOOL params that shadow inherited names
-		if p.Type == "BOOL" && !p.IsChan && p.ChanArrayDims == 0 {
+		if isScalarBoolParam(p) {
 			newBoolVars[p.Name] = true
 		} else {
 			delete(newBoolVars, p.Name)
 		}
+		if p.Type == "BOOL" && !p.IsChan && !isScalarBoolParam(p) {
+			g.rejectBoolArray(proc.Token.Line)
+		}
+		if p.Mobile && !p.IsVal && !p.IsChan {
+			g.mobileVars[p.Name] = g.mobileZero(p.Type, p.TypeRef.IsDataArray())
+		} else {
+			delete(g.mobileVars, p.Name)
+		}
 		// Register chan params with protocol mappings and element types
-		if p.IsChan || p.ChanArrayDims > 0 {
-			if _, ok := g.protocolDefs[p.ChanElemType]; ok {
-				g.chanProtocols[p.Name] = p.ChanElemType
+		if elem := chanElemType(p.TypeRef); elem != "" {
+			if _, ok := g.protocolDefs[elem]; ok {
+				g.chanProtocols[p.Name] = elem
 			}
-			g.chanElemTypes[p.Name] = g.occamTypeToGo(p.ChanElemType)
+			g.chanElemTypes[p.Name] = g.occamTypeToGo(elem)
+			g.boolChans[p.Name] = g.carriesBool(elem)
 		}
 		// Register record-typed params
 		if !p.IsChan {
@@ -2285,7 +6732,7 @@ func (g *Generator) generateProcDecl(proc *ast.ProcDecl) {
 	}
 	for _, stmt := range proc.Body {
 		if rd, ok := stmt.(*ast.RetypesDecl); ok {
-			if paramNames[rd.Source] && rd.Name == rd.Source {
+			if src, ok := rd.Source.(*ast.Identifier); ok && paramNames[src.Value] && rd.Name == src.Value {
 				if g.retypesRenames == nil {
 					g.retypesRenames = make(map[string]string)
 				}
@@ -2299,20 +6746,30 @@ func (g *Generator) generateProcDecl(proc *ast.ProcDecl) {
 	gName := goIdent(proc.Name)
 	if g.nestingLevel > 0 {
 		// Nested PROC: generate as Go closure
-		g.writeLine(fmt.Sprintf("%s := func(%s) {", gName, params))
+		g.writeLine(fmt.Sprintf("%s %s func(%s) {", gName, g.closureDefine(proc), params))
 	} else {
-		g.writeLine(fmt.Sprintf("func %s(%s) {", gName, params))
+		g.writeLine(fmt.Sprintf("func %s(%s) {", g.procIdent(proc.Name), params))
 	}
 	g.indent++
 	g.nestingLevel++
 
+	// Temp names are numbered per function so that edits to one PROC do not
+	// renumber the temporaries of every PROC generated after it.
+	oldTmpCounter := g.tmpCounter
+	g.tmpCounter = 0
+
 	// Register nested proc/func signatures for this scope so that calls
 	// within this proc resolve to the correct (local) signature rather than
 	// a same-named proc from a different scope.
 	oldSigs := make(map[string][]ast.ProcParam)
 	g.collectNestedProcSigsScoped(proc.Body, oldSigs)
 
+	oldPoisonProc, oldStopFunc, oldForking := g.poisonProc, g.stopFunc, g.forking
+	g.poisonProc, g.stopFunc, g.forking = proc, "", ""
+	g.beginFunc("PROC "+proc.Name, proc.Token.Line)
 	g.generateStatementsWithScoping(proc.Body)
+	g.endFunc()
+	g.poisonProc, g.stopFunc, g.forking = oldPoisonProc, oldStopFunc, oldForking
 
 	// Restore overwritten signatures
 	for name, params := range oldSigs {
@@ -2323,6 +6780,7 @@ func (g *Generator) generateProcDecl(proc *ast.ProcDecl) {
 		}
 	}
 
+	g.tmpCounter = oldTmpCounter
 	g.nestingLevel--
 	g.indent--
 	g.writeLine("}")
@@ -2331,30 +6789,14 @@ func (g *Generator) generateProcDecl(proc *ast.ProcDecl) {
 	// Restore previous context
 	g.refParams = oldRefParams
 	g.boolVars = oldBoolVars
+	g.chanElemTypes, g.boolChans, g.mobileVars = oldChanElemTypes, oldBoolChans, oldMobileVars
 	g.retypesRenames = oldRenames
 }
 
 func (g *Generator) generateProcParams(params []ast.ProcParam) string {
 	var parts []string
-	for _, p := range params {
-		var goType string
-		if p.ChanArrayDims > 0 {
-			goType = strings.Repeat("[]", p.ChanArrayDims) + "chan " + g.occamTypeToGo(p.ChanElemType)
-		} else if p.IsChan {
-			goType = chanDirPrefix(p.ChanDir) + g.occamTypeToGo(p.ChanElemType)
-		} else if p.OpenArrayDims > 0 {
-			goType = strings.Repeat("[]", p.OpenArrayDims) + g.occamTypeToGo(p.Type)
-		} else if p.ArraySize != "" {
-			// Fixed-size array parameter: use slice for Go compatibility
-			// (occam [n]TYPE and []TYPE both map to Go slices)
-			goType = "[]" + g.occamTypeToGo(p.Type)
-		} else {
-			goType = g.occamTypeToGo(p.Type)
-			if !p.IsVal {
-				// Non-VAL parameters are pass by reference in Occam
-				goType = "*" + goType
-			}
-		}
+	for i, p := range params {
+		goType := g.paramGoType(params, i)
 		pName := goIdent(p.Name)
 		if renamed, ok := g.retypesRenames[p.Name]; ok {
 			pName = renamed
@@ -2364,6 +6806,34 @@ func (g *Generator) generateProcParams(params []ast.ProcParam) string {
 	return strings.Join(parts, ", ")
 }
 
+// paramGoType returns the Go type of params[i].
+func (g *Generator) paramGoType(params []ast.ProcParam, i int) string {
+	p := params[i]
+	dir := p.ChanDir
+	if g.bidiChans[&params[i]] {
+		dir = ""
+	}
+	goType := g.goType(p.TypeRef, dir)
+	if p.TypeRef.IsData() && !p.IsVal {
+		// Non-VAL parameters are pass by reference in Occam
+		goType = "*" + goType
+	}
+	return goType
+}
+
+// goType returns the Go type of t, with direction dir ("?", "!" or "") if t
+// is a channel. Arrays of any size are slices, and channels in arrays have
+// no direction, since []chan T is not assignable to []<-chan T.
+func (g *Generator) goType(t *ast.TypeRef, dir string) string {
+	switch t.Kind {
+	case ast.ArrayType:
+		return "[]" + g.goType(t.Elem, "")
+	case ast.ChanType:
+		return chanDirPrefix(dir) + g.goType(t.Elem, "")
+	}
+	return g.occamTypeToGo(t.Name)
+}
+
 func chanDirPrefix(dir string) string {
 	switch dir {
 	case "?":
@@ -2376,6 +6846,10 @@ func chanDirPrefix(dir string) string {
 }
 
 func (g *Generator) generateProcCall(call *ast.ProcCall) {
+	if call.NoParens && g.strict {
+		g.warnings = append(g.warnings, fmt.Sprintf("line %d: call of PROC %s without parentheses", call.Token.Line, call.Name))
+	}
+
 	// Handle built-in print procedures
 	if printBuiltins[call.Name] {
 		g.generatePrintCall(call)
@@ -2388,46 +6862,65 @@ func (g *Generator) generateProcCall(call *ast.ProcCall) {
 		return
 	}
 
+	// Look up procedure signature to determine which args need address-of
+	name, params := g.procLookup(call.Name)
+
 	g.builder.WriteString(strings.Repeat("\t", g.indent))
-	g.write(goIdent(call.Name))
+	g.write(name)
 	g.write("(")
+	g.generateProcArgs(params, call.Args)
+	g.write(")")
+	g.write("\n")
+}
 
-	// Look up procedure signature to determine which args need address-of
-	params := g.procSigs[call.Name]
-
-	for i, arg := range call.Args {
+// generateProcArgs writes the arguments of a call to a PROC with params,
+// taking the address of those passed by reference.
+func (g *Generator) generateProcArgs(params []ast.ProcParam, args []ast.Expression) {
+	for i, arg := range args {
 		if i > 0 {
 			g.write(", ")
 		}
 		// If this parameter is not VAL (i.e., pass by reference), take address
 		// Channels, channel arrays, open arrays, and fixed-size arrays (mapped to slices) are already reference types
-		if i < len(params) && !params[i].IsVal && !params[i].IsChan && params[i].ChanArrayDims == 0 && params[i].OpenArrayDims == 0 && params[i].ArraySize == "" {
+		if i < len(params) && !params[i].IsVal && params[i].TypeRef.IsData() {
 			g.write("&")
 		}
 		// Wrap string literals with []byte() when passed to []BYTE parameters
-		if _, isStr := arg.(*ast.StringLiteral); isStr && i < len(params) && params[i].OpenArrayDims > 0 && params[i].Type == "BYTE" {
+		if _, isStr := arg.(*ast.StringLiteral); isStr && i < len(params) && params[i].TypeRef.IsDataArray() && params[i].Type == "BYTE" {
 			g.write("[]byte(")
 			g.generateExpression(arg)
 			g.write(")")
+		} else if i < len(params) && isScalarBoolParam(params[i]) {
+			g.generateBoolValue(arg)
 		} else {
 			g.generateExpression(arg)
 		}
 	}
-	g.write(")")
-	g.write("\n")
+}
+
+// procLookup returns the Go name and the parameters of the PROC called name.
+func (g *Generator) procLookup(name string) (string, []ast.ProcParam) {
+	if g.conversions[name] {
+		return g.prefix + "_" + name, conversionBuiltins[name]
+	}
+	if g.cycles[name] {
+		return g.prefix + "_" + name, cycleProcs[name]
+	}
+	return g.procIdent(name), g.procSigs[name]
 }
 
 func (g *Generator) generateFuncDecl(fn *ast.FuncDecl) {
 	params := g.generateProcParams(fn.Params)
+	g.funcResults[fn.Name] = fn.Results
 
 	// Build return type string
 	var returnTypeStr string
-	if len(fn.ReturnTypes) == 1 {
-		returnTypeStr = g.occamTypeToGo(fn.ReturnTypes[0])
+	if len(fn.Results) == 1 {
+		returnTypeStr = g.goType(fn.Results[0], "")
 	} else {
-		goTypes := make([]string, len(fn.ReturnTypes))
-		for i, rt := range fn.ReturnTypes {
-			goTypes[i] = g.occamTypeToGo(rt)
+		goTypes := make([]string, len(fn.Results))
+		for i, rt := range fn.Results {
+			goTypes[i] = g.goType(rt, "")
 		}
 		returnTypeStr = "(" + strings.Join(goTypes, ", ") + ")"
 	}
@@ -2441,38 +6934,59 @@ func (g *Generator) generateFuncDecl(fn *ast.FuncDecl) {
 		}
 	}
 	for _, p := range fn.Params {
-		if p.Type == "BOOL" && !p.IsChan && p.ChanArrayDims == 0 {
+		if isScalarBoolParam(p) {
 			newBoolVars[p.Name] = true
 		} else {
 			delete(newBoolVars, p.Name)
 		}
+		if p.Type == "BOOL" && !p.IsChan && !isScalarBoolParam(p) {
+			g.rejectBoolArray(fn.Token.Line)
+		}
+		// Register record-typed params
+		if _, ok := g.recordDefs[p.Type]; ok && !p.IsChan {
+			g.recordVars[p.Name] = p.Type
+		}
 	}
 	g.boolVars = newBoolVars
 
 	gName := goIdent(fn.Name)
 	if g.nestingLevel > 0 {
 		// Nested FUNCTION: generate as Go closure
-		g.writeLine(fmt.Sprintf("%s := func(%s) %s {", gName, params, returnTypeStr))
+		g.writeLine(fmt.Sprintf("%s %s func(%s) %s {", gName, g.closureDefine(fn), params, returnTypeStr))
 	} else {
-		g.writeLine(fmt.Sprintf("func %s(%s) %s {", gName, params, returnTypeStr))
+		g.writeLine(fmt.Sprintf("func %s(%s) %s {", g.procIdent(fn.Name), params, returnTypeStr))
 	}
 	g.indent++
 	g.nestingLevel++
+	oldTmpCounter := g.tmpCounter
+	g.tmpCounter = 0
+	g.beginFunc("FUNCTION "+fn.Name, fn.Token.Line)
+	oldStopFunc, oldForking := g.stopFunc, g.forking
+	g.stopFunc, g.forking = fn.Name, ""
 
 	g.generateStatementsWithScoping(fn.Body)
 
-	if len(fn.ResultExprs) > 0 {
+	// A body that always ends in STOP or CAUSEERROR has panicked by the
+	// RESULT, which Go would report as unreachable
+	if len(fn.ResultExprs) > 0 && !endsInError(fn.Body) {
 		g.builder.WriteString(strings.Repeat("\t", g.indent))
 		g.write("return ")
 		for i, expr := range fn.ResultExprs {
 			if i > 0 {
 				g.write(", ")
 			}
-			g.generateExpression(expr)
+			if i < len(fn.Results) && fn.Results[i].FlatName() == "BOOL" {
+				g.generateBoolValue(expr)
+			} else {
+				g.generateExpression(expr)
+			}
 		}
 		g.write("\n")
 	}
 
+	g.endFunc()
+	g.stopFunc, g.forking = oldStopFunc, oldForking
+	g.tmpCounter = oldTmpCounter
 	g.nestingLevel--
 	g.indent--
 	g.writeLine("}")
@@ -2482,11 +6996,27 @@ func (g *Generator) generateFuncDecl(fn *ast.FuncDecl) {
 	g.boolVars = oldBoolVars
 }
 
+// endsInError reports whether stmts always end in STOP or CAUSEERROR.
+func endsInError(stmts []ast.Statement) bool {
+	if len(stmts) == 0 {
+		return false
+	}
+	switch s := stmts[len(stmts)-1].(type) {
+	case *ast.Stop, *ast.Unsupported:
+		return true
+	case *ast.ProcCall:
+		return s.Name == "CAUSEERROR"
+	case *ast.SeqBlock:
+		return s.Replicator == nil && endsInError(s.Statements)
+	}
+	return false
+}
+
 func (g *Generator) generateFuncCallExpr(call *ast.FuncCall) {
 	if transpIntrinsics[call.Name] {
-		g.write("_" + call.Name)
+		g.write(g.prefix + "_" + call.Name)
 	} else {
-		g.write(goIdent(call.Name))
+		g.write(g.procIdent(call.Name))
 	}
 	g.write("(")
 	params := g.procSigs[call.Name]
@@ -2495,10 +7025,12 @@ func (g *Generator) generateFuncCallExpr(call *ast.FuncCall) {
 			g.write(", ")
 		}
 		// Wrap string literals with []byte() when passed to []BYTE parameters
-		if _, isStr := arg.(*ast.StringLiteral); isStr && i < len(params) && params[i].OpenArrayDims > 0 && params[i].Type == "BYTE" {
+		if _, isStr := arg.(*ast.StringLiteral); isStr && i < len(params) && params[i].TypeRef.IsDataArray() && params[i].Type == "BYTE" {
 			g.write("[]byte(")
 			g.generateExpression(arg)
 			g.write(")")
+		} else if i < len(params) && isScalarBoolParam(params[i]) {
+			g.generateBoolValue(arg)
 		} else {
 			g.generateExpression(arg)
 		}
@@ -2507,44 +7039,38 @@ func (g *Generator) generateFuncCallExpr(call *ast.FuncCall) {
 }
 
 func (g *Generator) generateMultiAssignment(stmt *ast.MultiAssignment) {
+	values := stmt.Values
+	if m, ok := values[0].(*ast.MobileExpr); ok && len(values) == 1 && len(stmt.Targets) > 1 {
+		// svr, cli := MOBILE FOO: both ends share one bundle
+		tmp := fmt.Sprintf("_tmp%d", g.tmpCounter)
+		g.tmpCounter++
+		g.builder.WriteString(strings.Repeat("\t", g.indent))
+		g.write(tmp + " := ")
+		g.generateMobile(m.Type)
+		g.write("\n")
+		values = nil
+		for range stmt.Targets {
+			values = append(values, &ast.Identifier{Token: m.Token, Value: tmp})
+		}
+	}
 	g.builder.WriteString(strings.Repeat("\t", g.indent))
 	for i, target := range stmt.Targets {
 		if i > 0 {
 			g.write(", ")
 		}
-		if len(target.Indices) > 0 {
-			// Check if this is a record field access (single index that is an identifier)
-			if len(target.Indices) == 1 {
-				if _, ok := g.recordVars[target.Name]; ok {
-					if ident, ok := target.Indices[0].(*ast.Identifier); ok {
-						g.write(goIdent(target.Name))
-						g.write(".")
-						g.write(goIdent(ident.Value))
-						continue
-					}
-				}
-			}
-			if g.refParams[target.Name] {
-				g.write("(*")
-				g.write(goIdent(target.Name))
-				g.write(")")
-			} else {
-				g.write(goIdent(target.Name))
-			}
-			g.generateIndices(target.Indices)
-		} else {
-			if g.refParams[target.Name] {
-				g.write("*")
-			}
-			g.write(goIdent(target.Name))
-		}
+		ref, _ := g.lvalue(target.Name, target.Indices)
+		g.write(ref)
 	}
 	g.write(" = ")
-	for i, val := range stmt.Values {
+	for i, val := range values {
 		if i > 0 {
 			g.write(", ")
 		}
-		g.generateExpression(val)
+		if len(values) == len(stmt.Targets) && len(stmt.Targets[i].Indices) == 0 && g.boolVars[stmt.Targets[i].Name] {
+			g.generateBoolValue(val)
+		} else {
+			g.generateExpression(val)
+		}
 	}
 	g.write("\n")
 }
@@ -2567,11 +7093,13 @@ func (g *Generator) generatePrintCall(call *ast.ProcCall) {
 }
 
 func (g *Generator) generateWhileLoop(loop *ast.WhileLoop) {
+	g.declareAltTimers(loop.Body)
 	g.builder.WriteString(strings.Repeat("\t", g.indent))
 	g.write("for ")
 	g.generateExpression(loop.Condition)
 	g.write(" {\n")
 	g.indent++
+	g.generatePriYield()
 
 	for _, s := range loop.Body {
 		g.generateStatement(s)
@@ -2615,7 +7143,7 @@ func (g *Generator) generateReplicatedIfLoop(stmt *ast.IfStatement, withinFlag b
 	if repl.Step != nil {
 		counter := "_repl_" + v
 		g.builder.WriteString(strings.Repeat("\t", g.indent))
-		g.write(fmt.Sprintf("for %s := 0; %s < ", counter, counter))
+		g.write(fmt.Sprintf("for %s := %s; %s < ", counter, g.asInt("0"), counter))
 		g.generateExpression(repl.Count)
 		g.write(fmt.Sprintf("; %s++ {\n", counter))
 		g.indent++
@@ -2628,7 +7156,7 @@ func (g *Generator) generateReplicatedIfLoop(stmt *ast.IfStatement, withinFlag b
 	} else {
 		g.builder.WriteString(strings.Repeat("\t", g.indent))
 		g.write(fmt.Sprintf("for %s := ", v))
-		g.generateExpression(repl.Start)
+		g.generateIntExpression(repl.Start)
 		g.write(fmt.Sprintf("; %s < ", v))
 		g.generateExpression(repl.Start)
 		g.write(" + ")
@@ -2756,6 +7284,17 @@ func (g *Generator) generateIfChoiceChain(choices []ast.IfChoice, isFirst bool)
 }
 
 func (g *Generator) generateCaseStatement(stmt *ast.CaseStatement) {
+	// A BYTE selector, or one with BYTE labels, has its other labels
+	// converted: constants such as VAL lf IS 10: are Go ints
+	byteSel := g.isByteExpr(stmt.Selector)
+	for _, choice := range stmt.Choices {
+		for _, val := range choice.Values {
+			if _, ok := val.(*ast.ByteLiteral); ok {
+				byteSel = true
+			}
+		}
+	}
+
 	g.builder.WriteString(strings.Repeat("\t", g.indent))
 	g.write("switch ")
 	g.generateExpression(stmt.Selector)
@@ -2771,7 +7310,18 @@ func (g *Generator) generateCaseStatement(stmt *ast.CaseStatement) {
 				if i > 0 {
 					g.write(", ")
 				}
-				g.generateExpression(val)
+				switch val.(type) {
+				case *ast.ByteLiteral, *ast.IntegerLiteral:
+					g.generateExpression(val)
+				default:
+					if byteSel {
+						g.write("byte(")
+						g.generateExpression(val)
+						g.write(")")
+					} else {
+						g.generateExpression(val)
+					}
+				}
 			}
 			g.write(":\n")
 		}
@@ -2785,16 +7335,53 @@ func (g *Generator) generateCaseStatement(stmt *ast.CaseStatement) {
 	g.writeLine("}")
 }
 
+// isByteExpr reports whether e is known to be a BYTE: a byte literal,
+// conversion or variable, or an element of a BYTE array or string.
+func (g *Generator) isByteExpr(e ast.Expression) bool {
+	switch e := e.(type) {
+	case *ast.ByteLiteral:
+		return true
+	case *ast.TypeConversion:
+		return e.TargetType == "BYTE"
+	case *ast.Identifier:
+		return g.byteVars[e.Value]
+	case *ast.IndexExpr:
+		switch left := e.Left.(type) {
+		case *ast.Identifier:
+			return g.arrayVars[left.Value] == "BYTE"
+		case *ast.StringLiteral:
+			return true
+		}
+	case *ast.ParenExpr:
+		return g.isByteExpr(e.Expr)
+	}
+	return false
+}
+
 func (g *Generator) generateExpression(expr ast.Expression) {
 	switch e := expr.(type) {
 	case *ast.Identifier:
-		if g.refParams[e.Value] {
-			g.write("*" + goIdent(e.Value))
+		if g.boolAsInt() && g.boolVars[e.Value] {
+			g.write("(" + g.varRef(e.Value) + " != 0)")
 		} else {
-			g.write(goIdent(e.Value))
+			g.write(g.varRef(e.Value))
 		}
 	case *ast.IntegerLiteral:
 		g.write(fmt.Sprintf("%d", e.Value))
+	case *ast.RealLiteral:
+		text := e.Token.Literal
+		if text == "" {
+			text = strconv.FormatFloat(e.Value, 'f', -1, 64)
+			if !strings.Contains(text, ".") {
+				text += ".0"
+			}
+		}
+		if e.Type != "" {
+			// A decorated literal has its type, as an undecorated one in Go
+			// takes the type of its context
+			text = g.occamTypeToGo(e.Type) + "(" + text + ")"
+		}
+		g.write(text)
 	case *ast.StringLiteral:
 		g.write(fmt.Sprintf("%q", e.Value))
 	case *ast.ByteLiteral:
@@ -2810,80 +7397,449 @@ func (g *Generator) generateExpression(expr ast.Expression) {
 	case *ast.UnaryExpr:
 		g.generateUnaryExpr(e)
 	case *ast.SizeExpr:
+		if t := g.intType(); t != "int" {
+			g.write(t + "(")
+		}
 		g.write("len(")
 		g.generateExpression(e.Expr)
 		g.write(")")
+		if g.intType() != "int" {
+			g.write(")")
+		}
+	case *ast.MobileExpr:
+		if e.Size != nil {
+			g.write(fmt.Sprintf("make([]%s, ", g.occamTypeToGo(e.Type)))
+			g.generateExpression(e.Size)
+			g.write(")")
+			break
+		}
+		g.generateMobile(e.Type)
 	case *ast.ParenExpr:
 		g.write("(")
 		g.generateExpression(e.Expr)
 		g.write(")")
 	case *ast.IndexExpr:
-		// Check if this is a record field access
-		if ident, ok := e.Left.(*ast.Identifier); ok {
-			if _, ok := g.recordVars[ident.Value]; ok {
-				if field, ok := e.Index.(*ast.Identifier); ok {
-					g.generateExpression(e.Left)
-					g.write(".")
-					g.write(goIdent(field.Value))
-					break
-				}
+		// Subscripts of a variable, selecting record fields by name
+		if name, indices, ok := indexPath(e); ok {
+			ref, fieldType := g.lvalue(name, indices)
+			if g.boolAsInt() && fieldType == "BOOL" {
+				ref = "(" + ref + " != 0)"
 			}
+			g.write(ref)
+			break
 		}
-		g.generateExpression(e.Left)
-		g.write("[")
-		g.generateExpression(e.Index)
-		g.write("]")
+		g.write(g.indexed(g.exprString(e.Left), []ast.Expression{e.Index}))
 	case *ast.SliceExpr:
-		g.generateExpression(e.Array)
-		g.write("[")
-		g.generateExpression(e.Start)
-		g.write(" : ")
-		g.generateExpression(e.Start)
-		g.write(" + ")
-		g.generateExpression(e.Length)
-		g.write("]")
+		g.write(g.slice(e.Array, e.Start, e.Length, e.Token.Line))
 	case *ast.FuncCall:
-		g.generateFuncCallExpr(e)
+		if g.boolAsInt() && g.returnsBool(e.Name) {
+			g.write("(")
+			g.generateFuncCallExpr(e)
+			g.write(" != 0)")
+		} else {
+			g.generateFuncCallExpr(e)
+		}
 	case *ast.TypeConversion:
-		if e.TargetType == "BOOL" {
-			// numeric → bool: emit ((expr) != 0)
-			g.write("((")
+		g.generateTypeConversion(e)
+	case *ast.MostExpr:
+		g.generateMostExpr(e)
+	case *ast.ArrayLiteral:
+		g.generateArrayLiteral(e)
+	case *ast.ArrayConstructor:
+		elem, dims := g.constructorType(e)
+		if elem == "" {
+			elem = "INT"
+		}
+		g.generateArrayConstructor(e, elem, dims)
+	case *ast.ValofExpr:
+		g.generateValofExpr(e)
+	default:
+		g.skip(expr)
+	}
+}
+
+// generateValofExpr generates (VALOF process RESULT e) as a Go closure,
+// called where it stands, that runs the process and returns the result.
+func (g *Generator) generateValofExpr(v *ast.ValofExpr) {
+	typ := g.valofType(v)
+	goType := g.occamTypeToGo(typ)
+	switch typ {
+	case "":
+		g.errors = append(g.errors, fmt.Sprintf("line %d: cannot tell the type of the VALOF's RESULT: declare the variable it names in the VALOF, or convert it (INT x)", v.Token.Line))
+		goType = g.intType()
+	case "BOOL":
+		// As the expressions it can stand for are
+		goType = "bool"
+	}
+	g.write(fmt.Sprintf("func() %s {\n", goType))
+	// A return from the body would only leave the closure
+	oldPoisonProc := g.poisonProc
+	g.poisonProc = nil
+	g.indent++
+	g.generateStatementsWithScoping(v.Body)
+	if !endsInError(v.Body) {
+		g.builder.WriteString(strings.Repeat("\t", g.indent))
+		g.write("return ")
+		g.generateExpression(v.Result)
+		g.write("\n")
+	}
+	g.indent--
+	g.poisonProc = oldPoisonProc
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write("}()")
+}
+
+// valofType returns the occam type of the result of v: that of the
+// variable it names, if declared in the VALOF, or else what can be told from
+// the expression without the types of the variables declared outside, or
+// "" if nothing can.
+func (g *Generator) valofType(v *ast.ValofExpr) string {
+	decls := map[string]string{}
+	for _, stmt := range v.Body {
+		switch s := stmt.(type) {
+		case *ast.VarDecl:
+			for _, n := range s.Names {
+				decls[n] = s.Type
+			}
+		case *ast.Abbreviation:
+			if s.TypeRef.IsData() {
+				decls[s.Name] = s.Type
+			}
+		}
+	}
+	var typeOf func(e ast.Expression) string
+	typeOf = func(e ast.Expression) string {
+		switch e := e.(type) {
+		case *ast.Identifier:
+			if typ, ok := decls[e.Value]; ok {
+				return typ
+			}
+			if g.boolVars[e.Value] {
+				return "BOOL"
+			}
+			return g.recordVars[e.Value]
+		case *ast.IntegerLiteral:
+			return "INT"
+		case *ast.ByteLiteral:
+			return "BYTE"
+		case *ast.BooleanLiteral:
+			return "BOOL"
+		case *ast.RealLiteral:
+			if e.Type != "" {
+				return e.Type
+			}
+			return "REAL64"
+		case *ast.TypeConversion:
+			return e.TargetType
+		case *ast.MostExpr:
+			return e.ExprType
+		case *ast.SizeExpr:
+			return "INT"
+		case *ast.ParenExpr:
+			return typeOf(e.Expr)
+		case *ast.UnaryExpr:
+			if e.Operator == "NOT" {
+				return "BOOL"
+			}
+			return typeOf(e.Right)
+		case *ast.BinaryExpr:
+			switch e.Operator {
+			case "=", "<>", "<", ">", "<=", ">=", "AND", "OR", "AFTER":
+				return "BOOL"
+			case "<<", ">>":
+				return typeOf(e.Left)
+			}
+			if typ := typeOf(e.Left); typ != "" {
+				return typ
+			}
+			return typeOf(e.Right)
+		case *ast.IndexExpr:
+			if id, ok := e.Left.(*ast.Identifier); ok {
+				return g.arrayVars[id.Value]
+			}
+		case *ast.FuncCall:
+			if results := g.funcResults[e.Name]; len(results) == 1 {
+				return results[0].FlatName()
+			}
+		case *ast.ValofExpr:
+			return g.valofType(e)
+		}
+		return ""
+	}
+	return typeOf(v.Result)
+}
+
+// generateTypeConversion emits a type conversion expression. All occam
+// conversions (INT x, BYTE x, REAL32 ROUND x, ...) go through here so that
+// BYTE/INT character conversions are emitted consistently.
+func (g *Generator) generateTypeConversion(e *ast.TypeConversion) {
+	target := g.primitiveType(e.TargetType)
+	if target == "BOOL" {
+		// numeric → bool: emit ((expr) != 0)
+		g.write("((")
+		g.generateExpression(e.Expr)
+		g.write(") != 0)")
+		return
+	}
+	if g.isBoolExpression(e.Expr) {
+		// bool → numeric: emit type(_boolToInt(expr))
+		goType := g.occamTypeToGo(e.TargetType)
+		if goType == "int" {
+			g.write(g.prefix + "_boolToInt(")
 			g.generateExpression(e.Expr)
-			g.write(") != 0)")
-		} else if g.isBoolExpression(e.Expr) {
-			// bool → numeric: emit type(_boolToInt(expr))
-			goType := g.occamTypeToGo(e.TargetType)
-			if goType == "int" {
-				g.write("_boolToInt(")
-				g.generateExpression(e.Expr)
-				g.write(")")
-			} else {
-				g.write(goType)
-				g.write("(_boolToInt(")
-				g.generateExpression(e.Expr)
-				g.write("))")
-			}
-		} else if e.Qualifier == "ROUND" && isOccamIntType(e.TargetType) {
-			// float → int with ROUND: emit goType(math.Round(float64(expr)))
-			goType := g.occamTypeToGo(e.TargetType)
+			g.write(")")
+		} else {
 			g.write(goType)
-			g.write("(math.Round(float64(")
+			g.write("(" + g.prefix + "_boolToInt(")
+			g.generateExpression(e.Expr)
+			g.write("))")
+		}
+		return
+	}
+	if g.checkedConversion(e) {
+		// Under -strict: _intChecked[goType](expr, line), rounding first
+		// for ROUND
+		g.write(fmt.Sprintf("%s_intChecked[%s](", g.prefix, g.occamTypeToGo(e.TargetType)))
+		if e.Qualifier == "ROUND" {
+			g.write("math.Round(float64(")
 			g.generateExpression(e.Expr)
-			g.write(")))")
+			g.write("))")
 		} else {
-			g.write(g.occamTypeToGo(e.TargetType))
-			g.write("(")
 			g.generateExpression(e.Expr)
-			g.write(")")
 		}
+		g.write(fmt.Sprintf(", %d)", e.Token.Line))
+		return
+	}
+	if e.Qualifier == "ROUND" && isOccamIntType(target) {
+		// float → int with ROUND: emit goType(math.Round(float64(expr)))
+		goType := g.occamTypeToGo(e.TargetType)
+		g.write(goType)
+		g.write("(math.Round(float64(")
+		g.generateExpression(e.Expr)
+		g.write(")))")
+		return
+	}
+	if isOccamIntType(target) {
+		// A constant conversion out of the target's range is a compile-time
+		// error in occam, as BYTE 300 is
+		goType := g.occamTypeToGo(e.TargetType)
+		v, isInt := constIntValue(e.Expr)
+		r, isReal := constRealValue(e.Expr)
+		if isReal && !isInt {
+			v = int64(r)
+		}
+		if isInt || isReal {
+			if lo, hi, ok := goIntRange(goType); ok && (v < lo || v > hi || isReal && (r < float64(lo) || r >= float64(hi)+1)) {
+				g.errors = append(g.errors, fmt.Sprintf("line %d: constant %s is out of range for %s", e.Token.Line, constText(isInt, v, r), target))
+			}
+		}
+		// Go rejects constant float to integer conversions that lose the
+		// fraction, so INT 2.5 (which truncates) is folded here; integer
+		// constants are folded by the fold-conversions pass
+		if isReal && !isInt || isInt && g.pass("fold-conversions") {
+			g.write(fmt.Sprintf("%s(%d)", goType, v))
+			return
+		}
+	}
+	g.write(g.occamTypeToGo(e.TargetType))
+	g.write("(")
+	g.generateExpression(e.Expr)
+	g.write(")")
+}
+
+// goIntRange returns the range of values of the Go integer type goType.
+func goIntRange(goType string) (lo, hi int64, ok bool) {
+	switch goType {
+	case "byte", "uint8":
+		return 0, math.MaxUint8, true
+	case "int8":
+		return math.MinInt8, math.MaxInt8, true
+	case "int16":
+		return math.MinInt16, math.MaxInt16, true
+	case "uint16":
+		return 0, math.MaxUint16, true
+	case "int32":
+		return math.MinInt32, math.MaxInt32, true
+	case "uint32":
+		return 0, math.MaxUint32, true
+	case "int", "int64":
+		return math.MinInt64, math.MaxInt64, true
+	}
+	return 0, 0, false
+}
+
+// constText formats a constant converted by a type conversion for an
+// error message.
+func constText(isInt bool, v int64, r float64) string {
+	if isInt {
+		return strconv.FormatInt(v, 10)
+	}
+	return strconv.FormatFloat(r, 'g', -1, 64)
+}
+
+// constBoolValue evaluates a BOOL constant expression built from TRUE,
+// FALSE, NOT, AND and OR, returning false if the expression is not constant.
+// FALSE AND x and TRUE OR x are constant whatever x is.
+func constBoolValue(expr ast.Expression) (bool, bool) {
+	switch e := expr.(type) {
+	case *ast.BooleanLiteral:
+		return e.Value, true
+	case *ast.ParenExpr:
+		return constBoolValue(e.Expr)
+	case *ast.UnaryExpr:
+		if e.Operator == "NOT" {
+			v, ok := constBoolValue(e.Right)
+			return !v, ok
+		}
+	case *ast.BinaryExpr:
+		if e.Operator != "AND" && e.Operator != "OR" {
+			return false, false
+		}
+		l, lok := constBoolValue(e.Left)
+		r, rok := constBoolValue(e.Right)
+		if e.Operator == "AND" && (lok && !l || rok && !r) {
+			return false, true
+		}
+		if e.Operator == "OR" && (lok && l || rok && r) {
+			return true, true
+		}
+		if lok && rok {
+			// AND of two TRUEs or OR of two FALSEs
+			return l, true
+		}
+	}
+	return false, false
+}
+
+// constRealValue evaluates a real constant expression: a real literal,
+// possibly negated or in parentheses.
+func constRealValue(expr ast.Expression) (float64, bool) {
+	switch e := expr.(type) {
+	case *ast.RealLiteral:
+		return e.Value, true
+	case *ast.ParenExpr:
+		return constRealValue(e.Expr)
+	case *ast.UnaryExpr:
+		if v, ok := constRealValue(e.Right); ok && e.Operator == "-" {
+			return -v, true
+		}
+	}
+	return 0, false
+}
+
+// constIntValue evaluates an integer constant expression built from integer
+// and byte literals, returning false if the expression is not constant.
+// generateUntypedValue writes the value of an untyped VAL abbreviation,
+// making integer constants INTs where INT is not Go int.
+func (g *Generator) generateUntypedValue(e ast.Expression) {
+	if isUntypedInt(e) {
+		g.generateIntExpression(e)
+		return
+	}
+	g.generateExpression(e)
+}
+
+// isUntypedInt reports whether e is integer arithmetic on literals and
+// MOSTNEG/MOSTPOS INT, to which Go gives the type int.
+func isUntypedInt(e ast.Expression) bool {
+	switch e := e.(type) {
+	case *ast.IntegerLiteral:
+		return true
 	case *ast.MostExpr:
-		g.generateMostExpr(e)
-	case *ast.ArrayLiteral:
-		g.generateArrayLiteral(e)
+		return e.ExprType == "INT"
+	case *ast.ParenExpr:
+		return isUntypedInt(e.Expr)
+	case *ast.UnaryExpr:
+		return e.Operator != "NOT" && isUntypedInt(e.Right)
+	case *ast.BinaryExpr:
+		switch e.Operator {
+		case "+", "-", "*", "/", "\\", "PLUS", "MINUS", "TIMES", "/\\", "\\/", "><", "<<", ">>":
+			return isUntypedInt(e.Left) && isUntypedInt(e.Right)
+		}
+	}
+	return false
+}
+
+func constIntValue(expr ast.Expression) (int64, bool) {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral:
+		return e.Value, true
+	case *ast.ByteLiteral:
+		return int64(e.Value), true
+	case *ast.ParenExpr:
+		return constIntValue(e.Expr)
+	case *ast.UnaryExpr:
+		v, ok := constIntValue(e.Right)
+		if !ok {
+			return 0, false
+		}
+		switch e.Operator {
+		case "-":
+			return -v, true
+		case "~":
+			return ^v, true
+		}
+	case *ast.TypeConversion:
+		if isOccamIntType(e.TargetType) && e.Qualifier == "" {
+			v, ok := constIntValue(e.Expr)
+			if ok && e.TargetType == "BYTE" && (v < 0 || v > 0xFF) {
+				// Out of range, reported where the conversion is generated
+				return 0, false
+			}
+			return v, ok
+		}
+	case *ast.BinaryExpr:
+		l, ok := constIntValue(e.Left)
+		if !ok {
+			return 0, false
+		}
+		r, ok := constIntValue(e.Right)
+		if !ok {
+			return 0, false
+		}
+		switch e.Operator {
+		case "+", "PLUS":
+			return l + r, true
+		case "-", "MINUS":
+			return l - r, true
+		case "*", "TIMES":
+			return l * r, true
+		case "/":
+			if r != 0 {
+				return l / r, true
+			}
+		case "\\":
+			if r != 0 {
+				return l % r, true
+			}
+		case "/\\":
+			return l & r, true
+		case "\\/":
+			return l | r, true
+		case "><":
+			return l ^ r, true
+		}
 	}
+	return 0, false
 }
 
 func (g *Generator) generateBinaryExpr(expr *ast.BinaryExpr) {
+	if eq := g.arrayEqualFunc(expr); eq != "" {
+		g.generateArrayComparison(expr, eq)
+		return
+	}
+	if fn := g.checkedArithFunc(expr); fn != "" {
+		g.write(g.prefix + fn + "(")
+		g.generateExpression(expr.Left)
+		g.write(", ")
+		g.generateExpression(expr.Right)
+		line := expr.Token.Line
+		if line == 0 {
+			line = exprLine(expr)
+		}
+		g.write(fmt.Sprintf(", %d)", line))
+		return
+	}
 	g.write("(")
 	g.generateExpression(expr.Left)
 	g.write(" ")
@@ -2893,6 +7849,180 @@ func (g *Generator) generateBinaryExpr(expr *ast.BinaryExpr) {
 	g.write(")")
 }
 
+// checkedArithFunc returns the helper that computes expr, a +, - or *,
+// stopping on overflow, with WithCheckedArith, and "" otherwise. Constant
+// operations are left to Go, which rejects those that overflow.
+func (g *Generator) checkedArithFunc(expr *ast.BinaryExpr) string {
+	if !g.checkedArith {
+		return ""
+	}
+	fn := map[string]string{"+": "_addChecked", "-": "_subChecked", "*": "_mulChecked"}[expr.Operator]
+	if fn == "" || isConstNumber(expr.Left) && isConstNumber(expr.Right) {
+		return ""
+	}
+	return fn
+}
+
+// isConstNumber reports whether e is an integer or real constant expression.
+func isConstNumber(e ast.Expression) bool {
+	if _, ok := constIntValue(e); ok {
+		return true
+	}
+	_, ok := constRealValue(e)
+	return ok
+}
+
+// containsCheckedArith checks if a statement tree contains a +, - or *
+// computed by a checked arithmetic helper.
+func (g *Generator) containsCheckedArith(stmt ast.Statement) bool {
+	return g.walkStatements(stmt, func(e ast.Expression) bool {
+		be, ok := e.(*ast.BinaryExpr)
+		return ok && g.checkedArithFunc(be) != ""
+	})
+}
+
+// checkedConversion reports whether e is a conversion to an integer type
+// that is range checked under -strict: one of a value not known until run
+// time, and not of a BOOL.
+func (g *Generator) checkedConversion(e *ast.TypeConversion) bool {
+	if !g.strict || !isOccamIntType(g.primitiveType(e.TargetType)) || g.isBoolExpression(e.Expr) {
+		return false
+	}
+	if _, ok := constIntValue(e.Expr); ok {
+		return false
+	}
+	_, ok := constRealValue(e.Expr)
+	return !ok
+}
+
+// containsCheckedConversion reports whether stmt has a range checked
+// conversion, needing the _intChecked helper.
+func (g *Generator) containsCheckedConversion(stmt ast.Statement) bool {
+	return g.walkStatements(stmt, func(e ast.Expression) bool {
+		tc, ok := e.(*ast.TypeConversion)
+		return ok && g.checkedConversion(tc)
+	})
+}
+
+// arrayEqualFunc returns the Go function comparing the operands of expr,
+// "bytes.Equal" or "slices.Equal" (_sliceEqual before Go 1.21), when
+// expr compares whole one-dimensional arrays with = or <> (Go cannot compare
+// slices with ==), "reflect.DeepEqual" when it compares arrays of more
+// dimensions, and "" otherwise.
+// A string literal is compared as a BYTE array when the other operand is an
+// array.
+func (g *Generator) arrayEqualFunc(expr *ast.BinaryExpr) string {
+	if expr.Operator != "=" && expr.Operator != "<>" {
+		return ""
+	}
+	elem, dims, ok := g.arrayShape(expr.Left)
+	if !ok {
+		elem, dims, ok = g.arrayShape(expr.Right)
+	}
+	if !ok {
+		return ""
+	}
+	if dims > 1 {
+		return "reflect.DeepEqual"
+	}
+	if elem == "" {
+		// An array literal compared with a string
+		elem = "BYTE"
+	}
+	if elem == "BYTE" && g.occamTypeToGo("BYTE") == "byte" {
+		return "bytes.Equal"
+	}
+	if g.goMinor < 21 {
+		return g.prefix + "_sliceEqual"
+	}
+	return "slices.Equal"
+}
+
+// arrayElemType reports whether e is a one-dimensional array (see
+// arrayShape), and its element type ("" for a literal).
+func (g *Generator) arrayElemType(e ast.Expression) (string, bool) {
+	elem, dims, ok := g.arrayShape(e)
+	return elem, ok && dims == 1
+}
+
+// arrayShape reports whether e is an array variable, a slice or row of one
+// or an array literal, with its element type ("" for a literal) and number
+// of dimensions.
+func (g *Generator) arrayShape(e ast.Expression) (string, int, bool) {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		if elem, dims := g.arrayVarShape(e.Value); dims > 0 {
+			return elem, dims, true
+		}
+	case *ast.IndexExpr:
+		if name, indices, ok := indexPath(e); ok {
+			if m, ok := g.multiArrays[name]; ok && len(indices) < m.dims {
+				return m.elem, m.dims - len(indices), true
+			}
+		}
+	case *ast.SliceExpr:
+		return g.arrayShape(e.Array)
+	case *ast.ParenExpr:
+		return g.arrayShape(e.Expr)
+	case *ast.ArrayLiteral:
+		dims := 1
+		for lit := e; len(lit.Elements) > 0; dims++ {
+			inner, ok := lit.Elements[0].(*ast.ArrayLiteral)
+			if !ok {
+				break
+			}
+			lit = inner
+		}
+		return "", dims, true
+	case *ast.ArrayConstructor:
+		return "", 1, true
+	}
+	return "", 0, false
+}
+
+// arrayVarShape returns the element type and number of dimensions of array
+// variable name, or 0 dimensions if it is not one.
+func (g *Generator) arrayVarShape(name string) (string, int) {
+	if elem, ok := g.arrayVars[name]; ok {
+		return elem, 1
+	}
+	if m, ok := g.multiArrays[name]; ok {
+		return m.elem, m.dims
+	}
+	return "", 0
+}
+
+// generateArrayComparison emits a whole-array = or <> as a call to eq.
+func (g *Generator) generateArrayComparison(expr *ast.BinaryExpr, eq string) {
+	elem, dims, ok := g.arrayShape(expr.Left)
+	if !ok || elem == "" {
+		elem, dims, _ = g.arrayShape(expr.Right)
+	}
+	if expr.Operator == "<>" {
+		g.write("!")
+	}
+	g.write(eq + "(")
+	for i, operand := range []ast.Expression{expr.Left, expr.Right} {
+		if i > 0 {
+			g.write(", ")
+		}
+		switch e := operand.(type) {
+		case *ast.StringLiteral:
+			g.write("[]byte(")
+			g.generateExpression(e)
+			g.write(")")
+		case *ast.ArrayLiteral, *ast.ArrayConstructor:
+			if elem == "" {
+				elem = "BYTE"
+			}
+			g.generateTypedLiteral(e, elem, dims)
+		default:
+			g.generateExpression(operand)
+		}
+	}
+	g.write(")")
+}
+
 func (g *Generator) generateUnaryExpr(expr *ast.UnaryExpr) {
 	op := g.occamOpToGo(expr.Operator)
 	g.write(op)
@@ -2943,115 +8073,1644 @@ func (g *Generator) occamOpToGo(op string) string {
 	}
 }
 
-// generateArrayLiteral emits a Go slice literal: []int{e1, e2, ...}
-func (g *Generator) generateArrayLiteral(al *ast.ArrayLiteral) {
-	g.write("[]int{")
-	for i, elem := range al.Elements {
-		if i > 0 {
-			g.write(", ")
-		}
-		g.generateExpression(elem)
-	}
-	g.write("}")
+// generateArrayLiteral emits a Go slice literal: []int{e1, e2, ...}
+// generateArrayLiteral emits an array literal whose type no declaration
+// gives, as a Go composite literal of the type arrayLiteralType finds.
+func (g *Generator) generateArrayLiteral(al *ast.ArrayLiteral) {
+	elem, dims := g.arrayLiteralType(al)
+	if elem == "" {
+		elem = "INT"
+	}
+	g.generateTypedLiteral(al, elem, dims)
+}
+
+// arrayLiteralType returns the element type and dimensions of an array
+// literal: the dimensions from its nested literals, and the type from a
+// decoration ([1, 2](INT32)), or failing that the first element whose type
+// is evident, or "" if none is.
+func (g *Generator) arrayLiteralType(al *ast.ArrayLiteral) (string, int) {
+	elem, dims := al.Type, 1
+	for i, e := range al.Elements {
+		if inner, ok := e.(*ast.ArrayLiteral); ok {
+			innerElem, innerDims := g.arrayLiteralType(inner)
+			if i == 0 {
+				dims += innerDims
+			}
+			if elem == "" {
+				elem = innerElem
+			}
+		} else if ac, ok := e.(*ast.ArrayConstructor); ok {
+			innerElem, innerDims := g.constructorType(ac)
+			if i == 0 {
+				dims += innerDims
+			}
+			if elem == "" {
+				elem = innerElem
+			}
+		} else if _, ok := e.(*ast.StringLiteral); ok {
+			// A string is a []BYTE
+			if i == 0 {
+				dims++
+			}
+			if elem == "" {
+				elem = "BYTE"
+			}
+		} else if elem == "" {
+			elem = g.literalElemType(e)
+		}
+	}
+	return elem, dims
+}
+
+// literalElemType returns the occam type of an array literal's element
+// where it is evident without declarations of scalar variables, or "".
+func (g *Generator) literalElemType(e ast.Expression) string {
+	switch e := e.(type) {
+	case *ast.ByteLiteral:
+		return "BYTE"
+	case *ast.BooleanLiteral:
+		return "BOOL"
+	case *ast.RealLiteral:
+		if e.Type != "" {
+			return e.Type
+		}
+		return "REAL64"
+	case *ast.TypeConversion:
+		return e.TargetType
+	case *ast.MostExpr:
+		return e.ExprType
+	case *ast.Identifier:
+		if g.boolVars[e.Value] {
+			return "BOOL"
+		}
+		return g.recordVars[e.Value]
+	case *ast.FuncCall:
+		if results := g.funcResults[e.Name]; len(results) == 1 {
+			return results[0].FlatName()
+		}
+	case *ast.ParenExpr:
+		return g.literalElemType(e.Expr)
+	case *ast.UnaryExpr:
+		if e.Operator == "NOT" {
+			return "BOOL"
+		}
+		return g.literalElemType(e.Right)
+	case *ast.BinaryExpr:
+		if g.isBoolExpression(e) {
+			return "BOOL"
+		}
+		if t := g.literalElemType(e.Left); t != "" {
+			return t
+		}
+		return g.literalElemType(e.Right)
+	}
+	return ""
+}
+
+// constructorType returns the element type and dimensions of an array
+// constructor, as arrayLiteralType does for its value as an element.
+func (g *Generator) constructorType(ac *ast.ArrayConstructor) (string, int) {
+	return g.arrayLiteralType(&ast.ArrayLiteral{Token: ac.Token, Elements: []ast.Expression{ac.Value}})
+}
+
+// generateArrayConstructor emits [i = start FOR count | value], an array of
+// the given occam type with dims dimensions, as a Go closure, called where
+// it stands, that appends value to a slice for each i:
+//
+//	func() []int {
+//		_table0 := make([]int, 0, count)
+//		for i := start; i < start + count; i++ {
+//			_table0 = append(_table0, value)
+//		}
+//		return _table0
+//	}()
+func (g *Generator) generateArrayConstructor(ac *ast.ArrayConstructor, occamType string, dims int) {
+	goType := strings.Repeat("[]", dims) + g.occamTypeToGo(occamType)
+	table := fmt.Sprintf("_table%d", g.tmpCounter)
+	g.tmpCounter++
+	rep := ac.Replicator
+	v := goIdent(rep.Variable)
+	g.write(fmt.Sprintf("func() %s {\n", goType))
+	g.indent++
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write(fmt.Sprintf("%s := make(%s, 0, ", table, goType))
+	g.generateExpression(rep.Count)
+	g.write(")\n")
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	if rep.Step != nil {
+		counter := "_repl_" + v
+		g.write(fmt.Sprintf("for %s := %s; %s < ", counter, g.asInt("0"), counter))
+		g.generateExpression(rep.Count)
+		g.write(fmt.Sprintf("; %s++ {\n", counter))
+		g.indent++
+		used := g.walkExpr(ac.Value, func(e ast.Expression) bool {
+			id, ok := e.(*ast.Identifier)
+			return ok && id.Value == rep.Variable
+		})
+		if used {
+			// Go rejects a variable that is not used
+			g.builder.WriteString(strings.Repeat("\t", g.indent))
+			g.write(fmt.Sprintf("%s := ", v))
+			g.generateExpression(rep.Start)
+			g.write(fmt.Sprintf(" + %s * ", counter))
+			g.generateExpression(rep.Step)
+			g.write("\n")
+		}
+	} else {
+		g.write(fmt.Sprintf("for %s := ", v))
+		g.generateIntExpression(rep.Start)
+		g.write(fmt.Sprintf("; %s < ", v))
+		g.generateExpression(rep.Start)
+		g.write(" + ")
+		g.generateExpression(rep.Count)
+		g.write(fmt.Sprintf("; %s++ {\n", v))
+		g.indent++
+	}
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write(fmt.Sprintf("%s = append(%s, ", table, table))
+	g.generateTypedLiteral(ac.Value, occamType, dims-1)
+	g.write(")\n")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("return " + table)
+	g.indent--
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write("}()")
+}
+
+// generateTypedLiteral emits e, a value of the given occam type with dims
+// array dimensions. An array literal becomes a Go composite literal of that
+// type, with the types of nested ones elided, and an array literal for a
+// record gives its fields in order: VAL POINT p IS [1, 2]: is POINT{x: 1, y: 2}.
+func (g *Generator) generateTypedLiteral(e ast.Expression, occamType string, dims int) {
+	if _, ok := e.(*ast.ArrayLiteral); ok && (dims > 0 || g.recordDefs[occamType] != nil) {
+		g.write(strings.Repeat("[]", dims) + g.occamTypeToGo(occamType))
+	}
+	g.generateLiteralElems(e, occamType, dims)
+}
+
+// generateLiteralElems emits the braced elements of e for
+// generateTypedLiteral, or e itself if it is not an array literal.
+func (g *Generator) generateLiteralElems(e ast.Expression, occamType string, dims int) {
+	if _, isStr := e.(*ast.StringLiteral); isStr && dims == 1 && occamType == "BYTE" {
+		g.write("[]byte(")
+		g.generateExpression(e)
+		g.write(")")
+		return
+	}
+	if ac, ok := e.(*ast.ArrayConstructor); ok && dims > 0 {
+		g.generateArrayConstructor(ac, occamType, dims)
+		return
+	}
+	al, ok := e.(*ast.ArrayLiteral)
+	rec := g.recordDefs[occamType]
+	if !ok || dims == 0 && rec == nil {
+		if occamType == "BOOL" {
+			g.generateBoolValue(e)
+		} else {
+			g.generateExpression(e)
+		}
+		return
+	}
+	if dims > 0 && g.largeLiteral(al) {
+		g.generateTableElems(al, occamType, dims)
+		return
+	}
+	g.write("{")
+	for i, elem := range al.Elements {
+		if i > 0 {
+			g.write(", ")
+		}
+		if dims > 0 {
+			g.generateLiteralElems(elem, occamType, dims-1)
+		} else if i < len(rec.Fields) {
+			// Struct fields cannot elide the type of a nested record
+			g.write(goIdent(rec.Fields[i].Name) + ": ")
+			g.generateTypedLiteral(elem, rec.Fields[i].Type, 0)
+		}
+	}
+	g.write("}")
+}
+
+// largeLiteral reports whether the array literal al is a large table (see
+// WithTableThreshold).
+func (g *Generator) largeLiteral(al *ast.ArrayLiteral) bool {
+	return g.tableThreshold > 0 && literalSize(al) > g.tableThreshold
+}
+
+// literalSize returns the number of scalars in e, 1 unless it is an array
+// literal.
+func literalSize(e ast.Expression) int {
+	al, ok := e.(*ast.ArrayLiteral)
+	if !ok {
+		return 1
+	}
+	n := 0
+	for _, elem := range al.Elements {
+		n += literalSize(elem)
+	}
+	return n
+}
+
+// generateTableElems emits the braced elements of the large table al for
+// generateLiteralElems, laid out as gofmt would: tableRowSize scalars or
+// one nested array to a line, each line ending in a comma, with integer
+// constants folded so that -1 is not written as - 1.
+func (g *Generator) generateTableElems(al *ast.ArrayLiteral, occamType string, dims int) {
+	g.write("{\n")
+	g.indent++
+	for i, elem := range al.Elements {
+		if dims > 1 || i%tableRowSize == 0 {
+			g.builder.WriteString(strings.Repeat("\t", g.indent))
+		}
+		if v, ok := constIntValue(elem); ok && dims == 1 && isOccamIntType(occamType) {
+			g.write(strconv.FormatInt(v, 10))
+		} else {
+			g.generateLiteralElems(elem, occamType, dims-1)
+		}
+		if dims > 1 || i%tableRowSize == tableRowSize-1 || i == len(al.Elements)-1 {
+			g.write(",\n")
+		} else {
+			g.write(", ")
+		}
+	}
+	g.indent--
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write("}")
+}
+
+// tableDataValue returns, under WithTableData, the Go expression decoding
+// the value of the top-level abbreviation abbr from a string, if it is a
+// large table of integer constants with one dimension.
+func (g *Generator) tableDataValue(abbr *ast.Abbreviation) (string, bool) {
+	al, ok := abbr.Value.(*ast.ArrayLiteral)
+	if dims, _ := abbr.TypeRef.Dims(); !g.tableData || !ok || dims != 1 || !isOccamIntType(abbr.Type) || !g.largeLiteral(al) {
+		return "", false
+	}
+	values := make([]int64, len(al.Elements))
+	for i, elem := range al.Elements {
+		if values[i], ok = constIntValue(elem); !ok {
+			return "", false
+		}
+	}
+	var data []byte
+	if abbr.Type == "BYTE" {
+		for _, v := range values {
+			data = append(data, byte(v))
+		}
+		return fmt.Sprintf("[]byte(%+q)", data), true
+	}
+	for _, v := range values {
+		data = binary.AppendVarint(data, v)
+	}
+	g.needTableInts = true
+	return fmt.Sprintf("%s_tableInts[%s](%+q, %d)", g.prefix, g.occamTypeToGo(abbr.Type), data, len(values)), true
+}
+
+// retypeView is a non-VAL RETYPES or RESHAPES in scope: its Go name, the
+// Go pointer or slice its source is written back through, and the
+// stmtDepth of the block declaring it.
+type retypeView struct {
+	name, dst string
+	depth     int
+	line      int
+}
+
+// generateRetypesDecl emits code for a RETYPES or RESHAPES declaration: the
+// target is allocated, then filled with the bytes of the source by
+// _retype, which STOPs if their sizes differ. An open first dimension is
+// sized to fit. A non-VAL target is a copy, which endStatement writes back.
+// When source and target share the same name (shadowing a parameter), the parameter
+// has been renamed in the signature (e.g. X → _rp_X) so we can use := with the
+// original name to create a new variable.
+func (g *Generator) generateRetypesDecl(r *ast.RetypesDecl) {
+	gName := goIdent(r.Name)
+	line := r.Token.Line
+	src, dst := g.retypeSource(r)
+	goType := g.occamTypeToGo(r.TargetType)
+	switch {
+	case len(r.Sizes) == 0:
+		g.writeLine(fmt.Sprintf("var %s %s", gName, goType))
+	default:
+		sizes := r.Sizes
+		if sizes[0] == nil {
+			// [][4]BYTE rows RETYPES x: as many rows as the bytes of x fill
+			count := fmt.Sprintf("_rtCount%d", g.tmpCounter)
+			g.tmpCounter++
+			g.builder.WriteString(strings.Repeat("\t", g.indent))
+			g.write(fmt.Sprintf("%s := %s_retypeCount[%s](%s, 1", count, g.prefix, goType, src))
+			for _, size := range sizes[1:] {
+				g.write("*int(")
+				g.generateExpression(size)
+				g.write(")")
+			}
+			g.write(fmt.Sprintf(", %d)\n", line))
+			sizes = append([]ast.Expression{&ast.Identifier{Value: count}}, sizes[1:]...)
+		}
+		if len(sizes) == 1 {
+			g.builder.WriteString(strings.Repeat("\t", g.indent))
+			g.write(fmt.Sprintf("%s := make([]%s, ", gName, goType))
+			g.generateExpression(sizes[0])
+			g.write(")\n")
+		} else {
+			g.generateMultiDimArrayInit(gName, goType, sizes, 0)
+		}
+	}
+	g.writeLine(fmt.Sprintf("%s_retype(&%s, %s, %d)", g.prefix, gName, src, line))
+	if g.nestingLevel > 0 {
+		g.writeLine(fmt.Sprintf("_ = %s", gName))
+	}
+	g.boolVars[r.Name] = r.TargetType == "BOOL" && len(r.Sizes) == 0
+	delete(g.refParams, r.Name)
+	if !r.IsVal {
+		g.retypeViews = append(g.retypeViews, retypeView{name: r.Name, dst: dst, depth: g.stmtDepth, line: line})
+	}
+}
+
+// retypeSource returns the Go value of the source of r and, unless r is
+// VAL, the Go pointer or slice through which its source is written.
+func (g *Generator) retypeSource(r *ast.RetypesDecl) (src, dst string) {
+	var name string
+	var indices []ast.Expression
+	switch v := r.Source.(type) {
+	case *ast.Identifier:
+		name = v.Value
+	case *ast.IndexExpr:
+		name, indices, _ = indexPath(v)
+	case *ast.SliceExpr:
+		// A slice shares the storage it is written through
+		src = g.exprString(v)
+		return src, src
+	}
+	if renamed, ok := g.retypesRenames[name]; ok && len(indices) == 0 {
+		// The parameter of the same name, renamed in the signature
+		ref := renamed
+		if g.refParams[name] {
+			return "*" + ref, ref
+		}
+		return ref, "&" + ref
+	}
+	src = g.exprString(r.Source)
+	if name != "" && !r.IsVal {
+		lv, _ := g.lvalue(name, indices)
+		dst = "&" + lv
+	}
+	return src, dst
+}
+
+// endStatement ends the generation of stmt: non-VAL RETYPES declared in
+// blocks inside it go out of scope, and those declared before it in its
+// own block are written back to their sources once it is the process they
+// scope over, that is unless it is a declaration or hides one of them.
+func (g *Generator) endStatement(stmt ast.Statement) {
+	views := g.retypeViews[:0]
+	for _, v := range g.retypeViews {
+		if v.depth <= g.stmtDepth {
+			views = append(views, v)
+		}
+	}
+	g.retypeViews = views
+	if _, isRetypes := stmt.(*ast.RetypesDecl); !isRetypes {
+		hidden := make(map[string]bool)
+		for _, n := range declaredNames(stmt) {
+			hidden[n] = true
+		}
+		views = g.retypeViews[:0]
+		for _, v := range g.retypeViews {
+			if v.depth == g.stmtDepth && hidden[v.name] {
+				continue
+			}
+			if v.depth == g.stmtDepth && !isDeclaration(stmt) {
+				// the process the declaration scopes over is done
+				g.writeLine(fmt.Sprintf("%s_retype(%s, %s, %d)", g.prefix, v.dst, goIdent(v.name), v.line))
+				continue
+			}
+			views = append(views, v)
+		}
+		g.retypeViews = views
+	}
+	g.stmtDepth--
+}
+
+// containsArrayComparison checks if a statement tree compares whole arrays
+// with the Go function eq (see arrayEqualFunc).
+func (g *Generator) containsArrayComparison(stmt ast.Statement, eq string) bool {
+	return g.walkStatements(stmt, func(e ast.Expression) bool {
+		be, ok := e.(*ast.BinaryExpr)
+		return ok && g.arrayEqualFunc(be) == eq
+	})
+}
+
+// containsIntrinsics checks if a statement tree contains transputer intrinsic calls.
+func (g *Generator) containsIntrinsics(stmt ast.Statement) bool {
+	return g.walkStatements(stmt, func(e ast.Expression) bool {
+		if fc, ok := e.(*ast.FuncCall); ok {
+			return transpIntrinsics[fc.Name]
+		}
+		return false
+	})
+}
+
+// containsRuntimeCall checks if a statement tree calls a PROC or FUNCTION
+// taken from the runtime package.
+func (g *Generator) containsRuntimeCall(stmt ast.Statement) bool {
+	isRuntime := func(name string) bool {
+		_, ok := runtimeProcs[name]
+		return ok
+	}
+	return g.containsProcCall(stmt, isRuntime) || g.walkStatements(stmt, func(e ast.Expression) bool {
+		fc, ok := e.(*ast.FuncCall)
+		return ok && isRuntime(fc.Name)
+	})
+}
+
+// useRuntimeProcs makes calls to the course library go to the runtime
+// package, and returns program without its own top-level declarations of
+// the PROCs and FUNCTIONs the runtime provides.
+func (g *Generator) useRuntimeProcs(program *ast.Program) *ast.Program {
+	for _, typ := range []string{"INT", "BYTE", "BOOL"} {
+		if g.goTypes[typ] != defaultGoTypes[typ] {
+			g.errors = append(g.errors, fmt.Sprintf("the course library runtime needs %s as %s, not %s", typ, defaultGoTypes[typ], g.goTypes[typ]))
+		}
+	}
+	for name, rp := range runtimeProcs {
+		g.procSigs[name] = rp.params
+		g.exported[name] = "occrt." + rp.goName
+		if rp.result != "" {
+			g.funcResults[name] = []*ast.TypeRef{ast.Scalar(rp.result)}
+		}
+	}
+	kept := &ast.Program{}
+	for _, stmt := range program.Statements {
+		name := ""
+		switch s := stmt.(type) {
+		case *ast.ProcDecl:
+			name = s.Name
+		case *ast.FuncDecl:
+			name = s.Name
+		}
+		if _, ok := runtimeProcs[name]; !ok {
+			kept.Statements = append(kept.Statements, stmt)
+		}
+	}
+	return kept
+}
+
+// containsBoolConversion checks if a statement tree contains a bool-to-numeric type conversion.
+func (g *Generator) containsBoolConversion(stmt ast.Statement) bool {
+	return g.walkStatements(stmt, func(e ast.Expression) bool {
+		tc, ok := e.(*ast.TypeConversion)
+		if !ok {
+			return false
+		}
+		// Only need the helper for bool→numeric (not numeric→bool)
+		return tc.TargetType != "BOOL" && g.isBoolExpression(tc.Expr)
+	})
+}
+
+// isBoolExpression returns true if the expression is known to produce a bool value.
+func (g *Generator) isBoolExpression(expr ast.Expression) bool {
+	switch e := expr.(type) {
+	case *ast.BooleanLiteral:
+		return true
+	case *ast.Identifier:
+		return g.boolVars[e.Value]
+	case *ast.UnaryExpr:
+		return e.Operator == "NOT"
+	case *ast.BinaryExpr:
+		switch e.Operator {
+		case "=", "<>", "<", ">", "<=", ">=", "AND", "OR", "AFTER":
+			return true
+		}
+	case *ast.TypeConversion:
+		return e.TargetType == "BOOL"
+	case *ast.ParenExpr:
+		return g.isBoolExpression(e.Expr)
+	case *ast.ValofExpr:
+		return g.valofType(e) == "BOOL"
+	}
+	return false
+}
+
+// boolAsInt reports whether BOOL is mapped to a non-bool Go type (see
+// WithTypeMap), so that stored BOOLs need converting to and from Go bool.
+func (g *Generator) boolAsInt() bool {
+	return g.goTypes["BOOL"] != "bool"
+}
+
+// isScalarBoolParam reports whether p is a plain BOOL parameter (VAL or
+// reference), as opposed to a BOOL array or channel.
+// isByteType reports whether t is a single BYTE.
+func isByteType(t *ast.TypeRef) bool {
+	return t != nil && t.Kind == ast.ScalarType && t.Name == "BYTE"
+}
+
+func isScalarBoolParam(p ast.ProcParam) bool {
+	return p.Type == "BOOL" && p.TypeRef.IsData()
+}
+
+// varRef returns the Go expression for a variable's storage, dereferencing
+// reference parameters.
+func (g *Generator) varRef(name string) string {
+	if g.refParams[name] {
+		return "*" + goIdent(name)
+	}
+	return goIdent(name)
+}
+
+// lvalue returns the Go expression for variable name selected by indices,
+// and the occam type of the record field it ends in ("" if it does not).
+// Reference parameters are dereferenced, leaving Go to dereference pointers
+// to records for their fields, and indices naming a field of a record
+// (p[x], or ps[i][x] in an array of records) become field selectors.
+func (g *Generator) lvalue(name string, indices []ast.Expression) (string, string) {
+	if len(indices) == 0 {
+		return g.varRef(name), ""
+	}
+	ref := goIdent(name)
+	rec := g.recordVars[name]
+	if g.refParams[name] && rec == "" {
+		ref = "(*" + ref + ")"
+	}
+	elem, dims := g.arrayVarShape(name)
+	fieldType := ""
+	for _, idx := range indices {
+		fieldType = ""
+		if f := g.recordField(rec, idx); f != nil {
+			ref += "." + goIdent(f.Name)
+			fieldType = f.Type
+			rec = ""
+			if _, ok := g.recordDefs[f.Type]; ok {
+				rec = f.Type
+			}
+			continue
+		}
+		ref = g.indexed(ref, []ast.Expression{idx})
+		rec = ""
+		if dims--; dims == 0 {
+			if _, ok := g.recordDefs[elem]; ok {
+				rec = elem
+			}
+		}
+	}
+	return ref, fieldType
+}
+
+// recordField returns the field of RECORD rec that idx names, or nil if idx
+// is not a field name of rec.
+func (g *Generator) recordField(rec string, idx ast.Expression) *ast.RecordField {
+	ident, ok := idx.(*ast.Identifier)
+	if rec == "" || !ok {
+		return nil
+	}
+	if def := g.recordDefs[rec]; def != nil {
+		for i := range def.Fields {
+			if def.Fields[i].Name == ident.Value {
+				return &def.Fields[i]
+			}
+		}
+	}
+	return nil
+}
+
+// indexPath splits v[i][j]... into the variable v and its indices, in
+// order; ok is false if the subscripted expression is not a variable.
+func indexPath(e *ast.IndexExpr) (name string, indices []ast.Expression, ok bool) {
+	var left ast.Expression = e
+	for {
+		switch l := left.(type) {
+		case *ast.IndexExpr:
+			indices = append([]ast.Expression{l.Index}, indices...)
+			left = l.Left
+		case *ast.Identifier:
+			return l.Value, indices, true
+		default:
+			return "", nil, false
+		}
+	}
+}
+
+// returnsBool reports whether name is a single-result BOOL FUNCTION.
+func (g *Generator) returnsBool(name string) bool {
+	results := g.funcResults[name]
+	return len(results) == 1 && results[0].FlatName() == "BOOL"
+}
+
+// recordFieldType returns the occam type of a field of record variable v.
+func (g *Generator) recordFieldType(v, field string) string {
+	if rec := g.recordDefs[g.recordVars[v]]; rec != nil {
+		for _, f := range rec.Fields {
+			if f.Name == field {
+				return f.Type
+			}
+		}
+	}
+	return ""
+}
+
+// generateBoolValue emits the BOOL expression expr for storing in a BOOL
+// variable, parameter, FUNCTION result, record field or channel. When BOOL
+// is mapped to an integer type, stored values are 0 or 1.
+func (g *Generator) generateBoolValue(expr ast.Expression) {
+	if !g.boolAsInt() {
+		g.generateExpression(expr)
+		return
+	}
+	// Values that are already stored BOOLs are copied as they are
+	if ident, ok := expr.(*ast.Identifier); ok && g.boolVars[ident.Value] {
+		g.write(g.varRef(ident.Value))
+		return
+	}
+	if call, ok := expr.(*ast.FuncCall); ok && g.returnsBool(call.Name) {
+		g.generateFuncCallExpr(call)
+		return
+	}
+	if ie, ok := expr.(*ast.IndexExpr); ok {
+		ident, isIdent := ie.Left.(*ast.Identifier)
+		field, isField := ie.Index.(*ast.Identifier)
+		if isIdent && isField && g.recordFieldType(ident.Value, field.Value) == "BOOL" {
+			g.write(goIdent(ident.Value) + "." + goIdent(field.Value))
+			return
+		}
+	}
+	if lit, ok := expr.(*ast.BooleanLiteral); ok {
+		if lit.Value {
+			g.write("1")
+		} else {
+			g.write("0")
+		}
+		return
+	}
+	g.write(g.goTypes["BOOL"] + "(" + g.prefix + "_boolToInt(")
+	g.generateExpression(expr)
+	g.write("))")
+}
+
+// rejectBoolArray reports a BOOL array as an error when BOOL is mapped to a
+// non-bool type, as its elements are not converted to and from Go bool and
+// the Go would not build.
+func (g *Generator) rejectBoolArray(line int) {
+	if g.boolAsInt() {
+		g.errors = append(g.errors, fmt.Sprintf("line %d: BOOL arrays are not supported with BOOL mapped to %s", line, g.goTypes["BOOL"]))
+	}
+}
+
+// collectAltTimeouts appends to out the deadline expressions of the ALT
+// timeout cases in stmts that are repeated by a loop (inLoop, or within a
+// WHILE or replicated SEQ in stmts). Each can reuse a single timer, except in
+// replicated PARs and ALTs, where several goroutines or cases share the same
+// AST node, and nested PROCs and FUNCTIONs, which are separate Go functions.
+func collectAltTimeouts(stmts []ast.Statement, inLoop bool, out []ast.Expression) []ast.Expression {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.SeqBlock:
+			out = collectAltTimeouts(s.Statements, inLoop || s.Replicator != nil, out)
+		case *ast.ParBlock:
+			if s.Replicator == nil {
+				out = collectAltTimeouts(s.Statements, inLoop, out)
+			}
+		case *ast.ClaimBlock:
+			out = collectAltTimeouts(s.Body, inLoop, out)
+		case *ast.ForkingBlock:
+			out = collectAltTimeouts(s.Body, inLoop, out)
+		case *ast.WhileLoop:
+			out = collectAltTimeouts(s.Body, true, out)
+		case *ast.IfStatement:
+			for _, choice := range s.Choices {
+				if choice.NestedIf != nil {
+					out = collectAltTimeouts([]ast.Statement{choice.NestedIf}, inLoop, out)
+				}
+				out = collectAltTimeouts(choice.Body, inLoop, out)
+			}
+		case *ast.CaseStatement:
+			for _, choice := range s.Choices {
+				out = collectAltTimeouts(choice.Body, inLoop, out)
+			}
+		case *ast.VariantReceive:
+			for _, c := range s.Cases {
+				out = collectAltTimeouts(c.Body, inLoop, out)
+			}
+		case *ast.AltBlock:
+			if s.Replicator != nil {
+				continue
+			}
+			for _, c := range s.Cases {
+				if c.IsTimer && inLoop {
+					out = append(out, c.Deadline)
+				}
+				out = collectAltTimeouts(c.Body, inLoop, out)
+			}
+		}
+	}
+	return out
+}
+
+// containsLoopedAltTimeout reports whether any loop within stmt, including
+// those in nested PROCs and replicated PARs, repeats an ALT timeout.
+func (g *Generator) containsLoopedAltTimeout(stmt ast.Statement) bool {
+	var children []ast.Statement
+	switch s := stmt.(type) {
+	case *ast.ClaimBlock:
+		children = s.Body
+	case *ast.ForkingBlock:
+		children = s.Body
+	case *ast.WhileLoop:
+		if len(collectAltTimeouts(s.Body, true, nil)) > 0 {
+			return true
+		}
+		children = s.Body
+	case *ast.SeqBlock:
+		if s.Replicator != nil && len(collectAltTimeouts(s.Statements, true, nil)) > 0 {
+			return true
+		}
+		children = s.Statements
+	case *ast.ParBlock:
+		children = s.Statements
+	case *ast.ProcDecl:
+		children = s.Body
+	case *ast.FuncDecl:
+		children = s.Body
+	case *ast.IfStatement:
+		for _, choice := range s.Choices {
+			if choice.NestedIf != nil {
+				children = append(children, choice.NestedIf)
+			}
+			children = append(children, choice.Body...)
+		}
+	case *ast.CaseStatement:
+		for _, choice := range s.Choices {
+			children = append(children, choice.Body...)
+		}
+	case *ast.VariantReceive:
+		for _, c := range s.Cases {
+			children = append(children, c.Body...)
+		}
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			children = append(children, c.Body...)
+		}
+	}
+	for _, inner := range children {
+		if g.containsLoopedAltTimeout(inner) {
+			return true
+		}
+	}
+	return false
+}
+
+// declareAltTimers declares, before a loop with body stmts, a timer for each
+// ALT timeout in it that does not have one from an enclosing loop.
+func (g *Generator) declareAltTimers(stmts []ast.Statement) {
+	if !g.pass("reuse-timers") {
+		return
+	}
+	for _, deadline := range collectAltTimeouts(stmts, true, nil) {
+		if _, ok := g.altTimers[deadline]; ok {
+			continue
+		}
+		name := fmt.Sprintf("_altTimer%d", g.tmpCounter)
+		g.tmpCounter++
+		g.altTimers[deadline] = name
+		g.writeLine(fmt.Sprintf("var %s *time.Timer", name))
+	}
+}
+
+// emitSliceEqualHelper writes the _sliceEqual helper function, which
+// stands in for slices.Equal before Go 1.21.
+func (g *Generator) emitSliceEqualHelper() {
+	g.writeLine("func " + g.prefix + "_sliceEqual[T comparable](a, b []T) bool {")
+	g.indent++
+	g.writeLine("if len(a) != len(b) {")
+	g.indent++
+	g.writeLine("return false")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("for i := range a {")
+	g.indent++
+	g.writeLine("if a[i] != b[i] {")
+	g.indent++
+	g.writeLine("return false")
+	g.indent--
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("return true")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// emitAltAfterHelper writes the _altAfter helper function.
+func (g *Generator) emitAltAfterHelper() {
+	g.writeLine("// " + g.prefix + "_altAfter returns the channel of *t, (re)started to fire at the occam")
+	g.writeLine("// time deadline, so that an ALT timeout in a loop reuses one timer")
+	g.writeLine("// instead of allocating one per iteration.")
+	g.writeLine("func " + g.prefix + "_altAfter(t **time.Timer, deadline " + g.intType() + ") <-chan time.Time {")
+	g.indent++
+	g.writeLine("d := time.Duration(deadline-" + g.intType() + "(time.Now().UnixMicro())) * time.Microsecond")
+	g.writeLine("if *t == nil {")
+	g.indent++
+	g.writeLine("*t = time.NewTimer(d)")
+	g.writeLine("return (*t).C")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("if !(*t).Stop() {")
+	g.indent++
+	g.writeLine("// Drain a fire that no ALT took")
+	g.writeLine("select {")
+	g.writeLine("case <-(*t).C:")
+	g.writeLine("default:")
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("(*t).Reset(d)")
+	g.writeLine("return (*t).C")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// emitBarrierHelper writes the _barrier helper type: a cyclic barrier whose
+// enrolled processes can change while it is in use.
+func (g *Generator) emitBarrierHelper() {
+	b := g.prefix + "_barrier"
+	g.writeLine("// " + b + " is an occam BARRIER: each SYNC waits until every enrolled")
+	g.writeLine("// process has reached a SYNC, then all of them carry on.")
+	g.writeLine("type " + b + " struct {")
+	g.indent++
+	g.writeLine("mu       sync.Mutex")
+	g.writeLine("enrolled int")
+	g.writeLine("waiting  int")
+	g.writeLine("release  chan struct{}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("// enroll adds n processes to b, or resigns -n of them.")
+	g.writeLine("func (b *" + b + ") enroll(n int) {")
+	g.indent++
+	g.writeLine("b.mu.Lock()")
+	g.writeLine("b.enrolled += n")
+	g.writeLine("b.check()")
+	g.writeLine("b.mu.Unlock()")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("// enrollPar enrolls the n branches of a PAR ENROLL in place of the")
+	g.writeLine("// process running the PAR.")
+	g.writeLine("func (b *" + b + ") enrollPar(n int) {")
+	g.indent++
+	g.writeLine("if n > 0 {")
+	g.indent++
+	g.writeLine("b.enroll(n - 1)")
+	g.indent--
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("// resignPar resigns a finished PAR ENROLL branch, of which *left are")
+	g.writeLine("// running: the last one hands its enrollment back to the process")
+	g.writeLine("// running the PAR.")
+	g.writeLine("func (b *" + b + ") resignPar(left *int) {")
+	g.indent++
+	g.writeLine("b.mu.Lock()")
+	g.writeLine("if *left--; *left > 0 {")
+	g.indent++
+	g.writeLine("b.enrolled--")
+	g.writeLine("b.check()")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("b.mu.Unlock()")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("// sync waits until every process enrolled on b is waiting.")
+	g.writeLine("func (b *" + b + ") sync() {")
+	g.indent++
+	g.writeLine("b.mu.Lock()")
+	g.writeLine("if b.release == nil {")
+	g.indent++
+	g.writeLine("b.release = make(chan struct{})")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("release := b.release")
+	g.writeLine("b.waiting++")
+	g.writeLine("done := b.check()")
+	g.writeLine("b.mu.Unlock()")
+	g.writeLine("if !done {")
+	g.indent++
+	g.writeLine("<-release")
+	g.indent--
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("// check releases the waiting processes if every enrolled one is")
+	g.writeLine("// waiting. b.mu must be held.")
+	g.writeLine("func (b *" + b + ") check() bool {")
+	g.indent++
+	g.writeLine("if b.waiting == 0 || b.waiting < b.enrolled {")
+	g.indent++
+	g.writeLine("return false")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("close(b.release)")
+	g.writeLine("b.release = nil")
+	g.writeLine("b.waiting = 0")
+	g.writeLine("return true")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// emitChanClaimHelper writes the _chanClaim helper function, which finds
+// the mutex that CLAIMs of one end of a SHARED channel hold.
+func (g *Generator) emitChanClaimHelper() {
+	g.writeLine("var " + g.prefix + "_chanClaims sync.Map")
+	g.writeLine("")
+	g.writeLine("// " + g.prefix + "_chanClaim returns the mutex held by CLAIMs of the end (\"!\" or \"?\")")
+	g.writeLine("// of the SHARED channel c, whichever direction c is typed with.")
+	g.writeLine("func " + g.prefix + "_chanClaim(c any, end string) *sync.Mutex {")
+	g.indent++
+	g.writeLine("key := struct {")
+	g.indent++
+	g.writeLine("c   uintptr")
+	g.writeLine("end string")
+	g.indent--
+	g.writeLine("}{reflect.ValueOf(c).Pointer(), end}")
+	g.writeLine("mu, _ := " + g.prefix + "_chanClaims.LoadOrStore(key, new(sync.Mutex))")
+	g.writeLine("return mu.(*sync.Mutex)")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// emitRendezvousHelpers writes the helpers of WithExtendedRendezvous. A
+// receive is in two phases: the message, then, from its sender, on the
+// channel's acknowledgement channel, a release channel of the sender's own,
+// which the receiver closes when it is done with the message. _sent,
+// called after each send, hands over the release and waits on it;
+// _received, called after an input, takes and closes it at once, and an
+// extended input takes it with _taken as soon as its message arrives and
+// closes it with _release when its extended process ends. Since a release
+// is taken before the receiver can input on the channel again, an extended
+// process receiving further messages on the same channel releases each
+// sender in turn, not whichever is waiting. Channels the harness reads or
+// writes itself are marked by _noAck as having no acknowledgement.
+func (g *Generator) emitRendezvousHelpers() {
+	p := g.prefix
+	g.writeLine("var " + p + "_acks sync.Map")
+	g.writeLine("")
+	g.writeLine("// " + p + "_ack returns the acknowledgement channel of the channel c, or nil")
+	g.writeLine("// if it has none, whichever direction c is typed with.")
+	g.writeLine("func " + p + "_ack(c any) chan chan struct{} {")
+	g.indent++
+	g.writeLine("key := reflect.ValueOf(c).Pointer()")
+	g.writeLine("if ack, ok := " + p + "_acks.Load(key); ok {")
+	g.indent++
+	g.writeLine("return ack.(chan chan struct{})")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("ack, _ := " + p + "_acks.LoadOrStore(key, make(chan chan struct{}))")
+	g.writeLine("return ack.(chan chan struct{})")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_noAck(c any) {")
+	g.writeLine("	" + p + "_acks.Store(reflect.ValueOf(c).Pointer(), (chan chan struct{})(nil))")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_sent(c any) {")
+	g.indent++
+	g.writeLine("if ack := " + p + "_ack(c); ack != nil {")
+	g.indent++
+	g.writeLine("release := make(chan struct{})")
+	g.writeLine("ack <- release")
+	g.writeLine("<-release")
+	g.indent--
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_taken(c any) chan struct{} {")
+	g.indent++
+	g.writeLine("if ack := " + p + "_ack(c); ack != nil {")
+	g.writeLine("	return <-ack")
+	g.writeLine("}")
+	g.writeLine("return nil")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_release(release chan struct{}) {")
+	g.indent++
+	g.writeLine("if release != nil {")
+	g.writeLine("	close(release)")
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_received(c any) {")
+	g.writeLine("	" + p + "_release(" + p + "_taken(c))")
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// sent writes, under WithExtendedRendezvous, the wait for the receiver of
+// the message just sent on ch to release the sender.
+func (g *Generator) sent(ch string) {
+	if g.rendezvous {
+		g.writeLine(g.prefix + "_sent(" + ch + ")")
+	}
+}
+
+// received writes, under WithExtendedRendezvous, the release of the sender
+// of the message last received on ch.
+func (g *Generator) received(ch string) {
+	if g.rendezvous {
+		g.writeLine(g.prefix + "_received(" + ch + ")")
+	}
+}
+
+// taken writes, under WithExtendedRendezvous, the first phase of the
+// release of an extended input's sender: taking, as soon as its message has
+// been received on ch, the channel that releases it, before the extended
+// process can receive other messages on ch. It returns the variable holding
+// it, for release, or "" without the rendezvous.
+func (g *Generator) taken(ch string) string {
+	if !g.rendezvous {
+		return ""
+	}
+	name := fmt.Sprintf("_ext%d", g.tmpCounter)
+	g.tmpCounter++
+	g.writeLine(fmt.Sprintf("%s := %s_taken(%s)", name, g.prefix, ch))
+	return name
+}
+
+// release writes the second phase of the release of an extended input's
+// sender, whose release taken put in name, once the extended process has
+// ended.
+func (g *Generator) release(name string) {
+	if name != "" {
+		g.writeLine(g.prefix + "_release(" + name + ")")
+	}
+}
+
+// emitTableIntsHelper writes the _tableInts helper function, which decodes
+// the tables WithTableData encodes.
+func (g *Generator) emitTableIntsHelper() {
+	g.writeLine("// " + g.prefix + "_tableInts decodes a table of n integers encoded as zigzag varints")
+	g.writeLine("func " + g.prefix + "_tableInts[T ~int | ~int16 | ~int32 | ~int64](data string, n int) []T {")
+	g.indent++
+	g.writeLine("t := make([]T, 0, n)")
+	g.writeLine("var v uint64")
+	g.writeLine("var shift uint")
+	g.writeLine("for i := 0; i < len(data); i++ {")
+	g.indent++
+	g.writeLine("v |= uint64(data[i]&0x7f) << shift")
+	g.writeLine("shift += 7")
+	g.writeLine("if data[i] < 0x80 {")
+	g.indent++
+	g.writeLine("t = append(t, T(int64(v>>1)^-int64(v&1)))")
+	g.writeLine("v, shift = 0, 0")
+	g.indent--
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("return t")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// emitPriSelectHelper writes the _priSelect helper function, which
+// replicated ALTs use in place of reflect.Select for PRI ALT and under
+// WithDeterministic.
+func (g *Generator) emitPriSelectHelper() {
+	g.writeLine("// " + g.prefix + "_priSelect is reflect.Select taking the first ready case, a default (SKIP) case when reached")
+	g.writeLine("func " + g.prefix + "_priSelect(cases []reflect.SelectCase) (int, reflect.Value) {")
+	g.indent++
+	g.writeLine("poll := []reflect.SelectCase{{}, {Dir: reflect.SelectDefault}}")
+	g.writeLine("for i, c := range cases {")
+	g.indent++
+	g.writeLine("if c.Dir == reflect.SelectDefault {")
+	g.indent++
+	g.writeLine("return i, reflect.Value{}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("poll[0] = c")
+	g.writeLine("if chosen, v, _ := reflect.Select(poll); chosen == 0 {")
+	g.indent++
+	g.writeLine("return i, v")
+	g.indent--
+	g.writeLine("}")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("chosen, v, _ := reflect.Select(cases)")
+	g.writeLine("return chosen, v")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// emitConversionHelpers writes the Go helper functions for the conversion
+// builtins in g.conversions. Strings are written into the caller's []BYTE
+// and their length returned through len, as the occam library does; a
+// buffer too small for the result panics with an index error.
+func (g *Generator) emitConversionHelpers() {
+	p := g.prefix
+	boolType := g.occamTypeToGo("BOOL")
+	setErr := []string{"\t*err = e != nil"}
+	if g.boolAsInt() {
+		setErr = []string{"\t*err = 0", "\tif e != nil { *err = 1 }"}
+	}
+	names := make([]string, 0, len(g.conversions))
+	for name := range g.conversions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	t := g.intType()
+	g.writeLine("// Number and string conversion helper functions")
+	for _, name := range names {
+		switch name {
+		case "INTTOSTRING":
+			g.writeLine("func " + p + "_INTTOSTRING(n *" + t + ", s []byte, x " + t + ") {")
+			if t == "int" {
+				g.writeLine("\tt := strconv.Itoa(x)")
+			} else {
+				g.writeLine("\tt := strconv.FormatInt(int64(x), 10)")
+			}
+			g.writeLine("\t*n = " + g.asInt("copy(s[:len(t)], t)"))
+			g.writeLine("}")
+		case "STRINGTOINT":
+			g.writeLine("func " + p + "_STRINGTOINT(err *" + boolType + ", n *" + t + ", s []byte) {")
+			if t == "int" {
+				g.writeLine("\tv, e := strconv.Atoi(string(s))")
+				g.writeLine("\t*n = v")
+			} else {
+				g.writeLine("\tv, e := strconv.ParseInt(string(s), 10, " + t[3:] + ")")
+				g.writeLine("\t*n = " + t + "(v)")
+			}
+			for _, line := range setErr {
+				g.writeLine(line)
+			}
+			g.writeLine("}")
+		case "REAL32TOSTRING", "REAL64TOSTRING":
+			bits := name[4:6]
+			g.writeLine("func " + p + "_" + name + "(n *" + t + ", s []byte, x " + g.occamTypeToGo("REAL"+bits) + ", ip, dp " + t + ") {")
+			if t == "int" {
+				g.writeLine("\tt := " + p + "_formatReal(float64(x), " + bits + ", ip, dp)")
+			} else {
+				g.writeLine("\tt := " + p + "_formatReal(float64(x), " + bits + ", int(ip), int(dp))")
+			}
+			g.writeLine("\t*n = " + g.asInt("copy(s[:len(t)], t)"))
+			g.writeLine("}")
+		case "STRINGTOREAL32", "STRINGTOREAL64":
+			bits := name[12:14]
+			goType := g.occamTypeToGo("REAL" + bits)
+			g.writeLine("func " + p + "_" + name + "(err *" + boolType + ", x *" + goType + ", s []byte) {")
+			g.writeLine("\tv, e := strconv.ParseFloat(string(s), " + bits + ")")
+			g.writeLine("\t*x = " + goType + "(v)")
+			for _, line := range setErr {
+				g.writeLine(line)
+			}
+			g.writeLine("}")
+		}
+		g.writeLine("")
+	}
+	if !g.conversions["REAL32TOSTRING"] && !g.conversions["REAL64TOSTRING"] {
+		return
+	}
+
+	// Ip = Dp = 0 is free format: the fewest digits that read back as x,
+	// with an exponent for very large or small numbers. Ip > 0 gives Ip
+	// characters (padded with spaces, counting any sign) before the point
+	// and Dp digits after it, with no point when Dp = 0; a number too wide
+	// for Ip gets an exponent instead. Ip = 0, Dp > 0 gives one digit before
+	// the point, Dp after and an exponent.
+	g.writeLine("func " + p + "_formatReal(x float64, bits, ip, dp int) string {")
+	g.writeLine("\tswitch {")
+	g.writeLine("\tcase math.IsNaN(x):")
+	g.writeLine("\t\treturn \"NaN\"")
+	g.writeLine("\tcase math.IsInf(x, 1):")
+	g.writeLine("\t\treturn \"Inf\"")
+	g.writeLine("\tcase math.IsInf(x, -1):")
+	g.writeLine("\t\treturn \"-Inf\"")
+	g.writeLine("\t}")
+	g.writeLine("\tif ip == 0 && dp == 0 {")
+	g.writeLine("\t\tdigits := 9")
+	g.writeLine("\t\tif bits == 64 { digits = 17 }")
+	g.writeLine("\t\tif a := math.Abs(x); a == 0 || (a >= 1e-4 && a < math.Pow10(digits)) {")
+	g.writeLine("\t\t\tt := strconv.FormatFloat(x, 'f', -1, bits)")
+	g.writeLine("\t\t\tfor i := 0; i < len(t); i++ {")
+	g.writeLine("\t\t\t\tif t[i] == '.' { return t }")
+	g.writeLine("\t\t\t}")
+	g.writeLine("\t\t\treturn t + \".0\"")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\treturn " + p + "_realExp(strconv.FormatFloat(x, 'E', -1, bits))")
+	g.writeLine("\t}")
+	g.writeLine("\tif ip == 0 {")
+	g.writeLine("\t\treturn " + p + "_realExp(strconv.FormatFloat(x, 'E', dp, bits))")
+	g.writeLine("\t}")
+	g.writeLine("\tt := strconv.FormatFloat(x, 'f', dp, bits)")
+	g.writeLine("\tw := len(t)")
+	g.writeLine("\tif dp > 0 { w -= dp + 1 }")
+	g.writeLine("\tif w > ip {")
+	g.writeLine("\t\tif dp == 0 { dp = -1 }")
+	g.writeLine("\t\treturn " + p + "_realExp(strconv.FormatFloat(x, 'E', dp, bits))")
+	g.writeLine("\t}")
+	g.writeLine("\tfor ; w < ip; w++ { t = \" \" + t }")
+	g.writeLine("\treturn t")
+	g.writeLine("}")
+	g.writeLine("")
+	// Go writes 1E+02; occam writes 1.0E+2
+	g.writeLine("func " + p + "_realExp(t string) string {")
+	g.writeLine("\ti := 0")
+	g.writeLine("\tpoint := false")
+	g.writeLine("\tfor ; t[i] != 'E'; i++ {")
+	g.writeLine("\t\tpoint = point || t[i] == '.'")
+	g.writeLine("\t}")
+	g.writeLine("\tmant, sign, exp := t[:i], t[i+1:i+2], t[i+2:]")
+	g.writeLine("\tif !point { mant += \".0\" }")
+	g.writeLine("\tfor len(exp) > 1 && exp[0] == '0' { exp = exp[1:] }")
+	g.writeLine("\treturn mant + \"E\" + sign + exp")
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// cycleNames returns the names in g.cycles in order.
+func (g *Generator) cycleNames() []string {
+	names := make([]string, 0, len(g.cycles))
+	for name := range g.cycles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// emitCycleHelpers writes the Go helper functions for the building-block
+// processes in g.cycles. Where the occam runs two inputs or two outputs in
+// PAR, a select takes them in whichever order they are ready, each channel
+// set to nil once used, so that no goroutines are started for them.
+func (g *Generator) emitCycleHelpers() {
+	p := g.prefix
+	in := "in <-chan " + g.intType()
+	out := "out chan<- " + g.intType()
+	g.writeLine("// Building-block process helper functions")
+	for _, name := range g.cycleNames() {
+		switch name {
+		case "id":
+			g.writeLine("func " + p + "_id(" + in + ", " + out + ") {")
+			g.writeLine("\tfor {")
+			g.writeLine("\t\tout <- <-in")
+			g.writeLine("\t}")
+		case "succ":
+			g.writeLine("func " + p + "_succ(" + in + ", " + out + ") {")
+			g.writeLine("\tfor {")
+			g.writeLine("\t\tout <- <-in + 1")
+			g.writeLine("\t}")
+		case "tail":
+			g.writeLine("func " + p + "_tail(" + in + ", " + out + ") {")
+			g.writeLine("\t<-in")
+			g.writeLine("\tfor {")
+			g.writeLine("\t\tout <- <-in")
+			g.writeLine("\t}")
+		case "prefix":
+			g.writeLine("func " + p + "_prefix(n " + g.intType() + ", " + in + ", " + out + ") {")
+			g.writeLine("\tout <- n")
+			g.writeLine("\tfor {")
+			g.writeLine("\t\tout <- <-in")
+			g.writeLine("\t}")
+		case "plus":
+			g.writeLine("func " + p + "_plus(in1, in2 <-chan " + g.intType() + ", " + out + ") {")
+			g.writeLine("\tfor {")
+			g.writeLine("\t\tvar a, b " + g.intType())
+			g.writeLine("\t\tc1, c2 := in1, in2")
+			g.writeLine("\t\tfor c1 != nil || c2 != nil {")
+			g.writeLine("\t\t\tselect {")
+			g.writeLine("\t\t\tcase a = <-c1:")
+			g.writeLine("\t\t\t\tc1 = nil")
+			g.writeLine("\t\t\tcase b = <-c2:")
+			g.writeLine("\t\t\t\tc2 = nil")
+			g.writeLine("\t\t\t}")
+			g.writeLine("\t\t}")
+			g.writeLine("\t\tout <- a + b")
+			g.writeLine("\t}")
+		case "delta":
+			g.writeLine("func " + p + "_delta(" + in + ", out1, out2 chan<- " + g.intType() + ") {")
+			g.writeLine("\tfor {")
+			g.writeLine("\t\tx := <-in")
+			g.writeLine("\t\tc1, c2 := out1, out2")
+			g.writeLine("\t\tfor c1 != nil || c2 != nil {")
+			g.writeLine("\t\t\tselect {")
+			g.writeLine("\t\t\tcase c1 <- x:")
+			g.writeLine("\t\t\t\tc1 = nil")
+			g.writeLine("\t\t\tcase c2 <- x:")
+			g.writeLine("\t\t\t\tc2 = nil")
+			g.writeLine("\t\t\t}")
+			g.writeLine("\t\t}")
+			g.writeLine("\t}")
+		case "consume":
+			g.writeLine("func " + p + "_consume(" + in + ") {")
+			g.writeLine("\tfor range in {")
+			g.writeLine("\t}")
+		}
+		g.writeLine("}")
+		g.writeLine("")
+	}
+}
+
+// emitCheckedArithHelpers writes the helpers for +, - and * under
+// WithCheckedArith, which STOP, naming the line, on overflow. They are
+// generic over Go's numeric types so that no operand types need working
+// out; T(1)/T(2) is 0 only for integer types, so REALs are computed
+// unchecked.
+func (g *Generator) emitCheckedArithHelpers() {
+	p := g.prefix
+	g.writeLine("func " + p + "_addChecked[T " + p + "_number](a, b T, line int) T {")
+	g.writeLine("\tr := a + b")
+	g.writeLine("\tif T(1)/T(2) == 0 && (b > 0 && r < a || b < 0 && r > a) {")
+	g.writeLine("\t\tfmt.Fprintf(os.Stderr, \"STOP: integer overflow in + at line %d\\n\", line)")
+	g.writeLine("\t\tselect {}")
+	g.writeLine("\t}")
+	g.writeLine("\treturn r")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_subChecked[T " + p + "_number](a, b T, line int) T {")
+	g.writeLine("\tr := a - b")
+	g.writeLine("\tif T(1)/T(2) == 0 && (b > 0 && r > a || b < 0 && r < a) {")
+	g.writeLine("\t\tfmt.Fprintf(os.Stderr, \"STOP: integer overflow in - at line %d\\n\", line)")
+	g.writeLine("\t\tselect {}")
+	g.writeLine("\t}")
+	g.writeLine("\treturn r")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_mulChecked[T " + p + "_number](a, b T, line int) T {")
+	g.writeLine("\tr := a * b")
+	g.writeLine("\t// r/a misses only -1 * the most negative value, which gives itself")
+	g.writeLine("\tif T(1)/T(2) == 0 && a != 0 && (r/a != b || a < 0 && a+1 == 0 && b < 0 && r == b) {")
+	g.writeLine("\t\tfmt.Fprintf(os.Stderr, \"STOP: integer overflow in * at line %d\\n\", line)")
+	g.writeLine("\t\tselect {}")
+	g.writeLine("\t}")
+	g.writeLine("\treturn r")
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// emitConvCheckHelper writes _intChecked, which converts a value to an
+// integer type and STOPs if it is out of the type's range. The comparison
+// is with the truncated value, so that REALs convert as with TRUNC.
+func (g *Generator) emitConvCheckHelper() {
+	g.writeLine("func " + g.prefix + "_intChecked[T, S " + g.prefix + "_number](v S, line int) T {")
+	g.writeLine("\tt := T(v)")
+	g.writeLine("\tif float64(t) != math.Trunc(float64(v)) {")
+	g.writeLine("\t\tfmt.Fprintf(os.Stderr, \"STOP: conversion out of range at line %d\\n\", line)")
+	g.writeLine("\t\tselect {}")
+	g.writeLine("\t}")
+	g.writeLine("\treturn t")
+	g.writeLine("}")
+	g.writeLine("")
 }
 
-// generateTypedArrayLiteral emits a typed Go slice literal with the given Go type.
-// For nested arrays (e.g. [][]int), inner array literals use bare {e1, e2} syntax
-// (Go composite literal elision).
-func (g *Generator) generateTypedArrayLiteral(al *ast.ArrayLiteral, goType string) {
-	g.write(goType + "{")
-	for i, elem := range al.Elements {
-		if i > 0 {
-			g.write(", ")
-		}
-		if innerArr, ok := elem.(*ast.ArrayLiteral); ok {
-			// Inner array: use bare composite literal {e1, e2, ...}
-			g.write("{")
-			for j, inner := range innerArr.Elements {
-				if j > 0 {
-					g.write(", ")
-				}
-				g.generateExpression(inner)
-			}
-			g.write("}")
-		} else {
-			g.generateExpression(elem)
-		}
-	}
-	g.write("}")
+// emitParRecoverHelper writes _parRecover, deferred by each PAR branch,
+// which reports a panic in the branch and exits, or panics again with the
+// report when the program was not run from its main.
+func (g *Generator) emitParRecoverHelper() {
+	p := g.prefix
+	g.writeLine("// " + p + "_parExit is set by main, for " + p + "_parRecover to exit.")
+	g.writeLine("var " + p + "_parExit bool")
+	g.writeLine("")
+	g.writeLine("// " + p + "_parRecover reports a panic in branch index (the value of variable")
+	g.writeLine("// repl in a replicated PAR) of the PAR at pos in proc, and exits, or")
+	g.writeLine("// panics again with the report when run from a host or as a package.")
+	g.writeLine("func " + p + "_parRecover(repl string, index int, pos, proc string) {")
+	g.writeLine("\tif r := recover(); r != nil {")
+	g.writeLine("\t\tif repl != \"\" {")
+	g.writeLine("\t\t\trepl += \" = \"")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\tmsg := fmt.Sprintf(\"panic in PAR branch %s%d at %s in %s: %v\", repl, index, pos, proc, r)")
+	g.writeLine("\t\tif !" + p + "_parExit {")
+	g.writeLine("\t\t\tpanic(msg)")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\tfmt.Fprintln(os.Stderr, msg)")
+	g.writeLine("\t\tos.Exit(2)")
+	g.writeLine("\t}")
+	g.writeLine("}")
+	g.writeLine("")
 }
 
-// generateRetypesDecl emits code for a RETYPES declaration.
-// VAL INT X RETYPES X : — reinterpret float32/64 bits as int(s)
-// When source and target share the same name (shadowing a parameter), the parameter
-// has been renamed in the signature (e.g. X → _rp_X) so we can use := with the
-// original name to create a new variable.
-func (g *Generator) generateRetypesDecl(r *ast.RetypesDecl) {
-	gName := goIdent(r.Name)
-	gSource := goIdent(r.Source)
-	// If the parameter was renamed for RETYPES shadowing, use the renamed source
-	if renamed, ok := g.retypesRenames[r.Source]; ok {
-		gSource = renamed
-	}
-	if r.IsArray {
-		// VAL [2]INT X RETYPES X : — split float64 into two int32 words
-		tmpVar := fmt.Sprintf("_retmp%d", g.tmpCounter)
-		g.tmpCounter++
-		g.writeLine(fmt.Sprintf("%s := math.Float64bits(float64(%s))", tmpVar, gSource))
-		g.writeLine(fmt.Sprintf("%s := []int{int(int32(uint32(%s))), int(int32(uint32(%s >> 32)))}", gName, tmpVar, tmpVar))
-	} else {
-		// VAL INT X RETYPES X : — reinterpret float32 as int
-		g.writeLine(fmt.Sprintf("%s := int(int32(math.Float32bits(float32(%s))))", gName, gSource))
-	}
+// emitPreemptOffHelper writes _preemptOff, which runs the program again with
+// GODEBUG=asyncpreemptoff=1 unless that is set: the Go runtime reads the
+// setting only as it starts, and rejects it in a //go:debug directive.
+func (g *Generator) emitPreemptOffHelper() {
+	p := g.prefix
+	g.writeLine("// " + p + "_preemptOff runs the program again, and exits with its status,")
+	g.writeLine("// unless it runs without asynchronous preemption.")
+	g.writeLine("func " + p + "_preemptOff() {")
+	g.writeLine("\tgodebug := os.Getenv(\"GODEBUG\")")
+	g.writeLine("\tif strings.Contains(\",\"+godebug+\",\", \",asyncpreemptoff=1,\") {")
+	g.writeLine("\t\treturn")
+	g.writeLine("\t}")
+	g.writeLine("\texe, err := os.Executable()")
+	g.writeLine("\tif err != nil {")
+	g.writeLine("\t\tfmt.Fprintln(os.Stderr, \"-deterministic:\", err)")
+	g.writeLine("\t\tos.Exit(1)")
+	g.writeLine("\t}")
+	g.writeLine("\tif godebug != \"\" {")
+	g.writeLine("\t\tgodebug += \",\"")
+	g.writeLine("\t}")
+	g.writeLine("\tcmd := exec.Command(exe, os.Args[1:]...)")
+	g.writeLine("\tcmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr")
+	g.writeLine("\tcmd.Env = append(os.Environ(), \"GODEBUG=\"+godebug+\"asyncpreemptoff=1\")")
+	g.writeLine("\tif err := cmd.Run(); err != nil {")
+	g.writeLine("\t\tif exit, ok := err.(*exec.ExitError); ok {")
+	g.writeLine("\t\t\tos.Exit(exit.ExitCode())")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\tfmt.Fprintln(os.Stderr, \"-deterministic:\", err)")
+	g.writeLine("\t\tos.Exit(1)")
+	g.writeLine("\t}")
+	g.writeLine("\tos.Exit(0)")
+	g.writeLine("}")
+	g.writeLine("")
 }
 
-// containsIntrinsics checks if a statement tree contains transputer intrinsic calls.
-func (g *Generator) containsIntrinsics(stmt ast.Statement) bool {
-	return g.walkStatements(stmt, func(e ast.Expression) bool {
-		if fc, ok := e.(*ast.FuncCall); ok {
-			return transpIntrinsics[fc.Name]
-		}
-		return false
-	})
+// parRecoverProc names the PROC, FUNCTION or main program being generated,
+// for _parRecover.
+func (g *Generator) parRecoverProc() string {
+	if len(g.funcFrames) == 0 {
+		return "main program"
+	}
+	return g.funcFrames[len(g.funcFrames)-1].desc
 }
 
-// containsBoolConversion checks if a statement tree contains a bool-to-numeric type conversion.
-func (g *Generator) containsBoolConversion(stmt ast.Statement) bool {
-	return g.walkStatements(stmt, func(e ast.Expression) bool {
-		tc, ok := e.(*ast.TypeConversion)
-		if !ok {
-			return false
-		}
-		// Only need the helper for bool→numeric (not numeric→bool)
-		return tc.TargetType != "BOOL" && g.isBoolExpression(tc.Expr)
-	})
+// emitBoundsHelpers writes _index, which returns a subscript after checking
+// it against the array's length, and _sliceEnd, which returns the end of a
+// [a FROM start FOR count] slice after checking it lies within the array.
+// Both STOP, naming the line, when out of range.
+func (g *Generator) emitBoundsHelpers() {
+	p := g.prefix
+	g.writeLine("func " + p + "_index[I " + p + "_number](i I, n, line int) I {")
+	g.writeLine("\tif i < 0 || int(i) >= n {")
+	g.writeLine("\t\tfmt.Fprintf(os.Stderr, \"STOP: subscript %d out of range for array of size %d at line %d\\n\", int(i), n, line)")
+	g.writeLine("\t\tselect {}")
+	g.writeLine("\t}")
+	g.writeLine("\treturn i")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_sliceEnd(start, count, n, line int) int {")
+	g.writeLine("\tif start < 0 || count < 0 || start+count > n {")
+	g.writeLine("\t\tfmt.Fprintf(os.Stderr, \"STOP: [FROM %d FOR %d] out of range for array of size %d at line %d\\n\", start, count, n, line)")
+	g.writeLine("\t\tselect {}")
+	g.writeLine("\t}")
+	g.writeLine("\treturn start + count")
+	g.writeLine("}")
+	g.writeLine("")
 }
 
-// isBoolExpression returns true if the expression is known to produce a bool value.
-func (g *Generator) isBoolExpression(expr ast.Expression) bool {
-	switch e := expr.(type) {
-	case *ast.BooleanLiteral:
-		return true
-	case *ast.Identifier:
-		return g.boolVars[e.Value]
-	case *ast.UnaryExpr:
-		return e.Operator == "NOT"
-	case *ast.BinaryExpr:
-		switch e.Operator {
-		case "=", "<>", "<", ">", "<=", ">=", "AND", "OR", "AFTER":
-			return true
+// emitRetypeHelpers writes _retype, which gives a RETYPES or RESHAPES
+// target, or a non-VAL one's source, the bytes of a value, and
+// _retypeCount, which sizes an open first dimension to fit them. Bytes are
+// little-endian as on the transputer, with INT a 32-bit word unless it is
+// int64. Record fields are unexported, so each RECORD gets a method giving
+// pointers to its fields for them to be set through.
+func (g *Generator) emitRetypeHelpers() {
+	p := g.prefix
+	fields := p + "_retypeFields"
+	var names []string
+	for name, rec := range g.recordDefs {
+		if !rec.ChanType {
+			names = append(names, name)
 		}
-	case *ast.TypeConversion:
-		return e.TargetType == "BOOL"
-	case *ast.ParenExpr:
-		return g.isBoolExpression(e.Expr)
 	}
-	return false
+	sort.Strings(names)
+	for _, name := range names {
+		var ptrs []string
+		for _, f := range g.recordDefs[name].Fields {
+			ptrs = append(ptrs, "&r."+goIdent(f.Name))
+		}
+		g.writeLine(fmt.Sprintf("func (r *%s) %s() []any { return []any{%s} }", goIdent(name), fields, strings.Join(ptrs, ", ")))
+		g.writeLine("")
+	}
+	g.writeLine("func " + p + "_retype(dst, src any, line int) {")
+	g.writeLine("\tv := reflect.ValueOf(dst)")
+	g.writeLine("\tif v.Kind() == reflect.Pointer {")
+	g.writeLine("\t\tv = v.Elem()")
+	g.writeLine("\t}")
+	g.writeLine("\tb := " + p + "_retypeBytes(nil, reflect.ValueOf(src))")
+	g.writeLine("\tif n := " + p + "_retypeSize(v); n != len(b) {")
+	g.writeLine("\t\tfmt.Fprintf(os.Stderr, \"STOP: RETYPES of %d bytes as %d bytes at line %d\\n\", len(b), n, line)")
+	g.writeLine("\t\tselect {}")
+	g.writeLine("\t}")
+	g.writeLine("\t" + p + "_retypeSet(v, b)")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_retypeCount[T any](src any, n, line int) int {")
+	g.writeLine("\tvar elem T")
+	g.writeLine("\tsize := n * " + p + "_retypeSize(reflect.ValueOf(elem))")
+	g.writeLine("\ttotal := " + p + "_retypeSize(reflect.ValueOf(src))")
+	g.writeLine("\tif size == 0 || total%size != 0 {")
+	g.writeLine("\t\tfmt.Fprintf(os.Stderr, \"STOP: RETYPES of %d bytes as elements of %d bytes at line %d\\n\", total, size, line)")
+	g.writeLine("\t\tselect {}")
+	g.writeLine("\t}")
+	g.writeLine("\treturn total / size")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_retypeSize(v reflect.Value) int {")
+	g.writeLine("\tswitch v.Kind() {")
+	g.writeLine("\tcase reflect.Bool, reflect.Int8, reflect.Uint8:")
+	g.writeLine("\t\treturn 1")
+	g.writeLine("\tcase reflect.Int16, reflect.Uint16:")
+	g.writeLine("\t\treturn 2")
+	g.writeLine("\tcase reflect.Int, reflect.Int32, reflect.Uint32, reflect.Float32:")
+	g.writeLine("\t\treturn 4")
+	g.writeLine("\tcase reflect.Int64, reflect.Uint64, reflect.Float64:")
+	g.writeLine("\t\treturn 8")
+	g.writeLine("\tcase reflect.Slice, reflect.Array:")
+	g.writeLine("\t\tn := 0")
+	g.writeLine("\t\tfor i := 0; i < v.Len(); i++ {")
+	g.writeLine("\t\t\tn += " + p + "_retypeSize(v.Index(i))")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\treturn n")
+	g.writeLine("\tcase reflect.Struct:")
+	g.writeLine("\t\tn := 0")
+	g.writeLine("\t\tfor i := 0; i < v.NumField(); i++ {")
+	g.writeLine("\t\t\tn += " + p + "_retypeSize(v.Field(i))")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\treturn n")
+	g.writeLine("\t}")
+	g.writeLine("\treturn 0")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_retypeBytes(b []byte, v reflect.Value) []byte {")
+	g.writeLine("\tvar u uint64")
+	g.writeLine("\tswitch v.Kind() {")
+	g.writeLine("\tcase reflect.Bool:")
+	g.writeLine("\t\tif v.Bool() {")
+	g.writeLine("\t\t\tu = 1")
+	g.writeLine("\t\t}")
+	g.writeLine("\tcase reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:")
+	g.writeLine("\t\tu = uint64(v.Int())")
+	g.writeLine("\tcase reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:")
+	g.writeLine("\t\tu = v.Uint()")
+	g.writeLine("\tcase reflect.Float32:")
+	g.writeLine("\t\tu = uint64(math.Float32bits(float32(v.Float())))")
+	g.writeLine("\tcase reflect.Float64:")
+	g.writeLine("\t\tu = math.Float64bits(v.Float())")
+	g.writeLine("\tcase reflect.Slice, reflect.Array:")
+	g.writeLine("\t\tfor i := 0; i < v.Len(); i++ {")
+	g.writeLine("\t\t\tb = " + p + "_retypeBytes(b, v.Index(i))")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\treturn b")
+	g.writeLine("\tcase reflect.Struct:")
+	g.writeLine("\t\tfor i := 0; i < v.NumField(); i++ {")
+	g.writeLine("\t\t\tb = " + p + "_retypeBytes(b, v.Field(i))")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\treturn b")
+	g.writeLine("\t}")
+	g.writeLine("\tfor i := 0; i < " + p + "_retypeSize(v); i++ {")
+	g.writeLine("\t\tb = append(b, byte(u>>(8*i)))")
+	g.writeLine("\t}")
+	g.writeLine("\treturn b")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + p + "_retypeSet(v reflect.Value, b []byte) []byte {")
+	g.writeLine("\tswitch v.Kind() {")
+	g.writeLine("\tcase reflect.Slice, reflect.Array:")
+	g.writeLine("\t\tfor i := 0; i < v.Len(); i++ {")
+	g.writeLine("\t\t\tb = " + p + "_retypeSet(v.Index(i), b)")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\treturn b")
+	g.writeLine("\tcase reflect.Struct:")
+	g.writeLine("\t\tfor _, f := range v.Addr().Interface().(interface{ " + fields + "() []any })." + fields + "() {")
+	g.writeLine("\t\t\tb = " + p + "_retypeSet(reflect.ValueOf(f).Elem(), b)")
+	g.writeLine("\t\t}")
+	g.writeLine("\t\treturn b")
+	g.writeLine("\t}")
+	g.writeLine("\tn := " + p + "_retypeSize(v)")
+	g.writeLine("\tvar u uint64")
+	g.writeLine("\tfor i := 0; i < n; i++ {")
+	g.writeLine("\t\tu |= uint64(b[i]) << (8 * i)")
+	g.writeLine("\t}")
+	g.writeLine("\tswitch v.Kind() {")
+	g.writeLine("\tcase reflect.Bool:")
+	g.writeLine("\t\tv.SetBool(u != 0)")
+	g.writeLine("\tcase reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:")
+	g.writeLine("\t\tshift := 64 - 8*n")
+	g.writeLine("\t\tv.SetInt(int64(u<<shift) >> shift)")
+	g.writeLine("\tcase reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:")
+	g.writeLine("\t\tv.SetUint(u)")
+	g.writeLine("\tcase reflect.Float32:")
+	g.writeLine("\t\tv.SetFloat(float64(math.Float32frombits(uint32(u))))")
+	g.writeLine("\tcase reflect.Float64:")
+	g.writeLine("\t\tv.SetFloat(math.Float64frombits(u))")
+	g.writeLine("\t}")
+	g.writeLine("\treturn b[n:]")
+	g.writeLine("}")
+	g.writeLine("")
 }
 
 // emitBoolHelper writes the _boolToInt helper function.
 func (g *Generator) emitBoolHelper() {
-	g.writeLine("func _boolToInt(b bool) int {")
+	g.writeLine("func " + g.prefix + "_boolToInt(b bool) int {")
 	g.indent++
 	g.writeLine("if b {")
 	g.indent++
@@ -3093,6 +9752,18 @@ func (g *Generator) containsRetypes(stmt ast.Statement) bool {
 				return true
 			}
 		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsRetypes(inner) {
+				return true
+			}
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			if g.containsRetypes(inner) {
+				return true
+			}
+		}
 	case *ast.WhileLoop:
 		for _, inner := range s.Body {
 			if g.containsRetypes(inner) {
@@ -3122,56 +9793,71 @@ func (g *Generator) containsRetypes(stmt ast.Statement) bool {
 	return false
 }
 
-func (g *Generator) containsAltReplicator(stmt ast.Statement) bool {
+// containsAltReplicator checks if a statement tree contains a replicated ALT,
+// or with pri a replicated PRI ALT.
+func (g *Generator) containsAltReplicator(stmt ast.Statement, pri bool) bool {
 	switch s := stmt.(type) {
 	case *ast.AltBlock:
-		if s.Replicator != nil {
+		if s.Replicator != nil && (s.Priority || !pri) {
 			return true
 		}
 		for _, c := range s.Cases {
 			for _, inner := range c.Body {
-				if g.containsAltReplicator(inner) {
+				// A nested ALT is chosen among with its parent's priority
+				if c.IsAlt && s.Priority && g.containsAltReplicator(inner, false) || g.containsAltReplicator(inner, pri) {
 					return true
 				}
 			}
 		}
 	case *ast.SeqBlock:
 		for _, inner := range s.Statements {
-			if g.containsAltReplicator(inner) {
+			if g.containsAltReplicator(inner, pri) {
 				return true
 			}
 		}
 	case *ast.ParBlock:
 		for _, inner := range s.Statements {
-			if g.containsAltReplicator(inner) {
+			if g.containsAltReplicator(inner, pri) {
 				return true
 			}
 		}
 	case *ast.ProcDecl:
 		for _, inner := range s.Body {
-			if g.containsAltReplicator(inner) {
+			if g.containsAltReplicator(inner, pri) {
 				return true
 			}
 		}
 	case *ast.FuncDecl:
 		for _, inner := range s.Body {
-			if g.containsAltReplicator(inner) {
+			if g.containsAltReplicator(inner, pri) {
+				return true
+			}
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.containsAltReplicator(inner, pri) {
+				return true
+			}
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			if g.containsAltReplicator(inner, pri) {
 				return true
 			}
 		}
 	case *ast.WhileLoop:
 		for _, inner := range s.Body {
-			if g.containsAltReplicator(inner) {
+			if g.containsAltReplicator(inner, pri) {
 				return true
 			}
 		}
 	case *ast.IfStatement:
 		for _, choice := range s.Choices {
-			if choice.NestedIf != nil && g.containsAltReplicator(choice.NestedIf) {
+			if choice.NestedIf != nil && g.containsAltReplicator(choice.NestedIf, pri) {
 				return true
 			}
 			for _, inner := range choice.Body {
-				if g.containsAltReplicator(inner) {
+				if g.containsAltReplicator(inner, pri) {
 					return true
 				}
 			}
@@ -3179,7 +9865,7 @@ func (g *Generator) containsAltReplicator(stmt ast.Statement) bool {
 	case *ast.CaseStatement:
 		for _, choice := range s.Choices {
 			for _, inner := range choice.Body {
-				if g.containsAltReplicator(inner) {
+				if g.containsAltReplicator(inner, pri) {
 					return true
 				}
 			}
@@ -3230,6 +9916,23 @@ func (g *Generator) walkStatements(stmt ast.Statement, fn func(ast.Expression) b
 				return true
 			}
 		}
+		for _, e := range s.ResultExprs {
+			if g.walkExpr(e, fn) {
+				return true
+			}
+		}
+	case *ast.ClaimBlock:
+		for _, inner := range s.Body {
+			if g.walkStatements(inner, fn) {
+				return true
+			}
+		}
+	case *ast.ForkingBlock:
+		for _, inner := range s.Body {
+			if g.walkStatements(inner, fn) {
+				return true
+			}
+		}
 	case *ast.WhileLoop:
 		if g.walkExpr(s.Condition, fn) {
 			return true
@@ -3284,8 +9987,13 @@ func (g *Generator) walkStatements(stmt ast.Statement, fn func(ast.Expression) b
 				return true
 			}
 		}
+	case *ast.ForkStmt:
+		return g.walkStatements(s.Call, fn)
 	case *ast.AltBlock:
 		for _, c := range s.Cases {
+			if g.walkExpr(c.Guard, fn) {
+				return true
+			}
 			for _, inner := range c.Body {
 				if g.walkStatements(inner, fn) {
 					return true
@@ -3294,6 +10002,11 @@ func (g *Generator) walkStatements(stmt ast.Statement, fn func(ast.Expression) b
 		}
 	case *ast.VariantReceive:
 		for _, c := range s.Cases {
+			for _, inner := range c.Declarations {
+				if g.walkStatements(inner, fn) {
+					return true
+				}
+			}
 			for _, inner := range c.Body {
 				if g.walkStatements(inner, fn) {
 					return true
@@ -3339,55 +10052,122 @@ func (g *Generator) walkExpr(expr ast.Expression, fn func(ast.Expression) bool)
 				return true
 			}
 		}
+	case *ast.ArrayConstructor:
+		r := e.Replicator
+		return g.walkExpr(r.Start, fn) || g.walkExpr(r.Count, fn) || g.walkExpr(r.Step, fn) || g.walkExpr(e.Value, fn)
+	case *ast.ValofExpr:
+		for _, inner := range e.Body {
+			if g.walkStatements(inner, fn) {
+				return true
+			}
+		}
+		return g.walkExpr(e.Result, fn)
 	}
 	return false
 }
 
 // emitIntrinsicHelpers writes the Go helper functions for transputer intrinsics.
-// These implement 32-bit transputer semantics using uint32/uint64 arithmetic.
+// These implement 32-bit transputer semantics using uint32/uint64 arithmetic,
+// or 64-bit words, with double words of 128 bits, when INT is int64.
 func (g *Generator) emitIntrinsicHelpers() {
+	t := g.intType()
 	g.writeLine("// Transputer intrinsic helper functions")
-	g.writeLine("func _LONGPROD(a, b, c int) (int, int) {")
+	if t == "int64" {
+		g.emitIntrinsicHelpers64()
+		return
+	}
+	g.writeLine("func " + g.prefix + "_LONGPROD(a, b, c " + t + ") (" + t + ", " + t + ") {")
 	g.writeLine("\tr := uint64(uint32(a))*uint64(uint32(b)) + uint64(uint32(c))")
-	g.writeLine("\treturn int(int32(uint32(r >> 32))), int(int32(uint32(r)))")
+	g.writeLine("\treturn " + t + "(int32(uint32(r >> 32))), " + t + "(int32(uint32(r)))")
 	g.writeLine("}")
 	g.writeLine("")
-	g.writeLine("func _LONGDIV(hi, lo, divisor int) (int, int) {")
+	g.writeLine("func " + g.prefix + "_LONGDIV(hi, lo, divisor " + t + ") (" + t + ", " + t + ") {")
 	g.writeLine("\tn := (uint64(uint32(hi)) << 32) | uint64(uint32(lo))")
 	g.writeLine("\td := uint64(uint32(divisor))")
 	g.writeLine("\tif d == 0 { panic(\"LONGDIV: division by zero\") }")
-	g.writeLine("\treturn int(int32(uint32(n / d))), int(int32(uint32(n % d)))")
+	g.writeLine("\treturn " + t + "(int32(uint32(n / d))), " + t + "(int32(uint32(n % d)))")
 	g.writeLine("}")
 	g.writeLine("")
-	g.writeLine("func _LONGSUM(a, b, carry int) (int, int) {")
+	g.writeLine("func " + g.prefix + "_LONGSUM(a, b, carry " + t + ") (" + t + ", " + t + ") {")
 	g.writeLine("\tr := uint64(uint32(a)) + uint64(uint32(b)) + uint64(uint32(carry))")
-	g.writeLine("\treturn int(int32(uint32(r >> 32))), int(int32(uint32(r)))")
+	g.writeLine("\treturn " + t + "(int32(uint32(r >> 32))), " + t + "(int32(uint32(r)))")
 	g.writeLine("}")
 	g.writeLine("")
-	g.writeLine("func _LONGDIFF(a, b, borrow int) (int, int) {")
+	g.writeLine("func " + g.prefix + "_LONGDIFF(a, b, borrow " + t + ") (" + t + ", " + t + ") {")
 	g.writeLine("\tr := uint64(uint32(a)) - uint64(uint32(b)) - uint64(uint32(borrow))")
-	g.writeLine("\tif uint32(a) >= uint32(b)+uint32(borrow) { return 0, int(int32(uint32(r))) }")
-	g.writeLine("\treturn 1, int(int32(uint32(r)))")
+	g.writeLine("\tif uint32(a) >= uint32(b)+uint32(borrow) { return 0, " + t + "(int32(uint32(r))) }")
+	g.writeLine("\treturn 1, " + t + "(int32(uint32(r)))")
 	g.writeLine("}")
 	g.writeLine("")
-	g.writeLine("func _NORMALISE(hi, lo int) (int, int, int) {")
+	g.writeLine("func " + g.prefix + "_NORMALISE(hi, lo " + t + ") (" + t + ", " + t + ", " + t + ") {")
 	g.writeLine("\tv := (uint64(uint32(hi)) << 32) | uint64(uint32(lo))")
 	g.writeLine("\tif v == 0 { return 64, 0, 0 }")
 	g.writeLine("\tn := bits.LeadingZeros64(v)")
 	g.writeLine("\tv <<= uint(n)")
-	g.writeLine("\treturn n, int(int32(uint32(v >> 32))), int(int32(uint32(v)))")
+	g.writeLine("\treturn " + g.asInt("n") + ", " + t + "(int32(uint32(v >> 32))), " + t + "(int32(uint32(v)))")
 	g.writeLine("}")
 	g.writeLine("")
-	g.writeLine("func _SHIFTRIGHT(hi, lo, n int) (int, int) {")
+	g.writeLine("func " + g.prefix + "_SHIFTRIGHT(hi, lo, n " + t + ") (" + t + ", " + t + ") {")
 	g.writeLine("\tv := (uint64(uint32(hi)) << 32) | uint64(uint32(lo))")
 	g.writeLine("\tv >>= uint(uint32(n))")
-	g.writeLine("\treturn int(int32(uint32(v >> 32))), int(int32(uint32(v)))")
+	g.writeLine("\treturn " + t + "(int32(uint32(v >> 32))), " + t + "(int32(uint32(v)))")
 	g.writeLine("}")
 	g.writeLine("")
-	g.writeLine("func _SHIFTLEFT(hi, lo, n int) (int, int) {")
+	g.writeLine("func " + g.prefix + "_SHIFTLEFT(hi, lo, n " + t + ") (" + t + ", " + t + ") {")
 	g.writeLine("\tv := (uint64(uint32(hi)) << 32) | uint64(uint32(lo))")
 	g.writeLine("\tv <<= uint(uint32(n))")
-	g.writeLine("\treturn int(int32(uint32(v >> 32))), int(int32(uint32(v)))")
+	g.writeLine("\treturn " + t + "(int32(uint32(v >> 32))), " + t + "(int32(uint32(v)))")
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// emitIntrinsicHelpers64 writes the intrinsic helpers for 64-bit words,
+// using math/bits for the 128-bit double word arithmetic.
+func (g *Generator) emitIntrinsicHelpers64() {
+	g.writeLine("func " + g.prefix + "_LONGPROD(a, b, c int64) (int64, int64) {")
+	g.writeLine("\thi, lo := bits.Mul64(uint64(a), uint64(b))")
+	g.writeLine("\tlo, carry := bits.Add64(lo, uint64(c), 0)")
+	g.writeLine("\treturn int64(hi + carry), int64(lo)")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + g.prefix + "_LONGDIV(hi, lo, divisor int64) (int64, int64) {")
+	g.writeLine("\tif divisor == 0 { panic(\"LONGDIV: division by zero\") }")
+	g.writeLine("\tq, r := bits.Div64(uint64(hi), uint64(lo), uint64(divisor))")
+	g.writeLine("\treturn int64(q), int64(r)")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + g.prefix + "_LONGSUM(a, b, carry int64) (int64, int64) {")
+	g.writeLine("\tr, c := bits.Add64(uint64(a), uint64(b), uint64(carry)&1)")
+	g.writeLine("\treturn int64(c), int64(r)")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + g.prefix + "_LONGDIFF(a, b, borrow int64) (int64, int64) {")
+	g.writeLine("\tr, c := bits.Sub64(uint64(a), uint64(b), uint64(borrow)&1)")
+	g.writeLine("\treturn int64(c), int64(r)")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + g.prefix + "_NORMALISE(hi, lo int64) (int64, int64, int64) {")
+	g.writeLine("\tif hi == 0 && lo == 0 { return 128, 0, 0 }")
+	g.writeLine("\tn := bits.LeadingZeros64(uint64(hi))")
+	g.writeLine("\tif hi == 0 { n = 64 + bits.LeadingZeros64(uint64(lo)) }")
+	g.writeLine("\th, l := " + g.prefix + "_shl128(uint64(hi), uint64(lo), uint(n))")
+	g.writeLine("\treturn int64(n), int64(h), int64(l)")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + g.prefix + "_SHIFTRIGHT(hi, lo, n int64) (int64, int64) {")
+	g.writeLine("\th, l, s := uint64(hi), uint64(lo), uint(uint64(n))")
+	g.writeLine("\tif s >= 64 { return 0, int64(h >> (s - 64)) }")
+	g.writeLine("\treturn int64(h >> s), int64(l>>s | h<<(64-s))")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + g.prefix + "_SHIFTLEFT(hi, lo, n int64) (int64, int64) {")
+	g.writeLine("\th, l := " + g.prefix + "_shl128(uint64(hi), uint64(lo), uint(uint64(n)))")
+	g.writeLine("\treturn int64(h), int64(l)")
+	g.writeLine("}")
+	g.writeLine("")
+	g.writeLine("func " + g.prefix + "_shl128(h, l uint64, s uint) (uint64, uint64) {")
+	g.writeLine("\tif s >= 64 { return l << (s - 64), 0 }")
+	g.writeLine("\treturn h<<s | l>>(64-s), l << s")
 	g.writeLine("}")
 	g.writeLine("")
 }
@@ -3395,7 +10175,8 @@ func (g *Generator) emitIntrinsicHelpers() {
 // declaredNames returns the variable names introduced by a declaration statement.
 // For non-replicated SEQ blocks (which are transparent in Go — no { } scope),
 // it recursively collects names from child statements so that the parent scope
-// can detect cross-block redeclarations.
+// can detect cross-block redeclarations, leaving out those of child SEQs that
+// get blocks of their own (see scopedSeq).
 func declaredNames(stmt ast.Statement) []string {
 	switch s := stmt.(type) {
 	case *ast.VarDecl:
@@ -3406,15 +10187,22 @@ func declaredNames(stmt ast.Statement) []string {
 		return s.Names
 	case *ast.TimerDecl:
 		return s.Names
+	case *ast.BarrierDecl:
+		return s.Names
 	case *ast.Abbreviation:
 		return []string{s.Name}
 	case *ast.RetypesDecl:
 		return []string{s.Name}
+	case *ast.ParBlock:
+		// Both PAR forms declare their WaitGroup in the enclosing scope
+		return []string{"wg"}
 	case *ast.SeqBlock:
 		if s.Replicator == nil {
 			var names []string
-			for _, child := range s.Statements {
-				names = append(names, declaredNames(child)...)
+			for i, child := range s.Statements {
+				if !scopedSeq(s.Statements, i) {
+					names = append(names, declaredNames(child)...)
+				}
 			}
 			return names
 		}
@@ -3424,15 +10212,138 @@ func declaredNames(stmt ast.Statement) []string {
 	}
 }
 
+// scopedSeq reports whether stmts[i] is a SEQ that is generated in a Go
+// block of its own: one with declarations that is followed by other
+// statements, which must not see them. A final SEQ stays transparent, as
+// nothing after it could.
+func scopedSeq(stmts []ast.Statement, i int) bool {
+	seq, ok := stmts[i].(*ast.SeqBlock)
+	return ok && seq.Replicator == nil && i < len(stmts)-1 && len(declaredNames(seq)) > 0
+}
+
+func isRoutineDecl(stmt ast.Statement) bool {
+	switch stmt.(type) {
+	case *ast.ProcDecl, *ast.FuncDecl:
+		return true
+	}
+	return false
+}
+
+// declareForwardRoutines declares, as Go function variables, the nested
+// PROCs and FUNCTIONs of the run of declarations starting stmts that are
+// called before their closures are defined: from their own bodies or from
+// those of earlier declarations in the run. Such a run may be mutually
+// recursive (see sema), but a Go closure is not in scope in its own
+// definition. The closures are then assigned rather than declared.
+func (g *Generator) declareForwardRoutines(stmts []ast.Statement) {
+	end := 0
+	for end < len(stmts) && isRoutineDecl(stmts[end]) {
+		end++
+	}
+	for i, stmt := range stmts[:end] {
+		var name string
+		switch d := stmt.(type) {
+		case *ast.ProcDecl:
+			name = d.Name
+		case *ast.FuncDecl:
+			name = d.Name
+		}
+		for _, caller := range stmts[:i+1] {
+			if g.callsRoutine(caller, name) {
+				if g.forwardRoutines == nil {
+					g.forwardRoutines = make(map[ast.Statement]bool)
+				}
+				g.forwardRoutines[stmt] = true
+				g.writeLine(fmt.Sprintf("var %s %s", goIdent(name), g.routineType(stmt)))
+				break
+			}
+		}
+	}
+}
+
+// closureDefine returns the operator defining the closure of a nested PROC
+// or FUNCTION: "=" if declareForwardRoutines has declared it, else ":=".
+func (g *Generator) closureDefine(decl ast.Statement) string {
+	if g.forwardRoutines[decl] {
+		return "="
+	}
+	return ":="
+}
+
+// callsRoutine reports whether the PROC or FUNCTION declaration decl calls
+// the PROC or FUNCTION name.
+func (g *Generator) callsRoutine(decl ast.Statement, name string) bool {
+	if g.containsProcCall(decl, func(n string) bool { return n == name }) {
+		return true
+	}
+	isCall := func(e ast.Expression) bool {
+		fc, ok := e.(*ast.FuncCall)
+		return ok && fc.Name == name
+	}
+	if g.walkStatements(decl, isCall) {
+		return true
+	}
+	if fn, ok := decl.(*ast.FuncDecl); ok {
+		for _, r := range fn.ResultExprs {
+			if g.walkExpr(r, isCall) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// routineType returns the Go function type of a PROC or FUNCTION
+// declaration.
+func (g *Generator) routineType(decl ast.Statement) string {
+	var params []ast.ProcParam
+	var results []string
+	switch d := decl.(type) {
+	case *ast.ProcDecl:
+		params = d.Params
+	case *ast.FuncDecl:
+		params = d.Params
+		for _, r := range d.Results {
+			results = append(results, g.goType(r, ""))
+		}
+	}
+	types := make([]string, len(params))
+	for i := range params {
+		types[i] = g.paramGoType(params, i)
+	}
+	sig := "func(" + strings.Join(types, ", ") + ")"
+	switch len(results) {
+	case 0:
+	case 1:
+		sig += " " + results[0]
+	default:
+		sig += " (" + strings.Join(results, ", ") + ")"
+	}
+	return sig
+}
+
 // generateStatementsWithScoping emits statements, opening new Go { } scope
 // blocks when a variable name is redeclared. This mirrors occam's scoping
 // where each declaration starts a new scope that extends to the end of its
-// enclosing block.
+// enclosing block. A SEQ with declarations followed by other statements
+// gets a block of its own, so that its names end with it rather than
+// hiding those of the enclosing scope from the statements after it.
 func (g *Generator) generateStatementsWithScoping(stmts []ast.Statement) {
 	declared := make(map[string]bool)
 	bracesOpened := 0
 
-	for _, stmt := range stmts {
+	for i, stmt := range stmts {
+		if g.nestingLevel > 0 && isRoutineDecl(stmt) && (i == 0 || !isRoutineDecl(stmts[i-1])) {
+			g.declareForwardRoutines(stmts[i:])
+		}
+		if scopedSeq(stmts, i) {
+			g.writeLine("{")
+			g.indent++
+			g.generateStatement(stmt)
+			g.indent--
+			g.writeLine("}")
+			continue
+		}
 		names := declaredNames(stmt)
 		needScope := false
 		for _, n := range names {
@@ -3459,3 +10370,115 @@ func (g *Generator) generateStatementsWithScoping(stmts []ast.Statement) {
 		bracesOpened--
 	}
 }
+
+// GenerateTests returns a Go test file for the program produced by Generate,
+// which must have been called first. Each top-level FUNCTION with "--#ASSERT"
+// examples gets a test checking them; a FUNCTION with scalar parameters and
+// results but no examples gets a skipped test skeleton calling it.
+func (g *Generator) GenerateTests(program *ast.Program) string {
+	var funcs []*ast.FuncDecl
+	needMath := false
+	for _, stmt := range program.Statements {
+		fn, ok := stmt.(*ast.FuncDecl)
+		if !ok || (len(fn.Asserts) == 0 && !isScalarFunc(fn)) {
+			continue
+		}
+		funcs = append(funcs, fn)
+		for _, a := range fn.Asserts {
+			if g.exprNeedsMath(a.Expr) {
+				needMath = true
+			}
+		}
+	}
+
+	g.builder.Reset()
+	g.indent = 0
+	g.writeLine("package " + g.packageName())
+	g.writeLine("")
+	g.writeLine("import (")
+	g.indent++
+	if needMath {
+		g.writeLine(`"math"`)
+	}
+	g.writeLine(`"testing"`)
+	g.indent--
+	g.writeLine(")")
+
+	for _, fn := range funcs {
+		g.writeLine("")
+		g.writeLine(fmt.Sprintf("func Test_%s(t *testing.T) {", goIdent(fn.Name)))
+		g.indent++
+		if len(fn.Asserts) == 0 {
+			g.generateTestSkeleton(fn)
+		}
+		for _, a := range fn.Asserts {
+			g.generateAssertCheck(fn, a)
+		}
+		g.indent--
+		g.writeLine("}")
+	}
+	return g.builder.String()
+}
+
+// isScalarFunc reports whether every parameter and result of fn is a plain
+// scalar, so that the FUNCTION can be called with zero values.
+func isScalarFunc(fn *ast.FuncDecl) bool {
+	for _, p := range fn.Params {
+		if p.TypeRef.Kind != ast.ScalarType || !isScalarType(p.TypeRef.Name) {
+			return false
+		}
+	}
+	for _, rt := range fn.Results {
+		if rt.Kind != ast.ScalarType || !isScalarType(rt.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+func isScalarType(t string) bool {
+	return isOccamIntType(t) || t == "BOOL" || t == "REAL" || t == "REAL32" || t == "REAL64"
+}
+
+// generateTestSkeleton emits a skipped call of fn with zero-valued arguments,
+// as a starting point for writing examples.
+func (g *Generator) generateTestSkeleton(fn *ast.FuncDecl) {
+	g.writeLine(fmt.Sprintf("t.Skip(%q)", "no --#ASSERT examples for FUNCTION "+fn.Name))
+	args := make([]string, len(fn.Params))
+	for i, p := range fn.Params {
+		args[i] = "0"
+		if p.Type == "BOOL" {
+			args[i] = "false"
+		}
+	}
+	blanks := strings.TrimSuffix(strings.Repeat("_, ", len(fn.Results)), ", ")
+	g.writeLine(fmt.Sprintf("%s = %s(%s)", blanks, g.procIdent(fn.Name), strings.Join(args, ", ")))
+}
+
+// generateAssertCheck emits the check for one "--#ASSERT" example. An example
+// of the form "f(args) = want" for a single-result f reports the value got.
+func (g *Generator) generateAssertCheck(fn *ast.FuncDecl, a *ast.Assert) {
+	if bin, ok := a.Expr.(*ast.BinaryExpr); ok && bin.Operator == "=" && len(fn.Results) == 1 {
+		if call, ok := bin.Left.(*ast.FuncCall); ok && call.Name == fn.Name {
+			g.builder.WriteString(strings.Repeat("\t", g.indent))
+			g.write("if got, want := ")
+			g.generateExpression(call)
+			g.write(", " + g.goType(fn.Results[0], "") + "(")
+			g.generateExpression(bin.Right)
+			g.write("); got != want {\n")
+			g.indent++
+			g.writeLine(fmt.Sprintf("t.Errorf(%q, got, want)", a.Text+": got %v, want %v"))
+			g.indent--
+			g.writeLine("}")
+			return
+		}
+	}
+	g.builder.WriteString(strings.Repeat("\t", g.indent))
+	g.write("if !(")
+	g.generateExpression(a.Expr)
+	g.write(") {\n")
+	g.indent++
+	g.writeLine(fmt.Sprintf("t.Error(%q)", "ASSERT "+a.Text+" failed"))
+	g.indent--
+	g.writeLine("}")
+}
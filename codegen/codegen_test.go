@@ -1,6 +1,8 @@
 package codegen
 
 import (
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -261,6 +263,16 @@ func TestStringEscapeCodegen(t *testing.T) {
 	}
 }
 
+func TestStringHexEscapeCodegen(t *testing.T) {
+	input := `VAL []BYTE msg IS "cmd*#00*#05*#FF":
+`
+	output := transpile(t, input)
+
+	if !strings.Contains(output, `[]byte("cmd\x00\x05\xff")`) {
+		t.Errorf("expected the bytes of msg as \\x escapes, got:\n%s", output)
+	}
+}
+
 func TestByteLiteral(t *testing.T) {
 	input := "x := 'A'\n"
 	output := transpile(t, input)
@@ -294,6 +306,38 @@ func TestStop(t *testing.T) {
 	}
 }
 
+func TestStopInFunction(t *testing.T) {
+	input := `INT FUNCTION safe.div(VAL INT a, VAL INT b)
+  INT r:
+  VALOF
+    IF
+      b = 0
+        STOP
+      TRUE
+        r := a / b
+    RESULT r
+:
+INT FUNCTION never(VAL INT a)
+  VALOF
+    CAUSEERROR()
+    RESULT a
+:
+`
+	output := transpile(t, input)
+	if !strings.Contains(output, `panic("STOP at line 6 in FUNCTION safe.div")`) {
+		t.Errorf("expected STOP to panic naming the FUNCTION, got:\n%s", output)
+	}
+	if strings.Contains(output, "select {}") || strings.Contains(output, `"os"`) {
+		t.Errorf("expected no deadlocking STOP in a FUNCTION, got:\n%s", output)
+	}
+	if !strings.Contains(output, "return r") {
+		t.Errorf("expected safe.div to return r, got:\n%s", output)
+	}
+	if strings.Contains(output, "return a") {
+		t.Errorf("expected no unreachable return after CAUSEERROR, got:\n%s", output)
+	}
+}
+
 func TestTypeConversion(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -318,6 +362,140 @@ func TestTypeConversion(t *testing.T) {
 	}
 }
 
+func TestTempNamesScopedPerProc(t *testing.T) {
+	// Temp numbering restarts in each PROC, so adding a receive to the
+	// first PROC leaves the second PROC's output unchanged.
+	second := `PROC second(CHAN OF PAIR c)
+  INT a, b:
+  c ? a ; b
+:
+`
+	header := `PROTOCOL PAIR IS INT ; INT
+`
+	before := transpile(t, header+`PROC first(CHAN OF PAIR c)
+  SKIP
+:
+`+second)
+	after := transpile(t, header+`PROC first(CHAN OF PAIR c)
+  INT x, y:
+  SEQ
+    c ? x ; y
+    c ? x ; y
+:
+`+second)
+
+	tail := func(code string) string {
+		i := strings.Index(code, "func second(")
+		if i < 0 {
+			t.Fatalf("expected func second in output, got:\n%s", code)
+		}
+		return code[i:]
+	}
+	if tail(before) != tail(after) {
+		t.Errorf("second PROC output changed:\nbefore:\n%s\nafter:\n%s", tail(before), tail(after))
+	}
+	if !strings.Contains(tail(after), "_tmp0 := <-c") {
+		t.Errorf("expected _tmp0 in second PROC, got:\n%s", tail(after))
+	}
+}
+
+func TestSeqDeclarationBlocks(t *testing.T) {
+	input := `PROC p()
+  INT x:
+  SEQ
+    SEQ
+      INT x:
+      x := 1
+    x := 2
+    SEQ
+      INT y:
+      y := x
+:
+`
+	output := transpile(t, input)
+	// The inner SEQ with a declaration followed by more statements gets
+	// its own block; the last one stays transparent
+	expected := "var x int\n\t_ = x\n\t{\n\t\tvar x int\n\t\t_ = x\n\t\tx = 1\n\t}\n\tx = 2\n\tvar y int\n\t_ = y\n\ty = x\n}"
+	if !strings.Contains(output, expected) {
+		t.Errorf("expected %q in output, got:\n%s", expected, output)
+	}
+}
+
+func TestConstantByteConversion(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		// Character arithmetic is folded at transpile time
+		{"x := BYTE (INT 'a' + 1)\n", "x = byte(98)"},
+		{"x := INT 'A'\n", "x = int(65)"},
+		{"x := BYTE 255\n", "x = byte(255)"},
+		// Non-constant conversions are left to Go
+		{"x := BYTE (n + 1)\n", "x = byte((n + 1))"},
+	}
+
+	for _, tt := range tests {
+		output := transpile(t, tt.input)
+		if !strings.Contains(output, tt.expected) {
+			t.Errorf("for input %q: expected %q in output, got:\n%s", tt.input, tt.expected, output)
+		}
+	}
+
+	// -O0 leaves the conversion as written
+	if output, _ := transpileWithOptions(t, "x := BYTE (INT 'a' + 1)\n", WithOptLevel(0)); !strings.Contains(output, "x = byte((int(byte(97)) + 1))") {
+		t.Errorf("expected an unfolded conversion at -O0, got:\n%s", output)
+	}
+}
+
+func TestConstantConversionRange(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x := BYTE 256\n", "line 1: constant 256 is out of range for BYTE"},
+		{"x := BYTE (-1)\n", "line 1: constant -1 is out of range for BYTE"},
+		{"x := BYTE (1000 + 65)\n", "line 1: constant 1065 is out of range for BYTE"},
+		{"x := INT16 40000\n", "line 1: constant 40000 is out of range for INT16"},
+		{"x := INT32 (-3000000000)\n", "line 1: constant -3000000000 is out of range for INT32"},
+		{"x := INT16 40000.5\n", "line 1: constant 40000.5 is out of range for INT16"},
+		{"x := BYTE (BYTE 256)\n", "line 1: constant 256 is out of range for BYTE"},
+	}
+
+	for _, tt := range tests {
+		for _, strict := range []bool{false, true} {
+			gen := New(WithStrict(strict))
+			gen.Generate(parser.New(lexer.New(tt.input)).ParseProgram())
+			if errs := gen.Errors(); len(errs) != 1 || errs[0] != tt.expected {
+				t.Errorf("for input %q (strict %v): expected error %q, got %v", tt.input, strict, tt.expected, errs)
+			}
+		}
+	}
+}
+
+func TestRealLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		// Undecorated literals take their type from the context in Go
+		{"x := 2.5\n", "x = 2.5"},
+		{"x := 1.0E-6\n", "x = 1.0E-6"},
+		{"x := 3.14159(REAL32)\n", "x = float32(3.14159)"},
+		{"x := y * 2.0(REAL64)\n", "x = (y * float64(2.0))"},
+		// Constant truncations are folded, as Go rejects them
+		{"x := INT TRUNC 2.7\n", "x = int(2)"},
+		{"x := INT (-2.7)\n", "x = int(-2)"},
+		{"x := INT ROUND 2.5\n", "x = int(math.Round(float64(2.5)))"},
+	}
+
+	for _, tt := range tests {
+		output := transpile(t, tt.input)
+		if !strings.Contains(output, tt.expected) {
+			t.Errorf("for input %q: expected %q in output, got:\n%s", tt.input, tt.expected, output)
+		}
+	}
+}
+
 func TestBoolTypeConversion(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -475,6 +653,190 @@ func TestCheckedArithmeticCodegen(t *testing.T) {
 	}
 }
 
+func TestCheckedArithOption(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x := a + b\n", "x = _addChecked(a, b, 1)"},
+		{"x := a - (b * 2)\n", "x = _subChecked(a, _mulChecked(b, 2, 1), 1)"},
+		{"x := a PLUS b\n", "x = (a + b)"},
+		{"x := a TIMES b\n", "x = (a * b)"},
+		// Constant operations are left to Go, which rejects overflows
+		{"x := 2 * 3\n", "x = (2 * 3)"},
+		{"x := a / b\n", "x = (a / b)"},
+	}
+
+	for _, tt := range tests {
+		output, _ := transpileWithOptions(t, tt.input, WithCheckedArith(true))
+		if !strings.Contains(output, tt.expected) {
+			t.Errorf("expected %q in output for %q, got:\n%s", tt.expected, tt.input, output)
+		}
+	}
+
+	output, _ := transpileWithOptions(t, "x := a PLUS b\n", WithCheckedArith(true))
+	if strings.Contains(output, "_addChecked") {
+		t.Errorf("expected no checked helpers without checked operators, got:\n%s", output)
+	}
+	if output := transpile(t, "x := a + b\n"); !strings.Contains(output, "x = (a + b)") || strings.Contains(output, "_addChecked") {
+		t.Errorf("expected unchecked + by default, got:\n%s", output)
+	}
+}
+
+func TestBoundsCheckOption(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x := a[i]\n", "x = a[_index(i, len(a), 1)]"},
+		{"a[i + 1] := x\n", "a[_index((i + 1), len(a), 1)] = x"},
+		{"x := g[1][i]\n", "x = g[_index(1, len(g), 1)][_index(i, len(g[_index(1, len(g), 1)]), 1)]"},
+		{"c[i] ! x\n", "c[_index(i, len(c), 1)] <- x"},
+		{"c ? a[i]\n", "a[_index(i, len(a), 1)] = <-c"},
+		{"x := SIZE [a FROM i FOR n]\n", "x = len(a[i : _sliceEnd(int(i), int(n), len(a), 1)])"},
+		{"[a FROM 0 FOR n] := b\n", "copy(a[0 : _sliceEnd(int(0), int(n), len(a), 1)], b)"},
+	}
+
+	for _, tt := range tests {
+		output, _ := transpileWithOptions(t, tt.input, WithBoundsCheck(true))
+		if !strings.Contains(output, tt.expected) {
+			t.Errorf("expected %q in output for %q, got:\n%s", tt.expected, tt.input, output)
+		}
+	}
+
+	if output := transpile(t, "x := a[i]\n"); !strings.Contains(output, "x = a[i]") || strings.Contains(output, "_index") {
+		t.Errorf("expected unchecked subscripts by default, got:\n%s", output)
+	}
+}
+
+func TestLeakCheckOption(t *testing.T) {
+	input := `INT FUNCTION sum.to(VAL INT n)
+  IS n
+:
+PROC hello(CHAN OF BYTE keyboard?, screen!, error!)
+  screen ! BYTE sum.to(65)
+:
+`
+	output, _ := transpileWithOptions(t, input, WithLeakCheck(true))
+	for _, want := range []string{
+		"\twg.Wait()\n\t_leakCheck(stderr)\n",
+		`"sum_to": "sum.to",`,
+		`"hello": "hello",`,
+		"func _leakProc(stack string) string {",
+		`"runtime"`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+
+	if output := transpile(t, input); strings.Contains(output, "_leak") {
+		t.Errorf("expected no leak check by default, got:\n%s", output)
+	}
+}
+
+func TestParRecoverOption(t *testing.T) {
+	input := `PROC p(CHAN OF INT c)
+  INT x:
+  PAR i = 0 FOR 2
+    PAR
+      c ! i
+      c ? x
+:
+`
+	output := transpile(t, input)
+	for _, want := range []string{
+		"defer _parRecover(\"i\", int(i), \"line 3\", \"PROC p\")",
+		"defer _parRecover(\"\", 1, \"line 4\", \"PROC p\")",
+		"defer _parRecover(\"\", 2, \"line 4\", \"PROC p\")",
+		"func _parRecover(repl string, index int, pos, proc string) {",
+		"\t\tif !_parExit {\n\t\t\tpanic(msg)\n\t\t}\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+
+	// A package has no main to let the branches exit
+	output, _ = transpileWithOptions(t, input, WithPackage("par"), WithSourcePos(func(n int) string { return fmt.Sprintf("p.occ:%d", n) }))
+	if !strings.Contains(output, "defer _parRecover(\"\", 1, \"p.occ:4\", \"PROC p\")") || strings.Contains(output, "_parExit = true") {
+		t.Errorf("expected source positions and no _parExit = true in a package, got:\n%s", output)
+	}
+	output = transpile(t, input+"PROC main(CHAN OF BYTE keyb?, scr!, err!)\n  CHAN OF INT c:\n  p(c)\n:\n")
+	if !strings.Contains(output, "func main() {\n\t_parExit = true\n") {
+		t.Errorf("expected main to set _parExit, got:\n%s", output)
+	}
+
+	if output, _ := transpileWithOptions(t, input, WithParRecover(false)); strings.Contains(output, "_parRecover") {
+		t.Errorf("expected no recover with WithParRecover(false), got:\n%s", output)
+	}
+}
+
+func TestPoisonUninitOption(t *testing.T) {
+	input := `RECORD PT
+  INT x:
+  REAL64 y:
+  BOOL b:
+SEQ
+  INT a:
+  BYTE c:
+  REAL32 r:
+  BOOL f:
+  PT p:
+  [2][3]INT m:
+  SKIP
+`
+	output, _ := transpileWithOptions(t, input, WithPoisonUninit(true))
+	for _, want := range []string{
+		"var _uninitNaN = math.NaN()",
+		"a = -559038737",
+		"c = 0xDE",
+		"r = float32(_uninitNaN)",
+		"p.x = -559038737",
+		"p.y = _uninitNaN",
+		"for _p0 := range m {\n\t\tfor _p1 := range m[_p0] {\n\t\t\tm[_p0][_p1] = -559038737",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "f = ") || strings.Contains(output, "p.b = ") {
+		t.Errorf("expected BOOLs left alone, got:\n%s", output)
+	}
+
+	if output := transpile(t, input); strings.Contains(output, "_uninitNaN") || strings.Contains(output, "-559038737") {
+		t.Errorf("expected zero-initialized variables by default, got:\n%s", output)
+	}
+}
+
+func TestStrictConversionCheck(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"b := BYTE x\n", "b = _intChecked[byte](x, 1)"},
+		{"s := INT16 (x + 1)\n", "s = _intChecked[int16]((x + 1), 1)"},
+		{"x := INT TRUNC r\n", "x = _intChecked[int](r, 1)"},
+		{"x := INT ROUND r\n", "x = _intChecked[int](math.Round(float64(r)), 1)"},
+		// Constants are checked at transpile time, and BOOLs and REALs are
+		// not range checked
+		{"b := BYTE 200\n", "b = byte(200)"},
+		{"BOOL flag:\nx := INT flag\n", "x = _boolToInt(flag)"},
+		{"r := REAL64 x\n", "r = float64(x)"},
+	}
+
+	for _, tt := range tests {
+		output, _ := transpileWithOptions(t, tt.input, WithStrict(true))
+		if !strings.Contains(output, tt.expected) {
+			t.Errorf("expected %q in output for %q, got:\n%s", tt.expected, tt.input, output)
+		}
+	}
+
+	if output := transpile(t, "b := BYTE x\n"); !strings.Contains(output, "b = byte(x)") || strings.Contains(output, "_intChecked") {
+		t.Errorf("expected an unchecked conversion by default, got:\n%s", output)
+	}
+}
+
 func TestSimpleProtocolType(t *testing.T) {
 	input := `PROTOCOL SIGNAL IS INT
 `
@@ -501,6 +863,42 @@ func TestSequentialProtocolType(t *testing.T) {
 	}
 }
 
+func TestFixedArrayProtocolType(t *testing.T) {
+	input := `PROTOCOL QUAD IS [4]BYTE
+PROTOCOL MSG
+  CASE
+    raw; INT; [4]BYTE
+    quit
+PROC p(CHAN OF MSG c!, CHAN OF QUAD q!)
+  [8]BYTE buf:
+  SEQ
+    c ! raw ; 1 ; [buf FROM 2 FOR 4]
+    q ! "abcd"
+:
+PROC r(CHAN OF MSG c?, [4]BYTE out)
+  INT n:
+  c ? CASE
+    raw ; n ; out
+      SKIP
+    quit
+      SKIP
+:
+`
+	output := transpile(t, input)
+
+	for _, want := range []string{
+		"type _proto_QUAD = []byte",
+		"_1 []byte",
+		"c <- _proto_MSG_raw{1, append([]byte(nil), buf[2 : 2 + 4]...)}",
+		`q <- append([]byte(nil), "abcd"...)`,
+		"copy(out, _v._1)",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+}
+
 func TestVariantProtocolType(t *testing.T) {
 	input := `PROTOCOL MSG
   CASE
@@ -546,6 +944,39 @@ func TestVariantProtocolDottedTags(t *testing.T) {
 	}
 }
 
+func TestProtocolExtends(t *testing.T) {
+	input := `PROTOCOL BASE
+  CASE
+    num; INT
+    stop
+:
+PROTOCOL EXT EXTENDS BASE
+  CASE
+    text; BYTE
+:
+PROC p(CHAN OF EXT c!)
+  SEQ
+    c ! num; 1
+    c ! text; 'a'
+:
+`
+	output := transpile(t, input)
+	for _, s := range []string{
+		"type _proto_BASE interface {\n\t_is_BASE()\n}",
+		"type _proto_EXT = _proto_BASE\n",
+		"type _proto_EXT_text struct {\n\t_0 byte\n}\nfunc (_proto_EXT_text) _is_BASE() {}",
+		"c <- _proto_BASE_num{1}",
+		"c <- _proto_EXT_text{byte(97)}",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, "_proto_EXT_num") {
+		t.Errorf("inherited tag redeclared for EXT:\n%s", output)
+	}
+}
+
 func TestRecordType(t *testing.T) {
 	input := `RECORD POINT
   INT x:
@@ -564,62 +995,242 @@ func TestRecordType(t *testing.T) {
 	}
 }
 
-func TestRecordFieldAssignmentCodegen(t *testing.T) {
-	input := `RECORD POINT
-  INT x:
-  INT y:
-SEQ
-  POINT p:
-  p[x] := 5
+func TestDataType(t *testing.T) {
+	input := `DATA TYPE MY.INT IS INT:
+DATA TYPE CELL
+  RECORD
+    MY.INT count:
+:
+MY.INT FUNCTION twice(VAL MY.INT n)
+  IS n * 2
+:
 `
 	output := transpile(t, input)
-
-	if !strings.Contains(output, "p.x = 5") {
-		t.Errorf("expected 'p.x = 5' in output, got:\n%s", output)
+	for _, s := range []string{
+		"type MY_INT int\n",
+		"type CELL struct {\n\tcount MY_INT\n}",
+		"func twice(n MY_INT) MY_INT {",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
 	}
 }
 
-func TestChanArrayDeclGen(t *testing.T) {
-	input := `[5]CHAN OF INT cs:
+func TestChanType(t *testing.T) {
+	input := `CHAN TYPE ADDER
+  MOBILE RECORD
+    CHAN INT req?:
+    CHAN INT resp!:
+:
+PROC client(SHARED ADDER! cli)
+  INT sum:
+  CLAIM cli
+    SEQ
+      cli[req] ! 1
+      cli[resp] ? sum
+:
+PROC main()
+  ADDER? svr:
+  SHARED ADDER! cli:
+  svr, cli := MOBILE ADDER
+:
 `
 	output := transpile(t, input)
-
-	if !strings.Contains(output, "cs := make([]chan int, 5)") {
-		t.Errorf("expected 'cs := make([]chan int, 5)' in output, got:\n%s", output)
+	for _, s := range []string{
+		"type ADDER struct {\n\treq chan int\n\tresp chan int\n\t_claim *sync.Mutex\n}",
+		"func client(cli *ADDER) {",
+		"cli._claim.Lock()\n\tcli.req <- 1\n\tsum = <-cli.resp\n\tcli._claim.Unlock()",
+		"_tmp0 := ADDER{req: make(chan int), resp: make(chan int), _claim: new(sync.Mutex)}\n\tsvr, cli = _tmp0, _tmp0",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
 	}
-	if !strings.Contains(output, "for _i0 := range cs { cs[_i0] = make(chan int) }") {
-		t.Errorf("expected init loop in output, got:\n%s", output)
+	if strings.Contains(output, "svr.req = make") {
+		t.Errorf("channels made for an end declaration:\n%s", output)
 	}
 }
 
-func TestIndexedSendGen(t *testing.T) {
-	input := `cs[0] ! 42
+func TestSharedChan(t *testing.T) {
+	input := `PROC writer(SHARED CHAN OF INT out!)
+  CLAIM out!
+    out ! 1
+:
+PROC main()
+  SHARED CHAN OF INT c:
+  INT x:
+  PAR
+    writer(c!)
+    CLAIM c?
+      c ? x
+:
 `
 	output := transpile(t, input)
-
-	if !strings.Contains(output, "cs[0] <- 42") {
-		t.Errorf("expected 'cs[0] <- 42' in output, got:\n%s", output)
+	for _, s := range []string{
+		"func _chanClaim(c any, end string) *sync.Mutex {",
+		"func writer(out chan<- int) {\n\t_chanClaim(out, \"!\").Lock()\n\tout <- 1\n\t_chanClaim(out, \"!\").Unlock()\n}",
+		"c := make(chan int)\n",
+		"_chanClaim(c, \"?\").Lock()\n\t\tx = <-c\n\t\t_chanClaim(c, \"?\").Unlock()",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
 	}
 }
 
-func TestIndexedReceiveGen(t *testing.T) {
-	input := `cs[0] ? x
+func TestMobileMove(t *testing.T) {
+	input := `PROC pass(CHAN MOBILE []BYTE in?, CHAN MOBILE []BYTE out!, MOBILE INT n)
+  MOBILE []BYTE buf, keep:
+  MOBILE INT m:
+  [4]BYTE plain:
+  SEQ
+    buf := MOBILE [n]BYTE
+    keep := buf
+    out ! keep
+    in ? buf
+    m := n
+    plain := buf
+:
 `
 	output := transpile(t, input)
-
-	if !strings.Contains(output, "x = <-cs[0]") {
-		t.Errorf("expected 'x = <-cs[0]' in output, got:\n%s", output)
+	for _, s := range []string{
+		"func pass(in <-chan []byte, out chan<- []byte, n *int) {",
+		"var buf []byte\n",
+		"buf = make([]byte, *n)\n",
+		"keep = buf\n\tbuf = nil\n",
+		"out <- keep\n\tkeep = nil\n",
+		"m = *n\n\t*n = 0\n",
+		"plain = buf\n\tbuf = nil\n",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, "buf = <-in\n\tbuf = nil") {
+		t.Errorf("expected input not to move the target:\n%s", output)
 	}
 }
 
-func TestChanArrayParamGen(t *testing.T) {
-	input := `PROC worker([]CHAN OF INT cs)
-  SKIP
+func TestForking(t *testing.T) {
+	input := `PROC worker(VAL INT id, INT count, MOBILE []BYTE buf, CHAN OF INT out!)
+  out ! id
+:
+PROC spawn(CHAN OF INT out!)
+  INT n:
+  MOBILE []BYTE b:
+  FORKING
+    SEQ
+      b := MOBILE [2]BYTE
+      FORK worker(1, n, b, out!)
+:
 `
 	output := transpile(t, input)
+	for _, s := range []string{
+		"var _forking0 sync.WaitGroup\n",
+		"_forking0.Add(1)\n\tgo func(_f0 int, _f1 int, _f2 []byte, _f3 chan<- int) {\n",
+		"defer _forking0.Done()\n\t\tworker(_f0, &_f1, _f2, _f3)\n\t}(1, n, b, out)\n\tb = nil\n",
+		"_forking0.Wait()\n",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
 
-	if !strings.Contains(output, "func worker(cs []chan int)") {
-		t.Errorf("expected 'func worker(cs []chan int)' in output, got:\n%s", output)
+	p := parser.New(lexer.New("PROC worker()\n  SKIP\n:\nPROC spawn()\n  FORK worker()\n:\n"))
+	gen := New()
+	gen.Generate(p.ParseProgram())
+	want := []string{"line 5: FORK outside a FORKING block"}
+	if fmt.Sprint(gen.Errors()) != fmt.Sprint(want) {
+		t.Errorf("expected errors %v, got %v", want, gen.Errors())
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	input := `PROC phase(BARRIER b)
+  SYNC b
+:
+PROC phases()
+  BARRIER b:
+  PAR ENROLL b
+    phase(b)
+    SYNC b
+:
+`
+	output := transpile(t, input)
+	for _, s := range []string{
+		"type _barrier struct {\n",
+		"func phase(b *_barrier) {\n\tb.sync()\n}\n",
+		"b := _barrier{enrolled: 1}\n",
+		"wg.Add(2)\n\t_enroll0 := 2\n\tb.enrollPar(_enroll0)\n",
+		"defer wg.Done()\n\t\tdefer _parRecover(\"\", 1, \"line 6\", \"PROC phases\")\n\t\tdefer b.resignPar(&_enroll0)\n\t\tphase(&b)\n",
+		"defer b.resignPar(&_enroll0)\n\t\tb.sync()\n",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(transpile(t, "PROC p()\n  SKIP\n:\n"), "_barrier") {
+		t.Errorf("expected no _barrier type without a BARRIER")
+	}
+}
+
+func TestRecordFieldAssignmentCodegen(t *testing.T) {
+	input := `RECORD POINT
+  INT x:
+  INT y:
+SEQ
+  POINT p:
+  p[x] := 5
+`
+	output := transpile(t, input)
+
+	if !strings.Contains(output, "p.x = 5") {
+		t.Errorf("expected 'p.x = 5' in output, got:\n%s", output)
+	}
+}
+
+func TestChanArrayDeclGen(t *testing.T) {
+	input := `[5]CHAN OF INT cs:
+`
+	output := transpile(t, input)
+
+	if !strings.Contains(output, "cs := make([]chan int, 5)") {
+		t.Errorf("expected 'cs := make([]chan int, 5)' in output, got:\n%s", output)
+	}
+	if !strings.Contains(output, "for _i0 := range cs { cs[_i0] = make(chan int) }") {
+		t.Errorf("expected init loop in output, got:\n%s", output)
+	}
+}
+
+func TestIndexedSendGen(t *testing.T) {
+	input := `cs[0] ! 42
+`
+	output := transpile(t, input)
+
+	if !strings.Contains(output, "cs[0] <- 42") {
+		t.Errorf("expected 'cs[0] <- 42' in output, got:\n%s", output)
+	}
+}
+
+func TestIndexedReceiveGen(t *testing.T) {
+	input := `cs[0] ? x
+`
+	output := transpile(t, input)
+
+	if !strings.Contains(output, "x = <-cs[0]") {
+		t.Errorf("expected 'x = <-cs[0]' in output, got:\n%s", output)
+	}
+}
+
+func TestChanArrayParamGen(t *testing.T) {
+	input := `PROC worker([]CHAN OF INT cs)
+  SKIP
+`
+	output := transpile(t, input)
+
+	if !strings.Contains(output, "func worker(cs []chan int)") {
+		t.Errorf("expected 'func worker(cs []chan int)' in output, got:\n%s", output)
 	}
 }
 
@@ -651,6 +1262,32 @@ func TestChanArrayDirParamGen(t *testing.T) {
 	}
 }
 
+func TestChanDirForwardedToUndirectedParam(t *testing.T) {
+	input := `PROC plain(CHAN OF INT in, out)
+  INT x:
+  SEQ
+    in ? x
+    out ! x
+:
+PROC relay(CHAN OF INT in?, out!)
+  plain(in, out)
+:
+PROC outer(CHAN OF INT in?, out!, log!)
+  SEQ
+    relay(in?, out!)
+    log ! 1
+:
+`
+	output := transpile(t, input)
+
+	if !strings.Contains(output, "func relay(in chan int, out chan int)") {
+		t.Errorf("expected relay's params widened to chan int, got:\n%s", output)
+	}
+	if !strings.Contains(output, "func outer(in chan int, out chan int, log chan<- int)") {
+		t.Errorf("expected outer's forwarded params widened and log kept directed, got:\n%s", output)
+	}
+}
+
 func TestRecordFieldAccessCodegen(t *testing.T) {
 	input := `RECORD POINT
   INT x:
@@ -667,6 +1304,63 @@ SEQ
 	}
 }
 
+func TestLvalueCodegen(t *testing.T) {
+	header := `RECORD POINT
+  INT x:
+  INT y:
+PROTOCOL PAIR IS INT ; INT
+PROTOCOL MSG
+  CASE
+    pt ; INT
+:
+PROC f(POINT p, VAL POINT q, [3]POINT ps, []POINT qs, INT n, [5]INT arr, CHAN OF INT c, CHAN OF PAIR d, CHAN OF MSG m)
+  TIMER tim:
+  POINT r:
+  SEQ
+`
+	tests := []struct {
+		stmt     string
+		expected string
+	}{
+		// Assignment
+		{"n := 1", "*n = 1"},
+		{"arr[n] := 1", "arr[*n] = 1"},
+		{"r[x] := 1", "r.x = 1"},
+		{"p[x] := 1", "p.x = 1"},
+		{"ps[1][y] := 1", "ps[1].y = 1"},
+		{"qs[n][y] := 1", "qs[*n].y = 1"},
+		{"p[y] := p[x] + q[y]", "p.y = (p.x + q.y)"},
+		{"n := ps[0][x]", "*n = ps[0].x"},
+		// Multiple assignment
+		{"p[x], n := n, p[x]", "p.x, *n = *n, p.x"},
+		{"ps[0][x], arr[1] := 1, 2", "ps[0].x, arr[1] = 1, 2"},
+		// Receive
+		{"c ? n", "*n = <-c"},
+		{"c ? arr[n]", "arr[*n] = <-c"},
+		{"c ? r[y]", "r.y = <-c"},
+		{"c ? p[x]", "p.x = <-c"},
+		{"c ? ps[1][y]", "ps[1].y = <-c"},
+		{"c ? qs[1][y]", "qs[1].y = <-c"},
+		{"d ? p[x] ; n", "p.x = _tmp0._0"},
+		{"d ? p[x] ; n", "*n = _tmp0._1"},
+		// Variant receive
+		{"m ? CASE\n      pt ; n\n        SKIP", "*n = _v._0"},
+		// Timer read
+		{"tim ? n", "*n = int(time.Now().UnixMicro())"},
+		// ALT receive
+		{"ALT\n      c ? p[y]\n        SKIP", "case p.y = <-c:"},
+		{"ALT\n      c ? n\n        SKIP", "case *n = <-c:"},
+		{"ALT\n      c ? ps[2][x]\n        SKIP", "case ps[2].x = <-c:"},
+	}
+
+	for _, tt := range tests {
+		output := transpile(t, header+"    "+tt.stmt+"\n:\n")
+		if !strings.Contains(output, tt.expected) {
+			t.Errorf("for %q: expected %q in output, got:\n%s", tt.stmt, tt.expected, output)
+		}
+	}
+}
+
 func TestSizeOperator(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -702,7 +1396,11 @@ func TestAbbreviation(t *testing.T) {
 	}{
 		{"VAL INT x IS 42:\n", "var x int = 42"},
 		{"VAL BOOL flag IS TRUE:\n", "var flag bool = true"},
-		{"INT y IS z:\n", "var y int = z"},
+		{"INT y IS z:\n", "y := &z"},
+		{"INT y IS a[i]:\n", "y := &a[i]"},
+		{"[]INT row IS grid[i]:\n", "var row []int = grid[i]"},
+		{"[]BYTE line IS [buf FROM 0 FOR n]:\n", "var line []byte = buf[0 : 0 + n]"},
+		{"[4]INT row IS grid[2]:\n", "var row []int = grid[2]"},
 		{"INITIAL INT x IS 42:\n", "var x int = 42"},
 		{"INITIAL BOOL done IS FALSE:\n", "var done bool = false"},
 		{"VAL BYTE x IS 1:\n", "var x byte = 1"},
@@ -718,6 +1416,30 @@ func TestAbbreviation(t *testing.T) {
 	}
 }
 
+func TestTypedLiteralAbbreviation(t *testing.T) {
+	input := `DATA TYPE POINT
+  RECORD
+    INT x:
+    INT y:
+:
+VAL POINT origin IS [0, 0]:
+VAL []POINT corners IS [[1, 2], [3, 4]]:
+VAL [2][2][2]INT cube IS [[[1, 2], [3, 4]], [[5, 6], [7, 8]]]:
+VAL []BYTE hi IS [72, 105]:
+`
+	output := transpile(t, input)
+	for _, want := range []string{
+		"var origin POINT = POINT{x: 0, y: 0}",
+		"var corners []POINT = []POINT{{x: 1, y: 2}, {x: 3, y: 4}}",
+		"var cube [][][]int = [][][]int{{{1, 2}, {3, 4}}, {{5, 6}, {7, 8}}}",
+		"var hi []byte = []byte{72, 105}",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+}
+
 func TestMultiAssignmentSimple(t *testing.T) {
 	input := `a, b := 1, 2
 `
@@ -754,6 +1476,29 @@ func TestArrayLiteralCodegen(t *testing.T) {
 	}
 }
 
+func TestTypedArrayLiteralCodegen(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"VAL x IS [[1, 2], [3, 4]] :\n", "[][]int{{1, 2}, {3, 4}}"},
+		{"VAL x IS [1, 2, 3](INT32) :\n", "[]int32{1, 2, 3}"},
+		{"VAL x IS [[1, 2], [3, 4]](INT16) :\n", "[][]int16{{1, 2}, {3, 4}}"},
+		{"VAL x IS ['a', 'b'] :\n", "[]byte{byte(97), byte(98)}"},
+		{"VAL x IS [1.5(REAL32), 2.0(REAL32)] :\n", "[]float32{float32(1.5), float32(2.0)}"},
+		{"VAL x IS [TRUE, FALSE] :\n", "[]bool{true, false}"},
+		{"VAL x IS [\"ab\", \"cd\"] :\n", `[][]byte{[]byte("ab"), []byte("cd")}`},
+		{"[3]INT32 a:\na := [1, 2, 3]\n", "a = []int32{1, 2, 3}"},
+		{"[4]BYTE b:\n[b FROM 0 FOR 2] := [1, 2]\n", "copy(b[0 : 0 + 2], []byte{1, 2})"},
+	}
+	for _, tt := range tests {
+		output := transpile(t, tt.input)
+		if !strings.Contains(output, tt.expected) {
+			t.Errorf("for input %q: expected %q in output, got:\n%s", tt.input, tt.expected, output)
+		}
+	}
+}
+
 func TestUntypedValCodegen(t *testing.T) {
 	input := `VAL x IS 42 :
 PROC dummy()
@@ -878,3 +1623,1469 @@ func TestEntryHarnessRawTerminal(t *testing.T) {
 		}
 	}
 }
+
+// bigProcSource returns a PROC whose body has blocks SEQs of n assignments each.
+func bigProcSource(blocks, n int) string {
+	var b strings.Builder
+	b.WriteString("PROC big(INT x)\n  SEQ\n")
+	for i := 0; i < blocks; i++ {
+		b.WriteString("    SEQ\n")
+		for j := 0; j < n; j++ {
+			b.WriteString(fmt.Sprintf("      x := x + %d\n", j))
+		}
+	}
+	b.WriteString(":\n")
+	return b.String()
+}
+
+func transpileWithOptions(t *testing.T, input string, opts ...Option) (string, []string) {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	for _, err := range p.Errors() {
+		t.Fatalf("parser error: %s", err)
+	}
+	gen := New(opts...)
+	return gen.Generate(program), gen.Warnings()
+}
+
+func TestFuncSizeWarning(t *testing.T) {
+	input := bigProcSource(4, 50)
+
+	_, warnings := transpileWithOptions(t, input)
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings without a limit, got %v", warnings)
+	}
+
+	_, warnings = transpileWithOptions(t, input, WithMaxFuncSize(1000))
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "line 1: PROC big generates") {
+		t.Errorf("expected a size warning for PROC big, got %v", warnings)
+	}
+}
+
+func TestFuncSizeExcludesNestedProc(t *testing.T) {
+	// The nested PROC is a separate Go closure, so only it is over the limit
+	nested := strings.ReplaceAll(bigProcSource(4, 50), "\n", "\n  ")
+	input := "PROC outer(INT x)\n  " + nested + "\n  big(x)\n:\n"
+
+	_, warnings := transpileWithOptions(t, input, WithMaxFuncSize(1000))
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "line 2: PROC big generates") {
+		t.Errorf("expected a single size warning for nested PROC big, got %v", warnings)
+	}
+}
+
+func TestOutliningKeepsFunctionsSmall(t *testing.T) {
+	input := bigProcSource(4, 50)
+
+	output, warnings := transpileWithOptions(t, input, WithMaxFuncSize(2000), WithOutlining(true))
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings with outlining, got %v", warnings)
+	}
+	if n := strings.Count(output, "func() {"); n != 2 {
+		t.Errorf("expected 2 outlined blocks, got %d in:\n%s", n, output)
+	}
+	if !strings.Contains(output, "\t\t*x = (*x + 49)\n\t}()\n") {
+		t.Errorf("expected outlined block to be indented and called, got:\n%s", output)
+	}
+}
+
+func TestEntryProcSelection(t *testing.T) {
+	procs := `PROC first(CHAN OF BYTE kyb?, scr!, err!)
+  SKIP
+:
+%sPROC second(CHAN OF BYTE kyb?, scr!, err!)
+  SKIP
+:
+PROC third(CHAN OF BYTE kyb?, scr!, err!)
+  SKIP
+:
+`
+	tests := []struct {
+		name     string
+		pragma   string
+		opts     []Option
+		wantCall string
+		wantWarn string
+	}{
+		{"last by default", "", nil, "third(keyboard, screen, _error)", "line 7: several PROCs match the entry point signature: first, second, third; using third"},
+		{"pragma", "--#PRAGMA ENTRY\n", nil, "second(keyboard, screen, _error)", ""},
+		{"option", "--#PRAGMA ENTRY\n", []Option{WithEntry("first")}, "first(keyboard, screen, _error)", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, warnings := transpileWithOptions(t, fmt.Sprintf(procs, tt.pragma), tt.opts...)
+			if !strings.Contains(output, "\t"+tt.wantCall+"\n") {
+				t.Errorf("expected main to call %q, got:\n%s", tt.wantCall, output)
+			}
+			if tt.wantWarn == "" && len(warnings) != 0 {
+				t.Errorf("expected no warnings, got %v", warnings)
+			}
+			if tt.wantWarn != "" && (len(warnings) == 0 || !strings.HasPrefix(warnings[0], tt.wantWarn)) {
+				t.Errorf("expected warning starting %q, got %v", tt.wantWarn, warnings)
+			}
+		})
+	}
+}
+
+func TestEntryOptionErrors(t *testing.T) {
+	input := `PROC helper(INT x)
+  SKIP
+:
+PROC main(CHAN OF BYTE kyb?, scr!, err!)
+  SKIP
+:
+`
+	for _, tt := range []struct{ entry, want string }{
+		{"fourth", "entry PROC fourth not found"},
+		{"helper", "line 1: entry PROC helper does not have an entry point signature"},
+	} {
+		p := parser.New(lexer.New(input))
+		program := p.ParseProgram()
+		gen := New(WithEntry(tt.entry))
+		output := gen.Generate(program)
+		if fmt.Sprint(gen.Errors()) != fmt.Sprint([]string{tt.want}) || strings.Contains(output, "main(keyboard, screen, _error)") {
+			t.Errorf("-entry %s: expected the error %q and no call of main, got %v:\n%s", tt.entry, tt.want, gen.Errors(), output)
+		}
+	}
+}
+
+func TestEntryPragmaOnNonEntryProc(t *testing.T) {
+	input := `--#PRAGMA ENTRY
+PROC helper(INT x)
+  SKIP
+:
+PROC main(CHAN OF BYTE kyb?, scr!, err!)
+  SKIP
+:
+`
+	output, warnings := transpileWithOptions(t, input)
+	if !strings.Contains(output, "main(keyboard, screen, _error)") {
+		t.Errorf("expected main to be the entry PROC, got:\n%s", output)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "PROC helper is marked ENTRY but does not have an entry point signature") {
+		t.Errorf("expected a warning about PROC helper, got %v", warnings)
+	}
+}
+
+func TestEntryHarnessFourthChannel(t *testing.T) {
+	tests := []struct {
+		param string
+		want  []string
+	}{
+		{"args?", []string{"_args := make(chan byte, 256)", "_runEntry(os.Stdin, os.Stdout, os.Stderr, restore, os.Args[1:])", "func RunWithIO(stdin io.Reader, stdout, stderr io.Writer, args ...string) {", "close(_args)", "run(keyboard, screen, _error, _args)"}},
+		{"log!", []string{"_error2 := make(chan byte, 256)", "wg.Add(3)", "for b := range _error2 {", "run(keyboard, screen, _error, _error2)", "close(_error2)"}},
+	}
+	for _, tt := range tests {
+		input := "PROC run(CHAN OF BYTE kyb?, scr!, err!, CHAN OF BYTE " + tt.param + ")\n  SKIP\n:\n"
+		output := transpile(t, input)
+		for _, want := range tt.want {
+			if !strings.Contains(output, want) {
+				t.Errorf("%s: expected %q in entry harness output, got:\n%s", tt.param, want, output)
+			}
+		}
+	}
+}
+
+func TestEntryHarnessScreenProtocol(t *testing.T) {
+	tests := []struct {
+		name   string
+		proto  string
+		want   []string
+		absent []string
+	}{
+		{
+			"terminal",
+			"PROTOCOL SCREEN\n  CASE\n    char; BYTE\n    goto; INT; INT\n    clear\n:\n",
+			[]string{"screen := make(chan _proto_SCREEN, 256)", "switch m := m.(type) {", "case _proto_SCREEN_char:", "w.WriteByte(m._0)", `fmt.Fprintf(w, "\x1b[%d;%dH", m._1, m._0)`, `w.WriteString("\x1b[2J\x1b[H")`},
+			[]string{"encoding/json"},
+		},
+		{
+			"terminal without fields",
+			"PROTOCOL SCREEN\n  CASE\n    clear\n    bell\n:\n",
+			[]string{"switch m.(type) {", "w.WriteByte(7)"},
+			[]string{`"fmt"`},
+		},
+		{
+			"json",
+			"PROTOCOL SCREEN\n  CASE\n    text; INT::[]BYTE\n    point; INT; REAL64\n    done\n:\n",
+			[]string{`"encoding/json"`, "enc := json.NewEncoder(w)", `enc.Encode(map[string]interface{}{"tag": "text", "args": []interface{}{string(m._1)}})`, `enc.Encode(map[string]interface{}{"tag": "point", "args": []interface{}{m._0, m._1}})`, `"tag": "done", "args": []interface{}{}`},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		input := tt.proto + "PROC show(CHAN OF BYTE kyb?, CHAN OF SCREEN scr!, CHAN OF BYTE err!)\n  SKIP\n:\n"
+		output := transpile(t, input)
+		for _, want := range tt.want {
+			if !strings.Contains(output, want) {
+				t.Errorf("%s: expected %q in entry harness output, got:\n%s", tt.name, want, output)
+			}
+		}
+		for _, absent := range tt.absent {
+			if strings.Contains(output, absent) {
+				t.Errorf("%s: expected no %q in entry harness output, got:\n%s", tt.name, absent, output)
+			}
+		}
+	}
+
+	// A simple protocol is not an entry point
+	output := transpile(t, "PROTOCOL SCREEN IS BYTE\nPROC show(CHAN OF BYTE kyb?, CHAN OF SCREEN scr!, CHAN OF BYTE err!)\n  SKIP\n:\n")
+	if strings.Contains(output, "func main()") {
+		t.Errorf("expected no entry harness for a simple screen protocol, got:\n%s", output)
+	}
+}
+
+func TestGenerateTestsSkeletons(t *testing.T) {
+	input := `INT, BOOL FUNCTION f(VAL INT x, VAL BOOL b)
+  IS x, b
+
+INT FUNCTION sum(VAL []INT xs)
+  INT total:
+  VALOF
+    SEQ
+      total := 0
+      SEQ i = 0 FOR SIZE xs
+        total := total + xs[i]
+    RESULT total
+`
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	for _, err := range p.Errors() {
+		t.Fatalf("parser error: %s", err)
+	}
+	gen := New()
+	gen.Generate(program)
+	output := gen.GenerateTests(program)
+
+	if !strings.Contains(output, `t.Skip("no --#ASSERT examples for FUNCTION f")`) {
+		t.Errorf("expected skipped skeleton for f in:\n%s", output)
+	}
+	if !strings.Contains(output, "_, _ = f(0, false)") {
+		t.Errorf("expected zero-valued call of f in:\n%s", output)
+	}
+	if strings.Contains(output, "Test_sum") {
+		t.Errorf("expected no skeleton for FUNCTION with an array parameter in:\n%s", output)
+	}
+}
+
+func TestTypeMap(t *testing.T) {
+	input := `BOOL FUNCTION pos(VAL INT16 x)
+  IS x > 0
+
+SEQ
+  [4]BOOL flags:
+  BOOL b:
+  b := pos(3)
+`
+	p := parser.New(lexer.New(input))
+	gen := New(WithTypeMap(map[string]string{"BOOL": "int32", "INT16": "int32"}))
+	output := gen.Generate(p.ParseProgram())
+
+	for _, want := range []string{
+		"func pos(x int32) int32 {",
+		"return int32(_boolToInt((x > 0)))",
+		"var b int32",
+		"b = pos(3)",
+		"func _boolToInt(b bool) int {",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+	want := []string{"line 5: BOOL arrays are not supported with BOOL mapped to int32"}
+	if fmt.Sprint(gen.Errors()) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, gen.Errors())
+	}
+	for _, src := range []string{"VAL [2]BOOL t IS [TRUE, FALSE]:\n", "PROC q([]BOOL bs)\n  SKIP\n:\n"} {
+		gen := New(WithTypeMap(map[string]string{"BOOL": "int32"}))
+		gen.Generate(parser.New(lexer.New(src)).ParseProgram())
+		if len(gen.Errors()) != 1 || !strings.HasPrefix(gen.Errors()[0], "line 1: BOOL arrays are not supported") {
+			t.Errorf("for %q: expected a BOOL array error, got %v", src, gen.Errors())
+		}
+	}
+
+	// The default mapping is unchanged
+	output, _ = transpileWithOptions(t, input)
+	if !strings.Contains(output, "func pos(x int16) bool {") {
+		t.Errorf("expected default types in output:\n%s", output)
+	}
+}
+
+func TestVariantReceiveExhaustiveness(t *testing.T) {
+	input := `PROTOCOL MSG
+  CASE
+    data; INT
+    reset
+    quit
+
+PROC p(CHAN OF MSG c?)
+  INT x:
+  c ? CASE
+    data ; x
+      SKIP
+:
+PROC q(CHAN OF MSG c?)
+  INT x:
+  c ? CASE
+    data ; x
+      SKIP
+    reset
+      SKIP
+    quit
+      SKIP
+:
+`
+	want := "line 9: variant receive on c does not handle reset, quit of PROTOCOL MSG"
+
+	_, warnings := transpileWithOptions(t, input)
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("expected warning %q, got %v", want, warnings)
+	}
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	gen := New(WithStrict(true))
+	output := gen.Generate(program)
+	if len(gen.Errors()) != 1 || gen.Errors()[0] != want || len(gen.Warnings()) != 0 {
+		t.Errorf("expected error %q under WithStrict, got errors %v warnings %v", want, gen.Errors(), gen.Warnings())
+	}
+	for _, s := range []string{
+		"case _proto_MSG_reset:",
+		`fmt.Fprintln(os.Stderr, "STOP: unhandled variant quit received on c")`,
+		"default:",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+}
+
+func TestProcCallWithoutParens(t *testing.T) {
+	input := `PROC tick()
+  SKIP
+:
+PROC main()
+  SEQ
+    tick
+    tick ()
+:
+`
+	output, warnings := transpileWithOptions(t, input)
+	if strings.Count(output, "\ttick()\n") != 2 {
+		t.Errorf("expected two calls of tick() in output:\n%s", output)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %v", warnings)
+	}
+
+	want := "line 6: call of PROC tick without parentheses"
+	_, warnings = transpileWithOptions(t, input, WithStrict(true))
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("expected warning %q under WithStrict, got %v", want, warnings)
+	}
+}
+
+func TestVariantReceiveElse(t *testing.T) {
+	input := `PROTOCOL MSG
+  CASE
+    data; INT
+    reset
+    quit
+
+PROC p(CHAN OF MSG c?)
+  c ? CASE
+    INT x:
+    data ; x
+      SKIP
+    ELSE
+      STOP
+:
+`
+	output, warnings := transpileWithOptions(t, input, WithStrict(true))
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings with an ELSE case, got %v", warnings)
+	}
+	for _, s := range []string{
+		"case _proto_MSG_data:\n\t\tvar x int\n\t\t_ = x\n\t\tx = _v._0\n",
+		"default:\n\t\tfmt.Fprintln(os.Stderr, \"STOP encountered\")",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, "unhandled variant") {
+		t.Errorf("expected no STOP cases for tags ELSE takes:\n%s", output)
+	}
+}
+
+func TestPoisonCases(t *testing.T) {
+	input := `PROTOCOL MSG
+  CASE
+    data; INT
+    poison
+
+PROTOCOL OTHER
+  CASE
+    other; INT
+
+PROC split(CHAN OF MSG in?, []CHAN OF MSG outs!, CHAN OF OTHER log!, CHAN OF MSG back)
+  INT x:
+  WHILE TRUE
+    in ? CASE
+      data ; x
+        SKIP
+:
+
+PROC own(CHAN OF MSG in?, CHAN OF MSG out!)
+  INT x:
+  in ? CASE
+    data ; x
+      SKIP
+    poison
+      SKIP
+:
+
+PROC inpar(CHAN OF MSG in?, CHAN OF MSG out!)
+  INT x:
+  PAR
+    in ? CASE
+      data ; x
+        SKIP
+    SKIP
+:
+`
+	output, warnings := transpileWithOptions(t, input, WithPoison("poison"))
+
+	want := `		case _proto_MSG_poison:
+			for _, _c0 := range outs {
+				_c0 <- _proto_MSG_poison{}
+			}
+			return
+`
+	if !strings.Contains(output, want) {
+		t.Errorf("expected poison case forwarding to outs only in:\n%s", output)
+	}
+	if strings.Count(output, "case _proto_MSG_poison:") != 3 {
+		t.Errorf("expected poison cases in split (added), own (user's) and inpar (STOP):\n%s", output)
+	}
+	if !strings.Contains(output, `"STOP: unhandled variant poison received on in"`) {
+		t.Errorf("expected the receive inside PAR to STOP on poison:\n%s", output)
+	}
+	if strings.Count(output, "return") != 1 {
+		t.Errorf("expected a single generated return:\n%s", output)
+	}
+	// The receive inside PAR still misses the poison tag
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "line 30: variant receive on in does not handle poison") {
+		t.Errorf("expected an exhaustiveness warning for the receive in PAR only, got %v", warnings)
+	}
+
+	output, _ = transpileWithOptions(t, input)
+	if strings.Contains(output, "return") {
+		t.Errorf("expected no poison handling without WithPoison:\n%s", output)
+	}
+}
+
+func TestAltGuardedTimeout(t *testing.T) {
+	input := `PROC poll(CHAN OF INT c?, VAL BOOL short)
+  TIMER tim:
+  INT t, x:
+  SEQ
+    tim ? t
+    ALT
+      short & tim ? AFTER t PLUS 10
+        SKIP
+      (NOT short) & tim ? AFTER t PLUS 1000
+        SKIP
+      c ? x
+        SKIP
+:
+`
+	output := transpile(t, input)
+
+	for _, want := range []string{
+		"var _alt0 <-chan time.Time\n",
+		"if short { _alt0 = time.After(",
+		"if !short { _alt1 = time.After(",
+		"case <-_alt0:",
+		"case <-_alt1:",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "case <-time.After(") {
+		t.Errorf("expected guarded timeouts to be started only when enabled, got:\n%s", output)
+	}
+}
+
+func TestAltConstantGuards(t *testing.T) {
+	input := `PROC serve(CHAN OF INT a?, b?)
+  CHAN OF INT unused:
+  INT x:
+  SEQ
+    ALT
+      FALSE & unused ? x
+        print.int(x)
+      TRUE & a ? x
+        SKIP
+      (TRUE AND FALSE) & b ? x
+        SKIP
+      TRUE & SKIP
+        SKIP
+    ALT
+      FALSE & b ? x
+        SKIP
+:
+`
+	output := transpile(t, input)
+	for _, want := range []string{
+		"\t_ = unused\n\t_ = b\n\tselect {\n\tcase x = <-a: // TRUE & a ? x\n",
+		"\tdefault: // TRUE & SKIP\n",
+		"\t_ = b\n\tfmt.Fprintln(os.Stderr, \"STOP encountered\")\n\tselect {}\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+	for _, unwanted := range []string{"_alt", "<-unused", "<-b", "fmt.Println"} {
+		if strings.Contains(output, unwanted) {
+			t.Errorf("unexpected %q in output:\n%s", unwanted, output)
+		}
+	}
+}
+
+func TestAltTimeoutTimerReuse(t *testing.T) {
+	input := `PROC poll(CHAN OF INT c?)
+  TIMER tim:
+  INT t, x:
+  SEQ
+    tim ? t
+    ALT
+      c ? x
+        SKIP
+      tim ? AFTER t
+        SKIP
+    WHILE TRUE
+      SEQ i = 0 FOR 3
+        ALT
+          c ? x
+            SKIP
+          tim ? AFTER (t + 1000)
+            SKIP
+    PAR i = 0 FOR 2
+      WHILE TRUE
+        ALT
+          c ? x
+            SKIP
+          tim ? AFTER t
+            SKIP
+:
+`
+	output := transpile(t, input)
+
+	// One timer per loop nest, declared before the outermost loop
+	if strings.Count(output, "*time.Timer\n") != 2 {
+		t.Errorf("expected two timer declarations, got:\n%s", output)
+	}
+	want := "var _altTimer0 *time.Timer\n\tfor true {"
+	if !strings.Contains(output, want) {
+		t.Errorf("expected %q in output, got:\n%s", want, output)
+	}
+	if !strings.Contains(output, "case <-_altAfter(&_altTimer0, (t + 1000)):") {
+		t.Errorf("expected ALT in loop to reuse _altTimer0, got:\n%s", output)
+	}
+	// Outside a loop, time.After is still used
+	if !strings.Contains(output, "case <-time.After(time.Duration(t - int(time.Now().UnixMicro())) * time.Microsecond):") {
+		t.Errorf("expected time.After for ALT outside a loop, got:\n%s", output)
+	}
+	// A WHILE in a replicated PAR gets a timer per goroutine
+	if !strings.Contains(output, "case <-_altAfter(&_altTimer1, t):") {
+		t.Errorf("expected ALT in replicated PAR loop to use _altTimer1, got:\n%s", output)
+	}
+	if !strings.Contains(output, "func _altAfter(t **time.Timer, deadline int) <-chan time.Time {") {
+		t.Errorf("expected _altAfter helper, got:\n%s", output)
+	}
+}
+
+func TestOptLevels(t *testing.T) {
+	input := `PROC poll(CHAN OF INT a?, b?)
+  TIMER tim:
+  INT t, x:
+  SEQ
+    tim ? t
+    WHILE TRUE
+      ALT
+        FALSE & a ? x
+          SKIP
+        TRUE & b ? x
+          SKIP
+        tim ? AFTER t
+          SKIP
+:
+`
+	const folded, timer = "case x = <-b:", "_altAfter(&_altTimer"
+	tests := []struct {
+		name        string
+		opts        []Option
+		fold, reuse bool
+	}{
+		{"default", nil, true, true},
+		{"O2", []Option{WithOptLevel(2)}, true, true},
+		{"O1", []Option{WithOptLevel(1)}, true, false},
+		{"O0", []Option{WithOptLevel(0)}, false, false},
+		{"O0 with reuse-timers", []Option{WithOptLevel(0), WithPass("reuse-timers", true)}, false, true},
+		{"O2 without fold-guards", []Option{WithPass("fold-guards", false)}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, _ := transpileWithOptions(t, input, tt.opts...)
+			if got := strings.Contains(output, folded) && !strings.Contains(output, "if false"); got != tt.fold {
+				t.Errorf("expected guards folded %v:\n%s", tt.fold, output)
+			}
+			if got := strings.Contains(output, timer); got != tt.reuse {
+				t.Errorf("expected timer reuse %v:\n%s", tt.reuse, output)
+			}
+			if !tt.reuse && !strings.Contains(output, "time.After(") {
+				t.Errorf("expected time.After without timer reuse:\n%s", output)
+			}
+		})
+	}
+}
+
+func TestAbbreviationOrdering(t *testing.T) {
+	input := `VAL INT total IS double(base) + offset:
+VAL INT base IS 20:
+INT FUNCTION double(VAL INT n)
+  INT base:
+  VALOF
+    base := n * scale
+    RESULT base
+:
+VAL INT scale IS 2:
+VAL INT offset IS 2:
+PROC main()
+  print.int(total)
+:
+`
+	output := transpile(t, input)
+
+	// scale is reached through double; double's own base is a local
+	want := "var scale int = 2\nvar base int = 20\nvar offset int = 2\nvar total int = (double(base) + offset)\n"
+	if !strings.Contains(output, want) {
+		t.Errorf("expected %q in output, got:\n%s", want, output)
+	}
+}
+
+func TestAbbreviationCycle(t *testing.T) {
+	input := `VAL INT a IS f(1):
+VAL INT b IS a + 1:
+INT FUNCTION f(VAL INT n)
+  INT r:
+  VALOF
+    r := n + b
+    RESULT r
+:
+VAL INT c IS 1:
+PROC main()
+  print.int(a + c)
+:
+`
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	gen := New()
+	gen.Generate(program)
+
+	want := []string{"line 2: abbreviation b is part of an initialization cycle: a -> f() -> b -> a"}
+	if fmt.Sprint(gen.Errors()) != fmt.Sprint(want) {
+		t.Errorf("expected errors %v, got %v", want, gen.Errors())
+	}
+}
+
+func TestPlacedPar(t *testing.T) {
+	input := `PROC main()
+  CHAN OF INT c:
+  INT x:
+  PLACE x AT #100:
+  PLACED PAR
+    PROCESSOR 0 T8
+      c ! 1
+    PROCESSOR 1 T8
+      INT y:
+      SEQ
+        c ? y
+        x := y
+:
+`
+	output, _ := transpileWithOptions(t, input)
+	for _, s := range []string{
+		"// PLACE x AT 256\n",
+		"// PLACED PAR\n",
+		"wg.Add(2)",
+		"\t\tdefer wg.Done()\n\t\tdefer _parRecover(\"\", 1, \"line 5\", \"PROC main\")\n\t\t// PROCESSOR 0 T8\n\t\tc <- 1\n",
+		"// PROCESSOR 1 T8\n\t\tvar y int\n",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	gen := New(WithRejectPlacement(true))
+	gen.Generate(program)
+
+	want := []string{
+		"line 4: PLACE x AT cannot place at an address",
+		"line 5: PLACED PAR cannot place processes on processors",
+	}
+	if fmt.Sprint(gen.Errors()) != fmt.Sprint(want) {
+		t.Errorf("expected errors %v, got %v", want, gen.Errors())
+	}
+}
+
+func TestArrayComparison(t *testing.T) {
+	input := `PROC p(VAL []BYTE cmd, VAL []INT xs, VAL INT n, VAL [][]INT m)
+  BOOL b:
+  SEQ
+    b := cmd = "quit"
+    b := xs <> [1, 2]
+    b := n = 2
+    b := m <> [[1, 2]]
+    b := m[0] = xs
+:
+`
+	output := transpile(t, input)
+	for _, s := range []string{
+		`"bytes"`,
+		`"slices"`,
+		`"reflect"`,
+		`b = bytes.Equal(cmd, []byte("quit"))`,
+		`b = !slices.Equal(xs, []int{1, 2})`,
+		`b = (n == 2)`,
+		`b = !reflect.DeepEqual(m, [][]int{{1, 2}})`,
+		`b = slices.Equal(m[0], xs)`,
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+
+	output = transpile(t, "PROC q(VAL INT n)\n  BOOL b:\n  b := n = 2\n:\n")
+	if strings.Contains(output, `"bytes"`) || strings.Contains(output, `"slices"`) {
+		t.Errorf("expected no bytes or slices import without array comparisons:\n%s", output)
+	}
+}
+
+func TestGoVersion(t *testing.T) {
+	input := `PROC p(VAL []INT xs, []CHAN OF INT cs)
+  BOOL b:
+  SEQ
+    b := xs = [1, 2]
+    PAR i = 0 FOR SIZE cs
+      cs[i] ! i
+:
+`
+	output, _ := transpileWithOptions(t, input)
+	for _, s := range []string{"\t\ti := i\n", "slices.Equal(xs, []int{1, 2})"} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+
+	// Go 1.22 gives each iteration its own loop variable
+	output, _ = transpileWithOptions(t, input, WithGoVersion(22))
+	if strings.Contains(output, "i := i") {
+		t.Errorf("unexpected loop variable copy for Go 1.22:\n%s", output)
+	}
+
+	// Go 1.20 has no package slices
+	output, _ = transpileWithOptions(t, input, WithGoVersion(20))
+	for _, s := range []string{"_sliceEqual(xs, []int{1, 2})", "func _sliceEqual[T comparable](a, b []T) bool {", "i := i"} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output for Go 1.20:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, `"slices"`) {
+		t.Errorf("unexpected slices import for Go 1.20:\n%s", output)
+	}
+}
+
+func TestParseGoVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		minor   int
+		err     bool
+	}{
+		{"1.22", 22, false},
+		{"1.21.5", 21, false},
+		{"go1.18", 18, false},
+		{"1.17", 0, true},
+		{"2.0", 0, true},
+		{"1.x", 0, true},
+		{"1.+2", 0, true},
+		{"1", 0, true},
+	} {
+		minor, err := ParseGoVersion(tt.version)
+		if (err != nil) != tt.err || minor != tt.minor {
+			t.Errorf("ParseGoVersion(%q) = %d, %v", tt.version, minor, err)
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	input := `PROC serve(CHAN OF INT a, b, []CHAN OF INT cs)
+  INT x:
+  SEQ
+    ALT
+      a ? x
+        SKIP
+      b ? x
+        SKIP
+    ALT i = 0 FOR SIZE cs
+      cs[i] ? x
+        SKIP
+:
+SEQ
+  SKIP
+`
+	output, _ := transpileWithOptions(t, input, WithDeterministic(true))
+	for _, s := range []string{
+		"\"runtime\"",
+		"func main() {\n\t// -deterministic: one thread without asynchronous preemption, so goroutines\n\t// switch where they block or, once they have run for 10ms, at a function call\n\t_preemptOff()\n\truntime.GOMAXPROCS(1)\n",
+		"\"os/exec\"",
+		"cmd.Env = append(os.Environ(), \"GODEBUG=\"+godebug+\"asyncpreemptoff=1\")",
+		"\tselect {\n\tcase x = <-a: // a ? x\n\t\t// SKIP\n\tdefault:\n\t\tselect {\n\t\tcase x = <-b: // b ? x\n",
+		"\t\tdefault:\n\t\t\tselect {\n\t\t\tcase x = <-a: // a ? x\n\t\t\t\t// SKIP\n\t\t\tcase x = <-b: // b ? x\n",
+		"func _priSelect(cases []reflect.SelectCase) (int, reflect.Value) {",
+		"_altChosen, _altValue := _priSelect(_altCases)",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+
+	output, _ = transpileWithOptions(t, input)
+	for _, s := range []string{"runtime", "default:", "_priSelect", "_preemptOff"} {
+		if strings.Contains(output, s) {
+			t.Errorf("unexpected %q in output without WithDeterministic:\n%s", s, output)
+		}
+	}
+}
+
+func TestAltCaseComments(t *testing.T) {
+	input := `PROC serve([]CHAN OF INT in, CHAN OF INT a, VAL INT max)
+  INT n, x:
+  TIMER tim:
+  SEQ
+    n := 0
+    ALT
+      (n < max) & in[1] ? x -- the guard, without this comment
+        SKIP
+      a ? x
+        SKIP
+      tim ? AFTER n PLUS
+          100
+        SKIP
+      (n > max) & SKIP
+        SKIP
+    ALT i = 0 FOR SIZE in
+      in[i] ? x
+        SKIP
+:
+`
+	output := transpile(t, input)
+	for _, want := range []string{
+		"\tcase x = <-_alt0: // (n < max) & in[1] ? x\n",
+		"\tcase x = <-a: // a ? x\n",
+		"* time.Microsecond): // tim ? AFTER n PLUS 100\n",
+		"\tdefault: // (n > max) & SKIP\n",
+		"reflect.ValueOf(in[i])}) // in[i] ? x\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+}
+
+func TestPriAlt(t *testing.T) {
+	// PRI ALT polls its cases in order before blocking on all of them; a
+	// plain ALT stays a single select
+	input := `PROC serve(CHAN OF INT a, b, []CHAN OF INT cs)
+  INT x:
+  SEQ
+    PRI ALT
+      a ? x
+        SKIP
+      b ? x
+        SKIP
+    PRI ALT i = 0 FOR SIZE cs
+      cs[i] ? x
+        SKIP
+    ALT i = 0 FOR SIZE cs
+      cs[i] ? x
+        SKIP
+:
+SEQ
+  SKIP
+`
+	output, _ := transpileWithOptions(t, input)
+	for _, s := range []string{
+		"\tselect {\n\tcase x = <-a: // a ? x\n\t\t// SKIP\n\tdefault:\n\t\tselect {\n\t\tcase x = <-b: // b ? x\n",
+		"func _priSelect(cases []reflect.SelectCase) (int, reflect.Value) {",
+		"_altChosen, _altValue := _priSelect(_altCases)",
+		"_altChosen, _altValue, _ := reflect.Select(_altCases)",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, "runtime") {
+		t.Errorf("unexpected runtime setup without WithDeterministic:\n%s", output)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	input := `PROTOCOL MSG
+  CASE
+    num; INT
+    done
+:
+PROTOCOL PAIR IS INT; INT
+PROC p(CHAN OF MSG out!, CHAN OF PAIR pairs!)
+  INT hi, lo:
+  SEQ
+    hi, lo := LONGPROD(2, 3, INT TRUE)
+    out ! num; lo
+    out ! done
+    pairs ! hi; lo
+:
+`
+	output, _ := transpileWithOptions(t, input, WithPrefix("lib"))
+	for _, s := range []string{
+		"type lib_proto_MSG interface {",
+		"func (lib_proto_MSG_num) _is_MSG() {}",
+		"type lib_proto_PAIR struct {",
+		"func p(out chan<- lib_proto_MSG, pairs chan<- lib_proto_PAIR) {",
+		"out <- lib_proto_MSG_done{}",
+		"pairs <- lib_proto_PAIR{hi, lo}",
+		"func lib_LONGPROD(",
+		"lib_LONGPROD(2, 3, lib_boolToInt(true))",
+		"func lib_boolToInt(b bool) int {",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, " _proto_") || strings.Contains(output, " _boolToInt") {
+		t.Errorf("unprefixed generated name in output:\n%s", output)
+	}
+}
+
+func TestConversionBuiltins(t *testing.T) {
+	input := `PROC p()
+  [12]BYTE buf:
+  INT len:
+  BOOL err:
+  SEQ
+    INTTOSTRING(len, buf, 42)
+    STRINGTOINT(err, len, "7")
+:
+`
+	output := transpile(t, input)
+	for _, s := range []string{
+		`"strconv"`,
+		"func _INTTOSTRING(n *int, s []byte, x int) {",
+		"func _STRINGTOINT(err *bool, n *int, s []byte) {",
+		"_INTTOSTRING(&_len, buf, 42)",
+		`_STRINGTOINT(&err, &_len, []byte("7"))`,
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, "_REAL64TOSTRING") || strings.Contains(output, "_formatReal") {
+		t.Errorf("helper for an unused conversion in output:\n%s", output)
+	}
+}
+
+func TestConversionBuiltinDeclared(t *testing.T) {
+	// A PROC of the same name, e.g. from an #INCLUDEd library, is used instead
+	input := `PROC INTTOSTRING(INT len, []BYTE string, VAL INT n)
+  len := 0
+:
+PROC p()
+  [12]BYTE buf:
+  INT len:
+  INTTOSTRING(len, buf, 42)
+:
+`
+	output := transpile(t, input)
+	if strings.Contains(output, "_INTTOSTRING") || strings.Contains(output, "strconv") {
+		t.Errorf("builtin INTTOSTRING used despite declaration:\n%s", output)
+	}
+	if !strings.Contains(output, "\tINTTOSTRING(&_len, buf, 42)") {
+		t.Errorf("expected call to declared INTTOSTRING in output:\n%s", output)
+	}
+}
+
+func TestPackage(t *testing.T) {
+	input := `PROTOCOL PAIR IS INT; INT
+INT FUNCTION double(VAL INT x)
+  IS x * 2
+:
+PROC send(CHAN OF PAIR out!)
+  out ! double(1); 2
+:
+PROC run(CHAN OF BYTE keyboard?, screen!, error!)
+  send(screen!)
+:
+`
+	output, _ := transpileWithOptions(t, input, WithPackage("occlib"))
+	for _, s := range []string{
+		"package occlib\n",
+		"type Proto_PAIR struct {\n\tF0 int\n\tF1 int\n}",
+		"func Double(x int) int {",
+		"func Send(out chan<- Proto_PAIR) {",
+		"out <- Proto_PAIR{Double(1), 2}",
+		"func Run(",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, "func main()") {
+		t.Errorf("unexpected main in package output:\n%s", output)
+	}
+}
+
+func TestPackageErrorWrappers(t *testing.T) {
+	input := `PROTOCOL ERR
+  CASE
+    bad; BYTE
+    empty
+:
+PROC parse(VAL []BYTE s, INT n, CHAN OF ERR error!)
+  n := SIZE s
+:
+PROC both(CHAN OF ERR error!, err!)
+  SKIP
+:
+`
+	output, _ := transpileWithOptions(t, input, WithPackage("occlib"), WithErrorWrappers(true))
+	for _, s := range []string{
+		"func ParseErr(s []byte) (int, error) {",
+		"\tParse(s, &n, _errs)\n",
+		"return n, _err",
+		"func (m Proto_ERR_bad) Error() string { return fmt.Sprintf(\"bad; %q\", m.F0) }",
+		"func (Proto_ERR_empty) Error() string { return \"empty\" }",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, "func BothErr(") {
+		t.Errorf("expected no wrapper for a PROC with two error channels:\n%s", output)
+	}
+
+	clash := `PROTOCOL ERR
+  CASE
+    empty
+:
+PROC parse(CHAN OF ERR error!)
+  SKIP
+:
+PROC parseErr()
+  SKIP
+:
+`
+	output, warnings := transpileWithOptions(t, clash, WithPackage("occlib"), WithErrorWrappers(true))
+	if strings.Count(output, "func ParseErr(") != 1 {
+		t.Errorf("expected no wrapper clashing with PROC parseErr:\n%s", output)
+	}
+	want := "line 5: no error wrapper for PROC parse: ParseErr is already declared"
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("expected warning %q, got %v", want, warnings)
+	}
+}
+
+func TestPackageRejectsMainStatements(t *testing.T) {
+	input := `SEQ
+  print.int(1)
+`
+	gen := New(WithPackage("occlib"))
+	output := gen.Generate(parser.New(lexer.New(input)).ParseProgram())
+	want := "package occlib: statements outside PROCs and FUNCTIONs need a program, not a package"
+	if len(gen.Errors()) != 1 || gen.Errors()[0] != want {
+		t.Errorf("expected error %q, got %v", want, gen.Errors())
+	}
+	if strings.Contains(output, "func main()") {
+		t.Errorf("unexpected main in package output:\n%s", output)
+	}
+}
+
+func TestPriPar(t *testing.T) {
+	input := `PROC p(CHAN OF INT c)
+  INT x:
+  PRI PAR
+    c ! 1
+    WHILE TRUE
+      c ? x
+:
+PROC q()
+  PRI PAR i = 0 FOR 2
+    SKIP
+:
+`
+	output, _ := transpileWithOptions(t, input)
+	if strings.Contains(output, "runtime") {
+		t.Errorf("expected PRI PAR to be PAR by default:\n%s", output)
+	}
+
+	output, _ = transpileWithOptions(t, input, WithPriPar(PriParLockThread))
+	if !strings.Contains(output, "defer _parRecover(\"\", 1, \"line 3\", \"PROC p\")\n\t\truntime.LockOSThread()\n\t\tdefer runtime.UnlockOSThread()\n\t\tc <- 1\n") {
+		t.Errorf("expected the first branch locked to its thread:\n%s", output)
+	}
+	if !strings.Contains(output, "if i == 0 {\n\t\t\t\truntime.LockOSThread()\n") {
+		t.Errorf("expected the first iteration locked to its thread:\n%s", output)
+	}
+	if strings.Contains(output, "Gosched") {
+		t.Errorf("expected no yields with lock-thread:\n%s", output)
+	}
+
+	output, _ = transpileWithOptions(t, input, WithPriPar(PriParYield))
+	if !strings.Contains(output, "defer _parRecover(\"\", 2, \"line 3\", \"PROC p\")\n\t\truntime.Gosched()\n\t\tfor true {\n\t\t\truntime.Gosched()\n") {
+		t.Errorf("expected the second branch to yield at its start and in its loop:\n%s", output)
+	}
+	if !strings.Contains(output, "_priLow0 := i != 0\n\t\t\tif _priLow0 {\n\t\t\t\truntime.Gosched()\n") {
+		t.Errorf("expected later iterations to yield:\n%s", output)
+	}
+	if strings.Contains(output, "LockOSThread") || !strings.Contains(output, "\t\"runtime\"\n") {
+		t.Errorf("expected runtime imported for yields only:\n%s", output)
+	}
+
+	if m, err := ParsePriPar("lock-thread"); err != nil || m != PriParLockThread || m.String() != "lock-thread" {
+		t.Errorf("expected lock-thread to parse, got %v, %v", m, err)
+	}
+	if _, err := ParsePriPar("realtime"); err == nil {
+		t.Error("expected an error for an unknown PRI PAR mode")
+	}
+}
+
+func TestValofExprType(t *testing.T) {
+	output := transpile(t, `PROC p(BYTE x, VAL INT y)
+  x := (VALOF
+          SKIP
+          RESULT BYTE y)
+:
+`)
+	if !strings.Contains(output, "*x = func() byte {\n\t\t// SKIP\n\t\treturn byte(y)\n\t}()\n") {
+		t.Errorf("expected a closure returning the converted result:\n%s", output)
+	}
+
+	p := parser.New(lexer.New("PROC p(INT x, VAL INT y)\n  x := (VALOF\n          SKIP\n          RESULT y)\n:\n"))
+	gen := New()
+	gen.Generate(p.ParseProgram())
+	want := []string{"line 2: cannot tell the type of the VALOF's RESULT: declare the variable it names in the VALOF, or convert it (INT x)"}
+	if fmt.Sprint(gen.Errors()) != fmt.Sprint(want) {
+		t.Errorf("expected errors %v, got %v", want, gen.Errors())
+	}
+}
+
+func TestArrayConstructor(t *testing.T) {
+	output := transpile(t, `PROC p(VAL INT n)
+  VAL []BYTE codes IS [i = 0 FOR n STEP 2 | 'a']:
+  SKIP
+:
+`)
+	want := "\tvar codes []byte = func() []byte {\n" +
+		"\t\t_table0 := make([]byte, 0, n)\n" +
+		"\t\tfor _repl_i := 0; _repl_i < n; _repl_i++ {\n" +
+		"\t\t\t_table0 = append(_table0, byte(97))\n" +
+		"\t\t}\n" +
+		"\t\treturn _table0\n" +
+		"\t}()\n"
+	if !strings.Contains(output, want) {
+		t.Errorf("expected a closure appending each element, typed by the abbreviation:\n%s", output)
+	}
+}
+
+func TestCycleProcs(t *testing.T) {
+	output := transpile(t, `PROC p(CHAN OF INT in?, out!)
+  CHAN OF INT c:
+  PAR
+    id(in?, c!)
+    succ(c?, out!)
+:
+`)
+	if !strings.Contains(output, "\t\t_id(in, c)\n") || !strings.Contains(output, "func _id(in <-chan int, out chan<- int) {\n\tfor {\n\t\tout <- <-in\n\t}\n}\n") {
+		t.Errorf("expected a call of the built-in id:\n%s", output)
+	}
+	if !strings.Contains(output, "func _succ(") || strings.Contains(output, "func _delta(") {
+		t.Errorf("expected helpers for the processes called only:\n%s", output)
+	}
+
+	// The program's own PROC wins
+	output = transpile(t, `PROC id(CHAN OF INT in?, out!)
+  SKIP
+:
+PROC p(CHAN OF INT in?, out!)
+  id(in?, out!)
+:
+`)
+	if strings.Contains(output, "_id") || !strings.Contains(output, "\tid(in, out)\n") {
+		t.Errorf("expected a call of the program's id:\n%s", output)
+	}
+
+	// -O0 turns the cycle-builtins pass, and the declarations sema is
+	// given, off
+	if len(CycleDecls()) != len(cycleProcs) || CycleDecls(WithOptLevel(0)) != nil || CycleDecls(WithOptLevel(0), WithPass("cycle-builtins", true)) == nil {
+		t.Error("expected the building-block declarations unless the cycle-builtins pass is off")
+	}
+	output, _ = transpileWithOptions(t, "PROC p(CHAN OF INT in?)\n  consume(in?)\n:\n", WithOptLevel(0))
+	if strings.Contains(output, "_consume") {
+		t.Errorf("expected no built-in consume at -O0:\n%s", output)
+	}
+}
+
+func TestExtendedInput(t *testing.T) {
+	input := `PROC p(CHAN OF INT c?, out!)
+  INT x:
+  c ?? x
+    out ! x
+:
+`
+	output, warnings := transpileWithOptions(t, input)
+	want := []string{"line 3: extended input on c releases its sender when the message arrives, not when the extended process ends"}
+	if fmt.Sprint(warnings) != fmt.Sprint(want) {
+		t.Errorf("expected warnings %v, got %v", want, warnings)
+	}
+	if !strings.Contains(output, "x = <-c\n\tout <- x\n") || strings.Contains(output, "_received") {
+		t.Errorf("expected a plain input then the extended process:\n%s", output)
+	}
+
+	output, warnings = transpileWithOptions(t, input, WithExtendedRendezvous(true))
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings with the rendezvous, got %v", warnings)
+	}
+	if !strings.Contains(output, "x = <-c\n\t_ext0 := _taken(c)\n\tout <- x\n\t_sent(out)\n\t_release(_ext0)\n") {
+		t.Errorf("expected the sender's release taken on input and given after the extended process:\n%s", output)
+	}
+
+	p := parser.New(lexer.New(input))
+	gen := New(WithExtendedRendezvous(true), WithPackage("lib"))
+	gen.Generate(p.ParseProgram())
+	if want := []string{"package lib: extended rendezvous needs a program, not a package"}; fmt.Sprint(gen.Errors()) != fmt.Sprint(want) {
+		t.Errorf("expected errors %v, got %v", want, gen.Errors())
+	}
+}
+
+func TestLargeTables(t *testing.T) {
+	var elems []string
+	for i := 0; i < 20; i++ {
+		elems = append(elems, fmt.Sprint(i-2))
+	}
+	input := "VAL []INT t IS [" + strings.Join(elems, ", ") + "]:\nVAL [][2]BYTE s IS [[1, 2], [3, 4], [5, 6]]:\nPROC p()\n  SKIP\n:\n"
+
+	output, _ := transpileWithOptions(t, input)
+	if !strings.Contains(output, "var t []int = []int{") || strings.Contains(output, "[]int{\n") {
+		t.Errorf("expected small tables on one line:\n%s", output)
+	}
+
+	output, _ = transpileWithOptions(t, input, WithTableThreshold(5))
+	for _, want := range []string{
+		"var t []int = []int{\n\t-2, -1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13,\n\t14, 15, 16, 17,\n}\n",
+		"var s [][]byte = [][]byte{\n\t{1, 2},\n\t{3, 4},\n\t{5, 6},\n}\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+
+	output, _ = transpileWithOptions(t, input, WithTableThreshold(5), WithTableData(true))
+	for _, want := range []string{
+		"func _tableInts[T ~int | ~int16 | ~int32 | ~int64](data string, n int) []T {",
+		"var t []int = _tableInts[int](\"\\x03\\x01\\x00\\x02\\x04",
+		"var s [][]byte = [][]byte{\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	input := `PROTOCOL PAIR IS INT ; INT
+PROTOCOL REPORT
+  CASE
+    bad; INT
+    done
+:
+VAL INT N IS 4:
+PROC sum(CHAN OF PAIR in?, [N]INT hist, VAL []BYTE name, INT total, CHAN OF REPORT error!)
+  SKIP
+:
+INT, BOOL FUNCTION half(VAL INT x)
+  VALOF
+    SKIP
+    RESULT x / 2, (x \ 2) = 0
+:
+`
+	program := parser.New(lexer.New(input)).ParseProgram()
+	gen := New(WithPackage("occlib"), WithErrorWrappers(true))
+	gen.Generate(program)
+
+	want := Manifest{
+		Package: "occlib",
+		Procs: []ManifestProc{
+			{
+				Name: "sum", GoName: "Sum", Kind: "PROC",
+				Params: []ManifestParam{
+					{Name: "in", Kind: "chan", ManifestType: ManifestType{"CHAN OF PAIR", "<-chan Proto_PAIR"}, Protocol: "PAIR", Direction: "in"},
+					{Name: "hist", Kind: "ref", ManifestType: ManifestType{"[N]INT", "[]int"}},
+					{Name: "name", Kind: "val", ManifestType: ManifestType{"[]BYTE", "[]byte"}},
+					{Name: "total", Kind: "ref", ManifestType: ManifestType{"INT", "*int"}},
+					{Name: "error", Kind: "chan", ManifestType: ManifestType{"CHAN OF REPORT", "chan<- Proto_REPORT"}, Protocol: "REPORT", Direction: "out"},
+				},
+				ErrFunc: "SumErr",
+			},
+			{
+				Name: "half", GoName: "Half", Kind: "FUNCTION",
+				Params:  []ManifestParam{{Name: "x", Kind: "val", ManifestType: ManifestType{"INT", "int"}}},
+				Results: []ManifestType{{"INT", "int"}, {"BOOL", "bool"}},
+			},
+		},
+		Protocols: []ManifestProtocol{
+			{Name: "PAIR", GoName: "Proto_PAIR", Kind: "sequential", Items: []string{"INT", "INT"}, Fields: []string{"int", "int"}},
+			{Name: "REPORT", GoName: "Proto_REPORT", Kind: "variant", Variants: []ManifestVariant{
+				{Tag: "bad", GoName: "Proto_REPORT_bad", Items: []string{"INT"}, Fields: []string{"int"}},
+				{Tag: "done", GoName: "Proto_REPORT_done"},
+			}},
+		},
+	}
+	if got := gen.Manifest(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected manifest\n%+v\ngot\n%+v", want, got)
+	}
+
+	gen = New()
+	gen.Generate(program)
+	if got := gen.Manifest(); !reflect.DeepEqual(got, Manifest{}) {
+		t.Errorf("expected no manifest for a program, got %+v", got)
+	}
+}
+
+func TestRuntime(t *testing.T) {
+	// The library's own declaration is dropped in favour of the runtime
+	input := `PROC out.string(VAL []BYTE s, VAL INT field, CHAN BYTE out!)
+  SEQ i = 0 FOR SIZE s
+    out ! s[i]
+:
+PROC greet(CHAN BYTE keyboard?, screen!, error!)
+  INT n:
+  SEQ
+    out.string("n? ", 0, screen!)
+    in.int(n, 4, keyboard?, screen!)
+    IF
+      equal.string("a", "b")
+        out.int(n, 0, screen!)
+      TRUE
+        SKIP
+:
+`
+	output, _ := transpileWithOptions(t, input, WithRuntime(true))
+	for _, want := range []string{
+		`occrt "github.com/codeassociates/occam2go/runtime"`,
+		`occrt.OutString([]byte("n? "), 0, screen)`,
+		`occrt.InInt(&n, 4, keyboard, screen)`,
+		`occrt.EqualString([]byte("a"), []byte("b"))`,
+		`occrt.OutInt(n, 0, screen)`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "func out_string(") {
+		t.Errorf("library declaration of out.string not dropped:\n%s", output)
+	}
+}
+
+func TestRuntimeNeedsDefaultTypes(t *testing.T) {
+	gen := New(WithRuntime(true), WithTypeMap(map[string]string{"INT": "int32"}))
+	gen.Generate(parser.New(lexer.New("PROC p(CHAN BYTE out!)\n  out.int(1, 0, out!)\n:\n")).ParseProgram())
+	want := "the course library runtime needs INT as int, not int32"
+	if len(gen.Errors()) != 1 || gen.Errors()[0] != want {
+		t.Errorf("expected error %q, got %v", want, gen.Errors())
+	}
+}
+
+func TestStats(t *testing.T) {
+	input := `PROTOCOL MSG IS INT:
+PROC worker([]CHAN OF INT cs?, CHAN OF INT out!)
+  INT x:
+  ALT i = 0 FOR SIZE cs
+    cs[i] ? x
+      out ! x
+:
+PROC main()
+  [3]CHAN OF INT cs:
+  CHAN OF INT out:
+  INT port, y:
+  PLACE port AT #40:
+  PAR
+    worker(cs, out)
+    cs[0] ! 1
+    PRI ALT
+      out ? y
+        SKIP
+:
+`
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	gen := New(WithDeterministic(true))
+	output := gen.Generate(program)
+	stats := gen.Stats()
+
+	want := Stats{
+		Procs:       2,
+		Channels:    2,
+		ParBranches: 3,
+		Alts:        2,
+		ReflectAlts: []string{"line 4: replicated ALT"},
+		Protocols:   1,
+		Skipped:     []string{"line 12: PLACE port AT (placement)"},
+		Lines:       strings.Count(output, "\n"),
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+}
+
+func TestWordSize(t *testing.T) {
+	input := `VAL N IS 4:
+PROC p()
+  [N]INT a:
+  INT x, t:
+  TIMER tim:
+  SEQ
+    x := MOSTPOS INT
+    SEQ i = 0 FOR SIZE a
+      a[i] := i
+    tim ? t
+    x, t := LONGPROD(x, t, 0)
+:
+`
+	tests := []struct {
+		bits int
+		want []string
+	}{
+		{0, []string{"var N = 4", "var x, t int", "x = math.MaxInt", "for i := 0; i < 0 + len(a); i++", "t = int(time.Now().UnixMicro())", "_LONGPROD(a, b, c int) (int, int)"}},
+		{32, []string{"var N = int32(4)", "var x, t int32", "x = math.MaxInt32", "for i := int32(0); i < 0 + int32(len(a)); i++", "t = int32(time.Now().UnixMicro())", "_LONGPROD(a, b, c int32) (int32, int32)"}},
+		{64, []string{"var N = int64(4)", "var x, t int64", "x = math.MaxInt64", "for i := int64(0); i < 0 + int64(len(a)); i++", "t = int64(time.Now().UnixMicro())", "bits.Mul64(uint64(a), uint64(b))"}},
+	}
+	for _, tt := range tests {
+		output, _ := transpileWithOptions(t, input, WithWordSize(tt.bits))
+		for _, want := range tt.want {
+			if !strings.Contains(output, want) {
+				t.Errorf("word size %d: expected %q in output, got:\n%s", tt.bits, want, output)
+			}
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package codegen
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestE2E_ArrayBasic(t *testing.T) {
 	// Test basic array: declare, store, load
@@ -443,6 +446,23 @@ func TestE2E_MixedDimAbbreviation(t *testing.T) {
 	}
 }
 
+func TestE2E_ThreeDimAbbreviation(t *testing.T) {
+	occam := `VAL [2][2][2]INT cube IS [[[1, 2], [3, 4]], [[5, 6], [7, 8]]]:
+VAL []BYTE hi IS [72, 105]:
+PROC main()
+  SEQ
+    print.int(cube[1][0][1])
+    print.int(cube[0][1][0])
+    print.int(INT hi[1])
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "6\n3\n105\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_MixedDimProcParam(t *testing.T) {
 	// PROC with [][2]INT parameter
 	occam := `PROC print.pairs(VAL [][2]INT pairs)
@@ -477,3 +497,150 @@ func TestE2E_MultiDimOpenAbbreviation(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_ChanArrayAbbreviation(t *testing.T) {
+	// A segment of a channel array keeps its protocol, and SIZE is the
+	// segment's; a single channel abbreviation keeps its element type
+	occam := `PROTOCOL PAIR IS INT ; INT
+PROC worker(CHAN OF PAIR out!, VAL INT id)
+  out ! id ; id * 10
+:
+PROC sum([]CHAN OF PAIR in, INT total)
+  SEQ
+    total := 0
+    SEQ i = 0 FOR SIZE in
+      INT a, b:
+      SEQ
+        in[i] ? a ; b
+        total := total + (a + b)
+:
+SEQ
+  [6]CHAN OF PAIR links:
+  [4]CHAN BOOL flags:
+  INT total:
+  BOOL flag:
+  SEQ
+    []CHAN OF PAIR mine IS [links FROM 2 FOR 3]:
+    []CHAN BOOL fl IS [flags FROM 1 FOR 2]:
+    CHAN BOOL last! IS fl[SIZE fl - 1]:
+    PAR
+      PAR i = 0 FOR SIZE mine
+        worker(mine[i]!, i + 1)
+      sum(mine, total)
+      last ! TRUE
+      flags[2] ? flag
+    print.int(SIZE mine)
+    print.int(total)
+    print.bool(flag)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "3\n66\ntrue\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_BoundsCheck(t *testing.T) {
+	// In range subscripts and slices run as without it
+	occam := `SEQ
+  [4]INT a:
+  [2][3]INT g:
+  SEQ
+    SEQ i = 0 FOR 4
+      a[i] := i * 10
+    g[1][2] := a[3]
+    [a FROM 0 FOR 2] := [a FROM 2 FOR 2]
+    print.int(g[1][2])
+    print.int(a[0] + a[1])
+    print.int(SIZE [a FROM 4 FOR 0])
+`
+	output := transpileCompileRun(t, occam, WithBoundsCheck(true))
+	expected := "30\n50\n0\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+
+	tests := []struct {
+		name, stmt, want string
+	}{
+		{"index", "a[n] := 1", "STOP: subscript 4 out of range for array of size 4 at line 7"},
+		{"negative index", "print.int(a[n - 5])", "STOP: subscript -1 out of range for array of size 4 at line 7"},
+		{"inner index", "g[0][n] := a[0]", "STOP: subscript 4 out of range for array of size 3 at line 7"},
+		{"slice past end", "print.int(SIZE [a FROM 2 FOR n])", "STOP: [FROM 2 FOR 4] out of range for array of size 4 at line 7"},
+		{"negative count", "print.int(SIZE [a FROM 1 FOR n - 5])", "STOP: [FROM 1 FOR -1] out of range for array of size 4 at line 7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			occam := `SEQ
+  [4]INT a:
+  [2][3]INT g:
+  INT n:
+  SEQ
+    n := 4
+    ` + tt.stmt + `
+`
+			output := transpileCompileRunFailing(t, occam, WithBoundsCheck(true))
+			if !strings.Contains(output, tt.want) {
+				t.Errorf("expected %q, got:\n%s", tt.want, output)
+			}
+		})
+	}
+}
+
+func TestE2E_LargeTables(t *testing.T) {
+	// Tables above the threshold, laid out over several lines or encoded
+	// as data, read back the same, including values that need every byte
+	// of a varint and BYTEs that are not valid UTF-8
+	occam := `VAL []INT32 wide IS [MOSTNEG INT32, -1, 0, 1, 300, MOSTPOS INT32]:
+VAL []INT sine IS [0, 17, 34, -50, -100, 1000000]:
+VAL []BYTE raw IS [0, 255, #C0, '*n', 127, 128]:
+VAL [][2]INT16 pairs IS [[1, -1], [2, -2], [3, -3]]:
+PROC main()
+  SEQ
+    SEQ i = 0 FOR SIZE wide
+      print.int(INT wide[i])
+    print.int(sine[3] + sine[5])
+    SEQ i = 0 FOR SIZE raw
+      print.int(INT raw[i])
+    print.int(INT pairs[2][1])
+:
+`
+	expected := "-2147483648\n-1\n0\n1\n300\n2147483647\n999950\n0\n255\n192\n10\n127\n128\n-3\n"
+	for _, data := range []bool{false, true} {
+		output := transpileCompileRun(t, occam, WithTableThreshold(5), WithTableData(data))
+		if output != expected {
+			t.Errorf("data %v: expected %q, got %q", data, expected, output)
+		}
+	}
+}
+
+func TestE2E_ArrayConstructor(t *testing.T) {
+	// Replicated constructors build their arrays element by element, typed
+	// by the declaration or assignment they are in where there is one
+	occam := `VAL []INT squares IS [i = 0 FOR 5 | i * i]:
+PROC main()
+  INT n:
+  SEQ
+    n := 4
+    VAL []BYTE letters IS [i = 0 FOR n | BYTE (i + (INT 'a'))]:
+    [4]INT evens:
+    [3][2]INT pairs:
+    [3]BOOL odd:
+    SEQ
+      evens := [i = 0 FOR 4 STEP 2 | i + 1]
+      pairs := [i = 1 FOR 3 | [i, -i]]
+      odd := [i = 0 FOR 3 | (i \ 2) = 1]
+      print.int(squares[4])
+      print.int(INT letters[3])
+      print.int(evens[3])
+      print.int(pairs[2][1])
+      print.bool(odd[1])
+      print.int(SIZE [j = 0 FOR n STEP 3 | j])
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "16\n100\n7\n-3\ntrue\n4\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
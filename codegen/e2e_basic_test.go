@@ -170,3 +170,40 @@ func TestE2E_VarRedeclInSiblingSeqs(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_SeqScopeEndsWithSeq(t *testing.T) {
+	// The x declared in the inner SEQ hides the outer x only until that
+	// SEQ ends; the statements after it see the outer one again
+	occam := `SEQ
+  INT x:
+  SEQ
+    x := 1
+    SEQ
+      INT x:
+      SEQ
+        x := 10
+        print.int(x)
+    print.int(x)
+    IF
+      x = 1
+        INT y:
+        SEQ
+          y := 2
+          print.int(y)
+      TRUE
+        SKIP
+    SEQ
+      INT y:
+      y := 3
+      print.int(y + x)
+    INT y:
+    SEQ
+      y := 5
+      print.int(y)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "10\n1\n2\n4\n5\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
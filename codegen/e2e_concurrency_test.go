@@ -1,6 +1,9 @@
 package codegen
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestE2E_PAR(t *testing.T) {
 	// Test that PAR executes both branches
@@ -181,6 +184,72 @@ func TestE2E_TimerAltTimeout(t *testing.T) {
 	}
 }
 
+func TestE2E_TimerAltTimeoutInLoop(t *testing.T) {
+	// A polling loop whose ALT timeout reuses one timer: it must still
+	// fire on later iterations, after both receives and earlier timeouts
+	occam := `SEQ
+  TIMER tim:
+  INT t, x, sum, timeouts:
+  CHAN OF INT c:
+  PAR
+    SEQ i = 0 FOR 3
+      c ! i
+    SEQ
+      sum := 0
+      timeouts := 0
+      tim ? t
+      WHILE timeouts < 3
+        ALT
+          c ? x
+            SEQ
+              sum := sum + x
+              tim ? t
+          tim ? AFTER (t + 100000)
+            SEQ
+              timeouts := timeouts + 1
+              tim ? t
+  print.int(sum)
+  print.int(timeouts)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "3\n3\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_TimerAltGuardedTimeouts(t *testing.T) {
+	// Two timeouts and a channel in one ALT: the guard disables the earlier
+	// timeout, so the later one fires, then with the guard flipped the
+	// earlier one wins
+	occam := `SEQ
+  TIMER tim:
+  CHAN OF INT c:
+  INT t, x:
+  BOOL short:
+  SEQ i = 0 FOR 2
+    SEQ
+      short := i = 1
+      tim ? t
+      ALT
+        short & tim ? AFTER t PLUS 1000
+          print.int(1)
+        (NOT short) & tim ? AFTER t PLUS 20000
+          print.int(2)
+        short & c ? x
+          print.int(3)
+        tim ? AFTER t PLUS 2000000
+          print.int(4)
+`
+	for _, opts := range [][]Option{nil, {WithDeterministic(true)}} {
+		output := transpileCompileRun(t, occam, opts...)
+		expected := "2\n1\n"
+		if output != expected {
+			t.Errorf("expected %q, got %q", expected, output)
+		}
+	}
+}
+
 func TestE2E_TimerAfterWait(t *testing.T) {
 	// Test standalone tim ? AFTER expr (non-ALT timer wait)
 	occam := `SEQ
@@ -265,6 +334,76 @@ SEQ
 	}
 }
 
+func TestE2E_ChanDirForwarded(t *testing.T) {
+	occam := `PROC double(CHAN OF INT in, out)
+  INT x:
+  SEQ
+    in ? x
+    out ! x * 2
+
+PROC stage(CHAN OF INT in?, out!)
+  double(in, out)
+
+PROC pipeline(VAL INT n, []CHAN OF INT cs?, CHAN OF INT out!)
+  PAR
+    PAR i = 0 FOR n - 1
+      stage(cs[i], cs[i + 1])
+    stage(cs[n - 1], out)
+
+SEQ
+  [3]CHAN OF INT cs:
+  CHAN OF INT result:
+  INT x:
+  PAR
+    pipeline(3, cs, result)
+    cs[0] ! 5
+    SEQ
+      result ? x
+      print.int(x)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "40\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_Deterministic(t *testing.T) {
+	// All senders are ready before the ALTs run, so only the order of
+	// the cases decides which one each ALT takes
+	occam := `SEQ
+  CHAN OF INT a, b:
+  [3]CHAN OF INT cs:
+  TIMER tim:
+  INT t:
+  PAR
+    a ! 1
+    b ! 2
+    PAR i = 0 FOR 3
+      cs[i] ! i * 10
+    SEQ
+      tim ? t
+      tim ? AFTER t + 20000
+      SEQ k = 0 FOR 2
+        INT x:
+        ALT
+          b ? x
+            print.int(x)
+          a ? x
+            print.int(x)
+      SEQ k = 0 FOR 3
+        ALT i = 0 FOR 3
+          INT x:
+          cs[i] ? x
+            print.int(x)
+`
+	output := transpileCompileRun(t, occam, WithDeterministic(true))
+	expected := "2\n1\n0\n10\n20\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2EChanShorthand(t *testing.T) {
 	occam := `SEQ
   CHAN INT c:
@@ -370,8 +509,498 @@ func TestE2E_ReplicatedAltByte(t *testing.T) {
 	}
 }
 
+func TestE2E_ReplicatedAltMixedArms(t *testing.T) {
+	// A replicated arm beside a control channel and a timeout, in a loop
+	occam := `SEQ
+  [3]CHAN OF INT cs:
+  CHAN OF INT stop:
+  TIMER tim:
+  INT t, total, got, x:
+  BOOL running:
+  SEQ
+    tim ? t
+    total, got, running := 0, 0, TRUE
+    PAR
+      SEQ
+        PAR i = 0 FOR 3
+          cs[i] ! i + 1
+        stop ! 0
+      WHILE running
+        ALT
+          ALT i = 0 FOR 3
+            cs[i] ? x
+              total, got := total + (x * i), got + 1
+          stop ? x
+            running := FALSE
+          tim ? AFTER t + 5000000
+            running := FALSE
+    print.int(got)
+    print.int(total)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "3\n8\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ReplicatedAltSeveralCases(t *testing.T) {
+	// Each replicated index offers an input and an output guard
+	occam := `SEQ
+  [2]CHAN OF INT in, out:
+  INT x, y:
+  SEQ
+    PAR
+      out[1] ? y
+      ALT i = 0 FOR 2
+        in[i] ? x
+          SKIP
+        out[i] ! 10 + i
+          x := i
+    print.int(x)
+    print.int(y)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "1\n11\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_NestedReplicatedAlt(t *testing.T) {
+	// Replicated ALTs nested in a replicated ALT, over a grid of channels
+	occam := `SEQ
+  [2][3]CHAN OF INT grid:
+  INT row, col, v:
+  PAR
+    grid[1][2] ! 5
+    ALT i = 0 FOR 2
+      ALT j = 0 FOR 3
+        grid[i][j] ? v
+          row, col := i, j
+  print.int(row)
+  print.int(col)
+  print.int(v)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "1\n2\n5\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_PriAltNestedReplicatedSkip(t *testing.T) {
+	// A ready replicated arm wins over the SKIP after it; with nothing
+	// ready, the SKIP is taken
+	occam := `SEQ
+  [2]CHAN OF INT cs:
+  INT x:
+  SEQ
+    x := 0
+    PAR
+      cs[1] ! 7
+      SEQ
+        TIMER tim:
+        INT t:
+        SEQ
+          tim ? t
+          tim ? AFTER t + 100000
+        PRI ALT
+          ALT i = 0 FOR 2
+            cs[i] ? x
+              SKIP
+          TRUE & SKIP
+            x := -1
+    print.int(x)
+    PRI ALT
+      ALT i = 0 FOR 2
+        cs[i] ? x
+          SKIP
+      TRUE & SKIP
+        x := -1
+    print.int(x)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "7\n-1\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_NestedAlt(t *testing.T) {
+	// Without replicators, a nested ALT's alternatives join the select
+	occam := `SEQ
+  CHAN OF INT a, b:
+  INT x:
+  PAR
+    b ! 3
+    ALT
+      ALT
+        a ? x
+          SKIP
+        b ? x
+          x := x * 2
+  print.int(x)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "6\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_AltScopedDeclBeforeInput(t *testing.T) {
+	// The declaration is created when the case is chosen, then the received
+	// value is assigned, then the body's own declarations use it
+	occam := `SEQ
+  CHAN OF INT a, b:
+  PAR
+    a ! 21
+    ALT
+      INT x:
+      a ? x
+        VAL INT doubled IS x * 2:
+        print.int(doubled)
+      INT x:
+      b ? x
+        print.int(x)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "42\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_AltGuardedScopedDecl(t *testing.T) {
+	occam := `SEQ
+  CHAN OF BYTE a, b:
+  BOOL ready:
+  SEQ
+    ready := TRUE
+    PAR
+      b ! 'B'
+      ALT
+        BYTE ch:
+        ready & b ? ch
+          VAL INT code IS INT ch:
+          print.int(code)
+        BYTE ch:
+        (NOT ready) & a ? ch
+          print.int(0)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "66\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_AltProtocolInputs(t *testing.T) {
+	// Sequential and variant protocol inputs as ALT guards, including a
+	// replicated ALT over channels carrying a sequential protocol
+	occam := `PROTOCOL PAIR IS INT ; INT
+PROTOCOL CMD
+  CASE
+    add; INT
+    quit
+:
+SEQ
+  [2]CHAN OF PAIR ps:
+  CHAN OF CMD c:
+  INT a, b:
+  BOOL on:
+  SEQ
+    on := TRUE
+    PAR
+      SEQ
+        ps[1] ! 1 ; 2
+        c ! add ; 5
+        c ! quit
+        ps[0] ! 3 ; 4
+      SEQ
+        SEQ i = 0 FOR 3
+          PRI ALT
+            on & ps[1] ? a ; b
+              print.int(a + b)
+            on & c ? CASE
+              INT k:
+              add; k
+                print.int(k)
+              quit
+                print.int(99)
+        ALT j = 0 FOR 2
+          ps[j] ? a ; b
+            print.int(a * b)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "3\n5\n99\n12\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ExtendedRendezvous(t *testing.T) {
+	// The sender of an extended input prints only once the extended
+	// process has, and output guards are taken when the receiver is ready,
+	// in a plain and a replicated ALT
+	occam := `SEQ
+  CHAN OF INT c, d:
+  [2]CHAN OF INT cs:
+  INT r:
+  PAR
+    SEQ
+      c ! 1
+      print.int(2)
+      d ! 3
+      print.int(5)
+      cs[1] ! 6
+      cs[0] ? r
+      print.int(r)
+    SEQ
+      INT x:
+      c ?? x
+        print.int(x)
+      ALT
+        d ?? x
+          SEQ
+            print.int(x)
+            print.int(4)
+      BOOL open:
+      SEQ
+        open := TRUE
+        ALT
+          open & cs[0] ! 0
+            print.int(0)
+          cs[1] ? r
+            print.int(r)
+        ALT i = 0 FOR 2
+          cs[i] ! 7 + i
+            SKIP
+`
+	for _, det := range []bool{false, true} {
+		output := transpileCompileRun(t, occam, WithExtendedRendezvous(true), WithDeterministic(det))
+		expected := "1\n2\n3\n4\n5\n6\n7\n"
+		if output != expected {
+			t.Errorf("deterministic %v: expected %q, got %q", det, expected, output)
+		}
+	}
+}
+
+func TestE2E_AltBodyReceivesSameChannel(t *testing.T) {
+	// A case whose body inputs again on the ALT's channel, as a protocol
+	// sent item by item, gets the items in order whatever the ALT's form
+	occam := `SEQ
+  CHAN OF INT c, d:
+  [2]CHAN OF INT cs:
+  INT n, m:
+  BOOL ok:
+  SEQ
+    ok := TRUE
+    PAR
+      SEQ
+        c ! 2
+        c ! 3
+        d ! 4
+        d ! 5
+        cs[1] ! 6
+        cs[1] ! 7
+        c ! 8
+        c ! 9
+      SEQ
+        ALT
+          c ? n
+            c ? m
+          d ? n
+            d ? m
+        print.int(n + m)
+        PRI ALT
+          ok & d ? n
+            d ? m
+          c ? n
+            c ? m
+        print.int(n * m)
+        ALT i = 0 FOR 2
+          cs[i] ? n
+            cs[i] ? m
+        print.int(n + m)
+        PRI ALT
+          (NOT ok) & d ? n
+            SKIP
+          ok & c ? n
+            c ? m
+        print.int(n * m)
+`
+	for _, opts := range [][]Option{nil, {WithDeterministic(true)}, {WithExtendedRendezvous(true)}} {
+		output := transpileCompileRun(t, occam, opts...)
+		expected := "5\n20\n13\n72\n"
+		if output != expected {
+			t.Errorf("%d options: expected %q, got %q", len(opts), expected, output)
+		}
+	}
+}
+
+func TestE2E_ExtendedRendezvousSameChannel(t *testing.T) {
+	// The extended process inputs again on its channel: the second sender
+	// is released at once, the first only when the extended process ends
+	occam := `SEQ
+  CHAN OF INT c:
+  TIMER tim:
+  INT t, x, y, u:
+  SEQ
+    tim ? t
+    PAR
+      SEQ
+        c ! 1
+        print.int(101)
+      SEQ
+        tim ? AFTER t + 50000
+        c ! 2
+        print.int(102)
+      c ?? x
+        SEQ
+          c ? y
+          tim ? u
+          tim ? AFTER u + 100000
+          print.int((x * 10) + y)
+`
+	output := transpileCompileRun(t, occam, WithExtendedRendezvous(true))
+	expected := "102\n12\n101\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ReplicatedAltBodyDeclUsesValue(t *testing.T) {
+	occam := `SEQ
+  [3]CHAN OF INT cs:
+  PAR
+    cs[1] ! 21
+    ALT i = 0 FOR 3
+      INT v:
+      cs[i] ? v
+        VAL INT doubled IS v * 2:
+        print.int(doubled + i)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "43\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ReplicatedAltArrayElement(t *testing.T) {
+	// Receiving into an element of a scoped array takes the element type
+	occam := `SEQ
+  [2]CHAN OF BYTE cs:
+  PAR
+    cs[1] ! 'x'
+    ALT i = 0 FOR 2
+      [2]BYTE buf:
+      cs[i] ? buf[i]
+        print.int(INT buf[i])
+`
+	output := transpileCompileRun(t, occam)
+	expected := "120\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ReplicatedAlt2DLinks(t *testing.T) {
+	// Nested channel indices computed from the replicator, on a 2-D link
+	// array passed as a [][]CHAN parameter
+	occam := `PROC node([][]CHAN OF INT links?, VAL INT d)
+  [3][2]INT got:
+  ALT i = 0 FOR SIZE links
+    links[i][(d + i) \ 2] ? got[i][d]
+      SEQ
+        print.int(i)
+        print.int(got[i][d])
+:
+SEQ
+  [3][2]CHAN OF INT links:
+  PAR
+    node(links, 1)
+    links[2][1] ! 42
+`
+	output := transpileCompileRun(t, occam)
+	expected := "2\n42\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ReplicatedAlt3DLinks(t *testing.T) {
+	// Indices from scoped abbreviations into a 3-D link array
+	occam := `SEQ
+  [2][2][2]CHAN OF BYTE cube:
+  BYTE b:
+  PAR
+    cube[1][1][0] ! 'A'
+    ALT k = 0 FOR 8
+      VAL INT x IS k / 4:
+      VAL INT y IS (k / 2) \ 2:
+      cube[x][y][k \ 2] ? b
+        SEQ
+          print.int(k)
+          print.int(INT b)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "6\n65\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ReplicatedAltGuard(t *testing.T) {
+	// A false guard disables its case, and its channel indices (here out of
+	// range for i = 0) are not evaluated
+	occam := `SEQ
+  [3][2]CHAN OF INT links:
+  INT v:
+  PAR
+    SEQ
+      links[0][0] ! 1
+      links[1][0] ! 2
+    SEQ
+      ALT i = 0 FOR 3
+        (i > 1) & links[i - 2][0] ? v
+          print.int(v)
+      ALT i = 0 FOR 2
+        links[i][0] ? v
+          print.int(v)
+`
+	expected := "1\n2\n"
+	if output := transpileCompileRun(t, occam); output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+	if output := transpileCompileRun(t, occam, WithDeterministic(true)); output != expected {
+		t.Errorf("deterministic: expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_SequentialPars(t *testing.T) {
+	// Each PAR declares its own WaitGroup; the second needs a new Go scope
+	occam := `SEQ
+  [2]INT a:
+  SEQ
+    PAR i = 0 FOR 2
+      a[i] := i + 1
+    PAR
+      a[0] := a[0] * 10
+      a[1] := a[1] * 10
+    print.int(a[0] + a[1])
+`
+	output := transpileCompileRun(t, occam)
+	expected := "30\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_PriAlt(t *testing.T) {
-	// Test PRI ALT: behaves the same as ALT in Go (no priority semantics)
+	// Test PRI ALT with a single ready case
 	occam := `SEQ
   CHAN OF INT c1:
   CHAN OF INT c2:
@@ -391,8 +1020,71 @@ func TestE2E_PriAlt(t *testing.T) {
 	}
 }
 
+func TestE2E_PriAltPriority(t *testing.T) {
+	// With both channels ready, PRI ALT always takes the first; a false
+	// guard or a later SKIP does not change that
+	occam := `SEQ
+  CHAN OF INT c1, c2:
+  TIMER tim:
+  INT t, x, y:
+  SEQ i = 0 FOR 20
+    PAR
+      c1 ! 1
+      c2 ! 2
+      SEQ
+        tim ? t
+        tim ? AFTER t + 2000
+        PRI ALT
+          (i < 0) & c2 ? x
+            SKIP
+          c1 ? x
+            SKIP
+          c2 ? x
+            SKIP
+          TRUE & SKIP
+            x := 0
+        IF
+          x = 1
+            c2 ? y
+          TRUE
+            c1 ? y
+        print.int(x)
+`
+	output := transpileCompileRun(t, occam)
+	expected := strings.Repeat("1\n", 20)
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ReplicatedPriAlt(t *testing.T) {
+	// A replicated PRI ALT takes the lowest ready index
+	occam := `SEQ
+  [4]CHAN OF INT cs:
+  TIMER tim:
+  INT t, x:
+  SEQ i = 0 FOR 10
+    PAR
+      cs[3] ! 3
+      cs[1] ! 1
+      SEQ
+        tim ? t
+        tim ? AFTER t + 2000
+        PRI ALT j = 0 FOR 4
+          cs[j] ? x
+            print.int(x)
+        cs[3] ? x
+`
+	output := transpileCompileRun(t, occam)
+	expected := strings.Repeat("1\n", 10)
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_PriPar(t *testing.T) {
-	// Test PRI PAR: behaves the same as PAR in Go (no priority semantics)
+	// Test PRI PAR: behaves the same as PAR in Go (no priority semantics
+	// without WithPriPar)
 	occam := `SEQ
   CHAN OF INT c:
   INT result:
@@ -409,6 +1101,59 @@ func TestE2E_PriPar(t *testing.T) {
 	}
 }
 
+func TestE2E_PriParModes(t *testing.T) {
+	// Each PRI PAR mode only adds scheduling hints: the results are those of PAR
+	occam := `SEQ
+  CHAN OF INT c:
+  [3]INT sums:
+  INT x:
+  SEQ
+    PRI PAR
+      SEQ i = 0 FOR 3
+        c ! i
+      SEQ
+        x := 0
+        WHILE x < 2
+          c ? x
+    PRI PAR i = 0 FOR 3
+      SEQ
+        sums[i] := 0
+        SEQ j = 0 FOR i + 2
+          sums[i] := sums[i] + j
+    print.int(x)
+    SEQ i = 0 FOR 3
+      print.int(sums[i])
+`
+	for _, mode := range []PriPar{PriParIgnore, PriParLockThread, PriParYield} {
+		output := transpileCompileRun(t, occam, WithPriPar(mode))
+		expected := "2\n1\n3\n6\n"
+		if output != expected {
+			t.Errorf("%s: expected %q, got %q", mode, expected, output)
+		}
+	}
+}
+
+func TestE2E_PlacedPar(t *testing.T) {
+	// PLACED PAR runs as PAR; the placement is only recorded in comments
+	occam := `SEQ
+  CHAN OF INT c:
+  INT result:
+  PLACE result AT 0:
+  PLACED PAR
+    PROCESSOR 0 T8
+      c ! 7
+    PROCESSOR 1 T8
+      SEQ
+        c ? result
+        print.int(result)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "7\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_ReceiveIntoIndexedVariable(t *testing.T) {
 	occam := `SEQ
   CHAN OF INT c:
@@ -446,3 +1191,330 @@ func TestE2E_IndexedChannelReceiveIntoIndexedVariable(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_MobileArrays(t *testing.T) {
+	// Each buffer is allocated, filled and moved down the pipeline: after
+	// an output or assignment the source holds no data, while the receiver
+	// owns the whole array
+	occam := `PROC producer(CHAN MOBILE []BYTE out!)
+  MOBILE []BYTE buf:
+  SEQ i = 1 FOR 3
+    SEQ
+      buf := MOBILE [i]BYTE
+      SEQ j = 0 FOR SIZE buf
+        buf[j] := BYTE (i * 10)
+      out ! buf
+      print.int(SIZE buf)
+:
+PROC consumer(CHAN MOBILE []BYTE in?)
+  MOBILE []BYTE data, keep:
+  INT sum:
+  SEQ i = 0 FOR 3
+    SEQ
+      in ? data
+      keep := data
+      sum := 0
+      SEQ j = 0 FOR SIZE keep
+        sum := sum + (INT keep[j])
+      print.int(SIZE data)
+      print.int(sum)
+:
+SEQ
+  CHAN MOBILE []BYTE c:
+  PAR
+    producer(c!)
+    consumer(c?)
+`
+	output := transpileCompileRun(t, occam)
+	// The producer's 0 after each output may come before or after the
+	// consumer's lines, so compare counts
+	lines := strings.Fields(output)
+	counts := map[string]int{}
+	for _, l := range lines {
+		counts[l]++
+	}
+	want := map[string]int{"0": 6, "10": 1, "40": 1, "90": 1}
+	if len(lines) != 9 {
+		t.Fatalf("expected 9 lines, got %q", output)
+	}
+	for v, n := range want {
+		if counts[v] != n {
+			t.Errorf("expected %d lines of %s, got %q", n, v, output)
+		}
+	}
+}
+
+func TestE2E_Forking(t *testing.T) {
+	// Each FORKed worker gets the value of i when it was forked and its own
+	// buffer; the FORKING block ends only when all of them have sent
+	occam := `PROC worker(VAL INT id, MOBILE []BYTE buf, CHAN OF INT out!)
+  out ! (id * 10) + (SIZE buf)
+:
+PROC main()
+  CHAN OF INT results:
+  INT total:
+  PAR
+    SEQ
+      FORKING
+        SEQ i = 1 FOR 4
+          MOBILE []BYTE b:
+          SEQ
+            b := MOBILE [i]BYTE
+            FORK worker(i, b, results!)
+      results ! -1
+    SEQ
+      total := 0
+      INT v:
+      SEQ
+        results ? v
+        WHILE v >= 0
+          SEQ
+            total := total + v
+            results ? v
+      print.int(total)
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "110\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_Barrier(t *testing.T) {
+	// Each worker sends one value a phase, then SYNCs: no value of the next
+	// phase is sent before every worker has sent its value of this one, so
+	// the values arrive in groups of three, one phase at a time
+	occam := `PROC worker(VAL INT id, BARRIER b, CHAN OF INT out!)
+  SEQ i = 0 FOR 3
+    SEQ
+      out ! (i * 10) + id
+      SYNC b
+:
+PROC main()
+  CHAN OF INT c:
+  BARRIER b:
+  PAR
+    PAR i = 0 FOR 3 ENROLL b
+      worker(i, b, c!)
+    SEQ i = 0 FOR 3
+      INT sum:
+      SEQ
+        sum := 0
+        SEQ j = 0 FOR 3
+          INT v:
+          SEQ
+            c ? v
+            sum := sum + v
+        print.int(sum)
+  SYNC b
+  print.int(-1)
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "3\n33\n63\n-1\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_SharedChanClaim(t *testing.T) {
+	// Three writers send id then count on one SHARED channel, each pair
+	// inside a CLAIM, so the reader never sees another writer's value
+	// between the two halves of a pair
+	occam := `PROC writer(VAL INT id, SHARED CHAN OF INT out!)
+  SEQ i = 0 FOR 3
+    CLAIM out!
+      SEQ
+        out ! id
+        out ! i
+:
+PROC main()
+  SHARED CHAN OF INT c:
+  INT pairs:
+  PAR
+    PAR i = 1 FOR 3
+      writer(i * 100, c!)
+    SEQ
+      pairs := 0
+      SEQ k = 0 FOR 9
+        INT id, n:
+        SEQ
+          c ? id
+          c ? n
+          IF
+            ((id \ 100) = 0) AND (n < 3)
+              pairs := pairs + 1
+            TRUE
+              SKIP
+      print.int(pairs)
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "9\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ChanTypeClaim(t *testing.T) {
+	// Three clients share the client end of one bundle, each CLAIMing it
+	// for a request and its reply; the last request sees every addition
+	occam := `CHAN TYPE ADDER
+  MOBILE RECORD
+    CHAN INT req?:
+    CHAN INT resp!:
+:
+PROC server(ADDER? svr, VAL INT count)
+  INT total, n:
+  SEQ
+    total := 0
+    SEQ i = 0 FOR count
+      SEQ
+        svr[req] ? n
+        total := total + n
+        svr[resp] ! total
+:
+PROC client(SHARED ADDER! cli, VAL INT n)
+  INT sum:
+  CLAIM cli
+    SEQ
+      cli[req] ! n
+      cli[resp] ? sum
+:
+PROC main()
+  ADDER? svr:
+  SHARED ADDER! cli:
+  INT last:
+  SEQ
+    svr, cli := MOBILE ADDER
+    PAR
+      server(svr, 4)
+      SEQ
+        PAR i = 1 FOR 3
+          client(cli, i)
+        CLAIM cli
+          SEQ
+            cli[req] ! 4
+            cli[resp] ? last
+    print.int(last)
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "10\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_CycleProcs(t *testing.T) {
+	// The demo_cycles processes make the running sums of 1, 2, 3, ..., the
+	// program's own id, which scales, taking the place of the built-in one
+	occam := `PROC id(CHAN OF INT in?, out!)
+  WHILE TRUE
+    INT x:
+    SEQ
+      in ? x
+      out ! x * 10
+:
+SEQ
+  CHAN OF INT a, b, c, n, s, fb, p, r, t, u:
+  PAR
+    prefix(0, b?, a!)
+    delta(a?, c!, n!)
+    succ(c?, b!)
+    plus(n?, fb?, s!)
+    delta(s?, r!, p!)
+    prefix(0, p?, fb!)
+    tail(r?, t!)
+    id(t?, u!)
+    SEQ
+      INT x:
+      SEQ i = 0 FOR 5
+        SEQ
+          u ? x
+          print.int(x)
+      STOP
+`
+	output := transpileCompileRunFailing(t, occam)
+	if !strings.HasPrefix(output, "10\n30\n60\n100\n150\nSTOP") {
+		t.Errorf("expected the scaled running sums then STOP, got %q", output)
+	}
+}
+
+func TestE2E_ParBranchPanic(t *testing.T) {
+	// A panic in a PAR branch is reported with the PAR's line, the branch
+	// and the PROC, not as a Go stack trace
+	occam := `PROC store(VAL INT k, []INT a)
+  a[k] := 1
+:
+PROC fill([]INT a)
+  PAR i = 2 FOR 4
+    store(i, a)
+:
+PROC divide(VAL INT d)
+  INT q:
+  PAR
+    SKIP
+    q := 10 / d
+:
+SEQ
+  [4]INT a:
+  fill(a)
+`
+	output := transpileCompileRunFailing(t, occam)
+	want := "panic in PAR branch i = 5 at line 5 in PROC fill: runtime error: index out of range [5] with length 4\n"
+	if !strings.Contains(output, want) || strings.Contains(output, "goroutine ") {
+		t.Errorf("expected %q and no stack trace, got %q", want, output)
+	}
+
+	output = transpileCompileRunFailing(t, strings.Replace(occam, "fill(a)", "divide(SIZE a - 4)", 1))
+	want = "panic in PAR branch 2 at line 10 in PROC divide: runtime error: integer divide by zero\n"
+	if !strings.Contains(output, want) {
+		t.Errorf("expected %q, got %q", want, output)
+	}
+
+	output = transpileCompileRunFailing(t, occam, WithParRecover(false))
+	if strings.Contains(output, "panic in PAR branch") || !strings.Contains(output, "goroutine ") {
+		t.Errorf("expected Go's stack trace without WithParRecover, got %q", output)
+	}
+
+	// Run through RunWithIO, not main, the branch panics again with the
+	// report, for the host to see
+	input := `PROC run(CHAN OF BYTE keyboard?, screen!, error!)
+  INT q, d:
+  SEQ
+    d := 0
+    PAR
+      SKIP
+      q := 10 / d
+:
+`
+	host := `package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestParPanic(t *testing.T) {
+	if os.Getenv("PAR_PANIC_CHILD") != "" {
+		RunWithIO(strings.NewReader(""), io.Discard, io.Discard)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestParPanic")
+	cmd.Env = append(os.Environ(), "PAR_PANIC_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	want := "panic: panic in PAR branch 2 at line 5 in PROC run: runtime error: integer divide by zero"
+	if err == nil || !strings.Contains(string(out), want) {
+		t.Errorf("expected %q, got %v:\n%s", want, err, out)
+	}
+}
+`
+	if output := transpileHostTest(t, input, host); !strings.Contains(output, "--- PASS: TestParPanic") {
+		t.Errorf("expected TestParPanic to pass, got:\n%s", output)
+	}
+}
@@ -413,3 +413,30 @@ func TestE2E_CaseCommaValuesElse(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+func TestE2E_CaseByteValues(t *testing.T) {
+	// Byte literal and constant labels on a BYTE selector, the untyped
+	// constants converted to byte
+	occam := `VAL esc IS 27:
+VAL BYTE tab IS '*t':
+SEQ
+  VAL lf IS 10:
+  VAL []BYTE keys IS "aB*n*t*#1Bz":
+  SEQ i = 0 FOR SIZE keys
+    CASE keys[i]
+      'a', 'A'
+        print.int(1)
+      'b', 'B', 127
+        print.int(2)
+      lf, tab
+        print.int(3)
+      esc
+        print.int(4)
+      ELSE
+        print.int(0)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "1\n2\n3\n3\n4\n0\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
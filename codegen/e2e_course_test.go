@@ -94,3 +94,24 @@ func TestE2E_HelloWorldCourseModule(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_CourseRuntime(t *testing.T) {
+	// No course.module needed: the library comes from the runtime package
+	input := `PROC sum(CHAN BYTE keyboard?, screen!, error!)
+  INT a, b:
+  SEQ
+    ask.int("a? ", a, 4, keyboard?, screen!)
+    ask.int("b? ", b, 4, keyboard?, screen!)
+    out.string("sum", 0, screen!)
+    out.int(a + b, 5, screen!)
+    out.string("*n", 0, screen!)
+    out.yes.no(equal.string("ab", "ab"), 0, screen!)
+    out.string("*n", 0, screen!)
+:
+`
+	output := transpileCompileRunWithInput(t, input, "12\n-5\n", WithRuntime(true))
+	expected := "a? 12\r\nb? -5\r\nsum    7\nyes\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
@@ -1,6 +1,9 @@
 package codegen
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestE2EEntryHarnessEcho(t *testing.T) {
 	// An echoing program that reads characters until 'Z' and echoes each one.
@@ -23,3 +26,259 @@ func TestE2EEntryHarnessEcho(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2EEntryHarnessExtraErrorChannel(t *testing.T) {
+	// The four-parameter variant's extra output channel goes to stderr
+	input := `PROC run(CHAN OF BYTE keyboard?, screen!, error!, CHAN OF BYTE log!)
+  SEQ
+    screen ! 'a'
+    log ! 'b'
+:
+`
+	output := transpileCompileRunWithInput(t, input, "")
+
+	if !strings.Contains(output, "a") || !strings.Contains(output, "b") {
+		t.Errorf("expected both %q and %q in output, got %q", "a", "b", output)
+	}
+}
+
+func TestE2EEntryHarnessRunWithIO(t *testing.T) {
+	// A host test drives the program twice in one process through RunWithIO
+	input := `PROC echo(CHAN OF BYTE keyboard?, screen!, error!)
+  BYTE ch:
+  SEQ
+    keyboard ? ch
+    WHILE ch <> 'Z'
+      SEQ
+        screen ! ch
+        keyboard ? ch
+    error ! '!'
+:
+`
+	host := `package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunWithIO(t *testing.T) {
+	for _, in := range []string{"hello Z", "again Z"} {
+		var stdout, stderr bytes.Buffer
+		RunWithIO(strings.NewReader(in), &stdout, &stderr)
+		if want := strings.TrimSuffix(in, "Z"); stdout.String() != want {
+			t.Errorf("stdout: expected %q, got %q", want, stdout.String())
+		}
+		if stderr.String() != "!" {
+			t.Errorf("stderr: expected %q, got %q", "!", stderr.String())
+		}
+	}
+}
+`
+	output := transpileHostTest(t, input, host)
+	if !strings.Contains(output, "--- PASS: TestRunWithIO") {
+		t.Errorf("expected TestRunWithIO to pass, got:\n%s", output)
+	}
+}
+
+func TestE2EEntryHarnessStopsReading(t *testing.T) {
+	// A program that never reads the keyboard leaves no reader behind:
+	// neither one blocked reading a pipe nor one blocked on a full channel
+	input := `PROC hello(CHAN OF BYTE keyboard?, screen!, error!)
+  screen ! 'h'
+:
+`
+	host := `package main
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunWithIOStopsReading(t *testing.T) {
+	before := runtime.NumGoroutine()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var stdout bytes.Buffer
+	RunWithIO(r, &stdout, &bytes.Buffer{})
+	RunWithIO(strings.NewReader(strings.Repeat("x", 1000)), &stdout, &bytes.Buffer{})
+	if stdout.String() != "hh" {
+		t.Errorf("expected %q, got %q", "hh", stdout.String())
+	}
+	for try := 0; runtime.NumGoroutine() > before; try++ {
+		if try == 100 {
+			t.Fatalf("expected %d goroutines, got %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+`
+	output := transpileHostTest(t, input, host)
+	if !strings.Contains(output, "--- PASS: TestRunWithIOStopsReading") {
+		t.Errorf("expected TestRunWithIOStopsReading to pass, got:\n%s", output)
+	}
+}
+
+func TestE2EEntryHarnessRunWithIOArgs(t *testing.T) {
+	// With an args? channel, RunWithIO takes the arguments to send
+	input := `PROC run(CHAN OF BYTE keyboard?, screen!, error!, CHAN OF BYTE args?)
+  BYTE ch:
+  SEQ i = 0 FOR 6
+    SEQ
+      args ? ch
+      screen ! ch
+:
+`
+	host := `package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunWithIOArgs(t *testing.T) {
+	var stdout bytes.Buffer
+	RunWithIO(strings.NewReader(""), &stdout, &bytes.Buffer{}, "ab", "cd")
+	if stdout.String() != "ab\ncd\n" {
+		t.Errorf("expected %q, got %q", "ab\ncd\n", stdout.String())
+	}
+}
+`
+	output := transpileHostTest(t, input, host)
+	if !strings.Contains(output, "--- PASS: TestRunWithIOArgs") {
+		t.Errorf("expected TestRunWithIOArgs to pass, got:\n%s", output)
+	}
+}
+
+func TestE2EEntryHarnessBoolStatus(t *testing.T) {
+	// A CHAN BOOL output gives the status: RunWithIO returns the last BOOL
+	// sent, and the program exits with status 1 if it was FALSE
+	input := `PROC check(CHAN OF BYTE keyboard?, screen!, error!, CHAN OF BOOL ok!)
+  BYTE ch:
+  SEQ
+    keyboard ? ch
+    screen ! ch
+    ok ! ch = 'y'
+:
+`
+	host := `package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunWithIOStatus(t *testing.T) {
+	for in, want := range map[string]bool{"y": true, "n": false} {
+		var stdout bytes.Buffer
+		if got := RunWithIO(strings.NewReader(in), &stdout, &bytes.Buffer{}); got != want || stdout.String() != in {
+			t.Errorf("input %q: got %v and %q, want %v", in, got, stdout.String(), want)
+		}
+	}
+}
+`
+	output := transpileHostTest(t, input, host)
+	if !strings.Contains(output, "--- PASS: TestRunWithIOStatus") {
+		t.Errorf("expected TestRunWithIOStatus to pass, got:\n%s", output)
+	}
+}
+
+func TestE2EEntryHarnessScreenProtocol(t *testing.T) {
+	// A terminal-control screen protocol is written as ANSI escapes, and
+	// any other variant protocol as JSON lines
+	input := `PROTOCOL SCREEN
+  CASE
+    clear
+    goto; INT; INT
+    string; INT::[]BYTE
+    int; INT
+    newline
+:
+PROTOCOL EVENT
+  CASE
+    text; INT::[]BYTE
+    point; INT; INT
+    done
+:
+PROC show(CHAN OF BYTE keyboard?, CHAN OF SCREEN screen!, CHAN OF BYTE error!)
+  SEQ
+    screen ! clear
+    screen ! goto; 3; 2
+    screen ! string; 2::"hi"
+    screen ! int; 42
+    screen ! newline
+:
+`
+	output := transpileCompileRunWithInput(t, input, "")
+	if want := "\x1b[2J\x1b[H\x1b[2;3Hhi42\n"; output != want {
+		t.Errorf("expected %q, got %q", want, output)
+	}
+
+	input = strings.Replace(input, "CHAN OF SCREEN screen!", "CHAN OF EVENT screen!", 1)
+	input = input[:strings.Index(input, "  SEQ\n")] + `  SEQ
+    screen ! text; 2::"hi"
+    screen ! point; 3; 4
+    screen ! done
+:
+`
+	output = transpileCompileRunWithInput(t, input, "")
+	want := `{"args":["hi"],"tag":"text"}
+{"args":[3,4],"tag":"point"}
+{"args":[],"tag":"done"}
+`
+	if output != want {
+		t.Errorf("expected %q, got %q", want, output)
+	}
+}
+
+func TestE2EEntryHarnessLeakCheck(t *testing.T) {
+	// With WithLeakCheck, goroutines still running PROCs when the entry
+	// PROC ends are reported on stderr
+	input := `PROC sender(CHAN OF INT c!)
+  c ! 1
+:
+PROC hello(CHAN OF BYTE keyboard?, screen!, error!)
+  screen ! 'a'
+:
+`
+	host := `package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakCheck(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	RunWithIO(strings.NewReader(""), &stdout, &stderr)
+	if stdout.String() != "a" || stderr.String() != "" {
+		t.Errorf("expected a and no report, got %q and %q", stdout.String(), stderr.String())
+	}
+
+	go sender(make(chan int))
+	time.Sleep(10 * time.Millisecond) // for it to start
+	stderr.Reset()
+	RunWithIO(strings.NewReader(""), &stdout, &stderr)
+	want := "leak: 1 goroutine(s) still running at exit:\n  PROC sender [chan send]\n"
+	if stderr.String() != want {
+		t.Errorf("expected %q, got %q", want, stderr.String())
+	}
+}
+`
+	output := transpileHostTest(t, input, host, WithLeakCheck(true))
+	if !strings.Contains(output, "--- PASS: TestLeakCheck") {
+		t.Errorf("expected TestLeakCheck to pass, got:\n%s", output)
+	}
+}
@@ -1,20 +1,40 @@
 package codegen
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/codeassociates/occam2go/ast"
 	"github.com/codeassociates/occam2go/lexer"
 	"github.com/codeassociates/occam2go/parser"
 	"github.com/codeassociates/occam2go/preproc"
+	"github.com/codeassociates/occam2go/sema"
 )
 
+// checkSemantics fails the test if program does not pass the semantic
+// checks, as the command would reject it before generating Go.
+func checkSemantics(t *testing.T, program *ast.Program, opts ...Option) {
+	t.Helper()
+	decls := CycleDecls(opts...)
+	if New(opts...).useRuntime {
+		decls = append(decls, RuntimeDecls()...)
+	}
+	if errs := sema.Check(program, decls...); len(errs) > 0 {
+		for _, err := range errs {
+			t.Errorf("semantic error: %s", err)
+		}
+		t.FailNow()
+	}
+}
+
 // transpileCompileRun takes Occam source, transpiles to Go, compiles, runs,
 // and returns the stdout output
-func transpileCompileRun(t *testing.T, occamSource string) string {
+func transpileCompileRun(t *testing.T, occamSource string, opts ...Option) string {
 	t.Helper()
 
 	// Transpile
@@ -28,8 +48,9 @@ func transpileCompileRun(t *testing.T, occamSource string) string {
 		}
 		t.FailNow()
 	}
+	checkSemantics(t, program, opts...)
 
-	gen := New()
+	gen := New(opts...)
 	goCode := gen.Generate(program)
 
 	// Create temp directory for this test
@@ -63,6 +84,188 @@ func transpileCompileRun(t *testing.T, occamSource string) string {
 	return string(output)
 }
 
+// transpileGoTest transpiles Occam source together with the test file from
+// GenerateTests, runs "go test -v" on them, and returns the combined output
+// and whether the tests passed.
+func transpileGoTest(t *testing.T, occamSource string) (string, bool) {
+	t.Helper()
+
+	p := parser.New(lexer.New(occamSource))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		t.FailNow()
+	}
+	checkSemantics(t, program)
+
+	gen := New()
+	goCode := gen.Generate(program)
+	testCode := gen.GenerateTests(program)
+
+	tmpDir, err := os.MkdirTemp("", "occam2go-test-*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	goFile := filepath.Join(tmpDir, "main.go")
+	testFile := filepath.Join(tmpDir, "main_test.go")
+	if err := os.WriteFile(goFile, []byte(goCode), 0644); err != nil {
+		t.Fatalf("failed to write Go file: %v", err)
+	}
+	if err := os.WriteFile(testFile, []byte(testCode), 0644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	cmd := exec.Command("go", "test", "-v", goFile, testFile)
+	output, err := cmd.CombinedOutput()
+	if err != nil && strings.Contains(string(output), "[build failed]") {
+		t.Fatalf("compilation failed: %v\nOutput: %s\nGo code:\n%s\nTest code:\n%s", err, output, goCode, testCode)
+	}
+	return string(output), err == nil
+}
+
+// transpileCompileRunFailing is like transpileCompileRun for programs that
+// are expected to halt with an error, such as STOP (which the Go runtime
+// reports as a deadlock once every goroutine is blocked). It returns the
+// combined output.
+func transpileCompileRunFailing(t *testing.T, occamSource string, opts ...Option) string {
+	t.Helper()
+
+	p := parser.New(lexer.New(occamSource))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		t.FailNow()
+	}
+	checkSemantics(t, program, opts...)
+	goCode := New(opts...).Generate(program)
+
+	tmpDir, err := os.MkdirTemp("", "occam2go-test-*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	goFile := filepath.Join(tmpDir, "main.go")
+	if err := os.WriteFile(goFile, []byte(goCode), 0644); err != nil {
+		t.Fatalf("failed to write Go file: %v", err)
+	}
+	binFile := filepath.Join(tmpDir, "main")
+	if out, err := exec.Command("go", "build", "-o", binFile, goFile).CombinedOutput(); err != nil {
+		t.Fatalf("compilation failed: %v\nOutput: %s\nGo code:\n%s", err, out, goCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, binFile).CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected execution to fail, got output: %s", output)
+	}
+	return string(output)
+}
+
+// transpileCompileRunPrefixed transpiles each program with WithPrefix set
+// to its key, builds the Go files together as one package, runs the result
+// and returns the combined output.
+func transpileCompileRunPrefixed(t *testing.T, programs map[string]string) string {
+	t.Helper()
+
+	tmpDir, err := os.MkdirTemp("", "occam2go-test-*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var goFiles []string
+	for prefix, occamSource := range programs {
+		p := parser.New(lexer.New(occamSource))
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			for _, err := range p.Errors() {
+				t.Errorf("parser error: %s", err)
+			}
+			t.FailNow()
+		}
+		checkSemantics(t, program)
+		goFile := filepath.Join(tmpDir, prefix+".go")
+		if err := os.WriteFile(goFile, []byte(New(WithPrefix(prefix)).Generate(program)), 0644); err != nil {
+			t.Fatalf("failed to write Go file: %v", err)
+		}
+		goFiles = append(goFiles, goFile)
+	}
+
+	binFile := filepath.Join(tmpDir, "main")
+	if out, err := exec.Command("go", append([]string{"build", "-o", binFile}, goFiles...)...).CombinedOutput(); err != nil {
+		t.Fatalf("compilation failed: %v\nOutput: %s", err, out)
+	}
+	output, err := exec.Command(binFile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("execution failed: %v\nOutput: %s", err, output)
+	}
+	return string(output)
+}
+
+// transpileCompileRunPackage transpiles a library with WithPackage(pkg) into
+// package pkg of a Go module, builds it with goMain, a hand-written main
+// package that imports it as "test/<pkg>", runs the result and returns the
+// combined output. Further options are applied after WithPackage.
+func transpileCompileRunPackage(t *testing.T, occamSource, pkg, goMain string, opts ...Option) string {
+	t.Helper()
+
+	p := parser.New(lexer.New(occamSource))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		t.FailNow()
+	}
+	checkSemantics(t, program, opts...)
+	gen := New(append([]Option{WithPackage(pkg)}, opts...)...)
+	goCode := gen.Generate(program)
+	for _, err := range gen.Errors() {
+		t.Fatalf("codegen error: %s", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "occam2go-test-*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := os.Mkdir(filepath.Join(tmpDir, pkg), 0755); err != nil {
+		t.Fatalf("failed to create package dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, pkg, pkg+".go"), []byte(goCode), 0644); err != nil {
+		t.Fatalf("failed to write Go file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "main.go"), []byte(goMain), 0644); err != nil {
+		t.Fatalf("failed to write Go file: %v", err)
+	}
+	modInit := exec.Command("go", "mod", "init", "test")
+	modInit.Dir = tmpDir
+	if out, err := modInit.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %v\n%s", err, out)
+	}
+
+	binFile := filepath.Join(tmpDir, "main")
+	compileCmd := exec.Command("go", "build", "-o", binFile, ".")
+	compileCmd.Dir = tmpDir
+	if out, err := compileCmd.CombinedOutput(); err != nil {
+		t.Fatalf("compilation failed: %v\nOutput: %s\nGo code:\n%s", err, out, goCode)
+	}
+	output, err := exec.Command(binFile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("execution failed: %v\nOutput: %s", err, output)
+	}
+	return string(output)
+}
+
 // transpileCompileRunFromFile takes an occam file path, preprocesses it,
 // then transpiles, compiles, and runs.
 func transpileCompileRunFromFile(t *testing.T, mainFile string, includePaths []string) string {
@@ -85,8 +288,9 @@ func transpileCompileRunFromFile(t *testing.T, mainFile string, includePaths []s
 // transpileCompileRunWithInput takes Occam source that uses the entry-point
 // PROC pattern (CHAN OF BYTE keyboard?, screen!, error!), transpiles to Go,
 // initialises a Go module (needed for golang.org/x/term), compiles, pipes
-// the given input to stdin, and returns the stdout output.
-func transpileCompileRunWithInput(t *testing.T, occamSource, stdin string) string {
+// the given input to stdin, and returns the stdout output. Code that imports
+// the runtime package gets it from this repository.
+func transpileCompileRunWithInput(t *testing.T, occamSource, stdin string, opts ...Option) string {
 	t.Helper()
 
 	// Transpile
@@ -100,8 +304,9 @@ func transpileCompileRunWithInput(t *testing.T, occamSource, stdin string) strin
 		}
 		t.FailNow()
 	}
+	checkSemantics(t, program, opts...)
 
-	gen := New()
+	gen := New(opts...)
 	goCode := gen.Generate(program)
 
 	// Create temp directory
@@ -123,6 +328,17 @@ func transpileCompileRunWithInput(t *testing.T, occamSource, stdin string) strin
 	if out, err := modInit.CombinedOutput(); err != nil {
 		t.Fatalf("go mod init failed: %v\n%s", err, out)
 	}
+	if strings.Contains(goCode, RuntimeImport) {
+		repo, err := filepath.Abs("..")
+		if err != nil {
+			t.Fatalf("failed to find repository: %v", err)
+		}
+		modEdit := exec.Command("go", "mod", "edit", "-require=github.com/codeassociates/occam2go@v0.0.0", "-replace=github.com/codeassociates/occam2go="+repo)
+		modEdit.Dir = tmpDir
+		if out, err := modEdit.CombinedOutput(); err != nil {
+			t.Fatalf("go mod edit failed: %v\n%s", err, out)
+		}
+	}
 	modTidy := exec.Command("go", "mod", "tidy")
 	modTidy.Dir = tmpDir
 	if out, err := modTidy.CombinedOutput(); err != nil {
@@ -147,3 +363,51 @@ func transpileCompileRunWithInput(t *testing.T, occamSource, stdin string) strin
 
 	return string(output)
 }
+
+// transpileHostTest transpiles an entry-point program into a Go module
+// together with hostTest, a _test.go file of the same package that drives it
+// (e.g. through RunWithIO), and returns the output of running "go test -v".
+func transpileHostTest(t *testing.T, occamSource, hostTest string, opts ...Option) string {
+	t.Helper()
+
+	p := parser.New(lexer.New(occamSource))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		t.FailNow()
+	}
+	checkSemantics(t, program, opts...)
+	goCode := New(opts...).Generate(program)
+
+	tmpDir, err := os.MkdirTemp("", "occam2go-test-*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "main.go"), []byte(goCode), 0644); err != nil {
+		t.Fatalf("failed to write Go file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "host_test.go"), []byte(hostTest), 0644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	// Initialise Go module (needed for golang.org/x/term dependency)
+	for _, args := range [][]string{{"mod", "init", "test"}, {"mod", "tidy"}} {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = tmpDir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go %s failed: %v\n%s\nGo code:\n%s", strings.Join(args, " "), err, out, goCode)
+		}
+	}
+
+	testCmd := exec.Command("go", "test", "-v", ".")
+	testCmd.Dir = tmpDir
+	output, err := testCmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go test failed: %v\nOutput: %s\nGo code:\n%s", err, output, goCode)
+	}
+	return string(output)
+}
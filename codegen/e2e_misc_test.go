@@ -286,6 +286,94 @@ func TestE2E_AltGuardedSkipFalse(t *testing.T) {
 	}
 }
 
+func TestE2E_AltConstantGuards(t *testing.T) {
+	// FALSE and TRUE guards are folded at transpile time: the ALT waits
+	// on c alone
+	occam := `SEQ
+  CHAN OF INT c, d:
+  INT result:
+  result := 0
+  PAR
+    ALT
+      FALSE & d ? result
+        result := -1
+      TRUE & c ? result
+        SKIP
+    SEQ
+      c ! 42
+  print.int(result)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "42\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_OptLevelZero(t *testing.T) {
+	// Without optimization passes the constant guards are evaluated at run
+	// time and each timeout makes a new timer, with the same results
+	occam := `SEQ
+  CHAN OF INT c, d:
+  TIMER tim:
+  INT result, t:
+  result := 0
+  tim ? t
+  PAR
+    SEQ i = 0 FOR 2
+      ALT
+        FALSE & d ? result
+          result := -1
+        TRUE & c ? result
+          SKIP
+        tim ? AFTER t + 1000000
+          result := -2
+    SEQ
+      c ! 42
+      c ! 43
+  print.int(result)
+`
+	output := transpileCompileRun(t, occam, WithOptLevel(0))
+	expected := "43\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_WordSize(t *testing.T) {
+	// INT wraps, and the intrinsics work, at the chosen word size
+	occam := `VAL N IS 3:
+SEQ
+  [N]INT a:
+  INT x, hi, lo:
+  SEQ
+    x := MOSTPOS INT
+    x := x PLUS 1
+    print.int(x)
+    SEQ i = 0 FOR SIZE a STEP 1
+      a[i] := i
+    PAR i = 0 FOR N
+      a[i] := a[i] * 2
+    print.int(a[N - 1])
+    hi, lo := LONGPROD(65536, 65536, 0)
+    print.int(hi)
+    print.int(lo)
+`
+	tests := []struct {
+		bits     int
+		expected string
+	}{
+		{32, "-2147483648\n4\n1\n0\n"},
+		{64, "-9223372036854775808\n4\n0\n4294967296\n"},
+	}
+	for _, tt := range tests {
+		output := transpileCompileRun(t, occam, WithWordSize(tt.bits))
+		if output != tt.expected {
+			t.Errorf("word size %d: expected %q, got %q", tt.bits, tt.expected, output)
+		}
+	}
+}
+
 func TestE2E_AltGuardedSkipFalseBlocking(t *testing.T) {
 	// Verify that when the SKIP guard is false, the ALT blocks on channels
 	// (not busy-waiting via default). The sender goes through a relay channel
@@ -842,3 +930,173 @@ SEQ
 		t.Errorf("expected 42, got %q", output)
 	}
 }
+
+func TestE2E_OutliningPreservesBehaviour(t *testing.T) {
+	// A tiny size limit forces every compound statement into a closure
+	occam := `SEQ
+  INT total:
+  SEQ
+    total := 0
+    SEQ i = 0 FOR 10
+      IF
+        (i \ 2) = 0
+          total := total + i
+        TRUE
+          SKIP
+    INT n:
+    SEQ
+      n := 3
+      WHILE n > 0
+        SEQ
+          total := total + n
+          n := n - 1
+    CHAN OF INT c:
+    INT v:
+    SEQ
+      PAR
+        c ! 100
+        c ? v
+      total := total + v
+    print.int(total)
+`
+	plain := transpileCompileRun(t, occam)
+	outlined := transpileCompileRun(t, occam, WithMaxFuncSize(50), WithOutlining(true))
+	if plain != "126\n" || outlined != plain {
+		t.Errorf("expected 126 from both, got %q plain and %q outlined", plain, outlined)
+	}
+}
+
+func TestE2E_PrefixedProgramsBuildTogether(t *testing.T) {
+	// Both programs declare PROTOCOL MSG and use _boolToInt and LONGSUM,
+	// which would be declared twice in the package without prefixes
+	lib := `PROTOCOL MSG
+  CASE
+    num; INT
+    done
+:
+PROC lib.send(CHAN OF MSG out!)
+  INT carry, sum:
+  SEQ
+    carry, sum := LONGSUM(1, 2, INT TRUE)
+    out ! num; sum
+    out ! done
+:
+`
+	app := `PROTOCOL MSG IS INT; INT
+SEQ
+  CHAN OF MSG c:
+  INT carry, sum, a, b:
+  SEQ
+    carry, sum := LONGSUM(40, 1, INT TRUE)
+    PAR
+      c ! sum; carry
+      c ? a; b
+    print.int(a + b)
+`
+	output := transpileCompileRunPrefixed(t, map[string]string{"lib": lib, "app": app})
+	if output != "42\n" {
+		t.Errorf("expected %q, got %q", "42\n", output)
+	}
+}
+
+func TestE2E_PackageImportedByGo(t *testing.T) {
+	// A library transpiled with WithPackage, driven by hand-written Go
+	lib := `VAL INT limit IS 3:
+PROTOCOL MSG
+  CASE
+    num; INT
+    done
+:
+INT FUNCTION double(VAL INT x)
+  IS x * 2
+:
+PROC sum.to(VAL INT n, INT total)
+  SEQ
+    total := 0
+    SEQ i = 0 FOR n
+      total := total + double(i)
+:
+PROC produce(CHAN OF MSG out!)
+  SEQ
+    SEQ i = 0 FOR limit
+      out ! num; i
+    out ! done
+:
+`
+	goMain := `package main
+
+import (
+	"fmt"
+
+	"test/occlib"
+)
+
+func main() {
+	var total int
+	occlib.Sum_to(4, &total)
+	fmt.Println(occlib.Double(21), total)
+
+	c := make(chan occlib.Proto_MSG)
+	go occlib.Produce(c)
+	for m := range c {
+		switch m := m.(type) {
+		case occlib.Proto_MSG_num:
+			fmt.Println(m.F0)
+		case occlib.Proto_MSG_done:
+			return
+		}
+	}
+}
+`
+	output := transpileCompileRunPackage(t, lib, "occlib", goMain)
+	expected := "42 12\n0\n1\n2\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_PackageErrorWrappers(t *testing.T) {
+	// parse reports bad digits on its error channel; ParseErr returns the first
+	lib := `PROTOCOL ERR
+  CASE
+    bad.digit; BYTE
+    empty
+:
+PROC parse(VAL []BYTE s, INT n, CHAN OF ERR error!)
+  SEQ
+    n := 0
+    IF
+      (SIZE s) = 0
+        error ! empty
+      TRUE
+        SEQ i = 0 FOR SIZE s
+          IF
+            (s[i] >= '0') AND (s[i] <= '9')
+              n := (n * 10) + (INT (s[i] - '0'))
+            TRUE
+              error ! bad.digit; s[i]
+:
+`
+	goMain := `package main
+
+import (
+	"errors"
+	"fmt"
+
+	"test/occlib"
+)
+
+func main() {
+	for _, s := range []string{"42", "4x2y", ""} {
+		n, err := occlib.ParseErr([]byte(s))
+		var bad occlib.Proto_ERR_bad_digit
+		fmt.Println(n, err, errors.As(err, &bad))
+	}
+}
+`
+	output := transpileCompileRunPackage(t, lib, "occlib", goMain, WithErrorWrappers(true))
+	expected := "42 <nil> false\n42 bad.digit; 'x' true\n0 empty false\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
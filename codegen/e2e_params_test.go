@@ -126,3 +126,117 @@ SEQ
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_SizeOfParamMatrix(t *testing.T) {
+	// SIZE of every parameter kind, used as a replicator count (and start)
+	// in each kind of replicator
+	tests := []struct {
+		name     string
+		occam    string
+		expected string
+	}{
+		{"chan array in SEQ and PAR", `PROC p([]CHAN OF INT in?, []CHAN OF INT out!)
+  INT total:
+  SEQ
+    total := 0
+    PAR
+      PAR i = 0 FOR SIZE out
+        out[i] ! i + 1
+      SEQ i = 0 FOR SIZE in
+        INT v:
+        SEQ
+          in[i] ? v
+          total := total + v
+    print.int(total)
+:
+SEQ
+  [3]CHAN OF INT cs:
+  p(cs, cs)
+`, "6\n"},
+		{"chan array in ALT", `PROC p([]CHAN OF INT cs)
+  INT total:
+  SEQ
+    total := 0
+    PAR
+      PAR i = 0 FOR SIZE cs
+        cs[i] ! 10
+      SEQ k = 0 FOR SIZE cs
+        ALT i = 0 FOR SIZE cs
+          INT v:
+          cs[i] ? v
+            total := total + v
+    print.int(total)
+:
+SEQ
+  [2]CHAN OF INT cs:
+  p(cs)
+`, "20\n"},
+		{"2D chan array in IF", `PROC p([][]CHAN OF INT grid)
+  IF
+    IF i = 0 FOR SIZE grid
+      (SIZE grid[i]) = 3
+        print.int(i)
+    TRUE
+      print.int(99)
+:
+SEQ
+  [2][3]CHAN OF INT grid:
+  p(grid)
+`, "0\n"},
+		{"fixed-size chan array FROM", `PROC p([3]CHAN OF INT cs)
+  SEQ i = (SIZE cs) - 1 FOR SIZE cs STEP -1
+    print.int(i)
+:
+SEQ
+  [3]CHAN OF INT cs:
+  p(cs)
+`, "2\n1\n0\n"},
+		{"open and fixed arrays", `PROC p([]INT a, VAL []INT b, [4]INT c, VAL [3]BYTE s, RESULT INT n)
+  SEQ
+    n := 0
+    SEQ i = 0 FOR ((SIZE a) + (SIZE b)) + ((SIZE c) + (SIZE s))
+      n := n + 1
+:
+SEQ
+  [2]INT a:
+  [4]INT c:
+  INT n:
+  SEQ
+    p(a, a, c, "abc", n)
+    print.int(n)
+`, "11\n"},
+		{"2D fixed array", `PROC p([2][5]INT m)
+  SEQ
+    SEQ i = 0 FOR SIZE m
+      SEQ j = 0 FOR SIZE m[i]
+        m[i][j] := i + j
+    print.int(m[1][4])
+:
+SEQ
+  [2][5]INT m:
+  p(m)
+`, "5\n"},
+		{"nested PROC sees outer params", `PROC p([]CHAN OF INT cs, []INT a)
+  PROC q(INT n)
+    n := (SIZE cs) + (SIZE a)
+  :
+  INT n:
+  SEQ
+    q(n)
+    print.int(n)
+:
+SEQ
+  [2]CHAN OF INT cs:
+  [3]INT a:
+  p(cs, a)
+`, "5\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := transpileCompileRun(t, tt.occam)
+			if output != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, output)
+			}
+		})
+	}
+}
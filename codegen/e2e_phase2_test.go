@@ -34,6 +34,24 @@ func TestE2E_ArrayLiteralIndexing(t *testing.T) {
 	}
 }
 
+func TestE2E_NestedArrayLiteral(t *testing.T) {
+	occam := `SEQ
+  VAL table IS [[1, 2, 3], [4, 5, 6]](INT32) :
+  VAL names IS ["ab", "cd"] :
+  [3]INT16 row:
+  SEQ
+    row := [7, 8, 9]
+    print.int(INT (table[1][2] + table[0][0]))
+    print.int(INT names[1][0])
+    print.int(INT row[2])
+`
+	output := transpileCompileRun(t, occam)
+	expected := "7\n99\n9\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_MultiLineBooleanIF(t *testing.T) {
 	occam := `SEQ
   INT x:
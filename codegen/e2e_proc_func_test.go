@@ -1,6 +1,9 @@
 package codegen
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestE2E_Procedure(t *testing.T) {
 	occam := `PROC double(VAL INT x, INT result)
@@ -226,6 +229,58 @@ SEQ
 	}
 }
 
+func TestE2E_FunctionArrayAndRecordResults(t *testing.T) {
+	occam := `RECORD POINT
+  INT x:
+  INT y:
+POINT FUNCTION midpoint(VAL POINT a, b)
+  POINT m:
+  VALOF
+    m[x], m[y] := (a[x] + b[x]) / 2, (a[y] + b[y]) / 2
+    RESULT m
+:
+[]INT FUNCTION table(VAL INT n)
+  [4]INT t:
+  VALOF
+    SEQ i = 0 FOR 4
+      t[i] := i * n
+    RESULT t
+:
+INT, []INT FUNCTION sum.and.reverse(VAL []INT a)
+  INT s:
+  [3]INT r:
+  VALOF
+    SEQ
+      s := 0
+      SEQ i = 0 FOR 3
+        SEQ
+          s := s + a[i]
+          r[i] := a[2 - i]
+    RESULT s, r
+:
+SEQ
+  POINT p, q, r:
+  [4]INT tab:
+  [3]INT rev:
+  INT s:
+  SEQ
+    p[x], p[y] := 0, 0
+    q[x], q[y] := 4, 8
+    r := midpoint(p, q)
+    print.int(r[y])
+    tab := table(3)
+    print.int(tab[3])
+    s, rev := sum.and.reverse([1, 2, 3])
+    print.int(s)
+    print.int(rev[0])
+`
+	output := transpileCompileRun(t, occam)
+	expected := "4\n9\n6\n3\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_NonValAbbreviation(t *testing.T) {
 	occam := `SEQ
   INT x:
@@ -240,6 +295,39 @@ func TestE2E_NonValAbbreviation(t *testing.T) {
 	}
 }
 
+func TestE2E_NonValAbbreviationAliases(t *testing.T) {
+	occam := `PROC bump(INT n)
+  n := n + 1
+:
+SEQ
+  [3][2]INT grid:
+  [5]BYTE buf:
+  [3]INT a:
+  INT i:
+  SEQ
+    SEQ k = 0 FOR 5
+      buf[k] := 'a'
+    a[1] := 10
+    i := 1
+    []INT row IS grid[i]:
+    []BYTE line IS [buf FROM 1 FOR 3]:
+    INT x IS a[i]:
+    SEQ
+      row[0] := 4
+      line[2] := 'z'
+      x := x + 1
+      bump(x)
+    print.int(grid[1][0])
+    print.int(a[1])
+    print.int(INT buf[3])
+`
+	output := transpileCompileRun(t, occam)
+	expected := "4\n12\n122\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_NestedProcClosure(t *testing.T) {
 	occam := `PROC outer(VAL INT n)
   INT x:
@@ -352,6 +440,52 @@ SEQ
 	}
 }
 
+func TestE2E_NestedMutualRecursion(t *testing.T) {
+	// Nested PROCs and FUNCTIONs calling themselves or ones declared after
+	// them in the same run of declarations
+	occam := `PROC parity(VAL INT n)
+  PROC even(VAL INT n, BOOL r)
+    IF
+      n = 0
+        r := TRUE
+      TRUE
+        odd(n - 1, r)
+  :
+  PROC odd(VAL INT n, BOOL r)
+    IF
+      n = 0
+        r := FALSE
+      TRUE
+        even(n - 1, r)
+  :
+  INT FUNCTION fact(VAL INT n)
+    INT r:
+    VALOF
+      IF
+        n = 0
+          r := 1
+        TRUE
+          r := n * fact(n - 1)
+      RESULT r
+  :
+  BOOL b:
+  SEQ
+    even(n, b)
+    print.bool(b)
+    print.int(fact(n))
+:
+
+SEQ
+  parity(4)
+  parity(5)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "true\n24\nfalse\n120\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_ProcLocalVarDecls(t *testing.T) {
 	occam := `PROC foo(VAL INT n)
   INT x:
@@ -371,3 +505,128 @@ SEQ
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_FunctionAssertTests(t *testing.T) {
+	occam := `--#ASSERT square(3) = 9
+--#ASSERT square(-4) = 16
+INT FUNCTION square(VAL INT x)
+  IS x * x
+
+--#ASSERT is.even(4)
+--#ASSERT NOT is.even(7)
+BOOL FUNCTION is.even(VAL INT n)
+  IS (n \ 2) = 0
+
+--#ASSERT upper('a') = 'A'
+BYTE FUNCTION upper(VAL BYTE c)
+  IS c - 32
+
+INT FUNCTION cube(VAL INT x)
+  IS (x * x) * x
+
+SEQ
+  print.int(square(2))
+`
+	output, ok := transpileGoTest(t, occam)
+	if !ok {
+		t.Fatalf("expected generated tests to pass, got:\n%s", output)
+	}
+	for _, want := range []string{"--- PASS: Test_square", "--- PASS: Test_is_even", "--- PASS: Test_upper", "--- SKIP: Test_cube"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+}
+
+func TestE2E_FunctionAssertFailure(t *testing.T) {
+	occam := `--#ASSERT square(3) = 10
+INT FUNCTION square(VAL INT x)
+  IS x * x
+
+SEQ
+  print.int(square(2))
+`
+	output, ok := transpileGoTest(t, occam)
+	if ok {
+		t.Fatalf("expected generated test to fail, got:\n%s", output)
+	}
+	if !strings.Contains(output, "square(3) = 10: got 9, want 10") {
+		t.Errorf("expected the failing example and value in output:\n%s", output)
+	}
+}
+
+func TestE2E_ValofExpr(t *testing.T) {
+	// A VALOF expression runs its process in a closure returning the RESULT
+	occam := `INT FUNCTION twice(VAL INT n)
+  IS n * 2
+:
+INT FUNCTION tri(VAL INT n)
+  IS (VALOF
+        INT r:
+        SEQ
+          r := 0
+          SEQ i = 1 FOR n
+            r := r + i
+        RESULT r)
+:
+SEQ
+  INT x, y:
+  BOOL b:
+  SEQ
+    y := 3
+    x := 1 + (VALOF
+                INT s:
+                PAR
+                  s := twice(y)
+                RESULT s
+             )
+    print.int(x)
+    b := (VALOF
+            VAL INT k IS 4:
+            RESULT (k < x) AND (VALOF
+                                  SKIP
+                                  RESULT TRUE))
+    print.bool(b)
+    print.int(tri(4) + (VALOF
+                          SKIP
+                          RESULT y))
+    print.int((INT s:
+               VAL INT k IS 4:
+               VALOF
+                 SEQ
+                   s := 0
+                   SEQ i = 0 FOR k
+                     s := s + i
+                 RESULT s))
+`
+	output := transpileCompileRun(t, occam)
+	expected := "7\ntrue\n13\n6\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_StopInFunction(t *testing.T) {
+	occam := `INT FUNCTION safe.div(VAL INT a, VAL INT b)
+  INT r:
+  VALOF
+    IF
+      b = 0
+        STOP
+      TRUE
+        r := a / b
+    RESULT r
+:
+
+SEQ
+  print.int(safe.div(10, 2))
+  print.int(safe.div(1, 0))
+`
+	output := transpileCompileRunFailing(t, occam)
+	if !strings.HasPrefix(output, "5\n") {
+		t.Errorf("expected the first call to print 5, got %q", output)
+	}
+	if !strings.Contains(output, "STOP at line 6 in FUNCTION safe.div") {
+		t.Errorf("expected STOP naming the FUNCTION, got %q", output)
+	}
+}
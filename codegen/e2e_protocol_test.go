@@ -1,6 +1,9 @@
 package codegen
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestE2E_SimpleProtocol(t *testing.T) {
 	// Simple protocol: just a named type alias
@@ -243,3 +246,365 @@ SEQ
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_VariantReceiveStopOnUnhandledTag(t *testing.T) {
+	occam := `PROTOCOL MSG
+  CASE
+    data; INT
+    quit
+
+SEQ
+  CHAN OF MSG c:
+  INT result:
+  PAR
+    c ! quit
+    c ? CASE
+      data ; result
+        print.int(result)
+`
+	output := transpileCompileRunFailing(t, occam)
+	if !strings.Contains(output, "STOP: unhandled variant quit received on c") {
+		t.Errorf("expected STOP naming the quit tag, got %q", output)
+	}
+}
+
+func TestE2E_VariantReceiveSpecificationsAndElse(t *testing.T) {
+	occam := `PROTOCOL MSG
+  CASE
+    count; INT
+    text; BYTE
+    quit
+
+SEQ
+  CHAN OF MSG c:
+  PAR
+    SEQ
+      c ! text; 'a'
+      c ! count; 4
+      c ! quit
+    SEQ i = 0 FOR 3
+      c ? CASE
+        INT n:
+        count; n
+          INT m:
+          SEQ
+            m := n * 2
+            print.int(m)
+        BYTE b:
+        text; b
+          print.int(INT b)
+        ELSE
+          print.int(i)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "97\n8\n2\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_PoisonPropagation(t *testing.T) {
+	// double and sink only handle data; WithPoison adds the shutdown branches
+	occam := `PROTOCOL MSG
+  CASE
+    data; INT
+    poison
+
+PROC gen(CHAN OF MSG out!)
+  SEQ
+    SEQ i = 0 FOR 3
+      out ! data ; i
+    out ! poison
+:
+
+PROC double(CHAN OF MSG in?, CHAN OF MSG out!)
+  INT x:
+  WHILE TRUE
+    in ? CASE
+      data ; x
+        out ! data ; 2 * x
+:
+
+PROC sink(CHAN OF MSG in?)
+  INT x:
+  SEQ
+    WHILE TRUE
+      in ? CASE
+        data ; x
+          print.int(x)
+    print.int(-1) -- not reached: poison returns from the PROC
+:
+
+SEQ
+  CHAN OF MSG a, b:
+  PAR
+    gen(a!)
+    double(a?, b!)
+    sink(b?)
+  print.int(100)
+`
+	expected := "0\n2\n4\n100\n"
+	if output := transpileCompileRun(t, occam, WithPoison("poison")); output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+	// Outlining must not move a poison return into a closure
+	if output := transpileCompileRun(t, occam, WithPoison("poison"), WithMaxFuncSize(100), WithOutlining(true)); output != expected {
+		t.Errorf("with outlining: expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_CountedArrayProtocol(t *testing.T) {
+	occam := `PROTOCOL PACKET IS INT32::[]BYTE
+PROTOCOL LINE IS INT ; INT::[]BYTE
+PROTOCOL MSG
+  CASE
+    text; INT; INT32::[]BYTE
+    quit
+
+PROC sender(CHAN OF PACKET out!, CHAN OF LINE lines!, CHAN OF MSG msgs!)
+  [10]BYTE buf:
+  SEQ
+    buf[0] := 'h'
+    buf[1] := 'i'
+    buf[2] := '!'
+    out ! 2 :: buf
+    lines ! 7 ; 3 :: buf
+    buf[0] := 'X'
+    msgs ! text ; 9 ; 3 :: "abc"
+    msgs ! quit
+:
+
+PROC receiver(CHAN OF PACKET in?, CHAN OF LINE lines?, CHAN OF MSG msgs?)
+  [10]BYTE b:
+  INT32 n:
+  INT m, k:
+  BOOL going:
+  SEQ
+    in ? n :: b
+    print.int(INT n)
+    print.int(INT b[1])
+    lines ? k ; m :: b
+    print.int(k)
+    print.int(m)
+    print.int(INT b[0])
+    going := TRUE
+    WHILE going
+      msgs ? CASE
+        text ; k ; n :: b
+          SEQ
+            print.int(k)
+            print.int(INT n)
+            print.int(INT b[2])
+        quit
+          going := FALSE
+:
+
+SEQ
+  CHAN OF PACKET c:
+  CHAN OF LINE l:
+  CHAN OF MSG msg:
+  PAR
+    sender(c!, l!, msg!)
+    receiver(c?, l?, msg?)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "2\n105\n7\n3\n104\n9\n3\n99\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_FixedArrayProtocol(t *testing.T) {
+	occam := `VAL INT N IS 4:
+PROTOCOL QUAD IS [N]BYTE
+PROTOCOL PAIR IS INT ; [2]INT
+PROTOCOL PACKET
+  CASE
+    raw; [4]BYTE
+    packet; INT; INT::[]BYTE; [2]INT
+    done
+
+PROC fill(CHAN OF PACKET in?, [4]BYTE out)
+  in ? CASE
+    raw ; out
+      SKIP
+:
+
+PROC sender(CHAN OF QUAD q!, CHAN OF PAIR p!, CHAN OF PACKET out!)
+  [10]BYTE buf:
+  [2]INT two:
+  INT len:
+  SEQ
+    SEQ i = 0 FOR 10
+      buf[i] := BYTE (i + 65)
+    two[0] := 7
+    two[1] := 9
+    q ! [buf FROM 6 FOR 4]
+    p ! 5 ; two
+    two[0] := 0
+    len := 3
+    out ! raw ; [buf FROM 2 FOR 4]
+    out ! raw ; "wxyz"
+    out ! packet ; len ; len :: [buf FROM 4 FOR len] ; [two FROM 0 FOR 2]
+    out ! done
+:
+
+PROC receiver(CHAN OF QUAD q?, CHAN OF PAIR p?, CHAN OF PACKET in?)
+  [4]BYTE got:
+  [10]BYTE b:
+  [2]INT t:
+  INT k, m:
+  SEQ
+    q ? got
+    print.int(INT got[0])
+    p ? k ; t
+    print.int(k + t[0] + t[1])
+    fill(in?, got)
+    print.int(INT got[3])
+    in ? CASE
+      raw ; got
+        print.int(INT got[0])
+    in ? CASE
+      packet ; k ; m :: b ; t
+        SEQ
+          print.int(m)
+          print.int(INT b[0])
+          print.int(t[0] + t[1])
+    in ? CASE
+      done
+        SKIP
+:
+
+SEQ
+  CHAN OF QUAD q:
+  CHAN OF PAIR p:
+  CHAN OF PACKET c:
+  PAR
+    sender(q!, p!, c!)
+    receiver(q?, p?, c?)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "71\n21\n70\n119\n3\n69\n9\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ProtocolExtends(t *testing.T) {
+	// numbers sends BASE tags on a channel of MORE, which extends BASE
+	// through EXT; the receive handles tags from all three
+	occam := `PROTOCOL BASE
+  CASE
+    num; INT
+    stop
+:
+PROTOCOL EXT EXTENDS BASE
+  CASE
+    text; BYTE
+:
+PROTOCOL MORE EXTENDS EXT
+  CASE
+    pair; INT; INT
+:
+PROC numbers(CHAN OF BASE out!)
+  SEQ
+    out ! num; 42
+:
+PROC producer(CHAN OF MORE out!)
+  SEQ
+    numbers(out!)
+    out ! text; 'x'
+    out ! pair; 1; 2
+    out ! stop
+:
+PROC consumer(CHAN OF MORE in?)
+  BOOL going:
+  INT n, a, b:
+  BYTE ch:
+  SEQ
+    going := TRUE
+    WHILE going
+      in ? CASE
+        num; n
+          print.int(n)
+        text; ch
+          print.int(INT ch)
+        pair; a; b
+          print.int(a + b)
+        stop
+          going := FALSE
+:
+PROC run()
+  CHAN OF MORE c:
+  PAR
+    producer(c!)
+    consumer(c?)
+:
+
+SEQ
+  run()
+`
+	output := transpileCompileRun(t, occam)
+	expected := "42\n120\n3\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_TypesDeclaredAfterUse(t *testing.T) {
+	// The PROCs come before the PROTOCOLs and RECORD they use, as they can
+	// when #INCLUDEs are ordered oddly, and run() has a PROTOCOL of its own
+	occam := `PROC producer(CHAN OF MSG out!, VAL CELL cell)
+  SEQ
+    out ! num; cell[n]
+    out ! pair; 1; 2
+    out ! done
+:
+PROC consumer(CHAN OF MSG in?)
+  BOOL going:
+  INT a, b:
+  SEQ
+    going := TRUE
+    WHILE going
+      in ? CASE
+        num; a
+          print.int(a)
+        pair; a; b
+          print.int(a + b)
+        done
+          going := FALSE
+:
+PROC run()
+  PROTOCOL PAIR IS INT; INT:
+  CHAN OF MSG c:
+  CHAN OF PAIR p:
+  CELL cell:
+  INT a, b:
+  SEQ
+    cell[n] := 42
+    PAR
+      producer(c!, cell)
+      consumer(c?)
+    PAR
+      p ! 5; 6
+      p ? a; b
+    print.int(a * b)
+:
+PROTOCOL MSG
+  CASE
+    num; INT
+    pair; INT; INT
+    done
+:
+RECORD CELL
+  INT n:
+
+SEQ
+  run()
+`
+	output := transpileCompileRun(t, occam)
+	expected := "42\n3\n30\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
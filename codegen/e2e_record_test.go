@@ -87,3 +87,204 @@ SEQ
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_RecordRefParamInput(t *testing.T) {
+	occam := `RECORD POINT
+  INT x:
+  INT y:
+
+PROC fill(POINT p, INT n, CHAN OF INT c)
+  SEQ
+    c ? p[x]
+    ALT
+      c ? p[y]
+        SKIP
+    c ? n
+    p[x], n := p[x] + p[y], p[x]
+
+SEQ
+  CHAN OF INT c:
+  POINT p:
+  INT n:
+  PAR
+    fill(p, n, c)
+    SEQ i = 1 FOR 3
+      c ! i
+  print.int(p[x])
+  print.int(p[y])
+  print.int(n)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "3\n2\n1\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_RecordChanFields(t *testing.T) {
+	occam := `PROTOCOL CMD
+  CASE
+    add; INT
+    quit
+
+RECORD PORTS
+  CHAN OF CMD req:
+  CHAN OF INT reply:
+
+PROC server(PORTS p)
+  INT total, x:
+  BOOL running:
+  SEQ
+    total := 0
+    running := TRUE
+    WHILE running
+      p[req] ? CASE
+        add ; x
+          SEQ
+            total := total + x
+            p[reply] ! total
+        quit
+          running := FALSE
+:
+
+PROC fetch(CHAN OF INT in?, INT r)
+  in ? r
+:
+
+SEQ
+  PORTS ports:
+  INT r:
+  PAR
+    server(ports)
+    SEQ
+      ports[req] ! add ; 5
+      ports[reply] ? r
+      print.int(r)
+      ports[req] ! add ; 7
+      ALT
+        ports[reply] ? r
+          print.int(r)
+      ports[req] ! add ; 30
+      fetch(ports[reply], r)
+      print.int(r)
+      ports[req] ! quit
+`
+	output := transpileCompileRun(t, occam)
+	expected := "5\n12\n42\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_DataType(t *testing.T) {
+	occam := `DATA TYPE MY.INT IS INT:
+DATA TYPE SMALL IS MY.INT:
+DATA TYPE COMPLEX64
+  RECORD
+    REAL32 real:
+    REAL32 imag:
+:
+DATA TYPE CELL IS PACKED RECORD
+  MY.INT count:
+  BYTE ch:
+:
+MY.INT FUNCTION twice(VAL MY.INT n)
+  IS n * 2
+:
+PROC bump(MY.INT n)
+  n := n + (MY.INT 1)
+:
+PROC main()
+  MY.INT a:
+  SMALL s:
+  COMPLEX64 z:
+  CELL c:
+  [3]MY.INT xs:
+  VAL MY.INT ten IS 10:
+  SEQ
+    a := twice(ten)
+    bump(a)
+    s := SMALL a
+    z[imag] := REAL32 (INT a)
+    z[real] := z[imag] / (REAL32 4)
+    c[count] := a
+    xs[0] := MY.INT ROUND z[real]
+    print.int(INT a)
+    print.int(INT s)
+    print.int(INT TRUNC z[imag])
+    print.int(INT c[count])
+    print.int(INT xs[0])
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "21\n21\n21\n21\n5\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_RecordValAbbreviation(t *testing.T) {
+	occam := `DATA TYPE POINT
+  RECORD
+    INT x:
+    INT y:
+    BOOL on:
+:
+VAL POINT origin IS [3, 4, TRUE]:
+VAL []POINT corners IS [[1, 2, FALSE], [5, 6, TRUE]]:
+PROC main()
+  VAL POINT p IS [10, 20, FALSE]:
+  SEQ
+    print.int(origin[x] + origin[y])
+    print.int(p[y])
+    print.int(corners[1][x])
+    print.bool(origin[on] AND corners[1][on])
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "7\n20\n5\ntrue\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_RecordArrays(t *testing.T) {
+	// Arrays of records, of one dimension or more, passed and abbreviated
+	occam := `DATA TYPE POINT
+  RECORD
+    INT x:
+    INT y:
+:
+INT FUNCTION sum(VAL []POINT ps)
+  INT total:
+  VALOF
+    SEQ
+      total := 0
+      SEQ i = 0 FOR SIZE ps
+        total := total + (ps[i][x] + ps[i][y])
+    RESULT total
+:
+PROC main()
+  [3]POINT ps:
+  [2][2]POINT grid:
+  SEQ
+    SEQ i = 0 FOR 3
+      SEQ
+        ps[i][x] := i
+        ps[i][y] := i * 10
+    SEQ i = 0 FOR 2
+      SEQ j = 0 FOR 2
+        grid[i][j] := ps[i + j]
+    []POINT row IS grid[1]:
+    SEQ
+      print.int(sum(ps))
+      print.int(row[1][y])
+      print.int(grid[0][1][x])
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "33\n20\n1\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
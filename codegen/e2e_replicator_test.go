@@ -150,3 +150,28 @@ func TestE2E_ReplicatedParStep(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_GoVersion(t *testing.T) {
+	// Replicated PAR without loop variable copies on Go 1.22, and array
+	// comparison without package slices before Go 1.21
+	occam := `SEQ
+  [3]CHAN OF INT cs:
+  [3]INT got:
+  PAR
+    PAR i = 0 FOR 3
+      cs[i] ! i * 10
+    PAR j = 0 FOR 3
+      cs[j] ? got[j]
+  IF
+    got = [0, 10, 20]
+      print.int(got[2])
+    TRUE
+      print.int(-1)
+`
+	for _, minor := range []int{20, 22} {
+		output := transpileCompileRun(t, occam, WithGoVersion(minor))
+		if output != "20\n" {
+			t.Errorf("Go 1.%d: expected %q, got %q", minor, "20\n", output)
+		}
+	}
+}
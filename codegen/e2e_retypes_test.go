@@ -119,3 +119,99 @@ SEQ
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_RetypesIntToBytes(t *testing.T) {
+	// INT is 4 bytes, little-endian, as on the transputer
+	occam := `SEQ
+  INT x:
+  SEQ
+    x := #01020304
+    VAL [4]BYTE b RETYPES x :
+    SEQ i = 0 FOR 4
+      print.int(INT b[i])
+`
+	output := transpileCompileRun(t, occam)
+	expected := "4\n3\n2\n1\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_RetypesWriteBack(t *testing.T) {
+	// assignments to a non-VAL RETYPES change its source
+	occam := `PROC clear.low([]BYTE bs)
+  []INT16 hs RETYPES bs :
+  hs[0] := 0
+:
+
+SEQ
+  INT x:
+  SEQ
+    x := #01020304
+    [4]BYTE b RETYPES x :
+    SEQ
+      b[0] := 255
+      b[3] := 0
+    print.int(x)
+    [2]INT pair:
+    SEQ
+      pair := [#12345678, 1]
+      [8]BYTE bytes RETYPES pair :
+      clear.low(bytes)
+      print.int(pair[0])
+      print.int(pair[1])
+`
+	output := transpileCompileRun(t, occam)
+	expected := "132095\n305397760\n1\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_RetypesRecord(t *testing.T) {
+	occam := `DATA TYPE PAIR
+  RECORD
+    INT16 a:
+    INT16 b:
+:
+
+SEQ
+  [4]BYTE raw:
+  SEQ
+    raw := [1, 0, 2, 0]
+    PAIR p RETYPES raw :
+    SEQ
+      print.int(INT p[a])
+      print.int(INT p[b])
+      p[b] := -1
+    print.int(INT raw[2])
+    print.int(INT raw[3])
+    VAL []INT16 hs RETYPES raw :
+    print.int(SIZE hs)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "1\n2\n255\n255\n2\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_Reshapes(t *testing.T) {
+	occam := `SEQ
+  [2][3]INT grid:
+  SEQ
+    SEQ i = 0 FOR 2
+      SEQ j = 0 FOR 3
+        grid[i][j] := (i * 3) + j
+    VAL []INT flat RESHAPES grid :
+    print.int(flat[4] + (SIZE flat))
+    [3][2]INT cols RESHAPES grid :
+    cols[2][1] := 50
+    print.int(grid[1][2])
+`
+	output := transpileCompileRun(t, occam)
+	expected := "10\n50\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
@@ -15,6 +15,29 @@ func TestE2E_ValByteArrayAbbreviation(t *testing.T) {
 	}
 }
 
+func TestE2E_StringHexEscapesAsMessage(t *testing.T) {
+	// *#hh bytes, NULs included, arrive exactly as written
+	occam := `PROTOCOL PACKET IS INT::[]BYTE
+SEQ
+  VAL []BYTE msg IS "cmd*#00*#05*#FF":
+  CHAN OF PACKET c:
+  [8]BYTE buf:
+  INT n:
+  PAR
+    c ! SIZE msg :: msg
+    SEQ
+      c ? n :: buf
+      print.int(n)
+      SEQ i = 0 FOR n
+        print.int(INT buf[i])
+`
+	output := transpileCompileRun(t, occam)
+	expected := "6\n99\n109\n100\n0\n5\n255\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_PrintString(t *testing.T) {
 	// print.string should output the string content
 	occam := `SEQ
@@ -77,3 +100,132 @@ func TestE2E_StringWithEscapedQuote(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_ArrayComparison(t *testing.T) {
+	// = and <> compare whole arrays and strings element by element
+	occam := `PROC check(VAL []BYTE cmd)
+  IF
+    cmd = "quit"
+      print.string("quit")
+    cmd <> "go"
+      print.string("other")
+    TRUE
+      print.string("go")
+:
+PROC main()
+  CHAN OF BYTE c:
+  [4]BYTE buffer:
+  [3]INT a, b:
+  SEQ
+    PAR
+      SEQ i = 0 FOR 4
+        c ! "quit"[i]
+      SEQ i = 0 FOR 4
+        c ? buffer[i]
+    check(buffer)
+    check("go")
+    check([buffer FOR 2])
+    SEQ i = 0 FOR 3
+      SEQ
+        a[i] := i
+        b[i] := i
+    print.bool(a = b)
+    b[2] := 7
+    print.bool(a = b)
+    print.bool([a FOR 2] = [b FOR 2])
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "quit\ngo\nother\ntrue\nfalse\ntrue\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_MultiDimArrayComparison(t *testing.T) {
+	// = and <> compare arrays of more dimensions, and their rows, element
+	// by element
+	occam := `PROC same(VAL [][]INT x, y)
+  print.bool(x = y)
+:
+PROC main()
+  [2][2]INT m, n:
+  SEQ
+    SEQ i = 0 FOR 2
+      SEQ j = 0 FOR 2
+        SEQ
+          m[i][j] := i + j
+          n[i][j] := i + j
+    print.bool(m = n)
+    n[1][1] := 7
+    print.bool(m <> n)
+    print.bool(m[0] = n[0])
+    print.bool(m[1] = n[1])
+    print.bool(m = [[0, 1], [1, 2]])
+    same(m, n)
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "true\ntrue\ntrue\nfalse\ntrue\nfalse\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_ConversionBuiltins(t *testing.T) {
+	// INTTOSTRING, STRINGTOINT, REALnTOSTRING and STRINGTOREALn from the
+	// occam library, with REALnTOSTRING's Ip/Dp formats
+	occam := `PROC line(VAL []BYTE s, CHAN OF BYTE out!)
+  SEQ
+    SEQ i = 0 FOR SIZE s
+      out ! s[i]
+    out ! '*n'
+:
+PROC run(CHAN OF BYTE keyboard?, screen!, error!)
+  [24]BYTE buf:
+  INT len, n:
+  BOOL err:
+  REAL32 y:
+  REAL64 x:
+  SEQ
+    INTTOSTRING(len, buf, -1234)
+    line([buf FOR len], screen!)
+    STRINGTOINT(err, n, "-56")
+    INTTOSTRING(len, buf, n + 1)
+    line([buf FOR len], screen!)
+    STRINGTOINT(err, n, "12x")
+    IF
+      err
+        line("error", screen!)
+      TRUE
+        SKIP
+    x := (REAL64 1) / (REAL64 4)
+    REAL64TOSTRING(len, buf, x, 0, 0)
+    line([buf FOR len], screen!)
+    REAL64TOSTRING(len, buf, x, 3, 2)
+    line([buf FOR len], screen!)
+    REAL64TOSTRING(len, buf, x, 0, 3)
+    line([buf FOR len], screen!)
+    REAL64TOSTRING(len, buf, REAL64 100, 0, 0)
+    line([buf FOR len], screen!)
+    REAL64TOSTRING(len, buf, REAL64 123, 1, 1)
+    line([buf FOR len], screen!)
+    REAL64TOSTRING(len, buf, (REAL64 (-15)) / (REAL64 2), 4, 0)
+    line([buf FOR len], screen!)
+    x := (REAL64 100000) * (REAL64 100000)
+    REAL64TOSTRING(len, buf, x * x, 0, 0)
+    line([buf FOR len], screen!)
+    y := (REAL32 1) / (REAL32 3)
+    REAL32TOSTRING(len, buf, y, 0, 0)
+    line([buf FOR len], screen!)
+    STRINGTOREAL64(err, x, "1.5E+2")
+    REAL64TOSTRING(len, buf, x, 0, 0)
+    line([buf FOR len], screen!)
+:
+`
+	output := transpileCompileRun(t, occam)
+	expected := "-1234\n-55\nerror\n0.25\n  0.25\n2.500E-1\n100.0\n1.2E+2\n  -8\n1.0E+20\n0.33333334\n150.0\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
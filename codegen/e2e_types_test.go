@@ -1,6 +1,9 @@
 package codegen
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestE2E_TypeConversionIntFromByte(t *testing.T) {
 	occam := `SEQ
@@ -47,6 +50,25 @@ func TestE2E_TypeConversionInExpression(t *testing.T) {
 	}
 }
 
+func TestE2E_TypeConversionCharArithmetic(t *testing.T) {
+	occam := `SEQ
+  BYTE ch:
+  INT digit:
+  ch := '7'
+  digit := INT ch - INT '0'
+  print.int(digit)
+  ch := BYTE (INT 'a' + 2)
+  print.int(INT ch)
+  ch := BYTE (digit + (INT '0'))
+  print.int(INT ch)
+`
+	output := transpileCompileRun(t, occam)
+	expected := "7\n99\n55\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_Real32VarDecl(t *testing.T) {
 	occam := `SEQ
   REAL32 x:
@@ -60,6 +82,27 @@ func TestE2E_Real32VarDecl(t *testing.T) {
 	}
 }
 
+func TestE2E_RealLiterals(t *testing.T) {
+	occam := `SEQ
+  REAL32 x:
+  REAL64 y:
+  SEQ
+    x := 3.25(REAL32)
+    y := 1.0E+3
+    y := (y * 2.5) / 0.5
+    print.int(INT (x * 100.0(REAL32)))
+    print.int(INT y)
+    print.int(INT TRUNC 7.9)
+    VAL half IS 0.5:
+    print.int(INT ROUND (y * half))
+`
+	output := transpileCompileRun(t, occam)
+	expected := "325\n5000\n7\n2500\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
 func TestE2E_Real64VarDecl(t *testing.T) {
 	occam := `SEQ
   REAL64 x:
@@ -401,6 +444,67 @@ func TestE2E_CheckedArithmeticWrapping(t *testing.T) {
 	}
 }
 
+func TestE2E_CheckedArithOption(t *testing.T) {
+	// Results in range, REALs and the modulo operators run as without it
+	occam := `SEQ
+  INT x:
+  INT16 s:
+  BYTE b:
+  REAL64 r:
+  SEQ
+    x := MOSTPOS INT
+    x := x PLUS 1
+    print.bool(x = (MOSTNEG INT))
+    s := 32000
+    s := (s - 100) + 767
+    print.int(INT s)
+    b := 250
+    b := b + 5
+    print.int(INT b)
+    r := 1.0E+300
+    r := r * r
+    print.bool(r > 1.0)
+`
+	output := transpileCompileRun(t, occam, WithCheckedArith(true))
+	expected := "true\n32667\n255\ntrue\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_CheckedArithOverflow(t *testing.T) {
+	tests := []struct {
+		name, expr, op string
+	}{
+		{"add", "x + 1", "+"},
+		{"sub", "(MOSTNEG INT) - x", "-"},
+		{"mul", "x * 2", "*"},
+		{"mul most negative", "((x - (MOSTPOS INT)) - 1) * (MOSTNEG INT)", "*"},
+		{"int16", "INT (s + s)", "+"},
+		{"byte", "INT (b + b)", "+"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			occam := `SEQ
+  INT x:
+  INT16 s:
+  BYTE b:
+  SEQ
+    x := MOSTPOS INT
+    s := 20000
+    b := 200
+    print.int(INT s)
+    print.int(` + tt.expr + `)
+`
+			// The output before the STOP is still written
+			output := transpileCompileRunFailing(t, occam, WithCheckedArith(true))
+			if want := "20000\nSTOP: integer overflow in " + tt.op + " at line 10"; !strings.Contains(output, want) {
+				t.Errorf("expected %q, got:\n%s", want, output)
+			}
+		})
+	}
+}
+
 func TestE2E_Int16VarDeclAndConversion(t *testing.T) {
 	occam := `SEQ
   INT16 x:
@@ -691,3 +795,216 @@ func TestE2E_TypedByteAbbreviation(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, output)
 	}
 }
+
+func TestE2E_BoolMappedToInt32(t *testing.T) {
+	occam := `RECORD CFG
+  BOOL verbose:
+  INT level:
+
+BOOL FUNCTION odd(VAL INT n)
+  IS (n \ 2) = 1
+
+VAL BOOL debug IS FALSE:
+
+BOOL, INT FUNCTION both(VAL BOOL b, VAL INT x)
+  VALOF
+    SKIP
+    RESULT NOT b, x + 1
+
+PROC flip(BOOL b)
+  b := NOT b
+
+PROC send.all(CHAN OF BOOL out!)
+  SEQ
+    out ! TRUE
+    out ! odd(4)
+
+PROC show(VAL BOOL b)
+  IF
+    b
+      print.int(1)
+    TRUE
+      print.int(0)
+
+SEQ
+  BOOL a, c:
+  INT n:
+  CHAN OF BOOL ch:
+  CFG conf:
+  VAL BOOL k IS odd(3):
+  SEQ
+    a := odd(3)
+    print.bool(a)
+    flip(a)
+    print.bool(a)
+    c, n := both(a, 41)
+    print.bool(c)
+    print.int(n)
+    a, c := c, a
+    show(a)
+    show(c OR k)
+    show(debug)
+    conf[verbose] := a AND k
+    show(conf[verbose])
+    print.int(INT c)
+    PAR
+      send.all(ch!)
+      SEQ
+        ch ? c
+        show(c)
+        ch ? c
+        print.bool(c)
+`
+	expected := "true\nfalse\ntrue\n42\n1\n1\n0\n1\n0\n1\nfalse\n"
+	if output := transpileCompileRun(t, occam); output != expected {
+		t.Errorf("default mapping: expected %q, got %q", expected, output)
+	}
+	if output := transpileCompileRun(t, occam, WithTypeMap(map[string]string{"BOOL": "int32"})); output != expected {
+		t.Errorf("BOOL as int32: expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_BoolChannels(t *testing.T) {
+	// BOOL on plain, simple-protocol, sequential and variant channels, and
+	// received in guarded ALTs, with BOOL as bool and as int32
+	occam := `PROTOCOL FLAG IS BOOL
+PROTOCOL PAIR IS BOOL; INT
+PROTOCOL MSG
+  CASE
+    flag; BOOL
+    both; BOOL; INT
+    done
+:
+PROC recv(CHAN OF BOOL c?, []CHAN OF BOOL cs?, CHAN OF FLAG f?, CHAN OF PAIR p?, CHAN OF MSG m?)
+  PROC skip(CHAN OF INT c?)
+    INT n:
+    c ? n
+  :
+  BOOL b, going:
+  INT n:
+  SEQ
+    CHAN OF INT ints:
+    PAR
+      skip(ints?)
+      ints ! 0
+    going := TRUE
+    ALT
+      going & c ? b
+        print.bool(b)
+    ALT
+      going & f ? b
+        print.bool(b)
+    ALT i = 0 FOR SIZE cs
+      going & cs[i] ? b
+        SEQ
+          print.int(i)
+          print.bool(b)
+    p ? b; n
+    print.bool(b)
+    print.int(n)
+    WHILE going
+      m ? CASE
+        flag; b
+          print.bool(b)
+        both; b; n
+          SEQ
+            print.bool(b)
+            print.int(n)
+        done
+          going := FALSE
+:
+PROC send(CHAN OF BOOL c!, []CHAN OF BOOL cs!, CHAN OF FLAG f!, CHAN OF PAIR p!, CHAN OF MSG m!)
+  SEQ
+    c ! TRUE
+    f ! FALSE
+    cs[1] ! 1 = 2
+    p ! TRUE; 7
+    m ! flag; FALSE
+    m ! both; TRUE; 8
+    m ! done
+:
+SEQ
+  CHAN OF BOOL c:
+  [2]CHAN OF BOOL cs:
+  CHAN OF FLAG f:
+  CHAN OF PAIR p:
+  CHAN OF MSG m:
+  PAR
+    send(c!, cs, f!, p!, m!)
+    recv(c?, cs, f?, p?, m?)
+`
+	expected := "true\nfalse\n1\nfalse\ntrue\n7\nfalse\ntrue\n8\n"
+	if output := transpileCompileRun(t, occam); output != expected {
+		t.Errorf("default mapping: expected %q, got %q", expected, output)
+	}
+	if output := transpileCompileRun(t, occam, WithTypeMap(map[string]string{"BOOL": "int32"})); output != expected {
+		t.Errorf("BOOL as int32: expected %q, got %q", expected, output)
+	}
+}
+
+func TestE2E_StrictConversionCheck(t *testing.T) {
+	// In range conversions run as without it
+	occam := `SEQ
+  INT x:
+  REAL64 r:
+  SEQ
+    x := 200
+    r := -2.7
+    print.int(INT (BYTE x))
+    print.int(INT (INT16 TRUNC r))
+    print.int(INT ROUND r)
+`
+	output := transpileCompileRun(t, occam, WithStrict(true))
+	expected := "200\n-2\n-3\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+
+	tests := []struct {
+		name, expr string
+	}{
+		{"byte", "BYTE x"},
+		{"negative byte", "BYTE (-x)"},
+		{"int16", "INT16 (x * 200)"},
+		{"real", "INT32 TRUNC (r * r)"},
+		{"round", "INT16 ROUND (r * r)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			occam := `SEQ
+  INT x:
+  REAL64 r:
+  SEQ
+    x := 256
+    r := 1.0E+10
+    print.int(INT (` + tt.expr + `))
+`
+			output := transpileCompileRunFailing(t, occam, WithStrict(true))
+			if !strings.Contains(output, "STOP: conversion out of range at line 7") {
+				t.Errorf("expected a STOP for an out of range conversion, got:\n%s", output)
+			}
+		})
+	}
+}
+
+func TestE2E_PoisonUninit(t *testing.T) {
+	// Assigned variables are unaffected; unassigned ones show
+	occam := `SEQ
+  INT a, b:
+  BYTE c:
+  REAL64 r:
+  [3]INT16 s:
+  SEQ
+    a := 7
+    print.int(a)
+    print.int(b)
+    print.int(INT c)
+    print.int(INT s[2])
+    print.bool(r <> r)
+`
+	output := transpileCompileRun(t, occam, WithPoisonUninit(true))
+	expected := "7\n-559038737\n222\n-8531\ntrue\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
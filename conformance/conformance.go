@@ -0,0 +1,251 @@
+// Package conformance runs a corpus of occam test programs, such as the
+// cgtests of the KRoC compiler, through the transpiler, the Go compiler and
+// a run of the program, and reports how many pass. The pass rate, and the
+// stage each failure stops at, show which language gaps matter most.
+//
+// A test passes when it transpiles, builds, exits with status 0 within the
+// timeout, and prints nothing matching the failure pattern: the cgtests
+// report failed checks on the screen rather than through the exit status.
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codeassociates/occam2go/codegen"
+	"github.com/codeassociates/occam2go/parser"
+	"github.com/codeassociates/occam2go/transpile"
+)
+
+// Stage is where a test stopped: StagePass, or the stage it failed in.
+type Stage string
+
+const (
+	StageTranspile Stage = "transpile" // preprocessing, parsing, checks or code generation failed
+	StageBuild     Stage = "build"     // the Go did not compile
+	StageRun       Stage = "run"       // the program exited with an error or timed out
+	StageCheck     Stage = "check"     // the program reported a failed check
+	StagePass      Stage = "pass"
+)
+
+// Stages lists the failure stages in pipeline order.
+var Stages = []Stage{StageTranspile, StageBuild, StageRun, StageCheck}
+
+// DefaultTimeout is how long a test program may run when Options.Timeout
+// is 0.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultFail matches the output of a test reporting a failed check when
+// Options.Fail is nil.
+var DefaultFail = regexp.MustCompile(`(?i)\b(fail(ed|ure)?|error)\b`)
+
+// Options configures Run. The directory of each test is searched for its
+// #INCLUDEs before IncludePaths.
+type Options struct {
+	IncludePaths []string
+	Defines      map[string]string
+	Dialect      parser.Dialect
+	Codegen      []codegen.Option
+
+	Timeout time.Duration  // per test program run; 0 for DefaultTimeout
+	Fail    *regexp.Regexp // output marking a failed check; nil for DefaultFail
+	Jobs    int            // tests handled at once; 0 for one
+}
+
+// Result is the outcome of one test.
+type Result struct {
+	File   string `json:"file"`
+	Stage  Stage  `json:"stage"`
+	Detail string `json:"detail,omitempty"` // first line of the failure
+}
+
+// Run transpiles, builds and runs each of files, calling done, if not nil,
+// with each result as it is known (one call at a time). The results are
+// returned in the order of files.
+func Run(files []string, opts Options, done func(Result)) []Result {
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]Result, len(files))
+	next := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				r := runTest(files[i], opts)
+				results[i] = r
+				if done != nil {
+					mu.Lock()
+					done(r)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// runTest takes one test through the stages until one fails.
+func runTest(file string, opts Options) Result {
+	fail := func(stage Stage, detail string) Result {
+		return Result{File: file, Stage: stage, Detail: firstLine(detail)}
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return fail(StageTranspile, err.Error())
+	}
+	goSrc, err := transpileTest(file, string(src), opts)
+	if err != nil {
+		return fail(StageTranspile, err.Error())
+	}
+
+	dir, err := os.MkdirTemp("", "occam2go-conformance-*")
+	if err != nil {
+		return fail(StageBuild, err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(goSrc), 0o644); err != nil {
+		return fail(StageBuild, err.Error())
+	}
+	build := exec.Command("go", "build", "-o", "test", "main.go")
+	build.Dir = dir
+	if out, err := build.CombinedOutput(); err != nil {
+		return fail(StageBuild, compilerError(string(out), err))
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	run := exec.CommandContext(ctx, filepath.Join(dir, "test"))
+	out, err := run.CombinedOutput()
+	if ctx.Err() != nil {
+		return fail(StageRun, fmt.Sprintf("timed out after %s", timeout))
+	}
+	if err != nil {
+		detail := err.Error()
+		if first := firstLine(string(out)); first != "" {
+			detail += ": " + first
+		}
+		return fail(StageRun, detail)
+	}
+	pattern := opts.Fail
+	if pattern == nil {
+		pattern = DefaultFail
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if pattern.MatchString(line) {
+			return fail(StageCheck, strings.TrimSpace(line))
+		}
+	}
+	return Result{File: file, Stage: StagePass}
+}
+
+// transpileTest transpiles the test program src, turning a panic in the
+// transpiler into an error so that the rest of the corpus still runs.
+func transpileTest(file, src string, opts Options) (goSrc string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	goSrc, _, err = transpile.Transpile(src, transpile.Options{
+		File:         file,
+		IncludePaths: append([]string{filepath.Dir(file)}, opts.IncludePaths...),
+		Defines:      opts.Defines,
+		Dialect:      opts.Dialect,
+		Codegen:      opts.Codegen,
+	})
+	return goSrc, err
+}
+
+// compilerError returns the first error the Go compiler reported in out,
+// skipping the "# package" heading, or err if there is none.
+func compilerError(out string, err error) string {
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return err.Error()
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
+
+// Summary counts the results of a Run.
+type Summary struct {
+	Total  int           `json:"total"`
+	Passed int           `json:"passed"`
+	Failed map[Stage]int `json:"failed"` // by the stage failed in
+}
+
+// Summarize counts results by stage.
+func Summarize(results []Result) Summary {
+	s := Summary{Total: len(results), Failed: map[Stage]int{}}
+	for _, r := range results {
+		if r.Stage == StagePass {
+			s.Passed++
+		} else {
+			s.Failed[r.Stage]++
+		}
+	}
+	return s
+}
+
+// Percent returns the pass rate, 0 for no tests.
+func (s Summary) Percent() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return 100 * float64(s.Passed) / float64(s.Total)
+}
+
+// String formats s as the pass rate followed by a line for each stage
+// that tests failed in.
+func (s Summary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d tests passed (%.1f%%)\n", s.Passed, s.Total, s.Percent())
+	for _, stage := range Stages {
+		if n := s.Failed[stage]; n > 0 {
+			fmt.Fprintf(&b, "  %-10s %d failed\n", stage+":", n)
+		}
+	}
+	return b.String()
+}
+
+// Tests returns the test programs in dir: the files matching the glob
+// pattern, such as "cgtest*.occ", in name order.
+func Tests(dir, pattern string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files matching " + pattern + " in " + dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,95 @@
+package conformance
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"cgmain.inc": `PROC check(VAL INT got, want, VAL []BYTE name, CHAN OF BYTE out!)
+  IF
+    got = want
+      SKIP
+    TRUE
+      SEQ
+        SEQ i = 0 FOR SIZE name
+          out ! name[i]
+        SEQ i = 0 FOR SIZE " FAILED*n"
+          out ! " FAILED*n"[i]
+:
+`,
+		"cgtest01.occ": `#INCLUDE "cgmain.inc"
+PROC cgtest01(CHAN OF BYTE keyb?, scr!, err!)
+  check(2 + 2, 4, "add", scr!)
+:
+`,
+		"cgtest02.occ": `PROC cgtest02(CHAN OF BYTE keyb?, scr!, err!)
+  SEQ
+    x := := 1
+:
+`,
+		"cgtest03.occ": `#INCLUDE "cgmain.inc"
+PROC cgtest03(CHAN OF BYTE keyb?, scr!, err!)
+  check(2 + 2, 5, "add", scr!)
+:
+`,
+		"cgtest04.occ": `PROC cgtest04(CHAN OF BYTE keyb?, scr!, err!)
+  STOP
+:
+`,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests, err := Tests(dir, "cgtest*.occ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 4 || filepath.Base(tests[0]) != "cgtest01.occ" {
+		t.Fatalf("expected the 4 cgtests in order, got %v", tests)
+	}
+
+	reported := 0
+	results := Run(tests, Options{Timeout: 5 * time.Second, Jobs: 2}, func(Result) { reported++ })
+	if reported != 4 {
+		t.Errorf("expected 4 results reported, got %d", reported)
+	}
+	want := []struct {
+		stage  Stage
+		detail string
+	}{
+		{StagePass, ""},
+		{StageTranspile, "unexpected token"},
+		{StageCheck, "add FAILED"},
+		{StageRun, "STOP"},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.File != tests[i] || r.Stage != w.stage || !strings.Contains(r.Detail, w.detail) {
+			t.Errorf("%s: expected %s with %q, got %s with %q", filepath.Base(tests[i]), w.stage, w.detail, r.Stage, r.Detail)
+		}
+	}
+
+	summary := Summarize(results)
+	if summary.Passed != 1 || summary.Total != 4 || summary.Percent() != 25 {
+		t.Errorf("expected 1 of 4 passed, got %+v", summary)
+	}
+	wantSummary := "1 of 4 tests passed (25.0%)\n  transpile: 1 failed\n  run:       1 failed\n  check:     1 failed\n"
+	if got := summary.String(); got != wantSummary {
+		t.Errorf("expected summary %q, got %q", wantSummary, got)
+	}
+}
+
+func TestTestsNoMatch(t *testing.T) {
+	if _, err := Tests(t.TempDir(), "cgtest*.occ"); err == nil {
+		t.Error("expected an error for a directory without tests")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/codeassociates/occam2go/preproc"
+)
+
+// position is where in the original source a diagnostic applies. Line and
+// Col are 1-based, and 0 where not known.
+type position struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p position) String() string {
+	s := p.File
+	if p.Line > 0 {
+		s += ":" + strconv.Itoa(p.Line)
+		if p.Col > 0 {
+			s += ":" + strconv.Itoa(p.Col)
+		}
+	}
+	return s
+}
+
+var lineErrRe = regexp.MustCompile(`^line (\d+)(?::(\d+))?: (.*)`)
+
+// filePosRe matches the "file:line: msg" form of the preprocessor's errors.
+var filePosRe = regexp.MustCompile(`^(.+?):(\d+): (.*)`)
+
+// translateError rewrites "line NNN: msg" to "file:line: msg", and "line
+// NNN:CC: msg" to "file:line:col: msg", using the source map.
+func translateError(errMsg string, sourceMap []preproc.SourceLoc) string {
+	pos, msg, ok := errorPos(errMsg, sourceMap)
+	if !ok {
+		return errMsg
+	}
+	return pos.String() + ": " + msg
+}
+
+// errorPos splits a "line NNN[:CC]: msg" error into its position in the
+// original source and msg.
+func errorPos(errMsg string, sourceMap []preproc.SourceLoc) (position, string, bool) {
+	m := lineErrRe.FindStringSubmatch(errMsg)
+	if m == nil {
+		return position{}, errMsg, false
+	}
+	lineNum, _ := strconv.Atoi(m[1])
+	idx := lineNum - 1 // source map is 0-indexed
+	if idx < 0 || idx >= len(sourceMap) {
+		return position{}, errMsg, false
+	}
+	col, _ := strconv.Atoi(m[2])
+	return position{File: sourceMap[idx].File, Line: sourceMap[idx].Line, Col: col}, m[3], true
+}
+
+// sourcePos returns a function naming expanded source line n as the
+// "file:line" it came from, for codegen.WithSourcePos. The file is named
+// relative to root, the directory of the program, or by its base name when
+// outside it, so that the generated code is the same wherever the
+// transpiler is run from.
+func sourcePos(sourceMap []preproc.SourceLoc, root string) func(n int) string {
+	return func(n int) string {
+		if n < 1 || n > len(sourceMap) || sourceMap[n-1].File == "" {
+			return fmt.Sprintf("line %d", n)
+		}
+		file := filepath.Base(sourceMap[n-1].File)
+		if rel, err := filepath.Rel(root, sourceMap[n-1].File); err == nil && filepath.IsLocal(rel) {
+			file = filepath.ToSlash(rel)
+		}
+		return position{File: file, Line: sourceMap[n-1].Line}.String()
+	}
+}
+
+// jsonDiagnostic is an error or warning as printed by -json-diagnostics.
+type jsonDiagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Col      int    `json:"col"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// diagnostics reports the errors and warnings of a run to stderr: each as
+// it comes, as
+//
+//	file:line:col: severity: msg
+//	<the source line>
+//	<a caret under column col>
+//
+// or, with -json-diagnostics, all together as one JSON array of
+// jsonDiagnostic when the run ends (see flush).
+type diagnostics struct {
+	json   bool
+	list   []jsonDiagnostic
+	errors int
+}
+
+// add reports msg at pos, with source, the line of source at pos, if known.
+func (d *diagnostics) add(severity string, pos position, msg, source string) {
+	if severity == "error" {
+		d.errors++
+	}
+	if d.json {
+		d.list = append(d.list, jsonDiagnostic{pos.File, pos.Line, pos.Col, severity, msg})
+		return
+	}
+	out := severity + ": " + msg
+	if pos.File != "" {
+		out = pos.String() + ": " + out
+	}
+	if strings.TrimSpace(source) != "" {
+		out += "\n" + source
+		if pos.Col > 0 {
+			// Keep the source's tabs so the caret lines up however they show
+			var caret strings.Builder
+			for i := 0; i < pos.Col-1; i++ {
+				if i < len(source) && source[i] == '\t' {
+					caret.WriteByte('\t')
+				} else {
+					caret.WriteByte(' ')
+				}
+			}
+			out += "\n" + caret.String() + "^"
+		}
+	}
+	fmt.Fprintln(os.Stderr, out)
+}
+
+// report reports errs, "line NNN[:CC]: msg" errors or warnings from the
+// parser, sema or codegen, mapped through the source map to the original
+// files. The source lines come from expanded, the preprocessor's output.
+func (d *diagnostics) report(severity string, errs []string, sourceMap []preproc.SourceLoc, expanded string) {
+	lines := strings.Split(expanded, "\n")
+	for _, e := range errs {
+		pos, msg, ok := errorPos(e, sourceMap)
+		source := ""
+		if m := lineErrRe.FindStringSubmatch(e); ok && m != nil {
+			if n, _ := strconv.Atoi(m[1]); n <= len(lines) {
+				source = strings.TrimRight(lines[n-1], "\r")
+			}
+		}
+		d.add(severity, pos, msg, source)
+	}
+}
+
+// preprocError reports err, which stopped the preprocessor in file, or in
+// the file err starts by naming when file is "".
+func (d *diagnostics) preprocError(file string, err error) {
+	pos, msg := position{File: file}, err.Error()
+	if f, rest, ok := strings.Cut(msg, ": "); file == "" && ok {
+		pos.File, msg = f, rest
+	}
+	if m := lineErrRe.FindStringSubmatch(msg); m != nil {
+		pos.Line, _ = strconv.Atoi(m[1])
+		msg = m[3]
+	}
+	d.add("error", pos, msg, "")
+}
+
+// preprocMessages reports msgs, the "file[:line]: msg" Errors of the
+// preprocessor, with severity.
+func (d *diagnostics) preprocMessages(severity string, msgs []string) {
+	for _, m := range msgs {
+		var pos position
+		if sm := filePosRe.FindStringSubmatch(m); sm != nil {
+			pos.File, m = sm[1], sm[3]
+			pos.Line, _ = strconv.Atoi(sm[2])
+		} else if f, rest, ok := strings.Cut(m, ": "); ok {
+			pos.File, m = f, rest
+		}
+		d.add(severity, pos, m, "")
+	}
+}
+
+// flush prints the JSON array of the diagnostics reported, empty if there
+// were none, with -json-diagnostics; otherwise they are already printed.
+func (d *diagnostics) flush() {
+	if !d.json {
+		return
+	}
+	list := d.list
+	if list == nil {
+		list = []jsonDiagnostic{}
+	}
+	out, _ := json.MarshalIndent(list, "", "  ")
+	fmt.Fprintln(os.Stderr, string(out))
+}
+
+// exit flushes the diagnostics and exits with code.
+func (d *diagnostics) exit(code int) {
+	d.flush()
+	os.Exit(code)
+}
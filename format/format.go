@@ -0,0 +1,184 @@
+// Package format prints an occam AST back as occam source, with 2-space
+// indentation and one spelling of each construct. Print renders a bare
+// AST, as after lowering; Source reformats a whole source file, keeping its
+// comments, blank lines and preprocessor directives.
+package format
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/codeassociates/occam2go/ast"
+	"github.com/codeassociates/occam2go/lexer"
+	"github.com/codeassociates/occam2go/parser"
+)
+
+// directives are the preprocessor directives Source keeps as written.
+var directives = map[string]bool{
+	"DEFINE": true, "IF": true, "ELSE": true, "ENDIF": true,
+	"INCLUDE": true, "COMMENT": true, "PRAGMA": true, "USE": true,
+}
+
+// Source formats occam source. Comments stay with the statement they
+// precede or end the line of, and runs of blank lines between statements
+// become one. Preprocessor directive lines are kept like comments rather
+// than acted on, so the code in every #IF branch is formatted. If the
+// source does not parse, Source returns the parser's errors instead.
+func Source(src string) (string, []string) {
+	lines := strings.Split(src, "\n")
+	code := make([]string, len(lines))
+	var kept []lexer.Comment
+	for i, line := range lines {
+		if trimmed := strings.TrimSpace(line); isDirective(trimmed) {
+			kept = append(kept, lexer.Comment{Line: i + 1, Column: strings.IndexByte(line, '#') + 1, Text: trimmed})
+			continue // lexed as a blank line
+		}
+		code[i] = line
+	}
+
+	l := lexer.New(strings.Join(code, "\n"))
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return "", p.Errors()
+	}
+
+	kept = append(kept, l.Comments()...)
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Line < kept[j].Line })
+	pr := &printer{src: lines, comments: kept}
+	pr.statements(program.Statements)
+	for len(pr.comments) > 0 {
+		pr.comment()
+	}
+	return pr.builder.String(), nil
+}
+
+func isDirective(trimmed string) bool {
+	if !strings.HasPrefix(trimmed, "#") {
+		return false
+	}
+	fields := strings.Fields(trimmed[1:])
+	return len(fields) > 0 && directives[strings.ToUpper(fields[0])]
+}
+
+// stmtLine returns the source line a statement starts on.
+func stmtLine(stmt ast.Statement) int {
+	switch s := stmt.(type) {
+	case *ast.VarDecl:
+		return s.Token.Line
+	case *ast.ArrayDecl:
+		return s.Token.Line
+	case *ast.ChanDecl:
+		return s.Token.Line
+	case *ast.TimerDecl:
+		return s.Token.Line
+	case *ast.BarrierDecl:
+		return s.Token.Line
+	case *ast.Abbreviation:
+		return s.Token.Line
+	case *ast.RetypesDecl:
+		return s.Token.Line
+	case *ast.PlaceDecl:
+		return s.Token.Line
+	case *ast.ProtocolDecl:
+		return s.Token.Line
+	case *ast.RecordDecl:
+		return s.Token.Line
+	case *ast.DataTypeDecl:
+		return s.Token.Line
+	case *ast.ProcDecl:
+		return s.Token.Line
+	case *ast.FuncDecl:
+		return s.Token.Line
+	case *ast.Assignment:
+		return s.Token.Line
+	case *ast.MultiAssignment:
+		return s.Token.Line
+	case *ast.SeqBlock:
+		return s.Token.Line
+	case *ast.ParBlock:
+		return s.Token.Line
+	case *ast.AltBlock:
+		return s.Token.Line
+	case *ast.IfStatement:
+		return s.Token.Line
+	case *ast.CaseStatement:
+		return s.Token.Line
+	case *ast.WhileLoop:
+		return s.Token.Line
+	case *ast.ClaimBlock:
+		return s.Token.Line
+	case *ast.ForkingBlock:
+		return s.Token.Line
+	case *ast.Skip:
+		return s.Token.Line
+	case *ast.Stop:
+		return s.Token.Line
+	case *ast.Unsupported:
+		return s.Token.Line
+	case *ast.ProcCall:
+		return s.Token.Line
+	case *ast.ForkStmt:
+		return s.Token.Line
+	case *ast.SyncStmt:
+		return s.Token.Line
+	case *ast.Send:
+		return s.Token.Line
+	case *ast.Receive:
+		return s.Token.Line
+	case *ast.VariantReceive:
+		return s.Token.Line
+	case *ast.TimerRead:
+		return s.Token.Line
+	case *ast.TimerAfterWait:
+		return s.Token.Line
+	}
+	return 0
+}
+
+// exprLine returns the source line an expression starts on, or 0 if it is
+// not known.
+func exprLine(e ast.Expression) int {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		return e.Token.Line
+	case *ast.IntegerLiteral:
+		return e.Token.Line
+	case *ast.RealLiteral:
+		return e.Token.Line
+	case *ast.BooleanLiteral:
+		return e.Token.Line
+	case *ast.StringLiteral:
+		return e.Token.Line
+	case *ast.ByteLiteral:
+		return e.Token.Line
+	case *ast.BinaryExpr:
+		if line := exprLine(e.Left); line != 0 {
+			return line
+		}
+		return e.Token.Line
+	case *ast.UnaryExpr:
+		return e.Token.Line
+	case *ast.TypeConversion:
+		return e.Token.Line
+	case *ast.SizeExpr:
+		return e.Token.Line
+	case *ast.MostExpr:
+		return e.Token.Line
+	case *ast.ParenExpr:
+		return e.Token.Line
+	case *ast.IndexExpr:
+		return exprLine(e.Left)
+	case *ast.FuncCall:
+		return e.Token.Line
+	case *ast.SliceExpr:
+		return e.Token.Line
+	case *ast.ArrayLiteral:
+		return e.Token.Line
+	case *ast.ArrayConstructor:
+		return e.Token.Line
+	case *ast.ValofExpr:
+		return e.Token.Line
+	}
+	return 0
+}
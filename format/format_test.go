@@ -0,0 +1,302 @@
+package format
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/codeassociates/occam2go/ast"
+	"github.com/codeassociates/occam2go/lexer"
+	"github.com/codeassociates/occam2go/parser"
+)
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		t.FailNow()
+	}
+	return program
+}
+
+func TestPrintRoundTrip(t *testing.T) {
+	input := `PROTOCOL CMD
+  CASE
+    move ; INT ; INT
+    quit
+:
+PROTOCOL MORE EXTENDS CMD
+  CASE
+    jump ; INT
+:
+PROTOCOL PAIR IS INT ; BYTE
+PROTOCOL PACKET IS INT32::[]BYTE
+PROTOCOL BLOCK IS [4]BYTE ; INT
+RECORD POINT
+  INT x:
+  INT y:
+DATA TYPE MY.INT IS INT:
+DATA TYPE CELL
+  RECORD
+    MY.INT count:
+:
+CHAN TYPE LINK
+  MOBILE RECORD
+    CHAN OF INT req?:
+:
+VAL []BYTE greeting IS "hi*n":
+VAL REAL32 pi IS 3.14159(REAL32):
+VAL REAL64 eps IS 1.0E-6:
+VAL table IS [[1, 2], [3, 4]](INT32):
+VAL [3]INT primes IS [2, 3, 5]:
+INT FUNCTION double(VAL INT n)
+  IS n * 2
+:
+INT FUNCTION sum(VAL []INT xs)
+  VALOF
+    INT total:
+    SEQ
+      total := 0
+      SEQ i = 0 FOR SIZE xs
+        total := total + xs[i]
+    RESULT total
+:
+PROC worker(CHAN OF CMD in?, CHAN OF PAIR out!, [2]INT acc, VAL INT limit)
+  TIMER tim:
+  INT t, a, b:
+  BYTE ch:
+  SEQ
+    pkts ? n :: buf
+    pkts ! SIZE buf :: buf
+    tim ? t
+    tim ? AFTER t + 100
+    [acc FROM 0 FOR 1] := [limit]
+    a, b := acc[0], acc[1]
+    out ! a ; 'x'
+    in ? CASE
+      move ; a ; b
+        acc[0] := (a + b) * #FF
+      INT c:
+      quit
+        SKIP
+      ELSE
+        SKIP
+    PRI ALT
+      (a > 0) & SKIP
+        SKIP
+      tim ? AFTER t
+        SKIP
+      (a > 0) & out ! a ; 'y'
+        b := a
+      ALT i = 0 FOR 2
+        (acc[i] > 0) & out ! i ; 'z'
+          SKIP
+    pkts ?? n :: buf
+      SKIP
+    CASE a
+      1, 2
+        out ! INT a ; BYTE a
+      ELSE
+        STOP
+    WHILE NOT (a = MOSTNEG INT)
+      a := -a
+    a := 1 + (VALOF
+                INT s:
+                SEQ
+                  s := b * 2
+                RESULT s
+             )
+    acc := [i = 0 FOR 2 STEP 3 | i * b]
+    PLACE t AT #40:
+    PLACED PAR
+      PROCESSOR 0 T8
+        a := 1
+      PROCESSOR 1 T8
+        b := 2
+:
+PROC serve(SHARED LINK! cli, LINK? svr)
+  LINK? s:
+  SHARED LINK! c:
+  SEQ
+    s, c := MOBILE LINK
+    CLAIM cli
+      cli[req] ! 1
+:
+PROC fill(CHAN MOBILE []BYTE out!, MOBILE INT n)
+  MOBILE []BYTE buf:
+  SEQ
+    buf := MOBILE [n]BYTE
+    out ! buf
+:
+PROC spawn(CHAN MOBILE []BYTE out!)
+  FORKING
+    FORK fill(out!, 4)
+:
+PROC log(SHARED CHAN OF INT out!)
+  SHARED CHAN OF INT c:
+  CLAIM out!
+    out ! 1
+:
+PROC step(BARRIER b)
+  SYNC b
+:
+PROC route([]CHAN OF INT links)
+  SEQ
+    []CHAN OF INT mine IS [links FROM 1 FOR 2]:
+    [2]CHAN OF INT pair IS [links FROM 0 FOR 2]:
+    CHAN OF INT first! IS mine[0]:
+    first ! 1
+:
+PROC views(VAL REAL32 r, [2][3]INT grid)
+  SEQ
+    VAL INT bits RETYPES r:
+    [][4]BYTE rows RETYPES [grid FROM 0 FOR 1]:
+    [6]INT flat RESHAPES grid:
+    flat[0] := bits
+:
+PROC phases()
+  BARRIER b:
+  PAR i = 0 FOR 2 ENROLL b
+    step(b)
+:
+`
+	first := Print(parse(t, input))
+	second := Print(parse(t, first))
+	if first != second {
+		t.Errorf("printing is not stable:\nfirst:\n%s\nsecond:\n%s", first, second)
+	}
+	for _, want := range []string{
+		"    move ; INT ; INT\n",
+		"PROTOCOL PAIR IS INT ; BYTE:\n",
+		"PROTOCOL PACKET IS INT32::[]BYTE:\nPROTOCOL BLOCK IS [4]BYTE ; INT:\n",
+		"VAL [3]INT primes IS [2, 3, 5]:\n",
+		"    pkts ? n :: buf\n",
+		"    pkts ! SIZE buf :: buf\n",
+		"VAL []BYTE greeting IS \"hi*n\":\n",
+		"VAL REAL32 pi IS 3.14159(REAL32):\nVAL REAL64 eps IS 1.0E-6:\nVAL table IS [[1, 2], [3, 4]](INT32):\n",
+		"INT FUNCTION double(VAL INT n)\n  IS n * 2\n:\n",
+		"PROC worker(CHAN OF CMD in?, CHAN OF PAIR out!, [2]INT acc, VAL INT limit)\n",
+		"    tim ? AFTER t + 100\n",
+		"    acc[0] := (a + b) * #FF\n",
+		"    WHILE NOT (a = MOSTNEG INT)\n",
+		"    a := 1 + (VALOF\n        INT s:\n        SEQ\n          s := b * 2\n        RESULT s)\n",
+		"      (a > 0) & SKIP\n",
+		"      (a > 0) & out ! a ; 'y'\n        b := a\n",
+		"    pkts ?? n :: buf\n      SKIP\n",
+		"    acc := [i = 0 FOR 2 STEP 3 | i * b]\n",
+		"    PLACE t AT #40:\n",
+		"PROTOCOL MORE EXTENDS CMD\n  CASE\n    jump ; INT\n:\n",
+		"DATA TYPE MY.INT IS INT:\nDATA TYPE CELL\n  RECORD\n    MY.INT count:\n:\n",
+		"CHAN TYPE LINK\n  MOBILE RECORD\n    CHAN OF INT req?:\n:\n",
+		"PROC serve(SHARED LINK! cli, LINK? svr)\n  LINK? s:\n  SHARED LINK! c:\n  SEQ\n    s, c := MOBILE LINK\n    CLAIM cli\n      cli[req] ! 1\n",
+		"    PLACED PAR\n      PROCESSOR 0 T8\n        a := 1\n",
+		"PROC fill(CHAN OF MOBILE []BYTE out!, MOBILE INT n)\n  MOBILE []BYTE buf:\n  SEQ\n    buf := MOBILE [n]BYTE\n",
+		"  FORKING\n    FORK fill(out!, 4)\n",
+		"PROC log(SHARED CHAN OF INT out!)\n  SHARED CHAN OF INT c:\n  CLAIM out!\n    out ! 1\n",
+		"PROC step(BARRIER b)\n  SYNC b\n",
+		"    []CHAN OF INT mine IS [links FROM 1 FOR 2]:\n    [2]CHAN OF INT pair IS [links FROM 0 FOR 2]:\n    CHAN OF INT first! IS mine[0]:\n",
+		"  BARRIER b:\n  PAR i = 0 FOR 2 ENROLL b\n    step(b)\n",
+	} {
+		if !strings.Contains(first, want) {
+			t.Errorf("expected %q in output:\n%s", want, first)
+		}
+	}
+}
+
+func TestSource(t *testing.T) {
+	input := `-- Doubler
+#INCLUDE "course.module"
+
+PROC   double (CHAN OF INT in?,CHAN OF INT out!)  -- the worker
+    INT x :
+    SEQ
+        in ? x   -- read
+
+
+        -- double it
+        x := x*2
+        out ! x
+        -- sent
+:
+
+PROC main(CHAN OF BYTE scr!)
+  CHAN OF INT a, b:
+  INT y:
+  PAR
+    double(a?, b!)
+    SEQ
+      a ! 1
+      b ? y
+      IF
+        -- big
+        y > 1
+          SKIP
+        TRUE
+          SKIP
+:
+-- end
+`
+	want := `-- Doubler
+#INCLUDE "course.module"
+
+PROC double(CHAN OF INT in?, CHAN OF INT out!)  -- the worker
+  INT x:
+  SEQ
+    in ? x  -- read
+
+    -- double it
+    x := x * 2
+    out ! x
+    -- sent
+:
+
+PROC main(CHAN OF BYTE scr!)
+  CHAN OF INT a, b:
+  INT y:
+  PAR
+    double(a?, b!)
+    SEQ
+      a ! 1
+      b ? y
+      IF
+        -- big
+        y > 1
+          SKIP
+        TRUE
+          SKIP
+:
+-- end
+`
+	got, errs := Source(input)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if again, _ := Source(got); again != got {
+		t.Errorf("formatting is not stable:\n%s", again)
+	}
+}
+
+func TestSourceDirectives(t *testing.T) {
+	input := "#IF DEFINED (DEBUG)\nVAL INT level IS 2 :\n#ELSE\nVAL INT level IS 0 :\n#ENDIF\n"
+	want := "#IF DEFINED (DEBUG)\nVAL INT level IS 2:\n#ELSE\nVAL INT level IS 0:\n#ENDIF\n"
+	got, errs := Source(input)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSourceErrors(t *testing.T) {
+	got, errs := Source("PROC p()\n  x :=\n:\n")
+	if got != "" || len(errs) == 0 || !strings.HasPrefix(errs[0], "line 3:") {
+		t.Errorf("expected a parse error on line 3 and no output, got %q, %v", got, errs)
+	}
+}
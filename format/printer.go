@@ -0,0 +1,691 @@
+package format
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/codeassociates/occam2go/ast"
+	"github.com/codeassociates/occam2go/lexer"
+)
+
+// Print renders an AST back to occam source (2-space indentation).
+// Parentheses are inserted around nested binary operands, since occam has
+// no operator precedence and the parser does not keep the originals.
+func Print(program *ast.Program) string {
+	pr := &printer{}
+	pr.statements(program.Statements)
+	return pr.builder.String()
+}
+
+type printer struct {
+	builder strings.Builder
+	indent  int
+
+	// For Source: the original lines, the comments (and directives) not
+	// yet printed, and the line whose end comment goes on the next line
+	// printed
+	src      []string
+	comments []lexer.Comment
+	trailing int
+}
+
+func (pr *printer) line(s string) {
+	pr.builder.WriteString(strings.Repeat("  ", pr.indent))
+	// The lines of a VALOF expression after its first are indented from this one
+	pr.builder.WriteString(strings.ReplaceAll(s, "\n", "\n"+strings.Repeat("  ", pr.indent)))
+	if pr.trailing > 0 && len(pr.comments) > 0 && pr.comments[0].Line == pr.trailing {
+		pr.builder.WriteString("  " + pr.comments[0].Text)
+		pr.comments = pr.comments[1:]
+	}
+	pr.trailing = 0
+	pr.builder.WriteString("\n")
+}
+
+func (pr *printer) block(stmts []ast.Statement) {
+	pr.indent++
+	pr.statements(stmts)
+	pr.blockComments(stmts)
+	pr.indent--
+}
+
+// at prepares for printing source line n: it prints the comments on the
+// lines before it, and a blank line if n had one before it, and marks n's
+// own end comment to go on the end of the next line printed.
+func (pr *printer) at(n int) {
+	if pr.src == nil || n == 0 {
+		return
+	}
+	for len(pr.comments) > 0 && pr.comments[0].Line < n {
+		pr.comment()
+	}
+	pr.blank(n)
+	pr.trailing = n
+}
+
+// comment prints the next comment on a line of its own.
+func (pr *printer) comment() {
+	c := pr.comments[0]
+	pr.comments = pr.comments[1:]
+	pr.blank(c.Line)
+	pr.trailing = 0
+	pr.line(c.Text)
+}
+
+// blank prints a blank line if source line n follows one, except at the
+// start of the output or after another blank line.
+func (pr *printer) blank(n int) {
+	if n < 2 || n-2 >= len(pr.src) || strings.TrimSpace(pr.src[n-2]) != "" {
+		return
+	}
+	if out := pr.builder.String(); out != "" && !strings.HasSuffix(out, "\n\n") {
+		pr.builder.WriteString("\n")
+	}
+}
+
+// blockComments prints the comments after the last statement of a block
+// that are indented as deeply as the block, up to the first line of code
+// indented less, so that they stay in the block.
+func (pr *printer) blockComments(stmts []ast.Statement) {
+	if pr.src == nil || len(stmts) == 0 {
+		return
+	}
+	first, last := stmtLine(stmts[0]), stmtLine(stmts[len(stmts)-1])
+	if first == 0 || last == 0 {
+		return
+	}
+	depth := indent(pr.src[first-1])
+	for len(pr.comments) > 0 {
+		c, line := pr.comments[0], pr.src[pr.comments[0].Line-1]
+		if indent(line) < depth || strings.TrimSpace(line) != c.Text {
+			return // shallower, or at the end of a line of code
+		}
+		for _, line := range pr.src[last:c.Line] {
+			if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "--") && indent(line) < depth {
+				return
+			}
+		}
+		pr.comment()
+	}
+}
+
+// indent returns the indentation of a source line, counting a tab as two
+// spaces as the lexer does.
+func indent(line string) int {
+	n := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 2
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+func (pr *printer) statements(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		pr.statement(stmt)
+	}
+}
+
+func (pr *printer) statement(stmt ast.Statement) {
+	pr.at(stmtLine(stmt))
+	switch s := stmt.(type) {
+	case *ast.VarDecl:
+		shared := ""
+		if s.Shared {
+			shared = "SHARED "
+		}
+		pr.line(fmt.Sprintf("%s%s%s %s:", shared, typeRef(s.TypeRef), s.End, strings.Join(s.Names, ", ")))
+	case *ast.ArrayDecl:
+		pr.line(fmt.Sprintf("%s %s:", typeRef(s.TypeRef), strings.Join(s.Names, ", ")))
+	case *ast.ChanDecl:
+		shared := ""
+		if s.Shared {
+			shared = "SHARED "
+		}
+		pr.line(fmt.Sprintf("%s%s %s:", shared, typeRef(s.TypeRef), strings.Join(s.Names, ", ")))
+	case *ast.TimerDecl:
+		pr.line(fmt.Sprintf("TIMER %s:", strings.Join(s.Names, ", ")))
+	case *ast.BarrierDecl:
+		pr.line(fmt.Sprintf("BARRIER %s:", strings.Join(s.Names, ", ")))
+	case *ast.Abbreviation:
+		if s.IsChan {
+			pr.line(fmt.Sprintf("%s %s%s IS %s:", typeRef(s.TypeRef), s.Name, s.ChanDir, expr(s.Value)))
+			break
+		}
+		var prefix string
+		if s.IsInitial {
+			prefix = "INITIAL "
+		} else if s.IsVal {
+			prefix = "VAL "
+		}
+		var typ string
+		if s.TypeRef != nil {
+			typ = typeRef(s.TypeRef) + " "
+		}
+		pr.line(fmt.Sprintf("%s%s%s IS %s:", prefix, typ, s.Name, expr(s.Value)))
+	case *ast.RetypesDecl:
+		var prefix string
+		if s.IsVal {
+			prefix = "VAL "
+		}
+		keyword := "RETYPES"
+		if s.Reshapes {
+			keyword = "RESHAPES"
+		}
+		pr.line(fmt.Sprintf("%s%s %s %s %s :", prefix, typeRef(s.TypeRef), s.Name, keyword, expr(s.Source)))
+	case *ast.PlaceDecl:
+		pr.line(fmt.Sprintf("PLACE %s AT %s:", s.Name, expr(s.Address)))
+	case *ast.ProtocolDecl:
+		pr.protocol(s)
+	case *ast.RecordDecl:
+		if s.DataType {
+			pr.line("DATA TYPE " + s.Name)
+			pr.indent++
+			pr.line("RECORD")
+		} else if s.ChanType {
+			pr.line("CHAN TYPE " + s.Name)
+			pr.indent++
+			pr.line("MOBILE RECORD")
+		} else {
+			pr.line("RECORD " + s.Name)
+		}
+		pr.indent++
+		for _, f := range s.Fields {
+			if f.IsChan {
+				pr.line(fmt.Sprintf("CHAN OF %s %s%s:", f.Type, f.Name, f.Dir))
+			} else {
+				pr.line(fmt.Sprintf("%s %s:", f.Type, f.Name))
+			}
+		}
+		pr.indent--
+		if s.DataType || s.ChanType {
+			pr.indent--
+			pr.line(":")
+		}
+	case *ast.DataTypeDecl:
+		pr.line(fmt.Sprintf("DATA TYPE %s IS %s:", s.Name, s.Type))
+	case *ast.ProcDecl:
+		pr.line(fmt.Sprintf("PROC %s(%s)", s.Name, params(s.Params)))
+		pr.block(s.Body)
+		pr.line(":")
+	case *ast.FuncDecl:
+		pr.function(s)
+	case *ast.Assignment:
+		var target string
+		if s.SliceTarget != nil {
+			target = expr(s.SliceTarget)
+		} else {
+			target = s.Name + indices(s.Indices)
+		}
+		pr.line(fmt.Sprintf("%s := %s", target, expr(s.Value)))
+	case *ast.MultiAssignment:
+		var targets []string
+		for _, t := range s.Targets {
+			targets = append(targets, t.Name+indices(t.Indices))
+		}
+		pr.line(fmt.Sprintf("%s := %s", strings.Join(targets, ", "), exprList(s.Values)))
+	case *ast.SeqBlock:
+		pr.line("SEQ" + replicator(s.Replicator))
+		pr.block(s.Statements)
+	case *ast.ParBlock:
+		kw := "PAR"
+		if s.Priority {
+			kw = "PRI PAR"
+		}
+		if s.Processors != nil {
+			kw = "PLACED PAR"
+		}
+		enroll := ""
+		if len(s.Enroll) > 0 {
+			enroll = " ENROLL " + strings.Join(s.Enroll, ", ")
+		}
+		pr.line(kw + replicator(s.Replicator) + enroll)
+		if s.Processors == nil {
+			pr.block(s.Statements)
+			break
+		}
+		pr.indent++
+		for i, proc := range s.Processors {
+			pr.line(fmt.Sprintf("PROCESSOR %s %s", expr(proc.Number), proc.Type))
+			pr.block(s.Statements[i : i+1])
+		}
+		pr.indent--
+	case *ast.AltBlock:
+		pr.alt(s)
+	case *ast.IfStatement:
+		pr.ifStatement(s)
+	case *ast.CaseStatement:
+		pr.line("CASE " + expr(s.Selector))
+		pr.indent++
+		for _, c := range s.Choices {
+			if c.IsElse {
+				pr.line("ELSE")
+			} else {
+				pr.at(exprLine(c.Values[0]))
+				pr.line(exprList(c.Values))
+			}
+			pr.block(c.Body)
+		}
+		pr.indent--
+	case *ast.WhileLoop:
+		pr.line("WHILE " + expr(s.Condition))
+		pr.block(s.Body)
+	case *ast.ClaimBlock:
+		pr.line("CLAIM " + s.Name + s.End)
+		pr.block(s.Body)
+	case *ast.ForkingBlock:
+		pr.line("FORKING")
+		pr.block(s.Body)
+	case *ast.Skip:
+		pr.line("SKIP")
+	case *ast.Stop:
+		pr.line("STOP")
+	case *ast.Unsupported:
+		pr.line("-- occam2go: unsupported: " + s.Text)
+	case *ast.ProcCall:
+		pr.line(call(s))
+	case *ast.ForkStmt:
+		pr.line("FORK " + call(s.Call))
+	case *ast.SyncStmt:
+		pr.line("SYNC " + s.Barrier)
+	case *ast.Send:
+		pr.line(send(s))
+	case *ast.Receive:
+		targets := receiveItems(append([]string{s.Variable + indices(s.VariableIndices)}, s.Variables...), s.Arrays)
+		pr.line(fmt.Sprintf("%s%s ? %s", s.Channel, indices(s.ChannelIndices), strings.Join(targets, " ; ")))
+	case *ast.VariantReceive:
+		pr.line(fmt.Sprintf("%s%s ? CASE", s.Channel, indices(s.ChannelIndices)))
+		pr.variants(s)
+	case *ast.TimerRead:
+		pr.line(fmt.Sprintf("%s ? %s", s.Timer, s.Variable))
+	case *ast.TimerAfterWait:
+		pr.line(fmt.Sprintf("%s ? AFTER %s", s.Timer, expr(s.Deadline)))
+	case nil:
+		// parser leaves nil entries for statements it could not parse
+	default:
+		pr.line(fmt.Sprintf("-- unprintable statement %T", stmt))
+	}
+}
+
+// variants prints the variants of a ? CASE, indented below it.
+func (pr *printer) variants(s *ast.VariantReceive) {
+	pr.indent++
+	for _, c := range s.Cases {
+		pr.statements(c.Declarations)
+		if c.IsElse {
+			pr.line("ELSE")
+		} else {
+			pr.line(strings.Join(append([]string{c.Tag}, receiveItems(c.Variables, c.Arrays)...), " ; "))
+		}
+		pr.block(c.Body)
+	}
+	pr.indent--
+}
+
+func (pr *printer) protocol(s *ast.ProtocolDecl) {
+	switch s.Kind {
+	case "variant":
+		if s.Extends != "" {
+			pr.line(fmt.Sprintf("PROTOCOL %s EXTENDS %s", s.Name, s.Extends))
+		} else {
+			pr.line("PROTOCOL " + s.Name)
+		}
+		pr.indent++
+		pr.line("CASE")
+		pr.indent++
+		for _, v := range s.Variants {
+			if v.From != "" {
+				continue // printed with the base PROTOCOL
+			}
+			pr.line(strings.Join(append([]string{v.Tag}, typeRefs(v.Items)...), " ; "))
+		}
+		pr.indent -= 2
+		pr.line(":")
+	default:
+		pr.line(fmt.Sprintf("PROTOCOL %s IS %s:", s.Name, strings.Join(typeRefs(s.Items), " ; ")))
+	}
+}
+
+func (pr *printer) function(s *ast.FuncDecl) {
+	header := fmt.Sprintf("%s FUNCTION %s(%s)", strings.Join(typeRefs(s.Results), ", "), s.Name, params(s.Params))
+	pr.line(header)
+	pr.indent++
+	if len(s.Body) == 0 {
+		pr.line("IS " + exprList(s.ResultExprs))
+		pr.indent--
+		pr.line(":")
+		return
+	}
+	pr.line("VALOF")
+	pr.indent++
+	pr.statements(s.Body)
+	pr.line("RESULT " + exprList(s.ResultExprs))
+	pr.indent -= 2
+	pr.line(":")
+}
+
+// send renders an output: c ! x, c ! x ; y or c ! tag ; x.
+func send(s *ast.Send) string {
+	var items []string
+	if s.VariantTag != "" {
+		items = append(items, s.VariantTag)
+	} else if s.Value != nil {
+		items = append(items, expr(s.Value))
+	}
+	for _, v := range s.Values {
+		items = append(items, expr(v))
+	}
+	return fmt.Sprintf("%s%s ! %s", s.Channel, indices(s.ChannelIndices), strings.Join(items, " ; "))
+}
+
+func (pr *printer) alt(s *ast.AltBlock) {
+	if s.ExtendedInput {
+		// c ?? x outside an ALT: just the case
+		pr.altCases(s.Cases)
+		return
+	}
+	kw := "ALT"
+	if s.Priority {
+		kw = "PRI ALT"
+	}
+	pr.line(kw + replicator(s.Replicator))
+	pr.indent++
+	pr.altCases(s.Cases)
+	pr.indent--
+}
+
+func (pr *printer) altCases(cases []ast.AltCase) {
+	for _, c := range cases {
+		if c.IsAlt {
+			pr.statement(c.Body[0])
+			continue
+		}
+		pr.statements(c.Declarations)
+		var input string
+		body := c.Body
+		op := "?"
+		if c.Extended {
+			op = "??"
+		}
+		switch {
+		case c.IsTimer:
+			input = fmt.Sprintf("%s ? AFTER %s", c.Timer, expr(c.Deadline))
+		case c.IsSkip:
+			input = "SKIP"
+		case c.IsOutput:
+			input = send(c.Body[0].(*ast.Send))
+			body = c.Body[1:]
+		case c.IsVariant:
+			input = fmt.Sprintf("%s%s ? CASE", c.Channel, indices(c.ChannelIndices))
+		default:
+			targets := receiveItems(append([]string{c.Variable + indices(c.VariableIndices)}, c.Variables...), c.Arrays)
+			input = fmt.Sprintf("%s%s %s %s", c.Channel, indices(c.ChannelIndices), op, strings.Join(targets, " ; "))
+		}
+		if c.Guard != nil {
+			pr.at(exprLine(c.Guard))
+			input = operand(c.Guard) + " & " + input
+		}
+		pr.line(input)
+		if c.IsVariant {
+			pr.variants(c.Body[0].(*ast.VariantReceive))
+		} else {
+			pr.block(body)
+		}
+	}
+}
+
+func (pr *printer) ifStatement(s *ast.IfStatement) {
+	pr.line("IF" + replicator(s.Replicator))
+	pr.indent++
+	for _, c := range s.Choices {
+		if c.NestedIf != nil {
+			pr.ifStatement(c.NestedIf)
+			continue
+		}
+		pr.at(exprLine(c.Condition))
+		pr.line(expr(c.Condition))
+		pr.block(c.Body)
+	}
+	pr.indent--
+}
+
+func params(ps []ast.ProcParam) string {
+	var out []string
+	for _, p := range ps {
+		var s string
+		if p.IsVal {
+			s = "VAL "
+		}
+		if p.Shared {
+			s = "SHARED "
+		}
+		if p.IsChan {
+			s += typeRef(p.TypeRef) + " " + p.Name + p.ChanDir
+		} else {
+			s += typeRef(p.TypeRef) + p.ChanDir + " " + p.Name
+		}
+		out = append(out, s)
+	}
+	return strings.Join(out, ", ")
+}
+
+// typeRef renders a structured type as it is written in occam.
+func typeRef(t *ast.TypeRef) string {
+	s := mobile(t.Mobile)
+	switch t.Kind {
+	case ast.ArrayType:
+		if t.Size != nil {
+			return s + "[" + expr(t.Size) + "]" + typeRef(t.Elem)
+		}
+		return s + "[]" + typeRef(t.Elem)
+	case ast.ChanType:
+		return s + "CHAN OF " + typeRef(t.Elem)
+	case ast.CountedType:
+		return s + typeRef(t.Count) + "::[]" + typeRef(t.Elem)
+	}
+	return s + t.Name
+}
+
+// typeRefs renders each of types.
+func typeRefs(types []*ast.TypeRef) []string {
+	out := make([]string, len(types))
+	for i, t := range types {
+		out[i] = typeRef(t)
+	}
+	return out
+}
+
+// mobile renders the MOBILE qualifier of a declaration or parameter.
+func mobile(on bool) string {
+	if on {
+		return "MOBILE "
+	}
+	return ""
+}
+
+func replicator(r *ast.Replicator) string {
+	if r == nil {
+		return ""
+	}
+	s := fmt.Sprintf(" %s = %s FOR %s", r.Variable, expr(r.Start), expr(r.Count))
+	if r.Step != nil {
+		s += " STEP " + expr(r.Step)
+	}
+	return s
+}
+
+func dims(sizes []ast.Expression) string {
+	var s string
+	for _, size := range sizes {
+		s += "[" + expr(size) + "]"
+	}
+	return s
+}
+
+func indices(idx []ast.Expression) string {
+	return dims(idx)
+}
+
+// receiveItems renders received variables, as "n :: arr" for counted arrays.
+func receiveItems(vars, arrays []string) []string {
+	out := make([]string, len(vars))
+	for i, v := range vars {
+		out[i] = v
+		if i < len(arrays) && arrays[i] != "" {
+			out[i] += " :: " + arrays[i]
+		}
+	}
+	return out
+}
+
+// call renders a PROC call with any direction annotations on its arguments.
+func call(c *ast.ProcCall) string {
+	var args []string
+	for i, arg := range c.Args {
+		s := expr(arg)
+		if i < len(c.ArgDirs) {
+			s += c.ArgDirs[i]
+		}
+		args = append(args, s)
+	}
+	return fmt.Sprintf("%s(%s)", c.Name, strings.Join(args, ", "))
+}
+
+func exprList(exprs []ast.Expression) string {
+	var out []string
+	for _, e := range exprs {
+		out = append(out, expr(e))
+	}
+	return strings.Join(out, ", ")
+}
+
+// operand renders a sub-expression, parenthesizing compound operands.
+func operand(e ast.Expression) string {
+	switch e.(type) {
+	case *ast.BinaryExpr, *ast.UnaryExpr, *ast.TypeConversion, *ast.SizeExpr:
+		return "(" + expr(e) + ")"
+	}
+	return expr(e)
+}
+
+func expr(e ast.Expression) string {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		return e.Value
+	case *ast.IntegerLiteral:
+		if e.Token.Type == lexer.INT && strings.HasPrefix(e.Token.Literal, "0x") {
+			return "#" + strings.ToUpper(e.Token.Literal[2:])
+		}
+		return fmt.Sprintf("%d", e.Value)
+	case *ast.RealLiteral:
+		text := e.Token.Literal
+		if e.Token.Type != lexer.REAL {
+			text = strconv.FormatFloat(e.Value, 'f', -1, 64)
+			if !strings.Contains(text, ".") {
+				text += ".0"
+			}
+		}
+		if e.Type != "" {
+			text += "(" + e.Type + ")"
+		}
+		return text
+	case *ast.BooleanLiteral:
+		if e.Value {
+			return "TRUE"
+		}
+		return "FALSE"
+	case *ast.StringLiteral:
+		if e.Token.Type == lexer.STRING {
+			return "\"" + e.Token.Literal + "\""
+		}
+		return "\"" + escape(e.Value, '"') + "\""
+	case *ast.ByteLiteral:
+		if e.Token.Type == lexer.BYTE_LIT {
+			return "'" + e.Token.Literal + "'"
+		}
+		return "'" + escape(string(e.Value), '\'') + "'"
+	case *ast.BinaryExpr:
+		return fmt.Sprintf("%s %s %s", operand(e.Left), e.Operator, operand(e.Right))
+	case *ast.UnaryExpr:
+		if e.Operator == "NOT" {
+			return "NOT " + operand(e.Right)
+		}
+		return e.Operator + operand(e.Right)
+	case *ast.TypeConversion:
+		if e.Qualifier != "" {
+			return fmt.Sprintf("%s %s %s", e.TargetType, e.Qualifier, operand(e.Expr))
+		}
+		return e.TargetType + " " + operand(e.Expr)
+	case *ast.SizeExpr:
+		return "SIZE " + operand(e.Expr)
+	case *ast.MobileExpr:
+		if e.Size != nil {
+			return "MOBILE [" + expr(e.Size) + "]" + e.Type
+		}
+		return "MOBILE " + e.Type
+	case *ast.MostExpr:
+		if e.IsNeg {
+			return "MOSTNEG " + e.ExprType
+		}
+		return "MOSTPOS " + e.ExprType
+	case *ast.ParenExpr:
+		return "(" + expr(e.Expr) + ")"
+	case *ast.IndexExpr:
+		return expr(e.Left) + "[" + expr(e.Index) + "]"
+	case *ast.FuncCall:
+		return fmt.Sprintf("%s(%s)", e.Name, exprList(e.Args))
+	case *ast.SliceExpr:
+		return fmt.Sprintf("[%s FROM %s FOR %s]", expr(e.Array), expr(e.Start), expr(e.Length))
+	case *ast.CountedArrayExpr:
+		return fmt.Sprintf("%s :: %s", expr(e.Count), expr(e.Array))
+	case *ast.ArrayLiteral:
+		if e.Type != "" {
+			return "[" + exprList(e.Elements) + "](" + e.Type + ")"
+		}
+		return "[" + exprList(e.Elements) + "]"
+	case *ast.ArrayConstructor:
+		return "[" + strings.TrimPrefix(replicator(e.Replicator), " ") + " | " + expr(e.Value) + "]"
+	case *ast.ValofExpr:
+		// The body goes on the lines below, which line indents
+		body := &printer{indent: 2}
+		body.statements(e.Body)
+		body.line("RESULT " + expr(e.Result) + ")")
+		return "(VALOF\n" + strings.TrimSuffix(body.builder.String(), "\n")
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("<%T>", e)
+}
+
+// escape re-encodes a decoded occam string using * escapes.
+func escape(s string, quote byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\n':
+			b.WriteString("*n")
+		case '\r':
+			b.WriteString("*c")
+		case '\t':
+			b.WriteString("*t")
+		case '*':
+			b.WriteString("**")
+		case quote:
+			b.WriteByte('*')
+			b.WriteByte(c)
+		default:
+			if c < ' ' || c > '~' {
+				fmt.Fprintf(&b, "*#%02X", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/codeassociates/occam2go/codegen"
+)
+
+// occam2goModule is the module the runtime package, imported by programs
+// transpiled with -use-runtime, belongs to.
+const occam2goModule = "github.com/codeassociates/occam2go"
+
+// parseTarget splits a build -target of the form GOOS/GOARCH, or "host"
+// for the machine running the transpiler.
+func parseTarget(target string) (goos, goarch string, err error) {
+	if target == "host" {
+		return runtime.GOOS, runtime.GOARCH, nil
+	}
+	goos, goarch, ok := strings.Cut(target, "/")
+	if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") {
+		return "", "", fmt.Errorf("-target %q is not GOOS/GOARCH, such as linux/arm64, or host", target)
+	}
+	return goos, goarch, nil
+}
+
+// binaryName is the executable build -target writes when -o is not given:
+// the first input's base name without .occ, with .exe for Windows.
+func binaryName(input, goos string) string {
+	name := strings.TrimSuffix(filepath.Base(input), ".occ")
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// goBuild compiles the transpiled program goSrc for goos/goarch into the
+// executable output, in a temporary module whose dependencies are those the
+// transpiler was itself built with: golang.org/x/term for the entry
+// harness, and for -use-runtime the occam2go module, taken from runtimeDir
+// if given. cgo is disabled so that any target can be built without a C
+// cross-compiler. The errors of the Go toolchain are returned with their
+// paths into the generated Go made absolute, and the module is then kept
+// for inspection.
+func goBuild(goSrc, goos, goarch, output, runtimeDir string) error {
+	if _, err := exec.LookPath("go"); err != nil {
+		return fmt.Errorf("-target needs the Go toolchain: %w", err)
+	}
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "occam2go-build-*")
+	if err != nil {
+		return err
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(goSrc), 0o644); err != nil {
+		return err
+	}
+	edit, err := moduleRequires(goSrc, runtimeDir)
+	if err != nil {
+		return err
+	}
+	steps := [][]string{{"mod", "init", "occam2go.build/" + modulePathElem(output)}}
+	if len(edit) > 0 {
+		steps = append(steps, append([]string{"mod", "edit"}, edit...))
+	}
+	steps = append(steps, []string{"mod", "tidy"})
+	for _, args := range steps {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("go %s: %s", strings.Join(args, " "), goToolError(string(out), err))
+		}
+	}
+
+	cmd := exec.Command("go", "build", "-trimpath", "-o", output, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch, "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		msg := fmt.Sprintf("go build for %s/%s failed", goos, goarch)
+		if keep = strings.Contains(string(out), "main.go:"); keep {
+			msg += " (the generated Go is kept in " + dir + ")"
+		}
+		return fmt.Errorf("%s:\n%s", msg, mapGoErrors(string(out), dir, err))
+	}
+	return nil
+}
+
+// moduleRequires returns the go mod edit flags pinning the modules goSrc
+// imports to the versions in the transpiler's build, so that the program
+// is built with the runtime it was generated for.
+func moduleRequires(goSrc, runtimeDir string) ([]string, error) {
+	versions := map[string]string{}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		versions[info.Main.Path] = info.Main.Version
+		for _, dep := range info.Deps {
+			versions[dep.Path] = dep.Version
+		}
+	}
+	var edit []string
+	if strings.Contains(goSrc, `"golang.org/x/term"`) {
+		for _, path := range []string{"golang.org/x/term", "golang.org/x/sys"} {
+			if v := versions[path]; v != "" {
+				edit = append(edit, "-require="+path+"@"+v)
+			}
+		}
+	}
+	if strings.Contains(goSrc, `"`+codegen.RuntimeImport+`"`) {
+		switch v := versions[occam2goModule]; {
+		case runtimeDir != "":
+			dir, err := filepath.Abs(runtimeDir)
+			if err != nil {
+				return nil, err
+			}
+			edit = append(edit, "-require="+occam2goModule+"@v0.0.0", "-replace="+occam2goModule+"="+dir)
+		case v == "" || v == "(devel)" || strings.HasSuffix(v, "+dirty"):
+			return nil, fmt.Errorf("this occam2go is a development build, so the runtime package for -use-runtime cannot be fetched; give its source with -runtime-dir")
+		default:
+			edit = append(edit, "-require="+occam2goModule+"@"+v)
+		}
+	}
+	return edit, nil
+}
+
+// modulePathElem makes a module path element of the name of the output.
+func modulePathElem(output string) string {
+	name := strings.TrimSuffix(filepath.Base(output), ".exe")
+	name = regexp.MustCompile(`[^A-Za-z0-9._-]+`).ReplaceAllString(name, "-")
+	if strings.Trim(name, ".-") == "" {
+		return "program"
+	}
+	return name
+}
+
+// goToolError is the output of a failed go command, or its error when
+// there is none.
+func goToolError(out string, err error) string {
+	if out = strings.TrimSpace(out); out != "" {
+		return out
+	}
+	return err.Error()
+}
+
+// mapGoErrors returns the output of a failed go build without its "#
+// package" headings, with the positions in the generated Go, which go
+// build gives relative to the module, made absolute so that they can be
+// opened from the terminal.
+func mapGoErrors(out, dir string, err error) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(strings.TrimPrefix(line, "./"), "main.go:"); ok {
+			line = filepath.Join(dir, "main.go") + ":" + rest
+		}
+		lines = append(lines, "  "+line)
+	}
+	if len(lines) == 0 {
+		return "  " + err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
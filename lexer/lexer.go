@@ -4,6 +4,12 @@ import (
 	"strings"
 )
 
+// directive is a "--#NAME text" comment.
+type directive struct {
+	name string
+	text string
+}
+
 type Lexer struct {
 	input        string
 	position     int  // current position in input (points to current char)
@@ -20,10 +26,30 @@ type Lexer struct {
 	// Parenthesis/bracket depth: suppress INDENT/DEDENT/NEWLINE inside (...) and [...]
 	parenDepth int
 
+	// Open (VALOF ... ) expressions, whose bodies are laid out by
+	// indentation like any other process, innermost last
+	valofs []valofFrame
+
 	// Last real token type for continuation detection.
 	// When the last token is a binary operator or :=, NEWLINE and INDENT/DEDENT
 	// are suppressed on the next line (multi-line expression continuation).
 	lastTokenType TokenType
+
+	// Directive comments ("--#PRAGMA ENTRY", "--#ASSERT ...") by line number
+	directives map[int]directive
+
+	// All comments, in source order, for tools that print source back
+	comments []Comment
+
+	// Offsets of the starts of lines, computed by Source when first needed
+	lineStarts []int
+}
+
+// Comment is a "--" comment in the source.
+type Comment struct {
+	Line   int
+	Column int    // of the first '-'
+	Text   string // from "--" to the end of the line, trailing space removed
 }
 
 func New(input string) *Lexer {
@@ -49,6 +75,11 @@ func (l *Lexer) readChar() {
 	l.column++
 }
 
+// Input returns the source text the lexer reads.
+func (l *Lexer) Input() string {
+	return l.input
+}
+
 func (l *Lexer) peekChar() byte {
 	if l.readPosition >= len(l.input) {
 		return 0
@@ -56,8 +87,26 @@ func (l *Lexer) peekChar() byte {
 	return l.input[l.readPosition]
 }
 
+// valofFrame records what an open (VALOF ... ) expression suspended: the
+// parenthesis depth, counting its own (, and the indentation levels
+// outside it.
+type valofFrame struct {
+	parenDepth int
+	indents    int
+}
+
 func (l *Lexer) NextToken() Token {
 	tok := l.nextTokenInner()
+	if tok.Type == VALOF && l.lastTokenType == LPAREN {
+		// The body of (VALOF is an indented block up to the closing )
+		l.valofs = append(l.valofs, valofFrame{parenDepth: l.parenDepth, indents: len(l.indentStack)})
+		l.parenDepth = 0
+	} else if tok.Type == COLON && l.parenDepth > 0 {
+		// So is everything after a specification inside (, the VALOF it
+		// precedes included: (INT s: then VALOF on the next line
+		l.valofs = append(l.valofs, valofFrame{parenDepth: l.parenDepth, indents: len(l.indentStack)})
+		l.parenDepth = 0
+	}
 	// Track last real token type for continuation detection
 	if tok.Type != NEWLINE && tok.Type != INDENT && tok.Type != DEDENT && tok.Type != EOF {
 		l.lastTokenType = tok.Type
@@ -111,10 +160,24 @@ func (l *Lexer) nextTokenInner() Token {
 		l.parenDepth++
 		tok = l.newToken(LPAREN, l.ch)
 	case ')':
-		if l.parenDepth > 0 {
+		tok = l.newToken(RPAREN, l.ch)
+		if l.parenDepth == 0 && len(l.valofs) > 0 {
+			// Closes a (VALOF: its block ends here, as at a dedent
+			frame := l.valofs[len(l.valofs)-1]
+			l.valofs = l.valofs[:len(l.valofs)-1]
+			l.parenDepth = frame.parenDepth - 1
+			for len(l.indentStack) > frame.indents {
+				l.indentStack = l.indentStack[:len(l.indentStack)-1]
+				l.pendingTokens = append(l.pendingTokens, Token{Type: DEDENT, Literal: "", Line: tok.Line, Column: tok.Column})
+			}
+			if len(l.pendingTokens) > 0 {
+				l.pendingTokens = append(l.pendingTokens, tok)
+				tok = l.pendingTokens[0]
+				l.pendingTokens = l.pendingTokens[1:]
+			}
+		} else if l.parenDepth > 0 {
 			l.parenDepth--
 		}
-		tok = l.newToken(RPAREN, l.ch)
 	case '[':
 		l.parenDepth++
 		tok = l.newToken(LBRACKET, l.ch)
@@ -127,6 +190,8 @@ func (l *Lexer) nextTokenInner() Token {
 		tok = l.newToken(COMMA, l.ch)
 	case ';':
 		tok = l.newToken(SEMICOLON, l.ch)
+	case '|':
+		tok = l.newToken(BAR, l.ch)
 	case '+':
 		tok = l.newToken(PLUS, l.ch)
 	case '*':
@@ -154,7 +219,12 @@ func (l *Lexer) nextTokenInner() Token {
 	case '!':
 		tok = l.newToken(SEND, l.ch)
 	case '?':
-		tok = l.newToken(RECEIVE, l.ch)
+		if l.peekChar() == '?' {
+			l.readChar()
+			tok = Token{Type: EXTRECEIVE, Literal: "??", Line: l.line, Column: l.column - 1}
+		} else {
+			tok = l.newToken(RECEIVE, l.ch)
+		}
 	case '&':
 		tok = l.newToken(AMPERSAND, l.ch)
 	case ':':
@@ -162,6 +232,9 @@ func (l *Lexer) nextTokenInner() Token {
 			ch := l.ch
 			l.readChar()
 			tok = Token{Type: ASSIGN, Literal: string(ch) + string(l.ch), Line: l.line, Column: l.column - 1}
+		} else if l.peekChar() == ':' {
+			l.readChar()
+			tok = Token{Type: DOUBLECOLON, Literal: "::", Line: l.line, Column: l.column - 1}
 		} else {
 			tok = l.newToken(COLON, l.ch)
 		}
@@ -260,6 +333,10 @@ func (l *Lexer) nextTokenInner() Token {
 		} else if isDigit(l.ch) {
 			tok.Type = INT
 			tok.Literal = l.readNumber()
+			if l.ch == '.' && isDigit(l.peekChar()) {
+				tok.Type = REAL
+				tok.Literal += l.readFraction()
+			}
 			tok.Line = l.line
 			return tok
 		} else {
@@ -291,6 +368,29 @@ func (l *Lexer) readNumber() string {
 	return l.input[position:l.position]
 }
 
+// readFraction reads the rest of a real literal from its '.': the fraction
+// digits and an optional exponent, E+n or E-n.
+func (l *Lexer) readFraction() string {
+	position := l.position
+	l.readChar() // '.'
+	for isDigit(l.ch) {
+		l.readChar()
+	}
+	if l.ch == 'E' || l.ch == 'e' {
+		next := l.peekChar()
+		if isDigit(next) || (next == '+' || next == '-') && l.readPosition+1 < len(l.input) && isDigit(l.input[l.readPosition+1]) {
+			l.readChar() // 'E'
+			if l.ch == '+' || l.ch == '-' {
+				l.readChar()
+			}
+			for isDigit(l.ch) {
+				l.readChar()
+			}
+		}
+	}
+	return l.input[position:l.position]
+}
+
 func (l *Lexer) readHexNumber() string {
 	// Current char is '#', skip it
 	l.readChar()
@@ -357,8 +457,128 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
+// Pragma returns the directive of a "--#PRAGMA ..." comment on the given
+// line (e.g. "ENTRY"), or "" if there is none. Only lines already lexed are known.
+func (l *Lexer) Pragma(line int) string {
+	text, _ := l.Directive(line, "PRAGMA")
+	return text
+}
+
+// Directive returns the text after "--#NAME" in a directive comment on the
+// given line (e.g. name "ASSERT" for "--#ASSERT f(2) = 4"), and whether the
+// line holds such a comment. Only lines already lexed are known.
+func (l *Lexer) Directive(line int, name string) (string, bool) {
+	d, ok := l.directives[line]
+	if !ok || d.name != name {
+		return "", false
+	}
+	return d.text, true
+}
+
+// Comments returns the comments lexed so far, in source order.
+func (l *Lexer) Comments() []Comment {
+	return l.comments
+}
+
+// Source returns the source text from the start of tok to the end of line
+// last, without comments, the lines joined by single spaces: the text of a
+// construct, for comments in generated code.
+func (l *Lexer) Source(tok Token, last int) string {
+	if l.lineStarts == nil {
+		l.lineStarts = []int{0}
+		for i := 0; i < len(l.input); i++ {
+			if l.input[i] == '\n' {
+				l.lineStarts = append(l.lineStarts, i+1)
+			}
+		}
+	}
+	var parts []string
+	for line := tok.Line; line >= 1 && line <= last && line <= len(l.lineStarts); line++ {
+		start, end := l.lineStarts[line-1], len(l.input)
+		if line < len(l.lineStarts) {
+			end = l.lineStarts[line] - 1
+		}
+		if line == tok.Line {
+			start = min(start+tok.Column-1, end)
+		}
+		if text := strings.TrimSpace(withoutComment(l.input[start:end])); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// withoutComment returns line up to any "--" comment outside string and
+// byte literals.
+func withoutComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch ch := line[i]; {
+		case quote != 0 && ch == '*':
+			i++ // an escape such as *" or *'
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '-' && i+1 < len(line) && line[i+1] == '-':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// noteComment records a comment starting at the current position (after
+// any indentation).
+func (l *Lexer) noteComment() {
+	pos := l.position
+	for pos < len(l.input) && (l.input[pos] == ' ' || l.input[pos] == '\t') {
+		pos++
+	}
+	if !strings.HasPrefix(l.input[pos:], "--") {
+		return
+	}
+	end := strings.IndexByte(l.input[pos:], '\n')
+	if end < 0 {
+		end = len(l.input) - pos
+	}
+	text := strings.TrimRight(l.input[pos:pos+end], " \t\r")
+	l.comments = append(l.comments, Comment{Line: l.line, Column: l.column + pos - l.position, Text: text})
+}
+
+// noteDirective records a "--#NAME ..." comment starting at the current
+// position (after any indentation).
+func (l *Lexer) noteDirective() {
+	pos := l.position
+	for pos < len(l.input) && (l.input[pos] == ' ' || l.input[pos] == '\t') {
+		pos++
+	}
+	const prefix = "--#"
+	if !strings.HasPrefix(l.input[pos:], prefix) {
+		return
+	}
+	end := strings.IndexByte(l.input[pos:], '\n')
+	if end < 0 {
+		end = len(l.input) - pos
+	}
+	name, text := l.input[pos+len(prefix):pos+end], ""
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name, text = name[:i], name[i+1:]
+	}
+	if name == "" {
+		return
+	}
+	if l.directives == nil {
+		l.directives = make(map[int]directive)
+	}
+	l.directives[l.line] = directive{name: strings.TrimSpace(name), text: strings.TrimSpace(text)}
+}
+
 func (l *Lexer) skipComment() {
 	// Skip -- comment until end of line
+	l.noteDirective()
+	l.noteComment()
 	for l.ch != '\n' && l.ch != 0 {
 		l.readChar()
 	}
@@ -402,6 +622,8 @@ func (l *Lexer) isBlankLine() bool {
 }
 
 func (l *Lexer) skipToEndOfLine() {
+	l.noteDirective()
+	l.noteComment()
 	for l.ch != '\n' && l.ch != 0 {
 		l.readChar()
 	}
@@ -270,6 +270,43 @@ func TestHexLiterals(t *testing.T) {
 	}
 }
 
+func TestRealLiterals(t *testing.T) {
+	input := "x := 3.14159(REAL32) + 1.0E-6 + 2.5e+3 + 7.0E\n"
+	tests := []struct {
+		expectedType    TokenType
+		expectedLiteral string
+	}{
+		{IDENT, "x"},
+		{ASSIGN, ":="},
+		{REAL, "3.14159"},
+		{LPAREN, "("},
+		{REAL32_TYPE, "REAL32"},
+		{RPAREN, ")"},
+		{PLUS, "+"},
+		{REAL, "1.0E-6"},
+		{PLUS, "+"},
+		{REAL, "2.5e+3"},
+		{PLUS, "+"},
+		{REAL, "7.0"},
+		{IDENT, "E"},
+		{NEWLINE, "\\n"},
+		{EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q (literal=%q)",
+				i, tt.expectedType, tok.Type, tok.Literal)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestNestedIndentation(t *testing.T) {
 	input := `SEQ
   INT x:
@@ -202,7 +202,7 @@ func TestByteLiteralEscapeToken(t *testing.T) {
 }
 
 func TestSendReceiveTokens(t *testing.T) {
-	input := "c ! 42\nc ? x\n"
+	input := "c ! 42\nc ? x\nc ?? y\n"
 	expected := []struct {
 		typ TokenType
 		lit string
@@ -215,6 +215,10 @@ func TestSendReceiveTokens(t *testing.T) {
 		{RECEIVE, "?"},
 		{IDENT, "x"},
 		{NEWLINE, "\\n"},
+		{IDENT, "c"},
+		{EXTRECEIVE, "??"},
+		{IDENT, "y"},
+		{NEWLINE, "\\n"},
 		{EOF, ""},
 	}
 
@@ -255,6 +259,19 @@ func TestSemicolonToken(t *testing.T) {
 	}
 }
 
+func TestDoubleColonToken(t *testing.T) {
+	input := "c ! n :: buf\nINT x:\n"
+	expected := []TokenType{IDENT, SEND, IDENT, DOUBLECOLON, IDENT, NEWLINE, INT_TYPE, IDENT, COLON, NEWLINE, EOF}
+
+	l := New(input)
+	for i, exp := range expected {
+		tok := l.NextToken()
+		if tok.Type != exp {
+			t.Fatalf("doublecolon[%d] - expected=%q, got=%q", i, exp, tok.Type)
+		}
+	}
+}
+
 func TestNestedParenDepth(t *testing.T) {
 	// Nested parens: depth tracks correctly
 	input := `x := ((1
@@ -317,3 +334,101 @@ func TestLineAndColumnTracking(t *testing.T) {
 		t.Errorf("x: expected line=1 col=5, got line=%d col=%d", tok.Line, tok.Column)
 	}
 }
+
+func TestCommentPragma(t *testing.T) {
+	input := "--#PRAGMA ENTRY\nPROC p()\n  --#PRAGMA  SHARED x  \n  SKIP -- not a pragma\n"
+	l := New(input)
+	for tok := l.NextToken(); tok.Type != EOF; tok = l.NextToken() {
+	}
+
+	tests := map[int]string{1: "ENTRY", 2: "", 3: "SHARED x", 4: ""}
+	for line, want := range tests {
+		if got := l.Pragma(line); got != want {
+			t.Errorf("line %d: expected pragma %q, got %q", line, want, got)
+		}
+	}
+}
+
+func TestCommentDirective(t *testing.T) {
+	input := "--#ASSERT sq(3) = 9\n--#ASSERT\tsq(0) = 0\n--#PRAGMA ENTRY\n-- #ASSERT no\nSKIP\n"
+	l := New(input)
+	for tok := l.NextToken(); tok.Type != EOF; tok = l.NextToken() {
+	}
+
+	tests := []struct {
+		line int
+		want string
+		ok   bool
+	}{
+		{1, "sq(3) = 9", true},
+		{2, "sq(0) = 0", true},
+		{3, "", false},
+		{4, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := l.Directive(tt.line, "ASSERT")
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("line %d: expected ASSERT (%q, %v), got (%q, %v)", tt.line, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestCommentsKept(t *testing.T) {
+	input := "-- header\nPROC p()\n\t-- tabbed\n  SKIP -- trailing  \n:\n--"
+	l := New(input)
+	for tok := l.NextToken(); tok.Type != EOF; tok = l.NextToken() {
+	}
+
+	want := []Comment{
+		{Line: 1, Column: 1, Text: "-- header"},
+		{Line: 3, Column: 2, Text: "-- tabbed"},
+		{Line: 4, Column: 8, Text: "-- trailing"},
+		{Line: 6, Column: 1, Text: "--"},
+	}
+	got := l.Comments()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d comments, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("comment %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestSource(t *testing.T) {
+	input := `ALT
+  (n < max) & in[i] ? x  -- a comment
+    SKIP
+  tim ? AFTER t PLUS
+      "--*"x" -- more
+`
+	l := New(input)
+	var toks []Token
+	for tok := l.NextToken(); tok.Type != EOF; tok = l.NextToken() {
+		toks = append(toks, tok)
+	}
+	tests := []struct {
+		from     string // literal of the first token
+		line     int
+		last     int
+		expected string
+	}{
+		{"(", 2, 2, "(n < max) & in[i] ? x"},
+		{"n", 2, 2, "n < max) & in[i] ? x"},
+		{"tim", 4, 5, `tim ? AFTER t PLUS "--*"x"`},
+		{"SKIP", 3, 2, ""},
+	}
+	for _, tt := range tests {
+		var tok Token
+		for _, candidate := range toks {
+			if candidate.Literal == tt.from && candidate.Line == tt.line {
+				tok = candidate
+				break
+			}
+		}
+		if got := l.Source(tok, tt.last); got != tt.expected {
+			t.Errorf("Source from %q to line %d: expected %q, got %q", tt.from, tt.last, tt.expected, got)
+		}
+	}
+}
@@ -13,6 +13,7 @@ const (
 	// Literals
 	IDENT     // variable names, procedure names
 	INT       // integer literal
+	REAL      // real literal: 3.14, 1.0E-6
 	STRING    // string literal
 	BYTE_LIT  // byte literal: 'A', '*n', etc.
 
@@ -31,6 +32,7 @@ const (
 	GE       // >=
 	SEND      // !
 	RECEIVE   // ?
+	EXTRECEIVE // ?? (occam-pi extended input)
 	AMPERSAND // & (guard separator in ALT)
 	BITAND    // /\  (bitwise AND)
 	BITOR     // \/  (bitwise OR)
@@ -47,6 +49,8 @@ const (
 	COMMA     // ,
 	COLON     // :
 	SEMICOLON // ;
+	DOUBLECOLON // :: (counted array)
+	BAR       // | (array constructor body)
 
 	// Keywords
 	keyword_beg
@@ -94,6 +98,7 @@ const (
 	MOSTPOS_KW
 	INITIAL
 	RETYPES  // RETYPES (bit-level type reinterpretation)
+	RESHAPES // RESHAPES (array reshaping)
 	INLINE   // INLINE (function modifier, ignored for transpilation)
 	PLUS_KW  // PLUS (modular addition keyword, distinct from + symbol)
 	MINUS_KW // MINUS (modular subtraction keyword, distinct from - symbol)
@@ -101,6 +106,22 @@ const (
 	ROUND_KW // ROUND (type conversion qualifier)
 	TRUNC_KW // TRUNC (type conversion qualifier)
 	PRI      // PRI (priority modifier for ALT/PAR)
+	PLACED    // PLACED (PLACED PAR)
+	PROCESSOR // PROCESSOR (branch of a PLACED PAR)
+	PLACE     // PLACE (PLACE x AT addr:)
+	AT        // AT
+	EXTENDS   // EXTENDS (PROTOCOL extension)
+	DATA      // DATA (DATA TYPE declaration)
+	TYPE      // TYPE
+	PACKED    // PACKED (PACKED RECORD)
+	MOBILE    // MOBILE (CHAN TYPE bundles: MOBILE RECORD, MOBILE FOO; mobile data)
+	SHARED    // SHARED (shared CHAN TYPE end)
+	CLAIM     // CLAIM (claim a SHARED end)
+	FORKING   // FORKING (block waiting for its FORKed processes)
+	FORK      // FORK (spawn a process)
+	BARRIER   // BARRIER (barrier declaration or parameter)
+	SYNC      // SYNC (synchronise on a barrier)
+	ENROLL    // ENROLL (PAR ... ENROLL b)
 	keyword_end
 )
 
@@ -113,6 +134,7 @@ var tokenNames = map[TokenType]string{
 
 	IDENT:    "IDENT",
 	INT:      "INT",
+	REAL:     "REAL",
 	STRING:   "STRING",
 	BYTE_LIT: "BYTE_LIT",
 
@@ -130,6 +152,7 @@ var tokenNames = map[TokenType]string{
 	GE:       ">=",
 	SEND:      "!",
 	RECEIVE:   "?",
+	EXTRECEIVE: "??",
 	AMPERSAND: "&",
 	BITAND:    "/\\",
 	BITOR:     "\\/",
@@ -145,6 +168,8 @@ var tokenNames = map[TokenType]string{
 	COMMA:     ",",
 	COLON:     ":",
 	SEMICOLON: ";",
+	DOUBLECOLON: "::",
+	BAR:       "|",
 
 	SEQ:       "SEQ",
 	PAR:       "PAR",
@@ -190,6 +215,7 @@ var tokenNames = map[TokenType]string{
 	MOSTPOS_KW: "MOSTPOS",
 	INITIAL:    "INITIAL",
 	RETYPES:    "RETYPES",
+	RESHAPES:   "RESHAPES",
 	INLINE:     "INLINE",
 	PLUS_KW:    "PLUS",
 	MINUS_KW:   "MINUS",
@@ -197,6 +223,22 @@ var tokenNames = map[TokenType]string{
 	ROUND_KW:   "ROUND",
 	TRUNC_KW:   "TRUNC",
 	PRI:        "PRI",
+	PLACED:     "PLACED",
+	PROCESSOR:  "PROCESSOR",
+	PLACE:      "PLACE",
+	AT:         "AT",
+	EXTENDS:    "EXTENDS",
+	DATA:       "DATA",
+	TYPE:       "TYPE",
+	PACKED:     "PACKED",
+	MOBILE:     "MOBILE",
+	SHARED:     "SHARED",
+	CLAIM:      "CLAIM",
+	FORKING:    "FORKING",
+	FORK:       "FORK",
+	BARRIER:    "BARRIER",
+	SYNC:       "SYNC",
+	ENROLL:     "ENROLL",
 }
 
 var keywords = map[string]TokenType{
@@ -244,6 +286,7 @@ var keywords = map[string]TokenType{
 	"MOSTPOS":  MOSTPOS_KW,
 	"INITIAL":  INITIAL,
 	"RETYPES":  RETYPES,
+	"RESHAPES": RESHAPES,
 	"INLINE":   INLINE,
 	"PLUS":     PLUS_KW,
 	"MINUS":    MINUS_KW,
@@ -251,6 +294,22 @@ var keywords = map[string]TokenType{
 	"ROUND":    ROUND_KW,
 	"TRUNC":    TRUNC_KW,
 	"PRI":      PRI,
+	"PLACED":    PLACED,
+	"PROCESSOR": PROCESSOR,
+	"PLACE":     PLACE,
+	"AT":        AT,
+	"EXTENDS":   EXTENDS,
+	"DATA":      DATA,
+	"TYPE":      TYPE,
+	"PACKED":    PACKED,
+	"MOBILE":    MOBILE,
+	"SHARED":    SHARED,
+	"CLAIM":     CLAIM,
+	"FORKING":   FORKING,
+	"FORK":      FORK,
+	"BARRIER":   BARRIER,
+	"SYNC":      SYNC,
+	"ENROLL":    ENROLL,
 }
 
 func (t TokenType) String() string {
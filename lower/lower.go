@@ -0,0 +1,233 @@
+// Package lower applies the desugaring steps the code generator performs
+// implicitly (nested IF flattening, replicated SEQ to WHILE loops, constant
+// ALT guard folding) as explicit AST rewrites, so that the result can be
+// printed back as occam and users can see what the transpiler thinks their
+// code means.
+package lower
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/codeassociates/occam2go/ast"
+	"github.com/codeassociates/occam2go/lexer"
+)
+
+// Step records one lowering transformation applied to the program.
+type Step struct {
+	Line        int    // occam source line of the construct that was rewritten
+	Description string // human-readable summary of the rewrite
+}
+
+func (s Step) String() string {
+	return fmt.Sprintf("line %d: %s", s.Line, s.Description)
+}
+
+// Lower rewrites the program in place and returns the steps applied, in source order.
+func Lower(program *ast.Program) []Step {
+	l := &lowerer{}
+	program.Statements = l.statements(program.Statements)
+	sort.SliceStable(l.steps, func(i, j int) bool { return l.steps[i].Line < l.steps[j].Line })
+	return l.steps
+}
+
+type lowerer struct {
+	steps []Step
+}
+
+func (l *lowerer) record(line int, format string, args ...interface{}) {
+	l.steps = append(l.steps, Step{Line: line, Description: fmt.Sprintf(format, args...)})
+}
+
+func (l *lowerer) statements(stmts []ast.Statement) []ast.Statement {
+	for i, stmt := range stmts {
+		stmts[i] = l.statement(stmt)
+	}
+	return stmts
+}
+
+func (l *lowerer) statement(stmt ast.Statement) ast.Statement {
+	switch s := stmt.(type) {
+	case *ast.SeqBlock:
+		s.Statements = l.statements(s.Statements)
+		if s.Replicator != nil {
+			return l.replicatedSeq(s)
+		}
+	case *ast.ParBlock:
+		s.Statements = l.statements(s.Statements)
+	case *ast.ProcDecl:
+		s.Body = l.statements(s.Body)
+	case *ast.FuncDecl:
+		s.Body = l.statements(s.Body)
+	case *ast.WhileLoop:
+		s.Body = l.statements(s.Body)
+	case *ast.ClaimBlock:
+		s.Body = l.statements(s.Body)
+	case *ast.ForkingBlock:
+		s.Body = l.statements(s.Body)
+	case *ast.IfStatement:
+		l.ifStatement(s)
+	case *ast.CaseStatement:
+		for i := range s.Choices {
+			s.Choices[i].Body = l.statements(s.Choices[i].Body)
+		}
+	case *ast.AltBlock:
+		for i := range s.Cases {
+			s.Cases[i].Body = l.statements(s.Cases[i].Body)
+		}
+		return l.altGuards(s)
+	case *ast.VariantReceive:
+		for i := range s.Cases {
+			s.Cases[i].Body = l.statements(s.Cases[i].Body)
+		}
+	}
+	return stmt
+}
+
+// ifStatement inlines non-replicated nested IFs into the enclosing choice
+// list, as the code generator does when it emits a single if/else-if chain.
+func (l *lowerer) ifStatement(s *ast.IfStatement) {
+	var flat []ast.IfChoice
+	for _, c := range s.Choices {
+		if c.NestedIf != nil && c.NestedIf.Replicator == nil {
+			l.ifStatement(c.NestedIf)
+			l.record(c.NestedIf.Token.Line, "nested IF flattened into enclosing IF")
+			flat = append(flat, c.NestedIf.Choices...)
+			continue
+		}
+		if c.NestedIf != nil {
+			l.ifStatement(c.NestedIf)
+		}
+		c.Body = l.statements(c.Body)
+		flat = append(flat, c)
+	}
+	s.Choices = flat
+}
+
+// altGuards folds constant ALT guards as the code generator does: an
+// alternative guarded by FALSE is removed, a TRUE guard is dropped (kept on
+// SKIP, which needs one) and a TRUE & SKIP after another is removed. An ALT
+// left with no alternatives becomes STOP.
+func (l *lowerer) altGuards(s *ast.AltBlock) ast.Statement {
+	var cases []ast.AltCase
+	skip := false
+	for _, c := range s.Cases {
+		v, ok := constBool(c.Guard)
+		switch {
+		case ok && !v:
+			l.record(s.Token.Line, "ALT alternative with FALSE guard removed")
+			continue
+		case ok && c.IsSkip && skip:
+			l.record(s.Token.Line, "ALT alternative TRUE & SKIP after another removed")
+			continue
+		case ok && c.IsSkip:
+			skip = true
+		case ok:
+			l.record(s.Token.Line, "TRUE guard dropped from ALT alternative")
+			c.Guard = nil
+		}
+		cases = append(cases, c)
+	}
+	s.Cases = cases
+	if len(cases) == 0 {
+		l.record(s.Token.Line, "ALT with no alternatives left lowered to STOP")
+		return &ast.Stop{Token: s.Token}
+	}
+	return s
+}
+
+// constBool evaluates a constant BOOL guard built from TRUE, FALSE, NOT,
+// AND and OR, reporting false if e is not constant.
+func constBool(e ast.Expression) (bool, bool) {
+	switch e := e.(type) {
+	case *ast.BooleanLiteral:
+		return e.Value, true
+	case *ast.ParenExpr:
+		return constBool(e.Expr)
+	case *ast.UnaryExpr:
+		if e.Operator == "NOT" {
+			v, ok := constBool(e.Right)
+			return !v, ok
+		}
+	case *ast.BinaryExpr:
+		l, lok := constBool(e.Left)
+		r, rok := constBool(e.Right)
+		switch {
+		case e.Operator == "AND" && (lok && !l || rok && !r):
+			return false, true
+		case e.Operator == "OR" && (lok && l || rok && r):
+			return true, true
+		case (e.Operator == "AND" || e.Operator == "OR") && lok && rok:
+			return l, true
+		}
+	}
+	return false, false
+}
+
+// replicatedSeq turns SEQ i = start FOR count [STEP step] into the WHILE
+// loop the generated Go for-loop corresponds to:
+//
+//	SEQ                               SEQ
+//	  INITIAL INT i IS start:           INITIAL INT i.repl IS 0:
+//	  WHILE i < (start + count)         WHILE i.repl < count
+//	    SEQ                               VAL INT i IS start + (i.repl * step):
+//	      body                            SEQ
+//	      i := i + 1                        body
+//	                                        i.repl := i.repl + 1
+func (l *lowerer) replicatedSeq(s *ast.SeqBlock) ast.Statement {
+	repl := s.Replicator
+	line := s.Token.Line
+	body := s.Statements
+	if len(body) != 1 {
+		body = []ast.Statement{&ast.SeqBlock{Token: s.Token, Statements: body}}
+	}
+
+	counter := repl.Variable
+	limit := ast.Expression(&ast.BinaryExpr{Operator: "+", Left: repl.Start, Right: repl.Count})
+	init := repl.Start
+	if repl.Step != nil {
+		counter = repl.Variable + ".repl"
+		limit = repl.Count
+		init = intLit(0)
+		body = append([]ast.Statement{&ast.Abbreviation{
+			IsVal:   true,
+			Type:    "INT",
+			Name:    repl.Variable,
+			TypeRef: ast.Scalar("INT"),
+			Value: &ast.BinaryExpr{Operator: "+", Left: repl.Start, Right: &ast.BinaryExpr{
+				Operator: "*", Left: ident(counter), Right: repl.Step,
+			}},
+		}}, &ast.SeqBlock{Token: s.Token, Statements: append(body, increment(counter))})
+		l.record(line, "replicated SEQ %s with STEP lowered to counted WHILE loop", repl.Variable)
+	} else {
+		body = []ast.Statement{&ast.SeqBlock{Token: s.Token, Statements: append(body, increment(counter))}}
+		l.record(line, "replicated SEQ %s lowered to WHILE loop", repl.Variable)
+	}
+
+	return &ast.SeqBlock{
+		Token: s.Token,
+		Statements: []ast.Statement{
+			&ast.Abbreviation{IsInitial: true, Type: "INT", Name: counter, Value: init, TypeRef: ast.Scalar("INT")},
+			&ast.WhileLoop{
+				Token:     s.Token,
+				Condition: &ast.BinaryExpr{Operator: "<", Left: ident(counter), Right: limit},
+				Body:      body,
+			},
+		},
+	}
+}
+
+func increment(name string) ast.Statement {
+	return &ast.Assignment{
+		Name:  name,
+		Value: &ast.BinaryExpr{Operator: "+", Left: ident(name), Right: intLit(1)},
+	}
+}
+
+func ident(name string) *ast.Identifier {
+	return &ast.Identifier{Token: lexer.Token{Type: lexer.IDENT, Literal: name}, Value: name}
+}
+
+func intLit(v int64) *ast.IntegerLiteral {
+	return &ast.IntegerLiteral{Value: v}
+}
@@ -0,0 +1,130 @@
+package lower
+
+import (
+	"testing"
+
+	"github.com/codeassociates/occam2go/ast"
+	"github.com/codeassociates/occam2go/format"
+	"github.com/codeassociates/occam2go/lexer"
+	"github.com/codeassociates/occam2go/parser"
+)
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		t.FailNow()
+	}
+	return program
+}
+
+func TestLowerReplicatedSeq(t *testing.T) {
+	program := parse(t, `SEQ i = 2 FOR n
+  x := x + i
+`)
+	steps := Lower(program)
+	got := format.Print(program)
+	want := `SEQ
+  INITIAL INT i IS 2:
+  WHILE i < (2 + n)
+    SEQ
+      x := x + i
+      i := i + 1
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if len(steps) != 1 || steps[0].String() != "line 1: replicated SEQ i lowered to WHILE loop" {
+		t.Errorf("unexpected steps: %v", steps)
+	}
+}
+
+func TestLowerReplicatedSeqStep(t *testing.T) {
+	program := parse(t, `SEQ i = 0 FOR 5 STEP 2
+  print.int(i)
+`)
+	Lower(program)
+	got := format.Print(program)
+	want := `SEQ
+  INITIAL INT i.repl IS 0:
+  WHILE i.repl < 5
+    VAL INT i IS 0 + (i.repl * 2):
+    SEQ
+      print.int(i)
+      i.repl := i.repl + 1
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLowerNestedIf(t *testing.T) {
+	program := parse(t, `IF
+  x > 10
+    SKIP
+  IF
+    x > 5
+      STOP
+    IF i = 0 FOR 3
+      x = i
+        SKIP
+  TRUE
+    SKIP
+`)
+	steps := Lower(program)
+	got := format.Print(program)
+	want := `IF
+  x > 10
+    SKIP
+  x > 5
+    STOP
+  IF i = 0 FOR 3
+    x = i
+      SKIP
+  TRUE
+    SKIP
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if len(steps) != 1 || steps[0].Line != 4 {
+		t.Errorf("unexpected steps: %v", steps)
+	}
+}
+
+func TestLowerAltGuards(t *testing.T) {
+	program := parse(t, `SEQ
+  ALT
+    FALSE & a ? x
+      SKIP
+    TRUE & b ? x
+      SKIP
+    (NOT FALSE) & SKIP
+      SKIP
+    TRUE & SKIP
+      STOP
+  ALT
+    FALSE AND ready & a ? x
+      SKIP
+`)
+	steps := Lower(program)
+	got := format.Print(program)
+	want := `SEQ
+  ALT
+    b ? x
+      SKIP
+    (NOT FALSE) & SKIP
+      SKIP
+  STOP
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if len(steps) != 5 {
+		t.Errorf("expected 5 steps, got %v", steps)
+	}
+}
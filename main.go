@@ -1,18 +1,34 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/codeassociates/occam2go/ast"
 	"github.com/codeassociates/occam2go/codegen"
+	"github.com/codeassociates/occam2go/conformance"
+	"github.com/codeassociates/occam2go/format"
 	"github.com/codeassociates/occam2go/lexer"
+	"github.com/codeassociates/occam2go/lower"
 	"github.com/codeassociates/occam2go/modgen"
+	"github.com/codeassociates/occam2go/network"
 	"github.com/codeassociates/occam2go/parser"
 	"github.com/codeassociates/occam2go/preproc"
+	"github.com/codeassociates/occam2go/protodoc"
+	"github.com/codeassociates/occam2go/reduce"
+	"github.com/codeassociates/occam2go/sema"
+	"github.com/codeassociates/occam2go/uninit"
 )
 
 const version = "0.1.0"
@@ -32,23 +48,99 @@ func main() {
 		genModuleCmd(os.Args[2:])
 		return
 	}
+	if len(os.Args) >= 2 && os.Args[1] == "flatten" {
+		flattenCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "protodoc" {
+		protodocCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "build" {
+		buildCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "check" {
+		checkCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "reduce" {
+		reduceCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "fmt" {
+		fmtCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "lex" {
+		lexCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "conformance" {
+		conformanceCmd(os.Args[2:])
+		return
+	}
 
 	showVersion := flag.Bool("version", false, "Print version and exit")
 	outputFile := flag.String("o", "", "Output file (default: stdout)")
+	force := flag.Bool("force", false, "Rewrite output files even when their content is unchanged")
 	var includePaths multiFlag
 	flag.Var(&includePaths, "I", "Include search path (repeatable)")
 	var defines multiFlag
 	flag.Var(&defines, "D", "Predefined symbol (repeatable)")
+	showLowered := flag.Bool("lowered", false, "Print the program as occam after desugaring instead of generating Go")
+	std := flag.String("std", "extended", "Language standard: occam2.1, occam2.5, occampi or extended")
+	maxFuncSize := flag.Int("max-func-size", 1<<20, "Warn about generated Go functions larger than this many bytes (0 disables)")
+	entry := flag.String("entry", "", "Name of the PROC to run as the program entry point (default: the one marked --#PRAGMA ENTRY, else the last matching)")
+	outline := flag.Bool("outline", false, "Move large blocks into closures to keep generated functions under -max-func-size")
+	tableThreshold := flag.Int("table-threshold", codegen.DefaultTableThreshold, "Lay out array literals with more elements than this over several lines (0 keeps them on one line)")
+	tableData := flag.Bool("table-data", false, "Encode top-level VAL tables of integers larger than -table-threshold as string data decoded at startup, which the Go compiler handles faster")
+	strict := flag.Bool("strict", false, "Treat variant receives that miss tags of their PROTOCOL as errors, warn about PROC calls without parentheses, STOP on out of range integer conversions, and warn about variables that may be read before they are assigned")
+	deterministic := flag.Bool("deterministic", false, "Generate a program that runs on one thread with ALTs taking the first ready case, so it gives the same output every run")
+	checkedArith := flag.Bool("checked-arith", false, "Stop the program on integer overflow in +, - and *, as occam does (PLUS, MINUS and TIMES still wrap)")
+	boundsCheck := flag.Bool("bounds-check", false, "Stop the program, with an occam-style message, on a subscript or slice out of range")
+	errorWrappers := flag.Bool("error-wrappers", false, "With -pkg, also generate NameErr for each PROC with an error, err or report channel of a variant PROTOCOL, returning the first message sent on it as an error")
+	leakCheck := flag.Bool("leakcheck", false, "Report on stderr the PROCs still running in goroutines when the entry PROC has finished")
+	parRecover := flag.Bool("par-recover", true, "Report a panic in a PAR branch with the PAR's line, the branch and the PROC it is in, and exit, instead of printing a Go stack trace (-par-recover=false to leave it)")
+	poisonUninit := flag.Bool("poison-uninit", false, "Fill variables, when declared, with 0xDEADBEEF, 0xDE or NaN instead of zero, so that reading one before assigning it shows")
+	extendedRendezvous := flag.Bool("extended-rendezvous", false, "Hold the sender of each message until its receiver is done with it, so that extended inputs (c ?? x) keep the sender blocked until their extended process ends")
+	priPar := flag.String("pri-par", "ignore", "What PRI PAR priority becomes: ignore (run as PAR), lock-thread (run the first branch on an OS thread of its own) or yield (later branches yield when they start and on each loop iteration)")
+	permissive := flag.Bool("permissive", false, "Replace each statement that cannot be parsed by a stub that panics with \"occam2go: unsupported: <statement> at file:line\", warning about it, and report semantic errors as warnings, so that the rest of the file is still translated")
+	rejectPlacement := flag.Bool("reject-placement", false, "Treat PLACED PAR and PLACE declarations as errors instead of running PLACED PAR as PAR")
+	poison := flag.String("poison", "", "Variant tag to propagate to a PROC's output channels, ending the PROC, when a variant receive gets it")
+	prefix := flag.String("prefix", "", "Start the names of generated protocol types and helper functions with this, so that several transpiled programs can be built as one package")
+	pkg := flag.String("pkg", "", "Generate an importable Go package with this name, with exported PROCs and FUNCTIONs and no main, instead of a program")
+	manifest := flag.String("manifest", "", "With -pkg, also write a JSON description of the package's PROCs, FUNCTIONs and protocols, with their occam and Go names and types, to this file")
+	useRuntime := flag.Bool("use-runtime", false, "Call the Go implementations of the course library (out.string, in.int, ...) in the runtime package instead of transpiling it")
+	goVersion := flag.String("go-version", codegen.DefaultGoVersion, "Oldest Go release the generated code must build with, e.g. 1.22 to drop loop variable copies")
+	var typeMaps multiFlag
+	flag.Var(&typeMaps, "map-type", "Go type for an occam scalar type, e.g. BOOL=int32 (repeatable)")
+	wordSize := flag.Int("word-size", 0, "Map occam INT to Go int32 or int64 (32 or 64) instead of int, and predefine TARGET.BITS.PER.WORD to match")
+	testsFile := flag.String("tests", "", "Also write a Go test file for the FUNCTIONs (from --#ASSERT comments) to this file")
+	stdinName := flag.String("stdin-name", "<stdin>", "File name to report in errors and -stamp for a program read from stdin (input -)")
+	jsonDiags := flag.Bool("json-diagnostics", false, "Print errors and warnings to stderr as one JSON array of {file, line, col, severity, message}, for editor integration")
+	stats := flag.Bool("stats", false, "Print counts of what was translated (PROCs, channels, PAR branches, ALTs, ...) to stderr")
+	optLevel := flag.Int("O", codegen.DefaultOptLevel, "Optimization level, also written -O0, -O1 or -O2: 0 runs no optimization passes, for the most direct translation")
+	passes := flag.String("passes", "", "Comma-separated optimization passes to run whatever -O, or with a leading - not to run: "+passNames())
+	header := addHeaderFlags(flag.CommandLine)
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "occam2go - An Occam to Go transpiler\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] <input.occ>\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "       %s gen-module [-o output] <SConscript>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <input.occ | ->\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s build [options] [-target GOOS/GOARCH] <dir | input.occ...>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s check [-I path]... [-D SYMBOL]... [-std dialect] [-use-runtime] <dir | input.occ...>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s gen-module [-o output] <SConscript>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s flatten [-o output] [-I path]... [-D SYMBOL]... <input.occ>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s protodoc [-o output] [-I path]... [-D SYMBOL]... <input.occ>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s reduce [-o output] [-match text] [-vet] [-I path]... [-D SYMBOL]... <input.occ>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s fmt [-w] [-l] <dir | input.occ...>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s lex [-o output] [-json] [-I path]... [-D SYMBOL]... <input.occ>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s conformance [-run regexp] [-timeout d] [-j n] [-json] [-I path]... [-D SYMBOL]... <dir | test.occ...>\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	flag.CommandLine.Parse(optLevelArgs(os.Args[1:]))
 
 	if *showVersion {
 		fmt.Printf("occam2go version %s\n", version)
@@ -62,86 +154,230 @@ func main() {
 	}
 
 	inputFile := args[0]
+	if *testsFile != "" && *showLowered {
+		fmt.Fprintf(os.Stderr, "Error: -tests cannot be used with -lowered\n")
+		os.Exit(1)
+	}
 
-	// Build defines map
-	defs := map[string]string{}
-	for _, d := range defines {
-		if idx := strings.Index(d, "="); idx >= 0 {
-			defs[d[:idx]] = d[idx+1:]
-		} else {
-			defs[d] = ""
-		}
+	if *prefix != "" && !goIdentRe.MatchString(*prefix) {
+		fmt.Fprintf(os.Stderr, "Error: -prefix %q is not a Go identifier\n", *prefix)
+		os.Exit(1)
+	}
+	checkPackageName(*pkg)
+	if *errorWrappers && *pkg == "" {
+		fmt.Fprintf(os.Stderr, "Error: -error-wrappers needs -pkg\n")
+		os.Exit(1)
+	}
+	checkManifest(*manifest, *pkg)
+	goMinor := parseGoVersion(*goVersion)
+	if *optLevel < 0 || *optLevel > 2 {
+		fmt.Fprintf(os.Stderr, "Error: -O%d is not an optimization level (0, 1 or 2)\n", *optLevel)
+		os.Exit(1)
+	}
+	passOpts := append([]codegen.Option{codegen.WithOptLevel(*optLevel)}, parsePasses(*passes)...)
+	if *wordSize != 0 && *wordSize != 32 && *wordSize != 64 {
+		fmt.Fprintf(os.Stderr, "Error: -word-size %d is not 32 or 64\n", *wordSize)
+		os.Exit(1)
+	}
+	if *wordSize != 0 && !hasDefine(defines, "TARGET.BITS.PER.WORD") {
+		defines = append(defines, fmt.Sprintf("TARGET.BITS.PER.WORD=%d", *wordSize))
 	}
 
-	// Preprocess
-	pp := preproc.New(
-		preproc.WithIncludePaths(includePaths),
-		preproc.WithDefines(defs),
-	)
-	expanded, err := pp.ProcessFile(inputFile)
+	dialect, err := parser.ParseDialect(*std)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Preprocessor error: %s\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 		os.Exit(1)
 	}
-	if len(pp.Errors()) > 0 {
-		fmt.Fprintf(os.Stderr, "Preprocessor warnings:\n")
-		for _, e := range pp.Errors() {
-			fmt.Fprintf(os.Stderr, "  %s\n", e)
-		}
+	priParMode, err := codegen.ParsePriPar(*priPar)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -pri-par: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Preprocess
+	diags := &diagnostics{json: *jsonDiags}
+	pp, expanded := preprocessFile(inputFile, *stdinName, includePaths, defines, diags)
+	if inputFile == "-" {
+		inputFile = *stdinName
 	}
 
 	// Lex
 	l := lexer.New(expanded)
 
 	// Parse
-	p := parser.New(l)
+	p := parser.New(l, parser.WithDialect(dialect), parser.WithPermissive(*permissive))
 	program := p.ParseProgram()
 
 	if len(p.Errors()) > 0 {
-		fmt.Fprintf(os.Stderr, "Parse errors:\n")
+		diags.report("error", p.Errors(), pp.SourceMap(), expanded)
+		diags.exit(1)
+	}
+	diags.report("warning", p.Unsupported(), pp.SourceMap(), expanded)
+
+	if errs := sema.Check(program, libraryDecls(*useRuntime, passOpts...)...); len(errs) > 0 {
+		if *permissive {
+			// Often the uses of a declaration that was stubbed
+			diags.report("warning", errs, pp.SourceMap(), expanded)
+		} else {
+			diags.report("error", errs, pp.SourceMap(), expanded)
+			diags.exit(1)
+		}
+	}
+	if *strict {
+		diags.report("warning", uninit.Check(program, libraryDecls(*useRuntime, passOpts...)...), pp.SourceMap(), expanded)
+	}
+
+	var output string
+	comment := "// "
+	if *showLowered {
+		comment = "-- "
+		// Print desugared occam, prefixed with the lowering steps applied
+		var sb strings.Builder
 		sourceMap := pp.SourceMap()
-		for _, err := range p.Errors() {
-			fmt.Fprintf(os.Stderr, "  %s\n", translateError(err, sourceMap))
+		for _, step := range lower.Lower(program) {
+			sb.WriteString("-- " + translateError(step.String(), sourceMap) + "\n")
+		}
+		sb.WriteString(format.Print(program))
+		output = sb.String()
+	} else {
+		// Generate Go code
+		gen := codegen.New(append([]codegen.Option{
+			codegen.WithMaxFuncSize(*maxFuncSize),
+			codegen.WithOutlining(*outline),
+			codegen.WithTableThreshold(*tableThreshold),
+			codegen.WithTableData(*tableData),
+			codegen.WithEntry(*entry),
+			codegen.WithTypeMap(parseTypeMaps(typeMaps)),
+			codegen.WithWordSize(*wordSize),
+			codegen.WithStrict(*strict),
+			codegen.WithPoison(*poison),
+			codegen.WithRejectPlacement(*rejectPlacement),
+			codegen.WithDeterministic(*deterministic),
+			codegen.WithCheckedArith(*checkedArith),
+			codegen.WithBoundsCheck(*boundsCheck),
+			codegen.WithLeakCheck(*leakCheck),
+			codegen.WithParRecover(*parRecover),
+			codegen.WithPoisonUninit(*poisonUninit),
+			codegen.WithExtendedRendezvous(*extendedRendezvous),
+			codegen.WithPriPar(priParMode),
+			codegen.WithErrorWrappers(*errorWrappers),
+			codegen.WithPrefix(*prefix),
+			codegen.WithPackage(*pkg),
+			codegen.WithRuntime(*useRuntime),
+			codegen.WithGoVersion(goMinor),
+			codegen.WithSourcePos(sourcePos(pp.SourceMap(), filepath.Dir(inputFile))),
+		}, passOpts...)...)
+		output = gen.Generate(program)
+		diags.report("warning", gen.Warnings(), pp.SourceMap(), expanded)
+		if len(gen.Errors()) > 0 {
+			diags.report("error", gen.Errors(), pp.SourceMap(), expanded)
+			diags.exit(1)
+		}
+		if *stats {
+			printStats(gen.Stats(), pp.SourceMap())
+		}
+		if *manifest != "" {
+			writeManifest(*manifest, gen.Manifest(), *force)
+		}
+		if *testsFile != "" {
+			writeOutput(*testsFile, header.render(comment, inputFile, expanded)+gen.GenerateTests(program), *force)
 		}
-		os.Exit(1)
 	}
 
-	// Generate Go code
-	gen := codegen.New()
-	output := gen.Generate(program)
+	writeOutput(*outputFile, header.render(comment, inputFile, expanded)+output, *force)
+	diags.flush()
+}
 
-	// Write output
-	if *outputFile != "" {
-		err := os.WriteFile(*outputFile, []byte(output), 0644)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error writing file: %s\n", err)
+// parseDefines builds the preprocessor defines map from -D SYMBOL[=value] flags.
+func parseDefines(defines []string) map[string]string {
+	defs := map[string]string{}
+	for _, d := range defines {
+		if idx := strings.Index(d, "="); idx >= 0 {
+			defs[d[:idx]] = d[idx+1:]
+		} else {
+			defs[d] = ""
+		}
+	}
+	return defs
+}
+
+// hasDefine reports whether -D flags define name.
+func hasDefine(defines []string, name string) bool {
+	for _, d := range defines {
+		if sym, _, _ := strings.Cut(d, "="); sym == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTypeMaps builds the codegen type map from -map-type OCCAM=GO flags.
+func parseTypeMaps(maps []string) map[string]string {
+	types := map[string]string{}
+	for _, m := range maps {
+		occamType, goType, ok := strings.Cut(m, "=")
+		if !ok || occamType == "" || goType == "" {
+			fmt.Fprintf(os.Stderr, "Error: -map-type %q is not of the form OCCAM=GO (e.g. BOOL=int32)\n", m)
 			os.Exit(1)
 		}
-	} else {
-		fmt.Print(output)
+		types[occamType] = goType
 	}
+	return types
 }
 
-var lineErrRe = regexp.MustCompile(`^line (\d+): (.*)`)
+var optLevelRe = regexp.MustCompile(`^--?O([0-9])$`)
 
-// translateError rewrites "line NNN: msg" to "file:line: msg" using the source map.
-func translateError(errMsg string, sourceMap []preproc.SourceLoc) string {
-	m := lineErrRe.FindStringSubmatch(errMsg)
-	if m == nil {
-		return errMsg
+// optLevelArgs rewrites -O0, -O1, ... in args as -O=0, -O=1, ... for the
+// flag package.
+func optLevelArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		if m := optLevelRe.FindStringSubmatch(arg); m != nil {
+			arg = "-O=" + m[1]
+		}
+		out[i] = arg
 	}
-	lineNum, _ := strconv.Atoi(m[1])
-	idx := lineNum - 1 // source map is 0-indexed
-	if idx < 0 || idx >= len(sourceMap) {
-		return errMsg
+	return out
+}
+
+// passNames lists the optimization passes, with the -O level each runs from.
+func passNames() string {
+	var names []string
+	for _, p := range codegen.Passes {
+		names = append(names, fmt.Sprintf("%s (-O%d: %s)", p.Name, p.Level, p.Doc))
 	}
-	loc := sourceMap[idx]
-	return fmt.Sprintf("%s:%d: %s", loc.File, loc.Line, m[2])
+	return strings.Join(names, "; ")
 }
 
+// parsePasses returns the codegen options for -passes, a comma-separated
+// list of optimization passes each turned on, or off with a leading -.
+func parsePasses(list string) []codegen.Option {
+	var opts []codegen.Option
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		on := !strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		known := false
+		for _, p := range codegen.Passes {
+			known = known || p.Name == name
+		}
+		if !known {
+			fmt.Fprintf(os.Stderr, "Error: -passes: unknown optimization pass %q\n", name)
+			os.Exit(1)
+		}
+		opts = append(opts, codegen.WithPass(name, on))
+	}
+	return opts
+}
+
+var goIdentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 func genModuleCmd(args []string) {
 	fs := flag.NewFlagSet("gen-module", flag.ExitOnError)
 	outputFile := fs.String("o", "", "Output file (default: stdout)")
+	force := fs.Bool("force", false, "Rewrite the output file even when its content is unchanged")
 	moduleName := fs.String("name", "", "Module guard name (default: derived from library name)")
 	fs.Parse(args)
 
@@ -177,10 +413,786 @@ func genModuleCmd(args []string) {
 		guard = strings.ToUpper(name) + ".MODULE"
 	}
 
-	output := modgen.GenerateModule(lib, guard)
+	writeOutput(*outputFile, modgen.GenerateModule(lib, guard), *force)
+}
+
+func flattenCmd(args []string) {
+	fs := flag.NewFlagSet("flatten", flag.ExitOnError)
+	outputFile := fs.String("o", "", "Output file (default: stdout)")
+	force := fs.Bool("force", false, "Rewrite the output file even when its content is unchanged")
+	var includePaths multiFlag
+	fs.Var(&includePaths, "I", "Include search path (repeatable)")
+	var defines multiFlag
+	fs.Var(&defines, "D", "Predefined symbol (repeatable)")
+	header := addHeaderFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: occam2go flatten [-o output] [-I path]... [-D SYMBOL]... <input.occ>\n")
+		os.Exit(1)
+	}
+
+	pp, expanded := preprocessFile(fs.Arg(0), "<stdin>", includePaths, defines, &diagnostics{})
+	writeOutput(*outputFile, header.render("-- ", fs.Arg(0), expanded)+preproc.Flatten(expanded, pp.SourceMap()), *force)
+}
+
+func protodocCmd(args []string) {
+	fs := flag.NewFlagSet("protodoc", flag.ExitOnError)
+	outputFile := fs.String("o", "", "Output file (default: stdout)")
+	force := fs.Bool("force", false, "Rewrite the output file even when its content is unchanged")
+	var includePaths multiFlag
+	fs.Var(&includePaths, "I", "Include search path (repeatable)")
+	var defines multiFlag
+	fs.Var(&defines, "D", "Predefined symbol (repeatable)")
+	header := addHeaderFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: occam2go protodoc [-o output] [-I path]... [-D SYMBOL]... <input.occ>\n")
+		os.Exit(1)
+	}
+
+	pp, expanded := preprocessFile(fs.Arg(0), "<stdin>", includePaths, defines, &diagnostics{})
+	p := parser.New(lexer.New(expanded))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		fmt.Fprintf(os.Stderr, "Parse errors:\n")
+		sourceMap := pp.SourceMap()
+		for _, err := range p.Errors() {
+			fmt.Fprintf(os.Stderr, "  %s\n", translateError(err, sourceMap))
+		}
+		os.Exit(1)
+	}
+
+	// Markdown has no line comments; the header goes in an HTML comment
+	writeOutput(*outputFile, header.render("", fs.Arg(0), expanded)+protodoc.GenerateMarkdown(program), *force)
+}
+
+// lexToken is a token as printed by the lex subcommand with -json.
+type lexToken struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Col     int    `json:"col"`
+	Type    string `json:"type"`
+	Literal string `json:"literal"`
+}
+
+func lexCmd(args []string) {
+	fs := flag.NewFlagSet("lex", flag.ExitOnError)
+	outputFile := fs.String("o", "", "Output file (default: stdout)")
+	force := fs.Bool("force", false, "Rewrite the output file even when its content is unchanged")
+	jsonOut := fs.Bool("json", false, "Print the tokens as a JSON array of {file, line, col, type, literal}")
+	var includePaths multiFlag
+	fs.Var(&includePaths, "I", "Include search path (repeatable)")
+	var defines multiFlag
+	fs.Var(&defines, "D", "Predefined symbol (repeatable)")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: occam2go lex [-o output] [-json] [-I path]... [-D SYMBOL]... <input.occ>\n")
+		os.Exit(1)
+	}
+
+	pp, expanded := preprocessFile(fs.Arg(0), "<stdin>", includePaths, defines, &diagnostics{})
+	sourceMap := pp.SourceMap()
+	var tokens []lexToken
+	for _, tok := range lexer.Tokenize(expanded) {
+		t := lexToken{Line: tok.Line, Col: tok.Column, Type: tok.Type.String(), Literal: tok.Literal}
+		if i := tok.Line - 1; i >= 0 && i < len(sourceMap) {
+			t.File, t.Line = sourceMap[i].File, sourceMap[i].Line
+		}
+		tokens = append(tokens, t)
+	}
+
+	var out strings.Builder
+	if *jsonOut {
+		data, _ := json.MarshalIndent(tokens, "", "  ")
+		out.Write(data)
+		out.WriteString("\n")
+	} else {
+		// One token per line: position, type and the quoted literal, if any
+		for _, t := range tokens {
+			out.WriteString(position{File: t.File, Line: t.Line, Col: t.Col}.String() + "\t" + t.Type)
+			if t.Literal != "" {
+				out.WriteString("\t" + strconv.Quote(t.Literal))
+			}
+			out.WriteString("\n")
+		}
+	}
+	writeOutput(*outputFile, out.String(), *force)
+}
+
+func checkCmd(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	var includePaths multiFlag
+	fs.Var(&includePaths, "I", "Include search path (repeatable)")
+	var defines multiFlag
+	fs.Var(&defines, "D", "Predefined symbol (repeatable)")
+	std := fs.String("std", "extended", "Language standard: occam2.1, occam2.5, occampi or extended")
+	useRuntime := fs.Bool("use-runtime", false, "Check calls to the course library against the Go implementations in the runtime package")
+	jsonDiags := fs.Bool("json-diagnostics", false, "Print errors to stderr as one JSON array of {file, line, col, severity, message}")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: occam2go check [-I path]... [-D SYMBOL]... <dir | input.occ...>\n")
+		os.Exit(1)
+	}
+	dialect, err := parser.ParseDialect(*std)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	programs, err := checkPrograms(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	// All programs are checked whatever the earlier ones gave
+	diags := &diagnostics{json: *jsonDiags}
+	failed := 0
+	for _, files := range programs {
+		if !checkProgram(files, includePaths, defines, dialect, *useRuntime, diags) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		if !diags.json {
+			fmt.Fprintf(os.Stderr, "%d of %d programs failed the checks\n", failed, len(programs))
+		}
+		diags.exit(1)
+	}
+	diags.flush()
+}
+
+// checkPrograms returns the files of each program check is given: a file is
+// a program of its own, and the .occ files of a directory are one program,
+// ordered by their #USEs as build orders them.
+func checkPrograms(args []string) ([][]string, error) {
+	var programs [][]string
+	for _, arg := range args {
+		files, err := buildInputs([]string{arg})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 1 {
+			if files, err = preproc.OrderFiles(files); err != nil {
+				return nil, err
+			}
+		}
+		programs = append(programs, files)
+	}
+	return programs, nil
+}
+
+// checkProgram preprocesses, parses and semantically checks the program made
+// of files, reports its errors to diags, after any unbalanced #IF/#ENDIF the
+// preprocessor found, and returns whether there were none. Semantic checks
+// are skipped when the program does not parse.
+func checkProgram(files []string, includePaths, defines []string, dialect parser.Dialect, useRuntime bool, diags *diagnostics) bool {
+	before := diags.errors
+	pp := preproc.New(
+		preproc.WithIncludePaths(includePaths),
+		preproc.WithDefines(parseDefines(defines)),
+	)
+	expanded, err := pp.ProcessFiles(files)
+	if err != nil {
+		diags.preprocError("", err)
+		return false
+	}
+	diags.preprocMessages("error", pp.Errors())
+
+	p := parser.New(lexer.New(expanded), parser.WithDialect(dialect))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		diags.report("error", p.Errors(), pp.SourceMap(), expanded)
+	} else {
+		diags.report("error", sema.Check(program, libraryDecls(useRuntime)...), pp.SourceMap(), expanded)
+	}
+	if diags.errors == before {
+		diags.report("warning", network.Check(program), pp.SourceMap(), expanded)
+		diags.report("warning", uninit.Check(program, libraryDecls(useRuntime)...), pp.SourceMap(), expanded)
+	}
+	return diags.errors == before
+}
+
+func fmtCmd(args []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "Write the result back to each file instead of to stdout")
+	list := fs.Bool("l", false, "List the files whose formatting differs instead of printing them")
+	jsonDiags := fs.Bool("json-diagnostics", false, "Print errors to stderr as one JSON array of {file, line, col, severity, message}")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: occam2go fmt [-w] [-l] <dir | input.occ...>\n")
+		os.Exit(1)
+	}
+	files, err := buildInputs(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	// A file that does not parse is left alone; the others are still done
+	diags := &diagnostics{json: *jsonDiags}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		src := string(data)
+		out, errs := format.Source(src)
+		if len(errs) > 0 {
+			sourceMap := make([]preproc.SourceLoc, strings.Count(src, "\n")+1)
+			for i := range sourceMap {
+				sourceMap[i] = preproc.SourceLoc{File: file, Line: i + 1}
+			}
+			diags.report("error", errs, sourceMap, src)
+			continue
+		}
+		if *list && out != src {
+			fmt.Println(file)
+		}
+		if *write {
+			writeOutput(file, out, false)
+		} else if !*list {
+			fmt.Print(out)
+		}
+	}
+	if diags.errors > 0 {
+		diags.exit(1)
+	}
+	diags.flush()
+}
+
+func reduceCmd(args []string) {
+	fs := flag.NewFlagSet("reduce", flag.ExitOnError)
+	outputFile := fs.String("o", "", "Output file (default: stdout)")
+	force := fs.Bool("force", false, "Rewrite the output file even when its content is unchanged")
+	var includePaths multiFlag
+	fs.Var(&includePaths, "I", "Include search path (repeatable)")
+	var defines multiFlag
+	fs.Var(&defines, "D", "Predefined symbol (repeatable)")
+	match := fs.String("match", "", "Text the failure must contain throughout (default: the first error message of the input, without its position)")
+	vet := fs.Bool("vet", false, "Also run go vet on the generated Go, and count its complaints as failures")
+	std := fs.String("std", "extended", "Language standard: occam2.1, occam2.5, occampi or extended")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: occam2go reduce [-o output] [-match text] [-vet] [-I path]... [-D SYMBOL]... <input.occ>\n")
+		os.Exit(1)
+	}
+	dialect, err := parser.ParseDialect(*std)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	// The includes are flattened in, so the reproducer stands alone
+	_, expanded := preprocessFile(fs.Arg(0), "<stdin>", includePaths, defines, &diagnostics{})
+	dir, err := os.MkdirTemp("", "occam2go-reduce")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+
+	failure := transpileFailure(expanded, dialect, *vet, dir)
+	if failure == "" || !strings.Contains(failure, *match) {
+		fmt.Fprintf(os.Stderr, "Error: %s does not fail", fs.Arg(0))
+		if *match != "" {
+			fmt.Fprintf(os.Stderr, " with %q", *match)
+		}
+		fmt.Fprintf(os.Stderr, "\n%s", failure)
+		os.Exit(1)
+	}
+	if *match == "" {
+		// Keep to this failure rather than drifting to whichever a
+		// deletion causes, such as a parse error
+		*match = firstError(failure)
+		fmt.Fprintf(os.Stderr, "Reducing while it fails with %q\n", *match)
+	}
+
+	attempts := 0
+	fails := func(source string) bool {
+		attempts++
+		failure := transpileFailure(source, dialect, *vet, dir)
+		return failure != "" && strings.Contains(failure, *match)
+	}
+
+	reduced := reduce.Reduce(expanded, fails)
+	fmt.Fprintf(os.Stderr, "Reduced %d lines to %d in %d attempts; it fails with:\n%s",
+		strings.Count(expanded, "\n"), strings.Count(reduced, "\n"), attempts, transpileFailure(reduced, dialect, *vet, dir))
+	writeOutput(*outputFile, reduced, *force)
+}
+
+// transpileFailure transpiles source and returns the errors it fails with,
+// or "" if it succeeds. A panic in the transpiler is a failure too, and
+// with vet so is a complaint from go vet about the Go generated, which is
+// written to dir to be checked.
+func transpileFailure(source string, dialect parser.Dialect, vet bool, dir string) (failure string) {
+	defer func() {
+		if r := recover(); r != nil {
+			failure = fmt.Sprintf("panic: %v\n", r)
+		}
+	}()
+	report := func(kind string, errs []string) string {
+		return kind + ":\n  " + strings.Join(errs, "\n  ") + "\n"
+	}
+
+	p := parser.New(lexer.New(source), parser.WithDialect(dialect))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return report("Parse errors", p.Errors())
+	}
+	if errs := sema.Check(program, codegen.CycleDecls()...); len(errs) > 0 {
+		return report("Semantic errors", errs)
+	}
+	gen := codegen.New()
+	output := gen.Generate(program)
+	if len(gen.Errors()) > 0 {
+		return report("Codegen errors", gen.Errors())
+	}
+	if !vet {
+		return ""
+	}
+
+	file := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(file, []byte(output), 0644); err != nil {
+		return report("Error writing Go", []string{err.Error()})
+	}
+	cmd := exec.Command("go", "vet", file)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "go vet:\n" + string(out)
+	}
+	return ""
+}
+
+// errorPosRe matches the position at the start of an error message: "line
+// 12: " or "line 12:7: " from the transpiler, "./main.go:23:8: " from go vet.
+var errorPosRe = regexp.MustCompile(`^(vet: )?(line \d+(:\d+)?: |\S+\.go:\d+:\d+: )`)
+
+// firstError returns the first error message in the failure reported by
+// transpileFailure, without its position, which deletions change.
+func firstError(failure string) string {
+	for _, line := range strings.Split(failure, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasSuffix(line, ":") {
+			continue // a heading
+		}
+		return errorPosRe.ReplaceAllString(line, "")
+	}
+	return ""
+}
+
+func conformanceCmd(args []string) {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	var includePaths multiFlag
+	fs.Var(&includePaths, "I", "Include search path (repeatable), after the directory of each test")
+	var defines multiFlag
+	fs.Var(&defines, "D", "Predefined symbol (repeatable)")
+	std := fs.String("std", "extended", "Language standard: occam2.1, occam2.5, occampi or extended")
+	pattern := fs.String("pattern", "cgtest*.occ", "Files of a directory argument that are tests")
+	run := fs.String("run", "", "Only run the tests whose file names match this regular expression")
+	failText := fs.String("fail", conformance.DefaultFail.String(), "Regular expression matching the output lines of a test that reports a failed check")
+	timeout := fs.Duration("timeout", conformance.DefaultTimeout, "How long each test program may run")
+	jobs := fs.Int("j", runtime.NumCPU(), "Number of tests to transpile, build and run at once")
+	jsonOut := fs.Bool("json", false, "Print the results and summary as JSON instead of text")
+	wordSize := fs.Int("word-size", 0, "Map occam INT to Go int32 or int64 (32 or 64), as for the transpiler")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: occam2go conformance [-run regexp] [-timeout d] [-j n] [-json] [-I path]... [-D SYMBOL]... <dir | test.occ...>\n")
+		os.Exit(1)
+	}
+	dialect, err := parser.ParseDialect(*std)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	runRe, err := regexp.Compile(*run)
+	if err == nil {
+		_, err = regexp.Compile(*failText)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if *wordSize != 0 && *wordSize != 32 && *wordSize != 64 {
+		fmt.Fprintf(os.Stderr, "Error: -word-size %d is not 32 or 64\n", *wordSize)
+		os.Exit(1)
+	}
+	if *wordSize != 0 && !hasDefine(defines, "TARGET.BITS.PER.WORD") {
+		defines = append(defines, fmt.Sprintf("TARGET.BITS.PER.WORD=%d", *wordSize))
+	}
+
+	var files []string
+	for _, arg := range fs.Args() {
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			tests, err := conformance.Tests(arg, *pattern)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(1)
+			}
+			files = append(files, tests...)
+		} else {
+			files = append(files, arg)
+		}
+	}
+	var selected []string
+	for _, file := range files {
+		if runRe.MatchString(filepath.Base(file)) {
+			selected = append(selected, file)
+		}
+	}
+
+	opts := conformance.Options{
+		IncludePaths: includePaths,
+		Defines:      parseDefines(defines),
+		Dialect:      dialect,
+		Codegen:      []codegen.Option{codegen.WithWordSize(*wordSize)},
+		Timeout:      *timeout,
+		Fail:         regexp.MustCompile(*failText),
+		Jobs:         *jobs,
+	}
+	var progress func(conformance.Result)
+	if !*jsonOut {
+		progress = func(r conformance.Result) {
+			if r.Stage == conformance.StagePass {
+				fmt.Printf("PASS %s\n", r.File)
+			} else {
+				fmt.Printf("FAIL %s (%s): %s\n", r.File, r.Stage, r.Detail)
+			}
+		}
+	}
+	results := conformance.Run(selected, opts, progress)
+	summary := conformance.Summarize(results)
+	if *jsonOut {
+		out, _ := json.MarshalIndent(struct {
+			Results []conformance.Result `json:"results"`
+			conformance.Summary
+			Percent float64 `json:"percent"`
+		}{results, summary, summary.Percent()}, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Print(summary)
+}
+
+func buildCmd(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	outputFile := fs.String("o", "", "Output file (default: stdout; with -target, the executable, named after the first input)")
+	force := fs.Bool("force", false, "Rewrite the output file even when its content is unchanged")
+	var includePaths multiFlag
+	fs.Var(&includePaths, "I", "Include search path (repeatable)")
+	var defines multiFlag
+	fs.Var(&defines, "D", "Predefined symbol (repeatable)")
+	std := fs.String("std", "extended", "Language standard: occam2.1, occam2.5, occampi or extended")
+	entry := fs.String("entry", "", "Name of the PROC to run as the program entry point (default: the one marked --#PRAGMA ENTRY, else the last matching, which must all be in one file)")
+	prefix := fs.String("prefix", "", "Start the names of generated protocol types and helper functions with this")
+	pkg := fs.String("pkg", "", "Generate an importable Go package with this name instead of a program")
+	manifest := fs.String("manifest", "", "With -pkg, also write a JSON description of the package's PROCs, FUNCTIONs and protocols to this file")
+	useRuntime := fs.Bool("use-runtime", false, "Call the Go implementations of the course library in the runtime package instead of transpiling it")
+	jsonDiags := fs.Bool("json-diagnostics", false, "Print errors and warnings to stderr as one JSON array of {file, line, col, severity, message}")
+	stats := fs.Bool("stats", false, "Print counts of what was translated (PROCs, channels, PAR branches, ALTs, ...) to stderr")
+	goVersion := fs.String("go-version", codegen.DefaultGoVersion, "Oldest Go release the generated code must build with")
+	target := fs.String("target", "", "Compile to an executable for GOOS/GOARCH (e.g. linux/arm64), or host, with the Go toolchain instead of writing Go")
+	runtimeDir := fs.String("runtime-dir", "", "With -target and -use-runtime, build the runtime package from this occam2go source directory")
+	header := addHeaderFlags(fs)
+	// Flags may also follow the inputs: build -target linux/arm64 prog.occ -o prog
+	var inputs []string
+	fs.Parse(args)
+	for fs.NArg() > 0 {
+		inputs = append(inputs, fs.Arg(0))
+		fs.Parse(fs.Args()[1:])
+	}
+
+	if len(inputs) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: occam2go build [-o output] [-target GOOS/GOARCH] [-I path]... [-D SYMBOL]... [-entry PROC] <dir | input.occ...>\n")
+		os.Exit(1)
+	}
+	if *prefix != "" && !goIdentRe.MatchString(*prefix) {
+		fmt.Fprintf(os.Stderr, "Error: -prefix %q is not a Go identifier\n", *prefix)
+		os.Exit(1)
+	}
+	checkPackageName(*pkg)
+	checkManifest(*manifest, *pkg)
+	goMinor := parseGoVersion(*goVersion)
+	var goos, goarch string
+	if *target != "" {
+		if *pkg != "" {
+			fmt.Fprintf(os.Stderr, "Error: -target builds a program, not a -pkg package\n")
+			os.Exit(1)
+		}
+		var err error
+		if goos, goarch, err = parseTarget(*target); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	dialect, err := parser.ParseDialect(*std)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	files, err := buildInputs(inputs)
+	if err == nil {
+		files, err = preproc.OrderFiles(files)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
 
-	if *outputFile != "" {
-		err := os.WriteFile(*outputFile, []byte(output), 0644)
+	pp := preproc.New(
+		preproc.WithIncludePaths(includePaths),
+		preproc.WithDefines(parseDefines(defines)),
+	)
+	diags := &diagnostics{json: *jsonDiags}
+	expanded, err := pp.ProcessFiles(files)
+	if err != nil {
+		diags.preprocError("", err)
+		diags.exit(1)
+	}
+	diags.preprocMessages("warning", pp.Errors())
+	sourceMap := pp.SourceMap()
+
+	p := parser.New(lexer.New(expanded), parser.WithDialect(dialect))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		diags.report("error", p.Errors(), sourceMap, expanded)
+		diags.exit(1)
+	}
+	if errs := sema.Check(program, libraryDecls(*useRuntime)...); len(errs) > 0 {
+		diags.report("error", errs, sourceMap, expanded)
+		diags.exit(1)
+	}
+	if *entry == "" && *pkg == "" {
+		if err := checkSingleEntryFile(program, sourceMap); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	gen := codegen.New(
+		codegen.WithEntry(*entry),
+		codegen.WithPrefix(*prefix),
+		codegen.WithPackage(*pkg),
+		codegen.WithRuntime(*useRuntime),
+		codegen.WithGoVersion(goMinor),
+	)
+	output := gen.Generate(program)
+	diags.report("warning", gen.Warnings(), sourceMap, expanded)
+	if len(gen.Errors()) > 0 {
+		diags.report("error", gen.Errors(), sourceMap, expanded)
+		diags.exit(1)
+	}
+	if *stats {
+		printStats(gen.Stats(), sourceMap)
+	}
+	if *manifest != "" {
+		writeManifest(*manifest, gen.Manifest(), *force)
+	}
+
+	output = header.render("// ", inputs[0], expanded) + output
+	if *target != "" {
+		if *outputFile == "" {
+			*outputFile = binaryName(inputs[0], goos)
+		}
+		if err := goBuild(output, goos, goarch, *outputFile, *runtimeDir); err != nil {
+			diags.flush()
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		diags.flush()
+		return
+	}
+	writeOutput(*outputFile, output, *force)
+	diags.flush()
+}
+
+// printStats writes the -stats summary of a generation to stderr, listing
+// the ALTs that use reflect.Select and the constructs left out of the Go.
+func printStats(s codegen.Stats, sourceMap []preproc.SourceLoc) {
+	w := os.Stderr
+	fmt.Fprintf(w, "PROCs:         %d\n", s.Procs)
+	fmt.Fprintf(w, "FUNCTIONs:     %d\n", s.Functions)
+	fmt.Fprintf(w, "channels:      %d\n", s.Channels)
+	fmt.Fprintf(w, "PAR branches:  %d\n", s.ParBranches)
+	fmt.Fprintf(w, "ALTs:          %d (%d with reflect.Select)\n", s.Alts, len(s.ReflectAlts))
+	for _, alt := range s.ReflectAlts {
+		fmt.Fprintf(w, "  %s\n", translateError(alt, sourceMap))
+	}
+	fmt.Fprintf(w, "protocols:     %d\n", s.Protocols)
+	fmt.Fprintf(w, "skipped:       %d\n", len(s.Skipped))
+	for _, skipped := range s.Skipped {
+		fmt.Fprintf(w, "  %s\n", translateError(skipped, sourceMap))
+	}
+	fmt.Fprintf(w, "Go lines:      %d\n", s.Lines)
+}
+
+// checkManifest exits with an error if a -manifest file is given without
+// -pkg, as only a package has an API to describe.
+func checkManifest(manifest, pkg string) {
+	if manifest != "" && pkg == "" {
+		fmt.Fprintf(os.Stderr, "Error: -manifest needs -pkg\n")
+		os.Exit(1)
+	}
+}
+
+// writeManifest writes the -manifest description of a generated package to
+// the file name as indented JSON, leaving the arrows of Go channel types
+// unescaped.
+func writeManifest(name string, m codegen.Manifest, force bool) {
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(m)
+	writeOutput(name, buf.String(), force)
+}
+
+// checkPackageName exits with an error unless pkg, given with -pkg, is
+// empty or can name a library package.
+func checkPackageName(pkg string) {
+	if pkg == "" {
+		return
+	}
+	if !goIdentRe.MatchString(pkg) || pkg == "main" {
+		fmt.Fprintf(os.Stderr, "Error: -pkg %q is not a Go package name other than main\n", pkg)
+		os.Exit(1)
+	}
+}
+
+// parseGoVersion validates the -go-version flag, exiting on error, and
+// returns the release's minor version for codegen.WithGoVersion.
+func parseGoVersion(v string) int {
+	minor, err := codegen.ParseGoVersion(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -go-version: %s\n", err)
+		os.Exit(1)
+	}
+	return minor
+}
+
+// buildInputs expands the arguments of build into the list of files to
+// transpile: a directory stands for the .occ files in it, in name order.
+func buildInputs(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.occ"))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no .occ files in %s", arg)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// checkSingleEntryFile reports an error when the PROCs that could become
+// main (those marked --#PRAGMA ENTRY if any, else all with an entry point
+// signature) come from more than one file, since picking the last would
+// then depend on the order the files were joined in.
+func checkSingleEntryFile(program *ast.Program, sourceMap []preproc.SourceLoc) error {
+	var candidates, marked []string
+	files := map[string]bool{}
+	markedFiles := map[string]bool{}
+	for _, stmt := range program.Statements {
+		proc, ok := stmt.(*ast.ProcDecl)
+		if !ok || !codegen.IsEntryProc(proc) {
+			continue
+		}
+		var file string
+		where := proc.Name
+		if idx := proc.Token.Line - 1; idx >= 0 && idx < len(sourceMap) {
+			file = sourceMap[idx].File
+			where = fmt.Sprintf("%s at %s:%d", proc.Name, file, sourceMap[idx].Line)
+		}
+		candidates = append(candidates, where)
+		files[file] = true
+		if proc.Entry {
+			marked = append(marked, where)
+			markedFiles[file] = true
+		}
+	}
+	if len(marked) > 0 {
+		candidates, files = marked, markedFiles
+	}
+	if len(files) > 1 {
+		return fmt.Errorf("entry PROCs in several files (%s); choose one with -entry or --#PRAGMA ENTRY", strings.Join(candidates, ", "))
+	}
+	return nil
+}
+
+// preprocessFile runs the preprocessor for a subcommand, exiting on error
+// and reporting warnings to diags.
+// preprocessFile preprocesses inputFile, or stdin when inputFile is "-",
+// whose lines are then reported as lines of stdinName. #INCLUDEs in stdin
+// are found only through includePaths.
+func preprocessFile(inputFile, stdinName string, includePaths, defines []string, diags *diagnostics) (*preproc.Preprocessor, string) {
+	pp := preproc.New(
+		preproc.WithIncludePaths(includePaths),
+		preproc.WithDefines(parseDefines(defines)),
+	)
+	var expanded string
+	var err error
+	if inputFile == "-" {
+		var source []byte
+		source, err = io.ReadAll(os.Stdin)
+		if err == nil {
+			expanded, err = pp.ProcessSourceAs(string(source), stdinName)
+		}
+	} else {
+		expanded, err = pp.ProcessFile(inputFile)
+	}
+	if err != nil {
+		if inputFile == "-" {
+			inputFile = stdinName
+		}
+		diags.preprocError(inputFile, err)
+		diags.exit(1)
+	}
+	diags.preprocMessages("warning", pp.Errors())
+	return pp, expanded
+}
+
+// libraryDecls returns the PROCs and FUNCTIONs that calls go to when the
+// program does not declare them, for sema to check calls against: the
+// building-block processes unless opts turn them off, and the course
+// library taken from the runtime package when useRuntime is on.
+func libraryDecls(useRuntime bool, opts ...codegen.Option) []ast.Statement {
+	decls := codegen.CycleDecls(opts...)
+	if useRuntime {
+		decls = append(decls, codegen.RuntimeDecls()...)
+	}
+	return decls
+}
+
+// writeOutput writes output to the named file, or to stdout if name is empty
+// or "-". A file that already holds exactly output is left alone, keeping
+// its modification time for build systems, unless force is set.
+func writeOutput(name, output string, force bool) {
+	if name != "" && name != "-" {
+		if !force {
+			if existing, err := os.ReadFile(name); err == nil && string(existing) == output {
+				return
+			}
+		}
+		err := os.WriteFile(name, []byte(output), 0644)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error writing file: %s\n", err)
 			os.Exit(1)
@@ -189,3 +1201,66 @@ func genModuleCmd(args []string) {
 		fmt.Print(output)
 	}
 }
+
+// headerFlags holds the flags controlling the header written at the top of
+// every output file.
+type headerFlags struct {
+	file         *string
+	stamp        *bool
+	reproducible *bool
+}
+
+func addHeaderFlags(fs *flag.FlagSet) headerFlags {
+	return headerFlags{
+		file:         fs.String("header", "", "File whose text (e.g. a license) is copied, as comments, to the top of the output"),
+		stamp:        fs.Bool("stamp", false, "Add a provenance stamp: \"Code generated by occam2go ... DO NOT EDIT.\", source hash and time"),
+		reproducible: fs.Bool("reproducible", false, "Omit the timestamp from -stamp so that output is byte-for-byte repeatable"),
+	}
+}
+
+// render returns the header to prepend to output generated from inputFile
+// (source is the preprocessed text, which is what the hash covers), with each
+// line prefixed by comment. An empty comment wraps the header in <!-- -->.
+// It returns "" when neither -header nor -stamp is given.
+func (h headerFlags) render(comment, inputFile, source string) string {
+	var lines []string
+	if *h.file != "" {
+		data, err := os.ReadFile(*h.file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading header: %s\n", err)
+			os.Exit(1)
+		}
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	}
+	if *h.stamp {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines,
+			fmt.Sprintf("Code generated by occam2go v%s from %s; DO NOT EDIT.", version, filepath.Base(inputFile)),
+			fmt.Sprintf("Preprocessed source SHA-256: %x", sha256.Sum256([]byte(source))),
+		)
+		if !*h.reproducible {
+			lines = append(lines, "Generated at: "+time.Now().UTC().Format(time.RFC3339))
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	if comment == "" {
+		sb.WriteString("<!--\n")
+		for _, line := range lines {
+			sb.WriteString(strings.ReplaceAll(line, "--", "- -") + "\n")
+		}
+		sb.WriteString("-->\n\n")
+		return sb.String()
+	}
+	for _, line := range lines {
+		sb.WriteString(strings.TrimRight(comment+line, " ") + "\n")
+	}
+	// Blank line so a Go header does not become the package doc comment
+	sb.WriteString("\n")
+	return sb.String()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// occam2go is the transpiler built for the tests that run it as a command.
+var occam2go string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "occam2go-cli-*")
+	if err != nil {
+		panic(err)
+	}
+	occam2go = filepath.Join(dir, "occam2go")
+	if out, err := exec.Command("go", "build", "-o", occam2go, ".").CombinedOutput(); err != nil {
+		panic("building occam2go: " + err.Error() + "\n" + string(out))
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// run runs the transpiler with args in dir, returning its stdout and
+// stderr.
+func run(t *testing.T, dir string, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	cmd := exec.Command(occam2go, args...)
+	cmd.Dir = dir
+	var out, errOut strings.Builder
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	err = cmd.Run()
+	return out.String(), errOut.String(), err
+}
+
+// writeFiles writes files, by name, into a new temporary directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const helloOcc = `PROC hello(CHAN OF BYTE keyb?, scr!, err!)
+  SEQ
+    scr ! 'h'
+    scr ! '*n'
+:
+`
+
+func TestWriteOutputUnchanged(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.go")
+	writeOutput(name, "package main\n", false)
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+	modTime := func() time.Time {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ModTime()
+	}
+
+	writeOutput(name, "package main\n", false)
+	if !modTime().Equal(old) {
+		t.Error("expected an unchanged output file not to be rewritten")
+	}
+	writeOutput(name, "package main\n", true)
+	if modTime().Equal(old) {
+		t.Error("expected -force to rewrite an unchanged output file")
+	}
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+	writeOutput(name, "package other\n", false)
+	if data, _ := os.ReadFile(name); string(data) != "package other\n" || modTime().Equal(old) {
+		t.Errorf("expected a changed output file to be rewritten, got %q", data)
+	}
+}
+
+func TestOutputDash(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"hello.occ": helloOcc})
+	out, stderr, err := run(t, dir, "-o", "-", "hello.occ")
+	if err != nil {
+		t.Fatalf("transpile failed: %v\n%s", err, stderr)
+	}
+	if !strings.HasPrefix(out, "package main") {
+		t.Errorf("expected -o - to write the Go to stdout, got:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "-")); err == nil {
+		t.Error("expected -o - not to create a file named -")
+	}
+}
+
+func TestHeaderAndStamp(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"hello.occ":   helloOcc,
+		"license.txt": "Copyright Example\nAll rights reserved.\n",
+	})
+	out, stderr, err := run(t, dir, "-header", "license.txt", "-stamp", "-reproducible", "hello.occ")
+	if err != nil {
+		t.Fatalf("transpile failed: %v\n%s", err, stderr)
+	}
+	lines := strings.Split(out, "\n")
+	want := []string{
+		"// Copyright Example",
+		"// All rights reserved.",
+		"//",
+		"// Code generated by occam2go v" + version + " from hello.occ; DO NOT EDIT.",
+	}
+	for i, w := range want {
+		if lines[i] != w {
+			t.Errorf("expected header line %d %q, got %q", i+1, w, lines[i])
+		}
+	}
+	if !strings.HasPrefix(lines[4], "// Preprocessed source SHA-256: ") || lines[5] != "" || lines[6] != "package main" {
+		t.Errorf("expected the source hash and then the package, got:\n%s", strings.Join(lines[4:7], "\n"))
+	}
+
+	again, _, _ := run(t, dir, "-header", "license.txt", "-stamp", "-reproducible", "hello.occ")
+	if again != out {
+		t.Error("expected -reproducible output to be the same on each run")
+	}
+	if stamped, _, _ := run(t, dir, "-stamp", "hello.occ"); !strings.Contains(stamped, "// Generated at: ") {
+		t.Errorf("expected a generation time without -reproducible, got:\n%s", stamped)
+	}
+	if plain, _, _ := run(t, dir, "hello.occ"); !strings.HasPrefix(plain, "package main") {
+		t.Errorf("expected no header without -header or -stamp, got:\n%s", plain)
+	}
+}
+
+func TestSourcePosRelative(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"prog.occ": "#INCLUDE \"work.inc\"\nPROC prog(CHAN BYTE kbd?, scr!, err!)\n  PAR\n    work()\n    SKIP\n:\n",
+		"work.inc": "PROC work()\n  PAR\n    SKIP\n    SKIP\n:\n",
+	})
+	// Named by an absolute path, the files are still named relative to the
+	// program's directory in the generated code
+	out, stderr, err := run(t, t.TempDir(), "-o", "-", filepath.Join(dir, "prog.occ"))
+	if err != nil {
+		t.Fatalf("transpile failed: %v\n%s", err, stderr)
+	}
+	if !strings.Contains(out, `_parRecover("", 1, "prog.occ:3", "PROC prog")`) ||
+		!strings.Contains(out, `_parRecover("", 1, "work.inc:2", "PROC work")`) {
+		t.Errorf("expected PAR positions relative to the program's directory, got:\n%s", out)
+	}
+	if strings.Contains(out, dir) {
+		t.Errorf("expected the generated code not to contain %s", dir)
+	}
+}
+
+func TestLexCmd(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"hello.occ": helloOcc})
+	out, stderr, err := run(t, dir, "lex", "hello.occ")
+	if err != nil {
+		t.Fatalf("lex failed: %v\n%s", err, stderr)
+	}
+	lines := strings.Split(out, "\n")
+	if lines[0] != "hello.occ:1:1\tPROC\t\"PROC\"" || lines[1] != "hello.occ:1:6\tIDENT\t\"hello\"" {
+		t.Errorf("expected the PROC heading's tokens first, got:\n%s", strings.Join(lines[:2], "\n"))
+	}
+	if !strings.Contains(out, "hello.occ:2:1\tINDENT\n") || !strings.Contains(out, "hello.occ:3:13\tBYTE_LIT\t\"h\"") {
+		t.Errorf("expected indentation and byte literal tokens, got:\n%s", out)
+	}
+
+	out, stderr, err = run(t, dir, "lex", "-json", "hello.occ")
+	if err != nil {
+		t.Fatalf("lex -json failed: %v\n%s", err, stderr)
+	}
+	if !strings.HasPrefix(out, "[") || !strings.Contains(out, `"file": "hello.occ"`) || !strings.Contains(out, `"literal": "PROC"`) {
+		t.Errorf("expected a JSON array of tokens, got:\n%s", out)
+	}
+}
+
+// elfMachine returns the machine field of the ELF executable name.
+func elfMachine(t *testing.T, name string) int {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 20 || string(data[1:4]) != "ELF" {
+		t.Fatalf("expected %s to be an ELF executable", name)
+	}
+	return int(data[18]) | int(data[19])<<8
+}
+
+func TestBuildTarget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs with the Go toolchain")
+	}
+	dir := writeFiles(t, map[string]string{
+		"hello.occ": helloOcc,
+		"course.occ": `PROC course(CHAN OF BYTE keyb?, scr!, err!)
+  out.string("course*n", 0, scr!)
+:
+`,
+	})
+
+	// Flags may follow the input; -o names the executable
+	if _, stderr, err := run(t, dir, "build", "-target", "linux/arm64", "hello.occ", "-o", "hello.arm64"); err != nil {
+		t.Fatalf("build -target linux/arm64 failed: %v\n%s", err, stderr)
+	}
+	if m := elfMachine(t, filepath.Join(dir, "hello.arm64")); m != 183 {
+		t.Errorf("expected an arm64 executable (machine 183), got machine %d", m)
+	}
+
+	// Without -o the executable is named after the input
+	if _, stderr, err := run(t, dir, "build", "-target", "host", "hello.occ"); err != nil {
+		t.Fatalf("build -target host failed: %v\n%s", err, stderr)
+	}
+	exe := filepath.Join(dir, binaryName("hello.occ", runtime.GOOS))
+	if out, err := exec.Command(exe).Output(); err != nil || string(out) != "h\n" {
+		t.Errorf("expected the host executable to print \"h\\n\", got %q (%v)", out, err)
+	}
+
+	// The runtime package is built from -runtime-dir
+	repo, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, stderr, err := run(t, dir, "build", "-use-runtime", "-runtime-dir", repo, "-target", "host", "course.occ"); err != nil {
+		t.Fatalf("build -use-runtime -runtime-dir failed: %v\n%s", err, stderr)
+	}
+	exe = filepath.Join(dir, binaryName("course.occ", runtime.GOOS))
+	if out, err := exec.Command(exe).Output(); err != nil || string(out) != "course\n" {
+		t.Errorf("expected the runtime program to print \"course\\n\", got %q (%v)", out, err)
+	}
+
+	errorTests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-target", "linux", "hello.occ"}, `Error: -target "linux" is not GOOS/GOARCH, such as linux/arm64, or host`},
+		{[]string{"-target", "plan9/nope", "hello.occ"}, "unsupported GOOS/GOARCH pair plan9/nope"},
+		{[]string{"-target", "host", "-pkg", "hello", "hello.occ"}, "Error: -target builds a program, not a -pkg package"},
+	}
+	for _, tt := range errorTests {
+		_, stderr, err := run(t, dir, append([]string{"build"}, tt.args...)...)
+		if err == nil || !strings.Contains(stderr, tt.want) {
+			t.Errorf("build %s: expected failure with %q, got %v:\n%s", strings.Join(tt.args, " "), tt.want, err, stderr)
+		}
+	}
+}
+
+func TestGoBuildErrors(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs with the Go toolchain")
+	}
+	output := filepath.Join(t.TempDir(), "bad")
+	err := goBuild("package main\n\nfunc main() {\n\tx := 1\n}\n", runtime.GOOS, runtime.GOARCH, output, "")
+	if err == nil {
+		t.Fatal("expected an error for Go that does not compile")
+	}
+	msg := err.Error()
+	_, kept, _ := strings.Cut(msg, "the generated Go is kept in ")
+	kept, _, _ = strings.Cut(kept, ")")
+	defer os.RemoveAll(kept)
+	if kept == "" || !strings.Contains(msg, filepath.Join(kept, "main.go")+":4:2: declared and not used: x") {
+		t.Errorf("expected the compiler error at an absolute path in the kept module, got:\n%s", msg)
+	}
+	if _, err := os.Stat(filepath.Join(kept, "main.go")); err != nil {
+		t.Errorf("expected the generated Go to be kept: %v", err)
+	}
+}
+
+func TestLifeExample(t *testing.T) {
+	// life declares abbreviations in each branch of a replicated PAR
+	repo, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, stderr, err := run(t, repo, filepath.Join("historical-examples", "life.occ"))
+	if err != nil {
+		t.Fatalf("transpiling life.occ failed: %v\n%s", err, stderr)
+	}
+	if !strings.Contains(out, "func life(") {
+		t.Errorf("expected the life PROC in the output, got:\n%s", out)
+	}
+}
+
+func TestCheckCmd(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"bad.occ": "PROC bad()\n  x := 1\n:\n",
+	})
+	prog := filepath.Join(dir, "prog")
+	if err := os.Mkdir(prog, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	lib := "PROC greet(CHAN OF BYTE out!)\n  out ! 'h'\n:\n"
+	main := "#USE \"lib\"\nPROC main(CHAN OF BYTE keyb?, scr!, err!)\n  greet(scr!)\n:\n"
+	for name, src := range map[string]string{"lib.occ": lib, "main.occ": main} {
+		if err := os.WriteFile(filepath.Join(prog, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A directory is one program, so main sees the PROC lib declares
+	if _, stderr, err := run(t, dir, "check", "prog"); err != nil {
+		t.Errorf("check of a #USE directory failed: %v\n%s", err, stderr)
+	}
+
+	_, stderr, err := run(t, dir, "check", "bad.occ", "prog")
+	if err == nil || !strings.Contains(stderr, "bad.occ:2:") || !strings.Contains(stderr, "1 of 2 programs failed the checks") {
+		t.Errorf("expected bad.occ alone to fail, got %v:\n%s", err, stderr)
+	}
+}
@@ -0,0 +1,405 @@
+// Package network analyses the process network of an occam program: the
+// channels it declares and the processes that send on and receive from
+// each, following channels passed to PROCs into what the PROCs do with
+// their parameters. Check uses it to find channels whose communications
+// have no peer running in parallel, a common cause of deadlock in ported
+// code.
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/codeassociates/occam2go/ast"
+)
+
+// Channel is a declared channel, or array of channels, and its uses.
+type Channel struct {
+	Name string
+	Line int // of the declaration
+	Uses []Use
+	// Unknown is set when the channel is used in a way the analysis does
+	// not follow, such as by a nested PROC or an abbreviation, so that
+	// its uses may be incomplete
+	Unknown bool
+
+	depth int // PAR branches from the top level to the declaration
+}
+
+// Use is a communication on a channel: directly, or by passing it to a PROC.
+type Use struct {
+	Line    int
+	Proc    string // the PROC communicating: the one called, or the one containing the use; "" at top level
+	Send    bool
+	Receive bool // with Send, a PROC that both sends and receives on the channel it is passed
+
+	pars []branch // PAR branches from the channel's declaration to the use
+}
+
+// branch is the place of a process among those running in parallel: a
+// branch of a PAR block, or a FORK.
+type branch struct {
+	node  ast.Statement
+	index int
+}
+
+// Analyze returns the channels declared in the program, in declaration order.
+func Analyze(program *ast.Program) []*Channel {
+	a := &analyzer{procs: map[string][]*target{}}
+	a.statements(program.Statements, scope{}, nil, "")
+
+	var channels []*Channel
+	for _, t := range a.channels {
+		for _, u := range t.uses {
+			if !a.resolve(&u) {
+				t.ch.Unknown = true
+				continue
+			}
+			if u.Send || u.Receive {
+				t.ch.Uses = append(t.ch.Uses, u.Use)
+			}
+		}
+		if t.opaque {
+			t.ch.Unknown = true
+		}
+		channels = append(channels, t.ch)
+	}
+	return channels
+}
+
+// Check returns a warning, in "line N: msg" form, for each channel that is
+// sent on but never received from, received from but never sent on, or
+// used both ways only by processes that run in sequence, so that the
+// communications cannot happen. Channels the analysis cannot follow, and
+// channel parameters (whose peers are the caller's), are not reported.
+func Check(program *ast.Program) []string {
+	var warnings []string
+	for _, ch := range Analyze(program) {
+		if ch.Unknown || len(ch.Uses) == 0 {
+			continue
+		}
+		var senders, receivers []Use
+		connected := false
+		for _, u := range ch.Uses {
+			if u.Send && u.Receive {
+				connected = true
+			} else if u.Send {
+				senders = append(senders, u)
+			} else {
+				receivers = append(receivers, u)
+			}
+		}
+		switch {
+		case connected:
+		case len(receivers) == 0:
+			warnings = append(warnings, fmt.Sprintf("line %d: channel %s is sent on%s but never received from", ch.Line, ch.Name, by(senders)))
+		case len(senders) == 0:
+			warnings = append(warnings, fmt.Sprintf("line %d: channel %s is received from%s but never sent on", ch.Line, ch.Name, by(receivers)))
+		case !anyParallel(senders, receivers, ch.depth):
+			warnings = append(warnings, fmt.Sprintf("line %d: channel %s is sent on and received from only in sequence, never by processes running in parallel", ch.Line, ch.Name))
+		}
+	}
+	return warnings
+}
+
+// by names the PROCs making uses, as " by a, b", or "" if none is in a PROC.
+func by(uses []Use) string {
+	seen := map[string]bool{}
+	var procs []string
+	for _, u := range uses {
+		if u.Proc != "" && !seen[u.Proc] {
+			seen[u.Proc] = true
+			procs = append(procs, u.Proc)
+		}
+	}
+	if len(procs) == 0 {
+		return ""
+	}
+	sort.Strings(procs)
+	return " by " + strings.Join(procs, ", ")
+}
+
+// anyParallel reports whether a sender and a receiver can run at the same
+// time, below the depth of the channel's declaration.
+func anyParallel(senders, receivers []Use, depth int) bool {
+	for _, s := range senders {
+		for _, r := range receivers {
+			if parallel(s.pars[depth:], r.pars[depth:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parallel reports whether uses at the ends of two PAR paths can run at the
+// same time: they are in different branches of one PAR, in one branch of a
+// replicated PAR (whose copies run in parallel), or one is FORKed.
+func parallel(a, b []branch) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i].node == b[i].node || isFork(a[i]) || isFork(b[i])
+		}
+		if par, ok := a[i].node.(*ast.ParBlock); ok && par.Replicator != nil {
+			return true
+		}
+	}
+	// One path leads on from the other's end: only a FORK there runs
+	// alongside it
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	return len(a) > len(b) && isFork(a[len(b)])
+}
+
+func isFork(b branch) bool {
+	_, ok := b.node.(*ast.ForkStmt)
+	return ok
+}
+
+// target collects the uses of a declared channel or of a channel parameter.
+type target struct {
+	ch     *Channel // nil for a parameter
+	dir    string   // declared direction of a parameter: "?", "!" or ""
+	uses   []use
+	opaque bool // used where the analysis cannot follow it
+
+	// Cached direction of a parameter (see direction)
+	state         int // 0 not worked out, 1 in progress, 2 done
+	send, receive bool
+	known         bool
+}
+
+// use is a Use before calls are resolved: a use passing the channel to a
+// PROC has call set, and its direction comes from the PROC's parameter.
+type use struct {
+	Use
+	call string
+	arg  int
+}
+
+// scope maps the channel names in scope to their targets. Captured marks
+// the names declared outside the PROC being walked.
+type scope map[string]*scoped
+
+type scoped struct {
+	t        *target
+	captured bool
+}
+
+func (s scope) copy() scope {
+	c := make(scope, len(s))
+	for k, v := range s {
+		c[k] = v
+	}
+	return c
+}
+
+type analyzer struct {
+	channels []*target
+	procs    map[string][]*target // PROC name -> per parameter, its target, or nil if not a channel
+}
+
+// statements walks a statement list. pars is the PAR path to it from the
+// top level and proc the PROC it is in.
+func (a *analyzer) statements(stmts []ast.Statement, sc scope, pars []branch, proc string) {
+	sc = sc.copy()
+	for _, stmt := range stmts {
+		a.statement(stmt, sc, pars, proc)
+	}
+}
+
+func (a *analyzer) statement(stmt ast.Statement, sc scope, pars []branch, proc string) {
+	switch s := stmt.(type) {
+	case *ast.ChanDecl:
+		for _, name := range s.Names {
+			t := &target{ch: &Channel{Name: name, Line: s.Token.Line, depth: len(pars)}}
+			a.channels = append(a.channels, t)
+			sc[name] = &scoped{t: t}
+		}
+	case *ast.VarDecl:
+		a.shadow(sc, s.Names...)
+	case *ast.ArrayDecl:
+		a.shadow(sc, s.Names...)
+	case *ast.Abbreviation:
+		// A channel abbreviated under another name is not followed
+		if name := baseName(s.Value); name != "" && sc[name] != nil {
+			sc[name].t.opaque = true
+		}
+		a.shadow(sc, s.Name)
+	case *ast.ProcDecl:
+		// The outer channels a nested PROC uses are used wherever it is
+		// called, which the analysis does not follow
+		inner := scope{}
+		for name, v := range sc {
+			inner[name] = &scoped{t: v.t, captured: true}
+		}
+		params := make([]*target, len(s.Params))
+		for i, p := range s.Params {
+			if p.IsChan {
+				params[i] = &target{dir: p.ChanDir}
+				inner[p.Name] = &scoped{t: params[i]}
+			} else {
+				delete(inner, p.Name)
+			}
+		}
+		a.procs[s.Name] = params
+		a.statements(s.Body, inner, nil, s.Name)
+	case *ast.Send:
+		a.use(sc, s.Channel, use{Use: Use{Line: s.Token.Line, Proc: proc, Send: true, pars: pars}})
+	case *ast.Receive:
+		a.use(sc, s.Channel, use{Use: Use{Line: s.Token.Line, Proc: proc, Receive: true, pars: pars}})
+	case *ast.VariantReceive:
+		a.use(sc, s.Channel, use{Use: Use{Line: s.Token.Line, Proc: proc, Receive: true, pars: pars}})
+		for _, c := range s.Cases {
+			caseScope := sc.copy()
+			for _, d := range c.Declarations {
+				a.statement(d, caseScope, pars, proc)
+			}
+			a.statements(c.Body, caseScope, pars, proc)
+		}
+	case *ast.ProcCall:
+		a.call(sc, s, pars)
+	case *ast.ForkStmt:
+		a.call(sc, s.Call, append(pars[:len(pars):len(pars)], branch{node: s}))
+	case *ast.SeqBlock:
+		a.statements(s.Statements, a.replicated(sc, s.Replicator), pars, proc)
+	case *ast.ParBlock:
+		inner := a.replicated(sc, s.Replicator)
+		for i, stmts := range s.Branches() {
+			a.statements(stmts, inner.copy(), append(pars[:len(pars):len(pars)], branch{node: s, index: i}), proc)
+		}
+	case *ast.AltBlock:
+		inner := a.replicated(sc, s.Replicator)
+		for _, c := range s.Cases {
+			caseScope := inner.copy()
+			for _, d := range c.Declarations {
+				a.statement(d, caseScope, pars, proc)
+			}
+			if !c.IsTimer && !c.IsSkip && !c.IsVariant && !c.IsOutput && !c.IsAlt { // a variant input, an output guard or a nested ALT is the VariantReceive, Send or AltBlock of its body
+				a.use(caseScope, c.Channel, use{Use: Use{Line: s.Token.Line, Proc: proc, Receive: true, pars: pars}})
+			}
+			a.statements(c.Body, caseScope, pars, proc)
+		}
+	case *ast.IfStatement:
+		inner := a.replicated(sc, s.Replicator)
+		for _, c := range s.Choices {
+			if c.NestedIf != nil {
+				a.statement(c.NestedIf, inner.copy(), pars, proc)
+			}
+			a.statements(c.Body, inner, pars, proc)
+		}
+	case *ast.CaseStatement:
+		for _, c := range s.Choices {
+			a.statements(c.Body, sc, pars, proc)
+		}
+	case *ast.WhileLoop:
+		a.statements(s.Body, sc, pars, proc)
+	case *ast.ClaimBlock:
+		a.statements(s.Body, sc, pars, proc)
+	case *ast.ForkingBlock:
+		a.statements(s.Body, sc, pars, proc)
+	}
+}
+
+// replicated returns the scope inside a replicated block, in which the
+// replicator variable hides any channel of its name.
+func (a *analyzer) replicated(sc scope, r *ast.Replicator) scope {
+	if r == nil {
+		return sc
+	}
+	inner := sc.copy()
+	delete(inner, r.Variable)
+	return inner
+}
+
+// shadow removes names declared as something other than a channel.
+func (a *analyzer) shadow(sc scope, names ...string) {
+	for _, name := range names {
+		delete(sc, name)
+	}
+}
+
+// use records a use of the named channel, if it is one the analysis tracks.
+func (a *analyzer) use(sc scope, name string, u use) {
+	v := sc[name]
+	if v == nil {
+		return
+	}
+	if v.captured {
+		v.t.opaque = true
+		return
+	}
+	v.t.uses = append(v.t.uses, u)
+}
+
+// call records the channels passed to a PROC.
+func (a *analyzer) call(sc scope, call *ast.ProcCall, pars []branch) {
+	for i, arg := range call.Args {
+		name := baseName(arg)
+		if name == "" {
+			continue
+		}
+		a.use(sc, name, use{Use: Use{Line: call.Token.Line, Proc: call.Name, pars: pars}, call: call.Name, arg: i})
+	}
+}
+
+// baseName returns the variable an argument or abbreviated value names,
+// through indexing and slicing, or "".
+func baseName(e ast.Expression) string {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		return e.Value
+	case *ast.IndexExpr:
+		return baseName(e.Left)
+	case *ast.SliceExpr:
+		return baseName(e.Array)
+	}
+	return ""
+}
+
+// resolve fills in the direction of a use passing a channel to a PROC from
+// what the PROC does with the parameter. It reports false if that is not
+// known.
+func (a *analyzer) resolve(u *use) bool {
+	if u.call == "" {
+		return true
+	}
+	params, ok := a.procs[u.call]
+	if !ok || u.arg >= len(params) {
+		return false // e.g. a PROC from outside the program
+	}
+	if params[u.arg] == nil {
+		return true // not passed as a channel
+	}
+	send, receive, known := a.direction(params[u.arg])
+	u.Send, u.Receive = send, receive
+	return known
+}
+
+// direction returns whether a PROC sends and receives on a channel
+// parameter, and whether that is known. A parameter it does nothing with
+// is taken to be used as its declared direction says.
+func (a *analyzer) direction(t *target) (send, receive, known bool) {
+	switch t.state {
+	case 1:
+		return false, false, true // recursion adds nothing new
+	case 2:
+		return t.send, t.receive, t.known
+	}
+	t.state = 1
+	t.known = !t.opaque
+	for _, u := range t.uses {
+		if !a.resolve(&u) {
+			t.known = false
+		}
+		t.send = t.send || u.Send
+		t.receive = t.receive || u.Receive
+	}
+	if !t.send && !t.receive {
+		t.send, t.receive = t.dir == "!", t.dir == "?"
+	}
+	t.state = 2
+	return t.send, t.receive, t.known
+}
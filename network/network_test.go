@@ -0,0 +1,119 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/codeassociates/occam2go/ast"
+	"github.com/codeassociates/occam2go/lexer"
+	"github.com/codeassociates/occam2go/parser"
+)
+
+func parse(t *testing.T, src string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		t.FailNow()
+	}
+	return program
+}
+
+func TestCheck(t *testing.T) {
+	input := `PROC producer(CHAN OF INT out!)
+  out ! 1
+:
+PROC consumer(CHAN OF INT in?)
+  INT x:
+  in ? x
+:
+PROC relay(CHAN OF INT in?, CHAN OF INT out!)
+  INT x:
+  SEQ
+    in ? x
+    out ! x
+:
+PROC loop(CHAN OF INT c)
+  INT x:
+  PAR
+    c ! 1
+    c ? x
+:
+PROC main()
+  CHAN OF INT a, b, lost, orphan, seq, self:
+  [4]CHAN OF INT pipe:
+  INT x:
+  SEQ
+    PAR
+      producer(a!)
+      relay(a?, b!)
+      consumer(b?)
+      producer(lost!)
+      ALT
+        orphan ? x
+          SKIP
+      PAR i = 0 FOR 3
+        relay(pipe[i]?, pipe[i + 1]!)
+      loop(self)
+    seq ! 1
+    seq ? x
+:
+`
+	want := []string{
+		"line 21: channel lost is sent on by producer but never received from",
+		"line 21: channel orphan is received from by main but never sent on",
+		"line 21: channel seq is sent on and received from only in sequence, never by processes running in parallel",
+	}
+	if got := Check(parse(t, input)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestCheckUnknown(t *testing.T) {
+	input := `PROC main()
+  CHAN OF INT a, b:
+  PROC send()
+    a ! 1
+  :
+  SEQ
+    external(b!)
+    send()
+:
+`
+	channels := Analyze(parse(t, input))
+	if len(channels) != 2 {
+		t.Fatalf("expected 2 channels, got %d", len(channels))
+	}
+	for _, ch := range channels {
+		if !ch.Unknown {
+			t.Errorf("expected channel %s to be unknown, got uses %+v", ch.Name, ch.Uses)
+		}
+	}
+	if got := Check(parse(t, input)); len(got) != 0 {
+		t.Errorf("expected no warnings, got %q", got)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	par := &ast.ParBlock{}
+	rep := &ast.ParBlock{Replicator: &ast.Replicator{Variable: "i"}}
+	fork := &ast.ForkStmt{}
+	for _, tt := range []struct {
+		a, b []branch
+		want bool
+	}{
+		{[]branch{{par, 0}}, []branch{{par, 1}}, true},
+		{[]branch{{par, 0}}, []branch{{par, 0}}, false},
+		{nil, nil, false},
+		{[]branch{{rep, 0}}, []branch{{rep, 0}}, true},
+		{nil, []branch{{fork, 0}}, true},
+		{[]branch{{par, 0}}, []branch{{&ast.ParBlock{}, 0}}, false},
+	} {
+		if got := parallel(tt.a, tt.b); got != tt.want {
+			t.Errorf("parallel(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -66,12 +66,158 @@ type Parser struct {
 	protocolNames map[string]bool
 	protocolDefs  map[string]*ast.ProtocolDecl
 
-	// Track record type names and definitions
+	// Tags of every variant PROTOCOL in the input, found by prescan
+	variantTags map[string]bool
+
+	// The ( of each VALOF expression with specifications before its VALOF,
+	// found by prescan
+	valofSpecs map[lexer.Token]bool
+
+	// Track record type names and definitions; recordNames also has the
+	// names of DATA TYPEs, which are declared and passed the same way
 	recordNames map[string]bool
 	recordDefs  map[string]*ast.RecordDecl
+
+	// DATA TYPEs naming primitive types, usable as conversions
+	dataTypes map[string]bool
+
+	// CHAN TYPE names (also in recordNames), whose variables are ends
+	chanTypes map[string]bool
+
+	// Set by PLACED for the PAR that follows
+	placedPar bool
+
+	// Language standard to enforce (DialectExtended accepts everything)
+	dialect Dialect
+
+	// Replace statements that fail to parse by ast.Unsupported stubs
+	// (WithPermissive), moving their errors to unsupported
+	permissive  bool
+	unsupported []string
+
+	// Recursion depth through parseStatement/parseExpression
+	depth   int
+	tooDeep bool
+}
+
+// maxNestingDepth bounds recursion through statements and expressions so that
+// pathological input (e.g. machine-generated code with a million nested
+// parentheses) is reported as an error instead of overflowing the stack.
+const maxNestingDepth = 100000
+
+// Dialect selects which occam language standard the parser enforces.
+type Dialect int
+
+const (
+	DialectExtended Dialect = iota // all occam2go extensions accepted (default)
+	DialectOccam21
+	DialectOccam25
+	DialectOccamPi
+)
+
+var dialectNames = map[string]Dialect{
+	"extended": DialectExtended,
+	"occam2.1": DialectOccam21,
+	"occam2.5": DialectOccam25,
+	"occampi":  DialectOccamPi,
 }
 
-func New(l *lexer.Lexer) *Parser {
+// ParseDialect maps a -std name (occam2.1, occam2.5, occampi, extended) to a Dialect.
+func ParseDialect(name string) (Dialect, error) {
+	if d, ok := dialectNames[name]; ok {
+		return d, nil
+	}
+	return DialectExtended, fmt.Errorf("unknown dialect %q (want occam2.1, occam2.5, occampi or extended)", name)
+}
+
+func (d Dialect) String() string {
+	for name, v := range dialectNames {
+		if v == d {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// extension identifies a non-standard construct accepted by occam2go.
+type extension int
+
+const (
+	extChanShorthand    extension = iota // CHAN BYTE without OF
+	extUntypedVal                        // VAL x IS expr:
+	extRecordKeyword                     // RECORD name (instead of DATA TYPE name RECORD)
+	extValofExpr                         // (VALOF ... RESULT e) in an expression
+	extArrayConstructor                  // [i = 0 FOR n | e]
+	extProtocolExtends                   // PROTOCOL P EXTENDS Q
+	extChanType                          // CHAN TYPE bundles
+	extMobile                            // MOBILE data, channels and parameters
+	extForking                           // FORKING and FORK
+	extBarrier                           // BARRIER, SYNC and PAR ... ENROLL
+	extShared                            // SHARED channels and ends, and CLAIM
+	extExtendedInput                     // c ?? x
+)
+
+var extensionNames = map[extension]string{
+	extChanShorthand:    "CHAN without OF",
+	extUntypedVal:       "untyped VAL abbreviation",
+	extRecordKeyword:    "RECORD declaration without DATA TYPE",
+	extValofExpr:        "VALOF expression",
+	extArrayConstructor: "replicated array constructor",
+	extProtocolExtends:  "PROTOCOL EXTENDS",
+	extChanType:         "CHAN TYPE",
+	extMobile:           "MOBILE",
+	extForking:          "FORKING or FORK",
+	extBarrier:          "BARRIER",
+	extShared:           "SHARED or CLAIM",
+	extExtendedInput:    "extended input (??)",
+}
+
+// dialectExtensions lists the extensions each standard dialect accepts:
+// occam2.5 adds VALOF expressions and array constructors to occam2.1, and
+// occam-pi the process-oriented constructs and its shorthands.
+var dialectExtensions = map[Dialect][]extension{
+	DialectOccam21: {},
+	DialectOccam25: {extValofExpr, extArrayConstructor},
+	DialectOccamPi: {
+		extValofExpr, extArrayConstructor, extChanShorthand, extUntypedVal, extProtocolExtends,
+		extChanType, extMobile, extForking, extBarrier, extShared, extExtendedInput,
+	},
+}
+
+// allows reports whether the dialect accepts the given extension.
+func (d Dialect) allows(ext extension) bool {
+	if d == DialectExtended {
+		return true
+	}
+	for _, e := range dialectExtensions[d] {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Option configures a Parser.
+type Option func(*Parser)
+
+// WithDialect restricts the parser to the given language standard.
+func WithDialect(d Dialect) Option {
+	return func(p *Parser) {
+		p.dialect = d
+	}
+}
+
+// WithPermissive makes a statement that fails to parse, with the lines
+// indented below it, an ast.Unsupported stub instead of an error, so that
+// the rest of the program is still parsed and translated. Its first error
+// is moved from Errors to Unsupported.
+func WithPermissive(on bool) Option {
+	return func(p *Parser) {
+		p.permissive = on
+	}
+}
+
+func New(l *lexer.Lexer, opts ...Option) *Parser {
 	p := &Parser{
 		l:             l,
 		errors:        []string{},
@@ -80,19 +226,169 @@ func New(l *lexer.Lexer) *Parser {
 		protocolDefs:  make(map[string]*ast.ProtocolDecl),
 		recordNames:   make(map[string]bool),
 		recordDefs:    make(map[string]*ast.RecordDecl),
+		dataTypes:     make(map[string]bool),
+		chanTypes:     make(map[string]bool),
+		variantTags:   make(map[string]bool),
+		valofSpecs:    make(map[lexer.Token]bool),
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
+	p.prescan(lexer.New(l.Input()))
 	// Read two tokens to initialize curToken and peekToken
 	p.nextToken()
 	p.nextToken()
 	return p
 }
 
+// prescan records the RECORD, DATA TYPE and CHAN TYPE names and the variant
+// PROTOCOL tags declared anywhere in the input, so that declarations,
+// parameters and sends before the type's declaration (as #INCLUDEs may
+// order them) parse as they would after it.
+func (p *Parser) prescan(l *lexer.Lexer) {
+	var toks []lexer.Token
+	for t := l.NextToken(); t.Type != lexer.EOF; t = l.NextToken() {
+		toks = append(toks, t)
+	}
+	at := func(i int, types ...lexer.TokenType) bool {
+		for j, t := range types {
+			if i+j >= len(toks) || toks[i+j].Type != t {
+				return false
+			}
+		}
+		return true
+	}
+	for i := range toks {
+		switch {
+		case at(i, lexer.DATA, lexer.TYPE, lexer.IDENT):
+			name := toks[i+2].Literal
+			p.recordNames[name] = true
+			if at(i+3, lexer.IS) && !at(i+4, lexer.PACKED) && !at(i+4, lexer.RECORD) {
+				p.dataTypes[name] = true
+			}
+		case at(i, lexer.RECORD, lexer.IDENT):
+			p.recordNames[toks[i+1].Literal] = true
+		case at(i, lexer.CHAN, lexer.TYPE, lexer.IDENT):
+			p.recordNames[toks[i+2].Literal] = true
+			p.chanTypes[toks[i+2].Literal] = true
+		case at(i, lexer.PROTOCOL, lexer.IDENT):
+			// PROTOCOL name [EXTENDS base] NEWLINE INDENT CASE NEWLINE INDENT,
+			// then a tag at the start of each line until the matching DEDENT
+			j := i + 2
+			for j < len(toks) && toks[j].Type != lexer.NEWLINE && toks[j].Type != lexer.IS {
+				j++
+			}
+			for at(j, lexer.NEWLINE) {
+				j++
+			}
+			if !at(j, lexer.INDENT, lexer.CASE) {
+				continue
+			}
+			j += 2
+			for at(j, lexer.NEWLINE) {
+				j++
+			}
+			if !at(j, lexer.INDENT) {
+				continue
+			}
+			depth, lineStart := 1, true
+			for j++; j < len(toks) && depth > 0; j++ {
+				switch toks[j].Type {
+				case lexer.INDENT:
+					depth++
+				case lexer.DEDENT:
+					depth--
+				case lexer.NEWLINE:
+					lineStart = true
+					continue
+				case lexer.IDENT:
+					if lineStart && depth == 1 {
+						p.variantTags[toks[j].Literal] = true
+					}
+				}
+				lineStart = false
+			}
+		}
+	}
+
+	// A ( directly holding a ':' opens (spec: VALOF ... ), unless it is
+	// (VALOF itself and the ':' ends a declaration in its body
+	var open []int
+	for i, t := range toks {
+		switch t.Type {
+		case lexer.LPAREN, lexer.LBRACKET:
+			open = append(open, i)
+		case lexer.RPAREN, lexer.RBRACKET:
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		case lexer.COLON:
+			if n := len(open); n > 0 && at(open[n-1], lexer.LPAREN) && !at(open[n-1]+1, lexer.VALOF) {
+				p.valofSpecs[toks[open[n-1]]] = true
+			}
+		}
+	}
+}
+
+// Errors returns the parse errors as "line N:C: msg", N and C being the line
+// and column of the token each was found at ("line N: msg" where no token
+// applies).
 func (p *Parser) Errors() []string {
 	return p.errors
 }
 
+// Unsupported returns the errors of the statements replaced by stubs under
+// WithPermissive, in the form of Errors.
+func (p *Parser) Unsupported() []string {
+	return p.unsupported
+}
+
 func (p *Parser) addError(msg string) {
-	p.errors = append(p.errors, fmt.Sprintf("line %d: %s", p.curToken.Line, msg))
+	p.addErrorAt(p.curToken, msg)
+}
+
+// addErrorAt records an error found at tok, such as an unexpected peekToken.
+func (p *Parser) addErrorAt(tok lexer.Token, msg string) {
+	if p.tooDeep {
+		// Errors raised while unwinding from a nesting overflow are noise
+		return
+	}
+	if tok.Column > 0 {
+		p.errors = append(p.errors, fmt.Sprintf("line %d:%d: %s", tok.Line, tok.Column, msg))
+		return
+	}
+	p.errors = append(p.errors, fmt.Sprintf("line %d: %s", tok.Line, msg))
+}
+
+// parseAsserts parses the run of "--#ASSERT expr" comments on the lines just
+// above line, in source order.
+func (p *Parser) parseAsserts(line int) []*ast.Assert {
+	first := line
+	for first > 1 {
+		if _, ok := p.l.Directive(first-1, "ASSERT"); !ok {
+			break
+		}
+		first--
+	}
+	var asserts []*ast.Assert
+	for n := first; n < line; n++ {
+		text, _ := p.l.Directive(n, "ASSERT")
+		sub := New(lexer.New(text), WithDialect(p.dialect))
+		expr := sub.parseExpression(LOWEST)
+		if len(sub.errors) > 0 || expr == nil || !sub.peekTokenIs(lexer.EOF) {
+			p.errors = append(p.errors, fmt.Sprintf("line %d: invalid ASSERT expression %q", n, text))
+			continue
+		}
+		asserts = append(asserts, &ast.Assert{Text: text, Expr: expr})
+	}
+	return asserts
+}
+
+// checkExtension records an error if the selected dialect does not permit ext.
+func (p *Parser) checkExtension(ext extension) {
+	if !p.dialect.allows(ext) {
+		p.addError(fmt.Sprintf("%s is not permitted by -std %s", extensionNames[ext], p.dialect))
+	}
 }
 
 func (p *Parser) nextToken() {
@@ -120,7 +416,7 @@ func (p *Parser) expectPeek(t lexer.TokenType) bool {
 		p.nextToken()
 		return true
 	}
-	p.addError(fmt.Sprintf("expected %s, got %s", t, p.peekToken.Type))
+	p.addErrorAt(p.peekToken, fmt.Sprintf("expected %s, got %s", t, p.peekToken.Type))
 	return false
 }
 
@@ -143,7 +439,7 @@ func (p *Parser) ParseProgram() *ast.Program {
 	program := &ast.Program{}
 	program.Statements = []ast.Statement{}
 
-	for !p.curTokenIs(lexer.EOF) {
+	for !p.curTokenIs(lexer.EOF) && !p.tooDeep {
 		stmt := p.parseStatement()
 		if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
@@ -154,12 +450,86 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return program
 }
 
+// nestingTooDeep records a single "nesting too deep" error; parsing then
+// unwinds without reporting further errors.
+func (p *Parser) nestingTooDeep() {
+	if !p.tooDeep {
+		p.addError(fmt.Sprintf("nesting too deep (more than %d levels)", maxNestingDepth))
+		p.tooDeep = true
+	}
+}
+
 func (p *Parser) parseStatement() ast.Statement {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxNestingDepth || p.tooDeep {
+		p.nestingTooDeep()
+		return nil
+	}
+
 	// Skip newlines
 	for p.curTokenIs(lexer.NEWLINE) {
 		p.nextToken()
 	}
 
+	if p.permissive {
+		return p.parseOrStub()
+	}
+	return p.parseStatementKind()
+}
+
+// parseOrStub parses a statement under WithPermissive: one raising errors
+// becomes an ast.Unsupported, and parsing resumes after its lines. A
+// statement nested in it that fails is replaced first, so the stub is for
+// the innermost statement that cannot be parsed.
+func (p *Parser) parseOrStub() ast.Statement {
+	start, level, errs := p.curToken, p.indentLevel, len(p.errors)
+	stmt := p.parseStatementKind()
+	if len(p.errors) == errs && p.peekToken.Line == start.Line && !p.peekTokenIs(lexer.NEWLINE) &&
+		!p.peekTokenIs(lexer.INDENT) && !p.peekTokenIs(lexer.DEDENT) && !p.peekTokenIs(lexer.EOF) {
+		// The rest of the line, such as the @@ of n := n @@ 2 or the FROB
+		// of x := 3 FROB 4, is part of it, so the statements that would
+		// otherwise be parsed from there are dropped with it
+		p.nextToken()
+		p.addError(fmt.Sprintf("unexpected token: %s", p.curToken.Type))
+	}
+	if len(p.errors) == errs || p.tooDeep {
+		return stmt
+	}
+	p.unsupported = append(p.unsupported, p.errors[errs])
+	_, reason, _ := strings.Cut(p.errors[errs], ": ")
+	p.errors = p.errors[:errs]
+	p.skipStatement(level)
+
+	// The whole line, in case the statement started part way along it
+	line := start
+	line.Column = 1
+	u := &ast.Unsupported{Token: start, Text: p.l.Source(line, start.Line), Reason: reason}
+	if start.Type == lexer.PROC {
+		name, _, _ := strings.Cut(strings.TrimPrefix(u.Text, "PROC"), "(")
+		u.Proc = strings.TrimSpace(name)
+	}
+	return u
+}
+
+// skipStatement moves past the rest of a statement that failed to parse,
+// which started at indentation level: to the end of its line and of the
+// lines indented below it, and onto the ':' that may end its declaration.
+func (p *Parser) skipStatement(level int) {
+	for !p.curTokenIs(lexer.EOF) {
+		if p.indentLevel <= level && (p.curTokenIs(lexer.DEDENT) || p.curTokenIs(lexer.NEWLINE) && !p.peekTokenIs(lexer.INDENT)) {
+			break
+		}
+		p.nextToken()
+	}
+	if p.curTokenIs(lexer.DEDENT) && p.indentLevel == level && p.peekTokenIs(lexer.COLON) {
+		p.nextToken()
+	}
+}
+
+// parseStatementKind parses the statement starting at curToken, chosen by
+// its first tokens.
+func (p *Parser) parseStatementKind() ast.Statement {
 	switch p.curToken.Type {
 	case lexer.VAL:
 		return p.parseAbbreviation()
@@ -167,20 +537,49 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseInitialDecl()
 	case lexer.INT_TYPE, lexer.BYTE_TYPE, lexer.BOOL_TYPE, lexer.REAL_TYPE, lexer.REAL32_TYPE, lexer.REAL64_TYPE,
 		lexer.INT16_TYPE, lexer.INT32_TYPE, lexer.INT64_TYPE:
-		if p.peekTokenIs(lexer.FUNCTION) || p.peekTokenIs(lexer.FUNC) || p.peekTokenIs(lexer.COMMA) || p.peekTokenIs(lexer.INLINE) {
+		if p.isFuncHeading() {
 			return p.parseFuncDecl()
 		}
 		return p.parseVarDeclOrAbbreviation()
 	case lexer.LBRACKET:
 		return p.parseArrayDecl()
 	case lexer.CHAN:
+		if p.peekTokenIs(lexer.TYPE) {
+			p.checkExtension(extChanType)
+			return p.parseChanTypeDecl()
+		}
 		return p.parseChanDecl()
+	case lexer.SHARED:
+		p.checkExtension(extShared)
+		if p.peekTokenIs(lexer.CHAN) {
+			p.nextToken() // move to CHAN
+			stmt := p.parseChanDecl()
+			if decl, ok := stmt.(*ast.ChanDecl); ok {
+				decl.Shared = true
+			}
+			return stmt
+		}
+		return p.parseChanTypeEndDecl()
+	case lexer.MOBILE:
+		return p.parseMobileDecl()
+	case lexer.CLAIM:
+		return p.parseClaimBlock()
+	case lexer.FORKING:
+		return p.parseForkingBlock()
+	case lexer.FORK:
+		return p.parseForkStmt()
 	case lexer.PROTOCOL:
 		return p.parseProtocolDecl()
 	case lexer.RECORD:
 		return p.parseRecordDecl()
+	case lexer.DATA:
+		return p.parseDataTypeDecl()
 	case lexer.TIMER:
 		return p.parseTimerDecl()
+	case lexer.BARRIER:
+		return p.parseBarrierDecl()
+	case lexer.SYNC:
+		return p.parseSyncStmt()
 	case lexer.SEQ:
 		return p.parseSeqBlock()
 	case lexer.PAR:
@@ -189,6 +588,14 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseAltBlock()
 	case lexer.PRI:
 		return p.parsePriBlock()
+	case lexer.PLACED:
+		if !p.expectPeek(lexer.PAR) {
+			return nil
+		}
+		p.placedPar = true
+		return p.parseParBlock()
+	case lexer.PLACE:
+		return p.parsePlaceDecl()
 	case lexer.SKIP:
 		return &ast.Skip{Token: p.curToken}
 	case lexer.STOP:
@@ -202,6 +609,14 @@ func (p *Parser) parseStatement() ast.Statement {
 	case lexer.CASE:
 		return p.parseCaseStatement()
 	case lexer.IDENT:
+		// FUNCTION returning a DATA TYPE or RECORD: MY.INT FUNCTION f(...)
+		if (p.dataTypes[p.curToken.Literal] || p.recordNames[p.curToken.Literal]) && p.isFuncHeading() {
+			return p.parseFuncDecl()
+		}
+		// CHAN TYPE end declaration: TYPENAME? var: or TYPENAME! var:
+		if p.chanTypes[p.curToken.Literal] && (p.peekTokenIs(lexer.RECEIVE) || p.peekTokenIs(lexer.SEND) || p.peekTokenIs(lexer.IDENT)) {
+			return p.parseChanTypeEndDecl()
+		}
 		// Check for record variable declaration: TYPENAME var:
 		if p.recordNames[p.curToken.Literal] && p.peekTokenIs(lexer.IDENT) {
 			return p.parseRecordVarDecl()
@@ -219,6 +634,9 @@ func (p *Parser) parseStatement() ast.Statement {
 		if p.peekTokenIs(lexer.SEND) {
 			return p.parseSend()
 		}
+		if p.peekTokenIs(lexer.EXTRECEIVE) {
+			return p.parseExtendedInput(p.curToken.Literal, nil, p.curToken)
+		}
 		if p.peekTokenIs(lexer.RECEIVE) {
 			if p.timerNames[p.curToken.Literal] {
 				return p.parseTimerRead()
@@ -236,8 +654,9 @@ func (p *Parser) parseStatement() ast.Statement {
 
 func (p *Parser) parseVarDecl() *ast.VarDecl {
 	decl := &ast.VarDecl{
-		Token: p.curToken,
-		Type:  p.curToken.Literal,
+		Token:   p.curToken,
+		Type:    p.curToken.Literal,
+		TypeRef: p.namedType(),
 	}
 
 	// Parse variable names
@@ -265,7 +684,7 @@ func (p *Parser) parseVarDecl() *ast.VarDecl {
 // or a non-VAL abbreviation (INT x IS expr:). Called when current token is a type keyword.
 func (p *Parser) parseVarDeclOrAbbreviation() ast.Statement {
 	typeToken := p.curToken
-	typeName := p.curToken.Literal
+	t := p.namedType()
 
 	// Consume the name
 	if !p.expectPeek(lexer.IDENT) {
@@ -273,6 +692,11 @@ func (p *Parser) parseVarDeclOrAbbreviation() ast.Statement {
 	}
 	name := p.curToken.Literal
 
+	// INT x RETYPES r: or RESHAPES
+	if p.isRetypes() {
+		return p.finishRetypes(typeToken, false, t, name)
+	}
+
 	// Check if this is an abbreviation (next token is IS)
 	if p.peekTokenIs(lexer.IS) {
 		p.nextToken() // consume IS
@@ -283,20 +707,15 @@ func (p *Parser) parseVarDeclOrAbbreviation() ast.Statement {
 			return nil
 		}
 
-		return &ast.Abbreviation{
-			Token: typeToken,
-			IsVal: false,
-			Type:  typeName,
-			Name:  name,
-			Value: value,
-		}
+		return newAbbreviation(typeToken, false, t, name, value)
 	}
 
 	// Otherwise, it's a regular variable declaration — continue parsing names
 	decl := &ast.VarDecl{
-		Token: typeToken,
-		Type:  typeName,
-		Names: []string{name},
+		Token:   typeToken,
+		Type:    t.Name,
+		Names:   []string{name},
+		TypeRef: t,
 	}
 
 	// Parse additional comma-separated names
@@ -321,6 +740,7 @@ func (p *Parser) parseVarDeclOrAbbreviation() ast.Statement {
 //   VAL x IS expr:              (untyped VAL abbreviation)
 //   VAL INT X RETYPES X :       (RETYPES declaration)
 //   VAL [n]INT X RETYPES X :    (array RETYPES declaration)
+//   VAL []INT flat RESHAPES g : (RESHAPES declaration)
 // Current token is VAL.
 func (p *Parser) parseAbbreviation() ast.Statement {
 	token := p.curToken // VAL token
@@ -328,32 +748,17 @@ func (p *Parser) parseAbbreviation() ast.Statement {
 	p.nextToken()
 
 	// Count bracket dimensions: [] (open) and [n] (fixed) in any combination
-	// e.g. []BYTE = 1 dim, [][2]BYTE = 2 dims, [][]INT = 2 dims, [8]INT = 1 dim (fixed, for RETYPES)
-	dims := 0
-	isFixedArray := false
-	var arraySize ast.Expression
-	for p.curTokenIs(lexer.LBRACKET) {
-		if p.peekTokenIs(lexer.RBRACKET) {
-			// Open dimension: []
-			dims++
-			p.nextToken() // consume ]
-			p.nextToken() // past ]
-		} else {
-			// Fixed dimension: [n]
-			dims++
-			isFixedArray = true
-			p.nextToken() // past [
-			arraySize = p.parseExpression(LOWEST)
-			if !p.expectPeek(lexer.RBRACKET) {
-				return nil
-			}
-			p.nextToken() // past ]
-		}
+	// e.g. []BYTE = 1 dim, [][2]BYTE = 2 dims, [][]INT = 2 dims, [8]INT = 1 dim
+	// (fixed, for RETYPES, which keeps the sizes, nil for open ones)
+	sizes, ok := p.parseArrayDims()
+	if !ok {
+		return nil
 	}
 
 	// Check for untyped VAL abbreviation: VAL name IS expr :
 	// Detect: curToken is IDENT and peekToken is IS (no type keyword)
-	if dims == 0 && p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.IS) {
+	if len(sizes) == 0 && p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.IS) {
+		p.checkExtension(extUntypedVal)
 		name := p.curToken.Literal
 		p.nextToken() // consume IS
 		p.nextToken() // move to expression
@@ -370,12 +775,12 @@ func (p *Parser) parseAbbreviation() ast.Statement {
 		}
 	}
 
-	// Expect a type keyword
-	if !isTypeToken(p.curToken.Type) {
+	// Expect a type keyword, DATA TYPE or record type
+	if !p.curTokenIsDataType() {
 		p.addError(fmt.Sprintf("expected type after VAL, got %s", p.curToken.Type))
 		return nil
 	}
-	typeName := p.curToken.Literal
+	t := ast.ArrayOfSizes(sizes, p.namedType())
 
 	// Expect name
 	if !p.expectPeek(lexer.IDENT) {
@@ -383,25 +788,9 @@ func (p *Parser) parseAbbreviation() ast.Statement {
 	}
 	name := p.curToken.Literal
 
-	// Check for RETYPES (instead of IS)
-	if p.peekTokenIs(lexer.RETYPES) {
-		p.nextToken() // consume RETYPES
-		if !p.expectPeek(lexer.IDENT) {
-			return nil
-		}
-		source := p.curToken.Literal
-		if !p.expectPeek(lexer.COLON) {
-			return nil
-		}
-		return &ast.RetypesDecl{
-			Token:      token,
-			IsVal:      true,
-			TargetType: typeName,
-			IsArray:    isFixedArray,
-			ArraySize:  arraySize,
-			Name:       name,
-			Source:      source,
-		}
+	// Check for RETYPES or RESHAPES (instead of IS)
+	if p.isRetypes() {
+		return p.finishRetypes(token, true, t, name)
 	}
 
 	// Expect IS
@@ -418,13 +807,71 @@ func (p *Parser) parseAbbreviation() ast.Statement {
 		return nil
 	}
 
-	return &ast.Abbreviation{
-		Token:         token,
-		IsVal:         true,
-		OpenArrayDims: dims,
-		Type:          typeName,
-		Name:          name,
-		Value:         value,
+	return newAbbreviation(token, true, t, name, value)
+}
+
+// newAbbreviation returns the abbreviation of value as name, of type t, with
+// the flattened type fields derived from t.
+func newAbbreviation(token lexer.Token, isVal bool, t *ast.TypeRef, name string, value ast.Expression) *ast.Abbreviation {
+	abbr := &ast.Abbreviation{Token: token, IsVal: isVal, Name: name, Value: value, TypeRef: t}
+	dims, elem := t.Dims()
+	abbr.OpenArrayDims = dims
+	if elem.Kind == ast.ChanType {
+		abbr.IsChan = true
+		elem = elem.Elem
+	}
+	abbr.Type = elem.FlatName()
+	return abbr
+}
+
+// parseArrayDims parses the dimensions, [] or [n], of an array type from
+// the current token, leaving the current token after them. It returns the
+// size of each, nil for an open one.
+func (p *Parser) parseArrayDims() ([]ast.Expression, bool) {
+	var sizes []ast.Expression
+	for p.curTokenIs(lexer.LBRACKET) {
+		var size ast.Expression
+		if !p.peekTokenIs(lexer.RBRACKET) {
+			p.nextToken() // past [
+			size = p.parseExpression(LOWEST)
+		}
+		if !p.expectPeek(lexer.RBRACKET) {
+			return nil, false
+		}
+		p.nextToken() // past ]
+		sizes = append(sizes, size)
+	}
+	return sizes, true
+}
+
+// isRetypes reports whether the name just parsed is followed by RETYPES or
+// RESHAPES.
+func (p *Parser) isRetypes() bool {
+	return p.peekTokenIs(lexer.RETYPES) || p.peekTokenIs(lexer.RESHAPES)
+}
+
+// finishRetypes parses the RETYPES expr: or RESHAPES expr: of a declaration
+// of name, of type t, whose name is the current token.
+func (p *Parser) finishRetypes(token lexer.Token, isVal bool, t *ast.TypeRef, name string) ast.Statement {
+	p.nextToken() // move to RETYPES or RESHAPES
+	reshapes := p.curTokenIs(lexer.RESHAPES)
+	p.nextToken() // move to expression
+	source := p.parseExpression(LOWEST)
+
+	if !p.expectPeek(lexer.COLON) {
+		return nil
+	}
+
+	_, elem := t.Dims()
+	return &ast.RetypesDecl{
+		Token:      token,
+		IsVal:      isVal,
+		Reshapes:   reshapes,
+		TargetType: elem.Name,
+		Sizes:      t.Sizes(),
+		Name:       name,
+		Source:     source,
+		TypeRef:    t,
 	}
 }
 
@@ -463,13 +910,9 @@ func (p *Parser) parseInitialDecl() *ast.Abbreviation {
 		return nil
 	}
 
-	return &ast.Abbreviation{
-		Token:     token,
-		IsInitial: true,
-		Type:      typeName,
-		Name:      name,
-		Value:     value,
-	}
+	abbr := newAbbreviation(token, false, ast.Scalar(typeName), name, value)
+	abbr.IsInitial = true
+	return abbr
 }
 
 func (p *Parser) parseAssignment() *ast.Assignment {
@@ -534,6 +977,11 @@ func (p *Parser) parseMultiAssignmentFrom(firstTarget ast.MultiAssignTarget) *as
 func (p *Parser) parseArrayDecl() ast.Statement {
 	lbracketToken := p.curToken
 
+	// Open array abbreviation: []INT row IS grid[i]:
+	if p.peekTokenIs(lexer.RBRACKET) {
+		return p.parseArrayAbbreviation(lbracketToken)
+	}
+
 	// Parse size expression after [
 	p.nextToken()
 	size := p.parseExpression(LOWEST)
@@ -572,20 +1020,19 @@ func (p *Parser) parseArrayDecl() ast.Statement {
 		// Expect OF (optional — CHAN BYTE is shorthand for CHAN OF BYTE)
 		if p.peekTokenIs(lexer.OF) {
 			p.nextToken() // consume OF
+		} else {
+			p.checkExtension(extChanShorthand)
 		}
 
-		// Expect type (INT, BYTE, BOOL, etc.) or protocol name (IDENT)
+		// Expect type (INT, BYTE, BOOL, etc.), protocol name (IDENT) or MOBILE type
 		p.nextToken()
-		if p.curTokenIs(lexer.INT_TYPE) || p.curTokenIs(lexer.BYTE_TYPE) ||
-			p.curTokenIs(lexer.BOOL_TYPE) || p.curTokenIs(lexer.REAL_TYPE) ||
-			p.curTokenIs(lexer.REAL32_TYPE) || p.curTokenIs(lexer.REAL64_TYPE) {
-			chanDecl.ElemType = p.curToken.Literal
-		} else if p.curTokenIs(lexer.IDENT) {
-			chanDecl.ElemType = p.curToken.Literal
-		} else {
+		elem := p.parseChanElemType()
+		if elem == nil {
 			p.addError(fmt.Sprintf("expected type after CHAN, got %s", p.curToken.Type))
 			return nil
 		}
+		chanDecl.ElemType = elem.FlatName()
+		chanDecl.TypeRef = ast.ArrayOfSizes(sizes, ast.ChanOf(elem))
 
 		// Parse channel names
 		for {
@@ -594,6 +1041,11 @@ func (p *Parser) parseArrayDecl() ast.Statement {
 			}
 			chanDecl.Names = append(chanDecl.Names, p.curToken.Literal)
 
+			// Fixed size channel array abbreviation: [3]CHAN OF INT c IS ...:
+			if len(chanDecl.Names) == 1 && p.isChanAbbreviation() {
+				return p.finishChanAbbreviation(lbracketToken, chanDecl.TypeRef, chanDecl.Names[0])
+			}
+
 			if p.peekTokenIs(lexer.COMMA) {
 				p.nextToken() // consume comma
 			} else {
@@ -611,15 +1063,19 @@ func (p *Parser) parseArrayDecl() ast.Statement {
 	// Regular array declaration
 	decl := &ast.ArrayDecl{Token: lbracketToken, Sizes: sizes}
 
-	// Expect type (INT, BYTE, BOOL, REAL, REAL32, REAL64)
+	// Expect type (INT, BYTE, BOOL, REAL, REAL32, REAL64, ...), DATA TYPE
+	// or record type
 	p.nextToken()
-	if !p.curTokenIs(lexer.INT_TYPE) && !p.curTokenIs(lexer.BYTE_TYPE) &&
-		!p.curTokenIs(lexer.BOOL_TYPE) && !p.curTokenIs(lexer.REAL_TYPE) &&
-		!p.curTokenIs(lexer.REAL32_TYPE) && !p.curTokenIs(lexer.REAL64_TYPE) {
+	if p.isArrayFuncHeading() {
+		// [4]INT FUNCTION f(...), returning an array
+		return p.parseFuncDeclFrom(lbracketToken, ast.ArrayOfSizes(sizes, p.namedType()))
+	}
+	if !p.curTokenIsDataType() {
 		p.addError(fmt.Sprintf("expected type after array size, got %s", p.curToken.Type))
 		return nil
 	}
 	decl.Type = p.curToken.Literal
+	decl.TypeRef = ast.ArrayOfSizes(sizes, p.namedType())
 
 	// Parse variable names
 	for {
@@ -628,6 +1084,15 @@ func (p *Parser) parseArrayDecl() ast.Statement {
 		}
 		decl.Names = append(decl.Names, p.curToken.Literal)
 
+		// Fixed size array abbreviation: [4]INT row IS grid[i]:
+		if len(decl.Names) == 1 && p.peekTokenIs(lexer.IS) {
+			return p.finishArrayAbbreviation(lbracketToken, decl.TypeRef, decl.Names[0])
+		}
+		// [4]BYTE b RETYPES word: or RESHAPES
+		if len(decl.Names) == 1 && p.isRetypes() {
+			return p.finishRetypes(lbracketToken, false, decl.TypeRef, decl.Names[0])
+		}
+
 		if p.peekTokenIs(lexer.COMMA) {
 			p.nextToken() // consume comma
 		} else {
@@ -642,6 +1107,118 @@ func (p *Parser) parseArrayDecl() ast.Statement {
 	return decl
 }
 
+// parseArrayAbbreviation parses a non-VAL array abbreviation, which aliases
+// an array, element of an array of arrays, or slice:
+//   []INT row IS grid[i]:
+//   []BYTE line IS [buf FROM 0 FOR n]:
+//   []CHAN OF INT mine IS [links FROM base FOR n]:
+// or, with RETYPES or RESHAPES in place of IS, retypes or reshapes one:
+//   []BYTE bytes RETYPES words:
+// Current token is the first [.
+func (p *Parser) parseArrayAbbreviation(lbracketToken lexer.Token) ast.Statement {
+	// Dimensions, [] or [n]; the sizes of fixed ones are kept only for
+	// RETYPES and RESHAPES
+	sizes, ok := p.parseArrayDims()
+	if !ok {
+		return nil
+	}
+
+	if p.curTokenIs(lexer.CHAN) {
+		if p.peekTokenIs(lexer.OF) {
+			p.nextToken() // consume OF
+		} else {
+			p.checkExtension(extChanShorthand)
+		}
+		p.nextToken()
+		elem := p.parseChanElemType()
+		if elem == nil {
+			p.addError(fmt.Sprintf("expected type after CHAN, got %s", p.curToken.Type))
+			return nil
+		}
+		if !p.expectPeek(lexer.IDENT) {
+			return nil
+		}
+		return p.finishChanAbbreviation(lbracketToken, ast.ArrayOfSizes(sizes, ast.ChanOf(elem)), p.curToken.Literal)
+	}
+
+	if p.isArrayFuncHeading() {
+		// []INT FUNCTION f(...), returning an array
+		return p.parseFuncDeclFrom(lbracketToken, ast.ArrayOfSizes(sizes, p.namedType()))
+	}
+	if !p.curTokenIsDataType() {
+		p.addError(fmt.Sprintf("expected type after [], got %s", p.curToken.Type))
+		return nil
+	}
+	t := ast.ArrayOfSizes(sizes, p.namedType())
+
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	if p.isRetypes() {
+		return p.finishRetypes(lbracketToken, false, t, p.curToken.Literal)
+	}
+	return p.finishArrayAbbreviation(lbracketToken, t, p.curToken.Literal)
+}
+
+// finishArrayAbbreviation parses the IS expr: of a non-VAL array
+// abbreviation of type t whose name is the current token.
+func (p *Parser) finishArrayAbbreviation(lbracketToken lexer.Token, t *ast.TypeRef, name string) ast.Statement {
+	if !p.expectPeek(lexer.IS) {
+		return nil
+	}
+	p.nextToken() // move to expression
+	value := p.parseExpression(LOWEST)
+
+	if !p.expectPeek(lexer.COLON) {
+		return nil
+	}
+
+	return newAbbreviation(lbracketToken, false, t, name, value)
+}
+
+// parseArrayLiteralType parses the element type decoration that may follow
+// an array literal, as in [1, 2, 3](INT32). Current token is the ].
+func (p *Parser) parseArrayLiteralType(al *ast.ArrayLiteral) ast.Expression {
+	if !p.peekTokenIs(lexer.LPAREN) {
+		return al
+	}
+	p.nextToken()
+	p.nextToken()
+	if !isTypeToken(p.curToken.Type) && !(p.curTokenIs(lexer.IDENT) && p.dataTypes[p.curToken.Literal]) {
+		p.addError(fmt.Sprintf("expected type after array literal (, got %s", p.curToken.Type))
+		return nil
+	}
+	al.Type = p.curToken.Literal
+	if !p.expectPeek(lexer.RPAREN) {
+		return nil
+	}
+	return al
+}
+
+// parseArrayConstructor parses the rest of an array constructor
+// [i = start FOR count STEP step | value], current token being the end of
+// start.
+func (p *Parser) parseArrayConstructor(lbracket lexer.Token, variable string, start ast.Expression) ast.Expression {
+	rep := &ast.Replicator{Variable: variable, Start: start}
+	p.nextToken() // consume FOR
+	p.nextToken()
+	rep.Count = p.parseExpression(LOWEST)
+	if p.peekTokenIs(lexer.STEP) {
+		p.nextToken()
+		p.nextToken()
+		rep.Step = p.parseExpression(LOWEST)
+	}
+	if !p.expectPeek(lexer.BAR) {
+		return nil
+	}
+	p.nextToken()
+	value := p.parseExpression(LOWEST)
+	if !p.expectPeek(lexer.RBRACKET) {
+		return nil
+	}
+	return &ast.ArrayConstructor{Token: lbracket, Replicator: rep, Value: value}
+}
+
 // parseSliceAssignment parses [arr FROM start FOR length] := value
 // Also handles [arr FOR length] shorthand (start defaults to 0).
 // Called from parseArrayDecl when FROM or FOR is detected after the array expression.
@@ -689,6 +1266,7 @@ func (p *Parser) parseSliceAssignment(lbracketToken lexer.Token, arrayExpr ast.E
 }
 
 func (p *Parser) parseIndexedOperation() ast.Statement {
+	start := p.curToken
 	name := p.curToken.Literal
 
 	p.nextToken() // move to [
@@ -734,43 +1312,20 @@ func (p *Parser) parseIndexedOperation() ast.Statement {
 	if p.peekTokenIs(lexer.SEND) {
 		// Indexed channel send: cs[i] ! value or cs[i][j] ! value
 		p.nextToken() // move to !
-		sendToken := p.curToken
-		p.nextToken() // move past !
-
 		stmt := &ast.Send{
-			Token:          sendToken,
+			Token:          p.curToken,
 			Channel:        name,
 			ChannelIndices: indices,
 		}
-
-		// Check if this is a variant send: first token is an identifier that is a variant tag
-		if p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.SEMICOLON) {
-			possibleTag := p.curToken.Literal
-			if p.isVariantTag(possibleTag) {
-				stmt.VariantTag = possibleTag
-				p.nextToken() // move to ;
-				for p.curTokenIs(lexer.SEMICOLON) {
-					p.nextToken() // move past ;
-					val := p.parseExpression(LOWEST)
-					stmt.Values = append(stmt.Values, val)
-				}
-				return stmt
-			}
-		}
-
-		stmt.Value = p.parseExpression(LOWEST)
-
-		// Check for sequential send
-		for p.peekTokenIs(lexer.SEMICOLON) {
-			p.nextToken() // move to ;
-			p.nextToken() // move past ;
-			val := p.parseExpression(LOWEST)
-			stmt.Values = append(stmt.Values, val)
-		}
-
+		p.parseSendValues(stmt)
 		return stmt
 	}
 
+	if p.peekTokenIs(lexer.EXTRECEIVE) {
+		// Indexed extended input: cs[i] ?? x
+		return p.parseExtendedInput(name, indices, start)
+	}
+
 	if p.peekTokenIs(lexer.RECEIVE) {
 		// Indexed channel receive: cs[i] ? x or cs[i][j] ? x or cs[i] ? CASE ...
 		p.nextToken() // move to ?
@@ -802,6 +1357,7 @@ func (p *Parser) parseIndexedOperation() ast.Statement {
 				return nil
 			}
 		}
+		stmt.Arrays = addReceiveArray(stmt.Arrays, 0, p.parseReceiveArray())
 
 		// Check for sequential receive
 		for p.peekTokenIs(lexer.SEMICOLON) {
@@ -810,13 +1366,14 @@ func (p *Parser) parseIndexedOperation() ast.Statement {
 				return nil
 			}
 			stmt.Variables = append(stmt.Variables, p.curToken.Literal)
+			stmt.Arrays = addReceiveArray(stmt.Arrays, len(stmt.Variables), p.parseReceiveArray())
 		}
 
 		return stmt
 	}
 
 	// Default: treat as indexed assignment (shouldn't reach here normally)
-	p.addError(fmt.Sprintf("expected :=, !, or ? after %s[...], got %s", name, p.peekToken.Type))
+	p.addErrorAt(p.peekToken, fmt.Sprintf("expected :=, !, or ? after %s[...], got %s", name, p.peekToken.Type))
 	return nil
 }
 
@@ -836,26 +1393,27 @@ func (p *Parser) parseIndexExpression(left ast.Expression) *ast.IndexExpr {
 	return expr
 }
 
-func (p *Parser) parseChanDecl() *ast.ChanDecl {
+// parseChanDecl parses a channel declaration, CHAN OF INT a, b:, or a
+// channel abbreviation, CHAN OF INT c IS links[i]:. Current token is CHAN.
+func (p *Parser) parseChanDecl() ast.Statement {
 	decl := &ast.ChanDecl{Token: p.curToken}
 
 	// Expect OF (optional — CHAN BYTE is shorthand for CHAN OF BYTE)
 	if p.peekTokenIs(lexer.OF) {
 		p.nextToken() // consume OF
+	} else {
+		p.checkExtension(extChanShorthand)
 	}
 
-	// Expect type (INT, BYTE, BOOL, etc.) or protocol name (IDENT)
+	// Expect type (INT, BYTE, BOOL, etc.), protocol name (IDENT) or MOBILE type
 	p.nextToken()
-	if p.curTokenIs(lexer.INT_TYPE) || p.curTokenIs(lexer.BYTE_TYPE) ||
-		p.curTokenIs(lexer.BOOL_TYPE) || p.curTokenIs(lexer.REAL_TYPE) ||
-		p.curTokenIs(lexer.REAL32_TYPE) || p.curTokenIs(lexer.REAL64_TYPE) {
-		decl.ElemType = p.curToken.Literal
-	} else if p.curTokenIs(lexer.IDENT) {
-		decl.ElemType = p.curToken.Literal
-	} else {
+	elem := p.parseChanElemType()
+	if elem == nil {
 		p.addError(fmt.Sprintf("expected type after CHAN, got %s", p.curToken.Type))
 		return nil
 	}
+	decl.ElemType = elem.FlatName()
+	decl.TypeRef = ast.ChanOf(elem)
 
 	// Parse channel names
 	for {
@@ -863,6 +1421,9 @@ func (p *Parser) parseChanDecl() *ast.ChanDecl {
 			return nil
 		}
 		decl.Names = append(decl.Names, p.curToken.Literal)
+		if len(decl.Names) == 1 && p.isChanAbbreviation() {
+			return p.finishChanAbbreviation(decl.Token, decl.TypeRef, decl.Names[0])
+		}
 
 		if p.peekTokenIs(lexer.COMMA) {
 			p.nextToken() // consume comma
@@ -878,6 +1439,39 @@ func (p *Parser) parseChanDecl() *ast.ChanDecl {
 	return decl
 }
 
+// isChanAbbreviation reports whether the channel name just parsed is
+// abbreviated, being followed by IS or a direction.
+func (p *Parser) isChanAbbreviation() bool {
+	return p.peekTokenIs(lexer.IS) || p.peekTokenIs(lexer.SEND) || p.peekTokenIs(lexer.RECEIVE)
+}
+
+// finishChanAbbreviation parses the [?|!] IS expr[?|!]: of a channel or
+// channel array abbreviation of type t whose name is the current token:
+//   CHAN OF INT c IS links[i]:
+//   []CHAN OF INT mine! IS [links FROM base FOR n]:
+// A direction may be given after the name, the channel abbreviated, or both.
+func (p *Parser) finishChanAbbreviation(token lexer.Token, t *ast.TypeRef, name string) ast.Statement {
+	dir := p.parseArgDirection()
+	if !p.expectPeek(lexer.IS) {
+		return nil
+	}
+	p.nextToken() // move to expression
+	value := p.parseExpression(LOWEST)
+	if valueDir := p.parseArgDirection(); dir == "" {
+		dir = valueDir
+	} else if valueDir != "" && valueDir != dir {
+		p.addError(fmt.Sprintf("cannot abbreviate the %s end of a channel as %s%s", valueDir, name, dir))
+	}
+
+	if !p.expectPeek(lexer.COLON) {
+		return nil
+	}
+
+	abbr := newAbbreviation(token, false, t, name, value)
+	abbr.ChanDir = dir
+	return abbr
+}
+
 func (p *Parser) parseProtocolDecl() *ast.ProtocolDecl {
 	decl := &ast.ProtocolDecl{Token: p.curToken}
 
@@ -887,6 +1481,22 @@ func (p *Parser) parseProtocolDecl() *ast.ProtocolDecl {
 	}
 	decl.Name = p.curToken.Literal
 
+	// occam-pi: PROTOCOL NAME EXTENDS BASE, followed by the CASE form
+	var base *ast.ProtocolDecl
+	if p.peekTokenIs(lexer.EXTENDS) {
+		p.nextToken()
+		p.checkExtension(extProtocolExtends)
+		if !p.expectPeek(lexer.IDENT) {
+			return nil
+		}
+		decl.Extends = p.curToken.Literal
+		base = p.protocolDefs[decl.Extends]
+		if base == nil || base.Kind != "variant" {
+			p.addError(fmt.Sprintf("PROTOCOL %s cannot extend %s, which is not a variant PROTOCOL", decl.Name, decl.Extends))
+			base = nil
+		}
+	}
+
 	// Check if this is IS form (simple/sequential) or CASE form (variant)
 	if p.peekTokenIs(lexer.NEWLINE) || p.peekTokenIs(lexer.INDENT) {
 		// Could be variant: PROTOCOL NAME \n INDENT CASE ...
@@ -903,7 +1513,7 @@ func (p *Parser) parseProtocolDecl() *ast.ProtocolDecl {
 			if p.curTokenIs(lexer.CASE) {
 				// Variant protocol
 				decl.Kind = "variant"
-				decl.Variants = p.parseProtocolVariants()
+				decl.Variants = p.parseProtocolVariants(decl.Name, inheritedVariants(base))
 				// Consume remaining DEDENTs back to the level before the INDENT
 				for p.peekTokenIs(lexer.DEDENT) && p.indentLevel > savedLevel {
 					p.nextToken()
@@ -923,27 +1533,31 @@ func (p *Parser) parseProtocolDecl() *ast.ProtocolDecl {
 	}
 
 	// IS form: PROTOCOL NAME IS TYPE [; TYPE]*
+	if decl.Extends != "" {
+		p.addError(fmt.Sprintf("PROTOCOL %s EXTENDS %s must be a variant (CASE) PROTOCOL", decl.Name, decl.Extends))
+	}
 	if !p.expectPeek(lexer.IS) {
 		return nil
 	}
 
 	// Parse type list
 	p.nextToken()
-	typeName := p.parseProtocolTypeName()
-	if typeName == "" {
+	item := p.parseProtocolItem()
+	if item == nil {
 		return nil
 	}
-	decl.Types = append(decl.Types, typeName)
+	decl.Items = append(decl.Items, item)
+	decl.Types = append(decl.Types, item.ItemName())
 
 	// Check for sequential: ; TYPE
 	for p.peekTokenIs(lexer.SEMICOLON) {
 		p.nextToken() // move to ;
 		p.nextToken() // move past ;
-		typeName = p.parseProtocolTypeName()
-		if typeName == "" {
+		if item = p.parseProtocolItem(); item == nil {
 			return nil
 		}
-		decl.Types = append(decl.Types, typeName)
+		decl.Items = append(decl.Items, item)
+		decl.Types = append(decl.Types, item.ItemName())
 	}
 
 	if len(decl.Types) == 1 {
@@ -962,30 +1576,76 @@ func (p *Parser) parseProtocolDecl() *ast.ProtocolDecl {
 	return decl
 }
 
-func (p *Parser) parseProtocolTypeName() string {
-	switch p.curToken.Type {
-	case lexer.INT_TYPE:
-		return "INT"
-	case lexer.BYTE_TYPE:
-		return "BYTE"
-	case lexer.BOOL_TYPE:
-		return "BOOL"
-	case lexer.REAL_TYPE:
-		return "REAL"
-	case lexer.REAL32_TYPE:
-		return "REAL32"
-	case lexer.REAL64_TYPE:
-		return "REAL64"
-	case lexer.IDENT:
-		return p.curToken.Literal
-	default:
-		p.addError(fmt.Sprintf("expected type name in protocol, got %s", p.curToken.Type))
-		return ""
+// inheritedVariants returns the variants a PROTOCOL extending base starts
+// with, marked with the PROTOCOL that declares them.
+func inheritedVariants(base *ast.ProtocolDecl) []ast.ProtocolVariant {
+	if base == nil {
+		return nil
 	}
+	variants := make([]ast.ProtocolVariant, len(base.Variants))
+	for i, v := range base.Variants {
+		if v.From == "" {
+			v.From = base.Name
+		}
+		variants[i] = v
+	}
+	return variants
 }
 
-func (p *Parser) parseProtocolVariants() []ast.ProtocolVariant {
-	var variants []ast.ProtocolVariant
+// parseProtocolItem parses a protocol item type, including a counted
+// array COUNT::[]ELEM, returning nil if there is none.
+func (p *Parser) parseProtocolItem() *ast.TypeRef {
+	if p.curTokenIs(lexer.LBRACKET) {
+		return p.parseProtocolArrayType()
+	}
+	t := p.parseProtocolScalarType()
+	if t == nil || !p.peekTokenIs(lexer.DOUBLECOLON) {
+		return t
+	}
+	p.nextToken() // move to ::
+	if !p.expectPeek(lexer.LBRACKET) || !p.expectPeek(lexer.RBRACKET) {
+		return nil
+	}
+	p.nextToken()
+	elem := p.parseProtocolScalarType()
+	if elem == nil {
+		return nil
+	}
+	return ast.CountedOf(t, elem)
+}
+
+// parseProtocolArrayType parses a fixed-size array protocol item [n]TYPE,
+// whose size is an integer literal or a named constant.
+func (p *Parser) parseProtocolArrayType() *ast.TypeRef {
+	p.nextToken()
+	if !p.curTokenIs(lexer.INT) && !p.curTokenIs(lexer.IDENT) {
+		p.addError(fmt.Sprintf("expected array size in protocol, got %s", p.curToken.Type))
+		return nil
+	}
+	size := p.parseExpression(LOWEST)
+	if !p.expectPeek(lexer.RBRACKET) {
+		return nil
+	}
+	p.nextToken()
+	elem := p.parseProtocolScalarType()
+	if elem == nil {
+		return nil
+	}
+	return ast.ArrayOf(size, elem)
+}
+
+func (p *Parser) parseProtocolScalarType() *ast.TypeRef {
+	if isTypeToken(p.curToken.Type) || p.curTokenIs(lexer.IDENT) {
+		return p.namedType()
+	}
+	p.addError(fmt.Sprintf("expected type name in protocol, got %s", p.curToken.Type))
+	return nil
+}
+
+// parseProtocolVariants parses the tags of the variant PROTOCOL name,
+// appending them to the inherited ones, which they must not redeclare.
+func (p *Parser) parseProtocolVariants(name string, inherited []ast.ProtocolVariant) []ast.ProtocolVariant {
+	variants := inherited
 
 	// Skip to next line after CASE
 	for p.peekTokenIs(lexer.NEWLINE) {
@@ -1042,14 +1702,19 @@ func (p *Parser) parseProtocolVariants() []ast.ProtocolVariant {
 		for p.peekTokenIs(lexer.SEMICOLON) {
 			p.nextToken() // move to ;
 			p.nextToken() // move past ;
-			typeName := p.parseProtocolTypeName()
-			if typeName == "" {
+			item := p.parseProtocolItem()
+			if item == nil {
 				return variants
 			}
-			v.Types = append(v.Types, typeName)
+			v.Items = append(v.Items, item)
+			v.Types = append(v.Types, item.ItemName())
 		}
 
-		variants = append(variants, v)
+		if owner := inheritedFrom(inherited, v.Tag); owner != "" {
+			p.addError(fmt.Sprintf("PROTOCOL %s: tag %s is already declared in PROTOCOL %s", name, v.Tag, owner))
+		} else {
+			variants = append(variants, v)
+		}
 
 		// Advance past newline if needed
 		if !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.DEDENT) && !p.curTokenIs(lexer.EOF) {
@@ -1057,18 +1722,254 @@ func (p *Parser) parseProtocolVariants() []ast.ProtocolVariant {
 		}
 	}
 
-	return variants
+	return variants
+}
+
+func inheritedFrom(inherited []ast.ProtocolVariant, tag string) string {
+	for _, v := range inherited {
+		if v.Tag == tag {
+			return v.From
+		}
+	}
+	return ""
+}
+
+func (p *Parser) parseRecordDecl() *ast.RecordDecl {
+	decl := &ast.RecordDecl{Token: p.curToken}
+	p.checkExtension(extRecordKeyword)
+
+	// Expect record name
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	decl.Name = p.curToken.Literal
+	return p.parseRecordFields(decl)
+}
+
+// parseDataTypeDecl parses DATA TYPE NAME IS TYPE: and the record form
+//
+//	DATA TYPE NAME
+//	  [PACKED] RECORD
+//	    fields
+//	:
+//
+// also accepting DATA TYPE NAME IS [PACKED] RECORD with the fields below.
+func (p *Parser) parseDataTypeDecl() ast.Statement {
+	token := p.curToken
+	if !p.expectPeek(lexer.TYPE) || !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	name := p.curToken.Literal
+
+	if p.peekTokenIs(lexer.IS) {
+		p.nextToken() // consume IS
+		p.nextToken()
+		if p.curTokenIs(lexer.PACKED) || p.curTokenIs(lexer.RECORD) {
+			decl := p.parseDataTypeRecord(token, name)
+			if decl != nil && p.peekTokenIs(lexer.COLON) {
+				p.nextToken()
+			}
+			return decl
+		}
+		if !isTypeToken(p.curToken.Type) && !(p.curTokenIs(lexer.IDENT) && p.dataTypes[p.curToken.Literal]) {
+			p.addError(fmt.Sprintf("DATA TYPE %s must name a primitive type, a DATA TYPE or a RECORD, got %s", name, p.curToken.Literal))
+			return nil
+		}
+		decl := &ast.DataTypeDecl{Token: token, Name: name, Type: p.curToken.Literal}
+		if !p.expectPeek(lexer.COLON) {
+			return nil
+		}
+		p.recordNames[name] = true
+		p.dataTypes[name] = true
+		return decl
+	}
+
+	// Record form: the RECORD is indented under the name
+	for p.peekTokenIs(lexer.NEWLINE) {
+		p.nextToken()
+	}
+	if !p.peekTokenIs(lexer.INDENT) {
+		p.addError(fmt.Sprintf("expected IS or an indented RECORD in DATA TYPE %s", name))
+		return nil
+	}
+	savedLevel := p.indentLevel
+	p.nextToken() // consume INDENT
+	p.nextToken() // move to RECORD
+	decl := p.parseDataTypeRecord(token, name)
+	// Consume remaining DEDENTs back to the level before the INDENT
+	for p.peekTokenIs(lexer.DEDENT) && p.indentLevel > savedLevel {
+		p.nextToken()
+	}
+	if decl != nil && p.peekTokenIs(lexer.COLON) {
+		p.nextToken()
+	}
+	return decl
+}
+
+// parseDataTypeRecord parses [PACKED] RECORD and its fields for DATA TYPE
+// name. PACKED is accepted and ignored: Go chooses the layout.
+func (p *Parser) parseDataTypeRecord(token lexer.Token, name string) *ast.RecordDecl {
+	if p.curTokenIs(lexer.PACKED) {
+		p.nextToken()
+	}
+	if !p.curTokenIs(lexer.RECORD) {
+		p.addError(fmt.Sprintf("expected RECORD in DATA TYPE %s, got %s", name, p.curToken.Type))
+		return nil
+	}
+	decl := &ast.RecordDecl{Token: token, Name: name, DataType: true}
+	return p.parseRecordFields(decl)
+}
+
+// parseChanTypeDecl parses an occam-pi channel bundle type
+//
+//	CHAN TYPE NAME
+//	  MOBILE RECORD
+//	    CHAN INT req?:
+//	    CHAN INT resp!:
+//	:
+//
+// as a RecordDecl whose fields are all CHANs with a direction.
+func (p *Parser) parseChanTypeDecl() ast.Statement {
+	token := p.curToken
+	p.nextToken() // consume TYPE
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	name := p.curToken.Literal
+	for p.peekTokenIs(lexer.NEWLINE) {
+		p.nextToken()
+	}
+	if !p.peekTokenIs(lexer.INDENT) {
+		p.addError(fmt.Sprintf("expected an indented MOBILE RECORD in CHAN TYPE %s", name))
+		return nil
+	}
+	savedLevel := p.indentLevel
+	p.nextToken() // consume INDENT
+	p.nextToken() // move to MOBILE
+	if p.curTokenIs(lexer.MOBILE) {
+		p.nextToken()
+	}
+	if !p.curTokenIs(lexer.RECORD) {
+		p.addError(fmt.Sprintf("expected RECORD in CHAN TYPE %s, got %s", name, p.curToken.Type))
+		return nil
+	}
+	decl := p.parseRecordFields(&ast.RecordDecl{Token: token, Name: name, ChanType: true})
+	// Consume remaining DEDENTs back to the level before the INDENT
+	for p.peekTokenIs(lexer.DEDENT) && p.indentLevel > savedLevel {
+		p.nextToken()
+	}
+	if decl == nil {
+		return nil
+	}
+	if p.peekTokenIs(lexer.COLON) {
+		p.nextToken()
+	}
+	p.chanTypes[name] = true
+	return decl
+}
+
+// parseChanTypeEndDecl parses a declaration of ends of a CHAN TYPE:
+// [SHARED] NAME? x: for the server end or [SHARED] NAME! x: for the client.
+func (p *Parser) parseChanTypeEndDecl() *ast.VarDecl {
+	decl := &ast.VarDecl{Token: p.curToken}
+	if p.curTokenIs(lexer.SHARED) {
+		decl.Shared = true
+		if !p.expectPeek(lexer.IDENT) {
+			return nil
+		}
+	}
+	decl.Type = p.curToken.Literal
+	decl.TypeRef = ast.Named(decl.Type)
+	if !p.chanTypes[decl.Type] {
+		p.addError(fmt.Sprintf("expected a CHAN TYPE after SHARED, got %s", decl.Type))
+		return nil
+	}
+	if !p.peekTokenIs(lexer.RECEIVE) && !p.peekTokenIs(lexer.SEND) {
+		p.addError(fmt.Sprintf("expected ? or ! after CHAN TYPE %s", decl.Type))
+		return nil
+	}
+	p.nextToken()
+	decl.End = p.curToken.Literal
+
+	for {
+		if !p.expectPeek(lexer.IDENT) {
+			return nil
+		}
+		decl.Names = append(decl.Names, p.curToken.Literal)
+		if !p.peekTokenIs(lexer.COMMA) {
+			break
+		}
+		p.nextToken() // consume comma
+	}
+	if !p.expectPeek(lexer.COLON) {
+		return nil
+	}
+	return decl
+}
+
+// parseClaimBlock parses CLAIM name followed by an indented process.
+func (p *Parser) parseClaimBlock() *ast.ClaimBlock {
+	block := &ast.ClaimBlock{Token: p.curToken}
+	p.checkExtension(extShared)
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	block.Name = p.curToken.Literal
+	if p.peekTokenIs(lexer.SEND) || p.peekTokenIs(lexer.RECEIVE) {
+		p.nextToken()
+		block.End = p.curToken.Literal
+	}
+
+	for p.peekTokenIs(lexer.NEWLINE) {
+		p.nextToken()
+	}
+	if !p.peekTokenIs(lexer.INDENT) {
+		p.addError(fmt.Sprintf("expected indented block after CLAIM %s", block.Name))
+		return block
+	}
+	p.nextToken() // consume INDENT
+	p.nextToken() // move to first statement
+
+	block.Body = p.parseBodyStatements()
+	return block
+}
+
+// parseForkingBlock parses FORKING followed by an indented process.
+func (p *Parser) parseForkingBlock() *ast.ForkingBlock {
+	block := &ast.ForkingBlock{Token: p.curToken}
+	p.checkExtension(extForking)
+
+	for p.peekTokenIs(lexer.NEWLINE) {
+		p.nextToken()
+	}
+	if !p.peekTokenIs(lexer.INDENT) {
+		p.addError("expected indented block after FORKING")
+		return block
+	}
+	p.nextToken() // consume INDENT
+	p.nextToken() // move to first statement
+
+	block.Body = p.parseBodyStatements()
+	return block
 }
 
-func (p *Parser) parseRecordDecl() *ast.RecordDecl {
-	decl := &ast.RecordDecl{Token: p.curToken}
-
-	// Expect record name
+// parseForkStmt parses FORK proc(args).
+func (p *Parser) parseForkStmt() *ast.ForkStmt {
+	stmt := &ast.ForkStmt{Token: p.curToken}
+	p.checkExtension(extForking)
 	if !p.expectPeek(lexer.IDENT) {
 		return nil
 	}
-	decl.Name = p.curToken.Literal
+	stmt.Call = p.parseProcCall()
+	if stmt.Call == nil {
+		return nil
+	}
+	return stmt
+}
 
+// parseRecordFields parses the indented field declarations of decl, with
+// the current token on the line before them.
+func (p *Parser) parseRecordFields(decl *ast.RecordDecl) *ast.RecordDecl {
 	// Skip newlines
 	for p.peekTokenIs(lexer.NEWLINE) {
 		p.nextToken()
@@ -1113,10 +2014,21 @@ func (p *Parser) parseRecordDecl() *ast.RecordDecl {
 			break
 		}
 
-		// Expect a type keyword (INT, BYTE, BOOL, REAL, REAL32, REAL64)
-		if !p.curTokenIs(lexer.INT_TYPE) && !p.curTokenIs(lexer.BYTE_TYPE) &&
-			!p.curTokenIs(lexer.BOOL_TYPE) && !p.curTokenIs(lexer.REAL_TYPE) &&
-			!p.curTokenIs(lexer.REAL32_TYPE) && !p.curTokenIs(lexer.REAL64_TYPE) {
+		// Channel field: CHAN OF TYPE name[, name]*:
+		isChan := false
+		if p.curTokenIs(lexer.CHAN) {
+			isChan = true
+			if p.peekTokenIs(lexer.OF) {
+				p.nextToken() // consume OF
+			} else {
+				p.checkExtension(extChanShorthand)
+			}
+			p.nextToken()
+		}
+
+		// Expect a type keyword or DATA TYPE, or a protocol name for a
+		// channel field
+		if !isTypeToken(p.curToken.Type) && !(p.curTokenIs(lexer.IDENT) && (isChan || p.dataTypes[p.curToken.Literal])) {
 			p.addError(fmt.Sprintf("expected type in record field, got %s", p.curToken.Type))
 			return nil
 		}
@@ -1127,10 +2039,21 @@ func (p *Parser) parseRecordDecl() *ast.RecordDecl {
 			if !p.expectPeek(lexer.IDENT) {
 				return nil
 			}
-			decl.Fields = append(decl.Fields, ast.RecordField{
-				Type: fieldType,
-				Name: p.curToken.Literal,
-			})
+			field := ast.RecordField{
+				Type:   fieldType,
+				Name:   p.curToken.Literal,
+				IsChan: isChan,
+			}
+			if decl.ChanType {
+				// CHAN TYPE fields have the direction seen from the ? end
+				if isChan && (p.peekTokenIs(lexer.RECEIVE) || p.peekTokenIs(lexer.SEND)) {
+					p.nextToken()
+					field.Dir = p.curToken.Literal
+				} else {
+					p.addError(fmt.Sprintf("CHAN TYPE %s: field %s must be a CHAN with a direction, %s? or %s!", decl.Name, field.Name, field.Name, field.Name))
+				}
+			}
+			decl.Fields = append(decl.Fields, field)
 
 			if p.peekTokenIs(lexer.COMMA) {
 				p.nextToken() // consume comma
@@ -1155,10 +2078,11 @@ func (p *Parser) parseRecordDecl() *ast.RecordDecl {
 	return decl
 }
 
-func (p *Parser) parseRecordVarDecl() *ast.VarDecl {
+func (p *Parser) parseRecordVarDecl() ast.Statement {
 	decl := &ast.VarDecl{
-		Token: p.curToken,
-		Type:  p.curToken.Literal,
+		Token:   p.curToken,
+		Type:    p.curToken.Literal,
+		TypeRef: ast.Named(p.curToken.Literal),
 	}
 
 	// Parse variable names
@@ -1167,6 +2091,10 @@ func (p *Parser) parseRecordVarDecl() *ast.VarDecl {
 			return nil
 		}
 		decl.Names = append(decl.Names, p.curToken.Literal)
+		// POINT p RETYPES bytes: or RESHAPES
+		if len(decl.Names) == 1 && p.isRetypes() {
+			return p.finishRetypes(decl.Token, false, decl.TypeRef, decl.Names[0])
+		}
 
 		if p.peekTokenIs(lexer.COMMA) {
 			p.nextToken() // consume comma
@@ -1182,6 +2110,127 @@ func (p *Parser) parseRecordVarDecl() *ast.VarDecl {
 	return decl
 }
 
+// parseMobileDecl parses an occam-pi MOBILE data declaration: MOBILE INT x:,
+// MOBILE [n]BYTE a:, or MOBILE []BYTE buf:, whose array is allocated later
+// by buf := MOBILE [n]BYTE.
+func (p *Parser) parseMobileDecl() ast.Statement {
+	p.checkExtension(extMobile)
+	p.nextToken() // move past MOBILE
+	switch {
+	case p.curTokenIs(lexer.LBRACKET) && p.peekTokenIs(lexer.RBRACKET):
+		decl := &ast.ArrayDecl{Token: p.curToken, Sizes: []ast.Expression{nil}, Mobile: true}
+		p.nextToken() // move to ]
+		p.nextToken() // move past ]
+		if p.curTokenIs(lexer.LBRACKET) {
+			p.addError("MOBILE arrays have one dimension")
+			return nil
+		}
+		if !isTypeToken(p.curToken.Type) && !(p.curTokenIs(lexer.IDENT) && p.dataTypes[p.curToken.Literal]) {
+			p.addError(fmt.Sprintf("expected type after MOBILE [], got %s", p.curToken.Type))
+			return nil
+		}
+		decl.Type = p.curToken.Literal
+		decl.TypeRef = ast.ArrayOf(nil, p.namedType())
+		decl.TypeRef.Mobile = true
+		for {
+			if !p.expectPeek(lexer.IDENT) {
+				return nil
+			}
+			decl.Names = append(decl.Names, p.curToken.Literal)
+			if !p.peekTokenIs(lexer.COMMA) {
+				break
+			}
+			p.nextToken() // consume comma
+		}
+		if !p.expectPeek(lexer.COLON) {
+			return nil
+		}
+		return decl
+	case p.curTokenIs(lexer.LBRACKET):
+		stmt := p.parseArrayDecl()
+		if decl, ok := stmt.(*ast.ArrayDecl); ok {
+			decl.Mobile = true
+			decl.TypeRef.Mobile = true
+			return decl
+		}
+		if stmt != nil {
+			p.addError("expected an array declaration after MOBILE")
+		}
+	case isTypeToken(p.curToken.Type):
+		stmt := p.parseVarDeclOrAbbreviation()
+		if decl, ok := stmt.(*ast.VarDecl); ok {
+			decl.Mobile = true
+			decl.TypeRef.Mobile = true
+			return decl
+		}
+		if stmt != nil {
+			p.addError("expected a variable declaration after MOBILE")
+		}
+	case p.curTokenIs(lexer.IDENT) && p.recordNames[p.curToken.Literal] && !p.chanTypes[p.curToken.Literal]:
+		stmt := p.parseRecordVarDecl()
+		if decl, ok := stmt.(*ast.VarDecl); ok {
+			decl.Mobile = true
+			decl.TypeRef.Mobile = true
+			return decl
+		}
+		if stmt != nil {
+			p.addError("expected a variable declaration after MOBILE")
+		}
+	default:
+		p.addError(fmt.Sprintf("MOBILE %s is not supported: only MOBILE data can be declared", p.curToken.Literal))
+	}
+	return nil
+}
+
+// parseChanElemType parses the element type of a channel at the current
+// token: a type, PROTOCOL or RECORD name, optionally occam-pi MOBILE, in
+// which case it may be an array (CHAN MOBILE []BYTE). It returns "" if
+// there is none.
+func (p *Parser) parseChanElemType() *ast.TypeRef {
+	if !p.curTokenIs(lexer.MOBILE) {
+		if isTypeToken(p.curToken.Type) || p.curTokenIs(lexer.IDENT) {
+			return p.namedType()
+		}
+		return nil
+	}
+	p.checkExtension(extMobile)
+	p.nextToken() // move past MOBILE
+	open := false
+	if p.curTokenIs(lexer.LBRACKET) && p.peekTokenIs(lexer.RBRACKET) {
+		open = true
+		p.nextToken() // move to ]
+		p.nextToken() // move past ]
+	}
+	if !isTypeToken(p.curToken.Type) && !p.curTokenIs(lexer.IDENT) {
+		return nil
+	}
+	t := p.namedType()
+	if open {
+		t = ast.ArrayOf(nil, t)
+	}
+	t.Mobile = true
+	return t
+}
+
+// curTokenIsDataType reports whether the current token names a type of data:
+// a primitive type, a DATA TYPE or a record type (not a CHAN TYPE).
+func (p *Parser) curTokenIsDataType() bool {
+	if isTypeToken(p.curToken.Type) {
+		return true
+	}
+	name := p.curToken.Literal
+	return p.curTokenIs(lexer.IDENT) && (p.dataTypes[name] || p.recordNames[name] && !p.chanTypes[name])
+}
+
+// namedType returns the type named by the current token: a primitive type,
+// or a RECORD, DATA TYPE, PROTOCOL or CHAN TYPE name.
+func (p *Parser) namedType() *ast.TypeRef {
+	if p.curTokenIs(lexer.IDENT) {
+		return ast.Named(p.curToken.Literal)
+	}
+	return ast.Scalar(p.curToken.Literal)
+}
+
 func (p *Parser) parseTimerDecl() *ast.TimerDecl {
 	decl := &ast.TimerDecl{Token: p.curToken}
 
@@ -1207,6 +2256,42 @@ func (p *Parser) parseTimerDecl() *ast.TimerDecl {
 	return decl
 }
 
+func (p *Parser) parseBarrierDecl() *ast.BarrierDecl {
+	decl := &ast.BarrierDecl{Token: p.curToken}
+	p.checkExtension(extBarrier)
+	decl.Names = p.parseNameList()
+	if decl.Names == nil || !p.expectPeek(lexer.COLON) {
+		return nil
+	}
+	return decl
+}
+
+// parseNameList parses the comma-separated names after the current token,
+// leaving curToken on the last one; nil if there is not at least one.
+func (p *Parser) parseNameList() []string {
+	var names []string
+	for {
+		if !p.expectPeek(lexer.IDENT) {
+			return nil
+		}
+		names = append(names, p.curToken.Literal)
+		if !p.peekTokenIs(lexer.COMMA) {
+			return names
+		}
+		p.nextToken() // consume comma
+	}
+}
+
+func (p *Parser) parseSyncStmt() *ast.SyncStmt {
+	stmt := &ast.SyncStmt{Token: p.curToken}
+	p.checkExtension(extBarrier)
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	stmt.Barrier = p.curToken.Literal
+	return stmt
+}
+
 func (p *Parser) parseTimerRead() ast.Statement {
 	timerName := p.curToken.Literal
 
@@ -1245,7 +2330,14 @@ func (p *Parser) parseSend() *ast.Send {
 
 	p.nextToken() // move to !
 	stmt.Token = p.curToken
+	p.parseSendValues(stmt)
+	return stmt
+}
 
+// parseSendValues parses what is sent by stmt, from its ! on: a value, the
+// values of a sequential protocol (c ! x ; y), or a variant tag and its
+// values (c ! tag ; x).
+func (p *Parser) parseSendValues(stmt *ast.Send) {
 	p.nextToken() // move past !
 
 	// Check if this is a variant send: first token is an identifier that is a variant tag
@@ -1265,37 +2357,68 @@ func (p *Parser) parseSend() *ast.Send {
 			// Parse remaining values after the tag
 			for p.curTokenIs(lexer.SEMICOLON) {
 				p.nextToken() // move past ;
-				val := p.parseExpression(LOWEST)
+				val := p.parseSendItem()
 				stmt.Values = append(stmt.Values, val)
+				if p.peekTokenIs(lexer.SEMICOLON) {
+					p.nextToken() // move to next ;
+				}
 			}
-			return stmt
+			return
 		}
 	}
 
-	stmt.Value = p.parseExpression(LOWEST)
+	stmt.Value = p.parseSendItem()
 
 	// Check for sequential send: c ! expr ; expr ; ...
 	for p.peekTokenIs(lexer.SEMICOLON) {
 		p.nextToken() // move to ;
 		p.nextToken() // move past ;
-		val := p.parseExpression(LOWEST)
+		val := p.parseSendItem()
 		stmt.Values = append(stmt.Values, val)
 	}
+}
 
-	return stmt
+// parseSendItem parses one item of a send: an expression, or a counted
+// array n :: arr.
+func (p *Parser) parseSendItem() ast.Expression {
+	val := p.parseExpression(LOWEST)
+	if !p.peekTokenIs(lexer.DOUBLECOLON) {
+		return val
+	}
+	p.nextToken() // move to ::
+	item := &ast.CountedArrayExpr{Token: p.curToken, Count: val}
+	p.nextToken() // move past ::
+	item.Array = p.parseExpression(LOWEST)
+	return item
 }
 
-func (p *Parser) isVariantTag(name string) bool {
-	for _, proto := range p.protocolDefs {
-		if proto.Kind == "variant" {
-			for _, v := range proto.Variants {
-				if v.Tag == name {
-					return true
-				}
-			}
-		}
+// parseReceiveArray parses the ":: arr" of a counted array receive item, if
+// present, returning the array name or "".
+func (p *Parser) parseReceiveArray() string {
+	if !p.peekTokenIs(lexer.DOUBLECOLON) {
+		return ""
 	}
-	return false
+	p.nextToken() // move to ::
+	if !p.expectPeek(lexer.IDENT) {
+		return ""
+	}
+	return p.curToken.Literal
+}
+
+// addReceiveArray records the counted array (or "") of the n'th received
+// variable, keeping arrays nil until a counted item is seen.
+func addReceiveArray(arrays []string, n int, arr string) []string {
+	if arr == "" && arrays == nil {
+		return nil
+	}
+	for len(arrays) < n {
+		arrays = append(arrays, "")
+	}
+	return append(arrays, arr)
+}
+
+func (p *Parser) isVariantTag(name string) bool {
+	return p.variantTags[name]
 }
 
 func (p *Parser) parseReceive() ast.Statement {
@@ -1329,6 +2452,7 @@ func (p *Parser) parseReceive() ast.Statement {
 			return nil
 		}
 	}
+	stmt.Arrays = addReceiveArray(stmt.Arrays, 0, p.parseReceiveArray())
 
 	// Check for sequential receive: c ? x ; y ; z
 	for p.peekTokenIs(lexer.SEMICOLON) {
@@ -1337,6 +2461,7 @@ func (p *Parser) parseReceive() ast.Statement {
 			return nil
 		}
 		stmt.Variables = append(stmt.Variables, p.curToken.Literal)
+		stmt.Arrays = addReceiveArray(stmt.Arrays, len(stmt.Variables), p.parseReceiveArray())
 	}
 
 	return stmt
@@ -1394,15 +2519,18 @@ func (p *Parser) parseVariantReceive(channel string, token lexer.Token) *ast.Var
 		prevToken := p.curToken
 		prevPeek := p.peekToken
 
-		// Parse a variant case: tag [; var]* \n INDENT body
-		vc := ast.VariantCase{}
+		// Parse a variant case: [decl]* tag [; var]* \n INDENT body
+		vc := ast.VariantCase{Declarations: p.parseVariantDeclarations()}
 
-		if !p.curTokenIs(lexer.IDENT) {
+		if p.curTokenIs(lexer.ELSE) {
+			vc.IsElse = true
+		} else if !p.curTokenIs(lexer.IDENT) {
 			p.addError(fmt.Sprintf("expected variant tag name, got %s", p.curToken.Type))
 			p.nextToken() // skip unrecognized token to avoid infinite loop
 			continue
+		} else {
+			vc.Tag = p.curToken.Literal
 		}
-		vc.Tag = p.curToken.Literal
 
 		// Parse optional variables after semicolons: tag ; x ; y
 		for p.peekTokenIs(lexer.SEMICOLON) {
@@ -1411,6 +2539,7 @@ func (p *Parser) parseVariantReceive(channel string, token lexer.Token) *ast.Var
 				return stmt
 			}
 			vc.Variables = append(vc.Variables, p.curToken.Literal)
+			vc.Arrays = addReceiveArray(vc.Arrays, len(vc.Variables)-1, p.parseReceiveArray())
 		}
 
 		// Skip newlines and expect INDENT for body
@@ -1438,6 +2567,28 @@ func (p *Parser) parseVariantReceive(channel string, token lexer.Token) *ast.Var
 	return stmt
 }
 
+// parseVariantDeclarations parses the specifications that may precede a
+// variant's tag in a ? CASE, scoped to that variant (e.g., INT n:).
+func (p *Parser) parseVariantDeclarations() []ast.Statement {
+	var decls []ast.Statement
+	for p.isAltDeclStart() || (p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.IDENT) &&
+		(p.recordNames[p.curToken.Literal] || p.dataTypes[p.curToken.Literal])) {
+		stmt := p.parseStatement()
+		if stmt != nil {
+			decls = append(decls, stmt)
+		}
+		// Advance past the end of the declaration
+		if !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.DEDENT) && !p.curTokenIs(lexer.EOF) {
+			p.nextToken()
+		}
+		// Skip newlines to reach the tag
+		for p.curTokenIs(lexer.NEWLINE) {
+			p.nextToken()
+		}
+	}
+	return decls
+}
+
 func (p *Parser) parseVariantReceiveWithIndex(channel string, channelIndices []ast.Expression, token lexer.Token) *ast.VariantReceive {
 	stmt := &ast.VariantReceive{
 		Token:          token,
@@ -1487,14 +2638,17 @@ func (p *Parser) parseVariantReceiveWithIndex(channel string, channelIndices []a
 		prevToken := p.curToken
 		prevPeek := p.peekToken
 
-		vc := ast.VariantCase{}
+		vc := ast.VariantCase{Declarations: p.parseVariantDeclarations()}
 
-		if !p.curTokenIs(lexer.IDENT) {
+		if p.curTokenIs(lexer.ELSE) {
+			vc.IsElse = true
+		} else if !p.curTokenIs(lexer.IDENT) {
 			p.addError(fmt.Sprintf("expected variant tag name, got %s", p.curToken.Type))
 			p.nextToken() // skip unrecognized token to avoid infinite loop
 			continue
+		} else {
+			vc.Tag = p.curToken.Literal
 		}
-		vc.Tag = p.curToken.Literal
 
 		for p.peekTokenIs(lexer.SEMICOLON) {
 			p.nextToken() // move to ;
@@ -1502,6 +2656,7 @@ func (p *Parser) parseVariantReceiveWithIndex(channel string, channelIndices []a
 				return stmt
 			}
 			vc.Variables = append(vc.Variables, p.curToken.Literal)
+			vc.Arrays = addReceiveArray(vc.Arrays, len(vc.Variables)-1, p.parseReceiveArray())
 		}
 
 		for p.peekTokenIs(lexer.NEWLINE) {
@@ -1565,6 +2720,8 @@ func (p *Parser) parseSeqBlock() *ast.SeqBlock {
 
 func (p *Parser) parseParBlock() *ast.ParBlock {
 	block := &ast.ParBlock{Token: p.curToken}
+	placed := p.placedPar
+	p.placedPar = false
 
 	// Check for replicator: PAR i = start FOR count
 	if p.peekTokenIs(lexer.IDENT) {
@@ -1581,6 +2738,16 @@ func (p *Parser) parseParBlock() *ast.ParBlock {
 		}
 	}
 
+	// PAR [replicator] ENROLL b, c
+	if p.peekTokenIs(lexer.ENROLL) {
+		p.nextToken() // move to ENROLL
+		p.checkExtension(extBarrier)
+		block.Enroll = p.parseNameList()
+		if block.Enroll == nil {
+			return block
+		}
+	}
+
 	// Skip to next line
 	for p.peekTokenIs(lexer.NEWLINE) {
 		p.nextToken()
@@ -1593,11 +2760,100 @@ func (p *Parser) parseParBlock() *ast.ParBlock {
 	}
 	p.nextToken() // consume INDENT
 
+	if placed {
+		p.parseProcessors(block)
+		return block
+	}
 	block.Statements = p.parseBlockStatements()
 
 	return block
 }
 
+// parseProcessors parses the PROCESSOR n TYPE branches of a PLACED PAR into
+// its statements, each a single process or a SEQ of a branch's declarations
+// and process. Called with curToken on the block's INDENT.
+func (p *Parser) parseProcessors(block *ast.ParBlock) {
+	startLevel := p.indentLevel
+
+	p.nextToken() // move past INDENT
+
+	for !p.curTokenIs(lexer.EOF) {
+		for p.curTokenIs(lexer.NEWLINE) {
+			p.nextToken()
+		}
+
+		for p.curTokenIs(lexer.DEDENT) {
+			if p.indentLevel < startLevel {
+				return
+			}
+			p.nextToken()
+		}
+
+		for p.curTokenIs(lexer.NEWLINE) {
+			p.nextToken()
+		}
+
+		if p.curTokenIs(lexer.EOF) || p.indentLevel < startLevel {
+			return
+		}
+
+		if !p.curTokenIs(lexer.PROCESSOR) {
+			p.addError(fmt.Sprintf("expected PROCESSOR in PLACED PAR, got %s", p.curToken.Type))
+			return
+		}
+		proc := &ast.Processor{Token: p.curToken}
+		p.nextToken()
+		proc.Number = p.parseExpression(LOWEST)
+		if !p.expectPeek(lexer.IDENT) {
+			return
+		}
+		proc.Type = p.curToken.Literal
+
+		for p.peekTokenIs(lexer.NEWLINE) {
+			p.nextToken()
+		}
+		if !p.peekTokenIs(lexer.INDENT) {
+			p.addError("expected indented process after PROCESSOR")
+			return
+		}
+		p.nextToken() // consume INDENT
+		p.nextToken() // move to body
+		body := p.parseBodyStatements()
+		var stmt ast.Statement = &ast.SeqBlock{Token: proc.Token, Statements: body}
+		if len(body) == 1 {
+			stmt = body[0]
+		}
+		block.Statements = append(block.Statements, stmt)
+		block.Processors = append(block.Processors, proc)
+
+		if !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.DEDENT) && !p.curTokenIs(lexer.EOF) {
+			p.nextToken()
+		}
+	}
+}
+
+// parsePlaceDecl parses PLACE name AT address:
+func (p *Parser) parsePlaceDecl() *ast.PlaceDecl {
+	decl := &ast.PlaceDecl{Token: p.curToken}
+
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	decl.Name = p.curToken.Literal
+
+	if !p.expectPeek(lexer.AT) {
+		return nil
+	}
+	p.nextToken()
+	decl.Address = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(lexer.COLON) {
+		return nil
+	}
+
+	return decl
+}
+
 // parseReplicator parses: variable = start FOR count [STEP step]
 // Assumes the variable identifier has already been consumed and is in curToken
 func (p *Parser) parseReplicator() *ast.Replicator {
@@ -1647,7 +2903,7 @@ func (p *Parser) parsePriBlock() ast.Statement {
 		block.Priority = true
 		return block
 	}
-	p.addError(fmt.Sprintf("expected ALT or PAR after PRI, got %s", p.peekToken.Type))
+	p.addErrorAt(p.peekToken, fmt.Sprintf("expected ALT or PAR after PRI, got %s", p.peekToken.Type))
 	return nil
 }
 
@@ -1734,6 +2990,74 @@ func (p *Parser) parseAltCases() []ast.AltCase {
 	return cases
 }
 
+// parseAltChannelOp parses the channel operation of an ALT case on
+// altCase.Channel, from the token before its !, ? or ?? on: an output guard,
+// whose Send starts the case's body, or an input.
+func (p *Parser) parseAltChannelOp(altCase *ast.AltCase, start lexer.Token) bool {
+	if p.peekTokenIs(lexer.SEND) {
+		p.nextToken() // move to !
+		send := &ast.Send{Token: p.curToken, Channel: altCase.Channel, ChannelIndices: altCase.ChannelIndices}
+		p.parseSendValues(send)
+		altCase.IsOutput = true
+		altCase.Body = []ast.Statement{send}
+		return true
+	}
+	if p.peekTokenIs(lexer.EXTRECEIVE) {
+		p.nextToken() // move to ??
+	} else if !p.expectPeek(lexer.RECEIVE) {
+		return false
+	}
+	return p.parseAltInput(altCase, start)
+}
+
+// parseAltInput parses the input of an ALT case on altCase.Channel, from
+// its ? (or the ?? of an extended input) on: a variable, which may be
+// subscripted, then for a sequential protocol the further variables
+// (c ? x ; y), or CASE and the variants of a variant protocol (c ? CASE),
+// which take the place of the case's body. The case's source text starts at
+// start.
+func (p *Parser) parseAltInput(altCase *ast.AltCase, start lexer.Token) bool {
+	recvToken := p.curToken
+	altCase.Extended = p.curTokenIs(lexer.EXTRECEIVE)
+	if altCase.Extended {
+		p.checkExtension(extExtendedInput)
+	}
+	if altCase.Extended && p.peekTokenIs(lexer.CASE) {
+		p.addErrorAt(p.peekToken, "extended input of a variant protocol (?? CASE) is not supported")
+		return false
+	}
+	if p.peekTokenIs(lexer.CASE) {
+		p.nextToken() // move to CASE
+		altCase.Text = p.l.Source(start, p.curToken.Line)
+		altCase.IsVariant = true
+		altCase.Body = []ast.Statement{p.parseVariantReceiveWithIndex(altCase.Channel, altCase.ChannelIndices, recvToken)}
+		return true
+	}
+	if !p.expectPeek(lexer.IDENT) {
+		return false
+	}
+	altCase.Variable = p.curToken.Literal
+	// Collect variable indices: ch ? flags[0]
+	for p.peekTokenIs(lexer.LBRACKET) {
+		p.nextToken() // move to [
+		p.nextToken() // move past [
+		altCase.VariableIndices = append(altCase.VariableIndices, p.parseExpression(LOWEST))
+		if !p.expectPeek(lexer.RBRACKET) {
+			return false
+		}
+	}
+	altCase.Arrays = addReceiveArray(altCase.Arrays, 0, p.parseReceiveArray())
+	for p.peekTokenIs(lexer.SEMICOLON) {
+		p.nextToken() // move to ;
+		if !p.expectPeek(lexer.IDENT) {
+			return false
+		}
+		altCase.Variables = append(altCase.Variables, p.curToken.Literal)
+		altCase.Arrays = addReceiveArray(altCase.Arrays, len(altCase.Variables), p.parseReceiveArray())
+	}
+	return true
+}
+
 func (p *Parser) isAltDeclStart() bool {
 	switch p.curToken.Type {
 	case lexer.INT_TYPE, lexer.BYTE_TYPE, lexer.BOOL_TYPE, lexer.REAL_TYPE, lexer.REAL32_TYPE, lexer.REAL64_TYPE,
@@ -1743,6 +3067,9 @@ func (p *Parser) isAltDeclStart() bool {
 		return true
 	case lexer.INITIAL:
 		return true
+	case lexer.LBRACKET:
+		// Array declaration: [n]TYPE name:
+		return true
 	}
 	return false
 }
@@ -1770,6 +3097,26 @@ func (p *Parser) parseAltCase() *ast.AltCase {
 	// or: channel ? var (no guard)
 	// or: guard & SKIP
 
+	start := p.curToken
+
+	// A nested ALT: ALT i = 0 FOR n (or PRI ALT) and its alternatives
+	if p.curTokenIs(lexer.ALT) || p.curTokenIs(lexer.PRI) && p.peekTokenIs(lexer.ALT) {
+		if len(altCase.Declarations) > 0 {
+			p.addError("declarations before a nested ALT are not supported")
+			return nil
+		}
+		altCase.IsAlt = true
+		altCase.Text = p.l.Source(start, start.Line)
+		priority := p.curTokenIs(lexer.PRI)
+		if priority {
+			p.nextToken() // move to ALT
+		}
+		nested := p.parseAltBlock()
+		nested.Priority = priority
+		altCase.Body = []ast.Statement{nested}
+		return altCase
+	}
+
 	// First token should be identifier, TRUE/FALSE, or ( for guard expression
 	if !p.curTokenIs(lexer.IDENT) && !p.curTokenIs(lexer.TRUE) && !p.curTokenIs(lexer.FALSE) && !p.curTokenIs(lexer.LPAREN) {
 		p.addError(fmt.Sprintf("expected channel name or guard in ALT case, got %s", p.curToken.Type))
@@ -1780,9 +3127,9 @@ func (p *Parser) parseAltCase() *ast.AltCase {
 	// If current is ( then it must be a guard expression
 	// If next token is & then we have a guard
 	// If next token is ? then it's a channel/timer receive
-	if p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.RECEIVE) {
+	if p.curTokenIs(lexer.IDENT) && (p.peekTokenIs(lexer.RECEIVE) || p.peekTokenIs(lexer.EXTRECEIVE) || p.peekTokenIs(lexer.SEND)) {
 		name := p.curToken.Literal
-		if p.timerNames[name] {
+		if p.timerNames[name] && p.peekTokenIs(lexer.RECEIVE) {
 			// Timer case: tim ? AFTER deadline
 			altCase.IsTimer = true
 			altCase.Timer = name
@@ -1793,21 +3140,10 @@ func (p *Parser) parseAltCase() *ast.AltCase {
 			p.nextToken() // move past AFTER
 			altCase.Deadline = p.parseExpression(LOWEST)
 		} else {
-			// Simple case: channel ? var or channel ? var[i]
-			altCase.Channel = name
-			p.nextToken() // move to ?
-			if !p.expectPeek(lexer.IDENT) {
-				return nil
-			}
-			altCase.Variable = p.curToken.Literal
-			// Collect variable indices: ch ? flags[0]
-			for p.peekTokenIs(lexer.LBRACKET) {
-				p.nextToken() // move to [
-				p.nextToken() // move past [
-				altCase.VariableIndices = append(altCase.VariableIndices, p.parseExpression(LOWEST))
-				if !p.expectPeek(lexer.RBRACKET) {
-					return nil
-				}
+			// Simple case: channel ? var, channel ? var[i] or channel ! value
+			altCase.Channel = name
+			if !p.parseAltChannelOp(altCase, start) {
+				return nil
 			}
 		}
 	} else if p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.LBRACKET) {
@@ -1822,22 +3158,9 @@ func (p *Parser) parseAltCase() *ast.AltCase {
 				return nil
 			}
 		}
-		if !p.expectPeek(lexer.RECEIVE) {
-			return nil
-		}
-		if !p.expectPeek(lexer.IDENT) {
+		if !p.parseAltChannelOp(altCase, start) {
 			return nil
 		}
-		altCase.Variable = p.curToken.Literal
-		// Collect variable indices: cs[i] ? flags[0]
-		for p.peekTokenIs(lexer.LBRACKET) {
-			p.nextToken() // move to [
-			p.nextToken() // move past [
-			altCase.VariableIndices = append(altCase.VariableIndices, p.parseExpression(LOWEST))
-			if !p.expectPeek(lexer.RBRACKET) {
-				return nil
-			}
-		}
 	} else {
 		// Guard followed by & channel ? var, or guard & SKIP
 		guard := p.parseExpression(LOWEST)
@@ -1854,6 +3177,16 @@ func (p *Parser) parseAltCase() *ast.AltCase {
 		if p.curTokenIs(lexer.SKIP) {
 			// Guarded SKIP: guard & SKIP
 			altCase.IsSkip = true
+		} else if p.curTokenIs(lexer.IDENT) && p.timerNames[p.curToken.Literal] && p.peekTokenIs(lexer.RECEIVE) {
+			// Guarded timer case: guard & tim ? AFTER deadline
+			altCase.IsTimer = true
+			altCase.Timer = p.curToken.Literal
+			p.nextToken() // move to ?
+			if !p.expectPeek(lexer.AFTER) {
+				return nil
+			}
+			p.nextToken() // move past AFTER
+			altCase.Deadline = p.parseExpression(LOWEST)
 		} else if !p.curTokenIs(lexer.IDENT) {
 			p.addError(fmt.Sprintf("expected channel name or SKIP after guard, got %s", p.curToken.Type))
 			return nil
@@ -1871,24 +3204,24 @@ func (p *Parser) parseAltCase() *ast.AltCase {
 				}
 			}
 
-			if !p.expectPeek(lexer.RECEIVE) {
-				return nil
-			}
-			if !p.expectPeek(lexer.IDENT) {
+			if !p.parseAltChannelOp(altCase, start) {
 				return nil
 			}
-			altCase.Variable = p.curToken.Literal
-			// Collect variable indices: guard & ch ? flags[0]
-			for p.peekTokenIs(lexer.LBRACKET) {
-				p.nextToken() // move to [
-				p.nextToken() // move past [
-				altCase.VariableIndices = append(altCase.VariableIndices, p.parseExpression(LOWEST))
-				if !p.expectPeek(lexer.RBRACKET) {
-					return nil
-				}
-			}
 		}
 	}
+	if altCase.IsVariant {
+		// The variants' processes are the case's body
+		return altCase
+	}
+	p.parseAltCaseBody(altCase, start, "expected indented body after ALT case")
+	return altCase
+}
+
+// parseAltCaseBody parses the body of altCase, after its guard and channel
+// operation, which are the case's source text from start; missing is the
+// error for a case without one.
+func (p *Parser) parseAltCaseBody(altCase *ast.AltCase, start lexer.Token, missing string) {
+	altCase.Text = p.l.Source(start, p.curToken.Line)
 
 	// Skip to next line for the body
 	for p.peekTokenIs(lexer.NEWLINE) {
@@ -1897,15 +3230,27 @@ func (p *Parser) parseAltCase() *ast.AltCase {
 
 	// Expect INDENT for body
 	if !p.peekTokenIs(lexer.INDENT) {
-		p.addError("expected indented body after ALT case")
-		return altCase
+		p.addError(missing)
+		return
 	}
 	p.nextToken() // consume INDENT
 	p.nextToken() // move into body
 
-	altCase.Body = p.parseBodyStatements()
+	altCase.Body = append(altCase.Body, p.parseBodyStatements()...)
+}
 
-	return altCase
+// parseExtendedInput parses an extended input c ?? x outside an ALT, from
+// its channel, name subscripted by indices, at start, and the extended
+// process indented below it. It is an ALT of that one input, marked
+// ExtendedInput.
+func (p *Parser) parseExtendedInput(name string, indices []ast.Expression, start lexer.Token) ast.Statement {
+	altCase := &ast.AltCase{Channel: name, ChannelIndices: indices}
+	p.nextToken() // move to ??
+	if !p.parseAltInput(altCase, start) {
+		return nil
+	}
+	p.parseAltCaseBody(altCase, start, fmt.Sprintf("expected the extended process of %s ?? indented below it", name))
+	return &ast.AltBlock{Token: start, Cases: []ast.AltCase{*altCase}, ExtendedInput: true}
 }
 
 func (p *Parser) parseBlockStatements() []ast.Statement {
@@ -2021,6 +3366,7 @@ func (p *Parser) parseBodyStatements() []ast.Statement {
 
 func (p *Parser) parseProcDecl() *ast.ProcDecl {
 	proc := &ast.ProcDecl{Token: p.curToken}
+	proc.Entry = p.l.Pragma(proc.Token.Line-1) == "ENTRY"
 
 	if !p.expectPeek(lexer.IDENT) {
 		return nil
@@ -2121,170 +3467,81 @@ func (p *Parser) parseProcParams() []ast.ProcParam {
 			p.nextToken()
 		}
 
-		param := ast.ProcParam{}
+		var param ast.ProcParam
 
 		// Check if this is a shared-type parameter: after a comma, if current token
 		// is an IDENT that is NOT a type keyword, record name, CHAN, VAL, RESULT, or [,
 		// re-use the previous param's type/flags.
 		if prevParam != nil && p.curTokenIs(lexer.IDENT) && !p.recordNames[p.curToken.Literal] {
-			// This is a shared-type param — re-use type info from previous param
-			param.IsVal = prevParam.IsVal
-			param.Type = prevParam.Type
-			param.IsChan = prevParam.IsChan
-			param.ChanArrayDims = prevParam.ChanArrayDims
-			param.OpenArrayDims = prevParam.OpenArrayDims
-			param.ChanElemType = prevParam.ChanElemType
-			param.ArraySize = prevParam.ArraySize
-			param.Name = p.curToken.Literal
+			param = ast.NewParam(p.curToken.Literal, prevParam.IsVal, prevParam.TypeRef)
+			param.Shared = prevParam.Shared
+			if p.chanTypes[param.Type] {
+				param.ChanDir = prevParam.ChanDir
+			}
+		} else {
+			isVal, shared := false, false
 
-			// Check for channel direction marker (? or !)
-			if (param.IsChan || param.ChanArrayDims > 0) && (p.peekTokenIs(lexer.RECEIVE) || p.peekTokenIs(lexer.SEND)) {
+			// Check for VAL keyword
+			if p.curTokenIs(lexer.VAL) {
+				isVal = true
 				p.nextToken()
-				param.ChanDir = p.curToken.Literal
 			}
 
-			params = append(params, param)
-			prevParam = &params[len(params)-1]
-
-			if !p.peekTokenIs(lexer.COMMA) {
-				break
+			// SHARED CHAN TYPE end
+			if p.curTokenIs(lexer.SHARED) {
+				p.checkExtension(extShared)
+				shared = true
+				p.nextToken()
 			}
-			p.nextToken() // consume comma
-			p.nextToken() // move to next param
-			continue
-		}
-
-		// Check for VAL keyword
-		if p.curTokenIs(lexer.VAL) {
-			param.IsVal = true
-			p.nextToken()
-		}
 
-		// Check for RESULT keyword (output-only parameter — maps to pointer like non-VAL)
-		if p.curTokenIs(lexer.RESULT) {
-			// RESULT is semantically like non-VAL (pointer param), just skip it
-			p.nextToken()
-		}
+			// Check for RESULT keyword (output-only parameter — maps to pointer like non-VAL)
+			if p.curTokenIs(lexer.RESULT) {
+				// RESULT is semantically like non-VAL (pointer param), just skip it
+				p.nextToken()
+			}
 
-		// Check for []...CHAN OF <type>, []...TYPE (open array), [n]TYPE (fixed-size array),
-		// or mixed [][n]TYPE (open+fixed dimensions)
-		if p.curTokenIs(lexer.LBRACKET) {
-			if p.peekTokenIs(lexer.RBRACKET) {
-				// Open array: [][]...CHAN OF TYPE or [][]...TYPE
-				// Count consecutive [] pairs
-				dims := 0
-				for p.curTokenIs(lexer.LBRACKET) && p.peekTokenIs(lexer.RBRACKET) {
-					dims++
-					p.nextToken() // consume ]
-					p.nextToken() // move past ]
-				}
-				// After open [] pairs, check for trailing [n] fixed dims (e.g. [][2]TYPE)
-				for p.curTokenIs(lexer.LBRACKET) && !p.peekTokenIs(lexer.RBRACKET) {
-					dims++
-					p.nextToken() // past [
-					// skip size expression tokens until ]
-					for !p.curTokenIs(lexer.RBRACKET) && !p.curTokenIs(lexer.EOF) {
-						p.nextToken()
-					}
-					p.nextToken() // past ]
-				}
-				if p.curTokenIs(lexer.CHAN) {
-					// []...CHAN OF <type> or []...CHAN <type> (channel array parameter)
-					param.IsChan = true
-					param.ChanArrayDims = dims
-					if p.peekTokenIs(lexer.OF) {
-						p.nextToken() // consume OF
-					}
-					p.nextToken() // move to element type
-					if isTypeToken(p.curToken.Type) || p.curTokenIs(lexer.IDENT) {
-						param.ChanElemType = p.curToken.Literal
-					} else {
-						p.addError(fmt.Sprintf("expected type after %sCHAN, got %s", strings.Repeat("[]", dims), p.curToken.Type))
+			// A type name must be a RECORD, DATA TYPE or CHAN TYPE: other
+			// names are taken as parameter names
+			if p.curTokenIs(lexer.IDENT) && !p.recordNames[p.curToken.Literal] {
+				p.addError(fmt.Sprintf("expected type in parameter, got %s", p.curToken.Type))
+				return params
+			}
+			t := p.parseTypeRef()
+			if t == nil {
+				return params
+			}
+			if t.Kind == ast.ArrayType && t.Size != nil {
+				if _, ok := t.Size.(*ast.IntegerLiteral); !ok {
+					if _, ok := t.Size.(*ast.Identifier); !ok {
+						p.addError("expected a literal or named array size in parameter")
 						return params
 					}
-					p.nextToken()
-				} else if isTypeToken(p.curToken.Type) {
-					param.OpenArrayDims = dims
-					param.Type = p.curToken.Literal
-					p.nextToken()
-				} else if p.curTokenIs(lexer.IDENT) && p.recordNames[p.curToken.Literal] {
-					param.OpenArrayDims = dims
-					param.Type = p.curToken.Literal
-					p.nextToken()
-				} else {
-					p.addError(fmt.Sprintf("expected type after %s, got %s", strings.Repeat("[]", dims), p.curToken.Type))
-					return params
-				}
-			} else {
-				// Fixed-size array: [n]TYPE — mapped to open array (slice) param
-				dims := 1
-				p.nextToken() // move past [
-				if !p.curTokenIs(lexer.INT) {
-					p.addError(fmt.Sprintf("expected array size, got %s", p.curToken.Type))
-					return params
-				}
-				param.ArraySize = p.curToken.Literal
-				if !p.expectPeek(lexer.RBRACKET) {
-					return params
-				}
-				p.nextToken() // move past ]
-				// Check for additional [n] dims after the first (e.g. [3][4]TYPE)
-				for p.curTokenIs(lexer.LBRACKET) && !p.peekTokenIs(lexer.RBRACKET) {
-					dims++
-					p.nextToken() // past [
-					for !p.curTokenIs(lexer.RBRACKET) && !p.curTokenIs(lexer.EOF) {
-						p.nextToken()
-					}
-					p.nextToken() // past ]
 				}
-				_ = dims // ArraySize already set; dims only relevant for open arrays
-				if isTypeToken(p.curToken.Type) {
-					param.Type = p.curToken.Literal
-				} else if p.curTokenIs(lexer.IDENT) && p.recordNames[p.curToken.Literal] {
-					param.Type = p.curToken.Literal
-				} else {
-					p.addError(fmt.Sprintf("expected type after [%s], got %s", param.ArraySize, p.curToken.Type))
+			}
+			param = ast.NewParam("", isVal, t)
+			param.Shared = shared
+
+			// CHAN TYPE end: FOO? svr
+			if t.Kind == ast.NamedType && p.chanTypes[t.Name] {
+				if !p.peekTokenIs(lexer.RECEIVE) && !p.peekTokenIs(lexer.SEND) {
+					p.addError(fmt.Sprintf("expected ? or ! after CHAN TYPE %s", t.Name))
 					return params
 				}
 				p.nextToken()
+				param.ChanDir = p.curToken.Literal
 			}
-		} else if p.curTokenIs(lexer.CHAN) {
-			// Check for CHAN OF <type> or CHAN <type>
-			param.IsChan = true
-			if p.peekTokenIs(lexer.OF) {
-				p.nextToken() // consume OF
-			}
-			p.nextToken() // move to element type
-			if isTypeToken(p.curToken.Type) || p.curTokenIs(lexer.IDENT) {
-				param.ChanElemType = p.curToken.Literal
-			} else {
-				p.addError(fmt.Sprintf("expected type after CHAN, got %s", p.curToken.Type))
-				return params
-			}
-			p.nextToken()
-		} else if p.curTokenIs(lexer.IDENT) && p.recordNames[p.curToken.Literal] {
-			// Record type parameter
-			param.Type = p.curToken.Literal
 			p.nextToken()
-		} else {
-			// Expect scalar type
-			if !isTypeToken(p.curToken.Type) {
-				p.addError(fmt.Sprintf("expected type in parameter, got %s", p.curToken.Type))
+
+			// Expect identifier
+			if !p.curTokenIs(lexer.IDENT) {
+				p.addError(fmt.Sprintf("expected parameter name, got %s", p.curToken.Type))
 				return params
 			}
-			param.Type = p.curToken.Literal
-			p.nextToken()
-		}
-
-		// Expect identifier
-		if !p.curTokenIs(lexer.IDENT) {
-			p.addError(fmt.Sprintf("expected parameter name, got %s", p.curToken.Type))
-			return params
+			param.Name = p.curToken.Literal
 		}
-		param.Name = p.curToken.Literal
 
 		// Check for channel direction marker (? or !)
-		if (param.IsChan || param.ChanArrayDims > 0) && (p.peekTokenIs(lexer.RECEIVE) || p.peekTokenIs(lexer.SEND)) {
+		if param.IsChan && (p.peekTokenIs(lexer.RECEIVE) || p.peekTokenIs(lexer.SEND)) {
 			p.nextToken()
 			param.ChanDir = p.curToken.Literal
 		}
@@ -2302,6 +3559,59 @@ func (p *Parser) parseProcParams() []ast.ProcParam {
 	return params
 }
 
+// parseTypeRef parses the type of a parameter at the current token, leaving
+// the current token on its last token: a primitive type, a RECORD, DATA
+// TYPE, PROTOCOL or CHAN TYPE name, [n]TYPE or []TYPE, CHAN OF TYPE (or
+// CHAN TYPE), or occam-pi MOBILE TYPE.
+func (p *Parser) parseTypeRef() *ast.TypeRef {
+	switch {
+	case p.curTokenIs(lexer.MOBILE):
+		p.checkExtension(extMobile)
+		p.nextToken() // move past MOBILE
+		t := p.parseTypeRef()
+		if t != nil {
+			t.Mobile = true
+		}
+		return t
+	case p.curTokenIs(lexer.LBRACKET):
+		var size ast.Expression
+		if !p.peekTokenIs(lexer.RBRACKET) {
+			p.nextToken() // move past [
+			size = p.parseExpression(LOWEST)
+		}
+		if !p.expectPeek(lexer.RBRACKET) {
+			return nil
+		}
+		p.nextToken() // move past ]
+		elem := p.parseTypeRef()
+		if elem == nil {
+			return nil
+		}
+		return ast.ArrayOf(size, elem)
+	case p.curTokenIs(lexer.CHAN):
+		if p.peekTokenIs(lexer.OF) {
+			p.nextToken() // consume OF
+		} else {
+			p.checkExtension(extChanShorthand)
+		}
+		p.nextToken() // move to element type
+		elem := p.parseTypeRef()
+		if elem == nil {
+			return nil
+		}
+		return ast.ChanOf(elem)
+	case isTypeToken(p.curToken.Type), p.curTokenIs(lexer.BARRIER):
+		if p.curTokenIs(lexer.BARRIER) {
+			p.checkExtension(extBarrier)
+		}
+		return ast.Scalar(p.curToken.Literal)
+	case p.curTokenIs(lexer.IDENT):
+		return ast.Named(p.curToken.Literal)
+	}
+	p.addError(fmt.Sprintf("expected type, got %s", p.curToken.Type))
+	return nil
+}
+
 func (p *Parser) parseProcCall() *ast.ProcCall {
 	call := &ast.ProcCall{
 		Token: p.curToken,
@@ -2310,6 +3620,7 @@ func (p *Parser) parseProcCall() *ast.ProcCall {
 
 	if !p.peekTokenIs(lexer.LPAREN) {
 		// No arguments
+		call.NoParens = true
 		return call
 	}
 
@@ -2322,19 +3633,13 @@ func (p *Parser) parseProcCall() *ast.ProcCall {
 
 	p.nextToken() // move to first arg
 	call.Args = append(call.Args, p.parseExpression(LOWEST))
-	// Consume optional channel direction annotation at call site (e.g., out!)
-	if p.peekTokenIs(lexer.SEND) || p.peekTokenIs(lexer.RECEIVE) {
-		p.nextToken()
-	}
+	call.ArgDirs = append(call.ArgDirs, p.parseArgDirection())
 
 	for p.peekTokenIs(lexer.COMMA) {
 		p.nextToken() // consume comma
 		p.nextToken() // move to next arg
 		call.Args = append(call.Args, p.parseExpression(LOWEST))
-		// Consume optional channel direction annotation at call site
-		if p.peekTokenIs(lexer.SEND) || p.peekTokenIs(lexer.RECEIVE) {
-			p.nextToken()
-		}
+		call.ArgDirs = append(call.ArgDirs, p.parseArgDirection())
 	}
 
 	if !p.expectPeek(lexer.RPAREN) {
@@ -2344,17 +3649,53 @@ func (p *Parser) parseProcCall() *ast.ProcCall {
 	return call
 }
 
+// parseArgDirection consumes an optional channel direction annotation after
+// a call argument (e.g., out!) and returns it, or "" if there is none.
+func (p *Parser) parseArgDirection() string {
+	if p.peekTokenIs(lexer.SEND) || p.peekTokenIs(lexer.RECEIVE) {
+		p.nextToken()
+		return p.curToken.Literal
+	}
+	return ""
+}
+
+// isFuncHeading reports whether the type at the current token is the
+// (first) result type of a FUNCTION heading.
+func (p *Parser) isFuncHeading() bool {
+	return p.peekTokenIs(lexer.FUNCTION) || p.peekTokenIs(lexer.FUNC) || p.peekTokenIs(lexer.COMMA) || p.peekTokenIs(lexer.INLINE)
+}
+
+// isArrayFuncHeading reports whether the current token, after the
+// dimensions of an array type, is the element type of the result of a
+// FUNCTION heading.
+func (p *Parser) isArrayFuncHeading() bool {
+	isElemType := isTypeToken(p.curToken.Type) || p.curTokenIs(lexer.IDENT) && (p.dataTypes[p.curToken.Literal] || p.recordNames[p.curToken.Literal])
+	return isElemType && p.isFuncHeading()
+}
+
 func (p *Parser) parseFuncDecl() *ast.FuncDecl {
+	return p.parseFuncDeclFrom(p.curToken, p.namedType())
+}
+
+// parseFuncDeclFrom parses a FUNCTION declaration from token, whose first
+// result type has been read; the current token is the last of that type.
+func (p *Parser) parseFuncDeclFrom(token lexer.Token, result *ast.TypeRef) *ast.FuncDecl {
 	fn := &ast.FuncDecl{
-		Token:       p.curToken,
-		ReturnTypes: []string{p.curToken.Literal},
+		Token:       token,
+		ReturnTypes: []string{result.FlatName()},
+		Results:     []*ast.TypeRef{result},
 	}
 
 	// Parse additional return types for multi-result functions: INT, INT FUNCTION
 	for p.peekTokenIs(lexer.COMMA) {
 		p.nextToken() // consume comma
 		p.nextToken() // move to next type
-		fn.ReturnTypes = append(fn.ReturnTypes, p.curToken.Literal)
+		t := p.parseTypeRef()
+		if t == nil {
+			return nil
+		}
+		fn.ReturnTypes = append(fn.ReturnTypes, t.FlatName())
+		fn.Results = append(fn.Results, t)
 	}
 
 	// Skip INLINE modifier if present (optimization hint, ignored for transpilation)
@@ -2369,6 +3710,7 @@ func (p *Parser) parseFuncDecl() *ast.FuncDecl {
 		return nil
 	}
 	fn.Name = p.curToken.Literal
+	fn.Asserts = p.parseAsserts(fn.Token.Line)
 
 	if !p.expectPeek(lexer.LPAREN) {
 		return nil
@@ -2419,11 +3761,18 @@ func (p *Parser) parseFuncDecl() *ast.FuncDecl {
 	}
 
 	// VALOF form: local declarations, then VALOF keyword, then body, then RESULT
-	// Parse local declarations (type keywords before VALOF)
-	for p.curTokenIs(lexer.INT_TYPE) || p.curTokenIs(lexer.BYTE_TYPE) ||
-		p.curTokenIs(lexer.BOOL_TYPE) || p.curTokenIs(lexer.REAL_TYPE) ||
-		p.curTokenIs(lexer.REAL32_TYPE) || p.curTokenIs(lexer.REAL64_TYPE) {
-		stmt := p.parseVarDecl()
+	// Parse local declarations (types before VALOF): scalars, arrays and records
+	for {
+		var stmt ast.Statement
+		if p.curTokenIs(lexer.INT_TYPE) || p.curTokenIs(lexer.BYTE_TYPE) ||
+			p.curTokenIs(lexer.BOOL_TYPE) || p.curTokenIs(lexer.REAL_TYPE) ||
+			p.curTokenIs(lexer.REAL32_TYPE) || p.curTokenIs(lexer.REAL64_TYPE) {
+			stmt = p.parseVarDecl()
+		} else if p.curTokenIs(lexer.LBRACKET) || p.curTokenIs(lexer.IDENT) && p.recordNames[p.curToken.Literal] && p.peekTokenIs(lexer.IDENT) {
+			stmt = p.parseStatement()
+		} else {
+			break
+		}
 		if stmt != nil {
 			fn.Body = append(fn.Body, stmt)
 		}
@@ -2505,6 +3854,92 @@ func (p *Parser) parseFuncDecl() *ast.FuncDecl {
 	return fn
 }
 
+// parseValofExpr parses the VALOF expression (VALOF process RESULT e) from
+// its VALOF, or the first of the specifications before it, to its closing ),
+// which the lexer precedes with the dedents ending the body. The
+// specifications start the body, as they scope over all of it.
+func (p *Parser) parseValofExpr() ast.Expression {
+	var specs []ast.Statement
+	if !p.curTokenIs(lexer.VALOF) {
+		// (INT s: then VALOF on the next line, indented, with any further
+		// specifications on the lines between
+		startLevel := p.indentLevel
+		for !p.curTokenIs(lexer.VALOF) {
+			if p.curTokenIs(lexer.EOF) || p.curTokenIs(lexer.DEDENT) && p.indentLevel <= startLevel {
+				p.addError("expected VALOF after the specifications of a VALOF expression")
+				return nil
+			}
+			if p.curTokenIs(lexer.NEWLINE) || p.curTokenIs(lexer.INDENT) {
+				p.nextToken()
+				continue
+			}
+			stmt := p.parseStatement()
+			if stmt == nil {
+				return nil
+			}
+			if !p.curTokenIs(lexer.COLON) {
+				p.addError("expected a specification, ending in ':', before VALOF")
+				return nil
+			}
+			specs = append(specs, stmt)
+			p.nextToken()
+		}
+	}
+	v := &ast.ValofExpr{Token: p.curToken, Body: specs}
+
+	for p.peekTokenIs(lexer.NEWLINE) {
+		p.nextToken()
+	}
+	if !p.peekTokenIs(lexer.INDENT) {
+		p.addError("expected indented block after VALOF")
+		return nil
+	}
+	p.nextToken() // consume INDENT
+	startLevel := p.indentLevel
+	p.nextToken() // move into VALOF body
+
+	// Declarations and statements until RESULT, as in a FUNCTION
+	for !p.curTokenIs(lexer.RESULT) && !p.curTokenIs(lexer.EOF) {
+		for p.curTokenIs(lexer.NEWLINE) {
+			p.nextToken()
+		}
+		if p.curTokenIs(lexer.DEDENT) && p.indentLevel < startLevel {
+			break
+		}
+		for p.curTokenIs(lexer.DEDENT) {
+			p.nextToken()
+		}
+		if p.curTokenIs(lexer.EOF) || p.curTokenIs(lexer.RESULT) || p.curTokenIs(lexer.RPAREN) {
+			break
+		}
+		stmt := p.parseStatement()
+		if stmt != nil {
+			v.Body = append(v.Body, stmt)
+		}
+		if !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.DEDENT) && !p.curTokenIs(lexer.EOF) && !p.curTokenIs(lexer.RESULT) {
+			p.nextToken()
+		}
+	}
+	if !p.curTokenIs(lexer.RESULT) {
+		p.addError("expected RESULT at the end of VALOF")
+		return nil
+	}
+	p.nextToken() // move past RESULT
+	v.Result = p.parseExpression(LOWEST)
+	if p.peekTokenIs(lexer.COMMA) {
+		p.addError("a VALOF expression has one RESULT")
+		return nil
+	}
+
+	for p.peekTokenIs(lexer.NEWLINE) || p.peekTokenIs(lexer.DEDENT) {
+		p.nextToken()
+	}
+	if !p.expectPeek(lexer.RPAREN) {
+		return nil
+	}
+	return v
+}
+
 // convertOccamStringEscapes converts occam escape sequences in string literals
 // to their actual byte values. Occam uses *c, *n, *t, *s, **, *", *' as escapes.
 func (p *Parser) convertOccamStringEscapes(raw string) string {
@@ -2528,6 +3963,14 @@ func (p *Parser) convertOccamStringEscapes(raw string) string {
 				buf.WriteByte('"')
 			case '\'':
 				buf.WriteByte('\'')
+			case '#':
+				// *#hh: the byte with hex value hh
+				if b, ok := hexEscape(raw[i+1:]); ok {
+					buf.WriteByte(b)
+					i += 2
+					break
+				}
+				buf.WriteString("*#")
 			default:
 				// Unknown escape: pass through as-is
 				buf.WriteByte('*')
@@ -2540,12 +3983,31 @@ func (p *Parser) convertOccamStringEscapes(raw string) string {
 	return buf.String()
 }
 
+// hexEscape returns the byte given by the two hex digits at the start of s,
+// as in the occam escape *#hh.
+func hexEscape(s string) (byte, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s[:2], 16, 8)
+	if err != nil {
+		return 0, false
+	}
+	return byte(v), true
+}
+
 // parseByteLiteralValue processes the raw content of a byte literal (between single quotes),
 // handling occam escape sequences (* prefix), and returns the resulting byte value.
 func (p *Parser) parseByteLiteralValue(raw string) (byte, error) {
 	if len(raw) == 0 {
 		return 0, fmt.Errorf("empty byte literal")
 	}
+	if raw[0] == '*' && len(raw) > 1 && raw[1] == '#' {
+		if b, ok := hexEscape(raw[2:]); ok && len(raw) == 4 {
+			return b, nil
+		}
+		return 0, fmt.Errorf("invalid escape sequence in byte literal: '%s' (want *#hh)", raw)
+	}
 	if raw[0] == '*' {
 		if len(raw) != 2 {
 			return 0, fmt.Errorf("invalid escape sequence in byte literal: '*%s'", raw[1:])
@@ -2812,15 +4274,68 @@ func (p *Parser) parseCaseStatement() *ast.CaseStatement {
 // Expression parsing using Pratt parsing
 
 func (p *Parser) parseExpression(precedence int) ast.Expression {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxNestingDepth || p.tooDeep {
+		p.nestingTooDeep()
+		return nil
+	}
+
 	var left ast.Expression
 
 	switch p.curToken.Type {
 	case lexer.IDENT:
-		if p.peekTokenIs(lexer.LPAREN) {
+		if p.dataTypes[p.curToken.Literal] {
+			// Conversion to a DATA TYPE: MY.INT x, MY.INT ROUND r
+			token := p.curToken
+			p.nextToken()
+			qualifier := ""
+			if p.curTokenIs(lexer.ROUND_KW) || p.curTokenIs(lexer.TRUNC_KW) {
+				qualifier = p.curToken.Literal
+				p.nextToken()
+			}
+			left = &ast.TypeConversion{
+				Token:      token,
+				TargetType: token.Literal,
+				Qualifier:  qualifier,
+				Expr:       p.parseExpression(PREFIX),
+			}
+		} else if p.peekTokenIs(lexer.LPAREN) {
 			left = p.parseFuncCallExpr()
 		} else {
 			left = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 		}
+	case lexer.MOBILE:
+		// New CHAN TYPE bundle: MOBILE FOO, or mobile array: MOBILE [n]BYTE
+		token := p.curToken
+		p.checkExtension(extMobile)
+		if p.peekTokenIs(lexer.LBRACKET) {
+			p.nextToken() // move to [
+			p.nextToken() // move past [
+			size := p.parseExpression(LOWEST)
+			if !p.expectPeek(lexer.RBRACKET) {
+				return nil
+			}
+			p.nextToken() // move past ]
+			if p.curTokenIs(lexer.LBRACKET) {
+				p.addError("MOBILE arrays have one dimension")
+				return nil
+			}
+			if !isTypeToken(p.curToken.Type) && !(p.curTokenIs(lexer.IDENT) && (p.dataTypes[p.curToken.Literal] || p.recordNames[p.curToken.Literal])) {
+				p.addError(fmt.Sprintf("expected type after MOBILE [n], got %s", p.curToken.Type))
+				return nil
+			}
+			left = &ast.MobileExpr{Token: token, Type: p.curToken.Literal, Size: size}
+			break
+		}
+		if !p.expectPeek(lexer.IDENT) {
+			return nil
+		}
+		if !p.chanTypes[p.curToken.Literal] {
+			p.addError(fmt.Sprintf("MOBILE %s: only CHAN TYPEs can be allocated", p.curToken.Literal))
+			return nil
+		}
+		left = &ast.MobileExpr{Token: token, Type: p.curToken.Literal}
 	case lexer.INT:
 		base := 10
 		literal := p.curToken.Literal
@@ -2834,6 +4349,28 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 			return nil
 		}
 		left = &ast.IntegerLiteral{Token: p.curToken, Value: val}
+	case lexer.REAL:
+		lit := &ast.RealLiteral{Token: p.curToken}
+		val, err := strconv.ParseFloat(p.curToken.Literal, 64)
+		if err != nil {
+			p.addError(fmt.Sprintf("could not parse %q as a real number", p.curToken.Literal))
+			return nil
+		}
+		lit.Value = val
+		// A type decoration: 3.14159(REAL32)
+		if p.peekTokenIs(lexer.LPAREN) {
+			p.nextToken()
+			p.nextToken()
+			if !p.curTokenIs(lexer.REAL32_TYPE) && !p.curTokenIs(lexer.REAL64_TYPE) {
+				p.addError(fmt.Sprintf("expected REAL32 or REAL64 after %s(, got %s", lit.Token.Literal, p.curToken.Type))
+				return nil
+			}
+			lit.Type = p.curToken.Literal
+			if !p.expectPeek(lexer.RPAREN) {
+				return nil
+			}
+		}
+		left = lit
 	case lexer.TRUE:
 		left = &ast.BooleanLiteral{Token: p.curToken, Value: true}
 	case lexer.FALSE:
@@ -2848,7 +4385,13 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 		}
 		left = &ast.ByteLiteral{Token: p.curToken, Value: b}
 	case lexer.LPAREN:
+		lparen := p.curToken
 		p.nextToken()
+		if p.curTokenIs(lexer.VALOF) || p.valofSpecs[lparen] {
+			p.checkExtension(extValofExpr)
+			left = p.parseValofExpr()
+			break
+		}
 		left = p.parseExpression(LOWEST)
 		if !p.expectPeek(lexer.RPAREN) {
 			return nil
@@ -2883,7 +4426,17 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 		p.nextToken() // move past [
 		firstExpr := p.parseExpression(LOWEST)
 
-		if p.peekTokenIs(lexer.COMMA) {
+		if eq, ok := firstExpr.(*ast.BinaryExpr); ok && eq.Operator == "=" && p.peekTokenIs(lexer.FOR) {
+			// Array constructor: [i = start FOR count | value], the
+			// replicator having been read as the comparison i = start
+			name, ok := eq.Left.(*ast.Identifier)
+			if !ok {
+				p.addError("expected a replicator name in array constructor")
+				return nil
+			}
+			p.checkExtension(extArrayConstructor)
+			left = p.parseArrayConstructor(lbracket, name.Value, eq.Right)
+		} else if p.peekTokenIs(lexer.COMMA) {
 			// Array literal: [expr, expr, ...]
 			elements := []ast.Expression{firstExpr}
 			for p.peekTokenIs(lexer.COMMA) {
@@ -2894,17 +4447,17 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 			if !p.expectPeek(lexer.RBRACKET) {
 				return nil
 			}
-			left = &ast.ArrayLiteral{
+			left = p.parseArrayLiteralType(&ast.ArrayLiteral{
 				Token:    lbracket,
 				Elements: elements,
-			}
+			})
 		} else if p.peekTokenIs(lexer.RBRACKET) {
 			// Single-element array literal: [expr]
 			p.nextToken() // consume ]
-			left = &ast.ArrayLiteral{
+			left = p.parseArrayLiteralType(&ast.ArrayLiteral{
 				Token:    lbracket,
 				Elements: []ast.Expression{firstExpr},
-			}
+			})
 		} else {
 			// Slice expression: [arr FROM start FOR length] or [arr FOR length]
 			var startExpr ast.Expression
@@ -2952,7 +4505,7 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 			!p.peekTokenIs(lexer.BOOL_TYPE) && !p.peekTokenIs(lexer.REAL_TYPE) &&
 			!p.peekTokenIs(lexer.REAL32_TYPE) && !p.peekTokenIs(lexer.REAL64_TYPE) &&
 			!p.peekTokenIs(lexer.INT16_TYPE) && !p.peekTokenIs(lexer.INT32_TYPE) && !p.peekTokenIs(lexer.INT64_TYPE) {
-			p.addError(fmt.Sprintf("expected type after %s, got %s", token.Literal, p.peekToken.Type))
+			p.addErrorAt(p.peekToken, fmt.Sprintf("expected type after %s, got %s", token.Literal, p.peekToken.Type))
 			return nil
 		}
 		p.nextToken()
@@ -2981,9 +4534,16 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 		return nil
 	}
 
-	// Parse infix expressions
-	for !p.peekTokenIs(lexer.NEWLINE) && !p.peekTokenIs(lexer.EOF) &&
-		precedence < p.peekPrecedence() {
+	// Parse infix expressions. Each iteration wraps left in a new node, so a
+	// long operator chain nests as deeply as parentheses do and counts
+	// towards the same limit (codegen recurses down the left spine).
+	for chain := 1; !p.peekTokenIs(lexer.NEWLINE) && !p.peekTokenIs(lexer.EOF) &&
+		precedence < p.peekPrecedence(); chain++ {
+
+		if p.depth+chain > maxNestingDepth {
+			p.nestingTooDeep()
+			return nil
+		}
 
 		switch p.peekToken.Type {
 		case lexer.PLUS, lexer.MINUS, lexer.MULTIPLY, lexer.DIVIDE, lexer.MODULO,
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/codeassociates/occam2go/ast"
@@ -381,6 +382,42 @@ func TestAltBlockWithGuardedSkip(t *testing.T) {
 	}
 }
 
+func TestAltBlockWithGuardedTimer(t *testing.T) {
+	input := `TIMER tim:
+ALT
+  waiting & tim ? AFTER deadline
+    some.proc()
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+
+	alt, ok := program.Statements[1].(*ast.AltBlock)
+	if !ok {
+		t.Fatalf("expected AltBlock, got %T", program.Statements[1])
+	}
+
+	if len(alt.Cases) != 1 {
+		t.Fatalf("expected 1 case, got %d", len(alt.Cases))
+	}
+
+	c := alt.Cases[0]
+	if !c.IsTimer || c.Timer != "tim" {
+		t.Errorf("expected timer case on tim, got IsTimer=%v Timer=%q", c.IsTimer, c.Timer)
+	}
+	if c.Guard == nil {
+		t.Error("expected guard expression, got nil")
+	}
+	if id, ok := c.Deadline.(*ast.Identifier); !ok || id.Value != "deadline" {
+		t.Errorf("expected deadline identifier, got %v", c.Deadline)
+	}
+}
+
 func TestPriAltBlock(t *testing.T) {
 	input := `PRI ALT
   c1 ? x
@@ -447,6 +484,51 @@ func TestPriParBlock(t *testing.T) {
 	}
 }
 
+func TestPlacedPar(t *testing.T) {
+	input := `PLACED PAR
+  PROCESSOR 0 T8
+    x := 1
+  PROCESSOR 1 T4
+    INT y:
+    y := 2
+PLACE x AT 4:
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+
+	par, ok := program.Statements[0].(*ast.ParBlock)
+	if !ok {
+		t.Fatalf("expected ParBlock, got %T", program.Statements[0])
+	}
+	if len(par.Statements) != 2 || len(par.Processors) != 2 {
+		t.Fatalf("expected 2 statements and processors, got %d and %d", len(par.Statements), len(par.Processors))
+	}
+	if par.Processors[1].Type != "T4" {
+		t.Errorf("expected processor type T4, got %q", par.Processors[1].Type)
+	}
+	if _, ok := par.Statements[0].(*ast.Assignment); !ok {
+		t.Errorf("expected Assignment for processor 0, got %T", par.Statements[0])
+	}
+	seq, ok := par.Statements[1].(*ast.SeqBlock)
+	if !ok || len(seq.Statements) != 2 {
+		t.Errorf("expected declaration and process for processor 1, got %#v", par.Statements[1])
+	}
+
+	place, ok := program.Statements[1].(*ast.PlaceDecl)
+	if !ok {
+		t.Fatalf("expected PlaceDecl, got %T", program.Statements[1])
+	}
+	if place.Name != "x" {
+		t.Errorf("expected PLACE x, got %q", place.Name)
+	}
+}
+
 func TestWhileLoop(t *testing.T) {
 	input := `WHILE x > 0
   x := x - 1
@@ -1040,6 +1122,61 @@ func TestMultiResultFuncDecl(t *testing.T) {
 	}
 }
 
+func TestFuncDeclArrayAndRecordResults(t *testing.T) {
+	input := `RECORD POINT
+  INT x:
+  INT y:
+POINT FUNCTION midpoint(VAL POINT a, b)
+  POINT m:
+  VALOF
+    m[x], m[y] := (a[x] + b[x]) / 2, (a[y] + b[y]) / 2
+    RESULT m
+:
+[]INT FUNCTION table(VAL INT n)
+  [4]INT t:
+  VALOF
+    SEQ i = 0 FOR 4
+      t[i] := i * n
+    RESULT t
+:
+[2][3]BYTE, INT, []POINT FUNCTION several()
+  IS words, 1, points
+:
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 4 {
+		t.Fatalf("expected 4 statements, got %d", len(program.Statements))
+	}
+	tests := []struct {
+		name    string
+		results []string
+		body    int
+	}{
+		{"midpoint", []string{"POINT"}, 2},
+		{"table", []string{"[]INT"}, 2},
+		{"several", []string{"[][]BYTE", "INT", "[]POINT"}, 0},
+	}
+	for i, tt := range tests {
+		fn, ok := program.Statements[i+1].(*ast.FuncDecl)
+		if !ok {
+			t.Fatalf("expected FuncDecl, got %T", program.Statements[i+1])
+		}
+		if fn.Name != tt.name {
+			t.Errorf("expected name %q, got %q", tt.name, fn.Name)
+		}
+		if strings.Join(fn.ReturnTypes, ", ") != strings.Join(tt.results, ", ") {
+			t.Errorf("%s: expected return types %v, got %v", tt.name, tt.results, fn.ReturnTypes)
+		}
+		if len(fn.Body) != tt.body {
+			t.Errorf("%s: expected %d body statements, got %d", tt.name, tt.body, len(fn.Body))
+		}
+	}
+}
+
 func TestMultiAssignment(t *testing.T) {
 	input := `a, b := swap(1, 2)
 `
@@ -1562,6 +1699,8 @@ func TestStringEscapeConversion(t *testing.T) {
 		{`x := "a**b"` + "\n", "a*b"},
 		{`x := "it*'s"` + "\n", "it's"},
 		{`x := "no escapes"` + "\n", "no escapes"},
+		{`x := "cmd*#00*#05*#ff"` + "\n", "cmd\x00\x05\xff"},
+		{`x := "*#4"` + "\n", "*#4"},
 	}
 
 	for _, tt := range tests {
@@ -1605,6 +1744,8 @@ func TestByteLiteral(t *testing.T) {
 		{"x := '**'\n", '*'},
 		{"x := '*''\n", '\''},
 		{"x := '*\"'\n", '"'},
+		{"x := '*#1B'\n", 0x1B},
+		{"x := '*#00'\n", 0},
 	}
 
 	for _, tt := range tests {
@@ -1633,6 +1774,53 @@ func TestByteLiteral(t *testing.T) {
 	}
 }
 
+func TestProcCallWithoutParens(t *testing.T) {
+	input := `tick
+tick ()
+tick()
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(program.Statements))
+	}
+	for i, noParens := range []bool{true, false, false} {
+		call, ok := program.Statements[i].(*ast.ProcCall)
+		if !ok {
+			t.Fatalf("statement %d: expected ProcCall, got %T", i, program.Statements[i])
+		}
+		if call.Name != "tick" || len(call.Args) != 0 || call.NoParens != noParens {
+			t.Errorf("statement %d: expected tick with no args and NoParens=%v, got %s with %d args and NoParens=%v", i, noParens, call.Name, len(call.Args), call.NoParens)
+		}
+	}
+}
+
+func TestProcCallArgDirections(t *testing.T) {
+	input := `worker(in?, out!, 3)
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	call, ok := program.Statements[0].(*ast.ProcCall)
+	if !ok {
+		t.Fatalf("expected ProcCall, got %T", program.Statements[0])
+	}
+	want := []string{"?", "!", ""}
+	if len(call.Args) != 3 || len(call.ArgDirs) != 3 {
+		t.Fatalf("expected 3 args and directions, got %d and %v", len(call.Args), call.ArgDirs)
+	}
+	for i, dir := range want {
+		if call.ArgDirs[i] != dir {
+			t.Errorf("arg %d: expected direction %q, got %q", i, dir, call.ArgDirs[i])
+		}
+	}
+}
+
 func TestStringLiteralInProcCall(t *testing.T) {
 	input := `print.string("hello")
 `
@@ -1727,6 +1915,121 @@ func TestSequentialProtocolDecl(t *testing.T) {
 	}
 }
 
+func TestCountedArrayProtocol(t *testing.T) {
+	input := `PROTOCOL PACKET IS INT32::[]BYTE
+PROTOCOL MSG
+  CASE
+    text; INT; INT::[]BYTE
+    quit
+SEQ
+  c ! 2 :: buf
+  c ? n :: b
+  m ! text ; 1 ; SIZE s :: s
+  m ? CASE
+    text ; k ; n :: b
+      SKIP
+    quit
+      SKIP
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	packet := program.Statements[0].(*ast.ProtocolDecl)
+	if packet.Kind != "simple" || len(packet.Types) != 1 || packet.Types[0] != "INT32::[]BYTE" {
+		t.Errorf("expected simple protocol [INT32::[]BYTE], got %s %v", packet.Kind, packet.Types)
+	}
+	if count, elem, ok := ast.CountedArray(packet.Types[0]); !ok || count != "INT32" || elem != "BYTE" {
+		t.Errorf("expected counted array INT32 of BYTE, got %q %q %v", count, elem, ok)
+	}
+	msg := program.Statements[1].(*ast.ProtocolDecl)
+	if got := msg.Variants[0].Types; len(got) != 2 || got[1] != "INT::[]BYTE" {
+		t.Errorf("expected text types [INT INT::[]BYTE], got %v", got)
+	}
+
+	seq := program.Statements[2].(*ast.SeqBlock)
+	send := seq.Statements[0].(*ast.Send)
+	ca, ok := send.Value.(*ast.CountedArrayExpr)
+	if !ok {
+		t.Fatalf("expected CountedArrayExpr, got %T", send.Value)
+	}
+	if arr, ok := ca.Array.(*ast.Identifier); !ok || arr.Value != "buf" {
+		t.Errorf("expected array buf, got %v", ca.Array)
+	}
+
+	recv := seq.Statements[1].(*ast.Receive)
+	if recv.Variable != "n" || len(recv.Arrays) != 1 || recv.Arrays[0] != "b" {
+		t.Errorf("expected n :: b, got %s %v", recv.Variable, recv.Arrays)
+	}
+
+	variantSend := seq.Statements[2].(*ast.Send)
+	if len(variantSend.Values) != 2 {
+		t.Fatalf("expected 2 values, got %d", len(variantSend.Values))
+	}
+	if _, ok := variantSend.Values[1].(*ast.CountedArrayExpr); !ok {
+		t.Errorf("expected CountedArrayExpr, got %T", variantSend.Values[1])
+	}
+
+	vr := seq.Statements[3].(*ast.VariantReceive)
+	text := vr.Cases[0]
+	if len(text.Variables) != 2 || len(text.Arrays) != 2 || text.Arrays[0] != "" || text.Arrays[1] != "b" {
+		t.Errorf("expected k ; n :: b, got %v %q", text.Variables, text.Arrays)
+	}
+	if vr.Cases[1].Arrays != nil {
+		t.Errorf("expected no arrays for quit, got %q", vr.Cases[1].Arrays)
+	}
+}
+
+func TestFixedArrayProtocol(t *testing.T) {
+	input := `PROTOCOL QUAD IS [4]BYTE
+PROTOCOL MSG
+  CASE
+    raw; [N]BYTE
+    packet; INT; INT::[]BYTE; [2]INT
+SEQ
+  m ! packet ; len ; len :: [buf FROM 0 FOR len] ; [two FROM 0 FOR 2]
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	quad := program.Statements[0].(*ast.ProtocolDecl)
+	if quad.Kind != "simple" || len(quad.Types) != 1 || quad.Types[0] != "[4]BYTE" {
+		t.Errorf("expected simple protocol [[4]BYTE], got %s %v", quad.Kind, quad.Types)
+	}
+	if size, elem, ok := ast.FixedArray(quad.Types[0]); !ok || size != "4" || elem != "BYTE" {
+		t.Errorf("expected fixed array 4 of BYTE, got %q %q %v", size, elem, ok)
+	}
+	msg := program.Statements[1].(*ast.ProtocolDecl)
+	if got := msg.Variants[0].Types; len(got) != 1 || got[0] != "[N]BYTE" {
+		t.Errorf("expected raw types [[N]BYTE], got %v", got)
+	}
+	if got := msg.Variants[1].Types; len(got) != 3 || got[1] != "INT::[]BYTE" || got[2] != "[2]INT" {
+		t.Errorf("expected packet types [INT INT::[]BYTE [2]INT], got %v", got)
+	}
+	if _, _, ok := ast.FixedArray(msg.Variants[1].Types[1]); ok {
+		t.Errorf("expected INT::[]BYTE not to be a fixed array")
+	}
+
+	seq := program.Statements[2].(*ast.SeqBlock)
+	send := seq.Statements[0].(*ast.Send)
+	if len(send.Values) != 3 {
+		t.Fatalf("expected 3 values, got %d", len(send.Values))
+	}
+	ca, ok := send.Values[1].(*ast.CountedArrayExpr)
+	if !ok {
+		t.Fatalf("expected CountedArrayExpr, got %T", send.Values[1])
+	}
+	if _, ok := ca.Array.(*ast.SliceExpr); !ok {
+		t.Errorf("expected slice array, got %T", ca.Array)
+	}
+	if _, ok := send.Values[2].(*ast.SliceExpr); !ok {
+		t.Errorf("expected SliceExpr, got %T", send.Values[2])
+	}
+}
+
 func TestVariantProtocolDecl(t *testing.T) {
 	input := `PROTOCOL MSG
   CASE
@@ -1843,132 +2146,664 @@ func TestVariantProtocolDeclDottedTags(t *testing.T) {
 	}
 }
 
-func TestChanDeclWithProtocol(t *testing.T) {
-	input := `PROTOCOL SIGNAL IS INT
-CHAN OF SIGNAL c:
+func TestProtocolExtends(t *testing.T) {
+	input := `PROTOCOL BASE
+  CASE
+    num; INT
+    stop
+:
+PROTOCOL EXT EXTENDS BASE
+  CASE
+    text; BYTE
+:
+PROTOCOL MORE EXTENDS EXT
+  CASE
+    pair; INT; INT
+:
 `
-	l := lexer.New(input)
-	p := New(l)
+	p := New(lexer.New(input))
 	program := p.ParseProgram()
 	checkParserErrors(t, p)
 
-	if len(program.Statements) != 2 {
-		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
-	}
-
-	chanDecl, ok := program.Statements[1].(*ast.ChanDecl)
+	more, ok := program.Statements[2].(*ast.ProtocolDecl)
 	if !ok {
-		t.Fatalf("expected ChanDecl, got %T", program.Statements[1])
+		t.Fatalf("expected ProtocolDecl, got %T", program.Statements[2])
 	}
-
-	if chanDecl.ElemType != "SIGNAL" {
-		t.Errorf("expected element type 'SIGNAL', got %s", chanDecl.ElemType)
+	if more.Kind != "variant" || more.Extends != "EXT" {
+		t.Errorf("expected variant extending EXT, got %s extending %q", more.Kind, more.Extends)
 	}
-
-	if len(chanDecl.Names) != 1 || chanDecl.Names[0] != "c" {
-		t.Errorf("expected name 'c', got %v", chanDecl.Names)
+	var got []string
+	for _, v := range more.Variants {
+		got = append(got, v.Tag+"/"+v.From)
+	}
+	want := []string{"num/BASE", "stop/BASE", "text/EXT", "pair/"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected variants %v, got %v", want, got)
 	}
 }
 
-func TestSequentialSend(t *testing.T) {
-	input := `c ! 42 ; 65
+func TestDataTypeDecl(t *testing.T) {
+	input := `DATA TYPE MY.INT IS INT:
+DATA TYPE CELL
+  PACKED RECORD
+    MY.INT count:
+    BYTE ch:
+:
+DATA TYPE PAIR IS RECORD
+  INT a:
+  INT b:
+:
+MY.INT FUNCTION twice(VAL MY.INT n)
+  IS n * 2
+:
+SEQ
+  [2]MY.INT xs:
+  xs[0] := MY.INT ROUND 1
 `
-	l := lexer.New(input)
-	p := New(l)
+	p := New(lexer.New(input))
 	program := p.ParseProgram()
 	checkParserErrors(t, p)
 
-	if len(program.Statements) != 1 {
-		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	if len(program.Statements) != 5 {
+		t.Fatalf("expected 5 statements, got %d", len(program.Statements))
 	}
-
-	send, ok := program.Statements[0].(*ast.Send)
+	dt, ok := program.Statements[0].(*ast.DataTypeDecl)
 	if !ok {
-		t.Fatalf("expected Send, got %T", program.Statements[0])
+		t.Fatalf("expected DataTypeDecl, got %T", program.Statements[0])
 	}
-
-	if send.Channel != "c" {
-		t.Errorf("expected channel 'c', got %s", send.Channel)
+	if dt.Name != "MY.INT" || dt.Type != "INT" {
+		t.Errorf("expected MY.INT IS INT, got %s IS %s", dt.Name, dt.Type)
 	}
-
-	// First value
-	intLit, ok := send.Value.(*ast.IntegerLiteral)
-	if !ok {
-		t.Fatalf("expected IntegerLiteral for Value, got %T", send.Value)
+	for i, name := range []string{"CELL", "PAIR"} {
+		rec, ok := program.Statements[i+1].(*ast.RecordDecl)
+		if !ok {
+			t.Fatalf("expected RecordDecl, got %T", program.Statements[i+1])
+		}
+		if rec.Name != name || !rec.DataType || len(rec.Fields) != 2 {
+			t.Errorf("expected DATA TYPE %s with 2 fields, got %s (DataType=%v) with %d", name, rec.Name, rec.DataType, len(rec.Fields))
+		}
 	}
-	if intLit.Value != 42 {
-		t.Errorf("expected value 42, got %d", intLit.Value)
+	if cell := program.Statements[1].(*ast.RecordDecl); cell.Fields[0].Type != "MY.INT" {
+		t.Errorf("expected field count of type MY.INT, got %s", cell.Fields[0].Type)
 	}
-
-	// Additional values
-	if len(send.Values) != 1 {
-		t.Fatalf("expected 1 additional value, got %d", len(send.Values))
+	fn, ok := program.Statements[3].(*ast.FuncDecl)
+	if !ok {
+		t.Fatalf("expected FuncDecl, got %T", program.Statements[3])
 	}
-	intLit2, ok := send.Values[0].(*ast.IntegerLiteral)
+	if len(fn.ReturnTypes) != 1 || fn.ReturnTypes[0] != "MY.INT" {
+		t.Errorf("expected MY.INT return type, got %v", fn.ReturnTypes)
+	}
+	seq := program.Statements[4].(*ast.SeqBlock)
+	assign, ok := seq.Statements[1].(*ast.Assignment)
 	if !ok {
-		t.Fatalf("expected IntegerLiteral for Values[0], got %T", send.Values[0])
+		t.Fatalf("expected Assignment, got %T", seq.Statements[1])
 	}
-	if intLit2.Value != 65 {
-		t.Errorf("expected value 65, got %d", intLit2.Value)
+	conv, ok := assign.Value.(*ast.TypeConversion)
+	if !ok || conv.TargetType != "MY.INT" || conv.Qualifier != "ROUND" {
+		t.Errorf("expected MY.INT ROUND conversion, got %#v", assign.Value)
 	}
 }
 
-func TestRecordDecl(t *testing.T) {
-	input := `RECORD POINT
-  INT x:
-  INT y:
+func TestChanType(t *testing.T) {
+	input := `CHAN TYPE ADDER
+  MOBILE RECORD
+    CHAN INT req?:
+    CHAN INT resp!:
+:
+PROC client(SHARED ADDER! cli, ADDER? svr)
+  CLAIM cli
+    cli[req] ! 1
+:
+PROC main()
+  ADDER? svr:
+  SHARED ADDER! cli:
+  svr, cli := MOBILE ADDER
+:
 `
-	l := lexer.New(input)
-	p := New(l)
+	p := New(lexer.New(input))
 	program := p.ParseProgram()
 	checkParserErrors(t, p)
 
-	if len(program.Statements) != 1 {
-		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
-	}
-
 	rec, ok := program.Statements[0].(*ast.RecordDecl)
 	if !ok {
 		t.Fatalf("expected RecordDecl, got %T", program.Statements[0])
 	}
-
-	if rec.Name != "POINT" {
-		t.Errorf("expected name 'POINT', got %s", rec.Name)
+	if !rec.ChanType || len(rec.Fields) != 2 {
+		t.Fatalf("expected CHAN TYPE with 2 fields, got ChanType=%v with %d", rec.ChanType, len(rec.Fields))
 	}
-
-	if len(rec.Fields) != 2 {
-		t.Fatalf("expected 2 fields, got %d", len(rec.Fields))
+	for i, want := range []string{"req?", "resp!"} {
+		if f := rec.Fields[i]; !f.IsChan || f.Type != "INT" || f.Name+f.Dir != want {
+			t.Errorf("field %d: expected CHAN INT %s, got %+v", i, want, f)
+		}
 	}
 
-	if rec.Fields[0].Type != "INT" || rec.Fields[0].Name != "x" {
-		t.Errorf("expected field 0: INT x, got %s %s", rec.Fields[0].Type, rec.Fields[0].Name)
+	client := program.Statements[1].(*ast.ProcDecl)
+	if p := client.Params[0]; p.Type != "ADDER" || p.ChanDir != "!" || !p.Shared {
+		t.Errorf("expected SHARED ADDER! param, got %+v", p)
+	}
+	if p := client.Params[1]; p.Type != "ADDER" || p.ChanDir != "?" || p.Shared {
+		t.Errorf("expected ADDER? param, got %+v", p)
+	}
+	claim, ok := client.Body[0].(*ast.ClaimBlock)
+	if !ok || claim.Name != "cli" || len(claim.Body) != 1 {
+		t.Fatalf("expected CLAIM cli with one process, got %#v", client.Body[0])
 	}
 
-	if rec.Fields[1].Type != "INT" || rec.Fields[1].Name != "y" {
-		t.Errorf("expected field 1: INT y, got %s %s", rec.Fields[1].Type, rec.Fields[1].Name)
+	body := program.Statements[2].(*ast.ProcDecl).Body
+	if d := body[1].(*ast.VarDecl); d.Type != "ADDER" || d.End != "!" || !d.Shared {
+		t.Errorf("expected SHARED ADDER! declaration, got %+v", d)
+	}
+	assign, ok := body[2].(*ast.MultiAssignment)
+	if !ok {
+		t.Fatalf("expected MultiAssignment, got %T", body[2])
+	}
+	if m, ok := assign.Values[0].(*ast.MobileExpr); !ok || m.Type != "ADDER" {
+		t.Errorf("expected MOBILE ADDER, got %#v", assign.Values[0])
 	}
 }
 
-func TestRecordDeclMultipleFieldNames(t *testing.T) {
-	input := `RECORD R
-  INT a, b:
+func TestSharedChan(t *testing.T) {
+	input := `PROC writer(SHARED CHAN OF INT out!, log!)
+  CLAIM out!
+    out ! 1
+:
+PROC main()
+  SHARED CHAN OF INT c:
+  CLAIM c
+    c ! 2
+:
 `
-	l := lexer.New(input)
-	p := New(l)
+	p := New(lexer.New(input))
 	program := p.ParseProgram()
 	checkParserErrors(t, p)
 
-	if len(program.Statements) != 1 {
-		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	writer := program.Statements[0].(*ast.ProcDecl)
+	for _, p := range writer.Params {
+		if !p.IsChan || !p.Shared || p.ChanDir != "!" {
+			t.Errorf("expected SHARED CHAN OF INT param, got %+v", p)
+		}
 	}
-
-	rec, ok := program.Statements[0].(*ast.RecordDecl)
-	if !ok {
-		t.Fatalf("expected RecordDecl, got %T", program.Statements[0])
+	if claim, ok := writer.Body[0].(*ast.ClaimBlock); !ok || claim.Name != "out" || claim.End != "!" {
+		t.Errorf("expected CLAIM out!, got %#v", writer.Body[0])
 	}
 
-	if len(rec.Fields) != 2 {
-		t.Fatalf("expected 2 fields, got %d", len(rec.Fields))
+	body := program.Statements[1].(*ast.ProcDecl).Body
+	if d, ok := body[0].(*ast.ChanDecl); !ok || !d.Shared || d.ElemType != "INT" {
+		t.Errorf("expected SHARED CHAN OF INT declaration, got %#v", body[0])
+	}
+	if claim, ok := body[1].(*ast.ClaimBlock); !ok || claim.Name != "c" || claim.End != "" {
+		t.Errorf("expected CLAIM c, got %#v", body[1])
+	}
+}
+
+func TestMobileData(t *testing.T) {
+	input := `PROC pass(CHAN MOBILE []BYTE in?, CHAN OF MOBILE []BYTE out!, MOBILE []BYTE spare, MOBILE INT n)
+  MOBILE []BYTE buf:
+  MOBILE INT x:
+  SEQ
+    buf := MOBILE [n]BYTE
+    in ? buf
+    out ! buf
+:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	proc := program.Statements[0].(*ast.ProcDecl)
+	for i, want := range []string{"[]BYTE", "[]BYTE"} {
+		if p := proc.Params[i]; !p.IsChan || p.ChanElemType != want {
+			t.Errorf("param %d: expected CHAN MOBILE %s, got %+v", i, want, p)
+		}
+	}
+	if p := proc.Params[2]; !p.Mobile || p.OpenArrayDims != 1 || p.Type != "BYTE" {
+		t.Errorf("expected MOBILE []BYTE param, got %+v", p)
+	}
+	if p := proc.Params[3]; !p.Mobile || p.Type != "INT" {
+		t.Errorf("expected MOBILE INT param, got %+v", p)
+	}
+
+	arr, ok := proc.Body[0].(*ast.ArrayDecl)
+	if !ok || !arr.Mobile || arr.Type != "BYTE" || len(arr.Sizes) != 1 || arr.Sizes[0] != nil {
+		t.Errorf("expected MOBILE []BYTE declaration, got %#v", proc.Body[0])
+	}
+	if v, ok := proc.Body[1].(*ast.VarDecl); !ok || !v.Mobile || v.Type != "INT" {
+		t.Errorf("expected MOBILE INT declaration, got %#v", proc.Body[1])
+	}
+	assign := proc.Body[2].(*ast.SeqBlock).Statements[0].(*ast.Assignment)
+	if m, ok := assign.Value.(*ast.MobileExpr); !ok || m.Type != "BYTE" || m.Size == nil {
+		t.Errorf("expected MOBILE [n]BYTE, got %#v", assign.Value)
+	}
+}
+
+func TestMobileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		input, want string
+	}{
+		{"MOBILE BARRIER b:\n", "MOBILE BARRIER is not supported"},
+		{"MOBILE [][]INT grid:\n", "MOBILE arrays have one dimension"},
+		{"x := MOBILE [2][2]INT\n", "MOBILE arrays have one dimension"},
+	} {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		if errs := p.Errors(); len(errs) == 0 || !strings.Contains(errs[0], tt.want) {
+			t.Errorf("%q: expected error %q, got %v", tt.input, tt.want, errs)
+		}
+	}
+}
+
+func TestForking(t *testing.T) {
+	input := `PROC spawn(CHAN OF INT out!)
+  FORKING
+    SEQ i = 0 FOR 3
+      FORK worker(i, out!)
+:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	proc := program.Statements[0].(*ast.ProcDecl)
+	forking, ok := proc.Body[0].(*ast.ForkingBlock)
+	if !ok || len(forking.Body) != 1 {
+		t.Fatalf("expected FORKING block, got %#v", proc.Body[0])
+	}
+	seq := forking.Body[0].(*ast.SeqBlock)
+	fork, ok := seq.Statements[0].(*ast.ForkStmt)
+	if !ok || fork.Call.Name != "worker" || len(fork.Call.Args) != 2 {
+		t.Errorf("expected FORK worker(i, out!), got %#v", seq.Statements[0])
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	input := `PROC phases(BARRIER b)
+  BARRIER c, d:
+  PAR i = 0 FOR 2 ENROLL b, c
+    SYNC b
+:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	proc := program.Statements[0].(*ast.ProcDecl)
+	if len(proc.Params) != 1 || proc.Params[0].Type != "BARRIER" || proc.Params[0].IsVal {
+		t.Errorf("expected a BARRIER param, got %#v", proc.Params)
+	}
+	decl, ok := proc.Body[0].(*ast.BarrierDecl)
+	if !ok || strings.Join(decl.Names, " ") != "c d" {
+		t.Fatalf("expected BARRIER c, d:, got %#v", proc.Body[0])
+	}
+	par, ok := proc.Body[1].(*ast.ParBlock)
+	if !ok || par.Replicator == nil || strings.Join(par.Enroll, " ") != "b c" {
+		t.Fatalf("expected PAR i = 0 FOR 2 ENROLL b, c, got %#v", proc.Body[1])
+	}
+	sync, ok := par.Statements[0].(*ast.SyncStmt)
+	if !ok || sync.Barrier != "b" {
+		t.Errorf("expected SYNC b, got %#v", par.Statements[0])
+	}
+}
+
+func TestParamTypeRef(t *testing.T) {
+	input := `PROC fan([4][]CHAN OF MOBILE []BYTE links, VAL [2][3]INT grid, BYTE b, c)
+  SKIP
+:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	proc := program.Statements[0].(*ast.ProcDecl)
+	links := proc.Params[0]
+	dims, elem := links.TypeRef.Dims()
+	if dims != 2 || elem.Kind != ast.ChanType || elem.Elem.Kind != ast.ArrayType || !elem.Elem.Mobile || elem.Elem.Elem.Name != "BYTE" {
+		t.Fatalf("expected [4][]CHAN OF MOBILE []BYTE, got %d dims of %+v", dims, elem)
+	}
+	if sizes := links.TypeRef.Sizes(); len(sizes) != 2 || sizes[1] != nil {
+		t.Errorf("expected sizes [4 nil], got %v", sizes)
+	}
+	if !links.IsChan || links.ChanArrayDims != 2 || links.ChanElemType != "[]BYTE" || links.ArraySize != "4" {
+		t.Errorf("flat fields not derived from type: %+v", links)
+	}
+
+	grid := proc.Params[1]
+	if !grid.IsVal || grid.OpenArrayDims != 2 || grid.ArraySize != "2" || grid.Type != "INT" {
+		t.Errorf("expected VAL [2][3]INT, got %+v", grid)
+	}
+	if c := proc.Params[3]; c.TypeRef != proc.Params[2].TypeRef || !c.TypeRef.IsData() || c.Type != "BYTE" {
+		t.Errorf("expected c to share BYTE with b, got %+v", c)
+	}
+}
+
+func TestDeclTypeRef(t *testing.T) {
+	input := `PROTOCOL MSG
+  CASE
+    data ; INT32::[]BYTE ; [4]INT
+:
+INT, [2]REAL32 FUNCTION f(VAL INT n)
+  IS n, [1.0(REAL32), 2.0(REAL32)]
+:
+PROC p()
+  MOBILE []BYTE buf:
+  [2][3]INT grid:
+  [4]CHAN OF MOBILE []BYTE links:
+  VAL [3]INT primes IS [2, 3, 5]:
+  []CHAN OF MOBILE []BYTE mine IS [links FROM 0 FOR 2]:
+  SKIP
+:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	items := program.Statements[0].(*ast.ProtocolDecl).Variants[0].Items
+	if len(items) != 2 || items[0].Kind != ast.CountedType || items[0].Count.Name != "INT32" || items[0].Elem.Name != "BYTE" {
+		t.Fatalf("expected a counted INT32::[]BYTE item, got %+v", items)
+	}
+	if items[1].Kind != ast.ArrayType || items[1].ItemName() != "[4]INT" {
+		t.Errorf("expected a [4]INT item, got %+v", items[1])
+	}
+
+	fn := program.Statements[1].(*ast.FuncDecl)
+	if len(fn.Results) != 2 || fn.Results[0].Name != "INT" || fn.Results[1].Kind != ast.ArrayType || fn.Results[1].Size == nil {
+		t.Errorf("expected results INT and [2]REAL32, got %+v", fn.Results)
+	}
+	if fn.ReturnTypes[1] != "[]REAL32" {
+		t.Errorf("expected ReturnTypes derived from Results, got %v", fn.ReturnTypes)
+	}
+
+	body := program.Statements[2].(*ast.ProcDecl).Body
+	buf := body[0].(*ast.ArrayDecl)
+	if !buf.TypeRef.Mobile || buf.TypeRef.Kind != ast.ArrayType || buf.TypeRef.Size != nil {
+		t.Errorf("expected MOBILE []BYTE, got %+v", buf.TypeRef)
+	}
+	grid := body[1].(*ast.ArrayDecl)
+	if dims, elem := grid.TypeRef.Dims(); dims != 2 || elem.Name != "INT" || len(grid.TypeRef.Sizes()) != 2 {
+		t.Errorf("expected [2][3]INT, got %+v", grid.TypeRef)
+	}
+	links := body[2].(*ast.ChanDecl)
+	if dims, ch := links.TypeRef.Dims(); dims != 1 || ch.Kind != ast.ChanType || !ch.Elem.Mobile || links.ElemType != "[]BYTE" {
+		t.Errorf("expected [4]CHAN OF MOBILE []BYTE, got %+v", links.TypeRef)
+	}
+	primes := body[3].(*ast.Abbreviation)
+	if primes.TypeRef.Size == nil || primes.OpenArrayDims != 1 || primes.Type != "INT" {
+		t.Errorf("expected VAL [3]INT, got %+v", primes)
+	}
+	mine := body[4].(*ast.Abbreviation)
+	if !mine.IsChan || mine.OpenArrayDims != 1 || mine.Type != "[]BYTE" {
+		t.Errorf("expected []CHAN OF MOBILE []BYTE, got %+v", mine)
+	}
+}
+
+func TestArrayOfRecords(t *testing.T) {
+	input := `DATA TYPE POINT
+  RECORD
+    INT x:
+    INT y:
+:
+VAL INT n IS 2:
+PROTOCOL BLOCK IS [n * 2]POINT
+PROC p([3]POINT ps)
+  [2]POINT qs:
+  [2][n]POINT grid:
+  []POINT rs IS qs:
+  SKIP
+:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if block := program.Statements[2].(*ast.ProtocolDecl); block.Types[0] != "[n * 2]POINT" {
+		t.Errorf("expected a [n * 2]POINT item, got %v", block.Types)
+	}
+	proc := program.Statements[3].(*ast.ProcDecl)
+	if ps := proc.Params[0]; ps.Type != "POINT" || ps.ArraySize != "3" {
+		t.Errorf("expected [3]POINT, got %+v", ps)
+	}
+	qs, ok := proc.Body[0].(*ast.ArrayDecl)
+	if !ok {
+		t.Fatalf("expected ArrayDecl, got %T", proc.Body[0])
+	}
+	if dims, elem := qs.TypeRef.Dims(); dims != 1 || elem.Kind != ast.NamedType || qs.Type != "POINT" {
+		t.Errorf("expected [2]POINT, got %+v", qs.TypeRef)
+	}
+	grid := proc.Body[1].(*ast.ArrayDecl)
+	if dims, elem := grid.TypeRef.Dims(); dims != 2 || elem.Name != "POINT" {
+		t.Errorf("expected [2][n]POINT, got %+v", grid.TypeRef)
+	}
+	rs := proc.Body[2].(*ast.Abbreviation)
+	if rs.Type != "POINT" || !rs.TypeRef.IsDataArray() {
+		t.Errorf("expected []POINT abbreviation, got %+v", rs)
+	}
+}
+
+func TestTypesDeclaredAfterUse(t *testing.T) {
+	input := `PROC p(CELL cell, CHAN OF MSG out!)
+  CELL copy:
+  SEQ
+    copy := cell
+    out ! num; copy[n]
+:
+DATA TYPE CELL
+  RECORD
+    INT n:
+:
+PROTOCOL MSG
+  CASE
+    num; INT
+:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	proc := program.Statements[0].(*ast.ProcDecl)
+	if len(proc.Params) != 2 || proc.Params[0].Type != "CELL" || !proc.Params[1].IsChan {
+		t.Fatalf("expected params (CELL cell, CHAN OF MSG out!), got %+v", proc.Params)
+	}
+	if v, ok := proc.Body[0].(*ast.VarDecl); !ok || v.Type != "CELL" {
+		t.Errorf("expected CELL declaration, got %#v", proc.Body[0])
+	}
+	send := proc.Body[1].(*ast.SeqBlock).Statements[1].(*ast.Send)
+	if send.VariantTag != "num" || len(send.Values) != 1 {
+		t.Errorf("expected variant send of num, got %#v", send)
+	}
+}
+
+func TestProtocolExtendsErrors(t *testing.T) {
+	input := `PROTOCOL BASE
+  CASE
+    num; INT
+:
+PROTOCOL PAIR IS INT; INT
+PROTOCOL EXT EXTENDS BASE
+  CASE
+    num; BYTE
+    text; BYTE
+:
+PROTOCOL BAD EXTENDS PAIR
+  CASE
+    other
+:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	want := []string{
+		"line 8:10: PROTOCOL EXT: tag num is already declared in PROTOCOL BASE",
+		"line 11:22: PROTOCOL BAD cannot extend PAIR, which is not a variant PROTOCOL",
+	}
+	errs := p.Errors()
+	if len(errs) != len(want) {
+		t.Fatalf("expected errors %v, got %v", want, errs)
+	}
+	for i := range want {
+		if !strings.Contains(errs[i], want[i]) {
+			t.Errorf("expected error %q, got %q", want[i], errs[i])
+		}
+	}
+	ext := program.Statements[2].(*ast.ProtocolDecl)
+	if len(ext.Variants) != 2 || ext.Variants[1].Tag != "text" {
+		t.Errorf("expected num from BASE then text, got %v", ext.Variants)
+	}
+}
+
+func TestChanDeclWithProtocol(t *testing.T) {
+	input := `PROTOCOL SIGNAL IS INT
+CHAN OF SIGNAL c:
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+
+	chanDecl, ok := program.Statements[1].(*ast.ChanDecl)
+	if !ok {
+		t.Fatalf("expected ChanDecl, got %T", program.Statements[1])
+	}
+
+	if chanDecl.ElemType != "SIGNAL" {
+		t.Errorf("expected element type 'SIGNAL', got %s", chanDecl.ElemType)
+	}
+
+	if len(chanDecl.Names) != 1 || chanDecl.Names[0] != "c" {
+		t.Errorf("expected name 'c', got %v", chanDecl.Names)
+	}
+}
+
+func TestSequentialSend(t *testing.T) {
+	input := `c ! 42 ; 65
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	}
+
+	send, ok := program.Statements[0].(*ast.Send)
+	if !ok {
+		t.Fatalf("expected Send, got %T", program.Statements[0])
+	}
+
+	if send.Channel != "c" {
+		t.Errorf("expected channel 'c', got %s", send.Channel)
+	}
+
+	// First value
+	intLit, ok := send.Value.(*ast.IntegerLiteral)
+	if !ok {
+		t.Fatalf("expected IntegerLiteral for Value, got %T", send.Value)
+	}
+	if intLit.Value != 42 {
+		t.Errorf("expected value 42, got %d", intLit.Value)
+	}
+
+	// Additional values
+	if len(send.Values) != 1 {
+		t.Fatalf("expected 1 additional value, got %d", len(send.Values))
+	}
+	intLit2, ok := send.Values[0].(*ast.IntegerLiteral)
+	if !ok {
+		t.Fatalf("expected IntegerLiteral for Values[0], got %T", send.Values[0])
+	}
+	if intLit2.Value != 65 {
+		t.Errorf("expected value 65, got %d", intLit2.Value)
+	}
+}
+
+func TestRecordDecl(t *testing.T) {
+	input := `RECORD POINT
+  INT x:
+  INT y:
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	}
+
+	rec, ok := program.Statements[0].(*ast.RecordDecl)
+	if !ok {
+		t.Fatalf("expected RecordDecl, got %T", program.Statements[0])
+	}
+
+	if rec.Name != "POINT" {
+		t.Errorf("expected name 'POINT', got %s", rec.Name)
+	}
+
+	if len(rec.Fields) != 2 {
+		t.Fatalf("expected 2 fields, got %d", len(rec.Fields))
+	}
+
+	if rec.Fields[0].Type != "INT" || rec.Fields[0].Name != "x" {
+		t.Errorf("expected field 0: INT x, got %s %s", rec.Fields[0].Type, rec.Fields[0].Name)
+	}
+
+	if rec.Fields[1].Type != "INT" || rec.Fields[1].Name != "y" {
+		t.Errorf("expected field 1: INT y, got %s %s", rec.Fields[1].Type, rec.Fields[1].Name)
+	}
+}
+
+func TestValRecordAbbreviation(t *testing.T) {
+	input := `DATA TYPE POINT
+  RECORD
+    INT x:
+    INT y:
+:
+VAL POINT origin IS [0, 0]:
+VAL []POINT corners IS [[1, 2], [3, 4]]:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(program.Statements))
+	}
+	for i, dims := range []int{0, 1} {
+		abbr, ok := program.Statements[i+1].(*ast.Abbreviation)
+		if !ok {
+			t.Fatalf("expected Abbreviation, got %T", program.Statements[i+1])
+		}
+		if !abbr.IsVal || abbr.Type != "POINT" || abbr.OpenArrayDims != dims {
+			t.Errorf("expected VAL POINT with %d dims, got %+v", dims, abbr)
+		}
+		if _, ok := abbr.Value.(*ast.ArrayLiteral); !ok {
+			t.Errorf("expected ArrayLiteral value, got %T", abbr.Value)
+		}
+	}
+}
+
+func TestRecordDeclMultipleFieldNames(t *testing.T) {
+	input := `RECORD R
+  INT a, b:
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	}
+
+	rec, ok := program.Statements[0].(*ast.RecordDecl)
+	if !ok {
+		t.Fatalf("expected RecordDecl, got %T", program.Statements[0])
+	}
+
+	if len(rec.Fields) != 2 {
+		t.Fatalf("expected 2 fields, got %d", len(rec.Fields))
 	}
 
 	if rec.Fields[0].Type != "INT" || rec.Fields[0].Name != "a" {
@@ -1980,6 +2815,38 @@ func TestRecordDeclMultipleFieldNames(t *testing.T) {
 	}
 }
 
+func TestRecordDeclChanFields(t *testing.T) {
+	input := `RECORD PORTS
+  CHAN OF CMD req, ctl:
+  CHAN OF INT reply:
+  INT id:
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	rec, ok := program.Statements[0].(*ast.RecordDecl)
+	if !ok {
+		t.Fatalf("expected RecordDecl, got %T", program.Statements[0])
+	}
+
+	expected := []ast.RecordField{
+		{Type: "CMD", Name: "req", IsChan: true},
+		{Type: "CMD", Name: "ctl", IsChan: true},
+		{Type: "INT", Name: "reply", IsChan: true},
+		{Type: "INT", Name: "id"},
+	}
+	if len(rec.Fields) != len(expected) {
+		t.Fatalf("expected %d fields, got %d", len(expected), len(rec.Fields))
+	}
+	for i, f := range expected {
+		if rec.Fields[i] != f {
+			t.Errorf("field %d: expected %+v, got %+v", i, f, rec.Fields[i])
+		}
+	}
+}
+
 func TestRecordVarDecl(t *testing.T) {
 	input := `RECORD POINT
   INT x:
@@ -2603,6 +3470,77 @@ func TestNonValAbbreviation(t *testing.T) {
 	}
 }
 
+func TestNonValArrayAbbreviation(t *testing.T) {
+	tests := []struct {
+		input string
+		dims  int
+		slice bool
+	}{
+		{"[]INT row IS grid[i]:\n", 1, false},
+		{"[]BYTE line IS [buf FROM 0 FOR n]:\n", 1, true},
+		{"[][]INT g IS grids[k]:\n", 2, false},
+		{"[4]INT row IS grid[2]:\n", 1, false},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		abbr, ok := program.Statements[0].(*ast.Abbreviation)
+		if !ok {
+			t.Fatalf("%q: expected Abbreviation, got %T", tt.input, program.Statements[0])
+		}
+		if abbr.IsVal || abbr.OpenArrayDims != tt.dims {
+			t.Errorf("%q: expected non-VAL with OpenArrayDims=%d, got IsVal=%v OpenArrayDims=%d", tt.input, tt.dims, abbr.IsVal, abbr.OpenArrayDims)
+		}
+		if _, isSlice := abbr.Value.(*ast.SliceExpr); isSlice != tt.slice {
+			t.Errorf("%q: expected a slice value %v, got %T", tt.input, tt.slice, abbr.Value)
+		}
+	}
+}
+
+func TestChanAbbreviation(t *testing.T) {
+	tests := []struct {
+		input string
+		dims  int
+		dir   string
+		elem  string
+	}{
+		{"CHAN OF INT c IS links[i]:\n", 0, "", "INT"},
+		{"CHAN BOOL c! IS flags[0]:\n", 0, "!", "BOOL"},
+		{"CHAN OF INT c IS in?:\n", 0, "?", "INT"},
+		{"[]CHAN OF PAIR mine IS [links FROM base FOR n]:\n", 1, "", "PAIR"},
+		{"[2]CHAN OF INT two! IS [links FOR 2]:\n", 1, "!", "INT"},
+		{"[][]CHAN INT grid IS net:\n", 2, "", "INT"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		abbr, ok := program.Statements[0].(*ast.Abbreviation)
+		if !ok {
+			t.Fatalf("%q: expected Abbreviation, got %T", tt.input, program.Statements[0])
+		}
+		if !abbr.IsChan || abbr.OpenArrayDims != tt.dims || abbr.ChanDir != tt.dir || abbr.Type != tt.elem {
+			t.Errorf("%q: expected CHAN abbreviation of %s with OpenArrayDims=%d ChanDir=%q, got IsChan=%v %s OpenArrayDims=%d ChanDir=%q",
+				tt.input, tt.elem, tt.dims, tt.dir, abbr.IsChan, abbr.Type, abbr.OpenArrayDims, abbr.ChanDir)
+		}
+	}
+
+	p := New(lexer.New("CHAN OF INT c! IS in?:\n"))
+	p.ParseProgram()
+	if errs := p.Errors(); len(errs) == 0 || !strings.Contains(errs[0], "cannot abbreviate the ? end of a channel as c!") {
+		t.Errorf("expected an error for abbreviating the other end, got %v", errs)
+	}
+}
+
 func TestValBoolAbbreviation(t *testing.T) {
 	input := `VAL BOOL flag IS TRUE:
 `
@@ -2895,6 +3833,42 @@ func TestHexIntegerLiteral(t *testing.T) {
 	}
 }
 
+func TestRealLiteral(t *testing.T) {
+	tests := []struct {
+		input string
+		value float64
+		typ   string
+	}{
+		{"x := 2.5\n", 2.5, ""},
+		{"x := 1.0E-6\n", 1e-6, ""},
+		{"x := 3.14159(REAL32)\n", 3.14159, "REAL32"},
+		{"x := 6.0E+2(REAL64)\n", 600, "REAL64"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		assign, ok := program.Statements[0].(*ast.Assignment)
+		if !ok {
+			t.Fatalf("%q: expected Assignment, got %T", tt.input, program.Statements[0])
+		}
+		lit, ok := assign.Value.(*ast.RealLiteral)
+		if !ok {
+			t.Fatalf("%q: expected RealLiteral, got %T", tt.input, assign.Value)
+		}
+		if lit.Value != tt.value || lit.Type != tt.typ {
+			t.Errorf("%q: expected %v(%s), got %v(%s)", tt.input, tt.value, tt.typ, lit.Value, lit.Type)
+		}
+	}
+
+	p := New(lexer.New("x := 2.5(INT)\n"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || !strings.Contains(p.Errors()[0], "expected REAL32 or REAL64") {
+		t.Errorf("expected an error for an INT decoration, got %q", p.Errors())
+	}
+}
+
 func TestHexIntegerLiteralLarge(t *testing.T) {
 	input := `x := #80000000
 `
@@ -3298,6 +4272,32 @@ func TestArrayLiteral(t *testing.T) {
 	}
 }
 
+func TestArrayLiteralDecoration(t *testing.T) {
+	input := `VAL x IS [[1, 2], [3, 4]](INT32) :
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	abbr := program.Statements[0].(*ast.Abbreviation)
+	arr, ok := abbr.Value.(*ast.ArrayLiteral)
+	if !ok {
+		t.Fatalf("expected ArrayLiteral, got %T", abbr.Value)
+	}
+	if arr.Type != "INT32" {
+		t.Errorf("expected type INT32, got %q", arr.Type)
+	}
+	if len(arr.Elements) != 2 {
+		t.Fatalf("expected 2 elements, got %d", len(arr.Elements))
+	}
+	for i, el := range arr.Elements {
+		inner, ok := el.(*ast.ArrayLiteral)
+		if !ok || len(inner.Elements) != 2 || inner.Type != "" {
+			t.Errorf("element %d: expected an undecorated 2-element ArrayLiteral, got %#v", i, el)
+		}
+	}
+}
+
 func TestRetypesDecl(t *testing.T) {
 	input := `VAL INT X RETYPES Y :
 `
@@ -3324,11 +4324,11 @@ func TestRetypesDecl(t *testing.T) {
 	if rt.Name != "X" {
 		t.Errorf("expected Name 'X', got %q", rt.Name)
 	}
-	if rt.Source != "Y" {
-		t.Errorf("expected Source 'Y', got %q", rt.Source)
+	if src, ok := rt.Source.(*ast.Identifier); !ok || src.Value != "Y" {
+		t.Errorf("expected Source 'Y', got %v", rt.Source)
 	}
-	if rt.IsArray {
-		t.Error("expected IsArray to be false")
+	if len(rt.Sizes) != 0 {
+		t.Error("expected no Sizes")
 	}
 }
 
@@ -3358,21 +4358,57 @@ func TestRetypesDeclArray(t *testing.T) {
 	if rt.Name != "X" {
 		t.Errorf("expected Name 'X', got %q", rt.Name)
 	}
-	if rt.Source != "Y" {
-		t.Errorf("expected Source 'Y', got %q", rt.Source)
-	}
-	if !rt.IsArray {
-		t.Error("expected IsArray to be true")
+	if src, ok := rt.Source.(*ast.Identifier); !ok || src.Value != "Y" {
+		t.Errorf("expected Source 'Y', got %v", rt.Source)
 	}
-	if rt.ArraySize == nil {
-		t.Fatal("expected non-nil ArraySize")
+	if len(rt.Sizes) != 1 {
+		t.Fatalf("expected 1 size, got %d", len(rt.Sizes))
 	}
-	sizelit, ok := rt.ArraySize.(*ast.IntegerLiteral)
+	sizelit, ok := rt.Sizes[0].(*ast.IntegerLiteral)
 	if !ok {
-		t.Fatalf("expected IntegerLiteral for ArraySize, got %T", rt.ArraySize)
+		t.Fatalf("expected IntegerLiteral for Sizes[0], got %T", rt.Sizes[0])
 	}
 	if sizelit.Value != 2 {
-		t.Errorf("expected ArraySize 2, got %d", sizelit.Value)
+		t.Errorf("expected size 2, got %d", sizelit.Value)
+	}
+}
+
+func TestRetypesForms(t *testing.T) {
+	tests := []struct {
+		input    string
+		isVal    bool
+		reshapes bool
+		typ      string
+		sizes    int
+		open     bool
+	}{
+		{"INT w RETYPES bytes:\n", false, false, "INT", 0, false},
+		{"[4]BYTE b RETYPES w:\n", false, false, "BYTE", 1, false},
+		{"[]BYTE b RETYPES [words FROM 1 FOR 2]:\n", false, false, "BYTE", 1, true},
+		{"VAL [][2]INT16 pairs RETYPES r[i]:\n", true, false, "INT16", 2, true},
+		{"VAL []INT flat RESHAPES grid:\n", true, true, "INT", 1, true},
+		{"[2][3]INT g RESHAPES flat:\n", false, true, "INT", 2, false},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		rt, ok := program.Statements[0].(*ast.RetypesDecl)
+		if !ok {
+			t.Fatalf("%q: expected RetypesDecl, got %T", tt.input, program.Statements[0])
+		}
+		if rt.IsVal != tt.isVal || rt.Reshapes != tt.reshapes || rt.TargetType != tt.typ || len(rt.Sizes) != tt.sizes {
+			t.Errorf("%q: expected IsVal=%v Reshapes=%v %s with %d sizes, got IsVal=%v Reshapes=%v %s with %d sizes",
+				tt.input, tt.isVal, tt.reshapes, tt.typ, tt.sizes, rt.IsVal, rt.Reshapes, rt.TargetType, len(rt.Sizes))
+			continue
+		}
+		if tt.sizes > 0 && (rt.Sizes[0] == nil) != tt.open {
+			t.Errorf("%q: expected an open first dimension %v, got %v", tt.input, tt.open, rt.Sizes[0])
+		}
 	}
 }
 
@@ -3488,18 +4524,164 @@ func TestAltReplicator(t *testing.T) {
 	if vd.Type != "BYTE" {
 		t.Errorf("expected type 'BYTE', got %q", vd.Type)
 	}
-	if len(vd.Names) != 1 || vd.Names[0] != "ch" {
-		t.Errorf("expected name 'ch', got %v", vd.Names)
+	if len(vd.Names) != 1 || vd.Names[0] != "ch" {
+		t.Errorf("expected name 'ch', got %v", vd.Names)
+	}
+
+	if c.Channel != "in" {
+		t.Errorf("expected channel 'in', got %q", c.Channel)
+	}
+	if len(c.ChannelIndices) == 0 {
+		t.Fatal("expected channel index, got nil")
+	}
+	if c.Variable != "ch" {
+		t.Errorf("expected variable 'ch', got %q", c.Variable)
+	}
+}
+
+func TestAltCaseArrayDeclaration(t *testing.T) {
+	input := `ALT
+  [2]BYTE buf:
+  in ? buf[0]
+    SKIP
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	alt, ok := program.Statements[0].(*ast.AltBlock)
+	if !ok {
+		t.Fatalf("expected AltBlock, got %T", program.Statements[0])
+	}
+
+	c := alt.Cases[0]
+	if len(c.Declarations) != 1 {
+		t.Fatalf("expected 1 declaration, got %d", len(c.Declarations))
+	}
+	ad, ok := c.Declarations[0].(*ast.ArrayDecl)
+	if !ok {
+		t.Fatalf("expected ArrayDecl, got %T", c.Declarations[0])
+	}
+	if ad.Type != "BYTE" || len(ad.Names) != 1 || ad.Names[0] != "buf" {
+		t.Errorf("expected [2]BYTE buf, got %s %v", ad.Type, ad.Names)
+	}
+	if c.Channel != "in" || c.Variable != "buf" || len(c.VariableIndices) != 1 {
+		t.Errorf("expected in ? buf[0], got %s ? %s (%d indices)", c.Channel, c.Variable, len(c.VariableIndices))
+	}
+}
+
+func TestAltProtocolInputs(t *testing.T) {
+	input := `ALT
+  in ? x ; n :: buf
+    SKIP
+  ready & cmds[1] ? CASE
+    INT k:
+    add ; k
+      SKIP
+    quit
+      SKIP
+  other ? y
+    SKIP
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	alt, ok := program.Statements[0].(*ast.AltBlock)
+	if !ok {
+		t.Fatalf("expected AltBlock, got %T", program.Statements[0])
+	}
+	if len(alt.Cases) != 3 {
+		t.Fatalf("expected 3 cases, got %d", len(alt.Cases))
+	}
+
+	seq := alt.Cases[0]
+	if seq.Variable != "x" || len(seq.Variables) != 1 || seq.Variables[0] != "n" || len(seq.Arrays) != 2 || seq.Arrays[0] != "" || seq.Arrays[1] != "buf" {
+		t.Errorf("expected in ? x ; n :: buf, got %s ; %v (arrays %v)", seq.Variable, seq.Variables, seq.Arrays)
+	}
+
+	variant := alt.Cases[1]
+	if !variant.IsVariant || variant.Guard == nil || variant.Channel != "cmds" || len(variant.ChannelIndices) != 1 {
+		t.Fatalf("expected a guarded variant input on cmds[1], got %+v", variant)
+	}
+	if variant.Text != "ready & cmds[1] ? CASE" {
+		t.Errorf("expected the case text without its variants, got %q", variant.Text)
+	}
+	if len(variant.Body) != 1 {
+		t.Fatalf("expected the variants as the body, got %d statements", len(variant.Body))
+	}
+	vr, ok := variant.Body[0].(*ast.VariantReceive)
+	if !ok {
+		t.Fatalf("expected VariantReceive body, got %T", variant.Body[0])
+	}
+	if vr.Channel != "cmds" || len(vr.Cases) != 2 || vr.Cases[0].Tag != "add" || len(vr.Cases[0].Declarations) != 1 || vr.Cases[1].Tag != "quit" {
+		t.Errorf("expected variants add (with a declaration) and quit, got %+v", vr.Cases)
+	}
+
+	if c := alt.Cases[2]; c.Channel != "other" || c.Variable != "y" || c.IsVariant {
+		t.Errorf("expected other ? y after the variant input, got %+v", c)
+	}
+}
+
+func TestExtendedInputAndOutputGuards(t *testing.T) {
+	input := `SEQ
+  c ?? x
+    out ! x
+  cs[i] ?? y
+    SKIP
+  ALT
+    ready & d ! 1 ; 2
+      SKIP
+    e ?? z
+      out ! z
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	seq := program.Statements[0].(*ast.SeqBlock)
+	if len(seq.Statements) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(seq.Statements))
+	}
+	for i, ch := range []string{"c", "cs"} {
+		ext, ok := seq.Statements[i].(*ast.AltBlock)
+		if !ok || !ext.ExtendedInput || len(ext.Cases) != 1 {
+			t.Fatalf("expected an extended input, got %T %+v", seq.Statements[i], seq.Statements[i])
+		}
+		c := ext.Cases[0]
+		if c.Channel != ch || !c.Extended || len(c.Body) != 1 {
+			t.Errorf("expected %s ?? with its extended process, got %+v", ch, c)
+		}
+	}
+	if idx := seq.Statements[1].(*ast.AltBlock).Cases[0].ChannelIndices; len(idx) != 1 {
+		t.Errorf("expected cs[i] to keep its index, got %v", idx)
 	}
 
-	if c.Channel != "in" {
-		t.Errorf("expected channel 'in', got %q", c.Channel)
+	alt, ok := seq.Statements[2].(*ast.AltBlock)
+	if !ok || alt.ExtendedInput || len(alt.Cases) != 2 {
+		t.Fatalf("expected an ALT of 2 cases, got %+v", seq.Statements[2])
 	}
-	if len(c.ChannelIndices) == 0 {
-		t.Fatal("expected channel index, got nil")
+	out := alt.Cases[0]
+	if !out.IsOutput || out.Guard == nil || out.Channel != "d" || len(out.Body) != 2 {
+		t.Fatalf("expected a guarded output on d followed by its process, got %+v", out)
 	}
-	if c.Variable != "ch" {
-		t.Errorf("expected variable 'ch', got %q", c.Variable)
+	send, ok := out.Body[0].(*ast.Send)
+	if !ok || send.Channel != "d" || len(send.Values) != 1 {
+		t.Errorf("expected d ! 1 ; 2 to start the body, got %+v", out.Body[0])
+	}
+	if c := alt.Cases[1]; !c.Extended || c.Variable != "z" || len(c.Body) != 1 {
+		t.Errorf("expected e ?? z with its extended process, got %+v", c)
+	}
+}
+
+func TestExtendedVariantInputUnsupported(t *testing.T) {
+	p := New(lexer.New("c ?? CASE\n  quit\n    SKIP\n"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || !strings.Contains(p.Errors()[0], "?? CASE") {
+		t.Errorf("expected an error for ?? CASE, got %v", p.Errors())
 	}
 }
 
@@ -3553,6 +4735,189 @@ func TestAltReplicatorWithAbbreviation(t *testing.T) {
 	}
 }
 
+func TestNestedAlt(t *testing.T) {
+	input := `TIMER tim:
+ALT
+  ALT i = 0 FOR n
+    in[i] ? x
+      SKIP
+    ready & out[i] ! x
+      SKIP
+  PRI ALT
+    ctl ? x
+      SKIP
+  tim ? AFTER t
+    SKIP
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	alt := program.Statements[1].(*ast.AltBlock)
+	if len(alt.Cases) != 3 {
+		t.Fatalf("expected 3 cases, got %d", len(alt.Cases))
+	}
+	c := alt.Cases[0]
+	if !c.IsAlt || c.Text != "ALT i = 0 FOR n" {
+		t.Fatalf("expected a nested ALT case, got %+v", c)
+	}
+	nested := c.Body[0].(*ast.AltBlock)
+	if nested.Replicator == nil || len(nested.Cases) != 2 || !nested.Cases[1].IsOutput {
+		t.Errorf("expected a replicated ALT of an input and an output guard, got %+v", nested)
+	}
+	if c := alt.Cases[1]; !c.IsAlt || !c.Body[0].(*ast.AltBlock).Priority {
+		t.Errorf("expected a nested PRI ALT, got %+v", c)
+	}
+	if !alt.Cases[2].IsTimer {
+		t.Errorf("expected the timer case after the nested ALTs, got %+v", alt.Cases[2])
+	}
+
+	p = New(lexer.New("ALT\n  INT x:\n  ALT i = 0 FOR n\n    in[i] ? x\n      SKIP\n"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || !strings.Contains(p.Errors()[0], "declarations before a nested ALT") {
+		t.Errorf("expected an error for declarations before a nested ALT, got %v", p.Errors())
+	}
+}
+
+func TestValofExpr(t *testing.T) {
+	input := `SEQ
+  x := 1 + (VALOF
+              INT r:
+              SEQ
+                r := (y + 1) * 2
+              RESULT r
+           )
+  b := f((VALOF
+           SKIP
+           RESULT TRUE), 2)
+  z := 3
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	seq := program.Statements[0].(*ast.SeqBlock)
+	if len(seq.Statements) != 3 {
+		t.Fatalf("expected 3 statements after the VALOFs, got %d", len(seq.Statements))
+	}
+	sum := seq.Statements[0].(*ast.Assignment).Value.(*ast.BinaryExpr)
+	v, ok := sum.Right.(*ast.ValofExpr)
+	if !ok {
+		t.Fatalf("expected a VALOF operand, got %T", sum.Right)
+	}
+	if len(v.Body) != 2 || v.Result.(*ast.Identifier).Value != "r" {
+		t.Errorf("expected a declaration and a SEQ with RESULT r, got %+v", v)
+	}
+	call := seq.Statements[1].(*ast.Assignment).Value.(*ast.FuncCall)
+	if len(call.Args) != 2 {
+		t.Fatalf("expected 2 arguments, got %d", len(call.Args))
+	}
+	if v, ok := call.Args[0].(*ast.ValofExpr); !ok || len(v.Body) != 1 {
+		t.Errorf("expected a VALOF argument, got %+v", call.Args[0])
+	}
+	if a := seq.Statements[2].(*ast.Assignment); a.Name != "z" {
+		t.Errorf("expected z := 3 after the VALOFs, got %+v", a)
+	}
+
+	p = New(lexer.New("x := (VALOF\n       SKIP\n     )\n"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || !strings.Contains(p.Errors()[0], "expected RESULT") {
+		t.Errorf("expected an error for a VALOF without RESULT, got %v", p.Errors())
+	}
+}
+
+func TestValofExprSpecifications(t *testing.T) {
+	input := `SEQ
+  v := (INT s:
+        VAL INT k IS 4:
+        VALOF
+          s := k
+          RESULT s)
+  w := f((BOOL b:
+          VALOF
+            b := TRUE
+            RESULT b), (INT x) + 1)
+  z := 3
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	seq := program.Statements[0].(*ast.SeqBlock)
+	if len(seq.Statements) != 3 {
+		t.Fatalf("expected 3 statements after the VALOFs, got %d", len(seq.Statements))
+	}
+	v, ok := seq.Statements[0].(*ast.Assignment).Value.(*ast.ValofExpr)
+	if !ok {
+		t.Fatalf("expected a VALOF expression, got %T", seq.Statements[0].(*ast.Assignment).Value)
+	}
+	if len(v.Body) != 3 {
+		t.Fatalf("expected the 2 specifications and the assignment in the body, got %d statements", len(v.Body))
+	}
+	if decl, ok := v.Body[0].(*ast.VarDecl); !ok || decl.Names[0] != "s" {
+		t.Errorf("expected INT s: first, got %+v", v.Body[0])
+	}
+	if abbr, ok := v.Body[1].(*ast.Abbreviation); !ok || abbr.Name != "k" {
+		t.Errorf("expected VAL INT k IS 4: second, got %+v", v.Body[1])
+	}
+	call := seq.Statements[1].(*ast.Assignment).Value.(*ast.FuncCall)
+	if len(call.Args) != 2 {
+		t.Fatalf("expected 2 arguments, got %d", len(call.Args))
+	}
+	if v, ok := call.Args[0].(*ast.ValofExpr); !ok || len(v.Body) != 2 {
+		t.Errorf("expected a VALOF argument with a declaration, got %+v", call.Args[0])
+	}
+	if _, ok := call.Args[1].(*ast.BinaryExpr); !ok {
+		t.Errorf("expected (INT x) + 1 as the second argument, got %+v", call.Args[1])
+	}
+	if a := seq.Statements[2].(*ast.Assignment); a.Name != "z" {
+		t.Errorf("expected z := 3 after the VALOFs, got %+v", a)
+	}
+
+	p = New(lexer.New("x := (INT s:\n      s := 1\n      RESULT s)\n"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || !strings.Contains(p.Errors()[0], "before VALOF") {
+		t.Errorf("expected an error for a process before VALOF, got %v", p.Errors())
+	}
+}
+
+func TestArrayConstructor(t *testing.T) {
+	input := `VAL []INT squares IS [i = 0 FOR n | i * i]:
+x := [j = 1 FOR 4 STEP 2 | [j, j = 3]]
+y := [a = b, c]
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	ac, ok := program.Statements[0].(*ast.Abbreviation).Value.(*ast.ArrayConstructor)
+	if !ok {
+		t.Fatalf("expected an array constructor, got %T", program.Statements[0].(*ast.Abbreviation).Value)
+	}
+	if ac.Replicator.Variable != "i" || ac.Replicator.Count.(*ast.Identifier).Value != "n" || ac.Replicator.Step != nil {
+		t.Errorf("expected the replicator i = 0 FOR n, got %+v", ac.Replicator)
+	}
+	if v, ok := ac.Value.(*ast.BinaryExpr); !ok || v.Operator != "*" {
+		t.Errorf("expected the value i * i, got %+v", ac.Value)
+	}
+	ac, ok = program.Statements[1].(*ast.Assignment).Value.(*ast.ArrayConstructor)
+	if !ok || ac.Replicator.Step == nil {
+		t.Fatalf("expected an array constructor with STEP, got %+v", program.Statements[1].(*ast.Assignment).Value)
+	}
+	if al, ok := ac.Value.(*ast.ArrayLiteral); !ok || len(al.Elements) != 2 {
+		t.Errorf("expected a literal value, got %+v", ac.Value)
+	}
+	if al, ok := program.Statements[2].(*ast.Assignment).Value.(*ast.ArrayLiteral); !ok || len(al.Elements) != 2 {
+		t.Errorf("expected [a = b, c] to stay a literal, got %+v", program.Statements[2].(*ast.Assignment).Value)
+	}
+
+	p = New(lexer.New("x := [i = 0 FOR 4 i]\n"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || !strings.Contains(p.Errors()[0], "expected |") {
+		t.Errorf("expected an error for a constructor without |, got %v", p.Errors())
+	}
+}
+
 func TestInt16Int32Int64VarDecl(t *testing.T) {
 	types := []struct {
 		input    string
@@ -3927,6 +5292,58 @@ PROC test(CHAN OF CMD ch)
 	}
 }
 
+func TestVariantReceiveSpecificationsAndElse(t *testing.T) {
+	input := `PROTOCOL CMD
+  CASE
+    data; INT
+    quit
+
+PROC test(CHAN OF CMD ch)
+  ch ? CASE
+    INT n:
+    VAL INT limit IS 10:
+    data; n
+      SKIP
+    ELSE
+      SKIP
+:
+`
+	l := lexer.New(input)
+	pr := New(l)
+	program := pr.ParseProgram()
+	checkParserErrors(t, pr)
+
+	proc, ok := program.Statements[1].(*ast.ProcDecl)
+	if !ok {
+		t.Fatalf("expected ProcDecl, got %T", program.Statements[1])
+	}
+	vr, ok := proc.Body[0].(*ast.VariantReceive)
+	if !ok {
+		t.Fatalf("expected VariantReceive, got %T", proc.Body[0])
+	}
+	if len(vr.Cases) != 2 {
+		t.Fatalf("expected 2 variant cases, got %d", len(vr.Cases))
+	}
+
+	data := vr.Cases[0]
+	if data.Tag != "data" || len(data.Variables) != 1 || data.Variables[0] != "n" {
+		t.Errorf("expected data; n, got %s %v", data.Tag, data.Variables)
+	}
+	if len(data.Declarations) != 2 {
+		t.Fatalf("expected 2 declarations before data, got %d", len(data.Declarations))
+	}
+	if _, ok := data.Declarations[0].(*ast.VarDecl); !ok {
+		t.Errorf("expected VarDecl, got %T", data.Declarations[0])
+	}
+	if _, ok := data.Declarations[1].(*ast.Abbreviation); !ok {
+		t.Errorf("expected Abbreviation, got %T", data.Declarations[1])
+	}
+
+	if !vr.Cases[1].IsElse || vr.Cases[1].Tag != "" || len(vr.Cases[1].Body) != 1 {
+		t.Errorf("expected an ELSE case with a body, got %+v", vr.Cases[1])
+	}
+}
+
 func TestReceiveIndexedVariable(t *testing.T) {
 	input := `ch ? flags[0]
 `
@@ -4096,3 +5513,324 @@ func TestMixedDimProcParam(t *testing.T) {
 		t.Error("expected IsVal to be true")
 	}
 }
+
+func TestFixedSizeChanAndMultiDimParams(t *testing.T) {
+	input := `PROC f([3]CHAN OF INT cs?, [2][5]INT m)
+  SKIP
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	proc, ok := program.Statements[0].(*ast.ProcDecl)
+	if !ok {
+		t.Fatalf("expected ProcDecl, got %T", program.Statements[0])
+	}
+	if len(proc.Params) != 2 {
+		t.Fatalf("expected 2 params, got %d", len(proc.Params))
+	}
+	cs, m := proc.Params[0], proc.Params[1]
+	if cs.ChanArrayDims != 1 || cs.ChanElemType != "INT" || cs.ChanDir != "?" || cs.ArraySize != "3" {
+		t.Errorf("expected [3]CHAN OF INT cs?, got %+v", cs)
+	}
+	if m.OpenArrayDims != 2 || m.Type != "INT" || m.ArraySize != "2" {
+		t.Errorf("expected [2][5]INT m with 2 dims, got %+v", m)
+	}
+}
+
+func TestDialectRejectsExtensions(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		dialect Dialect
+		wantErr string
+	}{
+		{"chan shorthand occam2.1", "CHAN BYTE c:\n", DialectOccam21, "CHAN without OF"},
+		{"untyped VAL occam2.5", "VAL x IS 42:\n", DialectOccam25, "untyped VAL abbreviation"},
+		{"record occampi", "RECORD POINT\n  INT x:\n  INT y:\n", DialectOccamPi, "RECORD declaration without DATA TYPE"},
+		{"chan param occam2.1", "PROC p(CHAN INT c?)\n  SKIP\n:\n", DialectOccam21, "CHAN without OF"},
+		{"valof occam2.1", "x := (VALOF\n  SKIP\n  RESULT 1\n)\n", DialectOccam21, "VALOF expression"},
+		{"constructor occam2.1", "x := [i = 0 FOR 3 | i]\n", DialectOccam21, "replicated array constructor"},
+		{"barrier occam2.5", "BARRIER b:\n", DialectOccam25, "BARRIER"},
+		{"sync occam2.1", "SYNC b\n", DialectOccam21, "BARRIER"},
+		{"mobile occam2.5", "MOBILE []BYTE buf:\n", DialectOccam25, "MOBILE"},
+		{"mobile param occam2.1", "PROC p(MOBILE []BYTE b)\n  SKIP\n:\n", DialectOccam21, "MOBILE"},
+		{"shared chan occam2.5", "SHARED CHAN OF INT c:\n", DialectOccam25, "SHARED or CLAIM"},
+		{"claim occam2.1", "CLAIM c!\n  SKIP\n", DialectOccam21, "SHARED or CLAIM"},
+		{"forking occam2.5", "FORKING\n  SKIP\n", DialectOccam25, "FORKING or FORK"},
+		{"chan type occam2.5", "CHAN TYPE LINK\n  MOBILE RECORD\n    CHAN OF INT req?:\n:\n", DialectOccam25, "CHAN TYPE"},
+		{"extends occam2.5", "PROTOCOL A\n  CASE\n    stop\n:\nPROTOCOL B EXTENDS A\n  CASE\n    go\n:\n", DialectOccam25, "PROTOCOL EXTENDS"},
+		{"extended input occam2.5", "c ?? x\n  SKIP\n", DialectOccam25, "extended input (??)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(lexer.New(tt.input), WithDialect(tt.dialect))
+			p.ParseProgram()
+			errs := p.Errors()
+			if len(errs) == 0 || !strings.Contains(errs[0], tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, errs)
+			}
+		})
+	}
+}
+
+func TestDialectAcceptsExtensions(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		dialect Dialect
+	}{
+		{"chan of occam2.1", "CHAN OF BYTE c:\n", DialectOccam21},
+		{"chan shorthand occampi", "CHAN BYTE c:\n", DialectOccamPi},
+		{"untyped VAL occampi", "VAL x IS 42:\n", DialectOccamPi},
+		{"record extended", "RECORD POINT\n  INT x:\n  INT y:\n", DialectExtended},
+		{"valof occam2.5", "x := (VALOF\n  SKIP\n  RESULT 1\n)\n", DialectOccam25},
+		{"constructor occam2.5", "x := [i = 0 FOR 3 | i]\n", DialectOccam25},
+		{"barrier occampi", "BARRIER b:\n", DialectOccamPi},
+		{"forking occampi", "FORKING\n  SKIP\n", DialectOccamPi},
+		{"mobile occampi", "MOBILE []BYTE buf:\n", DialectOccamPi},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(lexer.New(tt.input), WithDialect(tt.dialect))
+			p.ParseProgram()
+			checkParserErrors(t, p)
+		})
+	}
+}
+
+func TestParseDialect(t *testing.T) {
+	for _, name := range []string{"occam2.1", "occam2.5", "occampi", "extended"} {
+		d, err := ParseDialect(name)
+		if err != nil {
+			t.Fatalf("ParseDialect(%q): %v", name, err)
+		}
+		if d.String() != name {
+			t.Errorf("ParseDialect(%q).String() = %q", name, d.String())
+		}
+	}
+	if _, err := ParseDialect("occam3"); err == nil {
+		t.Error("expected error for unknown dialect")
+	}
+}
+
+func TestNestingTooDeep(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"parentheses", "x := " + strings.Repeat("(", maxNestingDepth+1) + "1" + strings.Repeat(")", maxNestingDepth+1) + "\n"},
+		{"operator chain", "x := 1" + strings.Repeat(" + 1", maxNestingDepth+1) + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(lexer.New(tt.input))
+			p.ParseProgram()
+			errs := p.Errors()
+			if len(errs) != 1 || !strings.Contains(errs[0], "nesting too deep") {
+				t.Errorf("expected a single nesting error, got %d errors: %.200v", len(errs), errs)
+			}
+		})
+	}
+}
+
+func TestDeepSeqNesting(t *testing.T) {
+	const depth = 1000
+	var b strings.Builder
+	for i := 0; i < depth; i++ {
+		b.WriteString(strings.Repeat("  ", i) + "SEQ\n")
+	}
+	b.WriteString(strings.Repeat("  ", depth) + "SKIP\n")
+
+	p := New(lexer.New(b.String()))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	n := 0
+	for stmt := program.Statements[0]; ; n++ {
+		seq, ok := stmt.(*ast.SeqBlock)
+		if !ok {
+			break
+		}
+		stmt = seq.Statements[0]
+	}
+	if n != depth {
+		t.Errorf("expected %d nested SEQs, got %d", depth, n)
+	}
+}
+
+func TestProcEntryPragma(t *testing.T) {
+	input := `PROC a()
+  SKIP
+:
+--#PRAGMA ENTRY
+PROC b()
+  SKIP
+:
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+	a := program.Statements[0].(*ast.ProcDecl)
+	b := program.Statements[1].(*ast.ProcDecl)
+	if a.Entry || !b.Entry {
+		t.Errorf("expected only PROC b marked entry, got a=%v b=%v", a.Entry, b.Entry)
+	}
+}
+
+func TestFuncAsserts(t *testing.T) {
+	input := `--#ASSERT square(0) = 0
+-- unrelated comment
+--#ASSERT square(3) = 9
+--#ASSERT (square(2) + 1) = 5
+INT FUNCTION square(VAL INT x)
+  IS x * x
+`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	fn, ok := program.Statements[0].(*ast.FuncDecl)
+	if !ok {
+		t.Fatalf("expected FuncDecl, got %T", program.Statements[0])
+	}
+	if len(fn.Asserts) != 2 {
+		t.Fatalf("expected 2 asserts (the run just above the FUNCTION), got %d", len(fn.Asserts))
+	}
+	if fn.Asserts[0].Text != "square(3) = 9" {
+		t.Errorf("unexpected first assert: %q", fn.Asserts[0].Text)
+	}
+	bin, ok := fn.Asserts[0].Expr.(*ast.BinaryExpr)
+	if !ok || bin.Operator != "=" {
+		t.Fatalf("expected = BinaryExpr, got %T", fn.Asserts[0].Expr)
+	}
+	if call, ok := bin.Left.(*ast.FuncCall); !ok || call.Name != "square" {
+		t.Errorf("expected call to square on the left, got %T", bin.Left)
+	}
+}
+
+func TestFuncAssertInvalid(t *testing.T) {
+	input := `--#ASSERT square(3 = 9
+INT FUNCTION square(VAL INT x)
+  IS x * x
+`
+	p := New(lexer.New(input))
+	p.ParseProgram()
+	errs := p.Errors()
+	if len(errs) != 1 || !strings.Contains(errs[0], "line 1: invalid ASSERT expression") {
+		t.Errorf("expected an invalid ASSERT error on line 1, got %v", errs)
+	}
+}
+
+func TestErrorColumn(t *testing.T) {
+	input := `PROC p()
+  INT x:
+  x := 1 +
+:
+`
+	p := New(lexer.New(input))
+	p.ParseProgram()
+	errs := p.Errors()
+	if len(errs) == 0 || !strings.HasPrefix(errs[0], "line 4:1: ") {
+		t.Errorf("expected the first error at line 4, column 1, got %v", errs)
+	}
+
+	p = New(lexer.New("PROC p()\n  SEQ\n    x := (1 + )\n:\n"))
+	p.ParseProgram()
+	errs = p.Errors()
+	if len(errs) == 0 || !strings.HasPrefix(errs[0], "line 3:15: ") {
+		t.Errorf("expected the first error at line 3, column 15, got %v", errs)
+	}
+}
+
+func TestPermissive(t *testing.T) {
+	input := `PROC odd(INT x, MOBILE @@ y)
+  x := 1
+:
+PROC p(INT n)
+  SEQ
+    n := n @@ 2
+    IF
+      n > 0
+        n := ))
+      TRUE
+        SKIP
+    n := 3
+:
+`
+	p := New(lexer.New(input), WithPermissive(true))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	if len(p.Unsupported()) != 3 || !strings.HasPrefix(p.Unsupported()[0], "line 1:") {
+		t.Fatalf("expected 3 statements replaced, the first on line 1, got %v", p.Unsupported())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 top-level statements, got %d", len(program.Statements))
+	}
+
+	odd, ok := program.Statements[0].(*ast.Unsupported)
+	if !ok || odd.Proc != "odd" || odd.Text != "PROC odd(INT x, MOBILE @@ y)" {
+		t.Fatalf("expected a stub for PROC odd, got %#v", program.Statements[0])
+	}
+
+	proc, ok := program.Statements[1].(*ast.ProcDecl)
+	if !ok {
+		t.Fatalf("expected PROC p, got %T", program.Statements[1])
+	}
+	seq := proc.Body[0].(*ast.SeqBlock)
+	if len(seq.Statements) != 3 {
+		t.Fatalf("expected 3 statements in the SEQ, got %d", len(seq.Statements))
+	}
+	if u, ok := seq.Statements[0].(*ast.Unsupported); !ok || u.Text != "n := n @@ 2" {
+		t.Errorf("expected a stub for the whole line, got %#v", seq.Statements[0])
+	}
+	ifStmt, ok := seq.Statements[1].(*ast.IfStatement)
+	if !ok || len(ifStmt.Choices) != 2 {
+		t.Fatalf("expected the IF with 2 choices kept, got %#v", seq.Statements[1])
+	}
+	if u, ok := ifStmt.Choices[0].Body[0].(*ast.Unsupported); !ok || u.Token.Line != 9 {
+		t.Errorf("expected a stub for line 9 in the first choice, got %#v", ifStmt.Choices[0].Body)
+	}
+	if _, ok := seq.Statements[2].(*ast.Assignment); !ok {
+		t.Errorf("expected parsing to resume at n := 3, got %T", seq.Statements[2])
+	}
+
+	p = New(lexer.New(input))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || len(p.Unsupported()) != 0 {
+		t.Errorf("expected errors and no stubs without WithPermissive, got %v and %v", p.Errors(), p.Unsupported())
+	}
+}
+
+func TestPermissiveTrailingTokens(t *testing.T) {
+	input := `PROC p(INT x)
+  SEQ
+    x := 3 FROB 4
+    GLORP x
+    x := 1
+:
+`
+	p := New(lexer.New(input), WithPermissive(true))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	if len(p.Unsupported()) != 2 {
+		t.Fatalf("expected 2 statements replaced, got %v", p.Unsupported())
+	}
+	seq := program.Statements[0].(*ast.ProcDecl).Body[0].(*ast.SeqBlock)
+	if len(seq.Statements) != 3 {
+		t.Fatalf("expected one statement for each line, got %d", len(seq.Statements))
+	}
+	for i, text := range []string{"x := 3 FROB 4", "GLORP x"} {
+		if u, ok := seq.Statements[i].(*ast.Unsupported); !ok || u.Text != text {
+			t.Errorf("expected a stub for %q with nothing parsed from its line, got %#v", text, seq.Statements[i])
+		}
+	}
+	if _, ok := seq.Statements[2].(*ast.Assignment); !ok {
+		t.Errorf("expected parsing to resume at x := 1, got %T", seq.Statements[2])
+	}
+}
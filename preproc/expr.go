@@ -0,0 +1,282 @@
+package preproc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// condValue is the value of an operand: an integer, a string or a boolean.
+type condValue struct {
+	kind byte // 'i', 's' or 'b'
+	i    int64
+	s    string
+	b    bool
+}
+
+// condParser evaluates one #IF condition from its tokens.
+type condParser struct {
+	pp     *Preprocessor
+	tokens []string
+	pos    int
+}
+
+// evalCondition evaluates an #IF condition, an expression over the
+// defined symbols:
+//
+//	TRUE, FALSE
+//	DEFINED (SYMBOL), or a bare SYMBOL, TRUE if the symbol is defined
+//	(a = b), (a <> b), (a < b), (a <= b), (a > b), (a >= b)
+//	NOT c, c AND c, c OR c, (c)
+//
+// The operands of a comparison are integers (decimal or #hex), "strings",
+// TRUE, FALSE and symbols, standing for their values: a value that is an
+// integer compares as one, so TARGET.BITS.PER.WORD = 32 compares numbers.
+// A comparison with a symbol that is not defined is FALSE. AND binds more
+// tightly than OR, although occam sources bracket mixed operators anyway.
+func (pp *Preprocessor) evalCondition(expr string) (bool, error) {
+	tokens, err := condTokens(expr)
+	if err != nil {
+		return false, err
+	}
+	if len(tokens) == 0 {
+		return false, fmt.Errorf("missing condition")
+	}
+	p := &condParser{pp: pp, tokens: tokens}
+	v, err := p.or()
+	if err != nil {
+		return false, err
+	}
+	if p.pos < len(p.tokens) {
+		return false, fmt.Errorf("unexpected %s in condition", p.tokens[p.pos])
+	}
+	return v, nil
+}
+
+// condTokens splits a condition into words (symbols, keywords and
+// numbers), "strings", brackets and comparison operators.
+func condTokens(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '=':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '<' || c == '>':
+			if i+1 < len(expr) && (expr[i+1] == '=' || c == '<' && expr[i+1] == '>') {
+				tokens = append(tokens, expr[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, string(c))
+				i++
+			}
+		case c == '"':
+			end := strings.IndexByte(expr[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in condition")
+			}
+			tokens = append(tokens, expr[i:i+end+2])
+			i += end + 2
+		case c == '-' && i+1 < len(expr) && expr[i+1] == '-':
+			// A trailing comment
+			return tokens, nil
+		default:
+			start := i
+			for i < len(expr) && !strings.ContainsRune(" \t()=<>\"", rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, expr[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+func (p *condParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *condParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *condParser) expect(t string) error {
+	if got := p.next(); got != t {
+		if got == "" {
+			got = "end of condition"
+		}
+		return fmt.Errorf("expected %s, got %s", t, got)
+	}
+	return nil
+}
+
+func (p *condParser) or() (bool, error) {
+	v, err := p.and()
+	for err == nil && p.peek() == "OR" {
+		p.next()
+		var w bool
+		w, err = p.and()
+		v = v || w
+	}
+	return v, err
+}
+
+func (p *condParser) and() (bool, error) {
+	v, err := p.not()
+	for err == nil && p.peek() == "AND" {
+		p.next()
+		var w bool
+		w, err = p.not()
+		v = v && w
+	}
+	return v, err
+}
+
+func (p *condParser) not() (bool, error) {
+	if p.peek() == "NOT" {
+		p.next()
+		v, err := p.not()
+		return !v, err
+	}
+	return p.comparison()
+}
+
+// comparison parses an operand, compared with a second if a comparison
+// operator follows.
+func (p *condParser) comparison() (bool, error) {
+	switch t := p.peek(); t {
+	case "(":
+		p.next()
+		v, err := p.or()
+		if err != nil {
+			return false, err
+		}
+		return v, p.expect(")")
+	case "DEFINED":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		_, ok := p.pp.defines[p.next()]
+		return ok, p.expect(")")
+	}
+
+	left, leftOK, err := p.operand()
+	if err != nil {
+		return false, err
+	}
+	op := p.peek()
+	switch op {
+	case "=", "<>", "<", "<=", ">", ">=":
+		p.next()
+	default:
+		// A lone operand: a symbol is TRUE if defined
+		if sym := p.tokens[p.pos-1]; isSymbol(sym) {
+			_, ok := p.pp.defines[sym]
+			return ok, nil
+		}
+		if left.kind != 'b' {
+			return false, fmt.Errorf("%s is not a condition", p.tokens[p.pos-1])
+		}
+		return left.b, nil
+	}
+	right, rightOK, err := p.operand()
+	if err != nil || !leftOK || !rightOK {
+		return false, err
+	}
+	return compare(left, op, right)
+}
+
+// operand parses a literal or symbol, ok false for an undefined symbol.
+func (p *condParser) operand() (v condValue, ok bool, err error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return v, false, fmt.Errorf("missing operand at end of condition")
+	case strings.ContainsAny(t, "()=<>"):
+		return v, false, fmt.Errorf("unexpected %s in condition", t)
+	case isSymbol(t):
+		value, defined := p.pp.defines[t]
+		return parseValue(value), defined, nil
+	}
+	return parseValue(t), true, nil
+}
+
+// isSymbol reports whether a word token names a symbol rather than being
+// a literal.
+func isSymbol(t string) bool {
+	if t == "" || t == "TRUE" || t == "FALSE" || t[0] == '"' || t[0] == '#' || t[0] == '-' {
+		return false
+	}
+	return t[0] < '0' || t[0] > '9'
+}
+
+// parseValue reads a literal or the value of a symbol: an integer, TRUE
+// or FALSE, or else a string (a "string" without its quotes).
+func parseValue(s string) condValue {
+	switch {
+	case s == "TRUE" || s == "FALSE":
+		return condValue{kind: 'b', b: s == "TRUE"}
+	case strings.HasPrefix(s, "#"):
+		if n, err := strconv.ParseInt(s[1:], 16, 64); err == nil {
+			return condValue{kind: 'i', i: n}
+		}
+	default:
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return condValue{kind: 'i', i: n}
+		}
+	}
+	return condValue{kind: 's', s: stripQuotes(s)}
+}
+
+// compare applies a comparison operator to two values of the same kind.
+func compare(a condValue, op string, b condValue) (bool, error) {
+	if a.kind != b.kind {
+		return false, nil
+	}
+	var c int
+	switch a.kind {
+	case 'i':
+		c = cmpInt(a.i, b.i)
+	case 's':
+		c = strings.Compare(a.s, b.s)
+	case 'b':
+		if op != "=" && op != "<>" {
+			return false, fmt.Errorf("cannot order TRUE and FALSE with %s", op)
+		}
+		if a.b != b.b {
+			c = 1
+		}
+	}
+	switch op {
+	case "=":
+		return c == 0, nil
+	case "<>":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
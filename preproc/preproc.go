@@ -1,6 +1,7 @@
 // Package preproc implements a textual preprocessor for occam source files.
 // It handles #IF/#ELSE/#ENDIF conditional compilation, #DEFINE symbols,
-// #INCLUDE file inclusion, and ignores #COMMENT/#PRAGMA/#USE directives.
+// #INCLUDE file inclusion, and ignores #COMMENT/#PRAGMA/#USE directives
+// (though OrderFiles reads #USE to order the files of a multi-file program).
 // The output is a single expanded string suitable for feeding into the lexer.
 package preproc
 
@@ -62,7 +63,8 @@ func New(opts ...Option) *Preprocessor {
 	return pp
 }
 
-// Errors returns any errors accumulated during processing.
+// Errors returns any errors accumulated during processing, as "file:line:
+// msg", or "file: msg" for an #IF left open at the end of a file.
 func (pp *Preprocessor) Errors() []string {
 	return pp.errors
 }
@@ -94,10 +96,111 @@ func (pp *Preprocessor) ProcessFile(filename string) (string, error) {
 	return pp.processSource(string(data), filepath.Dir(absPath), filename)
 }
 
+// ProcessFiles processes several files as one program, in the given order
+// (see OrderFiles), joining their expanded text. The source map covers all
+// of them, and a file already #INCLUDEd by an earlier one, or listed twice,
+// is not expanded again.
+func (pp *Preprocessor) ProcessFiles(filenames []string) (string, error) {
+	var parts []string
+	for _, name := range filenames {
+		if absPath, err := filepath.Abs(name); err == nil {
+			if pp.included[absPath] {
+				continue
+			}
+			pp.included[absPath] = true
+		}
+		expanded, err := pp.ProcessFile(name)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		parts = append(parts, expanded)
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// OrderFiles sorts the files of a multi-file program so that each comes
+// after the files it names with #USE, since occam names must be declared
+// before use. A #USE names a file by its base name, with or without
+// extension; ones that name no file in the list (libraries) are ignored.
+// Otherwise the given order is kept. A #USE cycle is an error.
+func OrderFiles(filenames []string) ([]string, error) {
+	byName := map[string]int{}
+	for i, name := range filenames {
+		byName[useKey(name)] = i
+	}
+	uses := make([][]int, len(filenames))
+	for i, name := range filenames {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %q: %w", name, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			trimmed := strings.TrimSpace(line)
+			if !strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			directive, rest := parseDirectiveLine(trimmed)
+			if directive != "USE" {
+				continue
+			}
+			if j, ok := byName[useKey(stripQuotes(rest))]; ok && j != i {
+				uses[i] = append(uses[i], j)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(filenames))
+	var ordered, path []string
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("#USE cycle: %s -> %s", strings.Join(path, " -> "), filenames[i])
+		}
+		state[i] = visiting
+		path = append(path, filenames[i])
+		for _, j := range uses[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = done
+		ordered = append(ordered, filenames[i])
+		return nil
+	}
+	for i := range filenames {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// useKey is the name by which #USE refers to a file: its base name
+// without extension.
+func useKey(name string) string {
+	base := filepath.Base(name)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
 // ProcessSource processes occam source text with no file context.
 // #INCLUDE directives will only resolve against includePaths.
 func (pp *Preprocessor) ProcessSource(source string) (string, error) {
-	return pp.processSource(source, "", "<input>")
+	return pp.ProcessSourceAs(source, "<input>")
+}
+
+// ProcessSourceAs is ProcessSource with filename, which need not exist, as
+// the file the source map gives for the text's lines.
+func (pp *Preprocessor) ProcessSourceAs(source, filename string) (string, error) {
+	return pp.processSource(source, "", filename)
 }
 
 // processSource performs line-by-line preprocessing.
@@ -121,23 +224,34 @@ func (pp *Preprocessor) processSource(source string, baseDir string, filename st
 			switch directive {
 			case "DEFINE":
 				if isActive(condStack) {
-					sym := strings.TrimSpace(rest)
+					// #DEFINE SYMBOL, or #DEFINE SYMBOL value for #IF comparisons
+					sym, value := rest, ""
+					if idx := strings.IndexAny(rest, " \t"); idx >= 0 {
+						sym, value = rest[:idx], strings.TrimSpace(rest[idx+1:])
+					}
 					if sym != "" {
-						pp.defines[sym] = ""
+						pp.defines[sym] = value
 					}
 				}
 				out.WriteString("") // blank line preserves line numbers
 				pp.sourceMap = append(pp.sourceMap, SourceLoc{filename, i + 1})
 
 			case "IF":
-				val := pp.evalExpr(rest)
+				// Conditions inside an excluded block are not evaluated
+				val := false
+				if isActive(condStack) {
+					var err error
+					if val, err = pp.evalCondition(rest); err != nil {
+						pp.errors = append(pp.errors, fmt.Sprintf("%s:%d: #IF: %s", filename, i+1, err))
+					}
+				}
 				condStack = append(condStack, condState{active: val, seenTrue: val})
 				out.WriteString("")
 				pp.sourceMap = append(pp.sourceMap, SourceLoc{filename, i + 1})
 
 			case "ELSE":
 				if len(condStack) == 0 {
-					pp.errors = append(pp.errors, fmt.Sprintf("line %d: #ELSE without matching #IF", i+1))
+					pp.errors = append(pp.errors, fmt.Sprintf("%s:%d: #ELSE without matching #IF", filename, i+1))
 				} else {
 					top := &condStack[len(condStack)-1]
 					if top.seenTrue {
@@ -152,7 +266,7 @@ func (pp *Preprocessor) processSource(source string, baseDir string, filename st
 
 			case "ENDIF":
 				if len(condStack) == 0 {
-					pp.errors = append(pp.errors, fmt.Sprintf("line %d: #ENDIF without matching #IF", i+1))
+					pp.errors = append(pp.errors, fmt.Sprintf("%s:%d: #ENDIF without matching #IF", filename, i+1))
 				} else {
 					condStack = condStack[:len(condStack)-1]
 				}
@@ -200,7 +314,7 @@ func (pp *Preprocessor) processSource(source string, baseDir string, filename st
 	}
 
 	if len(condStack) > 0 {
-		pp.errors = append(pp.errors, fmt.Sprintf("unterminated #IF (missing %d #ENDIF)", len(condStack)))
+		pp.errors = append(pp.errors, fmt.Sprintf("%s: unterminated #IF (missing %d #ENDIF)", filename, len(condStack)))
 	}
 
 	return out.String(), nil
@@ -290,68 +404,29 @@ func stripQuotes(s string) string {
 	return s
 }
 
-// evalExpr evaluates a preprocessor conditional expression.
-// Supports: TRUE, FALSE, DEFINED (SYMBOL), NOT (expr), (SYMBOL = value)
-func (pp *Preprocessor) evalExpr(expr string) bool {
-	expr = strings.TrimSpace(expr)
-	if expr == "" {
-		return false
-	}
-
-	// TRUE / FALSE
-	if expr == "TRUE" {
-		return true
-	}
-	if expr == "FALSE" {
-		return false
-	}
-
-	// NOT (expr) or NOT DEFINED (...)
-	if strings.HasPrefix(expr, "NOT ") || strings.HasPrefix(expr, "NOT(") {
-		inner := strings.TrimPrefix(expr, "NOT")
-		inner = strings.TrimSpace(inner)
-		return !pp.evalExpr(inner)
-	}
-
-	// DEFINED (SYMBOL)
-	if strings.HasPrefix(expr, "DEFINED") {
-		inner := strings.TrimPrefix(expr, "DEFINED")
-		inner = strings.TrimSpace(inner)
-		sym := stripParens(inner)
-		_, ok := pp.defines[sym]
-		return ok
-	}
-
-	// Parenthesized expression
-	if strings.HasPrefix(expr, "(") && strings.HasSuffix(expr, ")") {
-		inner := expr[1 : len(expr)-1]
-		inner = strings.TrimSpace(inner)
-
-		// Check for equality: SYMBOL = value
-		if eqIdx := strings.Index(inner, "="); eqIdx >= 0 {
-			lhs := strings.TrimSpace(inner[:eqIdx])
-			rhs := strings.TrimSpace(inner[eqIdx+1:])
-			lhsVal, ok := pp.defines[lhs]
-			if !ok {
-				return false
-			}
-			return lhsVal == rhs
+// Flatten renders preprocessed output as a single self-contained occam source.
+// Whenever the origin of the lines changes file, a "-- #FILE "name" N" comment
+// marks where the following lines came from. Runs of blank lines (including
+// those left behind by directives and excluded #IF branches) collapse to one.
+func Flatten(expanded string, sourceMap []SourceLoc) string {
+	var out strings.Builder
+	lastFile := ""
+	blank := false
+	for i, line := range strings.Split(expanded, "\n") {
+		if strings.TrimSpace(line) == "" {
+			blank = out.Len() > 0
+			continue
 		}
-
-		// Otherwise recurse
-		return pp.evalExpr(inner)
-	}
-
-	// Bare symbol — treat as DEFINED
-	_, ok := pp.defines[expr]
-	return ok
-}
-
-// stripParens removes surrounding parentheses and whitespace.
-func stripParens(s string) string {
-	s = strings.TrimSpace(s)
-	if len(s) >= 2 && s[0] == '(' && s[len(s)-1] == ')' {
-		return strings.TrimSpace(s[1 : len(s)-1])
+		if blank {
+			out.WriteString("\n")
+			blank = false
+		}
+		if i < len(sourceMap) && sourceMap[i].File != lastFile {
+			lastFile = sourceMap[i].File
+			fmt.Fprintf(&out, "-- #FILE %q %d\n", lastFile, sourceMap[i].Line)
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
 	}
-	return s
+	return out.String()
 }
@@ -202,6 +202,89 @@ is32
 	}
 }
 
+func TestConditionExpressions(t *testing.T) {
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"(TARGET.BITS.PER.WORD = 64)", true},
+		{"(TARGET.BITS.PER.WORD <> 32)", true},
+		{"(TARGET.BITS.PER.WORD >= 32)", true},
+		{"(TARGET.BITS.PER.WORD < 32)", false},
+		{"(TARGET.BITS.PER.WORD = #40)", true},
+		{"(VERSION > 2) AND (VERSION <= 3)", true},
+		{"(VERSION = 2) OR (NAME = \"demo\")", true},
+		{"(VERSION = 2) OR DEFINED (MISSING)", false},
+		{"NOT (VERSION = 2) AND NOT DEFINED (MISSING)", true},
+		{"NOT ((VERSION = 3) OR FLAG)", false},
+		{"(MISSING = 0) OR (MISSING <> 0)", false},
+		{"FLAG AND TRUE", true},
+		{"(FLAG = \"\")", true},
+		{"(TARGET.BITS.PER.WORD = 64) -- 64-bit words", true},
+	}
+	for _, tt := range tests {
+		pp := New(WithDefines(map[string]string{"FLAG": ""}))
+		src := "#DEFINE VERSION 3\n#DEFINE NAME \"demo\"\n#IF " + tt.cond + "\nyes\n#ELSE\nno\n#ENDIF\n"
+		out, err := pp.ProcessSource(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pp.Errors()) > 0 {
+			t.Errorf("#IF %s: unexpected errors %v", tt.cond, pp.Errors())
+			continue
+		}
+		if got := strings.Contains(out, "yes"); got != tt.want || strings.Contains(out, "no") == tt.want {
+			t.Errorf("#IF %s: expected %v, got output %q", tt.cond, tt.want, out)
+		}
+	}
+}
+
+func TestConditionErrors(t *testing.T) {
+	tests := []struct {
+		cond string
+		want string
+	}{
+		{"", "main.occ:1: #IF: missing condition"},
+		{"(TARGET.BITS.PER.WORD = 64", "main.occ:1: #IF: expected ), got end of condition"},
+		{"(TARGET.BITS.PER.WORD =)", "main.occ:1: #IF: unexpected ) in condition"},
+		{"TRUE FALSE", "main.occ:1: #IF: unexpected FALSE in condition"},
+		{"42", "main.occ:1: #IF: 42 is not a condition"},
+		{"(TRUE < FALSE)", "main.occ:1: #IF: cannot order TRUE and FALSE with <"},
+		{"(NAME = \"demo)", "main.occ:1: #IF: unterminated string in condition"},
+	}
+	for _, tt := range tests {
+		pp := New()
+		src := "#IF " + tt.cond + "\nyes\n#ENDIF\n"
+		out, err := pp.ProcessSourceAs(src, "main.occ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pp.Errors()) != 1 || pp.Errors()[0] != tt.want {
+			t.Errorf("#IF %s: expected error %q, got %v", tt.cond, tt.want, pp.Errors())
+		}
+		if strings.Contains(out, "yes") {
+			t.Errorf("#IF %s: a malformed condition should exclude its block", tt.cond)
+		}
+	}
+}
+
+func TestConditionInExcludedBlock(t *testing.T) {
+	pp := New()
+	src := `#IF FALSE
+#IF (TARGET.BITS.PER.WORD =
+inner
+#ENDIF
+#ENDIF
+`
+	out, err := pp.ProcessSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pp.Errors()) > 0 || strings.Contains(out, "inner") {
+		t.Errorf("expected the excluded #IF to be skipped, got errors %v and output %q", pp.Errors(), out)
+	}
+}
+
 func TestIncludeGuardPattern(t *testing.T) {
 	pp := New()
 	src := `#IF NOT (DEFINED (MY.MODULE))
@@ -414,12 +497,12 @@ func TestElseWithoutIf(t *testing.T) {
 	src := `#ELSE
 hello
 `
-	_, err := pp.ProcessSource(src)
+	_, err := pp.ProcessSourceAs(src, "main.occ")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(pp.Errors()) == 0 {
-		t.Error("expected #ELSE without #IF error")
+	if len(pp.Errors()) != 1 || pp.Errors()[0] != "main.occ:1: #ELSE without matching #IF" {
+		t.Errorf("expected #ELSE without #IF error on main.occ line 1, got %v", pp.Errors())
 	}
 }
 
@@ -483,6 +566,23 @@ func TestSourceMapWithDirectives(t *testing.T) {
 	}
 }
 
+func TestSourceMapNamedSource(t *testing.T) {
+	pp := New(WithDefines(map[string]string{"FAST": ""}))
+	src := "#IF DEFINED (FAST)\nfast\n#ELSE\nslow\n#ENDIF"
+	out, err := pp.ProcessSourceAs(src, "editor.occ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out) != "fast" {
+		t.Errorf("expected only the FAST branch, got %q", out)
+	}
+	for i, loc := range pp.SourceMap() {
+		if loc.File != "editor.occ" || loc.Line != i+1 {
+			t.Errorf("entry %d: got %s:%d, want editor.occ:%d", i, loc.File, loc.Line, i+1)
+		}
+	}
+}
+
 func TestSourceMapWithInclude(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -527,3 +627,97 @@ func TestSourceMapWithInclude(t *testing.T) {
 		t.Errorf("entry 4: got {%s, %d}, want {main.occ, 3}", sm[4].File, sm[4].Line)
 	}
 }
+
+func TestFlattenWithInclude(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	os.WriteFile(filepath.Join(tmpDir, "inc.occ"), []byte("VAL INT x IS 1:\n"), 0644)
+
+	mainContent := "#IF FALSE\nskipped\n#ENDIF\n#INCLUDE \"inc.occ\"\n\n\nPROC p()\n  SKIP\n:\n"
+	mainFile := filepath.Join(tmpDir, "main.occ")
+	os.WriteFile(mainFile, []byte(mainContent), 0644)
+
+	pp := New()
+	out, err := pp.ProcessFile(mainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	incFile := filepath.Join(tmpDir, "inc.occ")
+	got := Flatten(out, pp.SourceMap())
+	want := "-- #FILE \"" + incFile + "\" 1\n" +
+		"VAL INT x IS 1:\n" +
+		"\n" +
+		"-- #FILE \"" + mainFile + "\" 7\n" +
+		"PROC p()\n" +
+		"  SKIP\n" +
+		":\n"
+	if got != want {
+		t.Errorf("Flatten output mismatch:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestOrderFilesByUse(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	mainFile := filepath.Join(tmpDir, "main.occ")
+	utilFile := filepath.Join(tmpDir, "util.occ")
+	ioFile := filepath.Join(tmpDir, "io.occ")
+	os.WriteFile(mainFile, []byte("#USE \"util\"\n#USE \"course.lib\"\nmain\n"), 0644)
+	os.WriteFile(utilFile, []byte("#USE \"io.occ\"\nutil\n"), 0644)
+	os.WriteFile(ioFile, []byte("io\n"), 0644)
+
+	got, err := OrderFiles([]string{mainFile, utilFile, ioFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ioFile, utilFile, mainFile}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("OrderFiles = %v, want %v", got, want)
+	}
+}
+
+func TestOrderFilesCycle(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	aFile := filepath.Join(tmpDir, "a.occ")
+	bFile := filepath.Join(tmpDir, "b.occ")
+	os.WriteFile(aFile, []byte("#USE \"b\"\n"), 0644)
+	os.WriteFile(bFile, []byte("#USE \"a\"\n"), 0644)
+
+	_, err := OrderFiles([]string{aFile, bFile})
+	if err == nil {
+		t.Fatal("expected error for #USE cycle")
+	}
+	if !strings.Contains(err.Error(), "#USE cycle") {
+		t.Errorf("expected #USE cycle error, got: %v", err)
+	}
+}
+
+func TestProcessFilesSourceMap(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// Both files include common.inc; it is expanded only once
+	os.WriteFile(filepath.Join(tmpDir, "common.inc"), []byte("common"), 0644)
+	aFile := filepath.Join(tmpDir, "a.occ")
+	bFile := filepath.Join(tmpDir, "b.occ")
+	os.WriteFile(aFile, []byte("#INCLUDE \"common.inc\"\na2"), 0644)
+	os.WriteFile(bFile, []byte("#INCLUDE \"common.inc\"\nb2"), 0644)
+
+	pp := New()
+	out, err := pp.ProcessFiles([]string{aFile, bFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "common\na2\n\nb2"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	sm := pp.SourceMap()
+	if len(sm) != 4 {
+		t.Fatalf("source map length %d, want 4", len(sm))
+	}
+	if sm[2].File != bFile || sm[2].Line != 1 || sm[3].File != bFile || sm[3].Line != 2 {
+		t.Errorf("entries 2-3: got %v %v, want {%s 1} {%s 2}", sm[2], sm[3], bFile, bFile)
+	}
+}
@@ -0,0 +1,241 @@
+// Package protodoc generates Markdown documentation for occam channel
+// protocols. Each PROTOCOL declaration is described with its tags and payload
+// types, together with the PROCs that send on or receive from channels
+// carrying it (found by walking the AST and resolving channel names, and the
+// CHAN OF fields of record variables, to their declared protocol in each
+// PROC's scope).
+package protodoc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/codeassociates/occam2go/ast"
+)
+
+// topLevel names the process made of statements outside any PROC.
+const topLevel = "(top level)"
+
+// Usage records which PROCs send on and receive from channels of a protocol.
+type Usage struct {
+	Senders   []string
+	Receivers []string
+}
+
+// Analyze returns the usage of every declared protocol, keyed by protocol name.
+// Protocols with no senders or receivers still get an (empty) entry.
+func Analyze(program *ast.Program) map[string]*Usage {
+	a := &analyzer{
+		usage:   map[string]*Usage{},
+		seen:    map[string]bool{},
+		protos:  map[string]bool{},
+		records: map[string]*ast.RecordDecl{},
+	}
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.ProtocolDecl:
+			a.protos[s.Name] = true
+			a.usage[s.Name] = &Usage{}
+		case *ast.RecordDecl:
+			a.records[s.Name] = s
+		}
+	}
+	a.statements(program.Statements, topLevel, map[string]string{})
+	for _, u := range a.usage {
+		sort.Strings(u.Senders)
+		sort.Strings(u.Receivers)
+	}
+	return a.usage
+}
+
+// GenerateMarkdown renders a Markdown report for every PROTOCOL in the program,
+// in declaration order.
+func GenerateMarkdown(program *ast.Program) string {
+	usage := Analyze(program)
+
+	var b strings.Builder
+	b.WriteString("# Protocols\n")
+	for _, stmt := range program.Statements {
+		pd, ok := stmt.(*ast.ProtocolDecl)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n", pd.Name)
+		switch pd.Kind {
+		case "variant":
+			if pd.Extends != "" {
+				fmt.Fprintf(&b, "Variant protocol extending `%s`.\n\n", pd.Extends)
+			} else {
+				b.WriteString("Variant protocol.\n\n")
+			}
+			b.WriteString("| Tag | Payload |\n|---|---|\n")
+			for _, v := range pd.Variants {
+				payload := "—"
+				if len(v.Types) > 0 {
+					payload = "`" + strings.Join(v.Types, " ; ") + "`"
+				}
+				if v.From != "" {
+					payload += fmt.Sprintf(" (from `%s`)", v.From)
+				}
+				fmt.Fprintf(&b, "| `%s` | %s |\n", v.Tag, payload)
+			}
+		case "sequential":
+			fmt.Fprintf(&b, "Sequential protocol: `%s`\n", strings.Join(pd.Types, " ; "))
+		default:
+			fmt.Fprintf(&b, "Simple protocol: `%s`\n", strings.Join(pd.Types, " ; "))
+		}
+		u := usage[pd.Name]
+		fmt.Fprintf(&b, "\n- Sent by: %s\n", procList(u.Senders))
+		fmt.Fprintf(&b, "- Received by: %s\n", procList(u.Receivers))
+	}
+	return b.String()
+}
+
+func procList(names []string) string {
+	if len(names) == 0 {
+		return "_none_"
+	}
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = "`" + n + "`"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+type analyzer struct {
+	usage   map[string]*Usage
+	seen    map[string]bool // "proto/send/proc" keys already recorded
+	protos  map[string]bool
+	records map[string]*ast.RecordDecl
+}
+
+func (a *analyzer) record(chans map[string]string, channel, proc string, send bool) {
+	proto := chans[channel]
+	if !a.protos[proto] {
+		return
+	}
+	key := fmt.Sprintf("%s/%t/%s", proto, send, proc)
+	if a.seen[key] {
+		return
+	}
+	a.seen[key] = true
+	if send {
+		a.usage[proto].Senders = append(a.usage[proto].Senders, proc)
+	} else {
+		a.usage[proto].Receivers = append(a.usage[proto].Receivers, proc)
+	}
+}
+
+// declareRecord adds the channel fields of record variable name, if typ is a
+// record type, to the scope as "name[field]".
+func (a *analyzer) declareRecord(chans map[string]string, typ, name string) {
+	rec := a.records[typ]
+	if rec == nil {
+		return
+	}
+	for _, f := range rec.Fields {
+		if f.IsChan {
+			chans[name+"["+f.Name+"]"] = f.Type
+		}
+	}
+}
+
+// chanKey returns the scope key of a channel: its name, or "r[field]" for
+// the channel field of a record variable.
+func chanKey(chans map[string]string, channel string, indices []ast.Expression) string {
+	if len(indices) > 0 {
+		if ident, ok := indices[0].(*ast.Identifier); ok {
+			if key := channel + "[" + ident.Value + "]"; chans[key] != "" {
+				return key
+			}
+		}
+	}
+	return channel
+}
+
+// statements walks a statement list. chans maps channel names in scope to
+// their element type; declarations extend a copy so that inner scopes do not
+// leak into outer ones.
+func (a *analyzer) statements(stmts []ast.Statement, proc string, chans map[string]string) {
+	chans = copyScope(chans)
+	for _, stmt := range stmts {
+		a.statement(stmt, proc, chans)
+	}
+}
+
+func (a *analyzer) statement(stmt ast.Statement, proc string, chans map[string]string) {
+	switch s := stmt.(type) {
+	case *ast.ChanDecl:
+		for _, name := range s.Names {
+			chans[name] = s.ElemType
+		}
+	case *ast.Abbreviation:
+		if s.IsChan {
+			chans[s.Name] = s.Type
+		}
+	case *ast.VarDecl:
+		for _, name := range s.Names {
+			a.declareRecord(chans, s.Type, name)
+		}
+	case *ast.ProcDecl:
+		inner := copyScope(chans)
+		for _, p := range s.Params {
+			if p.IsChan {
+				inner[p.Name] = p.ChanElemType
+			} else {
+				a.declareRecord(inner, p.Type, p.Name)
+			}
+		}
+		a.statements(s.Body, s.Name, inner)
+	case *ast.Send:
+		a.record(chans, chanKey(chans, s.Channel, s.ChannelIndices), proc, true)
+	case *ast.Receive:
+		a.record(chans, chanKey(chans, s.Channel, s.ChannelIndices), proc, false)
+	case *ast.VariantReceive:
+		a.record(chans, chanKey(chans, s.Channel, s.ChannelIndices), proc, false)
+		for _, c := range s.Cases {
+			a.statements(c.Body, proc, chans)
+		}
+	case *ast.SeqBlock:
+		a.statements(s.Statements, proc, chans)
+	case *ast.ParBlock:
+		a.statements(s.Statements, proc, chans)
+	case *ast.WhileLoop:
+		a.statements(s.Body, proc, chans)
+	case *ast.ClaimBlock:
+		a.statements(s.Body, proc, chans)
+	case *ast.ForkingBlock:
+		a.statements(s.Body, proc, chans)
+	case *ast.IfStatement:
+		a.ifChoices(s.Choices, proc, chans)
+	case *ast.CaseStatement:
+		for _, c := range s.Choices {
+			a.statements(c.Body, proc, chans)
+		}
+	case *ast.AltBlock:
+		for _, c := range s.Cases {
+			if !c.IsTimer && !c.IsSkip && !c.IsVariant && !c.IsOutput && !c.IsAlt { // a variant input, an output guard or a nested ALT is the VariantReceive, Send or AltBlock of its body
+				a.record(chans, chanKey(chans, c.Channel, c.ChannelIndices), proc, false)
+			}
+			a.statements(c.Body, proc, chans)
+		}
+	}
+}
+
+func (a *analyzer) ifChoices(choices []ast.IfChoice, proc string, chans map[string]string) {
+	for _, c := range choices {
+		if c.NestedIf != nil {
+			a.ifChoices(c.NestedIf.Choices, proc, chans)
+		}
+		a.statements(c.Body, proc, chans)
+	}
+}
+
+func copyScope(chans map[string]string) map[string]string {
+	out := make(map[string]string, len(chans))
+	for k, v := range chans {
+		out[k] = v
+	}
+	return out
+}
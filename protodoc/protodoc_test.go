@@ -0,0 +1,157 @@
+package protodoc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/codeassociates/occam2go/ast"
+	"github.com/codeassociates/occam2go/lexer"
+	"github.com/codeassociates/occam2go/parser"
+)
+
+const input = `PROTOCOL CMD
+  CASE
+    move ; INT
+    quit
+:
+PROTOCOL PAIR IS INT ; BYTE
+PROTOCOL TICK IS INT
+PROTOCOL UNUSED IS INT
+PROC controller(CHAN OF CMD out!)
+  SEQ
+    out ! move ; 1
+    out ! quit
+:
+PROC worker(CHAN OF CMD in?, CHAN OF PAIR report!)
+  INT x, y:
+  in ? CASE
+    move ; x
+      report ! x ; 'm'
+    quit
+      SKIP
+:
+PROC logger(CHAN OF PAIR in?, CHAN OF TICK tick?)
+  INT n:
+  BYTE b:
+  SEQ
+    in ? n ; b
+    ALT
+      tick ? n
+        SKIP
+:
+SEQ
+  CHAN OF CMD c:
+  CHAN OF PAIR r:
+  CHAN OF TICK t:
+  PAR
+    controller(c!)
+    worker(c?, r!)
+    logger(r?, t?)
+    t ! 1
+`
+
+func parse(t *testing.T, src string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		t.FailNow()
+	}
+	return program
+}
+
+func TestAnalyze(t *testing.T) {
+	usage := Analyze(parse(t, input))
+
+	want := map[string]Usage{
+		"CMD":    {Senders: []string{"controller"}, Receivers: []string{"worker"}},
+		"PAIR":   {Senders: []string{"worker"}, Receivers: []string{"logger"}},
+		"TICK":   {Senders: []string{"(top level)"}, Receivers: []string{"logger"}},
+		"UNUSED": {},
+	}
+	if len(usage) != len(want) {
+		t.Fatalf("expected %d protocols, got %d", len(want), len(usage))
+	}
+	for name, w := range want {
+		got := usage[name]
+		if got == nil {
+			t.Errorf("missing usage for %s", name)
+			continue
+		}
+		if !reflect.DeepEqual(got.Senders, w.Senders) || !reflect.DeepEqual(got.Receivers, w.Receivers) {
+			t.Errorf("%s: got senders %v receivers %v, want senders %v receivers %v",
+				name, got.Senders, got.Receivers, w.Senders, w.Receivers)
+		}
+	}
+}
+
+func TestGenerateMarkdown(t *testing.T) {
+	doc := GenerateMarkdown(parse(t, input))
+
+	for _, want := range []string{
+		"# Protocols\n",
+		"## CMD\n\nVariant protocol.\n",
+		"| `move` | `INT` |\n",
+		"| `quit` | — |\n",
+		"## PAIR\n\nSequential protocol: `INT ; BYTE`\n",
+		"## UNUSED\n\nSimple protocol: `INT`\n\n- Sent by: _none_\n- Received by: _none_\n",
+		"- Sent by: `controller`\n- Received by: `worker`\n",
+	} {
+		if !strings.Contains(doc, want) {
+			t.Errorf("expected %q in output:\n%s", want, doc)
+		}
+	}
+	if strings.Index(doc, "## CMD") > strings.Index(doc, "## PAIR") {
+		t.Errorf("protocols not in declaration order:\n%s", doc)
+	}
+}
+
+func TestGenerateMarkdownExtends(t *testing.T) {
+	doc := GenerateMarkdown(parse(t, `PROTOCOL CMD
+  CASE
+    move ; INT
+    quit
+:
+PROTOCOL MORE EXTENDS CMD
+  CASE
+    jump ; INT
+:
+`))
+
+	want := "## MORE\n\nVariant protocol extending `CMD`.\n\n| Tag | Payload |\n|---|---|\n" +
+		"| `move` | `INT` (from `CMD`) |\n| `quit` | — (from `CMD`) |\n| `jump` | `INT` |\n"
+	if !strings.Contains(doc, want) {
+		t.Errorf("expected %q in output:\n%s", want, doc)
+	}
+}
+
+func TestAnalyzeRecordChanFields(t *testing.T) {
+	usage := Analyze(parse(t, `PROTOCOL CMD IS INT
+RECORD PORTS
+  CHAN OF CMD req:
+  CHAN OF INT reply:
+PROC server(PORTS p)
+  INT x:
+  SEQ
+    p[req] ? x
+    p[reply] ! x
+:
+SEQ
+  PORTS ports:
+  INT r:
+  PAR
+    server(ports)
+    SEQ
+      ports[req] ! 1
+      ports[reply] ? r
+`))
+
+	want := Usage{Senders: []string{"(top level)"}, Receivers: []string{"server"}}
+	if got := usage["CMD"]; !reflect.DeepEqual(*got, want) {
+		t.Errorf("CMD: expected %+v, got %+v", want, *got)
+	}
+}
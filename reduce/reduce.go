@@ -0,0 +1,115 @@
+// Package reduce shrinks an occam program that shows a transpiler failure
+// to a small one that still shows it, for bug reports. Like creduce, it
+// knows nothing of the failure: it tries deleting parts of the program and
+// keeps each deletion after which a caller-supplied predicate still fails.
+//
+// The parts deleted follow occam's layout rather than its grammar: a block
+// is a line and the more deeply indented lines under it, with the ":" that
+// ends a PROC or type declaration.
+package reduce
+
+import "strings"
+
+// Reduce shrinks source, for which fails returns true, to a program for
+// which fails still returns true. It deletes blocks, and block header lines
+// (moving their bodies out a level), for as long as any deletion keeps the
+// failure, so no one deletion from the result fails. Lines are tried in
+// order and the passes repeat until one deletes nothing; fails is called
+// once per attempt.
+func Reduce(source string, fails func(string) bool) string {
+	lines := strings.Split(strings.TrimRight(source, "\n"), "\n")
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(lines); {
+			if smaller := attempt(lines, i, fails); smaller != nil {
+				lines = smaller
+				changed = true
+				continue // line i is now a different line
+			}
+			i++
+		}
+	}
+	return join(lines)
+}
+
+// attempt returns the first of the deletions at line i that still fails,
+// or nil if none does.
+func attempt(lines []string, i int, fails func(string) bool) []string {
+	for _, smaller := range candidates(lines, i) {
+		if fails(join(smaller)) {
+			return smaller
+		}
+	}
+	return nil
+}
+
+// candidates returns the programs tried for line i, the biggest deletion
+// first: the whole block at i, then its header line alone.
+func candidates(lines []string, i int) [][]string {
+	end, terminated := blockEnd(lines, i)
+	cs := [][]string{splice(lines, i, end)}
+	if end > i+1 && !terminated {
+		cs = append(cs, unwrap(lines, i, end))
+	}
+	return cs
+}
+
+// blockEnd returns the index after the block starting at line i, and
+// whether the block ends with a ":" line at its own indentation.
+func blockEnd(lines []string, i int) (int, bool) {
+	if blank(lines[i]) {
+		return i + 1, false
+	}
+	level := indent(lines[i])
+	j := i + 1
+	for j < len(lines) && (blank(lines[j]) || indent(lines[j]) > level) {
+		j++
+	}
+	if j < len(lines) && indent(lines[j]) == level && strings.TrimSpace(lines[j]) == ":" {
+		return j + 1, true
+	}
+	return j, false
+}
+
+// unwrap returns lines without the header line i of the block ending at
+// end, its body moved out to the header's indentation.
+func unwrap(lines []string, i, end int) []string {
+	shift := -1
+	for _, line := range lines[i+1 : end] {
+		if !blank(line) {
+			shift = indent(line) - indent(lines[i])
+			break
+		}
+	}
+	body := make([]string, 0, end-i-1)
+	for _, line := range lines[i+1 : end] {
+		if shift > 0 && indent(line) >= shift {
+			line = line[shift:]
+		}
+		body = append(body, line)
+	}
+	return splice(lines, i, end, body...)
+}
+
+// splice returns a copy of lines with lines[from:to] replaced by with.
+func splice(lines []string, from, to int, with ...string) []string {
+	out := make([]string, 0, len(lines)-(to-from)+len(with))
+	out = append(out, lines[:from]...)
+	out = append(out, with...)
+	return append(out, lines[to:]...)
+}
+
+func indent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func blank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func join(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,67 @@
+package reduce
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReduce(t *testing.T) {
+	input := `PROC helper(VAL INT n)
+  SKIP
+:
+PROC main()
+  INT x:
+  SEQ
+    x := 1
+
+    WHILE x > 0
+      STOP
+    x := 2
+:
+`
+	// The failure needs a STOP inside some PROC
+	fails := func(src string) bool {
+		return strings.Contains(src, "STOP") && strings.Contains(src, "PROC") && strings.Contains(src, "\n:")
+	}
+	want := "PROC main()\n  STOP\n:\n"
+	if got := Reduce(input, fails); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestReduceKeepsFailure(t *testing.T) {
+	input := "PROC p()\n  SEQ\n    a\n    b\n:\n"
+	calls := 0
+	fails := func(src string) bool {
+		calls++
+		return strings.Contains(src, "    a\n    b\n:\n")
+	}
+	if got := Reduce(input, fails); got != input {
+		t.Errorf("expected nothing deleted, got %q", got)
+	}
+	// One pass: PROC p (not unwrapped, as that would drop its ":"), SEQ and
+	// then its header, a, b and ":"
+	if calls != 6 {
+		t.Errorf("expected 6 attempts, got %d", calls)
+	}
+}
+
+func TestBlockEnd(t *testing.T) {
+	lines := strings.Split("PROC p()\n  SEQ\n\n    SKIP\n  SKIP\n:\nSKIP", "\n")
+	for _, tt := range []struct {
+		line       int
+		end        int
+		terminated bool
+	}{
+		{0, 6, true},
+		{1, 4, false},
+		{2, 3, false},
+		{4, 5, false},
+		{6, 7, false},
+	} {
+		end, terminated := blockEnd(lines, tt.line)
+		if end != tt.end || terminated != tt.terminated {
+			t.Errorf("line %d: expected %d, %v, got %d, %v", tt.line, tt.end, tt.terminated, end, terminated)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// Package runtime implements the PROCs and FUNCTIONs of the KRoC course
+// library natively in Go. Programs transpiled with -use-runtime call these
+// instead of transpiled copies of the library source.
+//
+// Each function takes its occam parameters in order, mapped as the
+// transpiler maps them: VAL parameters by value, others as pointers, []BYTE
+// as []byte and CHAN BYTE ends as directed byte channels.
+package runtime
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FLUSH, sent on a screen channel, asks for buffered output to be written.
+const FLUSH = 255
+
+const (
+	bell      = 7
+	backspace = 8
+	del       = 127
+)
+
+// writeString sends s on out.
+func writeString(out chan<- byte, s string) {
+	for i := 0; i < len(s); i++ {
+		out <- s[i]
+	}
+}
+
+// writeField sends s on out right-justified in field characters.
+func writeField(out chan<- byte, s string, field int) {
+	OutRepeat(' ', field-len(s), out)
+	writeString(out, s)
+}
+
+// OutRepeat is out.repeat: ch, n times.
+func OutRepeat(ch byte, n int, out chan<- byte) {
+	for i := 0; i < n; i++ {
+		out <- ch
+	}
+}
+
+// OutCh is out.ch: ch right-justified in field.
+func OutCh(ch byte, field int, out chan<- byte) {
+	OutRepeat(' ', field-1, out)
+	out <- ch
+}
+
+// OutString is out.string: s right-justified in field.
+func OutString(s []byte, field int, out chan<- byte) {
+	OutRepeat(' ', field-len(s), out)
+	for _, b := range s {
+		out <- b
+	}
+}
+
+// OutByte is out.byte: the value of b in decimal, right-justified in field.
+func OutByte(b byte, field int, out chan<- byte) {
+	writeField(out, strconv.Itoa(int(b)), field)
+}
+
+// OutInt is out.int: n in decimal, right-justified in field.
+func OutInt(n int, field int, out chan<- byte) {
+	writeField(out, strconv.Itoa(n), field)
+}
+
+// OutHex is out.hex: '#' and n in upper-case hexadecimal, with leading
+// zeros to fill field.
+func OutHex(n int, field int, out chan<- byte) {
+	digits := strings.ToUpper(strconv.FormatUint(uint64(n), 16))
+	out <- '#'
+	OutRepeat('0', field-1-len(digits), out)
+	writeString(out, digits)
+}
+
+// OutBool is out.bool: TRUE or FALSE, right-justified in field.
+func OutBool(b bool, field int, out chan<- byte) {
+	if b {
+		writeField(out, "TRUE", field)
+	} else {
+		writeField(out, "FALSE", field)
+	}
+}
+
+// OutYesNo is out.yes.no: yes or no, right-justified in field.
+func OutYesNo(b bool, field int, out chan<- byte) {
+	if b {
+		writeField(out, "yes", field)
+	} else {
+		writeField(out, "no", field)
+	}
+}
+
+// Flush is flush: ask for the output sent on out so far to be written.
+func Flush(out chan<- byte) {
+	out <- FLUSH
+}
+
+// BlackHole is black.hole: read and discard everything sent on in.
+func BlackHole(in <-chan byte) {
+	for range in {
+	}
+}
+
+// InSkip is in.skip: read past spaces, leaving the first other character
+// in ch.
+func InSkip(ch *byte, in <-chan byte) {
+	*ch = <-in
+	for *ch == ' ' {
+		*ch = <-in
+	}
+}
+
+// InDigit is in.digit: read until a decimal digit, which is echoed to out
+// and left in d. Other characters ring the bell.
+func InDigit(d *byte, in <-chan byte, out chan<- byte) {
+	for {
+		ch := <-in
+		if ch >= '0' && ch <= '9' {
+			*d = ch
+			out <- ch
+			Flush(out)
+			return
+		}
+		out <- bell
+		Flush(out)
+	}
+}
+
+// readLine reads a line of at most max characters accepted by ok, echoing
+// them to out, until a carriage return or newline. Backspace and delete
+// remove the last character; anything else rings the bell.
+func readLine(max int, ok func(line []byte, ch byte) bool, in <-chan byte, out chan<- byte) []byte {
+	var line []byte
+	for {
+		ch, open := <-in
+		switch {
+		case !open, ch == '\r', ch == '\n':
+			return line
+		case ch == backspace || ch == del:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				writeString(out, "\b \b")
+			} else {
+				out <- bell
+			}
+		case len(line) < max && ok(line, ch):
+			line = append(line, ch)
+			out <- ch
+		default:
+			out <- bell
+		}
+		Flush(out)
+	}
+}
+
+// InString is in.string: read a line of at most max characters (and at
+// most SIZE s) into s, setting length to its length and padding the rest of
+// s with NULs.
+func InString(s []byte, length *int, max int, in <-chan byte, out chan<- byte) {
+	if max > len(s) {
+		max = len(s)
+	}
+	line := readLine(max, func(_ []byte, ch byte) bool { return ch >= ' ' && ch < del }, in, out)
+	*length = copy(s, line)
+	for i := *length; i < len(s); i++ {
+		s[i] = 0
+	}
+}
+
+// InBool is in.bool: read y or n, echoing yes or no, into b.
+func InBool(b *bool, in <-chan byte, out chan<- byte) {
+	for {
+		switch <-in {
+		case 'y', 'Y':
+			*b = true
+			writeString(out, "yes")
+			Flush(out)
+			return
+		case 'n', 'N':
+			*b = false
+			writeString(out, "no")
+			Flush(out)
+			return
+		}
+		out <- bell
+		Flush(out)
+	}
+}
+
+// digit reports whether ch is a decimal digit, for readLine.
+func digit(_ []byte, ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// InByte is in.byte: read a number of at most max digits, which must fit a
+// BYTE, into b. Numbers that do not fit ring the bell and are read again.
+func InByte(b *byte, max int, in <-chan byte, out chan<- byte) {
+	for {
+		line := readLine(max, digit, in, out)
+		if v, err := strconv.Atoi(string(line)); err == nil && v < 256 {
+			*b = byte(v)
+			return
+		}
+		out <- bell
+		Flush(out)
+	}
+}
+
+// InInt is in.int: read a number of at most max characters, with an
+// optional sign, into n. Numbers that do not fit an INT ring the bell and
+// are read again.
+func InInt(n *int, max int, in <-chan byte, out chan<- byte) {
+	sign := func(line []byte, ch byte) bool {
+		return digit(line, ch) || (len(line) == 0 && (ch == '+' || ch == '-'))
+	}
+	for {
+		line := readLine(max, sign, in, out)
+		if v, err := strconv.Atoi(string(line)); err == nil {
+			*n = v
+			return
+		}
+		out <- bell
+		Flush(out)
+	}
+}
+
+// askEnd ends an ask.* line.
+func askEnd(out chan<- byte) {
+	writeString(out, "\r\n")
+	Flush(out)
+}
+
+// AskString is ask.string: prompt, then in.string.
+func AskString(prompt []byte, s []byte, length *int, max int, in <-chan byte, out chan<- byte) {
+	OutString(prompt, 0, out)
+	Flush(out)
+	InString(s, length, max, in, out)
+	askEnd(out)
+}
+
+// AskBool is ask.bool: prompt, then in.bool.
+func AskBool(prompt []byte, b *bool, in <-chan byte, out chan<- byte) {
+	OutString(prompt, 0, out)
+	Flush(out)
+	InBool(b, in, out)
+	askEnd(out)
+}
+
+// AskByte is ask.byte: prompt, then in.byte.
+func AskByte(prompt []byte, b *byte, max int, in <-chan byte, out chan<- byte) {
+	OutString(prompt, 0, out)
+	Flush(out)
+	InByte(b, max, in, out)
+	askEnd(out)
+}
+
+// AskInt is ask.int: prompt, then in.int.
+func AskInt(prompt []byte, n *int, max int, in <-chan byte, out chan<- byte) {
+	OutString(prompt, 0, out)
+	Flush(out)
+	InInt(n, max, in, out)
+	askEnd(out)
+}
+
+// escape sends the VT100 control sequence ESC [ seq.
+func escape(out chan<- byte, seq string) {
+	out <- 27
+	out <- '['
+	writeString(out, seq)
+}
+
+// CursorXY is cursor.x.y: move the cursor to column x, row y (from 1).
+func CursorXY(x, y byte, out chan<- byte) {
+	escape(out, strconv.Itoa(int(y))+";"+strconv.Itoa(int(x))+"H")
+}
+
+// CursorUp is cursor.up: move the cursor up n rows.
+func CursorUp(n byte, out chan<- byte) {
+	escape(out, strconv.Itoa(int(n))+"A")
+}
+
+// CursorDown is cursor.down: move the cursor down n rows.
+func CursorDown(n byte, out chan<- byte) {
+	escape(out, strconv.Itoa(int(n))+"B")
+}
+
+// CursorRight is cursor.right: move the cursor right n columns.
+func CursorRight(n byte, out chan<- byte) {
+	escape(out, strconv.Itoa(int(n))+"C")
+}
+
+// CursorLeft is cursor.left: move the cursor left n columns.
+func CursorLeft(n byte, out chan<- byte) {
+	escape(out, strconv.Itoa(int(n))+"D")
+}
+
+// EraseEOL is erase.eol: erase to the end of the line.
+func EraseEOL(out chan<- byte) {
+	escape(out, "K")
+}
+
+// EraseBOL is erase.bol: erase to the beginning of the line.
+func EraseBOL(out chan<- byte) {
+	escape(out, "1K")
+}
+
+// EraseLine is erase.line: erase the whole line.
+func EraseLine(out chan<- byte) {
+	escape(out, "2K")
+}
+
+// EraseEOS is erase.eos: erase to the end of the screen.
+func EraseEOS(out chan<- byte) {
+	escape(out, "J")
+}
+
+// EraseBOS is erase.bos: erase to the beginning of the screen.
+func EraseBOS(out chan<- byte) {
+	escape(out, "1J")
+}
+
+// EraseScreen is erase.screen: erase the whole screen.
+func EraseScreen(out chan<- byte) {
+	escape(out, "2J")
+}
+
+// CursorVisible is cursor.visible: show the cursor.
+func CursorVisible(out chan<- byte) {
+	escape(out, "?25h")
+}
+
+// CursorInvisible is cursor.invisible: hide the cursor.
+func CursorInvisible(out chan<- byte) {
+	escape(out, "?25l")
+}
+
+// MakeString is make.string: set a to its first length characters padded
+// with NULs.
+func MakeString(a []byte, length int) {
+	for i := length; i < len(a); i++ {
+		a[i] = 0
+	}
+}
+
+// CopyString is copy.string: copy a into b, padding b with NULs.
+func CopyString(a, b []byte) {
+	n := copy(b, a)
+	MakeString(b, n)
+}
+
+// trimNul returns s without trailing NULs, as strings made by make.string
+// are compared.
+func trimNul(s []byte) []byte {
+	for len(s) > 0 && s[len(s)-1] == 0 {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// EqualString is equal.string: whether a and b hold the same string,
+// ignoring NUL padding.
+func EqualString(a, b []byte) bool {
+	return string(trimNul(a)) == string(trimNul(b))
+}
+
+// CompareString is compare.string: -1, 0 or 1 as a sorts before, the same
+// as or after b, ignoring NUL padding.
+func CompareString(a, b []byte) int {
+	return strings.Compare(string(trimNul(a)), string(trimNul(b)))
+}
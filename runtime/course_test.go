@@ -0,0 +1,94 @@
+package runtime
+
+import "testing"
+
+// collect runs proc with the given keyboard input and returns what it sends
+// on the screen channel, without FLUSH bytes.
+func collect(input string, proc func(in <-chan byte, out chan<- byte)) string {
+	in := make(chan byte, len(input))
+	for i := 0; i < len(input); i++ {
+		in <- input[i]
+	}
+	close(in)
+	out := make(chan byte)
+	go func() {
+		proc(in, out)
+		close(out)
+	}()
+	var got []byte
+	for b := range out {
+		if b != FLUSH {
+			got = append(got, b)
+		}
+	}
+	return string(got)
+}
+
+func TestOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		proc func(out chan<- byte)
+		want string
+	}{
+		{"out.int", func(out chan<- byte) { OutInt(-42, 5, out) }, "  -42"},
+		{"out.int narrow", func(out chan<- byte) { OutInt(12345, 2, out) }, "12345"},
+		{"out.byte", func(out chan<- byte) { OutByte('A', 0, out) }, "65"},
+		{"out.hex", func(out chan<- byte) { OutHex(255, 5, out) }, "#00FF"},
+		{"out.string", func(out chan<- byte) { OutString([]byte("ab"), 4, out) }, "  ab"},
+		{"out.ch", func(out chan<- byte) { OutCh('x', 2, out) }, " x"},
+		{"out.bool", func(out chan<- byte) { OutBool(false, 0, out) }, "FALSE"},
+		{"out.yes.no", func(out chan<- byte) { OutYesNo(true, 4, out) }, " yes"},
+		{"cursor.x.y", func(out chan<- byte) { CursorXY(3, 7, out) }, "\x1b[7;3H"},
+		{"erase.screen", func(out chan<- byte) { EraseScreen(out) }, "\x1b[2J"},
+	}
+	for _, tt := range tests {
+		got := collect("", func(_ <-chan byte, out chan<- byte) { tt.proc(out) })
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInInt(t *testing.T) {
+	var n int
+	echo := collect("-1x2\b3\r", func(in <-chan byte, out chan<- byte) { InInt(&n, 4, in, out) })
+	if n != -13 {
+		t.Errorf("n = %d, want -13", n)
+	}
+	if want := "-1\a2\b \b3"; echo != want {
+		t.Errorf("echo %q, want %q", echo, want)
+	}
+}
+
+func TestInString(t *testing.T) {
+	s := make([]byte, 4)
+	length := -1
+	echo := collect("hello\n", func(in <-chan byte, out chan<- byte) { InString(s, &length, 10, in, out) })
+	if string(s[:length]) != "hell" || echo != "hell\a" {
+		t.Errorf("s = %q, echo %q", s[:length], echo)
+	}
+}
+
+func TestAskBool(t *testing.T) {
+	var b bool
+	echo := collect("?y", func(in <-chan byte, out chan<- byte) { AskBool([]byte("ok? "), &b, in, out) })
+	if !b || echo != "ok? \ayes\r\n" {
+		t.Errorf("b = %v, echo %q", b, echo)
+	}
+}
+
+func TestStrings(t *testing.T) {
+	a := []byte("abc\x00\x00")
+	b := make([]byte, 6)
+	CopyString(a[:3], b)
+	if !EqualString(a, b) {
+		t.Errorf("equal.string(%q, %q) = FALSE", a, b)
+	}
+	if got := CompareString([]byte("abd"), b); got != 1 {
+		t.Errorf("compare.string = %d, want 1", got)
+	}
+	MakeString(b, 1)
+	if string(b) != "a\x00\x00\x00\x00\x00" {
+		t.Errorf("make.string: %q", b)
+	}
+}
@@ -0,0 +1,1474 @@
+// Package sema checks a parsed program before code generation. It builds
+// the scopes of the program's declarations, reports names used without (or
+// before) their declaration and names used as the wrong kind of thing (a
+// variable called as a PROC, a PROC sent on as a channel), and reports type
+// mismatches that would otherwise surface as Go compile errors about
+// generated code: assignments, abbreviations, channel communications, PROC
+// and FUNCTION arguments and results, operands and conditions. Types that
+// cannot be worked out (literals, multi-result FUNCTIONs, protocols) are not
+// checked.
+package sema
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/codeassociates/occam2go/ast"
+)
+
+// Check returns the semantic errors in program, as "line N: msg" strings in
+// source order. predeclared are PROC and FUNCTION declarations provided from
+// outside the program, such as codegen.RuntimeDecls.
+func Check(program *ast.Program, predeclared ...ast.Statement) []string {
+	c := &checker{scope: newScope(nil), claimed: map[*symbol]bool{}, types: map[ast.Expression]exprType{}}
+	for _, stmt := range predeclared {
+		c.declare(stmt)
+	}
+	// Top-level declarations become Go package-level declarations, so they
+	// may be used before the point at which they are declared
+	for _, stmt := range program.Statements {
+		c.declare(stmt)
+	}
+	c.statements(program.Statements)
+	return c.errors
+}
+
+type kind int
+
+const (
+	kindVar kind = iota
+	kindChan
+	kindTimer
+	kindBarrier
+	kindProc
+	kindFunc
+	kindProtocol
+	kindTag
+	kindRecord
+	kindDataType
+)
+
+var kindNames = map[kind]string{
+	kindVar:      "variable",
+	kindChan:     "channel",
+	kindTimer:    "timer",
+	kindBarrier:  "barrier",
+	kindProc:     "PROC",
+	kindFunc:     "FUNCTION",
+	kindProtocol: "PROTOCOL",
+	kindTag:      "protocol tag",
+	kindRecord:   "RECORD type",
+	kindDataType: "DATA TYPE",
+}
+
+// symbol is a declared name.
+type symbol struct {
+	kind   kind
+	typ    string          // variable type, channel protocol or element type
+	dims   int             // array dimensions of a variable or channel
+	isVal  bool            // VAL abbreviation, VAL parameter or replicator
+	params []ast.ProcParam // PROC and FUNCTION parameters
+	result []*ast.TypeRef  // FUNCTION result types
+	record *ast.RecordDecl // RECORD type fields
+	proto  *ast.ProtocolDecl
+	end    string  // "?" or "!" for an end of a CHAN TYPE
+	shared bool    // SHARED CHAN TYPE end, usable inside CLAIM
+	sizes  []int64 // array sizes per dimension, -1 where not constant
+	value  int64   // value of a constant VAL abbreviation, if known
+	known  bool
+}
+
+type scope struct {
+	names map[string]*symbol
+	outer *scope
+}
+
+func newScope(outer *scope) *scope {
+	return &scope{names: map[string]*symbol{}, outer: outer}
+}
+
+func (s *scope) lookup(name string) *symbol {
+	for ; s != nil; s = s.outer {
+		if sym, ok := s.names[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+// Built-in PROCs and FUNCTIONs, which codegen implements itself
+var (
+	builtinProcs = map[string]bool{
+		"print.int":      true,
+		"print.string":   true,
+		"print.bool":     true,
+		"print.newline":  true,
+		"CAUSEERROR":     true,
+		"INTTOSTRING":    true,
+		"STRINGTOINT":    true,
+		"REAL32TOSTRING": true,
+		"REAL64TOSTRING": true,
+		"STRINGTOREAL32": true,
+		"STRINGTOREAL64": true,
+	}
+	builtinFuncs = map[string]bool{
+		"LONGPROD":   true,
+		"LONGDIV":    true,
+		"LONGSUM":    true,
+		"LONGDIFF":   true,
+		"NORMALISE":  true,
+		"SHIFTRIGHT": true,
+		"SHIFTLEFT":  true,
+	}
+)
+
+// scalarTypes are the occam primitive data types
+var scalarTypes = map[string]bool{
+	"INT": true, "INT16": true, "INT32": true, "INT64": true, "BYTE": true,
+	"BOOL": true, "REAL": true, "REAL32": true, "REAL64": true,
+}
+
+type checker struct {
+	scope   *scope
+	errors  []string
+	claimed map[*symbol]bool // SHARED ends inside their CLAIM
+
+	// Types of the operators typeOf has seen, so that each operand's type
+	// is found once and a long chain a + b + ... is checked in linear time
+	types map[ast.Expression]exprType
+}
+
+// exprType is the type and array dimensions of an expression.
+type exprType struct {
+	typ  string
+	dims int
+}
+
+func (c *checker) errorf(line int, format string, args ...interface{}) {
+	c.errors = append(c.errors, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+}
+
+func (c *checker) push() { c.scope = newScope(c.scope) }
+func (c *checker) pop()  { c.scope = c.scope.outer }
+
+// block checks stmts in a scope of their own.
+func (c *checker) block(stmts []ast.Statement) {
+	c.push()
+	c.statements(stmts)
+	c.pop()
+}
+
+// statements checks stmts in the current scope: each declaration is in
+// scope for the statements after it, except that a run of PROC and FUNCTION
+// declarations are in scope in all of their bodies, so that they may call
+// each other.
+func (c *checker) statements(stmts []ast.Statement) {
+	for i, stmt := range stmts {
+		if isRoutine(stmt) && (i == 0 || !isRoutine(stmts[i-1])) {
+			for _, later := range stmts[i:] {
+				if !isRoutine(later) {
+					break
+				}
+				c.declare(later)
+			}
+		}
+		c.statement(stmt)
+	}
+}
+
+func isRoutine(stmt ast.Statement) bool {
+	switch stmt.(type) {
+	case *ast.ProcDecl, *ast.FuncDecl:
+		return true
+	}
+	return false
+}
+
+// lookup finds name, reporting it if it is not declared or is not one of
+// the kinds wanted. It returns nil after reporting.
+func (c *checker) lookup(line int, name string, want ...kind) *symbol {
+	sym := c.scope.lookup(name)
+	if sym == nil {
+		c.errorf(line, "%s is not declared", name)
+		return nil
+	}
+	for _, k := range want {
+		if sym.kind == k {
+			return sym
+		}
+	}
+	c.errorf(line, "%s is a %s, not a %s", name, kindNames[sym.kind], kindNames[want[0]])
+	return nil
+}
+
+// declare adds the names declared by stmt, if any, to the current scope.
+func (c *checker) declare(stmt ast.Statement) {
+	names := c.scope.names
+	switch s := stmt.(type) {
+	case *ast.VarDecl:
+		for _, n := range s.Names {
+			names[n] = &symbol{kind: kindVar, typ: s.Type, end: s.End, shared: s.Shared}
+		}
+	case *ast.ArrayDecl:
+		dims, elem := s.TypeRef.Dims()
+		for _, n := range s.Names {
+			names[n] = &symbol{kind: kindVar, typ: elem.Name, dims: dims, sizes: c.constSizes(s.TypeRef.Sizes())}
+		}
+	case *ast.ChanDecl:
+		dims, ch := s.TypeRef.Dims()
+		for _, n := range s.Names {
+			names[n] = &symbol{kind: kindChan, typ: ch.Elem.FlatName(), dims: dims, sizes: c.constSizes(s.TypeRef.Sizes()), shared: s.Shared}
+		}
+	case *ast.TimerDecl:
+		for _, n := range s.Names {
+			names[n] = &symbol{kind: kindTimer}
+		}
+	case *ast.BarrierDecl:
+		for _, n := range s.Names {
+			names[n] = &symbol{kind: kindBarrier}
+		}
+	case *ast.ProcDecl:
+		names[s.Name] = &symbol{kind: kindProc, params: s.Params}
+	case *ast.FuncDecl:
+		names[s.Name] = &symbol{kind: kindFunc, params: s.Params, result: s.Results}
+	case *ast.ProtocolDecl:
+		names[s.Name] = &symbol{kind: kindProtocol, proto: s}
+		for _, v := range s.Variants {
+			names[v.Tag] = &symbol{kind: kindTag, typ: s.Name}
+		}
+	case *ast.RecordDecl:
+		names[s.Name] = &symbol{kind: kindRecord, record: s}
+	case *ast.DataTypeDecl:
+		names[s.Name] = &symbol{kind: kindDataType, typ: s.Type}
+	case *ast.Abbreviation:
+		sym := &symbol{kind: kindVar, typ: s.Type, dims: s.OpenArrayDims, isVal: s.IsVal}
+		if s.IsChan {
+			sym.kind, sym.end = kindChan, s.ChanDir
+			if root := c.root(s.Value); root != nil && root.kind == kindChan {
+				sym.shared = root.shared
+				if sym.end == "" {
+					sym.end = root.end
+				}
+			}
+		} else if root := c.root(s.Value); root != nil && (root.kind == kindChan || root.kind == kindTimer) {
+			sym.kind, sym.typ = root.kind, root.typ
+		} else if s.Type == "" {
+			sym.typ, sym.dims = c.typeOf(s.Value)
+		}
+		if v, ok := c.constant(s.Value); ok && s.IsVal && sym.dims == 0 {
+			sym.value, sym.known = v, true
+		}
+		sym.sizes = c.sizesOf(s.Value)
+		names[s.Name] = sym
+	case *ast.RetypesDecl:
+		dims, elem := s.TypeRef.Dims()
+		names[s.Name] = &symbol{kind: kindVar, typ: elem.Name, isVal: s.IsVal, dims: dims, sizes: c.constSizes(s.TypeRef.Sizes())}
+	}
+}
+
+// root returns the symbol an identifier, indexing or slice expression is
+// rooted at, without reporting anything.
+func (c *checker) root(e ast.Expression) *symbol {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		return c.scope.lookup(e.Value)
+	case *ast.IndexExpr:
+		return c.root(e.Left)
+	case *ast.SliceExpr:
+		return c.root(e.Array)
+	case *ast.ParenExpr:
+		return c.root(e.Expr)
+	}
+	return nil
+}
+
+// declareParams adds PROC or FUNCTION parameters to the current scope.
+func (c *checker) declareParams(params []ast.ProcParam) {
+	for _, p := range params {
+		dims, _ := p.TypeRef.Dims()
+		sizes := c.constSizes(p.TypeRef.Sizes())
+		if p.IsChan {
+			sym := &symbol{kind: kindChan, typ: p.ChanElemType, dims: dims, sizes: sizes, shared: p.Shared}
+			if p.Shared || dims == 0 {
+				// The direction of a channel array parameter is not
+				// checked, as Go drops it for channels in slices
+				sym.end = p.ChanDir
+			}
+			c.scope.names[p.Name] = sym
+			continue
+		}
+		if p.Type == "BARRIER" && dims == 0 {
+			c.scope.names[p.Name] = &symbol{kind: kindBarrier}
+			continue
+		}
+		sym := &symbol{kind: kindVar, typ: p.Type, dims: dims, sizes: sizes, isVal: p.IsVal, shared: p.Shared}
+		if c.record(p.Type) != nil && c.record(p.Type).ChanType {
+			sym.end = p.ChanDir
+		}
+		c.scope.names[p.Name] = sym
+	}
+}
+
+// checkType reports a type name that is neither a primitive type nor a
+// declared RECORD (or, for channels, PROTOCOL).
+func (c *checker) checkType(line int, typ string, want ...kind) {
+	if typ == "" || scalarTypes[typ] {
+		return
+	}
+	c.lookup(line, typ, want...)
+}
+
+// checkTypeRef reports the type names in t that are neither primitive types
+// nor declared as one of want.
+func (c *checker) checkTypeRef(line int, t *ast.TypeRef, want ...kind) {
+	switch t.Kind {
+	case ast.NamedType:
+		c.lookup(line, t.Name, want...)
+	case ast.CountedType:
+		c.checkTypeRef(line, t.Count, want...)
+		c.checkTypeRef(line, t.Elem, want...)
+	case ast.ArrayType, ast.ChanType:
+		c.checkTypeRef(line, t.Elem, want...)
+	}
+}
+
+// replicator checks a replicator's expressions and declares its variable.
+func (c *checker) replicator(line int, r *ast.Replicator) {
+	c.expr(line, r.Start)
+	c.expr(line, r.Count)
+	if r.Step != nil {
+		c.expr(line, r.Step)
+	}
+	c.scope.names[r.Variable] = &symbol{kind: kindVar, typ: "INT", isVal: true}
+}
+
+func (c *checker) statement(stmt ast.Statement) {
+	switch s := stmt.(type) {
+	case *ast.VarDecl:
+		c.checkTypeRef(s.Token.Line, s.TypeRef, kindRecord, kindDataType)
+	case *ast.ArrayDecl:
+		for _, size := range s.Sizes {
+			c.expr(s.Token.Line, size)
+		}
+	case *ast.ChanDecl:
+		for _, size := range s.Sizes {
+			c.expr(s.Token.Line, size)
+		}
+		c.checkTypeRef(s.Token.Line, s.TypeRef, kindProtocol, kindRecord, kindDataType)
+	case *ast.Abbreviation:
+		c.abbreviation(s)
+	case *ast.RetypesDecl:
+		c.retypes(s)
+	case *ast.PlaceDecl:
+		c.lookup(s.Token.Line, s.Name, kindVar, kindChan)
+		c.expr(s.Token.Line, s.Address)
+	case *ast.ProcDecl:
+		c.declare(s) // in scope in its own body
+		c.push()
+		c.declareParams(s.Params)
+		c.statements(s.Body)
+		c.pop()
+		return
+	case *ast.FuncDecl:
+		c.function(s)
+		return
+	case *ast.Assignment:
+		c.assignment(s)
+	case *ast.MultiAssignment:
+		c.multiAssignment(s)
+	case *ast.SeqBlock:
+		c.push()
+		if s.Replicator != nil {
+			c.replicator(s.Token.Line, s.Replicator)
+		}
+		c.statements(s.Statements)
+		c.pop()
+	case *ast.ParBlock:
+		c.push()
+		if s.Replicator != nil {
+			c.replicator(s.Token.Line, s.Replicator)
+		}
+		for _, proc := range s.Processors {
+			c.expr(proc.Token.Line, proc.Number)
+		}
+		for _, b := range s.Enroll {
+			c.lookup(s.Token.Line, b, kindBarrier)
+		}
+		// Each branch is a process of its own
+		for _, branch := range s.Branches() {
+			c.block(branch)
+		}
+		c.pop()
+	case *ast.WhileLoop:
+		c.condition(s.Token.Line, "WHILE", s.Condition)
+		c.block(s.Body)
+	case *ast.ClaimBlock:
+		c.claim(s)
+	case *ast.ForkingBlock:
+		c.block(s.Body)
+	case *ast.IfStatement:
+		c.ifStatement(s)
+	case *ast.CaseStatement:
+		c.expr(s.Token.Line, s.Selector)
+		sel, selDims := c.typeOf(s.Selector)
+		for _, choice := range s.Choices {
+			for _, v := range choice.Values {
+				c.expr(s.Token.Line, v)
+				if typ, dims := c.typeOf(v); sel != "" && typ != "" && !sameType(typ, dims, sel, selDims) {
+					c.errorf(s.Token.Line, "CASE label is %s, not %s", typeName(typ, dims), typeName(sel, selDims))
+				}
+			}
+			c.block(choice.Body)
+		}
+	case *ast.ProcCall:
+		c.procCall(s)
+	case *ast.ForkStmt:
+		c.procCall(s.Call)
+	case *ast.SyncStmt:
+		c.lookup(s.Token.Line, s.Barrier, kindBarrier)
+	case *ast.Send:
+		c.send(s)
+	case *ast.Receive:
+		c.receive(s)
+	case *ast.VariantReceive:
+		c.variantReceive(s)
+	case *ast.AltBlock:
+		c.altBlock(s)
+	case *ast.TimerRead:
+		c.lookup(s.Token.Line, s.Timer, kindTimer)
+		if sym := c.lookup(s.Token.Line, s.Variable, kindVar); sym != nil {
+			c.mismatch(s.Token.Line, "cannot read the time (%s) into %s of type %s", "INT", 0, s.Variable, sym.typ, sym.dims)
+		}
+	case *ast.TimerAfterWait:
+		c.lookup(s.Token.Line, s.Timer, kindTimer)
+		c.expr(s.Token.Line, s.Deadline)
+	case *ast.ProtocolDecl:
+		for _, t := range s.Items {
+			c.checkTypeRef(s.Token.Line, t, kindRecord, kindDataType)
+		}
+		for _, v := range s.Variants {
+			for _, t := range v.Items {
+				c.checkTypeRef(s.Token.Line, t, kindRecord, kindDataType)
+			}
+		}
+	case *ast.RecordDecl:
+		for _, f := range s.Fields {
+			if f.IsChan {
+				c.checkType(s.Token.Line, f.Type, kindProtocol)
+			} else {
+				c.checkType(s.Token.Line, f.Type, kindRecord, kindDataType)
+			}
+		}
+	case *ast.DataTypeDecl:
+		c.checkType(s.Token.Line, s.Type, kindDataType)
+	}
+	c.declare(stmt)
+}
+
+func (c *checker) abbreviation(a *ast.Abbreviation) {
+	line := a.Token.Line
+	if a.IsChan {
+		c.chanAbbreviation(a)
+		return
+	}
+	c.expr(line, a.Value)
+	if a.TypeRef == nil {
+		return
+	}
+	c.checkTypeRef(line, a.TypeRef, kindRecord, kindDataType)
+	if root := c.root(a.Value); root != nil && root.kind != kindVar {
+		return
+	}
+	c.mismatch(line, "cannot abbreviate %s as %s of type %s", "", 0, a.Name, a.Type, a.OpenArrayDims, a.Value)
+}
+
+// retypes checks a RETYPES or RESHAPES declaration. Unless VAL, it must
+// name a variable, element or segment to alias; RESHAPES keeps the element
+// type, and the number of elements where both are constant.
+func (c *checker) retypes(r *ast.RetypesDecl) {
+	line := r.Token.Line
+	for _, size := range r.Sizes {
+		if size != nil {
+			c.expr(line, size)
+		}
+	}
+	c.checkTypeRef(line, r.TypeRef, kindRecord, kindDataType)
+	c.expr(line, r.Source)
+	what := map[bool]string{false: "retype", true: "reshape"}[r.Reshapes]
+	if !r.IsVal {
+		if root := c.root(r.Source); root == nil || root.kind != kindVar {
+			c.errorf(line, "only a variable can be %sd as %s", what, r.Name)
+		} else if root.isVal {
+			c.errorf(line, "cannot %s a VAL as %s, which is not VAL", what, r.Name)
+		}
+	}
+	if !r.Reshapes {
+		return
+	}
+	typ, dims := c.typeOf(r.Source)
+	if typ != "" && (typ != r.TargetType || dims == 0) {
+		c.errorf(line, "cannot reshape %s as %s of type %s", typeName(typ, dims), r.Name, typeName(r.TargetType, len(r.Sizes)))
+		return
+	}
+	if from, to := count(c.sizesOf(r.Source)), count(c.constSizes(r.Sizes)); from >= 0 && to >= 0 && from != to {
+		c.errorf(line, "cannot reshape %d elements as %s of %d", from, r.Name, to)
+	}
+}
+
+// count returns the number of elements of an array with sizes, or -1 if
+// a size is not known.
+func count(sizes []int64) int64 {
+	if len(sizes) == 0 {
+		return -1
+	}
+	n := int64(1)
+	for _, size := range sizes {
+		if size < 0 {
+			return -1
+		}
+		n *= size
+	}
+	return n
+}
+
+// chanAbbreviation checks a CHAN abbreviation, which must name a channel,
+// element or segment of a channel array with the abbreviation's protocol and
+// dimensions, and may not take the other end of a channel restricted to one.
+func (c *checker) chanAbbreviation(a *ast.Abbreviation) {
+	line := a.Token.Line
+	c.checkTypeRef(line, a.TypeRef, kindProtocol, kindRecord, kindDataType)
+	sym, dims := c.chanValue(line, a.Value)
+	if sym == nil {
+		return
+	}
+	if sym.typ != a.Type || dims != a.OpenArrayDims {
+		c.errorf(line, "cannot abbreviate %s as %s of type %s", typeName("CHAN OF "+sym.typ, dims), a.Name, typeName("CHAN OF "+a.Type, a.OpenArrayDims))
+	}
+	if a.ChanDir != "" && sym.end != "" && sym.end != a.ChanDir {
+		c.errorf(line, "cannot abbreviate the %s end of a channel as %s%s", sym.end, a.Name, a.ChanDir)
+	}
+}
+
+// chanValue checks the channel e, a channel or an element or segment of a
+// channel array, and returns the channel it is rooted at and the dimensions
+// left after indexing it.
+func (c *checker) chanValue(line int, e ast.Expression) (*symbol, int) {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		if sym := c.lookup(line, e.Value, kindChan); sym != nil {
+			return sym, sym.dims
+		}
+	case *ast.IndexExpr:
+		c.expr(line, e.Index)
+		if sym, dims := c.chanValue(line, e.Left); sym != nil {
+			return sym, dims - 1
+		}
+	case *ast.SliceExpr:
+		c.expr(line, e.Start)
+		c.expr(line, e.Length)
+		c.checkSegment(line, e)
+		return c.chanValue(line, e.Array)
+	case *ast.ParenExpr:
+		return c.chanValue(line, e.Expr)
+	default:
+		c.expr(line, e)
+		c.errorf(line, "only a channel can be abbreviated as a channel")
+	}
+	return nil, 0
+}
+
+func (c *checker) function(f *ast.FuncDecl) {
+	line := f.Token.Line
+	for _, t := range f.Results {
+		c.checkTypeRef(line, t, kindRecord, kindDataType)
+	}
+	c.declare(f)
+	c.push()
+	c.declareParams(f.Params)
+	c.statements(f.Body)
+	for i, r := range f.ResultExprs {
+		c.expr(line, r)
+		if len(f.ResultExprs) == len(f.Results) {
+			want, wantDims := resultType(f.Results[i])
+			if typ, dims := c.typeOf(r); typ != "" && !sameType(typ, dims, want, wantDims) {
+				c.errorf(line, "result %d of %s is %s, not %s", i+1, f.Name, typeName(typ, dims), typeName(want, wantDims))
+			}
+		}
+	}
+	if len(f.ResultExprs) > 0 && len(f.ResultExprs) != len(f.Results) {
+		c.errorf(line, "FUNCTION %s returns %d values, not %d", f.Name, len(f.Results), len(f.ResultExprs))
+	}
+	c.pop()
+}
+
+func (c *checker) ifStatement(s *ast.IfStatement) {
+	c.push()
+	if s.Replicator != nil {
+		c.replicator(s.Token.Line, s.Replicator)
+	}
+	for _, choice := range s.Choices {
+		if choice.NestedIf != nil {
+			c.ifStatement(choice.NestedIf)
+			continue
+		}
+		c.condition(s.Token.Line, "IF", choice.Condition)
+		c.block(choice.Body)
+	}
+	c.pop()
+}
+
+// condition checks the condition of an IF choice, WHILE loop or ALT guard.
+func (c *checker) condition(line int, what string, e ast.Expression) {
+	if e == nil {
+		return
+	}
+	c.expr(line, e)
+	if typ, dims := c.typeOf(e); typ != "" && !sameType(typ, dims, "BOOL", 0) {
+		c.errorf(line, "%s condition is %s, not BOOL", what, typeName(typ, dims))
+	}
+}
+
+// target checks an assignment or input target name[indices...] and returns
+// its type, "" if unknown.
+func (c *checker) target(line int, name string, indices []ast.Expression) (string, int) {
+	sym := c.lookup(line, name, kindVar)
+	if sym == nil {
+		for _, idx := range indices {
+			c.expr(line, idx)
+		}
+		return "", 0
+	}
+	if sym.isVal {
+		c.errorf(line, "cannot assign to VAL %s", name)
+	}
+	for i := 0; i < len(indices) && i < sym.dims && i < len(sym.sizes); i++ {
+		c.checkIndex(line, c.indexedText(name, indices[:i]), indices[i], sym.sizes[i])
+	}
+	return c.indices(line, sym.typ, sym.dims, indices)
+}
+
+// indices checks the indices of a value of type typ, each an array index or,
+// for a record, a field name, and returns the type of the element indexed.
+func (c *checker) indices(line int, typ string, dims int, indices []ast.Expression) (string, int) {
+	for _, idx := range indices {
+		switch {
+		case dims > 0:
+			c.expr(line, idx)
+			dims--
+		case c.record(typ) != nil:
+			rec := c.record(typ)
+			typ = ""
+			if ident, ok := idx.(*ast.Identifier); ok {
+				f := field(rec, ident.Value)
+				if f == nil {
+					c.errorf(ident.Token.Line, "RECORD %s has no field %s", rec.Name, ident.Value)
+				} else if !f.IsChan {
+					typ = f.Type
+				}
+			} else {
+				c.expr(line, idx)
+			}
+		default:
+			c.expr(line, idx)
+			typ = ""
+		}
+	}
+	return typ, dims
+}
+
+// checkIndex reports a constant index idx of array name that is outside a
+// dimension of constant size, which would otherwise fail only when run.
+func (c *checker) checkIndex(line int, name string, idx ast.Expression, size int64) {
+	if size < 0 {
+		return
+	}
+	if i, ok := c.constant(idx); ok && (i < 0 || i >= size) {
+		c.errorf(line, "index %d is out of range for %s, which has %d elements", i, name, size)
+	}
+}
+
+// checkSegment reports a segment [a FROM start FOR n] of an array of constant
+// size that reaches outside it, for the start and count that are constant.
+func (c *checker) checkSegment(line int, e *ast.SliceExpr) {
+	sizes := c.sizesOf(e.Array)
+	name := c.arrayText(e.Array)
+	if len(sizes) == 0 || sizes[0] < 0 || name == "" {
+		return
+	}
+	size := sizes[0]
+	start, startOK := c.constant(e.Start)
+	n, nOK := c.constant(e.Length)
+	var segment string
+	switch {
+	case startOK && nOK && (start < 0 || n < 0 || start+n > size):
+		segment = fmt.Sprintf("FROM %d FOR %d", start, n)
+	case startOK && (start < 0 || start > size):
+		segment = fmt.Sprintf("FROM %d", start)
+	case nOK && (n < 0 || n > size):
+		segment = fmt.Sprintf("FOR %d", n)
+	default:
+		return
+	}
+	c.errorf(line, "segment %s is out of range for %s, which has %d elements", segment, name, size)
+}
+
+// arrayText returns the array e as an error names it, such as m[1] for a row
+// of a two-dimensional m, or "" if e is not a name or an element of one.
+func (c *checker) arrayText(e ast.Expression) string {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		return e.Value
+	case *ast.IndexExpr:
+		if name := c.arrayText(e.Left); name != "" {
+			return c.indexedText(name, []ast.Expression{e.Index})
+		}
+	case *ast.ParenExpr:
+		return c.arrayText(e.Expr)
+	}
+	return ""
+}
+
+// indexedText returns name followed by indices, each written as its value if
+// constant.
+func (c *checker) indexedText(name string, indices []ast.Expression) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, idx := range indices {
+		if v, ok := c.constant(idx); ok {
+			fmt.Fprintf(&b, "[%d]", v)
+		} else if ident, ok := idx.(*ast.Identifier); ok {
+			fmt.Fprintf(&b, "[%s]", ident.Value)
+		} else {
+			b.WriteString("[...]")
+		}
+	}
+	return b.String()
+}
+
+// constSizes returns the values of array sizes, -1 for those that are not
+// constant.
+func (c *checker) constSizes(sizes []ast.Expression) []int64 {
+	values := make([]int64, len(sizes))
+	for i, size := range sizes {
+		v, ok := c.constant(size)
+		if !ok {
+			v = -1
+		}
+		values[i] = v
+	}
+	return values
+}
+
+// sizesOf returns the constant sizes of the dimensions of the array e, as
+// far as they are known.
+func (c *checker) sizesOf(e ast.Expression) []int64 {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		if sym := c.scope.lookup(e.Value); sym != nil {
+			return sym.sizes
+		}
+	case *ast.IndexExpr:
+		if sizes := c.sizesOf(e.Left); len(sizes) > 1 {
+			return sizes[1:]
+		}
+	case *ast.SliceExpr:
+		// A segment has as many elements as its FOR says, if constant
+		sizes := append([]int64{-1}, c.sizesOf(e.Array)...)
+		if len(sizes) > 1 {
+			sizes = append(sizes[:1], sizes[2:]...)
+		}
+		if n, ok := c.constant(e.Length); ok {
+			sizes[0] = n
+		}
+		return sizes
+	case *ast.ParenExpr:
+		return c.sizesOf(e.Expr)
+	case *ast.ArrayLiteral:
+		return []int64{int64(len(e.Elements))}
+	case *ast.ArrayConstructor:
+		if n, ok := c.constant(e.Replicator.Count); ok {
+			return []int64{n}
+		}
+		return []int64{-1}
+	}
+	return nil
+}
+
+// constant returns the value of an integer expression that is known at
+// compile time: literals and constant VAL abbreviations combined by
+// arithmetic, and SIZE of arrays of constant size.
+func (c *checker) constant(e ast.Expression) (int64, bool) {
+	switch e := e.(type) {
+	case *ast.IntegerLiteral:
+		return e.Value, true
+	case *ast.ByteLiteral:
+		return int64(e.Value), true
+	case *ast.Identifier:
+		if sym := c.scope.lookup(e.Value); sym != nil && sym.known {
+			return sym.value, true
+		}
+	case *ast.ParenExpr:
+		return c.constant(e.Expr)
+	case *ast.SizeExpr:
+		if sizes := c.sizesOf(e.Expr); len(sizes) > 0 && sizes[0] >= 0 {
+			return sizes[0], true
+		}
+	case *ast.UnaryExpr:
+		if v, ok := c.constant(e.Right); ok && e.Operator == "-" {
+			return -v, true
+		}
+	case *ast.BinaryExpr:
+		l, ok := c.constant(e.Left)
+		if !ok {
+			return 0, false
+		}
+		r, ok := c.constant(e.Right)
+		if !ok {
+			return 0, false
+		}
+		switch e.Operator {
+		case "+":
+			return l + r, true
+		case "-":
+			return l - r, true
+		case "*":
+			return l * r, true
+		case "/":
+			if r != 0 {
+				return l / r, true
+			}
+		case "\\":
+			if r != 0 {
+				return l % r, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// record returns the declaration of the RECORD type typ, or nil.
+func (c *checker) record(typ string) *ast.RecordDecl {
+	if typ == "" || scalarTypes[typ] {
+		return nil
+	}
+	if sym := c.scope.lookup(typ); sym != nil {
+		return sym.record
+	}
+	return nil
+}
+
+func field(rec *ast.RecordDecl, name string) *ast.RecordField {
+	for i := range rec.Fields {
+		if rec.Fields[i].Name == name {
+			return &rec.Fields[i]
+		}
+	}
+	return nil
+}
+
+// indexed returns the type of sym indexed by indices: an element of an
+// array, or a field of a record.
+func (c *checker) indexed(sym *symbol, indices []ast.Expression) (string, int) {
+	typ, dims := sym.typ, sym.dims
+	for _, idx := range indices {
+		if dims > 0 {
+			dims--
+			continue
+		}
+		ident, ok := idx.(*ast.Identifier)
+		rec := c.record(typ)
+		if !ok || rec == nil {
+			return "", 0
+		}
+		f := field(rec, ident.Value)
+		if f == nil || f.IsChan {
+			return "", 0
+		}
+		typ = f.Type
+	}
+	return typ, dims
+}
+
+func (c *checker) assignment(a *ast.Assignment) {
+	line := a.Token.Line
+	c.expr(line, a.Value)
+	if a.SliceTarget != nil {
+		c.expr(line, a.SliceTarget)
+		return
+	}
+	typ, dims := c.target(line, a.Name, a.Indices)
+	c.mismatch(line, assignFormat, "", 0, targetName(a.Name, a.Indices), typ, dims, a.Value)
+}
+
+func (c *checker) multiAssignment(m *ast.MultiAssignment) {
+	line := m.Token.Line
+	for _, v := range m.Values {
+		c.expr(line, v)
+	}
+	types := make([]string, len(m.Targets))
+	dims := make([]int, len(m.Targets))
+	for i, t := range m.Targets {
+		types[i], dims[i] = c.target(line, t.Name, t.Indices)
+	}
+	if len(m.Values) == len(m.Targets) {
+		for i, v := range m.Values {
+			c.mismatch(line, assignFormat, "", 0, targetName(m.Targets[i].Name, m.Targets[i].Indices), types[i], dims[i], v)
+		}
+		return
+	}
+	if mobile, ok := m.Values[0].(*ast.MobileExpr); ok && len(m.Values) == 1 {
+		// The ends of a new bundle: svr, cli := MOBILE FOO
+		for i, t := range m.Targets {
+			c.mismatch(line, assignFormat, mobile.Type, 0, targetName(t.Name, t.Indices), types[i], dims[i])
+		}
+		return
+	}
+	call, ok := m.Values[0].(*ast.FuncCall)
+	if !ok || len(m.Values) != 1 {
+		c.errorf(line, "cannot assign %d values to %d variables", len(m.Values), len(m.Targets))
+		return
+	}
+	sym := c.scope.lookup(call.Name)
+	if sym == nil || sym.kind != kindFunc {
+		return
+	}
+	if len(sym.result) != len(m.Targets) {
+		c.errorf(line, "FUNCTION %s returns %d values, not %d", call.Name, len(sym.result), len(m.Targets))
+		return
+	}
+	for i, r := range sym.result {
+		typ, rdims := resultType(r)
+		c.mismatch(line, assignFormat, typ, rdims, targetName(m.Targets[i].Name, m.Targets[i].Indices), types[i], dims[i])
+	}
+}
+
+const assignFormat = "cannot assign %s to %s of type %s"
+
+// mismatch reports putting a value of type typ (or, when typ is "", the type
+// of value[0]) into name, of type want, if both types are known and differ.
+// format takes the value's type, name and want.
+func (c *checker) mismatch(line int, format, typ string, dims int, name, want string, wantDims int, value ...ast.Expression) {
+	if typ == "" && len(value) > 0 {
+		typ, dims = c.typeOf(value[0])
+		if _, ok := value[0].(*ast.RealLiteral); ok && typ == "" {
+			// Undecorated, it can still be any REAL type but no other
+			if !scalarTypes[want] || strings.HasPrefix(want, "REAL") {
+				return
+			}
+			typ = "REAL"
+		}
+	}
+	if typ == "" || want == "" || sameType(typ, dims, want, wantDims) {
+		return
+	}
+	c.errorf(line, format, typeName(typ, dims), name, typeName(want, wantDims))
+}
+
+func (c *checker) procCall(call *ast.ProcCall) {
+	line := call.Token.Line
+	for _, arg := range call.Args {
+		c.expr(line, arg)
+	}
+	if builtinProcs[call.Name] {
+		return
+	}
+	sym := c.lookup(line, call.Name, kindProc)
+	if sym == nil {
+		return
+	}
+	c.arguments(line, "PROC", call.Name, sym.params, call.Args)
+}
+
+// arguments checks the number of arguments of a call, the types of those
+// passed for scalar parameters and the PROTOCOLs of channels passed for
+// variant PROTOCOL channel parameters.
+func (c *checker) arguments(line int, what, name string, params []ast.ProcParam, args []ast.Expression) {
+	if len(args) != len(params) {
+		c.errorf(line, "%s %s takes %d arguments, not %d", what, name, len(params), len(args))
+		return
+	}
+	for i, p := range params {
+		if p.IsChan && p.ChanArrayDims == 0 {
+			c.channelArgument(line, i, name, p, args[i])
+			continue
+		}
+		if p.IsChan || p.OpenArrayDims > 0 || p.ArraySize != "" {
+			continue
+		}
+		if typ, dims := c.typeOf(args[i]); typ != "" && !sameType(typ, dims, p.Type, 0) {
+			c.errorf(line, "argument %d of %s is %s, not %s", i+1, name, typeName(typ, dims), typeName(p.Type, 0))
+		} else if sym := c.root(args[i]); sym != nil && sym.end != "" && sym.end != p.ChanDir {
+			c.errorf(line, "argument %d of %s is %s%s, not %s%s", i+1, name, sym.typ, sym.end, p.Type, p.ChanDir)
+		}
+	}
+}
+
+// channelArgument checks the channel arg passed for the variant PROTOCOL
+// channel parameter p. A channel of a PROTOCOL that EXTENDS p's may be
+// passed for an output (!) parameter, as it carries every tag p's does, and
+// one of a PROTOCOL that p's EXTENDS for an input (?) parameter.
+func (c *checker) channelArgument(line, i int, name string, p ast.ProcParam, arg ast.Expression) {
+	ident, ok := arg.(*ast.Identifier)
+	if !ok {
+		return
+	}
+	sym := c.scope.lookup(ident.Value)
+	if sym == nil || sym.kind != kindChan || sym.dims != 0 || sym.typ == p.ChanElemType {
+		return
+	}
+	if c.protocol(sym.typ) == nil || c.protocol(p.ChanElemType) == nil {
+		return
+	}
+	switch {
+	case p.ChanDir == "!" && c.extends(sym.typ, p.ChanElemType):
+	case p.ChanDir == "?" && c.extends(p.ChanElemType, sym.typ):
+	default:
+		c.errorf(line, "argument %d of %s is CHAN OF %s, not CHAN OF %s%s", i+1, name, sym.typ, p.ChanElemType, p.ChanDir)
+	}
+}
+
+// protocol returns the variant PROTOCOL named typ, if there is one.
+func (c *checker) protocol(typ string) *ast.ProtocolDecl {
+	if sym := c.scope.lookup(typ); sym != nil && sym.proto != nil && sym.proto.Kind == "variant" {
+		return sym.proto
+	}
+	return nil
+}
+
+// extends reports whether PROTOCOL name is base or EXTENDS it, directly or
+// through other PROTOCOLs.
+func (c *checker) extends(name, base string) bool {
+	for name != base {
+		proto := c.protocol(name)
+		if proto == nil || proto.Extends == "" {
+			return false
+		}
+		name = proto.Extends
+	}
+	return true
+}
+
+// channel checks the channel of a communication, name[indices...], and
+// returns its element type or protocol if it is known.
+func (c *checker) channel(line int, name string, indices []ast.Expression, op string) string {
+	sym := c.scope.lookup(name)
+	switch {
+	case sym == nil:
+		c.errorf(line, "%s is not declared", name)
+	case sym.kind == kindChan:
+		if sym.shared && sym.end != "" && !c.claimed[sym] {
+			c.errorf(line, "%s is SHARED and must be used inside CLAIM %s", name, name)
+		}
+		if sym.end != "" && sym.end != op && len(indices) == sym.dims {
+			verb := map[string]string{"!": "send on", "?": "receive from"}[op]
+			c.errorf(line, "cannot %s %s, the %s end of a channel", verb, name, sym.end)
+		}
+		for i, idx := range indices {
+			c.expr(line, idx)
+			if i < len(sym.sizes) {
+				c.checkIndex(line, c.indexedText(name, indices[:i]), idx, sym.sizes[i])
+			}
+		}
+		if len(indices) != sym.dims {
+			return ""
+		}
+		return sym.typ
+	case sym.kind == kindVar && len(indices) > 0:
+		// A CHAN OF field of a record: r[field]
+		typ, dims := c.indices(line, sym.typ, sym.dims, indices[:len(indices)-1])
+		rec := c.record(typ)
+		ident, ok := indices[len(indices)-1].(*ast.Identifier)
+		if dims == 0 && rec != nil && ok {
+			f := field(rec, ident.Value)
+			if f == nil {
+				c.errorf(line, "RECORD %s has no field %s", rec.Name, ident.Value)
+				return ""
+			}
+			if f.IsChan {
+				c.bundleField(line, name, sym, f, op)
+				return f.Type
+			}
+		}
+		c.errorf(line, "%s is a %s, not a channel", name, kindNames[sym.kind])
+		return ""
+	default:
+		c.errorf(line, "%s is a %s, not a channel", name, kindNames[sym.kind])
+	}
+	for _, idx := range indices {
+		c.expr(line, idx)
+	}
+	return ""
+}
+
+// bundleField checks communicating (op "!" or "?") on field f of sym, if
+// sym is an end of a CHAN TYPE: fields are declared as seen from the ? end,
+// so the ! end uses each in the other direction, and a SHARED end must be
+// CLAIMed first.
+func (c *checker) bundleField(line int, name string, sym *symbol, f *ast.RecordField, op string) {
+	if sym.end == "" {
+		return
+	}
+	dir := f.Dir
+	if sym.end == "!" {
+		dir = map[string]string{"?": "!", "!": "?"}[dir]
+	}
+	if op != dir {
+		verb := map[string]string{"!": "send on", "?": "receive from"}[op]
+		c.errorf(line, "cannot %s %s[%s] at the %s%s end", verb, name, f.Name, sym.typ, sym.end)
+	}
+	if sym.shared && !c.claimed[sym] {
+		c.errorf(line, "%s is SHARED and must be used inside CLAIM %s", name, name)
+	}
+}
+
+// claim checks CLAIM name and its body, in which name may be used.
+func (c *checker) claim(s *ast.ClaimBlock) {
+	sym := c.lookup(s.Token.Line, s.Name, kindVar, kindChan)
+	switch {
+	case sym == nil || sym.shared:
+	case sym.kind == kindChan:
+		c.errorf(s.Token.Line, "CLAIM %s: %s is not a SHARED channel", s.Name, s.Name)
+	default:
+		c.errorf(s.Token.Line, "CLAIM %s: %s is not a SHARED CHAN TYPE end", s.Name, s.Name)
+	}
+	if sym != nil {
+		defer delete(c.claimed, sym)
+		c.claimed[sym] = true
+	}
+	c.block(s.Body)
+}
+
+func (c *checker) send(s *ast.Send) {
+	line := s.Token.Line
+	elem := c.channel(line, s.Channel, s.ChannelIndices, "!")
+	if s.VariantTag != "" {
+		c.lookup(line, s.VariantTag, kindTag)
+	}
+	values := s.Values
+	if s.Value != nil {
+		values = append([]ast.Expression{s.Value}, values...)
+	}
+	for _, v := range values {
+		c.expr(line, v)
+	}
+	if scalarTypes[elem] && len(values) == 1 {
+		if typ, dims := c.typeOf(values[0]); typ != "" && !sameType(typ, dims, elem, 0) {
+			c.errorf(line, "cannot send %s on %s of type %s", typeName(typ, dims), s.Channel, elem)
+		}
+	}
+}
+
+func (c *checker) receive(r *ast.Receive) {
+	line := r.Token.Line
+	elem := c.channel(line, r.Channel, r.ChannelIndices, "?")
+	typ, dims := c.target(line, r.Variable, r.VariableIndices)
+	for _, v := range r.Variables {
+		c.target(line, v, nil)
+	}
+	for _, a := range r.Arrays {
+		if a != "" {
+			c.target(line, a, nil)
+		}
+	}
+	if scalarTypes[elem] && len(r.Variables) == 0 && r.Arrays == nil {
+		c.received(line, r.Channel, elem, r.Variable, typ, dims)
+	}
+}
+
+// received reports receiving from a channel of scalar type elem into a
+// variable of another type.
+func (c *checker) received(line int, channel, elem, name, typ string, dims int) {
+	if typ != "" && !sameType(elem, 0, typ, dims) {
+		c.errorf(line, "cannot receive %s from %s into %s of type %s", elem, channel, name, typeName(typ, dims))
+	}
+}
+
+func (c *checker) variantReceive(v *ast.VariantReceive) {
+	line := v.Token.Line
+	c.channel(line, v.Channel, v.ChannelIndices, "?")
+	for _, vc := range v.Cases {
+		c.push()
+		c.statements(vc.Declarations)
+		if !vc.IsElse {
+			c.lookup(line, vc.Tag, kindTag)
+		}
+		for _, name := range vc.Variables {
+			c.target(line, name, nil)
+		}
+		for _, a := range vc.Arrays {
+			if a != "" {
+				c.target(line, a, nil)
+			}
+		}
+		c.block(vc.Body)
+		c.pop()
+	}
+}
+
+func (c *checker) altBlock(alt *ast.AltBlock) {
+	line := alt.Token.Line
+	c.push()
+	if alt.Replicator != nil {
+		c.replicator(line, alt.Replicator)
+	}
+	for _, ac := range alt.Cases {
+		c.push()
+		c.statements(ac.Declarations)
+		c.condition(line, "ALT guard", ac.Guard)
+		switch {
+		case ac.IsTimer:
+			c.lookup(line, ac.Timer, kindTimer)
+			c.expr(line, ac.Deadline)
+		case ac.IsVariant:
+			// The channel and variants are checked with the VariantReceive
+			// of the body
+		case ac.IsOutput:
+			// The channel and values are checked with the Send starting
+			// the body
+		case ac.IsAlt:
+			// The alternatives are checked with the AltBlock of the body
+		case !ac.IsSkip:
+			elem := c.channel(line, ac.Channel, ac.ChannelIndices, "?")
+			if ac.Variable != "" {
+				typ, dims := c.target(line, ac.Variable, ac.VariableIndices)
+				for _, v := range ac.Variables {
+					c.target(line, v, nil)
+				}
+				for _, a := range ac.Arrays {
+					if a != "" {
+						c.target(line, a, nil)
+					}
+				}
+				if scalarTypes[elem] && len(ac.Variables) == 0 && ac.Arrays == nil {
+					c.received(line, ac.Channel, elem, ac.Variable, typ, dims)
+				}
+			}
+		}
+		c.statements(ac.Body)
+		c.pop()
+	}
+	c.pop()
+}
+
+// expr checks the names used in e.
+func (c *checker) expr(line int, e ast.Expression) {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		if sym := c.scope.lookup(e.Value); sym == nil {
+			c.errorf(e.Token.Line, "%s is not declared", e.Value)
+		} else if sym.kind == kindProc || sym.kind == kindFunc {
+			c.errorf(e.Token.Line, "%s is a %s, not a value", e.Value, kindNames[sym.kind])
+		}
+	case *ast.BinaryExpr:
+		c.expr(line, e.Left)
+		c.expr(line, e.Right)
+		c.operands(e)
+	case *ast.UnaryExpr:
+		c.expr(line, e.Right)
+		if e.Operator == "NOT" {
+			if typ, dims := c.typeOf(e.Right); typ != "" && !sameType(typ, dims, "BOOL", 0) {
+				c.errorf(e.Token.Line, "operand of NOT is %s, not BOOL", typeName(typ, dims))
+			}
+		}
+	case *ast.TypeConversion:
+		c.expr(line, e.Expr)
+	case *ast.MobileExpr:
+		if e.Size != nil {
+			c.expr(line, e.Size)
+			c.checkType(e.Token.Line, e.Type, kindRecord, kindDataType)
+			break
+		}
+		c.lookup(e.Token.Line, e.Type, kindRecord)
+	case *ast.SizeExpr:
+		c.expr(line, e.Expr)
+	case *ast.ParenExpr:
+		c.expr(line, e.Expr)
+	case *ast.IndexExpr:
+		c.expr(line, e.Left)
+		typ, dims := c.typeOf(e.Left)
+		c.indices(line, typ, dims, []ast.Expression{e.Index})
+		if sizes := c.sizesOf(e.Left); len(sizes) > 0 {
+			if name := c.arrayText(e.Left); name != "" {
+				c.checkIndex(line, name, e.Index, sizes[0])
+			}
+		}
+	case *ast.FuncCall:
+		for _, arg := range e.Args {
+			c.expr(line, arg)
+		}
+		if builtinFuncs[e.Name] {
+			return
+		}
+		if sym := c.lookup(e.Token.Line, e.Name, kindFunc); sym != nil {
+			c.arguments(e.Token.Line, "FUNCTION", e.Name, sym.params, e.Args)
+		}
+	case *ast.SliceExpr:
+		c.expr(line, e.Array)
+		c.expr(line, e.Start)
+		if e.Length != nil {
+			c.expr(line, e.Length)
+		}
+		c.checkSegment(line, e)
+	case *ast.CountedArrayExpr:
+		c.expr(line, e.Count)
+		c.expr(line, e.Array)
+	case *ast.ArrayLiteral:
+		for _, el := range e.Elements {
+			c.expr(line, el)
+		}
+	case *ast.ArrayConstructor:
+		c.push()
+		c.replicator(e.Token.Line, e.Replicator)
+		c.expr(e.Token.Line, e.Value)
+		c.pop()
+	case *ast.ValofExpr:
+		// The result is in the scope of the body's declarations
+		c.push()
+		c.statements(e.Body)
+		c.expr(e.Token.Line, e.Result)
+		c.pop()
+	}
+}
+
+// operands reports binary operations on mismatched types, and AND/OR on
+// operands that are not BOOL.
+func (c *checker) operands(e *ast.BinaryExpr) {
+	lt, ld := c.typeOf(e.Left)
+	rt, rd := c.typeOf(e.Right)
+	switch e.Operator {
+	case "AND", "OR":
+		for _, t := range []struct {
+			typ  string
+			dims int
+		}{{lt, ld}, {rt, rd}} {
+			if t.typ != "" && !sameType(t.typ, t.dims, "BOOL", 0) {
+				c.errorf(e.Token.Line, "operand of %s is %s, not BOOL", e.Operator, typeName(t.typ, t.dims))
+			}
+		}
+	case "<<", ">>":
+		// The shift count need not have the type of the value shifted
+	default:
+		if lt != "" && rt != "" && !sameType(lt, ld, rt, rd) {
+			c.errorf(e.Token.Line, "mismatched types %s and %s in %s", typeName(lt, ld), typeName(rt, rd), e.Operator)
+		}
+	}
+}
+
+// typeOf returns the type and array dimensions of e, or "" if it is not
+// known. Integer and byte literals are untyped: they fit any numeric type.
+func (c *checker) typeOf(e ast.Expression) (string, int) {
+	switch e.(type) {
+	case *ast.BinaryExpr, *ast.UnaryExpr, *ast.ParenExpr:
+		if t, ok := c.types[e]; ok {
+			return t.typ, t.dims
+		}
+		typ, dims := c.findType(e)
+		c.types[e] = exprType{typ, dims}
+		return typ, dims
+	}
+	return c.findType(e)
+}
+
+// findType works out the type of e for typeOf, which keeps those of
+// operators.
+func (c *checker) findType(e ast.Expression) (string, int) {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		if sym := c.scope.lookup(e.Value); sym != nil && sym.kind == kindVar {
+			return sym.typ, sym.dims
+		}
+	case *ast.BooleanLiteral:
+		return "BOOL", 0
+	case *ast.RealLiteral:
+		// An undecorated literal takes the REAL type of its context
+		return e.Type, 0
+	case *ast.StringLiteral:
+		return "BYTE", 1
+	case *ast.BinaryExpr:
+		switch e.Operator {
+		case "=", "<>", "<", ">", "<=", ">=", "AND", "OR", "AFTER":
+			return "BOOL", 0
+		case "<<", ">>":
+			return c.typeOf(e.Left)
+		}
+		if typ, dims := c.typeOf(e.Left); typ != "" {
+			return typ, dims
+		}
+		return c.typeOf(e.Right)
+	case *ast.UnaryExpr:
+		if e.Operator == "NOT" {
+			return "BOOL", 0
+		}
+		return c.typeOf(e.Right)
+	case *ast.TypeConversion:
+		return e.TargetType, 0
+	case *ast.SizeExpr:
+		return "INT", 0
+	case *ast.MobileExpr:
+		if e.Size != nil {
+			return e.Type, 1
+		}
+		return e.Type, 0
+	case *ast.MostExpr:
+		return e.ExprType, 0
+	case *ast.ParenExpr:
+		return c.typeOf(e.Expr)
+	case *ast.IndexExpr:
+		var indices []ast.Expression
+		left := ast.Expression(e)
+		for {
+			ie, ok := left.(*ast.IndexExpr)
+			if !ok {
+				break
+			}
+			indices = append([]ast.Expression{ie.Index}, indices...)
+			left = ie.Left
+		}
+		if ident, ok := left.(*ast.Identifier); ok {
+			if sym := c.scope.lookup(ident.Value); sym != nil && sym.kind == kindVar {
+				return c.indexed(sym, indices)
+			}
+		}
+	case *ast.FuncCall:
+		if sym := c.scope.lookup(e.Name); sym != nil && sym.kind == kindFunc && len(sym.result) == 1 {
+			return resultType(sym.result[0])
+		}
+	}
+	return "", 0
+}
+
+// sameType reports whether two types are the same, counting REAL as REAL64.
+func sameType(a string, adims int, b string, bdims int) bool {
+	if a == "REAL" {
+		a = "REAL64"
+	}
+	if b == "REAL" {
+		b = "REAL64"
+	}
+	return a == b && adims == bdims
+}
+
+// targetName formats an assignment target for messages: fields by name,
+// array indices elided, e.g. p[x] or a[...].
+func targetName(name string, indices []ast.Expression) string {
+	for _, idx := range indices {
+		if ident, ok := idx.(*ast.Identifier); ok {
+			name += "[" + ident.Value + "]"
+		} else {
+			name += "[...]"
+		}
+	}
+	return name
+}
+
+// typeName formats a type with its array dimensions, e.g. []BYTE.
+func typeName(typ string, dims int) string {
+	return strings.Repeat("[]", dims) + typ
+}
+
+// resultType returns the element type of a FUNCTION result t and its number
+// of array dimensions.
+func resultType(t *ast.TypeRef) (string, int) {
+	dims, elem := t.Dims()
+	return elem.Name, dims
+}
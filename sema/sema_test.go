@@ -0,0 +1,577 @@
+package sema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeassociates/occam2go/ast"
+	"github.com/codeassociates/occam2go/lexer"
+	"github.com/codeassociates/occam2go/parser"
+)
+
+func parse(t *testing.T, src string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parse errors: %v", p.Errors())
+	}
+	return program
+}
+
+func TestCheckValid(t *testing.T) {
+	program := parse(t, `VAL INT limit IS double(half):
+VAL INT half IS 4:
+PROTOCOL CMD
+  CASE
+    move ; INT
+    quit
+:
+RECORD LINK
+  CHAN OF INT data:
+  INT count:
+DATA TYPE MY.INT IS INT:
+DATA TYPE CELL
+  RECORD
+    MY.INT count:
+:
+INT FUNCTION double(VAL INT n)
+  IS n * 2
+:
+INT, INT FUNCTION pair(VAL INT n)
+  VALOF
+    INT m:
+    m := n + 1
+    RESULT n, m
+:
+[]INT FUNCTION squares(VAL INT n)
+  [4]INT t:
+  VALOF
+    SEQ i = 0 FOR 4
+      t[i] := (i * n) * n
+    RESULT t
+:
+LINK FUNCTION relink(VAL LINK l)
+  IS l
+:
+INT FUNCTION checked(VAL INT n)
+  VALOF
+    IF
+      n < 0
+        STOP
+      n > 100
+        CAUSEERROR()
+      TRUE
+        SKIP
+    RESULT n
+:
+PROC worker(CHAN OF CMD in?, []CHAN OF INT outs!, LINK l)
+  INT x, y:
+  [4]BYTE buf:
+  TIMER tim:
+  SEQ
+    x, y := pair(limit)
+    in ? CASE
+      move ; x
+        outs[0] ! x
+      quit
+        SKIP
+    l[data] ! l[count]
+    l[count] := x
+    tim ? y
+    ALT i = 0 FOR 2
+      INT v:
+      (x > i) & outs[i] ? v
+        SKIP
+    VAL BYTE b IS buf[0]:
+    buf[1] := b
+    SEQ j = 0 FOR SIZE buf
+      x := x + j
+    later()
+    x := (VALOF
+            INT r:
+            r := y + 1
+            RESULT r)
+    VAL []INT sq IS [k = 0 FOR 4 | k * x]:
+    x := sq[1]
+    VAL []INT sq2 IS squares(x):
+    x := sq2[1]
+    CELL cell:
+    cell[count] := MY.INT x
+:
+PROC later()
+  CHAN OF BYTE c:
+  BYTE ch:
+  PAR
+    c ! 'a'
+    c ? ch
+:
+PROC moving(CHAN MOBILE []BYTE out!, MOBILE INT n)
+  MOBILE []BYTE buf:
+  SEQ
+    buf := MOBILE [n]BYTE
+    buf[0] := 'x'
+    out ! buf
+:
+PROC spawner(CHAN MOBILE []BYTE out!)
+  FORKING
+    SEQ i = 1 FOR 2
+      FORK moving(out!, i)
+:
+PROC phase(BARRIER b)
+  SYNC b
+:
+PROC phases()
+  BARRIER b:
+  PAR ENROLL b
+    phase(b)
+    SYNC b
+:
+`)
+	if errs := Check(program); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	program := parse(t, `RECORD POINT
+  INT x:
+PROC p(VAL INT n)
+  SKIP
+:
+PROC main()
+  POINT pt:
+  INT i:
+  SEQ
+    i := j + 1
+    SEQ
+      INT k:
+      k := 1
+    k := 2
+    pt[z] := 1
+    q(1)
+    i(1)
+    i := p
+    i ! 1
+    CHAN OF WIDGET w:
+    SKIP
+:
+`)
+	want := []string{
+		"line 10: j is not declared",
+		"line 14: k is not declared",
+		"line 15: RECORD POINT has no field z",
+		"line 16: q is not declared",
+		"line 17: i is a variable, not a PROC",
+		"line 18: p is a PROC, not a value",
+		"line 19: i is a variable, not a channel",
+		"line 20: WIDGET is not declared",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckRoutineOrder(t *testing.T) {
+	// A run of PROC and FUNCTION declarations may call each other; a PROC
+	// declared after another statement is only in scope after it
+	program := parse(t, `PROC main()
+  PROC ping(VAL INT n)
+    IF
+      n > 0
+        pong(n - 1)
+      TRUE
+        late()
+  :
+  PROC pong(VAL INT n)
+    ping(twice(n))
+  :
+  INT FUNCTION twice(VAL INT n)
+    IS n * 2
+  INT x:
+  PROC late()
+    SKIP
+  :
+  ping(x)
+:
+`)
+	want := []string{
+		"line 7: late is not declared",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckParScopes(t *testing.T) {
+	// Declarations before a PAR branch are in scope for that branch only,
+	// and the body of a replicated PAR is one process
+	program := parse(t, `PROC main(CHAN OF INT in?, out!)
+  [4]CHAN OF INT c:
+  PAR
+    INT a:
+    in ? a
+    VAL INT b IS 2:
+    INT d:
+    SEQ
+      d := a + b
+      out ! d
+    PAR i = 0 FOR 4
+      VAL INT left IS (i + 3) \ 4:
+      INT x:
+      SEQ
+        c[left] ! i
+        c[i] ? x
+    PRI PAR
+      INT e:
+      in ? e
+      out ! 1
+    PLACED PAR
+      PROCESSOR 0 T8
+        INT f:
+        in ? f
+      PROCESSOR 1 T8
+        out ! f
+:
+`)
+	want := []string{
+		"line 9: a is not declared",
+		"line 26: f is not declared",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckTypes(t *testing.T) {
+	program := parse(t, `RECORD POINT
+  INT x:
+INT FUNCTION f(VAL INT a)
+  IS a + 1
+:
+BOOL FUNCTION g(VAL INT a)
+  IS a + 1
+:
+[]INT FUNCTION h(VAL INT a)
+  IS a
+:
+PROC p(VAL INT n)
+  SKIP
+:
+PROC main()
+  BOOL b:
+  BYTE c:
+  INT i:
+  POINT pt:
+  CHAN OF BOOL bc:
+  VAL INT limit IS 3:
+  SEQ
+    b := c
+    pt[x] := c
+    p(b)
+    p(1, 2)
+    i := f(TRUE)
+    WHILE i
+      SKIP
+    bc ! i
+    bc ? i
+    b := i AND b
+    i := i + c
+    i := h(1)
+    CASE c
+      'a', i
+        SKIP
+    limit := 4
+    VAL BOOL flag IS i:
+    SKIP
+:
+`)
+	want := []string{
+		"line 6: result 1 of g is INT, not BOOL",
+		"line 9: result 1 of h is INT, not []INT",
+		"line 23: cannot assign BYTE to b of type BOOL",
+		"line 24: cannot assign BYTE to pt[x] of type INT",
+		"line 25: argument 1 of p is BOOL, not INT",
+		"line 26: PROC p takes 1 arguments, not 2",
+		"line 27: argument 1 of f is BOOL, not INT",
+		"line 28: WHILE condition is INT, not BOOL",
+		"line 30: cannot send INT on bc of type BOOL",
+		"line 31: cannot receive BOOL from bc into i of type INT",
+		"line 32: operand of AND is INT, not BOOL",
+		"line 33: mismatched types INT and BYTE in +",
+		"line 34: cannot assign []INT to i of type INT",
+		"line 35: CASE label is INT, not BYTE",
+		"line 38: cannot assign to VAL limit",
+		"line 39: cannot abbreviate INT as flag of type BOOL",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckLongExpression(t *testing.T) {
+	// Each operand's type is found once, so a long chain of operators is
+	// checked in linear time; recomputing it at each operator took minutes
+	program := parse(t, "PROC p(INT x, BOOL b)\n  x := x"+strings.Repeat(" + x", 50000)+" + b\n:\n")
+	start := time.Now()
+	errs := Check(program)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the chain to be checked quickly, took %v", elapsed)
+	}
+	if want := []string{"line 2: mismatched types INT and BOOL in +"}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected %v, got %v", want, errs)
+	}
+}
+
+func TestCheckRealLiterals(t *testing.T) {
+	program := parse(t, `PROC main()
+  REAL32 x:
+  REAL64 y:
+  INT i:
+  SEQ
+    x := 2.5
+    y := 1.0E-6
+    x := 3.14159(REAL32)
+    x := x * 2.0
+    i := 2.5
+    y := 2.5(REAL32)
+    x := x * 2.0(REAL64)
+    i := INT TRUNC 2.5
+:
+`)
+	want := []string{
+		"line 10: cannot assign REAL to i of type INT",
+		"line 11: cannot assign REAL32 to y of type REAL64",
+		"line 12: mismatched types REAL32 and REAL64 in *",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckProtocolExtends(t *testing.T) {
+	program := parse(t, `PROTOCOL BASE
+  CASE
+    num; INT
+:
+PROTOCOL EXT EXTENDS BASE
+  CASE
+    text; BYTE
+:
+PROTOCOL OTHER
+  CASE
+    num.other; INT
+:
+PROC put(CHAN OF BASE out!)
+  out ! num; 1
+:
+PROC get(CHAN OF BASE in?)
+  SKIP
+:
+PROC get.ext(CHAN OF EXT in?)
+  SKIP
+:
+PROC main()
+  CHAN OF BASE b:
+  CHAN OF EXT e:
+  CHAN OF OTHER o:
+  SEQ
+    put(e!)
+    get.ext(b?)
+    get(e?)
+    put(o!)
+    e ! num; 2
+:
+`)
+	want := []string{
+		"line 29: argument 1 of get is CHAN OF EXT, not CHAN OF BASE?",
+		"line 30: argument 1 of put is CHAN OF OTHER, not CHAN OF BASE!",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckChanType(t *testing.T) {
+	program := parse(t, `CHAN TYPE ADDER
+  MOBILE RECORD
+    CHAN INT req?:
+    CHAN INT resp!:
+:
+PROC server(ADDER? svr)
+  INT n:
+  SEQ
+    svr[req] ? n
+    svr[resp] ! n
+    svr[req] ! 1
+:
+PROC main()
+  ADDER? svr:
+  SHARED ADDER! cli:
+  ADDER! plain:
+  INT x:
+  SEQ
+    svr, cli := MOBILE ADDER
+    CLAIM cli
+      SEQ
+        cli[req] ! 1
+        cli[resp] ? x
+        cli[resp] ! 2
+    cli[req] ! 1
+    CLAIM plain
+      SKIP
+    server(svr)
+    server(cli)
+:
+`)
+	want := []string{
+		"line 11: cannot send on svr[req] at the ADDER? end",
+		"line 24: cannot send on cli[resp] at the ADDER! end",
+		"line 25: cli is SHARED and must be used inside CLAIM cli",
+		"line 26: CLAIM plain: plain is not a SHARED CHAN TYPE end",
+		"line 29: argument 1 of server is ADDER!, not ADDER?",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckSharedChan(t *testing.T) {
+	program := parse(t, `PROC writer(SHARED CHAN OF INT out!)
+  SEQ
+    CLAIM out!
+      out ! 1
+    out ! 2
+:
+PROC main()
+  SHARED CHAN OF INT c:
+  CHAN OF INT plain:
+  INT x:
+  PAR
+    writer(c!)
+    c ? x
+    CLAIM plain
+      plain ! 3
+:
+`)
+	want := []string{
+		"line 5: out is SHARED and must be used inside CLAIM out",
+		"line 14: CLAIM plain: plain is not a SHARED channel",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckIndexBounds(t *testing.T) {
+	program := parse(t, `VAL INT n IS 5:
+PROC p([3]INT fixed, []INT open)
+  [n]INT a:
+  [2][3]INT m:
+  [4]CHAN OF INT cs:
+  VAL []INT lit IS [1, 2, 3]:
+  INT x:
+  SEQ
+    a[n - 1] := 1
+    a[n] := 2
+    x := a[-1]
+    m[1][3] := 0
+    x := m[2][0] + lit[SIZE lit]
+    fixed[3] := open[10]
+    cs[4] ! 1
+    SEQ i = 0 FOR n + 1
+      a[i] := i
+    x := m[1][3] + m[x][4]
+    [a FROM 2 FOR 3] := [a FROM 3 FOR 3]
+    [a FROM 0 FOR 6] := [a FROM x FOR 6]
+    x := [a FROM 6 FOR x][0] + [a FOR 6][0] + [open FROM 2 FOR 3][0]
+    cs[3] ! SIZE [cs FROM 1 FOR 4]
+:
+`)
+	want := []string{
+		"line 10: index 5 is out of range for a, which has 5 elements",
+		"line 11: index -1 is out of range for a, which has 5 elements",
+		"line 12: index 3 is out of range for m[1], which has 3 elements",
+		"line 13: index 2 is out of range for m, which has 2 elements",
+		"line 13: index 3 is out of range for lit, which has 3 elements",
+		"line 14: index 3 is out of range for fixed, which has 3 elements",
+		"line 15: index 4 is out of range for cs, which has 4 elements",
+		"line 18: index 3 is out of range for m[1], which has 3 elements",
+		"line 18: index 4 is out of range for m[x], which has 3 elements",
+		"line 19: segment FROM 3 FOR 3 is out of range for a, which has 5 elements",
+		"line 20: segment FOR 6 is out of range for a, which has 5 elements",
+		"line 20: segment FROM 0 FOR 6 is out of range for a, which has 5 elements",
+		"line 21: segment FROM 6 is out of range for a, which has 5 elements",
+		"line 21: segment FROM 0 FOR 6 is out of range for a, which has 5 elements",
+		"line 22: segment FROM 1 FOR 4 is out of range for cs, which has 4 elements",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckChanAbbreviation(t *testing.T) {
+	program := parse(t, `PROC p(CHAN OF INT in?, CHAN OF INT out!)
+  [4]CHAN OF INT links:
+  [4]CHAN BOOL flags:
+  INT x:
+  SEQ
+    []CHAN OF INT mine IS [links FROM 1 FOR 2]:
+    CHAN OF INT first! IS mine[0]:
+    CHAN OF INT back IS in:
+    []CHAN BOOL wrong IS [links FROM 0 FOR 2]:
+    CHAN OF INT whole IS links:
+    CHAN OF INT other! IS in:
+    CHAN OF INT notchan IS x:
+    SEQ
+      mine[SIZE mine - 1] ! 1
+      mine[2] ! 2
+      first ! 3
+      first ? x
+      back ! 4
+      out ? x
+:
+`)
+	want := []string{
+		"line 9: cannot abbreviate []CHAN OF INT as wrong of type []CHAN OF BOOL",
+		"line 10: cannot abbreviate []CHAN OF INT as whole of type CHAN OF INT",
+		"line 11: cannot abbreviate the ? end of a channel as other!",
+		"line 12: x is a variable, not a channel",
+		"line 15: index 2 is out of range for mine, which has 2 elements",
+		"line 17: cannot receive from first, the ! end of a channel",
+		"line 18: cannot send on back, the ? end of a channel",
+		"line 19: cannot receive from out, the ! end of a channel",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
+
+func TestCheckRetypes(t *testing.T) {
+	program := parse(t, `PROC p(VAL INT k, [2][3]INT grid)
+  INT x:
+  SEQ
+    VAL [4]BYTE b RETYPES x:
+    [4]BYTE w RETYPES x:
+    []INT16 h RETYPES [grid FROM 0 FOR 1]:
+    VAL []INT flat RESHAPES grid:
+    [3][2]INT cols RESHAPES grid:
+    [4]BYTE bad RETYPES x + 1:
+    INT y RETYPES k:
+    [4]REAL32 f RESHAPES grid:
+    VAL [5]INT five RESHAPES grid:
+    SKIP
+:
+`)
+	want := []string{
+		"line 9: only a variable can be retyped as bad",
+		"line 10: cannot retype a VAL as y, which is not VAL",
+		"line 11: cannot reshape [][]INT as f of type []REAL32",
+		"line 12: cannot reshape 6 elements as five of 5",
+	}
+	if errs := Check(program); !reflect.DeepEqual(errs, want) {
+		t.Errorf("expected errors\n%v\ngot\n%v", want, errs)
+	}
+}
@@ -0,0 +1,180 @@
+// Package transpile runs the whole occam to Go pipeline on one program
+// held in memory, for build tools that embed the transpiler rather than
+// run the occam2go command.
+package transpile
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/codeassociates/occam2go/codegen"
+	"github.com/codeassociates/occam2go/lexer"
+	"github.com/codeassociates/occam2go/parser"
+	"github.com/codeassociates/occam2go/preproc"
+	"github.com/codeassociates/occam2go/sema"
+)
+
+// Options configures Transpile. The zero value transpiles a program, with
+// no include paths or defines, as the occam2go command does by default.
+type Options struct {
+	// File names the source in diagnostics; "<input>" if empty. It need
+	// not exist: #INCLUDEs are found only through IncludePaths.
+	File string
+
+	// IncludePaths are searched, in order, for #INCLUDEd files (-I).
+	IncludePaths []string
+
+	// Defines are the preprocessor symbols defined before the source is
+	// read, with their values (-D SYMBOL=value; "" for -D SYMBOL).
+	Defines map[string]string
+
+	// Package, if set, generates an importable Go package of that name
+	// instead of package main (-pkg).
+	Package string
+
+	// Dialect is the language standard the parser enforces (-std).
+	Dialect parser.Dialect
+
+	// UseRuntime calls the Go course library in the runtime package in
+	// place of transpiled occam (-use-runtime).
+	UseRuntime bool
+
+	// Permissive replaces each statement that cannot be parsed by a stub
+	// that panics, with a warning, and makes semantic errors warnings
+	// (-permissive).
+	Permissive bool
+
+	// Codegen holds further code generator options, such as
+	// codegen.WithStrict, applied after those made from the fields above.
+	Codegen []codegen.Option
+}
+
+// Diagnostic is an error or warning found while transpiling. Line and Col
+// are 1-based, and 0 where not known; Severity is "error" or "warning".
+type Diagnostic struct {
+	File     string
+	Line     int
+	Col      int
+	Severity string
+	Message  string
+}
+
+// String formats d as file:line:col: severity: msg, as the occam2go command
+// prints it.
+func (d Diagnostic) String() string {
+	s := d.File
+	if d.Line > 0 {
+		s += ":" + strconv.Itoa(d.Line)
+		if d.Col > 0 {
+			s += ":" + strconv.Itoa(d.Col)
+		}
+	}
+	return s + ": " + d.Severity + ": " + d.Message
+}
+
+var lineErrRe = regexp.MustCompile(`^line (\d+)(?::(\d+))?: (.*)`)
+
+// Transpile preprocesses, parses, checks and generates Go for src. The
+// diagnostics hold every error and warning, positioned in the original
+// files through the preprocessor's source map. If there were errors, no Go
+// is returned and err is the first of them.
+func Transpile(src string, opts Options) (goSrc string, diags []Diagnostic, err error) {
+	file := opts.File
+	if file == "" {
+		file = "<input>"
+	}
+	if opts.Package != "" && (!token.IsIdentifier(opts.Package) || opts.Package == "main") {
+		return "", nil, fmt.Errorf("package %q is not a Go package name other than main", opts.Package)
+	}
+
+	pp := preproc.New(
+		preproc.WithIncludePaths(opts.IncludePaths),
+		preproc.WithDefines(opts.Defines),
+	)
+	expanded, ppErr := pp.ProcessSourceAs(src, file)
+	if ppErr != nil {
+		d := Diagnostic{File: file, Severity: "error", Message: ppErr.Error()}
+		if m := lineErrRe.FindStringSubmatch(d.Message); m != nil {
+			d.Line, _ = strconv.Atoi(m[1])
+			d.Message = m[3]
+		}
+		return "", []Diagnostic{d}, errors.New(d.String())
+	}
+	for _, msg := range pp.Errors() {
+		d := Diagnostic{Severity: "warning", Message: msg}
+		if f, rest, ok := strings.Cut(msg, ": "); ok {
+			d.File, d.Message = f, rest
+			if f, line, ok := strings.Cut(f, ":"); ok {
+				if n, convErr := strconv.Atoi(line); convErr == nil {
+					d.File, d.Line = f, n
+				}
+			}
+		}
+		diags = append(diags, d)
+	}
+
+	sourceMap := pp.SourceMap()
+	add := func(severity string, msgs []string) {
+		for _, msg := range msgs {
+			d := Diagnostic{File: file, Severity: severity, Message: msg}
+			if m := lineErrRe.FindStringSubmatch(msg); m != nil {
+				d.Message = m[3]
+				if n, _ := strconv.Atoi(m[1]); n >= 1 && n <= len(sourceMap) {
+					d.File, d.Line = sourceMap[n-1].File, sourceMap[n-1].Line
+					d.Col, _ = strconv.Atoi(m[2])
+				}
+			}
+			diags = append(diags, d)
+		}
+	}
+	failed := func() error {
+		for _, d := range diags {
+			if d.Severity == "error" {
+				return errors.New(d.String())
+			}
+		}
+		return nil
+	}
+
+	p := parser.New(lexer.New(expanded), parser.WithDialect(opts.Dialect), parser.WithPermissive(opts.Permissive))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		add("error", errs)
+		return "", diags, failed()
+	}
+	add("warning", p.Unsupported())
+	libraryDecls := codegen.CycleDecls(opts.Codegen...)
+	if opts.UseRuntime {
+		libraryDecls = append(libraryDecls, codegen.RuntimeDecls()...)
+	}
+	if errs := sema.Check(program, libraryDecls...); len(errs) > 0 {
+		if !opts.Permissive {
+			add("error", errs)
+			return "", diags, failed()
+		}
+		add("warning", errs)
+	}
+
+	genOpts := append([]codegen.Option{
+		codegen.WithPackage(opts.Package),
+		codegen.WithRuntime(opts.UseRuntime),
+		codegen.WithSourcePos(func(n int) string {
+			if n < 1 || n > len(sourceMap) {
+				return fmt.Sprintf("line %d", n)
+			}
+			return fmt.Sprintf("%s:%d", sourceMap[n-1].File, sourceMap[n-1].Line)
+		}),
+	}, opts.Codegen...)
+	gen := codegen.New(genOpts...)
+	goSrc = gen.Generate(program)
+	add("warning", gen.Warnings())
+	add("error", gen.Errors())
+	if err := failed(); err != nil {
+		return "", diags, err
+	}
+	return goSrc, diags, nil
+}
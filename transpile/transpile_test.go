@@ -0,0 +1,142 @@
+package transpile
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/codeassociates/occam2go/codegen"
+)
+
+func TestTranspile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "consts.inc"), []byte("VAL INT answer IS 42:\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := `#INCLUDE "consts.inc"
+PROC main(CHAN OF BYTE keyboard?, screen!, error!)
+  INT x:
+  SEQ
+    #IF DEFINED (DOUBLE)
+    x := answer * 2
+    #ELSE
+    x := answer
+    #ENDIF
+    tick
+:
+PROC tick()
+  SKIP
+:
+`
+	out, diags, err := Transpile(src, Options{
+		File:         "main.occ",
+		IncludePaths: []string{dir},
+		Defines:      map[string]string{"DOUBLE": ""},
+		Codegen:      []codegen.Option{codegen.WithStrict(true)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"package main", "func main()", "x = (answer * 2)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, out)
+		}
+	}
+	wantDiags := []Diagnostic{{File: "main.occ", Line: 10, Severity: "warning", Message: "call of PROC tick without parentheses"}}
+	if !reflect.DeepEqual(diags, wantDiags) {
+		t.Errorf("expected diagnostics %+v, got %+v", wantDiags, diags)
+	}
+}
+
+func TestTranspilePackage(t *testing.T) {
+	src := `PROC double(VAL INT x, INT y)
+  y := x * 2
+:
+`
+	out, _, err := Transpile(src, Options{Package: "occlib"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out, "package occlib") || !strings.Contains(out, "func Double(") {
+		t.Errorf("expected package occlib with func Double, got:\n%s", out)
+	}
+
+	if _, _, err := Transpile(src, Options{Package: "main"}); err == nil {
+		t.Errorf("expected an error for package main")
+	}
+}
+
+func TestTranspileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want Diagnostic
+	}{
+		{
+			"parse",
+			"SEQ\n  INT x:\n  x := )\n",
+			Diagnostic{File: "<input>", Line: 3, Severity: "error"},
+		},
+		{
+			"sema",
+			"SEQ\n  INT x:\n  x := y\n",
+			Diagnostic{File: "<input>", Line: 3, Severity: "error", Message: "y is not declared"},
+		},
+		{
+			"building block",
+			"SEQ\n  CHAN OF INT c:\n  id(c?)\n",
+			Diagnostic{File: "<input>", Line: 3, Severity: "error", Message: "PROC id takes 2 arguments, not 1"},
+		},
+		{
+			"include",
+			"#INCLUDE \"missing.inc\"\nSKIP\n",
+			Diagnostic{File: "<input>", Line: 1, Severity: "error", Message: `cannot find included file "missing.inc"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, diags, err := Transpile(tt.src, Options{})
+			if err == nil || out != "" {
+				t.Fatalf("expected an error and no output, got %v and %q", err, out)
+			}
+			if len(diags) == 0 {
+				t.Fatalf("expected diagnostics")
+			}
+			got := diags[0]
+			if tt.want.Message == "" {
+				got.Message, got.Col = "", 0
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+			if err.Error() != diags[0].String() {
+				t.Errorf("expected error %q, got %q", diags[0].String(), err.Error())
+			}
+		})
+	}
+}
+
+func TestTranspilePermissive(t *testing.T) {
+	src := `PROC main(CHAN OF BYTE keyboard?, screen!, error!)
+  INT x:
+  SEQ
+    x := 1
+    x := x @@ 2
+:
+`
+	if _, _, err := Transpile(src, Options{File: "main.occ"}); err == nil {
+		t.Fatal("expected an error without Permissive")
+	}
+	out, diags, err := Transpile(src, Options{File: "main.occ", Permissive: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out, `panic("occam2go: unsupported: x := x @@ 2 at main.occ:5")`) {
+		t.Errorf("expected a stub naming main.occ:5, got:\n%s", out)
+	}
+	if len(diags) != 1 || diags[0].Severity != "warning" || diags[0].Line != 5 {
+		t.Errorf("expected a warning on line 5, got %+v", diags)
+	}
+}
@@ -0,0 +1,670 @@
+// Package uninit finds reads of occam variables that may happen before the
+// variable has been assigned. occam variables are undefined until assigned,
+// but Go zero-initializes them, so a program that reads one too early can
+// work when transpiled and fail elsewhere (or the other way round).
+//
+// The analysis follows the paths through SEQ, IF, CASE, ALT, WHILE, PAR and
+// variant receives of each PROC, FUNCTION and the main program. It tracks
+// scalar variables only: arrays and records are often filled element by
+// element in loops whose trip count is unknown, which it cannot follow. It
+// errs towards silence: a variable passed to a reference parameter, aliased
+// by an abbreviation or RETYPES, or assigned by a nested PROC that is called,
+// counts as assigned from then on.
+package uninit
+
+import (
+	"fmt"
+
+	"github.com/codeassociates/occam2go/ast"
+)
+
+// Check returns a warning, in "line N: msg" form, for the first read of each
+// variable that may not have been assigned by then on some path through the
+// program. The predeclared statements, such as the PROCs of a library, are
+// in scope for the program.
+func Check(program *ast.Program, predeclared ...ast.Statement) []string {
+	a := &analyzer{scope: &scope{names: map[string]*variable{}}, records: map[string]bool{}}
+	for _, stmt := range program.Statements {
+		if r, ok := stmt.(*ast.RecordDecl); ok {
+			a.records[r.Name] = true
+		}
+	}
+	for _, stmt := range predeclared {
+		a.declare(stmt)
+	}
+	// Top-level PROCs and FUNCTIONs are package-level Go functions, in
+	// scope throughout, as in sema
+	for _, stmt := range program.Statements {
+		if isRoutine(stmt) {
+			a.declare(stmt)
+		}
+	}
+	a.statements(program.Statements, state{})
+	return a.warnings
+}
+
+// scalarTypes are the types of the variables tracked.
+var scalarTypes = map[string]bool{
+	"INT": true, "INT16": true, "INT32": true, "INT64": true, "BYTE": true,
+	"BOOL": true, "REAL": true, "REAL32": true, "REAL64": true,
+}
+
+// variable is a declared name: a variable, parameter, abbreviation or
+// replicator, or a PROC or FUNCTION.
+type variable struct {
+	name    string
+	typ     string
+	dims    int
+	tracked bool // a scalar variable declared in the routine being analysed
+	frame   int  // the routine declaring it
+	warned  bool
+	routine ast.Statement // the *ast.ProcDecl or *ast.FuncDecl of a routine
+	nested  bool          // a routine declared inside another, which may assign its variables
+}
+
+type scope struct {
+	names map[string]*variable
+	outer *scope
+}
+
+func (s *scope) lookup(name string) *variable {
+	for ; s != nil; s = s.outer {
+		if v, ok := s.names[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// state is the set of tracked variables assigned on every path to a point
+// in the program, or nil where the program cannot get to (after STOP).
+type state map[*variable]bool
+
+var unreachable state
+
+func (s state) copy() state {
+	if s == nil {
+		return nil
+	}
+	c := make(state, len(s))
+	for v := range s {
+		c[v] = true
+	}
+	return c
+}
+
+// join returns the state after one of several paths, whose end states are
+// given, has been taken: the variables assigned on all of them.
+func join(states []state) state {
+	var joined state
+	for _, s := range states {
+		if s == nil {
+			continue
+		}
+		if joined == nil {
+			joined = s.copy()
+			continue
+		}
+		for v := range joined {
+			if !s[v] {
+				delete(joined, v)
+			}
+		}
+	}
+	return joined
+}
+
+type analyzer struct {
+	scope    *scope
+	records  map[string]bool // RECORD type names, whose subscripts are field names
+	frame    int             // the routine being analysed; 0 for the main program
+	frames   int
+	quiet    int // inside code that cannot run, whose reads are not reported
+	warnings []string
+}
+
+func (a *analyzer) push() { a.scope = &scope{names: map[string]*variable{}, outer: a.scope} }
+func (a *analyzer) pop()  { a.scope = a.scope.outer }
+
+func (a *analyzer) define(name, typ string, dims int, tracked bool) *variable {
+	v := &variable{name: name, typ: typ, dims: dims, tracked: tracked, frame: a.frame}
+	a.scope.names[name] = v
+	return v
+}
+
+func isRoutine(stmt ast.Statement) bool {
+	switch stmt.(type) {
+	case *ast.ProcDecl, *ast.FuncDecl:
+		return true
+	}
+	return false
+}
+
+// declare brings the routine declared by stmt into scope.
+func (a *analyzer) declare(stmt ast.Statement) {
+	switch s := stmt.(type) {
+	case *ast.ProcDecl:
+		v := a.define(s.Name, "", 0, false)
+		v.routine, v.nested = s, a.scope.outer != nil
+	case *ast.FuncDecl:
+		v := a.define(s.Name, "", 0, false)
+		v.routine, v.nested = s, a.scope.outer != nil
+	}
+}
+
+// block analyses stmts in a scope of their own.
+func (a *analyzer) block(stmts []ast.Statement, in state) state {
+	a.push()
+	defer a.pop()
+	return a.statements(stmts, in)
+}
+
+// statements analyses stmts in the current scope, each declaration in
+// scope for the statements after it, and returns the state after them.
+func (a *analyzer) statements(stmts []ast.Statement, in state) state {
+	s := in
+	for i, stmt := range stmts {
+		// A run of PROC and FUNCTION declarations may call each other
+		if isRoutine(stmt) && (i == 0 || !isRoutine(stmts[i-1])) {
+			for _, later := range stmts[i:] {
+				if !isRoutine(later) {
+					break
+				}
+				a.declare(later)
+			}
+		}
+		s = a.statement(stmt, s)
+	}
+	return s
+}
+
+func (a *analyzer) statement(stmt ast.Statement, s state) state {
+	if s == nil {
+		// Nothing after a STOP runs, but its declarations still come into
+		// scope and its routines are still checked
+		a.quiet++
+		a.statement(stmt, state{})
+		a.quiet--
+		return unreachable
+	}
+	switch st := stmt.(type) {
+	case *ast.VarDecl:
+		for _, n := range st.Names {
+			a.define(n, st.Type, 0, scalarTypes[st.Type] && !st.Mobile && st.End == "")
+		}
+	case *ast.ArrayDecl:
+		for _, size := range st.Sizes {
+			a.read(size, s)
+		}
+		for _, n := range st.Names {
+			a.define(n, st.Type, len(st.Sizes), false)
+		}
+	case *ast.ChanDecl:
+		for _, size := range st.Sizes {
+			a.read(size, s)
+		}
+		for _, n := range st.Names {
+			a.define(n, st.ElemType, len(st.Sizes), false)
+		}
+	case *ast.TimerDecl:
+		for _, n := range st.Names {
+			a.define(n, "TIMER", 0, false)
+		}
+	case *ast.BarrierDecl:
+		for _, n := range st.Names {
+			a.define(n, "BARRIER", 0, false)
+		}
+	case *ast.Abbreviation:
+		if st.IsVal || st.IsInitial || st.IsChan {
+			a.read(st.Value, s)
+		} else {
+			// An alias: assignments through it cannot be followed
+			a.alias(st.Value, s)
+		}
+		a.define(st.Name, st.Type, st.OpenArrayDims, false)
+	case *ast.RetypesDecl:
+		for _, size := range st.Sizes {
+			a.read(size, s)
+		}
+		if st.IsVal {
+			a.read(st.Source, s)
+		} else {
+			a.alias(st.Source, s)
+		}
+		a.define(st.Name, st.TargetType, len(st.Sizes), false)
+	case *ast.PlaceDecl:
+		a.assign(st.Name, s)
+		a.read(st.Address, s)
+	case *ast.ProcDecl:
+		a.routine(st.Params, st.Body, nil)
+	case *ast.FuncDecl:
+		a.routine(st.Params, st.Body, st.ResultExprs)
+	case *ast.Assignment:
+		a.read(st.Value, s)
+		a.indices(st.Name, st.Indices, s)
+		if st.SliceTarget != nil {
+			a.read(st.SliceTarget.Start, s)
+			a.read(st.SliceTarget.Length, s)
+		} else if len(st.Indices) == 0 {
+			a.assign(st.Name, s)
+		}
+	case *ast.MultiAssignment:
+		for _, v := range st.Values {
+			a.read(v, s)
+		}
+		for _, t := range st.Targets {
+			a.indices(t.Name, t.Indices, s)
+			if len(t.Indices) == 0 {
+				a.assign(t.Name, s)
+			}
+		}
+	case *ast.SeqBlock:
+		if st.Replicator != nil {
+			return a.replicated(st.Replicator, st.Statements, s)
+		}
+		return a.block(st.Statements, s)
+	case *ast.ParBlock:
+		for _, p := range st.Processors {
+			a.read(p.Number, s)
+		}
+		if st.Replicator != nil {
+			return a.replicated(st.Replicator, st.Statements, s)
+		}
+		// Every branch starts from the state before the PAR, and the PAR
+		// ends when all have, having made all of their assignments
+		out := s.copy()
+		for _, branch := range st.Branches() {
+			end := a.block(branch, s.copy())
+			if end == nil {
+				return unreachable
+			}
+			for v := range end {
+				out[v] = true
+			}
+		}
+		return out
+	case *ast.IfStatement:
+		return join(a.ifOutcomes(st, s))
+	case *ast.CaseStatement:
+		a.read(st.Selector, s)
+		var outs []state
+		for _, c := range st.Choices {
+			for _, v := range c.Values {
+				a.read(v, s)
+			}
+			outs = append(outs, a.block(c.Body, s.copy()))
+		}
+		return join(outs)
+	case *ast.WhileLoop:
+		a.read(st.Condition, s)
+		a.block(st.Body, s.copy())
+		if b, ok := st.Condition.(*ast.BooleanLiteral); ok && b.Value {
+			return unreachable
+		}
+	case *ast.AltBlock:
+		a.push()
+		defer a.pop()
+		if st.Replicator != nil {
+			a.replicator(st.Replicator, s)
+		}
+		for _, c := range st.Cases {
+			a.read(c.Guard, s)
+		}
+		var outs []state
+		for _, c := range st.Cases {
+			outs = append(outs, a.altCase(c, s.copy()))
+		}
+		if st.Replicator != nil {
+			outs = append(outs, s)
+		}
+		return join(outs)
+	case *ast.Send:
+		for _, idx := range st.ChannelIndices {
+			a.read(idx, s)
+		}
+		a.read(st.Value, s)
+		for _, v := range st.Values {
+			a.read(v, s)
+		}
+	case *ast.Receive:
+		for _, idx := range st.ChannelIndices {
+			a.read(idx, s)
+		}
+		a.indices(st.Variable, st.VariableIndices, s)
+		if len(st.VariableIndices) == 0 {
+			a.assign(st.Variable, s)
+		}
+		for _, n := range st.Variables {
+			a.assign(n, s)
+		}
+	case *ast.VariantReceive:
+		for _, idx := range st.ChannelIndices {
+			a.read(idx, s)
+		}
+		var outs []state
+		for _, c := range st.Cases {
+			a.push()
+			in := a.statements(c.Declarations, s.copy())
+			for _, n := range c.Variables {
+				a.assign(n, in)
+			}
+			outs = append(outs, a.block(c.Body, in))
+			a.pop()
+		}
+		return join(outs)
+	case *ast.TimerRead:
+		a.assign(st.Variable, s)
+	case *ast.TimerAfterWait:
+		a.read(st.Deadline, s)
+	case *ast.ProcCall:
+		a.call(st, s)
+	case *ast.ForkStmt:
+		a.call(st.Call, s)
+	case *ast.ClaimBlock:
+		return a.block(st.Body, s)
+	case *ast.ForkingBlock:
+		return a.block(st.Body, s)
+	case *ast.Stop, *ast.Unsupported:
+		return unreachable
+	}
+	return s
+}
+
+// routine analyses the body of a PROC or FUNCTION on its own: the variables
+// of the routines around it may have been assigned by the time it is
+// called, so only its own are tracked.
+func (a *analyzer) routine(params []ast.ProcParam, body []ast.Statement, results []ast.Expression) {
+	outer := a.frame
+	a.frames++
+	a.frame = a.frames
+	defer func() { a.frame = outer }()
+	a.push()
+	defer a.pop()
+	for _, p := range params {
+		dims := p.OpenArrayDims
+		if p.ArraySize != "" {
+			dims++
+		}
+		a.define(p.Name, p.Type, dims, false)
+	}
+	s := a.statements(body, state{})
+	for _, r := range results {
+		a.read(r, s)
+	}
+}
+
+// ifOutcomes returns the states at the ends of the choices of an IF, whose
+// conditions are evaluated in turn in state s.
+func (a *analyzer) ifOutcomes(st *ast.IfStatement, s state) []state {
+	a.push()
+	defer a.pop()
+	if st.Replicator != nil {
+		a.replicator(st.Replicator, s)
+	}
+	var outs []state
+	for _, c := range st.Choices {
+		if c.NestedIf != nil {
+			outs = append(outs, a.ifOutcomes(c.NestedIf, s)...)
+			continue
+		}
+		a.read(c.Condition, s)
+		outs = append(outs, a.block(c.Body, s.copy()))
+	}
+	return outs
+}
+
+// altCase analyses an ALT alternative taken in state s.
+func (a *analyzer) altCase(c ast.AltCase, s state) state {
+	a.push()
+	defer a.pop()
+	s = a.statements(c.Declarations, s)
+	for _, idx := range c.ChannelIndices {
+		a.read(idx, s)
+	}
+	a.read(c.Deadline, s)
+	if c.Variable != "" {
+		a.indices(c.Variable, c.VariableIndices, s)
+		if len(c.VariableIndices) == 0 {
+			a.assign(c.Variable, s)
+		}
+		for _, n := range c.Variables {
+			a.assign(n, s)
+		}
+	}
+	return a.statements(c.Body, s)
+}
+
+// replicated analyses the body of a replicated SEQ or PAR, which runs at
+// least once only when its count is a positive constant.
+func (a *analyzer) replicated(r *ast.Replicator, body []ast.Statement, s state) state {
+	a.push()
+	defer a.pop()
+	a.replicator(r, s)
+	end := a.statements(body, s.copy())
+	if n, ok := r.Count.(*ast.IntegerLiteral); ok && n.Value > 0 {
+		return end
+	}
+	return s
+}
+
+func (a *analyzer) replicator(r *ast.Replicator, s state) {
+	a.read(r.Start, s)
+	a.read(r.Count, s)
+	a.read(r.Step, s)
+	a.define(r.Variable, "INT", 0, false)
+}
+
+// call analyses a PROC call: arguments for VAL parameters are read, and
+// those for reference parameters may be assigned by the PROC. A nested
+// PROC may also assign the variables around it that it names.
+func (a *analyzer) call(c *ast.ProcCall, s state) {
+	v := a.scope.lookup(c.Name)
+	var params []ast.ProcParam
+	if v != nil {
+		if p, ok := v.routine.(*ast.ProcDecl); ok {
+			params = p.Params
+			if v.nested {
+				for _, n := range assignedNames(p.Body) {
+					a.assign(n, s)
+				}
+			}
+		}
+	}
+	for i, arg := range c.Args {
+		if (i < len(params) && params[i].IsVal) || (params == nil && isPrint(c.Name)) {
+			a.read(arg, s)
+		} else {
+			a.alias(arg, s)
+		}
+	}
+}
+
+func isPrint(name string) bool {
+	switch name {
+	case "print.int", "print.string", "print.bool", "print.newline":
+		return true
+	}
+	return false
+}
+
+// alias analyses e used as a variable that may be read and assigned through
+// another name: a reference argument or the value of an abbreviation. Its
+// subscripts are read and the variable counts as assigned.
+func (a *analyzer) alias(e ast.Expression, s state) {
+	switch x := e.(type) {
+	case *ast.Identifier:
+		a.assign(x.Value, s)
+	case *ast.IndexExpr:
+		a.alias(x.Left, s)
+		if !a.isField(x) {
+			a.read(x.Index, s)
+		}
+	case *ast.SliceExpr:
+		a.alias(x.Array, s)
+		a.read(x.Start, s)
+		a.read(x.Length, s)
+	default:
+		a.read(e, s)
+	}
+}
+
+// assign records that the variable name has been assigned.
+func (a *analyzer) assign(name string, s state) {
+	if v := a.scope.lookup(name); v != nil && v.tracked {
+		s[v] = true
+	}
+}
+
+// indices reads the subscripts of an assignment or input target, except
+// those naming fields of a record.
+func (a *analyzer) indices(name string, indices []ast.Expression, s state) {
+	v := a.scope.lookup(name)
+	for i, idx := range indices {
+		if v != nil && a.records[v.typ] && i >= v.dims {
+			continue
+		}
+		a.read(idx, s)
+	}
+}
+
+// isField reports whether the subscript of x names a field of a record.
+func (a *analyzer) isField(x *ast.IndexExpr) bool {
+	depth := 0
+	e := x.Left
+	for {
+		inner, ok := e.(*ast.IndexExpr)
+		if !ok {
+			break
+		}
+		depth++
+		e = inner.Left
+	}
+	id, ok := e.(*ast.Identifier)
+	if !ok {
+		return false
+	}
+	v := a.scope.lookup(id.Value)
+	return v != nil && a.records[v.typ] && depth >= v.dims
+}
+
+// read checks the variables e reads in state s, reporting the first read of
+// each that may not have been assigned.
+func (a *analyzer) read(e ast.Expression, s state) {
+	switch x := e.(type) {
+	case nil:
+	case *ast.Identifier:
+		v := a.scope.lookup(x.Value)
+		if v != nil && v.tracked && v.frame == a.frame && !s[v] && !v.warned && a.quiet == 0 {
+			v.warned = true
+			a.warnings = append(a.warnings, fmt.Sprintf("line %d: %s may be read before it is assigned", x.Token.Line, x.Value))
+		}
+	case *ast.BinaryExpr:
+		a.read(x.Left, s)
+		a.read(x.Right, s)
+	case *ast.UnaryExpr:
+		a.read(x.Right, s)
+	case *ast.TypeConversion:
+		a.read(x.Expr, s)
+	case *ast.ParenExpr:
+		a.read(x.Expr, s)
+	case *ast.SizeExpr:
+		a.read(x.Expr, s)
+	case *ast.IndexExpr:
+		a.read(x.Left, s)
+		if !a.isField(x) {
+			a.read(x.Index, s)
+		}
+	case *ast.SliceExpr:
+		a.read(x.Array, s)
+		a.read(x.Start, s)
+		a.read(x.Length, s)
+	case *ast.FuncCall:
+		for _, arg := range x.Args {
+			a.read(arg, s)
+		}
+	case *ast.ArrayLiteral:
+		for _, el := range x.Elements {
+			a.read(el, s)
+		}
+	case *ast.ArrayConstructor:
+		a.push()
+		a.replicator(x.Replicator, s)
+		a.read(x.Value, s)
+		a.pop()
+	case *ast.CountedArrayExpr:
+		a.read(x.Count, s)
+		a.read(x.Array, s)
+	case *ast.MobileExpr:
+		a.read(x.Size, s)
+	case *ast.ValofExpr:
+		// The body can assign only its own variables
+		a.push()
+		a.read(x.Result, a.statements(x.Body, s.copy()))
+		a.pop()
+	}
+}
+
+// assignedNames returns the names that stmts assign, at any depth.
+func assignedNames(stmts []ast.Statement) []string {
+	var names []string
+	var walk func(stmts []ast.Statement)
+	walk = func(stmts []ast.Statement) {
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *ast.Assignment:
+				names = append(names, s.Name)
+			case *ast.MultiAssignment:
+				for _, t := range s.Targets {
+					names = append(names, t.Name)
+				}
+			case *ast.Receive:
+				names = append(names, s.Variable)
+				names = append(names, s.Variables...)
+			case *ast.TimerRead:
+				names = append(names, s.Variable)
+			case *ast.ProcCall:
+				for _, arg := range s.Args {
+					if id, ok := arg.(*ast.Identifier); ok {
+						names = append(names, id.Value)
+					}
+				}
+			case *ast.SeqBlock:
+				walk(s.Statements)
+			case *ast.ParBlock:
+				walk(s.Statements)
+			case *ast.WhileLoop:
+				walk(s.Body)
+			case *ast.ClaimBlock:
+				walk(s.Body)
+			case *ast.ForkingBlock:
+				walk(s.Body)
+			case *ast.ProcDecl:
+				walk(s.Body)
+			case *ast.IfStatement:
+				for _, c := range s.Choices {
+					if c.NestedIf != nil {
+						walk([]ast.Statement{c.NestedIf})
+					}
+					walk(c.Body)
+				}
+			case *ast.CaseStatement:
+				for _, c := range s.Choices {
+					walk(c.Body)
+				}
+			case *ast.AltBlock:
+				for _, c := range s.Cases {
+					names = append(names, c.Variable)
+					names = append(names, c.Variables...)
+					walk(c.Body)
+				}
+			case *ast.VariantReceive:
+				for _, c := range s.Cases {
+					names = append(names, c.Variables...)
+					walk(c.Body)
+				}
+			}
+		}
+	}
+	walk(stmts)
+	return names
+}
@@ -0,0 +1,116 @@
+package uninit
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/codeassociates/occam2go/ast"
+	"github.com/codeassociates/occam2go/lexer"
+	"github.com/codeassociates/occam2go/parser"
+)
+
+func parse(t *testing.T, src string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		t.FailNow()
+	}
+	return program
+}
+
+func TestCheck(t *testing.T) {
+	input := `RECORD POINT
+  INT x:
+PROC set(BOOL b)
+  b := TRUE
+:
+PROC p(VAL INT k, INT out, CHAN OF INT c?)
+  INT a, b, d, e, f, g, x:
+  BOOL ok:
+  POINT pt:
+  [4]INT arr:
+  SEQ
+    a := 1
+    out := a + b
+    out := b
+    IF
+      k > 0
+        d := 1
+      TRUE
+        SKIP
+    out := d
+    IF
+      k > 0
+        e := 1
+      TRUE
+        STOP
+    out := e
+    c ? f
+    out := f
+    WHILE k > 0
+      g := 1
+    out := g
+    arr[0] := arr[1]
+    pt[x] := 2
+    set(ok)
+    out := INT ok
+:
+PROC q(CHAN OF INT c?, d?)
+  INT a, b, n, m, r:
+  PROC fill()
+    r := 3
+  :
+  SEQ
+    PAR
+      c ? a
+      d ? b
+    n := a + b
+    ALT
+      c ? m
+        SKIP
+      d ? m
+        SKIP
+    n := m
+    CASE n
+      1
+        m := 2
+      ELSE
+        SKIP
+    fill()
+    n := r
+    SEQ i = 0 FOR 2
+      m := i
+    n := m
+:
+PROC r(VAL INT k)
+  INT a, b:
+  SEQ
+    SEQ i = 0 FOR k
+      a := i
+    b := a
+:
+INT FUNCTION f(VAL INT k)
+  INT r:
+  VALOF
+    IF
+      k > 0
+        r := k
+      k < 0
+        r := -k
+    RESULT r
+:
+`
+	want := []string{
+		"line 13: b may be read before it is assigned",
+		"line 20: d may be read before it is assigned",
+		"line 31: g may be read before it is assigned",
+		"line 69: a may be read before it is assigned",
+	}
+	if got := Check(parse(t, input)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected warnings\n%v\ngot\n%v", want, got)
+	}
+}